@@ -0,0 +1,501 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"chha/internal/config"
+	"chha/internal/hdr"
+)
+
+// A distributed run spreads one benchmark over several machines, since a
+// single one runs out of ports and CPU well before 100k connections. One
+// client coordinates: agents, clients run with -agent on the other
+// machines, register with it over HTTP and wait. Once all have, it gives
+// each its share of the clients and of the shape's rate and one start
+// time. Agents run their share as a normal benchmark, at the same moment,
+// and post back their results with their latency histograms, which the
+// coordinator merges so the percentiles are those of every attempt.
+//
+// The coordinator has no authentication: run it on a private network.
+
+// Coordinator endpoints
+const (
+	clockPath    = "/clock"
+	registerPath = "/register"
+	resultPath   = "/result"
+)
+
+// clockSamples is how many round trips an agent times to estimate its
+// clock offset from the coordinator; the quickest is used
+const clockSamples = 5
+
+type clockResponse struct {
+	// Now is the coordinator's clock, in Unix nanoseconds
+	Now int64 `json:"now"`
+}
+
+type registerRequest struct {
+	Agent string `json:"agent"`
+}
+
+// agentRun is the share of a distributed run one agent makes
+type agentRun struct {
+	Index      int           `json:"index"`
+	Agents     int           `json:"agents"`
+	ServerAddr string        `json:"server_addr"`
+	ProductID  string        `json:"product_id"`
+	Encoding   string        `json:"encoding"`
+	FrameCRC   bool          `json:"frame_crc32"`
+	Timestamps bool          `json:"frame_timestamps"`
+	Clients    int           `json:"clients"`
+	Attempts   int           `json:"attempts"`
+	Duration   time.Duration `json:"duration"`
+	Reuse      bool          `json:"reuse_connections"`
+	Shape      string        `json:"shape,omitempty"`
+	UserPrefix string        `json:"user_prefix"`
+	// Stock is what the whole run is checked against, -1 if unknown
+	Stock int64 `json:"stock"`
+	// StartAt is when every agent starts, in Unix nanoseconds on the
+	// coordinator's clock
+	StartAt int64 `json:"start_at"`
+}
+
+// agentResult is what an agent posts back once its share has run
+type agentResult struct {
+	Agent  string           `json:"agent"`
+	Result *BenchmarkResult `json:"result"`
+	// Buckets is the latency histogram as [microseconds, count] pairs
+	Buckets [][2]int64 `json:"buckets"`
+	// ClockOffset is how far the coordinator's clock was estimated ahead
+	// of the agent's, and ClockRTT the round trip it was estimated over
+	ClockOffset time.Duration `json:"clock_offset"`
+	ClockRTT    time.Duration `json:"clock_rtt"`
+}
+
+// coordinator hands out the shares of a distributed run and collects
+// their results
+type coordinator struct {
+	runs       []agentRun
+	startDelay time.Duration
+
+	mu sync.Mutex
+	// registered are the agents waiting for the start, in arrival order
+	registered []string
+	// ready is closed once every agent registered, then startAt is set
+	ready   chan struct{}
+	startAt time.Time
+	results map[string]agentResult
+	// done is closed once every agent posted its result
+	done chan struct{}
+}
+
+func (c *coordinator) handleClock(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, clockResponse{Now: time.Now().UnixNano()})
+}
+
+// handleRegister holds an agent's request until every agent registered,
+// then answers with its share and the start time. An agent that hangs up
+// first gives its place back.
+func (c *coordinator) handleRegister(w http.ResponseWriter, r *http.Request) {
+	var req registerRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Agent == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "agent name required"})
+		return
+	}
+
+	c.mu.Lock()
+	select {
+	case <-c.ready:
+		c.mu.Unlock()
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "the run already has every agent"})
+		return
+	default:
+	}
+	for _, name := range c.registered {
+		if name == req.Agent {
+			c.mu.Unlock()
+			writeJSON(w, http.StatusConflict, map[string]string{"error": "agent " + req.Agent + " is already registered"})
+			return
+		}
+	}
+	c.registered = append(c.registered, req.Agent)
+	fmt.Printf("Agent %s registered (%d of %d)\n", req.Agent, len(c.registered), len(c.runs))
+	if len(c.registered) == len(c.runs) {
+		c.startAt = time.Now().Add(c.startDelay)
+		close(c.ready)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-c.ready:
+	case <-r.Context().Done():
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		select {
+		case <-c.ready:
+			// Too late to leave: its share was planned, and its result
+			// will never come
+			log.Printf("Agent %s hung up before getting its share; interrupt the run, it cannot finish", req.Agent)
+		default:
+			for i, name := range c.registered {
+				if name == req.Agent {
+					c.registered = append(c.registered[:i], c.registered[i+1:]...)
+					break
+				}
+			}
+			fmt.Printf("Agent %s left (%d of %d)\n", req.Agent, len(c.registered), len(c.runs))
+		}
+		return
+	}
+
+	c.mu.Lock()
+	var run agentRun
+	for i, name := range c.registered {
+		if name == req.Agent {
+			run = c.runs[i]
+		}
+	}
+	run.StartAt = c.startAt.UnixNano()
+	c.mu.Unlock()
+	writeJSON(w, http.StatusOK, run)
+}
+
+func (c *coordinator) handleResult(w http.ResponseWriter, r *http.Request) {
+	var res agentResult
+	if err := json.NewDecoder(r.Body).Decode(&res); err != nil || res.Result == nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid result"})
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !slices.Contains(c.registered, res.Agent) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "agent " + res.Agent + " is not part of the run"})
+		return
+	}
+	if _, ok := c.results[res.Agent]; ok {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "result already posted"})
+		return
+	}
+	c.results[res.Agent] = res
+	fmt.Printf("Agent %s finished: %d requests, %d successful (%d of %d)\n",
+		res.Agent, res.Result.Requests, res.Result.Successful, len(c.results), len(c.runs))
+	if len(c.results) == len(c.runs) {
+		close(c.done)
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// Coordinate runs a distributed benchmark over agents, generating no load
+// itself, and prints and returns the merged results. The clients and the
+// shape's rate are split evenly; attempts and duration are every agent's.
+func Coordinate(cfg config.Client, opts ClientOptions, bench BenchmarkOptions) (*BenchmarkResult, error) {
+	c := &coordinator{
+		runs:       make([]agentRun, cfg.Agents),
+		startDelay: cfg.StartDelay,
+		ready:      make(chan struct{}),
+		results:    make(map[string]agentResult),
+		done:       make(chan struct{}),
+	}
+	var shape string
+	if bench.Shape != nil {
+		shape = bench.Shape.scaled(1 / float64(cfg.Agents)).String()
+	}
+	for i := range c.runs {
+		clients := bench.Clients / cfg.Agents
+		if i < bench.Clients%cfg.Agents {
+			clients++
+		}
+		c.runs[i] = agentRun{
+			Index:      i,
+			Agents:     cfg.Agents,
+			ServerAddr: cfg.ServerAddr,
+			ProductID:  cfg.ProductID,
+			Encoding:   opts.Encoding,
+			FrameCRC:   opts.FrameCRC,
+			Timestamps: opts.Timestamps,
+			Clients:    clients,
+			Attempts:   bench.Attempts,
+			Duration:   bench.Duration,
+			Reuse:      bench.Reuse,
+			Shape:      shape,
+			UserPrefix: fmt.Sprintf("agent%d_user", i),
+			Stock:      bench.Stock,
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+clockPath, c.handleClock)
+	mux.HandleFunc("POST "+registerPath, c.handleRegister)
+	mux.HandleFunc("POST "+resultPath, c.handleResult)
+	ln, err := net.Listen("tcp", cfg.CoordinateAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen: %w", err)
+	}
+	srv := &http.Server{Handler: mux}
+	go srv.Serve(ln)
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+	}()
+
+	fmt.Printf("Waiting for %d agents on %s\n", cfg.Agents, ln.Addr())
+	<-c.ready
+	fmt.Printf("Starting at %s\n", c.startAt.Format("15:04:05.000"))
+	<-c.done
+
+	c.mu.Lock()
+	parts := make([]agentResult, len(c.registered))
+	for i, name := range c.registered {
+		parts[i] = c.results[name]
+	}
+	c.mu.Unlock()
+	return mergeResults(cfg, opts, bench, c.startAt, parts), nil
+}
+
+// mergeResults adds up the agents' results and prints them, one row per
+// agent, then the totals
+func mergeResults(cfg config.Client, opts ClientOptions, bench BenchmarkOptions, startAt time.Time, parts []agentResult) *BenchmarkResult {
+	merged, _ := hdr.New(latencyHighest.Microseconds(), 3)
+	r := &BenchmarkResult{
+		StartedAt: startAt.UTC(),
+		Server:    cfg.ServerAddr,
+		Product:   cfg.ProductID,
+		Encoding:  opts.Encoding,
+		Clients:   bench.Clients,
+		Reuse:     bench.Reuse,
+		Stock:     bench.Stock,
+		latencies: merged,
+	}
+	if bench.Shape != nil {
+		r.Shape = bench.Shape.String()
+	} else if bench.Duration == 0 {
+		r.Attempts = bench.Attempts
+	}
+
+	fmt.Printf("\n=== Distributed Results (%d agents) ===\n", len(parts))
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "AGENT\tCLIENTS\tREQUESTS\tSUCCESSFUL\tERRORS\tTHROUGHPUT\tP99\tCLOCK OFFSET\t")
+	var serverSum, networkSum float64
+	var timed int64
+	for _, p := range parts {
+		a := p.Result
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%.0f req/sec\t%.2f ms\t%+.2f ms (±%.2f)\t\n", p.Agent, a.Clients,
+			a.Requests, a.Successful, a.Errors, a.Throughput, a.Latency.P99,
+			float64(p.ClockOffset.Microseconds())/1000, float64(p.ClockRTT.Microseconds())/2000)
+
+		r.Duration = max(r.Duration, a.Duration)
+		r.Requests += a.Requests
+		r.Successful += a.Successful
+		r.SoldOut += a.SoldOut
+		r.RateLimited += a.RateLimited
+		r.Busy += a.Busy
+		r.Queued += a.Queued
+		r.Errors += a.Errors
+		r.Connections += a.Connections
+		r.Reconnects += a.Reconnects
+		r.Missed += a.Missed
+		r.Latency.Mean += a.Latency.Mean * float64(a.Requests)
+		r.Latency.Max = max(r.Latency.Max, a.Latency.Max)
+		if a.Latency.Server != nil && a.Latency.Network != nil {
+			serverSum += *a.Latency.Server * float64(a.Requests)
+			networkSum += *a.Latency.Network * float64(a.Requests)
+			timed += a.Requests
+		}
+		for _, b := range p.Buckets {
+			merged.RecordN(b[0], b[1])
+		}
+	}
+	w.Flush()
+
+	if r.Requests > 0 {
+		r.Latency.Mean /= float64(r.Requests)
+	}
+	if r.Duration > 0 {
+		r.Throughput = float64(r.Requests) / r.Duration
+	}
+	if timed > 0 {
+		server, network := serverSum/float64(timed), networkSum/float64(timed)
+		r.Latency.Server, r.Latency.Network = &server, &network
+	}
+	// Buckets hold each agent's exact maximum, so no quantile exceeds it
+	r.Latency.P50 = float64(merged.ValueAtQuantile(0.50)) / 1000
+	r.Latency.P90 = float64(merged.ValueAtQuantile(0.90)) / 1000
+	r.Latency.P99 = float64(merged.ValueAtQuantile(0.99)) / 1000
+	r.Latency.P999 = float64(merged.ValueAtQuantile(0.999)) / 1000
+	r.Oversold = oversold(r.Successful, r.Stock)
+
+	fmt.Println()
+	fmt.Printf("Duration:          %v\n", time.Duration(r.Duration*float64(time.Second)).Round(time.Millisecond))
+	fmt.Printf("Total Requests:    %d\n", r.Requests)
+	fmt.Printf("Successful:        %d\n", r.Successful)
+	fmt.Printf("Sold Out:          %d\n", r.SoldOut)
+	if r.RateLimited > 0 {
+		fmt.Printf("Rate Limited:      %d\n", r.RateLimited)
+	}
+	if r.Busy > 0 {
+		fmt.Printf("Busy:              %d\n", r.Busy)
+	}
+	if r.Queued > 0 {
+		fmt.Printf("Queued:            %d\n", r.Queued)
+	}
+	fmt.Printf("Errors:            %d\n", r.Errors)
+	if r.Missed > 0 {
+		fmt.Printf("Missed:            %d (no client free; raise -clients)\n", r.Missed)
+	}
+	fmt.Printf("Throughput:        %.0f req/sec\n", r.Throughput)
+	fmt.Printf("Avg Latency:       %.2f ms\n", r.Latency.Mean)
+	if r.Latency.Server != nil {
+		fmt.Printf("  Server:          %.2f ms\n", *r.Latency.Server)
+		fmt.Printf("  Network:         %.2f ms\n", *r.Latency.Network)
+	}
+	for _, lq := range latencyQuantiles {
+		fmt.Printf("%-19s%.2f ms\n", lq.name+" Latency:", float64(merged.ValueAtQuantile(lq.q))/1000)
+	}
+	fmt.Printf("Max Latency:       %.2f ms\n", r.Latency.Max)
+	printHistogram(merged)
+	fmt.Printf("Oversell Check:    %s\n", checkOversell(r.Successful, r.Stock))
+	return r
+}
+
+// RunAgent registers with the coordinator, waits for the start, runs its
+// share of the load and posts the results back. The server, product and
+// load come from the coordinator; only the auth secret and the latency
+// samples are the agent's.
+func RunAgent(coordinatorAddr string, opts ClientOptions, samples io.Writer) error {
+	base := "http://" + coordinatorAddr
+	hc := &http.Client{Timeout: 10 * time.Second}
+	host, _ := os.Hostname()
+	name := fmt.Sprintf("%s-%d", host, os.Getpid())
+
+	offset, rtt, err := clockOffset(hc, base)
+	if err != nil {
+		return fmt.Errorf("failed to reach the coordinator: %w", err)
+	}
+	fmt.Printf("Agent %s: coordinator clock %+v ahead (round trip %v)\n", name, offset, rtt)
+
+	// The coordinator answers once every agent registered
+	fmt.Printf("Waiting for the other agents...\n")
+	var run agentRun
+	if err := postJSON(&http.Client{}, base+registerPath, registerRequest{Agent: name}, &run); err != nil {
+		return fmt.Errorf("failed to register: %w", err)
+	}
+
+	opts.Encoding, opts.FrameCRC, opts.Timestamps = run.Encoding, run.FrameCRC, run.Timestamps
+	bench := BenchmarkOptions{
+		Clients:    run.Clients,
+		Attempts:   run.Attempts,
+		Duration:   run.Duration,
+		Reuse:      run.Reuse,
+		UserPrefix: run.UserPrefix,
+		Stock:      run.Stock,
+		Samples:    samples,
+	}
+	if run.Shape != "" {
+		shape, err := ParseLoadShape(run.Shape)
+		if err != nil {
+			return fmt.Errorf("coordinator sent an invalid shape: %w", err)
+		}
+		bench.Shape = shape
+	}
+
+	start := time.Unix(0, run.StartAt).Add(-offset)
+	fmt.Printf("Agent %d of %d: %d clients against %s, starting at %s\n",
+		run.Index+1, run.Agents, run.Clients, run.ServerAddr, start.Format("15:04:05.000"))
+	if wait := time.Until(start); wait > 0 {
+		time.Sleep(wait)
+	} else {
+		log.Printf("Start time passed %v ago, starting now", -wait)
+	}
+
+	result := Benchmark(run.ServerAddr, run.ProductID, opts, bench)
+	report := agentResult{Agent: name, Result: result, ClockOffset: offset, ClockRTT: rtt}
+	maxLatency := result.latencies.Max()
+	result.latencies.Each(func(low, high, count int64) {
+		// The top bucket carries the exact maximum, for the merged one
+		v := low
+		if maxLatency <= high {
+			v = maxLatency
+		}
+		report.Buckets = append(report.Buckets, [2]int64{v, count})
+	})
+	if err := postJSON(hc, base+resultPath, report, nil); err != nil {
+		return fmt.Errorf("failed to post results: %w", err)
+	}
+	fmt.Println("Results posted to the coordinator")
+	return nil
+}
+
+// clockOffset estimates how far the coordinator's clock is ahead of this
+// one from the quickest of a few round trips, assuming the network took
+// as long each way
+func clockOffset(hc *http.Client, base string) (offset, rtt time.Duration, err error) {
+	rtt = time.Duration(math.MaxInt64)
+	for i := 0; i < clockSamples; i++ {
+		sent := time.Now()
+		var resp clockResponse
+		req, _ := http.NewRequest(http.MethodGet, base+clockPath, nil)
+		if err := doJSON(hc, req, &resp); err != nil {
+			return 0, 0, err
+		}
+		if d := time.Since(sent); d < rtt {
+			rtt = d
+			offset = time.Unix(0, resp.Now).Sub(sent.Add(d / 2))
+		}
+	}
+	return offset, rtt, nil
+}
+
+func postJSON(hc *http.Client, url string, body, resp interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return doJSON(hc, req, resp)
+}
+
+// doJSON sends req and decodes a JSON response into resp, if not nil. An
+// error status is returned as the response's error message.
+func doJSON(hc *http.Client, req *http.Request, resp interface{}) error {
+	res, err := hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		var e struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(res.Body).Decode(&e)
+		return fmt.Errorf("%s: %s", res.Status, e.Error)
+	}
+	if resp == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(resp)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
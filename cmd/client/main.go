@@ -1,157 +1,276 @@
 package main
 
 import (
-	"encoding/binary"
-	"encoding/json"
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
-	"net"
+	"math/bits"
+	"os"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
-)
 
-const (
-	MSG_ATTEMPT_PURCHASE byte = 0x01
+	"chha/internal/config"
+	"chha/internal/hdr"
+	"chha/pkg/client"
+	"chha/pkg/protocol"
 )
 
-type PurchaseRequest struct {
-	ProductID string `json:"product_id"`
-	UserID    string `json:"user_id"`
-}
-
-type PurchaseResponse struct {
-	Status         string `json:"status"`
-	RemainingStock int64  `json:"remaining_stock,omitempty"`
-	Error          string `json:"error,omitempty"`
+// ClientOptions selects the optional protocol features to ask for
+type ClientOptions struct {
+	// Encoding is "json" or "msgpack"; servers without msgpack support
+	// are spoken to in JSON
+	Encoding string
+	// FrameCRC adds a CRC-32C trailer to every frame
+	FrameCRC bool
+	// Timestamps asks the server to time every request, splitting the
+	// latency into server and network time
+	Timestamps bool
+	// AuthSecret is the server's AUTH_HMAC_SECRET; the client signs its
+	// own tokens with it, which only makes sense for load tests
+	AuthSecret string
+	// Tenant and TenantToken buy from a tenant of the server
+	Tenant      string
+	TenantToken string
+	// QUIC dials the server's QUIC listener, verified with QUICTLS
+	QUIC    bool
+	QUICTLS *tls.Config
 }
 
-type Client struct {
-	conn net.Conn
-	mu   sync.Mutex
-}
-
-func NewClient(addr string) (*Client, error) {
-	conn, err := net.Dial("tcp", addr)
-	if err != nil {
-		return nil, err
+// newClient returns a client of one connection with the options, which
+// a benchmark client dials as the run needs
+func newClient(serverAddr string, opts ClientOptions) *client.Client {
+	o := []client.Option{
+		client.WithPoolSize(1),
+		client.WithName("flashsale-client"),
+		// Slow attempts are measured, not cut short, and failed ones
+		// counted, not retried
+		client.WithRequestTimeout(latencyHighest),
+		client.WithRetry(client.RetryPolicy{MaxAttempts: 1}),
 	}
-	return &Client{conn: conn}, nil
-}
-
-func (c *Client) writeFrame(msgType byte, payload []byte) error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	// TYPE
-	if _, err := c.conn.Write([]byte{msgType}); err != nil {
-		return err
+	if opts.Encoding == "msgpack" {
+		o = append(o, client.WithMsgpack())
 	}
-
-	// LENGTH
-	lenBuf := make([]byte, 4)
-	binary.BigEndian.PutUint32(lenBuf, uint32(len(payload)))
-	if _, err := c.conn.Write(lenBuf); err != nil {
-		return err
+	if opts.FrameCRC {
+		o = append(o, client.WithFrameCRC())
 	}
-
-	// PAYLOAD
-	_, err := c.conn.Write(payload)
-	return err
-}
-
-func (c *Client) readFrame() (byte, []byte, error) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	// TYPE
-	typeBuf := make([]byte, 1)
-	if _, err := io.ReadFull(c.conn, typeBuf); err != nil {
-		return 0, nil, err
+	if opts.Timestamps {
+		o = append(o, client.WithTimestamps())
 	}
-
-	// LENGTH
-	lenBuf := make([]byte, 4)
-	if _, err := io.ReadFull(c.conn, lenBuf); err != nil {
-		return 0, nil, err
+	if opts.AuthSecret != "" {
+		o = append(o, client.WithHMACSecret(opts.AuthSecret))
 	}
-	length := binary.BigEndian.Uint32(lenBuf)
-
-	// PAYLOAD
-	payload := make([]byte, length)
-	if _, err := io.ReadFull(c.conn, payload); err != nil {
-		return 0, nil, err
+	if opts.Tenant != "" {
+		o = append(o, client.WithTenant(opts.Tenant, opts.TenantToken))
 	}
-
-	return typeBuf[0], payload, nil
-}
-
-func (c *Client) AttemptPurchase(productID, userID string) (*PurchaseResponse, error) {
-	req := PurchaseRequest{
-		ProductID: productID,
-		UserID:    userID,
+	if opts.QUIC {
+		o = append(o, client.WithQUIC(opts.QUICTLS))
 	}
+	return client.New(serverAddr, o...)
+}
 
-	payload, err := json.Marshal(req)
+// quicTLS trusts the PEM certificates in caFile besides the system roots,
+// for test servers with a self-signed certificate
+func quicTLS(caFile string) (*tls.Config, error) {
+	pem, err := os.ReadFile(caFile)
 	if err != nil {
 		return nil, err
 	}
-
-	if err := c.writeFrame(MSG_ATTEMPT_PURCHASE, payload); err != nil {
-		return nil, err
-	}
-
-	_, respPayload, err := c.readFrame()
+	roots, err := x509.SystemCertPool()
 	if err != nil {
-		return nil, err
+		roots = x509.NewCertPool()
 	}
-
-	var resp PurchaseResponse
-	if err := json.Unmarshal(respPayload, &resp); err != nil {
-		return nil, err
+	if !roots.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no PEM certificates found")
 	}
+	return &tls.Config{RootCAs: roots}, nil
+}
 
-	return &resp, nil
+// BenchmarkOptions size the load of a benchmark
+type BenchmarkOptions struct {
+	// Clients is how many connections buy concurrently
+	Clients int
+	// Attempts is how many purchases each client attempts, unless
+	// Duration is set
+	Attempts int
+	// Duration keeps the clients attempting until it has passed
+	Duration time.Duration
+	// Reuse sends all of a client's attempts over one connection
+	Reuse bool
+	// Samples, when set, receives the latency of every attempt as CSV
+	Samples io.Writer
+	// Shape, when set, makes the run open-loop: attempts follow its rate
+	// whatever the latency, taken by whichever client is free, and
+	// Attempts and Duration are ignored
+	Shape LoadShape
+	// UserPrefix starts the user ID of every attempt (default "user"), so
+	// agents of a distributed run buy as different users
+	UserPrefix string
+	// Stock is the units on sale when the run starts, which successful
+	// purchases must not exceed; negative when unknown, skipping the check
+	Stock int64
 }
 
-func (c *Client) Close() error {
-	return c.conn.Close()
+// latencyHighest is the slowest attempt the histogram tells apart; slower
+// ones are counted as this slow
+const latencyHighest = time.Minute
+
+// latencyQuantiles are the percentiles reported besides the average
+var latencyQuantiles = []struct {
+	name string
+	q    float64
+}{
+	{"p50", 0.50},
+	{"p90", 0.90},
+	{"p99", 0.99},
+	{"p99.9", 0.999},
 }
 
-// Benchmark runs a concurrent load test
-func Benchmark(serverAddr, productID string, numClients, numAttempts int) {
+// Benchmark runs a concurrent load test, prints its results and returns
+// them
+func Benchmark(serverAddr, productID string, opts ClientOptions, bench BenchmarkOptions) *BenchmarkResult {
 	var (
 		successCount int64
 		failCount    int64
+		limitedCount int64
+		busyCount    int64
+		queuedCount  int64
 		errorCount   int64
+		reconnects   int64
+		connections  int64
+		missed       int64
 		totalLatency int64
+
+		// Split of the latency of timed requests, in microseconds
+		timedReqs   int64
+		serverTime  int64
+		networkTime int64
+		clockOffset int64
 	)
 
+	// Latencies in microseconds, to three significant digits
+	latencies, _ := hdr.New(latencyHighest.Microseconds(), 3)
+
+	var samplesMu sync.Mutex
+	var samples *bufio.Writer
+	if bench.Samples != nil {
+		samples = bufio.NewWriter(bench.Samples)
+		fmt.Fprintln(samples, "client,attempt,start_us,latency_us,status")
+	}
+
+	userPrefix := bench.UserPrefix
+	if userPrefix == "" {
+		userPrefix = "user"
+	}
+
 	start := time.Now()
+	deadline := start.Add(bench.Duration)
+	// An open-loop run takes its attempts from the shape's schedule, each
+	// timed from when it fell due, waiting for a free client included
+	var jobs chan time.Time
+	if bench.Shape != nil {
+		jobs = make(chan time.Time, bench.Clients)
+		go bench.Shape.schedule(start, jobs, &missed)
+	}
+	// nextAttempt waits for a client's next attempt and reports whether
+	// there is one, with when it fell due in an open-loop run
+	nextAttempt := func(attempt int) (due time.Time, ok bool) {
+		switch {
+		case jobs != nil:
+			due, ok = <-jobs
+			return due, ok
+		case bench.Duration > 0:
+			return time.Time{}, time.Now().Before(deadline)
+		default:
+			return time.Time{}, attempt < bench.Attempts
+		}
+	}
 	var wg sync.WaitGroup
 
-	for i := 0; i < numClients; i++ {
+	for i := 0; i < bench.Clients; i++ {
 		wg.Add(1)
 		go func(clientID int) {
 			defer wg.Done()
 
-			client, err := NewClient(serverAddr)
-			if err != nil {
-				log.Printf("Client %d: connection failed: %v", clientID, err)
-				atomic.AddInt64(&errorCount, int64(numAttempts))
-				return
-			}
-			defer client.Close()
-
-			for j := 0; j < numAttempts; j++ {
-				userID := fmt.Sprintf("user_%d_%d", clientID, j)
+			// A client of one connection: a reuse run keeps it open, dialling
+			// again only after a failure or GOAWAY; otherwise every attempt
+			// gets a new one. Dials are never timed.
+			var c *client.Client
+			defer func() {
+				if c != nil {
+					c.Close()
+				}
+			}()
+			var dials, goAways int64
+			ctx := context.Background()
+
+			for j := 0; ; j++ {
+				due, ok := nextAttempt(j)
+				if !ok {
+					return
+				}
+				if c == nil {
+					c = newClient(serverAddr, opts)
+				}
+				if err := c.Warm(ctx, 1); err != nil && bench.Reuse && j == 0 {
+					log.Printf("Client %d: connection failed: %v", clientID, err)
+					if bench.Duration > 0 || jobs != nil {
+						atomic.AddInt64(&errorCount, 1)
+					} else {
+						atomic.AddInt64(&errorCount, int64(bench.Attempts-j))
+					}
+					return
+				} else if err != nil {
+					atomic.AddInt64(&errorCount, 1)
+					continue
+				}
+				if st := c.Stats(); st.Dials > dials {
+					atomic.AddInt64(&connections, st.Dials-dials)
+					// A connection replacing one the server retired
+					if st.GoAways > goAways && j > 0 {
+						atomic.AddInt64(&reconnects, st.GoAways-goAways)
+					}
+					dials, goAways = st.Dials, st.GoAways
+				}
+				userID := fmt.Sprintf("%s_%d_%d", userPrefix, clientID, j)
 
 				reqStart := time.Now()
-				resp, err := client.AttemptPurchase(productID, userID)
+				if !due.IsZero() {
+					reqStart = due
+				}
+				resp, err := c.Purchase(ctx, productID, userID)
 				latency := time.Since(reqStart)
 
 				atomic.AddInt64(&totalLatency, latency.Microseconds())
+				latencies.Record(latency.Microseconds())
+				if samples != nil {
+					status := "CONN_ERROR"
+					if err == nil {
+						status = resp.Status
+					}
+					samplesMu.Lock()
+					fmt.Fprintf(samples, "%d,%d,%d,%d,%s\n", clientID, j, reqStart.UnixMicro(), latency.Microseconds(), status)
+					samplesMu.Unlock()
+				}
+				if err == nil && resp.Timing != nil {
+					timing := resp.Timing
+					atomic.AddInt64(&timedReqs, 1)
+					atomic.AddInt64(&serverTime, timing.ServerTime().Microseconds())
+					atomic.AddInt64(&networkTime, timing.NetworkTime(timing.Received).Microseconds())
+					atomic.AddInt64(&clockOffset, timing.ClockOffset(timing.Received).Microseconds())
+				}
+
+				if !bench.Reuse {
+					c.Close()
+					c, dials, goAways = nil, 0, 0
+				}
 
 				if err != nil {
 					atomic.AddInt64(&errorCount, 1)
@@ -159,10 +278,17 @@ func Benchmark(serverAddr, productID string, numClients, numAttempts int) {
 				}
 
 				switch resp.Status {
-				case "SUCCESS":
+				case protocol.STATUS_SUCCESS:
 					atomic.AddInt64(&successCount, 1)
-				case "SOLD_OUT":
+				case protocol.STATUS_SOLD_OUT:
 					atomic.AddInt64(&failCount, 1)
+				case protocol.STATUS_RATE_LIMITED:
+					atomic.AddInt64(&limitedCount, 1)
+				case protocol.STATUS_BUSY:
+					atomic.AddInt64(&busyCount, 1)
+				case protocol.STATUS_QUEUED:
+					// Queue mode: the result is settled later
+					atomic.AddInt64(&queuedCount, 1)
 				default:
 					atomic.AddInt64(&errorCount, 1)
 				}
@@ -172,36 +298,296 @@ func Benchmark(serverAddr, productID string, numClients, numAttempts int) {
 
 	wg.Wait()
 	duration := time.Since(start)
+	if samples != nil {
+		if err := samples.Flush(); err != nil {
+			log.Printf("Failed to write latency samples: %v", err)
+		}
+	}
 
 	// Results
-	totalReqs := successCount + failCount + errorCount
+	totalReqs := successCount + failCount + limitedCount + busyCount + queuedCount + errorCount
 	fmt.Println("\n=== Benchmark Results ===")
 	fmt.Printf("Duration:          %v\n", duration)
 	fmt.Printf("Total Requests:    %d\n", totalReqs)
 	fmt.Printf("Successful:        %d\n", successCount)
 	fmt.Printf("Sold Out:          %d\n", failCount)
+	if limitedCount > 0 {
+		fmt.Printf("Rate Limited:      %d\n", limitedCount)
+	}
+	if busyCount > 0 {
+		fmt.Printf("Busy:              %d\n", busyCount)
+	}
+	if queuedCount > 0 {
+		fmt.Printf("Queued:            %d\n", queuedCount)
+	}
 	fmt.Printf("Errors:            %d\n", errorCount)
+	if !bench.Reuse {
+		fmt.Printf("Connections:       %d (one per attempt)\n", connections)
+	}
+	if reconnects > 0 {
+		fmt.Printf("Reconnects:        %d (GOAWAY)\n", reconnects)
+	}
+	if missed > 0 {
+		fmt.Printf("Missed:            %d (no client free; raise -clients)\n", missed)
+	}
 	fmt.Printf("Throughput:        %.0f req/sec\n", float64(totalReqs)/duration.Seconds())
 	fmt.Printf("Avg Latency:       %.2f ms\n", float64(totalLatency)/float64(totalReqs)/1000)
-	fmt.Printf("Oversell Check:    %s\n", checkOversell(successCount))
+	if timedReqs > 0 {
+		fmt.Printf("  Server:          %.2f ms\n", float64(serverTime)/float64(timedReqs)/1000)
+		fmt.Printf("  Network:         %.2f ms\n", float64(networkTime)/float64(timedReqs)/1000)
+		fmt.Printf("Clock Offset:      %+.2f ms (server ahead)\n", float64(clockOffset)/float64(timedReqs)/1000)
+	}
+	for _, lq := range latencyQuantiles {
+		fmt.Printf("%-19s%.2f ms\n", lq.name+" Latency:", float64(latencies.ValueAtQuantile(lq.q))/1000)
+	}
+	fmt.Printf("Max Latency:       %.2f ms\n", float64(latencies.Max())/1000)
+	printHistogram(latencies)
+	fmt.Printf("Oversell Check:    %s\n", checkOversell(successCount, bench.Stock))
+
+	r := &BenchmarkResult{
+		StartedAt:   start.UTC(),
+		Server:      serverAddr,
+		Product:     productID,
+		Encoding:    opts.Encoding,
+		Clients:     bench.Clients,
+		Reuse:       bench.Reuse,
+		Duration:    duration.Seconds(),
+		Requests:    totalReqs,
+		Successful:  successCount,
+		SoldOut:     failCount,
+		RateLimited: limitedCount,
+		Busy:        busyCount,
+		Queued:      queuedCount,
+		Errors:      errorCount,
+		Connections: connections,
+		Reconnects:  reconnects,
+		Missed:      missed,
+		Stock:       bench.Stock,
+		Oversold:    oversold(successCount, bench.Stock),
+		Throughput:  float64(totalReqs) / duration.Seconds(),
+		Latency: Latencies{
+			Mean: latencies.Mean() / 1000,
+			P50:  float64(latencies.ValueAtQuantile(0.50)) / 1000,
+			P90:  float64(latencies.ValueAtQuantile(0.90)) / 1000,
+			P99:  float64(latencies.ValueAtQuantile(0.99)) / 1000,
+			P999: float64(latencies.ValueAtQuantile(0.999)) / 1000,
+			Max:  float64(latencies.Max()) / 1000,
+		},
+		latencies: latencies,
+	}
+	if bench.Shape != nil {
+		r.Shape = bench.Shape.String()
+	} else if bench.Duration == 0 {
+		r.Attempts = bench.Attempts
+	}
+	if timedReqs > 0 {
+		server := float64(serverTime) / float64(timedReqs) / 1000
+		network := float64(networkTime) / float64(timedReqs) / 1000
+		r.Latency.Server, r.Latency.Network = &server, &network
+	}
+	return r
+}
+
+// histogramWidth is the length of the longest bar of printHistogram
+const histogramWidth = 40
+
+// printHistogram prints how many attempts took how long, one row per
+// power of two of microseconds
+func printHistogram(h *hdr.Histogram) {
+	if h.Count() == 0 {
+		return
+	}
+	// Row r counts latencies of [2^(r-1), 2^r) µs, row 0 those under 1µs.
+	// Histogram buckets never straddle a power of two.
+	var rows [64]int64
+	first, last := len(rows), 0
+	h.Each(func(low, high, count int64) {
+		r := bits.Len64(uint64(low))
+		rows[r] += count
+		first, last = min(first, r), max(last, r)
+	})
+	var most int64
+	for _, n := range rows[first : last+1] {
+		most = max(most, n)
+	}
+
+	fmt.Println("Latency Histogram:")
+	for r := first; r <= last; r++ {
+		low, high := int64(0), int64(1)
+		if r > 0 {
+			low, high = int64(1)<<(r-1), int64(1)<<r
+		}
+		bar := strings.Repeat("█", int((rows[r]*histogramWidth+most-1)/most))
+		fmt.Printf("  %8.3f - %8.3f ms  %-*s %5.1f%%  %d\n", float64(low)/1000, float64(high)/1000,
+			histogramWidth, bar, float64(rows[r])*100/float64(h.Count()), rows[r])
+	}
+}
+
+func checkOversell(successCount, stock int64) string {
+	if stock < 0 {
+		return "SKIPPED (stock unknown)"
+	}
+	if n := oversold(successCount, stock); n > 0 {
+		return fmt.Sprintf("✗ FAIL (oversold by %d of %d units)", n, stock)
+	}
+	return fmt.Sprintf("✓ PASS (%d of %d units sold)", successCount, stock)
+}
+
+// oversold returns how many more purchases succeeded than there was
+// stock, 0 when the stock is unknown
+func oversold(successCount, stock int64) int64 {
+	if stock < 0 {
+		return 0
+	}
+	return max(successCount-stock, 0)
 }
 
-func checkOversell(successCount int64) string {
-	if successCount <= 100 {
-		return "✓ PASS"
+// stockAtStart returns the stock the run is checked against: the -stock
+// flag if set, the product's remaining stock otherwise, or -1 if the
+// server could not say
+func stockAtStart(serverAddr, productID string, opts ClientOptions, stock int64) int64 {
+	if stock > 0 {
+		return stock
+	}
+	c := newClient(serverAddr, opts)
+	defer c.Close()
+	stock, err := c.Stock(context.Background(), productID)
+	if err != nil {
+		log.Printf("Failed to read the stock, skipping the oversell check: %v", err)
+		return -1
 	}
-	return fmt.Sprintf("✗ FAIL (oversold by %d)", successCount-100)
+	return stock
 }
 
 func main() {
-	serverAddr := "localhost:8080"
-	productID := "iphone15"
+	// Flags override the environment, which sets their defaults
+	var cfg config.Client
+	if err := config.Load(&cfg); err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
+	}
+	flag.StringVar(&cfg.ServerAddr, "addr", cfg.ServerAddr, "server address (SERVER_ADDR)")
+	flag.StringVar(&cfg.ProductID, "product", cfg.ProductID, "product to buy (PRODUCT_ID)")
+	flag.IntVar(&cfg.Clients, "clients", cfg.Clients, "concurrent clients (CLIENTS)")
+	flag.IntVar(&cfg.Attempts, "attempts", cfg.Attempts, "purchase attempts per client (ATTEMPTS)")
+	flag.DurationVar(&cfg.Duration, "duration", cfg.Duration, "attempt purchases for this long instead of -attempts times (DURATION)")
+	flag.StringVar(&cfg.LoadShape, "shape", cfg.LoadShape, "attempt at this rate over time instead, for example 30s:0-5000,1m:5000 (LOAD_SHAPE)")
+	flag.BoolVar(&cfg.ReuseConnections, "reuse", cfg.ReuseConnections, "send a client's attempts over one connection; -reuse=false dials for every attempt (REUSE_CONNECTIONS)")
+	flag.StringVar(&cfg.OutputFile, "output", cfg.OutputFile, "write the results to this file, as CSV if it ends in .csv, JSON otherwise (OUTPUT_FILE)")
+	flag.StringVar(&cfg.BaselineFile, "baseline", cfg.BaselineFile, "compare against the JSON results of an earlier run and exit 1 on regression (BASELINE_FILE)")
+	flag.Float64Var(&cfg.MaxRegression, "max-regression", cfg.MaxRegression, "percent throughput, p50 or p99 latency may worsen against -baseline (MAX_REGRESSION)")
+	flag.Int64Var(&cfg.Stock, "stock", cfg.Stock, "units on sale when the run starts, for the oversell check; 0 asks the server (STOCK)")
+	flag.StringVar(&cfg.SamplesFile, "samples", cfg.SamplesFile, "write the latency of every attempt to this CSV file (SAMPLES_FILE)")
+	flag.StringVar(&cfg.CoordinateAddr, "coordinate", cfg.CoordinateAddr, "coordinate a distributed run, listening here for -agents agents (COORDINATE_ADDR)")
+	flag.IntVar(&cfg.Agents, "agents", cfg.Agents, "agents a coordinated run waits for and splits the load between (AGENTS)")
+	flag.DurationVar(&cfg.StartDelay, "start-delay", cfg.StartDelay, "how long after the last agent registers a coordinated run starts (START_DELAY)")
+	flag.StringVar(&cfg.CoordinatorAddr, "agent", cfg.CoordinatorAddr, "run as an agent of the coordinator at this address (COORDINATOR_ADDR)")
+	printConfig := flag.Bool("print-config", false, "print the effective configuration and exit")
+	flag.Parse()
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
+	}
+	if *printConfig {
+		config.Print(os.Stdout, &cfg)
+		return
+	}
+	var shape LoadShape
+	if cfg.LoadShape != "" {
+		s, err := ParseLoadShape(cfg.LoadShape)
+		if err != nil {
+			log.Fatalf("Invalid configuration:\nLOAD_SHAPE: %v", err)
+		}
+		shape = s
+	}
+
+	opts := ClientOptions{
+		Encoding:   cfg.PayloadEncoding,
+		FrameCRC:   cfg.FrameCRC32,
+		Timestamps: cfg.FrameTimestamps,
+		AuthSecret: cfg.AuthHMACSecret,
+
+		Tenant:      cfg.Tenant,
+		TenantToken: cfg.TenantToken,
+
+		QUIC: cfg.QUIC,
+	}
+	if cfg.QUICCAFile != "" {
+		tlsConfig, err := quicTLS(cfg.QUICCAFile)
+		if err != nil {
+			log.Fatalf("Invalid configuration:\nQUIC_CA_FILE: %v", err)
+		}
+		opts.QUICTLS = tlsConfig
+	}
+
+	var samples io.Writer
+	if cfg.SamplesFile != "" {
+		f, err := os.Create(cfg.SamplesFile)
+		if err != nil {
+			log.Fatalf("Failed to create samples file: %v", err)
+		}
+		defer f.Close()
+		samples = f
+	}
+
+	if cfg.CoordinatorAddr != "" {
+		fmt.Println("Flash Sale Client - Agent Mode")
+		if err := RunAgent(cfg.CoordinatorAddr, opts, samples); err != nil {
+			log.Fatalf("Agent failed: %v", err)
+		}
+		return
+	}
 
 	fmt.Println("Flash Sale Client - Benchmark Mode")
-	fmt.Printf("Server: %s\n", serverAddr)
-	fmt.Printf("Product: %s\n", productID)
+	fmt.Printf("Server: %s\n", cfg.ServerAddr)
+	fmt.Printf("Product: %s\n", cfg.ProductID)
+	fmt.Printf("Encoding: %s\n", opts.Encoding)
+	bench := BenchmarkOptions{
+		Clients:  cfg.Clients,
+		Attempts: cfg.Attempts,
+		Duration: cfg.Duration,
+		Reuse:    cfg.ReuseConnections,
+		Shape:    shape,
+		Samples:  samples,
+	}
+	if bench.Shape != nil {
+		fmt.Printf("Load: %s (%d attempts over %v), %d clients\n",
+			bench.Shape, bench.Shape.Total(), bench.Shape.Duration(), bench.Clients)
+	} else if bench.Duration > 0 {
+		fmt.Printf("Load: %d clients for %v\n", bench.Clients, bench.Duration)
+	} else {
+		fmt.Printf("Load: %d clients, %d attempts each\n", bench.Clients, bench.Attempts)
+	}
+	// Read first, so a bad baseline fails before the load runs
+	var baseline *BenchmarkResult
+	if cfg.BaselineFile != "" {
+		b, err := readBaseline(cfg.BaselineFile)
+		if err != nil {
+			log.Fatalf("Failed to read baseline: %v", err)
+		}
+		baseline = b
+	}
+	bench.Stock = stockAtStart(cfg.ServerAddr, cfg.ProductID, opts, cfg.Stock)
+	if bench.Stock >= 0 {
+		fmt.Printf("Stock: %d units\n", bench.Stock)
+	}
 	fmt.Println("\nStarting benchmark...")
 
-	// Run benchmark: 1000 clients, 10 attempts each
-	Benchmark(serverAddr, productID, 10000, 10)
-}
\ No newline at end of file
+	var result *BenchmarkResult
+	if cfg.CoordinateAddr != "" {
+		r, err := Coordinate(cfg, opts, bench)
+		if err != nil {
+			log.Fatalf("Coordinated run failed: %v", err)
+		}
+		result = r
+	} else {
+		result = Benchmark(cfg.ServerAddr, cfg.ProductID, opts, bench)
+	}
+	if cfg.OutputFile != "" {
+		if err := writeResult(cfg.OutputFile, result); err != nil {
+			log.Fatalf("Failed to write results: %v", err)
+		}
+		fmt.Printf("Results written to %s\n", cfg.OutputFile)
+	}
+	if baseline != nil && compareBaseline(baseline, result, cfg.MaxRegression) {
+		os.Exit(1)
+	}
+}
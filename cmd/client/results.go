@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"chha/internal/hdr"
+)
+
+// BenchmarkResult is what a benchmark measured, as written by -output and
+// read back by -baseline. Latencies are in milliseconds.
+type BenchmarkResult struct {
+	StartedAt time.Time `json:"started_at"`
+	Server    string    `json:"server"`
+	Product   string    `json:"product"`
+	Encoding  string    `json:"encoding"`
+	Clients   int       `json:"clients"`
+	// Attempts is per client, 0 when the run was timed or open-loop
+	Attempts int `json:"attempts,omitempty"`
+	// Shape is the load shape of an open-loop run, see ParseLoadShape
+	Shape    string  `json:"shape,omitempty"`
+	Reuse    bool    `json:"reuse_connections"`
+	Duration float64 `json:"duration_seconds"`
+
+	Requests    int64 `json:"requests"`
+	Successful  int64 `json:"successful"`
+	SoldOut     int64 `json:"sold_out"`
+	RateLimited int64 `json:"rate_limited"`
+	// Busy counts the attempts still answered BUSY once the client's
+	// retries ran out
+	Busy        int64 `json:"busy"`
+	Queued      int64 `json:"queued"`
+	Errors      int64 `json:"errors"`
+	Connections int64 `json:"connections"`
+	Reconnects  int64 `json:"reconnects"`
+	// Missed counts the attempts of an open-loop run no client was free
+	// to make
+	Missed int64 `json:"missed,omitempty"`
+	// Stock is what was on sale when the run started, -1 if unknown
+	Stock    int64 `json:"stock"`
+	Oversold int64 `json:"oversold"`
+
+	Throughput float64   `json:"throughput_rps"`
+	Latency    Latencies `json:"latency_ms"`
+
+	// latencies holds every attempt's latency in microseconds, for the
+	// coordinator of a distributed run to merge
+	latencies *hdr.Histogram
+}
+
+// Latencies summarizes the latency of every attempt, in milliseconds.
+// Server and Network split the mean when the server timed requests.
+type Latencies struct {
+	Mean    float64  `json:"mean"`
+	P50     float64  `json:"p50"`
+	P90     float64  `json:"p90"`
+	P99     float64  `json:"p99"`
+	P999    float64  `json:"p999"`
+	Max     float64  `json:"max"`
+	Server  *float64 `json:"server,omitempty"`
+	Network *float64 `json:"network,omitempty"`
+}
+
+// resultColumns are the CSV columns of a result, in order, and how to
+// format each
+var resultColumns = []struct {
+	name  string
+	value func(r *BenchmarkResult) string
+}{
+	{"started_at", func(r *BenchmarkResult) string { return r.StartedAt.Format(time.RFC3339) }},
+	{"server", func(r *BenchmarkResult) string { return r.Server }},
+	{"product", func(r *BenchmarkResult) string { return r.Product }},
+	{"encoding", func(r *BenchmarkResult) string { return r.Encoding }},
+	{"clients", func(r *BenchmarkResult) string { return strconv.Itoa(r.Clients) }},
+	{"attempts", func(r *BenchmarkResult) string { return strconv.Itoa(r.Attempts) }},
+	{"shape", func(r *BenchmarkResult) string { return r.Shape }},
+	{"reuse_connections", func(r *BenchmarkResult) string { return strconv.FormatBool(r.Reuse) }},
+	{"duration_seconds", func(r *BenchmarkResult) string { return formatFloat(r.Duration) }},
+	{"requests", func(r *BenchmarkResult) string { return strconv.FormatInt(r.Requests, 10) }},
+	{"successful", func(r *BenchmarkResult) string { return strconv.FormatInt(r.Successful, 10) }},
+	{"sold_out", func(r *BenchmarkResult) string { return strconv.FormatInt(r.SoldOut, 10) }},
+	{"rate_limited", func(r *BenchmarkResult) string { return strconv.FormatInt(r.RateLimited, 10) }},
+	{"busy", func(r *BenchmarkResult) string { return strconv.FormatInt(r.Busy, 10) }},
+	{"queued", func(r *BenchmarkResult) string { return strconv.FormatInt(r.Queued, 10) }},
+	{"errors", func(r *BenchmarkResult) string { return strconv.FormatInt(r.Errors, 10) }},
+	{"connections", func(r *BenchmarkResult) string { return strconv.FormatInt(r.Connections, 10) }},
+	{"reconnects", func(r *BenchmarkResult) string { return strconv.FormatInt(r.Reconnects, 10) }},
+	{"stock", func(r *BenchmarkResult) string { return strconv.FormatInt(r.Stock, 10) }},
+	{"missed", func(r *BenchmarkResult) string { return strconv.FormatInt(r.Missed, 10) }},
+	{"oversold", func(r *BenchmarkResult) string { return strconv.FormatInt(r.Oversold, 10) }},
+	{"throughput_rps", func(r *BenchmarkResult) string { return formatFloat(r.Throughput) }},
+	{"latency_mean_ms", func(r *BenchmarkResult) string { return formatFloat(r.Latency.Mean) }},
+	{"latency_p50_ms", func(r *BenchmarkResult) string { return formatFloat(r.Latency.P50) }},
+	{"latency_p90_ms", func(r *BenchmarkResult) string { return formatFloat(r.Latency.P90) }},
+	{"latency_p99_ms", func(r *BenchmarkResult) string { return formatFloat(r.Latency.P99) }},
+	{"latency_p999_ms", func(r *BenchmarkResult) string { return formatFloat(r.Latency.P999) }},
+	{"latency_max_ms", func(r *BenchmarkResult) string { return formatFloat(r.Latency.Max) }},
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', 3, 64)
+}
+
+// writeResult writes r to path as CSV if it ends in .csv, as JSON
+// otherwise
+func writeResult(path string, r *BenchmarkResult) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		err = writeResultCSV(f, r)
+	} else {
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(r)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// writeResultCSV writes a header row and one row for r
+func writeResultCSV(w io.Writer, r *BenchmarkResult) error {
+	header := make([]string, len(resultColumns))
+	row := make([]string, len(resultColumns))
+	for i, col := range resultColumns {
+		header[i] = col.name
+		row[i] = col.value(r)
+	}
+	cw := csv.NewWriter(w)
+	cw.Write(header)
+	cw.Write(row)
+	cw.Flush()
+	return cw.Error()
+}
+
+// readBaseline reads a result written by -output as JSON
+func readBaseline(path string) (*BenchmarkResult, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var r BenchmarkResult
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, fmt.Errorf("%s is not a JSON benchmark result: %w", path, err)
+	}
+	return &r, nil
+}
+
+// comparison is one metric of a run against its baseline. Change is in
+// percent, positive when the metric grew; higherBetter says which way is
+// a regression.
+type comparison struct {
+	name         string
+	unit         string
+	baseline     float64
+	current      float64
+	higherBetter bool
+	// gated metrics fail the run when they regress
+	gated bool
+}
+
+// change returns how much the metric moved, in percent
+func (c comparison) change() float64 {
+	if c.baseline == 0 {
+		return 0
+	}
+	return (c.current - c.baseline) / c.baseline * 100
+}
+
+// regressed reports whether the metric got worse by more than
+// maxRegression percent
+func (c comparison) regressed(maxRegression float64) bool {
+	if !c.gated {
+		return false
+	}
+	if c.higherBetter {
+		return c.change() < -maxRegression
+	}
+	return c.change() > maxRegression
+}
+
+// compareBaseline prints how the run moved against the baseline and
+// reports whether throughput, p50 or p99 latency regressed by more than
+// maxRegression percent
+func compareBaseline(base, cur *BenchmarkResult, maxRegression float64) bool {
+	cmps := []comparison{
+		{"Throughput", "req/sec", base.Throughput, cur.Throughput, true, true},
+		{"Avg Latency", "ms", base.Latency.Mean, cur.Latency.Mean, false, false},
+		{"p50 Latency", "ms", base.Latency.P50, cur.Latency.P50, false, true},
+		{"p90 Latency", "ms", base.Latency.P90, cur.Latency.P90, false, false},
+		{"p99 Latency", "ms", base.Latency.P99, cur.Latency.P99, false, true},
+		{"p99.9 Latency", "ms", base.Latency.P999, cur.Latency.P999, false, false},
+	}
+
+	fmt.Printf("\n=== Baseline Comparison (%s, max regression %.1f%%) ===\n", base.StartedAt.Format(time.RFC3339), maxRegression)
+	if base.Clients != cur.Clients || base.Attempts != cur.Attempts || base.Shape != cur.Shape || base.Reuse != cur.Reuse {
+		load := fmt.Sprintf("%d attempts", base.Attempts)
+		if base.Shape != "" {
+			load = "shape " + base.Shape
+		}
+		fmt.Printf("Warning: the baseline ran a different load (%d clients, %s, reuse %t)\n",
+			base.Clients, load, base.Reuse)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "METRIC\tBASELINE\tCURRENT\tCHANGE\t")
+	regressed := false
+	for _, c := range cmps {
+		verdict := ""
+		if c.regressed(maxRegression) {
+			verdict = "✗ REGRESSION"
+			regressed = true
+		}
+		fmt.Fprintf(w, "%s\t%.2f %s\t%.2f %s\t%+.1f%%\t%s\n", c.name, c.baseline, c.unit, c.current, c.unit, c.change(), verdict)
+	}
+	w.Flush()
+	if regressed {
+		fmt.Println("✗ FAIL (regressed against the baseline)")
+	} else {
+		fmt.Println("✓ PASS")
+	}
+	return regressed
+}
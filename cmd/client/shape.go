@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// shapeTick is how often an open-loop run schedules the attempts that
+// fell due; attempts are timed from their tick
+const shapeTick = time.Millisecond
+
+// LoadStage is one stage of a load shape: the attempt rate moves linearly
+// from From to To attempts per second over Duration
+type LoadStage struct {
+	Duration time.Duration
+	From, To float64
+}
+
+// LoadShape is the attempt rate of an open-loop run over time, its stages
+// one after the other
+type LoadShape []LoadStage
+
+// ParseLoadShape reads comma separated stages, each "<duration>:<rate>"
+// for a constant rate or "<duration>:<from>-<to>" for a linear ramp, in
+// attempts per second. "30s:0-5000,1m:5000,10s:5000-0" ramps up for 30
+// seconds, holds for a minute and ramps down; "10s:100,5s:10000,10s:100"
+// is a spike.
+func ParseLoadShape(s string) (LoadShape, error) {
+	var shape LoadShape
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		durStr, rateStr, ok := strings.Cut(part, ":")
+		if !ok {
+			return nil, fmt.Errorf("stage %q is not <duration>:<rate>", part)
+		}
+		d, err := time.ParseDuration(durStr)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("stage %q: invalid duration %q", part, durStr)
+		}
+		fromStr, toStr, ramp := strings.Cut(rateStr, "-")
+		if !ramp {
+			toStr = fromStr
+		}
+		from, err1 := strconv.ParseFloat(fromStr, 64)
+		to, err2 := strconv.ParseFloat(toStr, 64)
+		if err1 != nil || err2 != nil || from < 0 || to < 0 {
+			return nil, fmt.Errorf("stage %q: invalid rate %q", part, rateStr)
+		}
+		shape = append(shape, LoadStage{Duration: d, From: from, To: to})
+	}
+	return shape, nil
+}
+
+// Duration returns how long the shape runs
+func (sh LoadShape) Duration() time.Duration {
+	var d time.Duration
+	for _, st := range sh {
+		d += st.Duration
+	}
+	return d
+}
+
+// Total returns how many attempts the shape schedules
+func (sh LoadShape) Total() int64 {
+	return sh.due(sh.Duration())
+}
+
+// due returns how many attempts fell due in the first t of the shape,
+// the integral of its rate
+func (sh LoadShape) due(t time.Duration) int64 {
+	var n float64
+	for _, st := range sh {
+		if t <= 0 {
+			break
+		}
+		x := min(t, st.Duration).Seconds()
+		d := st.Duration.Seconds()
+		n += st.From*x + (st.To-st.From)*x*x/(2*d)
+		t -= st.Duration
+	}
+	// Allow for rounding, so a shape schedules its whole total
+	return int64(n + 1e-6)
+}
+
+// scaled returns the shape with every rate multiplied by f, an agent's
+// share of a distributed run
+func (sh LoadShape) scaled(f float64) LoadShape {
+	out := make(LoadShape, len(sh))
+	for i, st := range sh {
+		out[i] = LoadStage{Duration: st.Duration, From: st.From * f, To: st.To * f}
+	}
+	return out
+}
+
+func (sh LoadShape) String() string {
+	parts := make([]string, len(sh))
+	for i, st := range sh {
+		if st.From == st.To {
+			parts[i] = fmt.Sprintf("%v:%g", st.Duration, st.From)
+		} else {
+			parts[i] = fmt.Sprintf("%v:%g-%g", st.Duration, st.From, st.To)
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// schedule sends the time every attempt of the shape fell due on jobs,
+// starting at start, and closes it at the end. An attempt no client is
+// free to take, with the backlog full, is counted in missed instead: the
+// run needs more clients to hold the rate.
+func (sh LoadShape) schedule(start time.Time, jobs chan<- time.Time, missed *int64) {
+	defer close(jobs)
+	end := sh.Duration()
+	var sent int64
+	ticker := time.NewTicker(shapeTick)
+	defer ticker.Stop()
+	for {
+		elapsed := min(time.Since(start), end)
+		due := start.Add(elapsed)
+		for n := sh.due(elapsed); sent < n; sent++ {
+			select {
+			case jobs <- due:
+			default:
+				atomic.AddInt64(missed, 1)
+			}
+		}
+		if elapsed >= end {
+			return
+		}
+		<-ticker.C
+	}
+}
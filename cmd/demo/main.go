@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+
+	"chha/internal/config"
+	"chha/internal/server"
+	"chha/internal/store"
+	"chha/pkg/protocol"
+)
+
+// Runs a whole flash sale on one machine: an in-process Redis, the server
+// and a crowd of buyers and bots racing for the stock, then checks the
+// invariants the sale must hold and prints them.
+//
+// Buyers make one attempt each on their own connection. Bots each hold
+// one connection and retry as one user, as fast as the server answers.
+// Everyone waits for the same start, so the stock goes in one burst, and
+// the per-user limit of the product is all that stops a bot winning more
+// than its share. The server is configured from the environment as
+// cmd/server is, except for its addresses, so limits and modes can be
+// tried with the same variables.
+
+// statusConnError counts attempts that got no answer
+const statusConnError = "CONN_ERROR"
+
+// tally counts the answers one population got, by status
+type tally struct {
+	mu       sync.Mutex
+	statuses map[string]int64
+}
+
+func newTally() *tally {
+	return &tally{statuses: make(map[string]int64)}
+}
+
+func (t *tally) add(status string) {
+	t.mu.Lock()
+	t.statuses[status]++
+	t.mu.Unlock()
+}
+
+func (t *tally) count(status string) int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.statuses[status]
+}
+
+func (t *tally) total() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var n int64
+	for _, c := range t.statuses {
+		n += c
+	}
+	return n
+}
+
+func main() {
+	stock := flag.Int64("stock", 100, "units on sale")
+	shards := flag.Int("shards", 0, "split the stock across this many shard keys; 0 keeps one key")
+	limit := flag.Int64("limit", 1, "units each user may hold; 0 sets no limit, so bots can buy many")
+	buyers := flag.Int("buyers", 1000, "buyers making one attempt each")
+	bots := flag.Int("bots", 10, "bots retrying as one user each")
+	botAttempts := flag.Int("bot-attempts", 100, "attempts per bot")
+	productID := flag.String("product", "demo", "product ID of the sale")
+	redisAddr := flag.String("redis", "", "use this Redis instead of an in-process one; the product is replaced, so use a disposable instance")
+	verbose := flag.Bool("v", false, "show the server log")
+	flag.Parse()
+
+	if *stock < 1 || *shards == 1 || *shards < 0 || *limit < 0 || *buyers < 0 || *bots < 0 || *botAttempts < 1 {
+		fmt.Println("-stock and -bot-attempts must be positive, -shards 0 or at least 2, -limit, -buyers and -bots not negative")
+		os.Exit(2)
+	}
+	ctx := context.Background()
+
+	// Redis
+	addr := *redisAddr
+	if addr == "" {
+		mr, err := miniredis.Run()
+		if err != nil {
+			log.Fatalf("Failed to start in-process Redis: %v", err)
+		}
+		defer mr.Close()
+		addr = mr.Addr()
+	}
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	defer client.Close()
+	st, err := store.NewRedisStore(ctx, client, store.RedisStoreOptions{})
+	if err != nil {
+		log.Fatalf("Failed to create store: %v", err)
+	}
+	err = st.ImportProducts(ctx, []store.ProductSpec{{
+		ID:        *productID,
+		Stock:     *stock,
+		Shards:    *shards,
+		UserLimit: *limit,
+	}})
+	if err != nil {
+		log.Fatalf("Failed to init product: %v", err)
+	}
+
+	// Server
+	var opts config.Server
+	if err := config.Load(&opts); err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
+	}
+	opts.RedisAddr = addr
+	opts.ListenAddr = "127.0.0.1:0"
+	opts.MetricsAddr = "127.0.0.1:0"
+	opts.DebugAddr = ""
+	if !*verbose {
+		log.SetOutput(io.Discard)
+	}
+	srv, err := server.NewServer(opts, "")
+	if err != nil {
+		log.SetOutput(os.Stderr)
+		log.Fatalf("Failed to create server: %v", err)
+	}
+	srv.Start()
+	serverAddr := srv.Addr().String()
+
+	fmt.Printf("=== Sale: %s (%d units, %d buyers, %d bots × %d attempts) ===\n",
+		*productID, *stock, *buyers, *bots, *botAttempts)
+	if *redisAddr == "" {
+		fmt.Printf("Redis:             in-process (%s)\n", addr)
+	} else {
+		fmt.Printf("Redis:             %s\n", addr)
+	}
+	fmt.Printf("Server:            %s\n", serverAddr)
+
+	// Sale
+	buyerTally, botTally := newTally(), newTally()
+	botWins := make([]int64, *bots)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < *buyers; i++ {
+		wg.Add(1)
+		go func(userID string) {
+			defer wg.Done()
+			<-start
+			buyer(serverAddr, *productID, userID, buyerTally)
+		}(fmt.Sprintf("buyer-%d", i))
+	}
+	for i := 0; i < *bots; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			botWins[i] = bot(serverAddr, *productID, fmt.Sprintf("bot-%d", i), *botAttempts, botTally)
+		}(i)
+	}
+	began := time.Now()
+	close(start)
+	wg.Wait()
+	elapsed := time.Since(began)
+
+	srv.Shutdown()
+	log.SetOutput(os.Stderr)
+
+	// Report
+	fmt.Printf("Duration:          %v\n\n", elapsed.Round(time.Millisecond))
+	printTallies(map[string]*tally{"buyers": buyerTally, "bots": botTally})
+
+	var botUnits, luckyBots int64
+	for _, n := range botWins {
+		botUnits += n
+		if n > 0 {
+			luckyBots++
+		}
+	}
+	won := buyerTally.count(protocol.STATUS_SUCCESS) + botUnits
+	fmt.Printf("\nUnits won:         %d (buyers %d, bots %d by %d of %d bots)\n",
+		won, buyerTally.count(protocol.STATUS_SUCCESS), botUnits, luckyBots, *bots)
+
+	v, err := st.VerifyProduct(ctx, *productID, nil)
+	if err != nil {
+		log.Fatalf("Failed to verify product: %v", err)
+	}
+	fmt.Printf("\n=== Verify: %s ===\n", *productID)
+	fmt.Printf("Remaining Stock:   %d\n", v.Info.Stock)
+	fmt.Printf("Initial Stock:     %d\n", v.Info.InitialStock)
+	fmt.Printf("Buyer Units:       %d\n", v.BuyerUnits)
+	fmt.Printf("Open Orders:       %d\n", v.OpenOrders)
+
+	// Every SUCCESS a client was told of must be a unit a buyer holds, and
+	// the other way round
+	failures := v.Discrepancies
+	if won > *stock {
+		failures = append(failures, store.Discrepancy{Check: "oversell",
+			Detail: fmt.Sprintf("%d purchases succeeded for %d units", won, *stock)})
+	}
+	if won != v.BuyerUnits {
+		failures = append(failures, store.Discrepancy{Check: "acknowledged",
+			Detail: fmt.Sprintf("clients were told %d purchases succeeded, but buyers hold %d units", won, v.BuyerUnits)})
+	}
+	// A healthy sale answers every attempt with an outcome; errors and
+	// read only answers mean the server failed some of them
+	for _, status := range []string{protocol.STATUS_ERROR, protocol.STATUS_READ_ONLY, statusConnError} {
+		if n := buyerTally.count(status) + botTally.count(status); n > 0 {
+			failures = append(failures, store.Discrepancy{Check: "failed attempts",
+				Detail: fmt.Sprintf("%d attempts answered %s", n, status)})
+		}
+	}
+	if len(failures) == 0 {
+		fmt.Printf("\n✓ No oversell: %d of %d units sold, every one accounted for\n", won, *stock)
+		return
+	}
+	fmt.Printf("\n=== Invariant Violations (%d) ===\n", len(failures))
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CHECK\tDETAIL")
+	for _, d := range failures {
+		fmt.Fprintf(w, "%s\t%s\n", d.Check, d.Detail)
+	}
+	w.Flush()
+	fmt.Println("✗ FAIL")
+	os.Exit(1)
+}
+
+// buyer makes one purchase attempt on its own connection
+func buyer(addr, productID, userID string, t *tally) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.add(statusConnError)
+		return
+	}
+	defer conn.Close()
+	t.add(purchase(conn, productID, userID))
+}
+
+// bot retries as one user until its attempts run out or the connection
+// fails, and returns how many of them succeeded
+func bot(addr, productID, userID string, attempts int, t *tally) int64 {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.add(statusConnError)
+		return 0
+	}
+	defer conn.Close()
+	var won int64
+	for i := 0; i < attempts; i++ {
+		status := purchase(conn, productID, userID)
+		t.add(status)
+		switch status {
+		case protocol.STATUS_SUCCESS:
+			won++
+		case statusConnError:
+			return won
+		}
+	}
+	return won
+}
+
+// purchase sends one MSG_ATTEMPT_PURCHASE and returns the status of the
+// answer, statusConnError if there was none
+func purchase(conn net.Conn, productID, userID string) string {
+	payload, err := json.Marshal(server.PurchaseRequest{ProductID: productID, UserID: userID})
+	if err != nil {
+		return statusConnError
+	}
+	if err := protocol.WriteFrame(conn, protocol.Framing{}, protocol.Frame{
+		Type:    protocol.MSG_ATTEMPT_PURCHASE,
+		Payload: payload,
+	}); err != nil {
+		return statusConnError
+	}
+	for {
+		fr, err := protocol.ReadFrame(conn, protocol.Framing{})
+		if err != nil {
+			return statusConnError
+		}
+		// A server in greeting mode sends MSG_SERVER_INFO on connect
+		if fr.Type == protocol.MSG_SERVER_INFO {
+			continue
+		}
+		var resp server.PurchaseResponse
+		if err := json.Unmarshal(fr.Payload, &resp); err != nil || resp.Status == "" {
+			return statusConnError
+		}
+		return resp.Status
+	}
+}
+
+// printTallies prints one row per population and one column per status
+// any of them got
+func printTallies(tallies map[string]*tally) {
+	seen := make(map[string]bool)
+	for _, t := range tallies {
+		for status := range t.statuses {
+			seen[status] = true
+		}
+	}
+	statuses := make([]string, 0, len(seen))
+	for status := range seen {
+		statuses = append(statuses, status)
+	}
+	sort.Strings(statuses)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "POPULATION\tATTEMPTS\t%s\t\n", strings.Join(statuses, "\t"))
+	for _, name := range []string{"buyers", "bots"} {
+		t := tallies[name]
+		fmt.Fprintf(w, "%s\t%d", name, t.total())
+		for _, status := range statuses {
+			fmt.Fprintf(w, "\t%d", t.count(status))
+		}
+		fmt.Fprintln(w, "\t")
+	}
+	w.Flush()
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/redis/go-redis/v9"
+
+	"chha/internal/config"
+	"chha/internal/persist"
+)
+
+// Writes the orders of the events stream to Postgres, the durable record
+// of every sale. Purchases keep going to Redis alone; this writer follows
+// the stream as a consumer group, so it may fall behind or stop without
+// slowing them down. Run several with the same CONSUMER_GROUP to share
+// the work. It applies the schema migrations on start.
+
+func main() {
+	migrateOnly := flag.Bool("migrate", false, "apply the schema migrations and exit")
+	printConfig := flag.Bool("print-config", false, "print the effective configuration and exit")
+	flag.Parse()
+
+	var cfg config.Persist
+	if err := config.Load(&cfg); err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
+	}
+	if *printConfig {
+		config.Print(os.Stdout, &cfg)
+		return
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	db, err := pgxpool.New(ctx, cfg.PostgresURL)
+	if err != nil {
+		log.Fatalf("Invalid POSTGRES_URL: %v", err)
+	}
+	defer db.Close()
+	if err := db.Ping(ctx); err != nil {
+		log.Fatalf("Postgres connection failed: %v", err)
+	}
+
+	n, err := persist.Migrate(ctx, db)
+	if err != nil {
+		log.Fatalf("Failed to migrate: %v", err)
+	}
+	if *migrateOnly {
+		fmt.Printf("✓ %d migrations applied\n", n)
+		return
+	}
+
+	rdb := redis.NewClient(&redis.Options{Addr: cfg.RedisAddr})
+	defer rdb.Close()
+	if err := rdb.Ping(ctx).Err(); err != nil {
+		log.Fatalf("Redis connection failed: %v", err)
+	}
+
+	consumer := cfg.ConsumerName
+	if consumer == "" {
+		consumer, err = os.Hostname()
+		if err != nil {
+			log.Fatalf("CONSUMER_NAME not set and no host name: %v", err)
+		}
+	}
+	w := persist.New(db, rdb, persist.Options{
+		Tenant:    cfg.Tenant,
+		Group:     cfg.ConsumerGroup,
+		Consumer:  consumer,
+		BatchSize: cfg.BatchSize,
+		ClaimIdle: cfg.ClaimIdle,
+	})
+
+	if cfg.MetricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", w.MetricsHandler())
+		srv := &http.Server{Addr: cfg.MetricsAddr, Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+		go func() {
+			if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Printf("Metrics listener error: %v", err)
+			}
+		}()
+		defer srv.Close()
+	}
+
+	log.Printf("Persisting %s to Postgres as %s/%s", w.Stream(), cfg.ConsumerGroup, consumer)
+	if err := w.Run(ctx); err != nil {
+		log.Fatalf("Persist failed: %v", err)
+	}
+	log.Printf("Writer stopped")
+}
@@ -0,0 +1,494 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"filippo.io/age"
+	"github.com/redis/go-redis/v9"
+
+	"chha/internal/archive"
+	"chha/internal/config"
+	"chha/internal/store"
+)
+
+// Rebuilds derived state from the purchase events of a sale.
+//
+// Events are read from the flashsale:events stream of SOURCE_REDIS_ADDR,
+// or from an archive written by `setup archive`. Buyers lists, orders and
+// the sold/returned counters are rebuilt from them and written to the
+// fresh Redis at TARGET_REDIS_ADDR, followed by the events themselves.
+
+// eventBatchSize is how many events are appended per pipeline
+const eventBatchSize = 1000
+
+func main() {
+	archiveDir := flag.String("archive", "", "read events from this archive instead of SOURCE_REDIS_ADDR")
+	identity := flag.String("identity", "", "age identity or SSH private key to decrypt an encrypted --archive")
+	productID := flag.String("product", "", "only replay this product")
+	initialStock := flag.Int64("initial-stock", 0, "initial stock of --product, when the source does not record it")
+	paymentTTL := flag.Duration("payment-ttl", 0, "PAYMENT_TTL the sale ran with; unconfirmed purchases are replayed as PENDING")
+	skipEvents := flag.Bool("skip-events", false, "do not copy the events into the target stream")
+	dryRun := flag.Bool("dry-run", false, "print what would be rebuilt without writing anything")
+	printConfig := flag.Bool("print-config", false, "print the effective configuration and exit")
+	flag.Parse()
+
+	var cfg config.Replay
+	if err := config.Load(&cfg); err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
+	}
+	if *printConfig {
+		config.Print(os.Stdout, &cfg)
+		return
+	}
+	if *initialStock < 0 || (*initialStock > 0 && *productID == "") {
+		log.Fatalf("--initial-stock needs --product and must not be negative")
+	}
+	if !*dryRun && cfg.TargetRedisAddr == "" {
+		log.Fatalf("TARGET_REDIS_ADDR is required unless --dry-run is set")
+	}
+
+	ctx := context.Background()
+
+	var ids []age.Identity
+	if *identity != "" {
+		var err error
+		ids, err = archive.ReadIdentities(*identity)
+		if err != nil {
+			log.Fatalf("Failed to load identity: %v", err)
+		}
+	}
+
+	src, err := openSource(ctx, cfg.SourceRedisAddr, cfg.Tenant, *archiveDir, *productID, ids)
+	if err != nil {
+		log.Fatalf("Failed to open source: %v", err)
+	}
+
+	fmt.Printf("=== Replaying events from %s ===\n", src.name)
+	p := newProjector(*paymentTTL)
+	if err := src.events(ctx, func(e store.Event) error {
+		p.apply(e)
+		return nil
+	}); err != nil {
+		log.Fatalf("Failed to read events: %v", err)
+	}
+	fmt.Printf("✓ Read %d events\n", p.events)
+
+	projections := p.projections()
+	for i := range projections {
+		proj := &projections[i]
+		switch {
+		case *initialStock > 0:
+			proj.InitialStock = *initialStock
+		default:
+			proj.InitialStock = src.initialStock(ctx, proj.ProductID)
+		}
+		p.printSummary(*proj)
+	}
+	if p.orphans > 0 {
+		fmt.Printf("\nWARNING: %d events refer to orders whose purchase is not in the source.\n", p.orphans)
+		fmt.Println("The stream was probably trimmed, so the rebuilt state is incomplete.")
+	}
+	if p.invalid > 0 {
+		fmt.Printf("\nWARNING: %d events move an order in a way the order lifecycle does not allow, and were skipped.\n", p.invalid)
+	}
+
+	if *dryRun {
+		fmt.Println("\nDry run, nothing written")
+		return
+	}
+
+	target := redis.NewClient(&redis.Options{Addr: cfg.TargetRedisAddr})
+	defer target.Close()
+	if err := target.Ping(ctx).Err(); err != nil {
+		log.Fatalf("Target Redis connection failed: %v", err)
+	}
+	dst, err := store.NewRedisStore(ctx, target, store.RedisStoreOptions{
+		ValueCodec: store.ValueCodecs[cfg.ValueCodec],
+		Tenant:     cfg.Tenant,
+	})
+	if err != nil {
+		log.Fatalf("Failed to create target store: %v", err)
+	}
+
+	stream := store.TenantPrefix(cfg.Tenant) + store.EventsStream
+	if !*skipEvents {
+		n, err := target.XLen(ctx, stream).Result()
+		if err != nil {
+			log.Fatalf("Failed to check target stream: %v", err)
+		}
+		if n > 0 {
+			log.Fatalf("Target already has %d events; use a fresh Redis or --skip-events", n)
+		}
+	}
+
+	fmt.Printf("\n=== Writing to %s ===\n", cfg.TargetRedisAddr)
+	for _, proj := range projections {
+		if err := dst.WriteProjection(ctx, proj); err != nil {
+			if errors.Is(err, store.ErrProductExists) {
+				log.Fatalf("Target is not empty: %v", err)
+			}
+			log.Fatalf("Failed to write %s: %v", proj.ProductID, err)
+		}
+		fmt.Printf("✓ %s: %d orders\n", proj.ProductID, len(proj.Orders))
+	}
+
+	if *skipEvents {
+		return
+	}
+	copied, err := copyEvents(ctx, src, dst)
+	if err != nil {
+		log.Fatalf("Failed to copy events after %d: %v", copied, err)
+	}
+	fmt.Printf("✓ %d events copied to %s\n", copied, stream)
+}
+
+func copyEvents(ctx context.Context, src *source, dst *store.RedisStore) (int, error) {
+	var (
+		batch  []store.Event
+		copied int
+	)
+	flush := func() error {
+		if err := dst.AppendEvents(ctx, batch); err != nil {
+			return err
+		}
+		copied += len(batch)
+		batch = batch[:0]
+		return nil
+	}
+
+	err := src.events(ctx, func(e store.Event) error {
+		batch = append(batch, e)
+		if len(batch) >= eventBatchSize {
+			return flush()
+		}
+		return nil
+	})
+	if err == nil && len(batch) > 0 {
+		err = flush()
+	}
+	return copied, err
+}
+
+// source yields the events of a sale in stream order
+type source struct {
+	name         string
+	events       func(ctx context.Context, fn func(store.Event) error) error
+	initialStock func(ctx context.Context, productID string) int64
+}
+
+func openSource(ctx context.Context, redisAddr, tenant, archiveDir, productID string, ids []age.Identity) (*source, error) {
+	keep := func(fields map[string]interface{}) bool {
+		return productID == "" || field(fields, "product_id") == productID
+	}
+
+	if archiveDir != "" {
+		m, err := archive.ReadManifest(archiveDir)
+		if err != nil {
+			return nil, err
+		}
+		file, ok := m.Find("events")
+		if !ok {
+			return nil, fmt.Errorf("archive %s has no events", archiveDir)
+		}
+		fmt.Printf("Verifying %s...\n", archiveDir)
+		if err := archive.Verify(archiveDir, m); err != nil {
+			return nil, err
+		}
+
+		return &source{
+			name: archiveDir,
+			events: func(ctx context.Context, fn func(store.Event) error) error {
+				return archive.ReadRecords(archiveDir, file, ids, func(line []byte) error {
+					var fields map[string]interface{}
+					if err := json.Unmarshal(line, &fields); err != nil {
+						return fmt.Errorf("corrupt event: %w", err)
+					}
+					id := field(fields, "id")
+					delete(fields, "id")
+					if !keep(fields) {
+						return nil
+					}
+					return fn(store.Event{ID: id, Fields: fields})
+				})
+			},
+			initialStock: func(ctx context.Context, id string) int64 {
+				if m.Labels["product_id"] != id {
+					return 0
+				}
+				n, _ := strconv.ParseInt(m.Labels["initial_stock"], 10, 64)
+				return n
+			},
+		}, nil
+	}
+
+	client := redis.NewClient(&redis.Options{Addr: redisAddr})
+	if err := client.Ping(ctx).Err(); err != nil {
+		return nil, fmt.Errorf("source Redis connection failed: %w", err)
+	}
+	st, err := store.NewRedisStore(ctx, client, store.RedisStoreOptions{Tenant: tenant})
+	if err != nil {
+		return nil, err
+	}
+
+	return &source{
+		name: redisAddr,
+		events: func(ctx context.Context, fn func(store.Event) error) error {
+			return st.Events(ctx, func(id string, fields map[string]interface{}) error {
+				if !keep(fields) {
+					return nil
+				}
+				return fn(store.Event{ID: id, Fields: fields})
+			})
+		},
+		initialStock: func(ctx context.Context, id string) int64 {
+			info, err := st.ProductInfo(ctx, id)
+			if err != nil {
+				return 0
+			}
+			return info.InitialStock
+		},
+	}, nil
+}
+
+// projector folds events into per-product state
+type projector struct {
+	paymentTTL time.Duration
+	products   map[string]*productState
+	events     int
+	// orphans are events about orders whose purchase event was not seen
+	orphans int
+	// invalid are events whose transition the order's status does not
+	// allow, such as a confirmation after expiry
+	invalid int
+}
+
+type productState struct {
+	id     string
+	orders []*store.Order
+	byID   map[string]*store.Order
+
+	sold, returned     int64
+	confirmed          int
+	cancelled, expired int
+	overdraftCancelled int
+	held, rejected     int
+	fulfilled          int
+}
+
+func newProjector(paymentTTL time.Duration) *projector {
+	return &projector{paymentTTL: paymentTTL, products: make(map[string]*productState)}
+}
+
+func (p *projector) product(id string) *productState {
+	ps, ok := p.products[id]
+	if !ok {
+		ps = &productState{id: id, byID: make(map[string]*store.Order)}
+		p.products[id] = ps
+	}
+	return ps
+}
+
+// apply follows the order lifecycle of the server: a purchase creates an
+// order, and every later event moves it on only where store.CanTransition
+// allows
+func (p *projector) apply(e store.Event) {
+	p.events++
+	f := e.Fields
+	productID := field(f, "product_id")
+	if productID == "" {
+		return
+	}
+	ps := p.product(productID)
+	orderID := field(f, "order_id")
+	ts, _ := strconv.ParseInt(field(f, "timestamp"), 10, 64)
+
+	switch field(f, "type") {
+	case "purchase":
+		if _, dup := ps.byID[orderID]; dup || orderID == "" {
+			return
+		}
+		o := &store.Order{
+			ID:        orderID,
+			ProductID: productID,
+			UserID:    field(f, "buyer"),
+			AgentID:   field(f, "agent"),
+			BundleID:  field(f, "bundle_id"),
+			Quantity:  1,
+			Status:    store.OrderConfirmed,
+			CreatedAt: time.Unix(ts, 0),
+		}
+		if p.paymentTTL > 0 {
+			o.Status = store.OrderPending
+			o.ExpiresAt = o.CreatedAt.Add(p.paymentTTL)
+		}
+		ps.orders = append(ps.orders, o)
+		ps.byID[orderID] = o
+		ps.sold++
+
+	case "order_confirmed":
+		if o := p.move(ps, orderID, store.OrderConfirmed); o != nil {
+			o.ExpiresAt = time.Time{}
+			ps.confirmed++
+		}
+
+	case "order_expired":
+		if o := p.move(ps, orderID, store.OrderExpired); o != nil {
+			ps.returned++
+			ps.expired++
+		}
+
+	case "purchase_cancelled":
+		if o := p.move(ps, orderID, store.OrderCancelled); o != nil {
+			o.ExpiresAt = time.Time{}
+			ps.returned++
+			ps.cancelled++
+		}
+
+	case "order_held":
+		if o := p.order(ps, orderID); o != nil && p.allowed(o, store.OrderHeld) {
+			o.HeldFrom = o.Status
+			o.Status = store.OrderHeld
+			o.HeldAt = time.Unix(ts, 0)
+			o.HoldReason = field(f, "reason")
+			ps.held++
+		}
+
+	case "order_approved":
+		if o := p.order(ps, orderID); o != nil && p.allowed(o, o.HeldFrom) {
+			o.Status = o.HeldFrom
+			if deadline, err := strconv.ParseInt(field(f, "payment_deadline"), 10, 64); err == nil && deadline > 0 {
+				o.ExpiresAt = time.Unix(deadline, 0)
+			}
+			o.HeldFrom, o.HeldAt, o.HoldReason = "", time.Time{}, ""
+			ps.held--
+		}
+
+	case "order_rejected":
+		if o := p.move(ps, orderID, store.OrderRejected); o != nil {
+			o.ExpiresAt = time.Time{}
+			ps.returned++
+			ps.held--
+			ps.rejected++
+		}
+
+	case "order_fulfilled":
+		if o := p.move(ps, orderID, store.OrderFulfilled); o != nil {
+			o.FulfilledAt = time.Unix(ts, 0)
+			ps.fulfilled++
+		}
+
+	case "overdraft_cancelled":
+		// Overdraft grants never reached Redis, there is nothing to undo
+		ps.overdraftCancelled++
+	}
+}
+
+func (p *projector) order(ps *productState, orderID string) *store.Order {
+	o, ok := ps.byID[orderID]
+	if !ok {
+		p.orphans++
+		return nil
+	}
+	return o
+}
+
+// allowed reports whether o can move to status, counting the event as
+// invalid if not. A retried event repeating the status o already has is
+// not counted.
+func (p *projector) allowed(o *store.Order, status string) bool {
+	if store.CanTransition(o.Status, status) {
+		return true
+	}
+	if o.Status != status {
+		p.invalid++
+	}
+	return false
+}
+
+// move moves an order to status if the lifecycle allows it, returning the
+// order moved
+func (p *projector) move(ps *productState, orderID, status string) *store.Order {
+	o := p.order(ps, orderID)
+	if o == nil || !p.allowed(o, status) {
+		return nil
+	}
+	o.Status = status
+	return o
+}
+
+// projections returns the rebuilt products sorted by ID
+func (p *projector) projections() []store.Projection {
+	ids := make([]string, 0, len(p.products))
+	for id := range p.products {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	out := make([]store.Projection, 0, len(ids))
+	for _, id := range ids {
+		ps := p.products[id]
+		proj := store.Projection{
+			ProductID: id,
+			Sold:      ps.sold,
+			Returned:  ps.returned,
+			Orders:    make([]store.Order, 0, len(ps.orders)),
+		}
+		for _, o := range ps.orders {
+			proj.Orders = append(proj.Orders, *o)
+		}
+		out = append(out, proj)
+	}
+	return out
+}
+
+func (p *projector) printSummary(proj store.Projection) {
+	ps := p.products[proj.ProductID]
+	buyers := proj.Sold - proj.Returned
+
+	fmt.Printf("\n%s:\n", proj.ProductID)
+	fmt.Printf("  Purchases:           %d\n", ps.sold)
+	fmt.Printf("  Payments confirmed:  %d\n", ps.confirmed)
+	fmt.Printf("  Cancelled:           %d\n", ps.cancelled)
+	fmt.Printf("  Expired:             %d\n", ps.expired)
+	if ps.fulfilled > 0 {
+		fmt.Printf("  Fulfilled:           %d\n", ps.fulfilled)
+	}
+	if ps.overdraftCancelled > 0 {
+		fmt.Printf("  Overdraft cancelled: %d\n", ps.overdraftCancelled)
+	}
+	if ps.held > 0 || ps.rejected > 0 {
+		fmt.Printf("  Held for review:     %d\n", ps.held)
+		fmt.Printf("  Rejected:            %d\n", ps.rejected)
+	}
+	fmt.Printf("  Buyers:              %d\n", buyers)
+	if proj.InitialStock > 0 {
+		fmt.Printf("  Stock:               %d of %d\n", proj.InitialStock-buyers, proj.InitialStock)
+		if buyers > proj.InitialStock {
+			fmt.Printf("  WARNING: more buyers than initial stock\n")
+		}
+	} else {
+		fmt.Printf("  Stock:               unknown, use --initial-stock (stock key not written)\n")
+	}
+}
+
+// field reads an event field as a string; stream values are strings, and
+// so are archived ones
+func field(fields map[string]interface{}, key string) string {
+	switch v := fields[key].(type) {
+	case string:
+		return v
+	case nil:
+		return ""
+	default:
+		return fmt.Sprint(v)
+	}
+}
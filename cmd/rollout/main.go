@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"chha/internal/config"
+)
+
+// Restarts a fleet of servers one at a time through their /admin/drain
+// endpoint.
+//
+// For each instance in turn: check the others are up and can take its
+// connections, drain it, wait for its connections to close, run the
+// restart command, wait for the new process to answer and admit
+// connections on it again. Any failure stops the rollout; an instance that
+// was drained but not yet restarted is admitted again first.
+
+// pollInterval is how often drain and readiness are checked
+const pollInterval = time.Second
+
+// drainStatus is the response of /admin/drain
+type drainStatus struct {
+	Draining    bool   `json:"draining"`
+	Connections int    `json:"connections"`
+	StartedAt   int64  `json:"started_at"`
+	Version     string `json:"version"`
+	Error       string `json:"error"`
+}
+
+type rollout struct {
+	client *http.Client
+	token  string
+
+	restartCmd         string
+	drainTimeout       time.Duration
+	readyTimeout       time.Duration
+	settle             time.Duration
+	maxRemaining       int
+	minSiblings        int
+	siblingConnections int
+}
+
+func main() {
+	restartCmd := flag.String("restart", "", "shell command restarting one instance; {addr} is replaced by its admin address")
+	drainTimeout := flag.Duration("drain-timeout", 2*time.Minute, "how long to wait for a drained instance's connections to close")
+	readyTimeout := flag.Duration("ready-timeout", 2*time.Minute, "how long to wait for a restarted instance to answer")
+	settle := flag.Duration("settle", 10*time.Second, "pause after admitting an instance before draining the next")
+	maxRemaining := flag.Int("max-remaining", 0, "restart once at most this many connections are left open")
+	minSiblings := flag.Int("min-siblings", -1, "other instances that must be up and admitting connections; -1 means all of them")
+	siblingConnections := flag.Int("sibling-connections", 0, "connections one instance can hold; the siblings must have room for the drained instance's (0 disables the check)")
+	httpTimeout := flag.Duration("http-timeout", 5*time.Second, "timeout of each admin API request")
+	printConfig := flag.Bool("print-config", false, "print the effective configuration and exit")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: rollout [flags] <admin_addr>...\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	var cfg config.Rollout
+	if err := config.Load(&cfg); err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
+	}
+	if *printConfig {
+		config.Print(os.Stdout, &cfg)
+		return
+	}
+	addrs := flag.Args()
+	if len(addrs) == 0 || *restartCmd == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *minSiblings < -1 || *minSiblings > len(addrs)-1 {
+		log.Fatalf("--min-siblings must be between -1 and %d", len(addrs)-1)
+	}
+	if *minSiblings == -1 {
+		*minSiblings = len(addrs) - 1
+	}
+
+	ro := &rollout{
+		client:             &http.Client{Timeout: *httpTimeout},
+		token:              cfg.AdminToken,
+		restartCmd:         *restartCmd,
+		drainTimeout:       *drainTimeout,
+		readyTimeout:       *readyTimeout,
+		settle:             *settle,
+		maxRemaining:       *maxRemaining,
+		minSiblings:        *minSiblings,
+		siblingConnections: *siblingConnections,
+	}
+
+	// An interrupt aborts the rollout like any other error
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	fmt.Printf("=== Rolling restart of %d instances ===\n", len(addrs))
+	for i, addr := range addrs {
+		siblings := make([]string, 0, len(addrs)-1)
+		siblings = append(siblings, addrs[:i]...)
+		siblings = append(siblings, addrs[i+1:]...)
+
+		fmt.Printf("\n[%d/%d] %s\n", i+1, len(addrs), addr)
+		if err := ro.restart(ctx, addr, siblings); err != nil {
+			log.Fatalf("Rollout aborted at %s (%d of %d restarted): %v", addr, i, len(addrs), err)
+		}
+		if i < len(addrs)-1 && ro.settle > 0 {
+			select {
+			case <-time.After(ro.settle):
+			case <-ctx.Done():
+				log.Fatalf("Rollout aborted after %s (%d of %d restarted): %v", addr, i+1, len(addrs), ctx.Err())
+			}
+		}
+	}
+	fmt.Printf("\n✓ All %d instances restarted\n", len(addrs))
+}
+
+// restart takes one instance through drain, restart and re-admission
+func (ro *rollout) restart(ctx context.Context, addr string, siblings []string) error {
+	before, err := ro.call(ctx, http.MethodGet, addr)
+	if err != nil {
+		return err
+	}
+	if before.Draining {
+		return fmt.Errorf("already draining, another rollout may be running")
+	}
+	if err := ro.checkSiblings(ctx, siblings, before.Connections); err != nil {
+		return err
+	}
+
+	if _, err := ro.call(ctx, http.MethodPost, addr); err != nil {
+		return fmt.Errorf("drain: %w", err)
+	}
+	fmt.Printf("  draining, %d connections open\n", before.Connections)
+	if err := ro.waitDrained(ctx, addr); err != nil {
+		// Nothing was restarted, so put the instance back in service
+		if _, rerr := ro.call(context.Background(), http.MethodDelete, addr); rerr != nil {
+			return fmt.Errorf("%w; re-admitting failed too, %s is still draining: %v", err, addr, rerr)
+		}
+		fmt.Printf("  re-admitted\n")
+		return err
+	}
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", strings.ReplaceAll(ro.restartCmd, "{addr}", addr))
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("restart command: %w; the instance may be draining or down", err)
+	}
+
+	after, err := ro.waitReady(ctx, addr, before.StartedAt)
+	if err != nil {
+		return err
+	}
+	if after.Draining {
+		if after, err = ro.call(ctx, http.MethodDelete, addr); err != nil {
+			return fmt.Errorf("re-admit: %w", err)
+		}
+	}
+	fmt.Printf("✓ restarted, version %s\n", after.Version)
+	return nil
+}
+
+// checkSiblings makes sure enough other instances are up and admitting
+// connections, and that they have room for the connections about to move
+// off the drained instance
+func (ro *rollout) checkSiblings(ctx context.Context, siblings []string, moving int) error {
+	ready, open := 0, 0
+	for _, addr := range siblings {
+		st, err := ro.call(ctx, http.MethodGet, addr)
+		switch {
+		case err != nil:
+			fmt.Printf("  sibling %s: %v\n", addr, err)
+		case st.Draining:
+			fmt.Printf("  sibling %s: draining\n", addr)
+		default:
+			ready++
+			open += st.Connections
+		}
+	}
+	if ready < ro.minSiblings {
+		return fmt.Errorf("only %d of %d siblings ready, need %d", ready, len(siblings), ro.minSiblings)
+	}
+	if ro.siblingConnections > 0 && open+moving > ready*ro.siblingConnections {
+		return fmt.Errorf("siblings hold %d connections and would get %d more, over the capacity of %d",
+			open, moving, ready*ro.siblingConnections)
+	}
+	return nil
+}
+
+// waitDrained polls until at most maxRemaining connections are left
+func (ro *rollout) waitDrained(ctx context.Context, addr string) error {
+	ctx, cancel := context.WithTimeout(ctx, ro.drainTimeout)
+	defer cancel()
+
+	for last := -1; ; {
+		st, err := ro.call(ctx, http.MethodGet, addr)
+		if err != nil {
+			return fmt.Errorf("drain: %w", err)
+		}
+		if !st.Draining {
+			return fmt.Errorf("drain was cancelled")
+		}
+		if st.Connections <= ro.maxRemaining {
+			fmt.Printf("  drained, %d connections left\n", st.Connections)
+			return nil
+		}
+		if st.Connections != last {
+			fmt.Printf("  %d connections open\n", st.Connections)
+			last = st.Connections
+		}
+		select {
+		case <-time.After(pollInterval):
+		case <-ctx.Done():
+			return fmt.Errorf("drain: %d connections still open: %w", st.Connections, ctx.Err())
+		}
+	}
+}
+
+// waitReady polls until a new process, one started after startedAt
+// answers on addr
+func (ro *rollout) waitReady(ctx context.Context, addr string, startedAt int64) (drainStatus, error) {
+	ctx, cancel := context.WithTimeout(ctx, ro.readyTimeout)
+	defer cancel()
+
+	for {
+		st, err := ro.call(ctx, http.MethodGet, addr)
+		if err == nil && st.StartedAt != startedAt {
+			return st, nil
+		}
+		select {
+		case <-time.After(pollInterval):
+		case <-ctx.Done():
+			if err == nil {
+				err = errors.New("still the old process")
+			}
+			return drainStatus{}, fmt.Errorf("not ready after restart: %v: %w", err, ctx.Err())
+		}
+	}
+}
+
+// call sends one /admin/drain request
+func (ro *rollout) call(ctx context.Context, method, addr string) (drainStatus, error) {
+	url := addr
+	if !strings.Contains(url, "://") {
+		url = "http://" + url
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(url, "/")+"/admin/drain", nil)
+	if err != nil {
+		return drainStatus{}, err
+	}
+	req.Header.Set("Authorization", "Bearer "+ro.token)
+
+	resp, err := ro.client.Do(req)
+	if err != nil {
+		return drainStatus{}, err
+	}
+	defer resp.Body.Close()
+
+	var st drainStatus
+	if err := json.NewDecoder(resp.Body).Decode(&st); err != nil {
+		return drainStatus{}, fmt.Errorf("%s: invalid response: %w", resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return drainStatus{}, fmt.Errorf("%s: %s", resp.Status, st.Error)
+	}
+	return st, nil
+}
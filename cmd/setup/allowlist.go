@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"chha/internal/store"
+)
+
+// allowlistOptions are the flags of setup allowlist
+type allowlistOptions struct {
+	replace    bool
+	clear      bool
+	earlyStart time.Time
+}
+
+func parseAllowlistFlags(args []string) (allowlistOptions, error) {
+	var opts allowlistOptions
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--replace":
+			opts.replace = true
+		case "--clear":
+			opts.clear = true
+		case "--early-start":
+			if i+1 >= len(args) {
+				return opts, fmt.Errorf("missing value for %s", args[i])
+			}
+			i++
+			t, err := time.Parse(time.RFC3339, args[i])
+			if err != nil {
+				return opts, fmt.Errorf("invalid early start %q, expected RFC3339", args[i])
+			}
+			opts.earlyStart = t
+		default:
+			return opts, fmt.Errorf("unknown flag: %s", args[i])
+		}
+	}
+	return opts, nil
+}
+
+// readAllowlist reads one user ID per line, skipping blank lines and #
+// comments. path - reads stdin.
+func readAllowlist(path string) ([]string, error) {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	var users []string
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		user := strings.TrimSpace(scanner.Text())
+		if user == "" || strings.HasPrefix(user, "#") {
+			continue
+		}
+		if strings.ContainsAny(user, " \t,") {
+			return nil, fmt.Errorf("line %d: user ID %q must not contain spaces or commas", line, user)
+		}
+		users = append(users, user)
+	}
+	return users, scanner.Err()
+}
+
+func loadAllowlist(ctx context.Context, st *store.RedisStore, productID, path string, opts allowlistOptions) {
+	if _, err := st.ProductInfo(ctx, productID); err != nil {
+		log.Fatalf("Failed to get product: %v", err)
+	}
+	users, err := readAllowlist(path)
+	if err != nil {
+		log.Fatalf("Failed to read allowlist: %v", err)
+	}
+
+	n, err := st.LoadAllowlist(ctx, productID, users, opts.replace)
+	if err != nil {
+		log.Fatalf("Failed to load allowlist: %v", err)
+	}
+	if !opts.earlyStart.IsZero() {
+		if err := st.SetEarlyStart(ctx, productID, opts.earlyStart); err != nil {
+			log.Fatalf("Failed to set early start: %v", err)
+		}
+	}
+
+	fmt.Printf("✓ Allowlist of '%s' holds %d users (%d read)\n", productID, n, len(users))
+	if !opts.earlyStart.IsZero() {
+		fmt.Printf("  Early access from %s\n", opts.earlyStart.Local().Format("2006-01-02 15:04"))
+	}
+}
+
+func clearAllowlist(ctx context.Context, st *store.RedisStore, productID string) {
+	if err := st.ClearAllowlist(ctx, productID); err != nil {
+		log.Fatalf("Failed to clear allowlist: %v", err)
+	}
+	fmt.Printf("✓ Allowlist of '%s' cleared, the sale opens to everyone at its start\n", productID)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/netip"
+	"strings"
+
+	"chha/internal/store"
+)
+
+// parseBlockTargets reads the user IDs or networks of setup block and
+// unblock. A network is a CIDR range or a single address.
+func parseBlockTargets(kind string, args []string) (store.Blocklist, error) {
+	var b store.Blocklist
+	for _, arg := range args {
+		switch kind {
+		case "user":
+			b.Users = append(b.Users, arg)
+		case "ip":
+			p, err := netip.ParsePrefix(arg)
+			if err != nil {
+				addr, addrErr := netip.ParseAddr(arg)
+				if addrErr != nil {
+					return b, fmt.Errorf("invalid address or CIDR range %q", arg)
+				}
+				addr = addr.Unmap()
+				p = netip.PrefixFrom(addr, addr.BitLen())
+			}
+			b.Networks = append(b.Networks, p.Masked())
+		default:
+			return b, fmt.Errorf("unknown kind %q, expected user or ip", kind)
+		}
+	}
+	return b, nil
+}
+
+func changeBlocklist(ctx context.Context, st *store.RedisStore, b store.Blocklist, block bool) {
+	var err error
+	if block {
+		err = st.Block(ctx, b)
+	} else {
+		err = st.Unblock(ctx, b)
+	}
+	if err != nil {
+		log.Fatalf("Failed to change blocklist: %v", err)
+	}
+
+	targets := append([]string{}, b.Users...)
+	for _, p := range b.Networks {
+		targets = append(targets, p.String())
+	}
+	if block {
+		fmt.Printf("✓ Blocked %s\n", strings.Join(targets, ", "))
+	} else {
+		fmt.Printf("✓ Unblocked %s\n", strings.Join(targets, ", "))
+	}
+}
+
+func showBlocklist(ctx context.Context, st *store.RedisStore) {
+	b, err := st.Blocklist(ctx)
+	if err != nil {
+		log.Fatalf("Failed to get blocklist: %v", err)
+	}
+	if len(b.Users) == 0 && len(b.Networks) == 0 {
+		fmt.Println("Blocklist is empty")
+		return
+	}
+
+	fmt.Printf("\n=== Blocklist: %d users, %d networks ===\n", len(b.Users), len(b.Networks))
+	for _, u := range b.Users {
+		fmt.Printf("user  %s\n", u)
+	}
+	for _, p := range b.Networks {
+		fmt.Printf("ip    %s\n", p)
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"chha/internal/store"
+)
+
+// exportPageSize is how many buyers each round trip fetches
+const exportPageSize = 1000
+
+// exportColumns are the CSV header, in the order of exportRow's fields
+var exportColumns = []string{"user_id", "order_id", "quantity", "created_at", "status", "agent_id", "bundle_id", "expires_at"}
+
+// exportRow is one buyers list entry, with its order's fields when the
+// entry names an order that still exists. Times are RFC3339.
+type exportRow struct {
+	UserID    string `json:"user_id"`
+	OrderID   string `json:"order_id,omitempty"`
+	Quantity  int64  `json:"quantity,omitempty"`
+	CreatedAt string `json:"created_at,omitempty"`
+	Status    string `json:"status,omitempty"`
+	AgentID   string `json:"agent_id,omitempty"`
+	BundleID  string `json:"bundle_id,omitempty"`
+	ExpiresAt string `json:"expires_at,omitempty"`
+}
+
+func (r exportRow) record() []string {
+	quantity := ""
+	if r.Quantity > 0 {
+		quantity = strconv.FormatInt(r.Quantity, 10)
+	}
+	return []string{r.UserID, r.OrderID, quantity, r.CreatedAt, r.Status, r.AgentID, r.BundleID, r.ExpiresAt}
+}
+
+func newExportRow(b store.BuyerRecord, order store.Order, hasOrder bool) exportRow {
+	row := exportRow{UserID: b.UserID, OrderID: b.OrderID, Quantity: b.Quantity}
+	if b.CreatedAt > 0 {
+		row.CreatedAt = formatExportTime(time.Unix(b.CreatedAt, 0))
+	}
+	if hasOrder {
+		row.Quantity = order.Quantity
+		row.CreatedAt = formatExportTime(order.CreatedAt)
+		row.Status = order.Status
+		row.AgentID = order.AgentID
+		row.BundleID = order.BundleID
+		row.ExpiresAt = formatExportTime(order.ExpiresAt)
+	}
+	return row
+}
+
+func formatExportTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// exportWriter writes rows in one output format
+type exportWriter interface {
+	write(row exportRow) error
+	close() error
+}
+
+type csvExport struct{ w *csv.Writer }
+
+func (e *csvExport) write(row exportRow) error { return e.w.Write(row.record()) }
+
+func (e *csvExport) close() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+// jsonExport streams a JSON array, one row per line
+type jsonExport struct {
+	w    *bufio.Writer
+	rows int
+}
+
+func (e *jsonExport) write(row exportRow) error {
+	data, err := json.Marshal(row)
+	if err != nil {
+		return err
+	}
+	sep := ",\n"
+	if e.rows == 0 {
+		sep = "[\n"
+	}
+	e.rows++
+	if _, err := e.w.WriteString(sep); err != nil {
+		return err
+	}
+	_, err = e.w.Write(data)
+	return err
+}
+
+func (e *jsonExport) close() error {
+	end := "\n]\n"
+	if e.rows == 0 {
+		end = "[]\n"
+	}
+	if _, err := e.w.WriteString(end); err != nil {
+		return err
+	}
+	return e.w.Flush()
+}
+
+func newExportWriter(format string, w io.Writer) (exportWriter, error) {
+	switch format {
+	case "csv":
+		cw := csv.NewWriter(w)
+		if err := cw.Write(exportColumns); err != nil {
+			return nil, err
+		}
+		return &csvExport{w: cw}, nil
+	case "json":
+		return &jsonExport{w: bufio.NewWriter(w)}, nil
+	default:
+		return nil, fmt.Errorf("unknown format %q, expected csv or json", format)
+	}
+}
+
+// exportOptions are the flags of setup export
+type exportOptions struct {
+	format string
+	out    string
+}
+
+func parseExportFlags(args []string) (exportOptions, error) {
+	opts := exportOptions{format: "csv"}
+	for i := 0; i < len(args); i++ {
+		if i+1 >= len(args) {
+			return opts, fmt.Errorf("missing value for %s", args[i])
+		}
+		switch args[i] {
+		case "--format":
+			i++
+			if args[i] != "csv" && args[i] != "json" {
+				return opts, fmt.Errorf("unknown format %q, expected csv or json", args[i])
+			}
+			opts.format = args[i]
+		case "--out":
+			i++
+			opts.out = args[i]
+		default:
+			return opts, fmt.Errorf("unknown flag: %s", args[i])
+		}
+	}
+	return opts, nil
+}
+
+// exportBuyers streams the product's buyers, oldest first, to opts.out or
+// stdout. A file is written under a temporary name and renamed once
+// complete, so a failed export leaves no partial file behind.
+func exportBuyers(ctx context.Context, st *store.RedisStore, productID string, opts exportOptions) {
+	var out io.Writer = os.Stdout
+	var tmp *os.File
+	if opts.out != "" {
+		var err error
+		tmp, err = os.CreateTemp(filepath.Dir(opts.out), filepath.Base(opts.out)+".*.tmp")
+		if err != nil {
+			log.Fatalf("Failed to create %s: %v", opts.out, err)
+		}
+		defer os.Remove(tmp.Name())
+		out = tmp
+	}
+
+	w, err := newExportWriter(opts.format, out)
+	if err != nil {
+		log.Fatalf("Failed to export: %v", err)
+	}
+
+	var rows, withOrders int64
+	offset := int64(0)
+	for offset >= 0 {
+		page, next, total, err := st.BuyerPage(ctx, productID, offset, exportPageSize)
+		if err != nil {
+			log.Fatalf("Failed to export buyers: %v", err)
+		}
+
+		var ids []string
+		for _, b := range page {
+			if b.OrderID != "" {
+				ids = append(ids, b.OrderID)
+			}
+		}
+		orders := map[string]store.Order{}
+		if len(ids) > 0 {
+			if orders, err = st.Orders(ctx, ids); err != nil {
+				log.Fatalf("Failed to export orders: %v", err)
+			}
+		}
+
+		for _, b := range page {
+			order, ok := orders[b.OrderID]
+			if ok {
+				withOrders++
+			}
+			if err := w.write(newExportRow(b, order, ok)); err != nil {
+				log.Fatalf("Failed to write export: %v", err)
+			}
+		}
+		rows += int64(len(page))
+		if tmp != nil {
+			fmt.Fprintf(os.Stderr, "\rExported %d of %d buyers", rows, total)
+		}
+		offset = next
+	}
+	if err := w.close(); err != nil {
+		log.Fatalf("Failed to write export: %v", err)
+	}
+
+	if tmp == nil {
+		return
+	}
+	fmt.Fprintln(os.Stderr)
+	if err := tmp.Close(); err != nil {
+		log.Fatalf("Failed to write export: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), opts.out); err != nil {
+		log.Fatalf("Failed to write export: %v", err)
+	}
+	fmt.Printf("✓ Exported %d buyers of '%s' to %s (%s, %d with orders)\n", rows, productID, opts.out, opts.format, withOrders)
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"chha/internal/store"
+)
+
+// importColumns are the CSV header names, and the JSON field names
+var importColumns = []string{"product_id", "stock", "sale_start", "sale_end", "per_user_limit", "shards", "sale_event"}
+
+// importRecord is one product of an import file as written, before
+// validation. Sale times are RFC3339, empty or "-" for an open side.
+type importRecord struct {
+	ProductID    string `json:"product_id"`
+	Stock        string `json:"stock"`
+	SaleStart    string `json:"sale_start"`
+	SaleEnd      string `json:"sale_end"`
+	PerUserLimit string `json:"per_user_limit"`
+	Shards       string `json:"shards"`
+	SaleEvent    string `json:"sale_event"`
+
+	// line locates the record in the file for error messages
+	line string
+}
+
+// UnmarshalJSON accepts numbers as JSON numbers or strings
+func (rec *importRecord) UnmarshalJSON(data []byte) error {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	for key := range raw {
+		if !containsString(importColumns, key) {
+			return fmt.Errorf("unknown field %q", key)
+		}
+	}
+	fields := map[string]*string{
+		"product_id": &rec.ProductID, "stock": &rec.Stock, "sale_start": &rec.SaleStart,
+		"sale_end": &rec.SaleEnd, "per_user_limit": &rec.PerUserLimit, "shards": &rec.Shards,
+		"sale_event": &rec.SaleEvent,
+	}
+	for key, dst := range fields {
+		v, ok := raw[key]
+		if !ok || string(v) == "null" {
+			continue
+		}
+		if err := json.Unmarshal(v, dst); err == nil {
+			continue
+		}
+		var n json.Number
+		if err := json.Unmarshal(v, &n); err != nil {
+			return fmt.Errorf("%s must be a string or a number", key)
+		}
+		*dst = n.String()
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// readImportFile reads products from a .json file holding an array of
+// objects, or from CSV with a header row naming the columns
+func readImportFile(path string) ([]importRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		var recs []importRecord
+		if err := json.NewDecoder(f).Decode(&recs); err != nil {
+			return nil, fmt.Errorf("invalid JSON: %w", err)
+		}
+		for i := range recs {
+			recs[i].line = fmt.Sprintf("entry %d", i+1)
+		}
+		return recs, nil
+	}
+	return readImportCSV(f)
+}
+
+func readImportCSV(r io.Reader) ([]importRecord, error) {
+	cr := csv.NewReader(r)
+	cr.TrimLeadingSpace = true
+	cr.Comment = '#'
+
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("invalid CSV: %w", err)
+	}
+	index := make(map[string]int)
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !containsString(importColumns, name) {
+			return nil, fmt.Errorf("unknown column %q, expected %s", name, strings.Join(importColumns, ", "))
+		}
+		index[name] = i
+	}
+	for _, name := range []string{"product_id", "stock"} {
+		if _, ok := index[name]; !ok {
+			return nil, fmt.Errorf("missing column %q", name)
+		}
+	}
+
+	var recs []importRecord
+	for {
+		row, err := cr.Read()
+		if err == io.EOF {
+			return recs, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("invalid CSV: %w", err)
+		}
+		line, _ := cr.FieldPos(0)
+		col := func(name string) string {
+			if i, ok := index[name]; ok {
+				return strings.TrimSpace(row[i])
+			}
+			return ""
+		}
+		recs = append(recs, importRecord{
+			ProductID:    col("product_id"),
+			Stock:        col("stock"),
+			SaleStart:    col("sale_start"),
+			SaleEnd:      col("sale_end"),
+			PerUserLimit: col("per_user_limit"),
+			Shards:       col("shards"),
+			SaleEvent:    col("sale_event"),
+			line:         fmt.Sprintf("line %d", line),
+		})
+	}
+}
+
+// parseImportRecords validates every record and reports all problems at
+// once, so a file can be fixed in one pass
+func parseImportRecords(recs []importRecord) ([]store.ProductSpec, []string) {
+	var specs []store.ProductSpec
+	var problems []string
+	seen := make(map[string]string)
+
+	for _, rec := range recs {
+		fail := func(format string, args ...interface{}) {
+			problems = append(problems, rec.line+": "+fmt.Sprintf(format, args...))
+		}
+
+		spec := store.ProductSpec{ID: rec.ProductID}
+		ok := true
+		switch {
+		case spec.ID == "":
+			fail("product_id is required")
+			ok = false
+		case strings.ContainsAny(spec.ID, " \t:{}"):
+			fail("product_id %q must not contain spaces, ':' or braces", spec.ID)
+			ok = false
+		case seen[spec.ID] != "":
+			fail("product %s is already listed on %s", spec.ID, seen[spec.ID])
+			ok = false
+		default:
+			seen[spec.ID] = rec.line
+		}
+
+		var err error
+		if spec.Stock, err = strconv.ParseInt(rec.Stock, 10, 64); err != nil || spec.Stock < 0 {
+			fail("invalid stock %q", rec.Stock)
+			ok = false
+		}
+		if rec.Shards != "" {
+			spec.Shards, err = strconv.Atoi(rec.Shards)
+			if err != nil || spec.Shards < 0 || spec.Shards == 1 || spec.Shards > store.MaxShards {
+				fail("shards must be 0 or between 2 and %d, got %q", store.MaxShards, rec.Shards)
+				ok = false
+			}
+		}
+		if rec.PerUserLimit != "" {
+			spec.UserLimit, err = strconv.ParseInt(rec.PerUserLimit, 10, 64)
+			if err != nil || spec.UserLimit < 0 {
+				fail("invalid per_user_limit %q", rec.PerUserLimit)
+				ok = false
+			}
+		}
+		if spec.SaleEvent = rec.SaleEvent; strings.ContainsAny(spec.SaleEvent, " \t:{}") {
+			fail("sale_event %q must not contain spaces, ':' or braces", spec.SaleEvent)
+			ok = false
+		}
+		if spec.SaleStart, err = parseImportTime(rec.SaleStart); err != nil {
+			fail("invalid sale_start: %v", err)
+			ok = false
+		}
+		if spec.SaleEnd, err = parseImportTime(rec.SaleEnd); err != nil {
+			fail("invalid sale_end: %v", err)
+			ok = false
+		}
+		if !spec.SaleStart.IsZero() && !spec.SaleEnd.IsZero() && !spec.SaleEnd.After(spec.SaleStart) {
+			fail("sale_end must be after sale_start")
+			ok = false
+		}
+
+		if ok {
+			specs = append(specs, spec)
+		}
+	}
+	return specs, problems
+}
+
+func parseImportTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return parseWindowTime(s)
+}
+
+// importOptions are the flags of setup import
+type importOptions struct {
+	dryRun  bool
+	replace bool
+}
+
+func parseImportFlags(args []string) (importOptions, error) {
+	var opts importOptions
+	for _, arg := range args {
+		switch arg {
+		case "--dry-run":
+			opts.dryRun = true
+		case "--replace":
+			opts.replace = true
+		default:
+			return opts, fmt.Errorf("unknown flag: %s", arg)
+		}
+	}
+	return opts, nil
+}
+
+func importProducts(ctx context.Context, st *store.RedisStore, path string, opts importOptions) {
+	recs, err := readImportFile(path)
+	if err != nil {
+		log.Fatalf("Failed to read %s: %v", path, err)
+	}
+	specs, problems := parseImportRecords(recs)
+	if len(problems) > 0 {
+		fmt.Printf("%s has %d problems, nothing was imported:\n", path, len(problems))
+		for _, p := range problems {
+			fmt.Printf("  %s\n", p)
+		}
+		os.Exit(1)
+	}
+	if len(specs) == 0 {
+		fmt.Printf("%s lists no products\n", path)
+		return
+	}
+
+	ids := make([]string, len(specs))
+	for i, spec := range specs {
+		ids[i] = spec.ID
+	}
+	existing, err := st.ExistingProducts(ctx, ids)
+	if err != nil {
+		log.Fatalf("Failed to check products: %v", err)
+	}
+
+	var units int64
+	for _, spec := range specs {
+		units += spec.Stock
+	}
+	printImportSummary(specs, existing)
+	fmt.Printf("\n%d products, %d units: %d new, %d replaced\n", len(specs), units, len(specs)-len(existing), len(existing))
+
+	if len(existing) > 0 && !opts.replace {
+		fmt.Println("Some products already exist and would lose their buyers and orders.")
+		fmt.Println("Nothing was imported; run again with --replace to initialize them anyway.")
+		os.Exit(1)
+	}
+	if opts.dryRun {
+		fmt.Println("Dry run, nothing was imported")
+		return
+	}
+
+	if err := st.ImportProducts(ctx, specs); err != nil {
+		log.Fatalf("Import failed, no product was changed: %v", err)
+	}
+	fmt.Printf("✓ Imported %d products from %s\n", len(specs), path)
+}
+
+func printImportSummary(specs []store.ProductSpec, existing map[string]bool) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PRODUCT\tSTOCK\tSHARDS\tLIMIT\tEVENT\tWINDOW\tACTION")
+	for _, spec := range specs {
+		shards, limit, event := "-", "-", "-"
+		if spec.Shards > 0 {
+			shards = strconv.Itoa(spec.Shards)
+		}
+		if spec.UserLimit > 0 {
+			limit = strconv.FormatInt(spec.UserLimit, 10)
+		}
+		if spec.SaleEvent != "" {
+			event = spec.SaleEvent
+		}
+		action := "create"
+		if existing[spec.ID] {
+			action = "replace"
+		}
+		window := store.ProductInfo{SaleStart: spec.SaleStart, SaleEnd: spec.SaleEnd}.Window()
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\t%s\n", spec.ID, spec.Stock, shards, limit, event, window, action)
+	}
+	w.Flush()
+}
@@ -2,11 +2,23 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/redis/go-redis/v9"
+
+	"chha/internal/archive"
+	"chha/internal/auth"
+	"chha/internal/config"
+	"chha/internal/store"
 )
 
 // Admin tool for managing flash sale products
@@ -17,11 +29,19 @@ func main() {
 		os.Exit(1)
 	}
 
-	redisAddr := getEnv("REDIS_ADDR", "localhost:6379")
+	var cfg config.Setup
+	if err := config.Load(&cfg); err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
+	}
+	if os.Args[1] == "--print-config" {
+		config.Print(os.Stdout, &cfg)
+		return
+	}
+
 	ctx := context.Background()
 
 	client := redis.NewClient(&redis.Options{
-		Addr: redisAddr,
+		Addr: cfg.RedisAddr,
 	})
 	defer client.Close()
 
@@ -29,25 +49,71 @@ func main() {
 		log.Fatalf("Redis connection failed: %v", err)
 	}
 
+	st, err := store.NewRedisStore(ctx, client, store.RedisStoreOptions{Tenant: cfg.Tenant})
+	if err != nil {
+		log.Fatalf("Failed to create store: %v", err)
+	}
+
 	command := os.Args[1]
 
 	switch command {
 	case "init":
-		if len(os.Args) != 4 {
-			fmt.Println("Usage: setup init <product_id> <stock>")
+		if len(os.Args) < 4 {
+			fmt.Println("Usage: setup init <product_id> <stock> [shards] [--start t] [--end t|--ttl d] [--per-user-limit n] [--sale-event id] [--paused]")
 			os.Exit(1)
 		}
 		productID := os.Args[2]
-		stock := os.Args[3]
-		initProduct(ctx, client, productID, stock)
+		stock, err := strconv.ParseInt(os.Args[3], 10, 64)
+		if err != nil || stock < 0 {
+			fmt.Printf("Invalid stock: %s\n", os.Args[3])
+			os.Exit(1)
+		}
+		args := os.Args[4:]
+		shards := 0
+		if len(args) > 0 && !strings.HasPrefix(args[0], "--") {
+			shards, err = strconv.Atoi(args[0])
+			if err != nil {
+				fmt.Printf("Invalid shard count: %s\n", args[0])
+				os.Exit(1)
+			}
+			args = args[1:]
+		}
+		policy, err := parseInitFlags(args)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if policy != nil {
+			initWithPolicy(ctx, st, store.ProductSpec{
+				ID:        productID,
+				Stock:     stock,
+				Shards:    shards,
+				SaleStart: policy.SaleStart,
+				SaleEnd:   policy.SaleEnd,
+				UserLimit: policy.UserLimit,
+				SaleEvent: policy.SaleEvent,
+				Paused:    policy.Paused,
+			})
+			break
+		}
+		if shards > 0 {
+			initShardedProduct(ctx, st, productID, stock, shards)
+			break
+		}
+		initProduct(ctx, st, productID, stock)
 
 	case "status":
 		if len(os.Args) != 3 {
-			fmt.Println("Usage: setup status <product_id>")
+			fmt.Println("Usage: setup status <product_id>|--all")
 			os.Exit(1)
 		}
 		productID := os.Args[2]
-		showStatus(ctx, client, productID)
+		if productID == "--all" {
+			showAllStatus(ctx, st)
+			break
+		}
+		showStatus(ctx, st, productID)
+		showShards(ctx, st, productID)
 
 	case "reset":
 		if len(os.Args) != 3 {
@@ -55,7 +121,7 @@ func main() {
 			os.Exit(1)
 		}
 		productID := os.Args[2]
-		resetProduct(ctx, client, productID)
+		resetProduct(ctx, st, productID)
 
 	case "buyers":
 		if len(os.Args) != 3 {
@@ -63,7 +129,267 @@ func main() {
 			os.Exit(1)
 		}
 		productID := os.Args[2]
-		showBuyers(ctx, client, productID)
+		showBuyers(ctx, st, productID)
+
+	case "export":
+		if len(os.Args) < 3 {
+			fmt.Println("Usage: setup export <product_id> [--format csv|json] [--out file]")
+			os.Exit(1)
+		}
+		opts, err := parseExportFlags(os.Args[3:])
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		exportBuyers(ctx, st, os.Args[2], opts)
+
+	case "watch":
+		if len(os.Args) < 3 {
+			fmt.Println("Usage: setup watch <product_id> [--interval d] [--recent n]")
+			os.Exit(1)
+		}
+		opts, err := parseWatchFlags(os.Args[3:])
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		watchProduct(ctx, client, st, os.Args[2], opts)
+
+	case "audit-duplicates":
+		if len(os.Args) != 3 {
+			fmt.Println("Usage: setup audit-duplicates <product_id>")
+			os.Exit(1)
+		}
+		auditDuplicates(ctx, st, os.Args[2])
+
+	case "verify":
+		if len(os.Args) != 3 {
+			fmt.Println("Usage: setup verify <product_id>")
+			os.Exit(1)
+		}
+		verifyProduct(ctx, st, os.Args[2])
+
+	case "expire-stale":
+		opts, err := parseStaleFlags(os.Args[2:])
+		if err != nil {
+			fmt.Println(err)
+			fmt.Println("Usage: setup expire-stale [--dry-run] [--payment-ttl d]")
+			os.Exit(1)
+		}
+		expireStale(ctx, client, cfg.Tenant, opts)
+
+	case "order":
+		if len(os.Args) != 3 {
+			fmt.Println("Usage: setup order <order_id>")
+			os.Exit(1)
+		}
+		showOrder(ctx, st, os.Args[2])
+
+	case "user-orders":
+		if len(os.Args) != 3 {
+			fmt.Println("Usage: setup user-orders <user_id>")
+			os.Exit(1)
+		}
+		showUserOrders(ctx, st, os.Args[2])
+
+	case "archive":
+		if len(os.Args) < 4 {
+			fmt.Println("Usage: setup archive <product_id> <dir> [--compression none|gzip|zstd] [--part-size size] [--recipient key]... [--recipients-file path]")
+			os.Exit(1)
+		}
+		opts, err := parseArchiveFlags(os.Args[4:])
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		archiveProduct(ctx, st, os.Args[2], os.Args[3], opts)
+
+	case "verify-archive":
+		if len(os.Args) != 3 {
+			fmt.Println("Usage: setup verify-archive <dir>")
+			os.Exit(1)
+		}
+		verifyArchive(os.Args[2])
+
+	case "snapshot":
+		if len(os.Args) < 3 {
+			fmt.Println("Usage: setup snapshot <product_id> [--out file]")
+			os.Exit(1)
+		}
+		out, err := parseSnapshotFlags(os.Args[3:])
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		snapshotProduct(ctx, st, os.Args[2], out)
+
+	case "restore":
+		if len(os.Args) != 3 && (len(os.Args) != 4 || os.Args[3] != "--replace") {
+			fmt.Println("Usage: setup restore <file|-> [--replace]")
+			os.Exit(1)
+		}
+		restoreProduct(ctx, st, os.Args[2], len(os.Args) == 4)
+
+	case "strict":
+		if len(os.Args) != 4 || (os.Args[3] != "on" && os.Args[3] != "off") {
+			fmt.Println("Usage: setup strict <product_id> on|off")
+			os.Exit(1)
+		}
+		productID := os.Args[2]
+		setStrict(ctx, st, productID, os.Args[3] == "on")
+
+	case "pause", "resume":
+		if len(os.Args) != 3 {
+			fmt.Printf("Usage: setup %s <product_id>\n", command)
+			os.Exit(1)
+		}
+		productID := os.Args[2]
+		setPaused(ctx, st, productID, command == "pause")
+
+	case "allowlist":
+		if len(os.Args) < 4 {
+			fmt.Println("Usage: setup allowlist <product_id> <file|-> [--replace] [--early-start t] | --clear")
+			os.Exit(1)
+		}
+		productID := os.Args[2]
+		if os.Args[3] == "--clear" && len(os.Args) == 4 {
+			clearAllowlist(ctx, st, productID)
+			break
+		}
+		opts, err := parseAllowlistFlags(os.Args[4:])
+		if err != nil || opts.clear {
+			fmt.Println("Usage: setup allowlist <product_id> <file|-> [--replace] [--early-start t] | --clear")
+			os.Exit(1)
+		}
+		loadAllowlist(ctx, st, productID, os.Args[3], opts)
+
+	case "block", "unblock":
+		if len(os.Args) < 4 {
+			fmt.Printf("Usage: setup %s user|ip <user_id|cidr>...\n", command)
+			os.Exit(1)
+		}
+		targets, err := parseBlockTargets(os.Args[2], os.Args[3:])
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		changeBlocklist(ctx, st, targets, command == "block")
+
+	case "blocklist":
+		showBlocklist(ctx, st)
+
+	case "sale-event":
+		if len(os.Args) < 4 {
+			fmt.Println("Usage: setup sale-event <event_id> <product_id>... | --clear <product_id>... | --reset <event_id>")
+			os.Exit(1)
+		}
+		switch os.Args[2] {
+		case "--clear":
+			setSaleEvent(ctx, st, "", os.Args[3:])
+		case "--reset":
+			resetSaleEvent(ctx, st, os.Args[3])
+		default:
+			setSaleEvent(ctx, st, os.Args[2], os.Args[3:])
+		}
+
+	case "queue":
+		if len(os.Args) != 4 || (os.Args[3] != "on" && os.Args[3] != "off") {
+			fmt.Println("Usage: setup queue <product_id> on|off")
+			os.Exit(1)
+		}
+		productID := os.Args[2]
+		setQueueMode(ctx, st, productID, os.Args[3] == "on")
+
+	case "window":
+		if len(os.Args) != 5 {
+			fmt.Println("Usage: setup window <product_id> <start|-> <end|->")
+			os.Exit(1)
+		}
+		productID := os.Args[2]
+		start, err := parseWindowTime(os.Args[3])
+		if err != nil {
+			fmt.Printf("Invalid start: %v\n", err)
+			os.Exit(1)
+		}
+		end, err := parseWindowTime(os.Args[4])
+		if err != nil {
+			fmt.Printf("Invalid end: %v\n", err)
+			os.Exit(1)
+		}
+		setWindow(ctx, st, productID, start, end)
+
+	case "close":
+		if len(os.Args) != 3 && len(os.Args) != 4 {
+			fmt.Println("Usage: setup close <product_id> [at|in]")
+			os.Exit(1)
+		}
+		end := time.Now()
+		if len(os.Args) == 4 {
+			if end, err = parseCloseTime(os.Args[3], end); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		}
+		closeSale(ctx, st, os.Args[2], end)
+
+	case "restock":
+		if len(os.Args) != 4 {
+			fmt.Println("Usage: setup restock <product_id> <delta>")
+			os.Exit(1)
+		}
+		productID := os.Args[2]
+		delta, err := strconv.ParseInt(os.Args[3], 10, 64)
+		if err != nil || delta == 0 {
+			fmt.Println("Delta must be a non-zero integer")
+			os.Exit(1)
+		}
+		restockProduct(ctx, st, productID, delta)
+
+	case "import":
+		if len(os.Args) < 3 {
+			fmt.Println("Usage: setup import <file.csv|file.json> [--dry-run] [--replace]")
+			os.Exit(1)
+		}
+		opts, err := parseImportFlags(os.Args[3:])
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		importProducts(ctx, st, os.Args[2], opts)
+
+	case "rebalance":
+		if len(os.Args) != 3 {
+			fmt.Println("Usage: setup rebalance <product_id>")
+			os.Exit(1)
+		}
+		productID := os.Args[2]
+		rebalanceProduct(ctx, st, productID)
+
+	case "reclaim":
+		if len(os.Args) != 4 {
+			fmt.Println("Usage: setup reclaim <product_id> <node_id>")
+			os.Exit(1)
+		}
+		reclaimAllotment(ctx, st, os.Args[2], os.Args[3])
+
+	case "issue-token", "issue-agent-token":
+		if len(os.Args) != 3 && len(os.Args) != 4 {
+			if command == "issue-token" {
+				fmt.Println("Usage: setup issue-token <user_id> [ttl]")
+			} else {
+				fmt.Println("Usage: setup issue-agent-token <agent_id> [ttl]")
+			}
+			os.Exit(1)
+		}
+		ttl := time.Hour
+		if len(os.Args) == 4 {
+			ttl, err = time.ParseDuration(os.Args[3])
+			if err != nil || ttl <= 0 {
+				fmt.Printf("Invalid ttl: %s\n", os.Args[3])
+				os.Exit(1)
+			}
+		}
+		issueToken(cfg.AuthHMACSecret, os.Args[2], ttl, command == "issue-agent-token")
 
 	default:
 		fmt.Printf("Unknown command: %s\n", command)
@@ -72,90 +398,745 @@ func main() {
 	}
 }
 
-func initProduct(ctx context.Context, client *redis.Client, productID, stock string) {
-	stockKey := fmt.Sprintf("product:%s:stock", productID)
-	buyersKey := fmt.Sprintf("product:%s:buyers", productID)
-
-	// Set stock
-	if err := client.Set(ctx, stockKey, stock, 0).Err(); err != nil {
-		log.Fatalf("Failed to set stock: %v", err)
+func initProduct(ctx context.Context, st store.Store, productID string, stock int64) {
+	if err := st.InitProduct(ctx, productID, stock); err != nil {
+		log.Fatalf("Failed to init product: %v", err)
 	}
 
-	// Clear buyers list
-	client.Del(ctx, buyersKey)
-
-	fmt.Printf("✓ Product '%s' initialized with %s units\n", productID, stock)
+	fmt.Printf("✓ Product '%s' initialized with %d units\n", productID, stock)
 }
 
-func showStatus(ctx context.Context, client *redis.Client, productID string) {
-	stockKey := fmt.Sprintf("product:%s:stock", productID)
-	buyersKey := fmt.Sprintf("product:%s:buyers", productID)
+func initShardedProduct(ctx context.Context, st *store.RedisStore, productID string, stock int64, shards int) {
+	if err := st.InitShardedProduct(ctx, productID, stock, shards); err != nil {
+		log.Fatalf("Failed to init product: %v", err)
+	}
 
-	stock, err := client.Get(ctx, stockKey).Result()
-	if err == redis.Nil {
+	fmt.Printf("✓ Product '%s' initialized with %d units across %d shards\n", productID, stock, shards)
+}
+
+func showStatus(ctx context.Context, st *store.RedisStore, productID string) {
+	info, err := st.ProductInfo(ctx, productID)
+	if errors.Is(err, store.ErrProductNotFound) {
 		fmt.Printf("Product '%s' not found\n", productID)
 		return
 	} else if err != nil {
-		log.Fatalf("Failed to get stock: %v", err)
+		log.Fatalf("Failed to get product: %v", err)
 	}
 
-	buyerCount, err := client.LLen(ctx, buyersKey).Result()
-	if err != nil {
-		log.Fatalf("Failed to get buyer count: %v", err)
+	durability := "standard"
+	if info.Strict {
+		durability = "strict"
 	}
 
 	fmt.Printf("\n=== Product Status: %s ===\n", productID)
-	fmt.Printf("Remaining Stock:   %s\n", stock)
-	fmt.Printf("Successful Buyers: %d\n", buyerCount)
+	fmt.Printf("Remaining Stock:   %d\n", info.Stock)
+	fmt.Printf("Successful Buyers: %d\n", info.Buyers)
+	if info.Tracked {
+		fmt.Printf("Initial Stock:     %d\n", info.InitialStock)
+		fmt.Printf("Sold (gross):      %d\n", info.Sold)
+		fmt.Printf("Returned:          %d\n", info.Returned)
+		fmt.Printf("Sold (net):        %d\n", info.NetSold())
+		if !info.Balanced() {
+			fmt.Printf("WARNING: stock %d + allotted %d + net sold %d != initial stock %d\n",
+				info.Stock, info.Allotted, info.NetSold(), info.InitialStock)
+		}
+	}
+	showAllotments(ctx, st, productID)
+	fmt.Printf("State:             %s\n", info.State(time.Now()))
+	fmt.Printf("Sale Window:       %s\n", info.Window())
+	if !info.ClosedAt.IsZero() {
+		fmt.Printf("Closed:            %s, %d units unsold\n", info.ClosedAt.Local().Format(time.RFC3339), info.ClosedStock)
+	}
+	fmt.Printf("Durability:        %s\n", durability)
+	if info.UserLimit > 0 {
+		fmt.Printf("Per-User Limit:    %d\n", info.UserLimit)
+	}
+	if info.SaleEvent != "" {
+		showSaleEventLine(ctx, st, info.SaleEvent)
+	}
+	if info.Allowlisted > 0 {
+		access := "no early access"
+		switch {
+		case info.SaleStart.IsZero():
+			access = "the only buyers"
+		case !info.EarlyStart.IsZero():
+			access = "early access from " + info.EarlyStart.Local().Format("2006-01-02 15:04")
+		}
+		fmt.Printf("Allowlist:         %d users, %s\n", info.Allowlisted, access)
+	}
+
+	queued, waiting, err := st.QueueMode(ctx, productID)
+	if err != nil {
+		log.Fatalf("Failed to get queue mode: %v", err)
+	}
+	if queued || waiting > 0 {
+		fmt.Printf("Queue:             %d waiting\n", waiting)
+	}
+
+	waitlisted, err := st.WaitlistLength(ctx, productID)
+	if err != nil {
+		log.Fatalf("Failed to get waitlist: %v", err)
+	}
+	if waitlisted > 0 {
+		fmt.Printf("Waitlist:          %d waiting\n", waitlisted)
+	}
 }
 
-func resetProduct(ctx context.Context, client *redis.Client, productID string) {
-	stockKey := fmt.Sprintf("product:%s:stock", productID)
-	buyersKey := fmt.Sprintf("product:%s:buyers", productID)
+func showAllStatus(ctx context.Context, st store.Store) {
+	products, err := st.ListProductInfo(ctx)
+	if err != nil {
+		log.Fatalf("Failed to list products: %v", err)
+	}
+
+	fmt.Printf("\n=== All Products (%d) ===\n", len(products))
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PRODUCT\tSTOCK\tBUYERS\tSOLD\tRETURNED\tSTATE\tWINDOW")
+	now := time.Now()
+	for _, p := range products {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%s\t%s\n", p.ID, p.Stock, p.Buyers, p.Sold, p.Returned, p.State(now), p.Window())
+	}
+	w.Flush()
+}
 
-	client.Del(ctx, stockKey)
-	client.Del(ctx, buyersKey)
+func setWindow(ctx context.Context, st *store.RedisStore, productID string, start, end time.Time) {
+	if !start.IsZero() && !end.IsZero() && !end.After(start) {
+		log.Fatalf("Sale end must be after start")
+	}
+	if err := st.SetSaleWindow(ctx, productID, start, end); err != nil {
+		log.Fatalf("Failed to set sale window: %v", err)
+	}
 
-	fmt.Printf("✓ Product '%s' reset (deleted)\n", productID)
+	info := store.ProductInfo{SaleStart: start, SaleEnd: end}
+	fmt.Printf("✓ Sale window for '%s' set to %s\n", productID, info.Window())
 }
 
-func showBuyers(ctx context.Context, client *redis.Client, productID string) {
-	buyersKey := fmt.Sprintf("product:%s:buyers", productID)
+func restockProduct(ctx context.Context, st *store.RedisStore, productID string, delta int64) {
+	change, err := st.AddStock(ctx, productID, delta)
+	if errors.Is(err, store.ErrProductNotFound) {
+		log.Fatalf("Product '%s' not found", productID)
+	}
+	if errors.Is(err, store.ErrInsufficientStock) {
+		log.Fatalf("Cannot remove %d units from '%s', not enough stock left", -delta, productID)
+	}
+	if errors.Is(err, store.ErrSaleClosed) {
+		log.Fatalf("The sale of '%s' is closed and its stock frozen; give it a new window to reopen it", productID)
+	}
+	if err != nil {
+		log.Fatalf("Failed to restock: %v", err)
+	}
 
-	buyers, err := client.LRange(ctx, buyersKey, 0, -1).Result()
+	if delta > 0 {
+		fmt.Printf("✓ Added %d units to '%s' (%d → %d)\n", delta, productID, change.Previous, change.Stock)
+	} else {
+		fmt.Printf("✓ Removed %d units from '%s' (%d → %d)\n", -delta, productID, change.Previous, change.Stock)
+	}
+}
+
+// parseCloseTime accepts an RFC3339 timestamp, or a duration from now
+func parseCloseTime(s string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		if d < 0 {
+			return time.Time{}, fmt.Errorf("invalid close time %q, expected a time or duration from now", s)
+		}
+		return now.Add(d), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid close time %q, expected RFC3339 or a duration", s)
+	}
+	return t, nil
+}
+
+// closeSale moves a product's sale end to end, keeping its start; the
+// servers close the sale once it passes
+func closeSale(ctx context.Context, st *store.RedisStore, productID string, end time.Time) {
+	info, err := st.ProductInfo(ctx, productID)
+	if errors.Is(err, store.ErrProductNotFound) {
+		log.Fatalf("Product '%s' not found", productID)
+	} else if err != nil {
+		log.Fatalf("Failed to get product: %v", err)
+	}
+	end = end.Truncate(time.Second)
+	if !info.SaleStart.IsZero() && !end.After(info.SaleStart) {
+		log.Fatalf("Sale end must be after start %s", info.SaleStart.Local().Format(time.RFC3339))
+	}
+	if err := st.SetSaleWindow(ctx, productID, info.SaleStart, end); err != nil {
+		log.Fatalf("Failed to set sale window: %v", err)
+	}
+
+	if !end.After(time.Now()) {
+		fmt.Printf("✓ Sale of '%s' ended, purchases answer ENDED and servers close it\n", productID)
+		return
+	}
+	fmt.Printf("✓ Sale of '%s' closes at %s\n", productID, end.Local().Format(time.RFC3339))
+}
+
+// parseWindowTime accepts RFC3339 timestamps, or "-" for an open side
+func parseWindowTime(s string) (time.Time, error) {
+	if s == "-" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+func showAllotments(ctx context.Context, st *store.RedisStore, productID string) {
+	held, err := st.Allotments(ctx, productID)
+	if err != nil {
+		log.Fatalf("Failed to get allotments: %v", err)
+	}
+	nodes := make([]string, 0, len(held))
+	for node := range held {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	for _, node := range nodes {
+		fmt.Printf("Allotted:          %d to node %s\n", held[node], node)
+	}
+}
+
+func reclaimAllotment(ctx context.Context, st *store.RedisStore, productID, node string) {
+	n, err := st.ReclaimAllotment(ctx, productID, node)
+	if err != nil {
+		log.Fatalf("Failed to reclaim allotment: %v", err)
+	}
+	fmt.Printf("✓ Returned %d units allotted to node %s to '%s'\n", n, node, productID)
+}
+
+func showShards(ctx context.Context, st *store.RedisStore, productID string) {
+	stocks, err := st.ShardStocks(ctx, productID)
+	if err != nil {
+		log.Fatalf("Failed to get shard stock: %v", err)
+	}
+	if stocks == nil {
+		return
+	}
+
+	fmt.Printf("Shards:            %d\n", len(stocks))
+	for i, stock := range stocks {
+		fmt.Printf("  shard %-3d        %d\n", i, stock)
+	}
+}
+
+func setStrict(ctx context.Context, st *store.RedisStore, productID string, strict bool) {
+	if err := st.SetStrictDurability(ctx, productID, strict); err != nil {
+		log.Fatalf("Failed to set durability mode: %v", err)
+	}
+
+	mode := "off"
+	if strict {
+		mode = "on"
+	}
+	fmt.Printf("✓ Strict durability %s for '%s'\n", mode, productID)
+}
+
+func setQueueMode(ctx context.Context, st *store.RedisStore, productID string, on bool) {
+	if err := st.SetQueueMode(ctx, productID, on); err != nil {
+		log.Fatalf("Failed to set queue mode: %v", err)
+	}
+
+	mode := "off"
+	if on {
+		mode = "on"
+	}
+	fmt.Printf("✓ Queue mode %s for '%s'\n", mode, productID)
+}
+
+func setPaused(ctx context.Context, st *store.RedisStore, productID string, paused bool) {
+	if _, err := st.ProductInfo(ctx, productID); errors.Is(err, store.ErrProductNotFound) {
+		log.Fatalf("Product '%s' not found", productID)
+	} else if err != nil {
+		log.Fatalf("Failed to get product: %v", err)
+	}
+	if err := st.SetPaused(ctx, productID, paused); err != nil {
+		log.Fatalf("Failed to set paused: %v", err)
+	}
+
+	if paused {
+		fmt.Printf("✓ Sale of '%s' paused, purchases answer PAUSED\n", productID)
+	} else {
+		fmt.Printf("✓ Sale of '%s' resumed\n", productID)
+	}
+}
+
+func rebalanceProduct(ctx context.Context, st *store.RedisStore, productID string) {
+	total, err := st.Rebalance(ctx, productID)
+	if err != nil {
+		log.Fatalf("Failed to rebalance: %v", err)
+	}
+
+	fmt.Printf("✓ Product '%s' rebalanced (%d units remaining)\n", productID, total)
+}
+
+func resetProduct(ctx context.Context, st store.Store, productID string) {
+	if err := st.ResetProduct(ctx, productID); err != nil {
+		log.Fatalf("Failed to reset product: %v", err)
+	}
+
+	fmt.Printf("✓ Product '%s' reset (deleted)\n", productID)
+}
+
+func showBuyers(ctx context.Context, st *store.RedisStore, productID string) {
+	buyers, err := st.BuyerRecords(ctx, productID)
 	if err != nil {
 		log.Fatalf("Failed to get buyers: %v", err)
 	}
 
 	fmt.Printf("\n=== Buyers for %s (%d total) ===\n", productID, len(buyers))
-	for i, buyer := range buyers {
-		fmt.Printf("%d. %s\n", i+1, buyer)
+	for i, b := range buyers {
+		// Entries written by the plain codec only carry the user ID
+		if b.OrderID == "" {
+			fmt.Printf("%d. %s\n", i+1, b.UserID)
+			continue
+		}
+		fmt.Printf("%d. %s\torder %s\t%s\n", i+1, b.UserID, b.OrderID,
+			time.Unix(b.CreatedAt, 0).Format(time.RFC3339))
+	}
+}
+
+func showOrder(ctx context.Context, st store.Store, orderID string) {
+	order, err := st.GetOrder(ctx, orderID)
+	if errors.Is(err, store.ErrOrderNotFound) {
+		fmt.Printf("Order '%s' not found\n", orderID)
+		return
+	} else if err != nil {
+		log.Fatalf("Failed to get order: %v", err)
+	}
+
+	fmt.Printf("\n=== Order: %s ===\n", order.ID)
+	fmt.Printf("Product:           %s\n", order.ProductID)
+	fmt.Printf("User:              %s\n", order.UserID)
+	if order.AgentID != "" {
+		fmt.Printf("Agent:             %s\n", order.AgentID)
+	}
+	if order.BundleID != "" {
+		fmt.Printf("Bundle:            %s\n", order.BundleID)
+	}
+	fmt.Printf("Quantity:          %d\n", order.Quantity)
+	fmt.Printf("Status:            %s\n", order.Status)
+	fmt.Printf("Created:           %s\n", order.CreatedAt.Local().Format(time.RFC3339))
+	if order.Status == store.OrderPending && !order.ExpiresAt.IsZero() {
+		fmt.Printf("Payment Deadline:  %s\n", order.ExpiresAt.Local().Format(time.RFC3339))
+	}
+	if order.Status == store.OrderHeld {
+		fmt.Printf("Held:              %s (%s), from %s\n", order.HeldAt.Local().Format(time.RFC3339), order.HoldReason, order.HeldFrom)
+	}
+	if !order.FulfilledAt.IsZero() {
+		fmt.Printf("Fulfilled:         %s\n", order.FulfilledAt.Local().Format(time.RFC3339))
 	}
 }
 
+func showUserOrders(ctx context.Context, st *store.RedisStore, userID string) {
+	orders, err := st.UserOrders(ctx, userID, 1000)
+	if err != nil {
+		log.Fatalf("Failed to get user orders: %v", err)
+	}
+
+	fmt.Printf("\n=== Orders of %s (%d) ===\n", userID, len(orders))
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ORDER\tPRODUCT\tSTATUS\tCREATED")
+	for _, o := range orders {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", o.ID, o.ProductID, o.Status, o.CreatedAt.Local().Format(time.RFC3339))
+	}
+	w.Flush()
+}
+
+func auditDuplicates(ctx context.Context, st *store.RedisStore, productID string) {
+	dups, err := st.AuditDuplicates(ctx, productID, nil)
+	if err != nil {
+		log.Fatalf("Failed to audit duplicates: %v", err)
+	}
+
+	fmt.Printf("\n=== Duplicate Purchases for %s (%d users) ===\n", productID, len(dups))
+	if len(dups) == 0 {
+		fmt.Println("✓ No user was granted more than one unit")
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "USER\tGRANTS\tBUYER ENTRIES\tORDERS\tEVENTS")
+	var excess int
+	for _, d := range dups {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\n", d.UserID, d.Grants(), d.BuyerEntries, len(d.Orders), d.Events)
+		excess += d.Grants() - 1
+	}
+	w.Flush()
+
+	// Keep each user's oldest order, everything after it is the excess
+	fmt.Printf("\n=== Remediation (%d excess units) ===\n", excess)
+	for _, d := range dups {
+		if len(d.Orders) > 0 {
+			fmt.Printf("%s: keep order %s\n", d.UserID, d.Orders[0].ID)
+			for _, o := range d.Orders[1:] {
+				fmt.Printf("%s: refund order %s (created %s)\n", d.UserID, o.ID, o.CreatedAt.Local().Format(time.RFC3339))
+			}
+		}
+		if extra := d.Grants() - max(len(d.Orders), 1); extra > 0 {
+			fmt.Printf("%s: %d grants without an order record, investigate manually\n", d.UserID, extra)
+		}
+	}
+}
+
+// verifyProduct reports the stock invariants a product breaks, and exits
+// with status 1 if there are any
+func verifyProduct(ctx context.Context, st *store.RedisStore, productID string) {
+	v, err := st.VerifyProduct(ctx, productID, nil)
+	if errors.Is(err, store.ErrProductNotFound) {
+		fmt.Printf("Product '%s' not found\n", productID)
+		os.Exit(1)
+	} else if err != nil {
+		log.Fatalf("Failed to verify product: %v", err)
+	}
+
+	fmt.Printf("\n=== Verify: %s ===\n", productID)
+	fmt.Printf("Remaining Stock:   %d\n", v.Info.Stock)
+	if v.Info.Allotted > 0 {
+		fmt.Printf("Allotted:          %d\n", v.Info.Allotted)
+	}
+	fmt.Printf("Initial Stock:     %d\n", v.Info.InitialStock)
+	fmt.Printf("Buyer Units:       %d\n", v.BuyerUnits)
+	fmt.Printf("Open Orders:       %d\n", v.OpenOrders)
+	if v.Info.Tracked {
+		fmt.Printf("Sold (net):        %d\n", v.Info.NetSold())
+	}
+
+	if v.OK() {
+		fmt.Println("\n✓ No discrepancies")
+		return
+	}
+	fmt.Printf("\n=== Discrepancies (%d) ===\n", len(v.Discrepancies))
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CHECK\tDETAIL")
+	for _, d := range v.Discrepancies {
+		fmt.Fprintf(w, "%s\t%s\n", d.Check, d.Detail)
+	}
+	w.Flush()
+	if len(v.OverLimit) > 0 {
+		fmt.Printf("\nRun 'setup audit-duplicates %s' for the orders to refund\n", productID)
+	}
+	os.Exit(1)
+}
+
+func parseArchiveFlags(args []string) (archive.Options, error) {
+	opts := archive.Options{Compression: archive.Zstd}
+	for i := 0; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return opts, fmt.Errorf("missing value for %s", args[i])
+		}
+		switch args[i] {
+		case "--compression":
+			c, err := archive.ParseCompression(args[i+1])
+			if err != nil {
+				return opts, err
+			}
+			opts.Compression = c
+		case "--part-size":
+			size, err := parseSize(args[i+1])
+			if err != nil {
+				return opts, fmt.Errorf("invalid part size: %s", args[i+1])
+			}
+			opts.PartSize = size
+		case "--recipient":
+			r, err := archive.ParseRecipient(args[i+1])
+			if err != nil {
+				return opts, err
+			}
+			opts.Recipients = append(opts.Recipients, r)
+		case "--recipients-file":
+			rs, err := archive.ReadRecipients(args[i+1])
+			if err != nil {
+				return opts, err
+			}
+			opts.Recipients = append(opts.Recipients, rs...)
+		default:
+			return opts, fmt.Errorf("unknown flag: %s", args[i])
+		}
+	}
+	return opts, nil
+}
+
+// parseSize accepts a byte count with an optional K, M or G suffix
+func parseSize(s string) (int64, error) {
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		mult, s = 1<<10, strings.TrimSuffix(s, "K")
+	case strings.HasSuffix(s, "M"):
+		mult, s = 1<<20, strings.TrimSuffix(s, "M")
+	case strings.HasSuffix(s, "G"):
+		mult, s = 1<<30, strings.TrimSuffix(s, "G")
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size")
+	}
+	return n * mult, nil
+}
+
+// archivedOrder is the archive format of an order, kept independent of
+// store.Order
+type archivedOrder struct {
+	OrderID   string `json:"order_id"`
+	ProductID string `json:"product_id"`
+	UserID    string `json:"user_id"`
+	AgentID   string `json:"agent_id,omitempty"`
+	BundleID  string `json:"bundle_id,omitempty"`
+	Quantity  int64  `json:"quantity"`
+	Status    string `json:"status"`
+	CreatedAt int64  `json:"created_at"`
+	ExpiresAt int64  `json:"expires_at,omitempty"`
+}
+
+func archiveProduct(ctx context.Context, st *store.RedisStore, productID, dir string, opts archive.Options) {
+	if _, err := os.Stat(filepath.Join(dir, archive.ManifestName)); err == nil {
+		log.Fatalf("%s already contains an archive", dir)
+	}
+
+	manifest := archive.Manifest{
+		CreatedAt: time.Now().UTC(),
+		Labels:    map[string]string{"product_id": productID},
+	}
+	// cmd/replay needs the initial stock to rebuild the stock counter
+	if info, err := st.ProductInfo(ctx, productID); err == nil && info.InitialStock > 0 {
+		manifest.Labels["initial_stock"] = strconv.FormatInt(info.InitialStock, 10)
+	}
+	add := func(name string, fill func(w *archive.Writer) error) {
+		w, err := archive.Create(dir, name, opts)
+		if err != nil {
+			log.Fatalf("Failed to archive %s: %v", name, err)
+		}
+		if err := fill(w); err != nil {
+			log.Fatalf("Failed to archive %s: %v", name, err)
+		}
+		file, err := w.Close()
+		if err != nil {
+			log.Fatalf("Failed to archive %s: %v", name, err)
+		}
+		manifest.Files = append(manifest.Files, file)
+		fmt.Printf("✓ %s: %d records in %d parts\n", name, file.Records, len(file.Parts))
+	}
+
+	add("buyers", func(w *archive.Writer) error {
+		buyers, err := st.BuyerRecords(ctx, productID)
+		if err != nil {
+			return err
+		}
+		for _, b := range buyers {
+			if err := w.WriteRecord(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	add("orders", func(w *archive.Writer) error {
+		orders, err := st.ProductOrders(ctx, productID)
+		if err != nil {
+			return err
+		}
+		for _, o := range orders {
+			rec := archivedOrder{
+				OrderID:   o.ID,
+				ProductID: o.ProductID,
+				UserID:    o.UserID,
+				AgentID:   o.AgentID,
+				BundleID:  o.BundleID,
+				Quantity:  o.Quantity,
+				Status:    o.Status,
+				CreatedAt: o.CreatedAt.Unix(),
+			}
+			if !o.ExpiresAt.IsZero() {
+				rec.ExpiresAt = o.ExpiresAt.Unix()
+			}
+			if err := w.WriteRecord(rec); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	add("events", func(w *archive.Writer) error {
+		return st.ProductEvents(ctx, productID, func(id string, fields map[string]interface{}) error {
+			rec := make(map[string]interface{}, len(fields)+1)
+			for k, v := range fields {
+				rec[k] = v
+			}
+			rec["id"] = id
+			return w.WriteRecord(rec)
+		})
+	})
+
+	if err := archive.WriteManifest(dir, manifest); err != nil {
+		log.Fatalf("Failed to write manifest: %v", err)
+	}
+	if len(opts.Recipients) > 0 {
+		fmt.Printf("✓ Product '%s' archived to %s (%s, encrypted to %d recipients)\n", productID, dir, opts.Compression, len(opts.Recipients))
+	} else {
+		fmt.Printf("✓ Product '%s' archived to %s (%s)\n", productID, dir, opts.Compression)
+	}
+}
+
+func verifyArchive(dir string) {
+	m, err := archive.ReadManifest(dir)
+	if err != nil {
+		log.Fatalf("Failed to open archive: %v", err)
+	}
+	if err := archive.Verify(dir, m); err != nil {
+		log.Fatalf("Archive is corrupt: %v", err)
+	}
+
+	fmt.Printf("\n=== Archive: %s ===\n", dir)
+	fmt.Printf("Created:           %s\n", m.CreatedAt.Local().Format(time.RFC3339))
+	for k, v := range m.Labels {
+		fmt.Printf("%-18s %s\n", k+":", v)
+	}
+	for _, f := range m.Files {
+		encryption := ""
+		if f.Encryption != "" {
+			encryption = ", " + f.Encryption + " encrypted"
+		}
+		fmt.Printf("%-18s %d records, %d parts, %s%s\n", f.Name+":", f.Records, len(f.Parts), f.Compression, encryption)
+	}
+	fmt.Println("✓ All checksums match")
+}
+
+// issueToken prints an HS256 auth_token for user_id, for testing servers
+// running with AUTH_HMAC_SECRET
+func issueToken(secret, subject string, ttl time.Duration, agent bool) {
+	if secret == "" {
+		log.Fatalf("AUTH_HMAC_SECRET is not set")
+	}
+	now := time.Now()
+	token, err := auth.SignHS256([]byte(secret), auth.Claims{
+		Subject:   subject,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(ttl).Unix(),
+		Agent:     agent,
+	})
+	if err != nil {
+		log.Fatalf("Failed to sign token: %v", err)
+	}
+	fmt.Println(token)
+}
+
 func printUsage() {
 	fmt.Println(`Flash Sale Setup & Admin Tool
 
 Commands:
-  init <product_id> <stock>    Initialize a product with stock
+  init <product_id> <stock> [shards] [--start t] [--end t|--ttl d]
+       [--per-user-limit n] [--sale-event id] [--paused]
+                               Initialize a product with stock, optionally
+                               split across N shard keys, and its sale
+                               policy (window RFC3339, or a ttl from the
+                               start or now), which replaces any earlier
+                               one
+  import <file> [--dry-run] [--replace]
+                               Initialize every product listed in a CSV or
+                               JSON file in one transaction, refusing
+                               existing products unless --replace is given
   status <product_id>          Show product status
+  status --all                 Show a table of every product
   reset <product_id>           Reset (delete) product data
   buyers <product_id>          List all successful buyers
+  export <product_id> [--format csv|json] [--out file]
+                               Stream buyers with their orders as CSV
+                               (default) or JSON, to stdout or a file
+  watch <product_id> [--interval d] [--recent n]
+                               Live view of stock, purchase rate and the
+                               latest buyers (default refresh 1s, 10 buyers)
+  expire-stale [--dry-run] [--payment-ttl d]
+                               Expire PENDING orders past their deadline,
+                               also those missing from the reaper's index;
+                               --payment-ttl is the PAYMENT_TTL of orders
+                               granted to the waitlist
+  order <order_id>             Show an order
+  user-orders <user_id>        Show a user's orders across products
+  audit-duplicates <product_id>
+                               Find users granted more than one unit and
+                               list the orders to refund
+  verify <product_id>          Check stock against buyers and orders and
+                               report discrepancies (exit status 1)
+  archive <product_id> <dir> [--compression none|gzip|zstd] [--part-size size]
+          [--recipient key]... [--recipients-file path]
+                               Export buyers, orders and events as
+                               checksummed JSON lines (default zstd,
+                               size accepts K/M/G), encrypted to age or
+                               SSH public keys when recipients are given
+  verify-archive <dir>         Check an archive against its manifest
+  snapshot <product_id> [--out file]
+                               Dump stock, buyers, orders and policy to a
+                               versioned JSON file, or stdout
+  restore <file|-> [--replace] Write a snapshot back in one transaction,
+                               refusing an existing product unless
+                               --replace is given
+  restock <product_id> <delta> Add delta units to a product mid-sale, or
+                               remove them if negative, keeping its buyers
+  rebalance <product_id>       Spread a sharded product's stock evenly
+  reclaim <product_id> <node_id>
+                               Return the stock allotted to a server that
+                               lost its allotment journal
+  window <product_id> <start|-> <end|->
+                               Set the advertised sale window (RFC3339)
+  close <product_id> [at|in]   End a sale now, at an RFC3339 time or after
+                               a duration; servers then freeze its stock
+  pause <product_id>           Refuse purchases of a product at once
+  resume <product_id>          Put a paused product back on sale
+  strict <product_id> on|off   Only confirm purchases once their event is
+                               durably in the events stream
+  allowlist <product_id> <file|-> [--replace] [--early-start t]
+                               Load users (one per line) who alone may buy
+                               before the sale start, from the early start
+  allowlist <product_id> --clear
+                               Drop the allowlist and early start
+  sale-event <event_id> <product_id>...
+                               Let each user buy one unit across the
+                               products of a sale event
+  sale-event --clear <product_id>...
+                               Take products out of their sale event
+  sale-event --reset <event_id>
+                               Forget who bought in a sale event
+  block user|ip <user_id|cidr>...
+                               Turn away purchases of users, or connections
+                               from addresses or CIDR ranges, on every server
+  unblock user|ip <user_id|cidr>...
+                               Remove users or ranges from the blocklist
+  blocklist                    List blocked users and ranges
+  queue <product_id> on|off    Queue purchase attempts and grant them in
+                               arrival order
+  issue-token <user_id> [ttl]  Print an HS256 auth_token for user_id
+                               (default ttl 1h)
+  issue-agent-token <agent_id> [ttl]
+                               Print an HS256 agent_token letting agent_id
+                               buy on behalf of any user (default ttl 1h)
 
 Environment:
   REDIS_ADDR                   Redis address (default: localhost:6379)
+  AUTH_HMAC_SECRET             Secret used by issue-token and
+                               issue-agent-token
+  TENANT                       Tenant whose products to manage, as named
+                               in the server's TENANTS_DIR (default: none)
+
+  --print-config               Print the effective configuration and exit
 
 Examples:
   setup init iphone15 100
+  setup init ps5 100000 16
+  setup init ps5 500 --start 2024-11-11T00:00:00Z --per-user-limit 2
   setup status iphone15
+  setup status --all
+  setup window iphone15 2024-11-11T00:00:00Z -
+  setup init ps5 500 --ttl 2h
+  setup close iphone15 30m
+  setup pause iphone15
+  setup sale-event launch iphone15-black iphone15-white iphone15-blue
+  setup block ip 203.0.113.0/24
+  setup allowlist ps5 vips.txt --early-start 2024-11-11T23:50:00Z
   setup buyers iphone15
-  setup reset iphone15
-`)
+  setup watch iphone15 --interval 500ms
+  setup verify iphone15
+  setup expire-stale --dry-run
+  setup archive iphone15 ./archive/iphone15 --part-size 256M
+  setup archive iphone15 ./archive/iphone15 --recipients-file ops.keys
+  setup snapshot iphone15 --out iphone15.snapshot.json
+  setup restore iphone15.snapshot.json --replace
+  setup reset iphone15`)
 }
-
-func getEnv(key, defaultValue string) string {
-	if value := os.Getenv(key); value != "" {
-		return value
-	}
-	return defaultValue
-}
\ No newline at end of file
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"chha/internal/store"
+)
+
+// initPolicy is the sale policy given to setup init, kept in the product's
+// meta hash and paused flag where the purchase script reads it
+type initPolicy struct {
+	SaleStart time.Time
+	SaleEnd   time.Time
+	UserLimit int64
+	SaleEvent string
+	Paused    bool
+}
+
+// parseInitFlags returns the policy flags of setup init, or nil without
+// any, which keeps the product's current policy
+func parseInitFlags(args []string) (*initPolicy, error) {
+	if len(args) == 0 {
+		return nil, nil
+	}
+	p := &initPolicy{}
+	var ttl time.Duration
+	for i := 0; i < len(args); i++ {
+		if args[i] == "--paused" {
+			p.Paused = true
+			continue
+		}
+		if i+1 >= len(args) {
+			return nil, fmt.Errorf("missing value for %s", args[i])
+		}
+		var err error
+		switch args[i] {
+		case "--start":
+			i++
+			if p.SaleStart, err = time.Parse(time.RFC3339, args[i]); err != nil {
+				return nil, fmt.Errorf("invalid start %q, expected RFC3339", args[i])
+			}
+		case "--end":
+			i++
+			if p.SaleEnd, err = time.Parse(time.RFC3339, args[i]); err != nil {
+				return nil, fmt.Errorf("invalid end %q, expected RFC3339", args[i])
+			}
+		case "--ttl":
+			i++
+			if ttl, err = time.ParseDuration(args[i]); err != nil || ttl <= 0 {
+				return nil, fmt.Errorf("invalid ttl %q", args[i])
+			}
+		case "--per-user-limit":
+			i++
+			p.UserLimit, err = strconv.ParseInt(args[i], 10, 64)
+			if err != nil || p.UserLimit < 0 {
+				return nil, fmt.Errorf("invalid per-user limit %q", args[i])
+			}
+		case "--sale-event":
+			i++
+			if p.SaleEvent = args[i]; p.SaleEvent == "" || strings.ContainsAny(p.SaleEvent, " \t:{}") {
+				return nil, fmt.Errorf("invalid sale event %q", args[i])
+			}
+		default:
+			return nil, fmt.Errorf("unknown flag: %s", args[i])
+		}
+	}
+	if ttl > 0 {
+		// The sale runs for ttl from its start, or from now without one
+		if !p.SaleEnd.IsZero() {
+			return nil, fmt.Errorf("--ttl and --end are mutually exclusive")
+		}
+		from := p.SaleStart
+		if from.IsZero() {
+			from = time.Now()
+		}
+		p.SaleEnd = from.Add(ttl).Truncate(time.Second)
+	}
+	if !p.SaleStart.IsZero() && !p.SaleEnd.IsZero() && !p.SaleEnd.After(p.SaleStart) {
+		return nil, fmt.Errorf("sale end must be after start")
+	}
+	return p, nil
+}
+
+// initWithPolicy initializes a product and replaces its policy in one
+// transaction, as an import of that product alone
+func initWithPolicy(ctx context.Context, st *store.RedisStore, spec store.ProductSpec) {
+	if err := st.ImportProducts(ctx, []store.ProductSpec{spec}); err != nil {
+		log.Fatalf("Failed to init product: %v", err)
+	}
+
+	info := store.ProductInfo{SaleStart: spec.SaleStart, SaleEnd: spec.SaleEnd, Paused: spec.Paused, Stock: spec.Stock}
+	if spec.Shards > 0 {
+		fmt.Printf("✓ Product '%s' initialized with %d units across %d shards\n", spec.ID, spec.Stock, spec.Shards)
+	} else {
+		fmt.Printf("✓ Product '%s' initialized with %d units\n", spec.ID, spec.Stock)
+	}
+	fmt.Printf("  Sale Window:    %s\n", info.Window())
+	if spec.UserLimit > 0 {
+		fmt.Printf("  Per-User Limit: %d\n", spec.UserLimit)
+	}
+	if spec.SaleEvent != "" {
+		fmt.Printf("  Sale Event:     %s\n", spec.SaleEvent)
+	}
+	fmt.Printf("  State:          %s\n", info.State(time.Now()))
+}
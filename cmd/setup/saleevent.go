@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"chha/internal/store"
+)
+
+// setSaleEvent puts products in sale event eventID, or takes them out of
+// theirs with an empty eventID
+func setSaleEvent(ctx context.Context, st *store.RedisStore, eventID string, productIDs []string) {
+	if strings.ContainsAny(eventID, " \t:{}") {
+		fmt.Printf("Invalid sale event %q: it must not contain spaces, ':' or braces\n", eventID)
+		os.Exit(1)
+	}
+	for _, id := range productIDs {
+		if err := st.SetSaleEvent(ctx, id, eventID); err != nil {
+			log.Fatalf("Failed to set sale event of %s: %v", id, err)
+		}
+	}
+	if eventID == "" {
+		fmt.Printf("✓ %d products left their sale event\n", len(productIDs))
+		return
+	}
+	fmt.Printf("✓ %d products are in sale event '%s', each user can buy one unit across them\n", len(productIDs), eventID)
+}
+
+// resetSaleEvent lets every user buy in a sale event again
+func resetSaleEvent(ctx context.Context, st *store.RedisStore, eventID string) {
+	n, err := st.SaleEventBuyers(ctx, eventID)
+	if err != nil {
+		log.Fatalf("Failed to count sale event buyers: %v", err)
+	}
+	if err := st.ResetSaleEvent(ctx, eventID); err != nil {
+		log.Fatalf("Failed to reset sale event: %v", err)
+	}
+	fmt.Printf("✓ Sale event '%s' reset, %d buyers may buy again\n", eventID, n)
+}
+
+// showSaleEventLine prints the status line of a product's sale event
+func showSaleEventLine(ctx context.Context, st *store.RedisStore, eventID string) {
+	n, err := st.SaleEventBuyers(ctx, eventID)
+	if err != nil {
+		log.Fatalf("Failed to count sale event buyers: %v", err)
+	}
+	fmt.Printf("Sale Event:        %s, %d buyers across its products\n", eventID, n)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"chha/internal/snowflake"
+	"chha/internal/store"
+)
+
+// staleOptions are the flags of expire-stale
+type staleOptions struct {
+	dryRun bool
+	// paymentTTL is the deadline of orders granted to waitlisted users
+	paymentTTL time.Duration
+}
+
+func parseStaleFlags(args []string) (staleOptions, error) {
+	var opts staleOptions
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--dry-run":
+			opts.dryRun = true
+		case "--payment-ttl":
+			if i+1 >= len(args) {
+				return opts, fmt.Errorf("missing value for %s", args[i])
+			}
+			i++
+			ttl, err := time.ParseDuration(args[i])
+			if err != nil || (ttl != 0 && ttl < time.Second) {
+				return opts, fmt.Errorf("invalid payment TTL: %s", args[i])
+			}
+			opts.paymentTTL = ttl
+		default:
+			return opts, fmt.Errorf("unknown flag: %s", args[i])
+		}
+	}
+	return opts, nil
+}
+
+// expireStale expires what the reaper left behind. Units freed while
+// someone waits are granted to them as the servers would, so the store
+// needs the servers' PAYMENT_TTL; its order IDs come from the last
+// snowflake node, which servers should leave to this tool.
+func expireStale(ctx context.Context, client *redis.Client, tenant string, opts staleOptions) {
+	ids, _ := snowflake.New(snowflake.MaxNode)
+	st, err := store.NewRedisStore(ctx, client, store.RedisStoreOptions{
+		Tenant:     tenant,
+		OrderIDs:   ids,
+		PaymentTTL: opts.paymentTTL,
+	})
+	if err != nil {
+		log.Fatalf("Failed to create store: %v", err)
+	}
+
+	if opts.dryRun {
+		stale, err := st.StaleOrders(ctx, nil)
+		if err != nil {
+			log.Fatalf("Failed to find stale orders: %v", err)
+		}
+		if len(stale) == 0 {
+			fmt.Println("No stale orders")
+			return
+		}
+
+		now := time.Now()
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ORDER\tPRODUCT\tUSER\tDEADLINE\tOVERDUE\tINDEXED")
+		unindexed := 0
+		for _, o := range stale {
+			indexed := "yes"
+			if o.Unindexed {
+				indexed = "no"
+				unindexed++
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", o.ID, o.ProductID, o.UserID,
+				o.ExpiresAt.Format(time.RFC3339), now.Sub(o.ExpiresAt).Truncate(time.Second), indexed)
+		}
+		w.Flush()
+		fmt.Printf("\n%d stale orders, %d missing from the pending index; nothing was changed\n", len(stale), unindexed)
+		return
+	}
+
+	sweep, err := st.ExpireStaleOrders(ctx, nil)
+	granted := 0
+	for _, e := range sweep.Expired {
+		if e.Grant != nil {
+			granted++
+			fmt.Printf("  %s (%s, %s) → granted to %s as order %s\n", e.ID, e.ProductID, e.UserID, e.Grant.Order.UserID, e.Grant.Order.ID)
+		} else {
+			fmt.Printf("  %s (%s, %s) → restocked\n", e.ID, e.ProductID, e.UserID)
+		}
+	}
+	if err != nil {
+		log.Fatalf("Failed to expire stale orders after %d: %v", len(sweep.Expired), err)
+	}
+	fmt.Printf("✓ Expired %d stale orders (%d missing from the pending index), %d granted to the waitlist\n",
+		len(sweep.Expired), sweep.Unindexed, granted)
+}
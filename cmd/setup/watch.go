@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"chha/internal/store"
+)
+
+// eventsChannel is the pub/sub channel the server publishes sale events on
+const eventsChannel = "flashsale_events"
+
+// watchHistory is how many seconds of purchase counts the view keeps, one
+// sparkline cell each
+const watchHistory = 60
+
+// sparkBlocks draw the purchase rate history, lowest first
+var sparkBlocks = []rune("▁▂▃▄▅▆▇█")
+
+// watchOptions are the flags of setup watch
+type watchOptions struct {
+	interval time.Duration
+	recent   int
+}
+
+func parseWatchFlags(args []string) (watchOptions, error) {
+	opts := watchOptions{interval: time.Second, recent: 10}
+	for i := 0; i < len(args); i++ {
+		if i+1 >= len(args) {
+			return opts, fmt.Errorf("missing value for %s", args[i])
+		}
+		switch args[i] {
+		case "--interval":
+			i++
+			d, err := time.ParseDuration(args[i])
+			if err != nil || d < 100*time.Millisecond {
+				return opts, fmt.Errorf("invalid interval %q, expected a duration of at least 100ms", args[i])
+			}
+			opts.interval = d
+		case "--recent":
+			i++
+			n, err := strconv.Atoi(args[i])
+			if err != nil || n < 0 {
+				return opts, fmt.Errorf("invalid recent count %q", args[i])
+			}
+			opts.recent = n
+		default:
+			return opts, fmt.Errorf("unknown flag: %s", args[i])
+		}
+	}
+	return opts, nil
+}
+
+// saleEvent is the part of a flashsale_events message the view uses
+type saleEvent struct {
+	Type      string `json:"type"`
+	ProductID string `json:"product_id"`
+	Buyer     string `json:"buyer"`
+	OrderID   string `json:"order_id"`
+	Remaining int64  `json:"remaining"`
+}
+
+// watchBuyer is one line of the recent buyers list
+type watchBuyer struct {
+	at        time.Time
+	buyer     string
+	orderID   string
+	remaining int64
+}
+
+// watchView is the state behind the live view of one product. Stock
+// comes from the store on every refresh, and from purchase events in
+// between; cancellations and expiries send events without the stock.
+type watchView struct {
+	productID string
+	started   time.Time
+	info      store.ProductInfo
+
+	// counts are purchases per second, counts[0] being the current one
+	counts     [watchHistory]int64
+	second     int64
+	peak       int64
+	purchases  int64
+	returned   int64
+	confirmed  int64
+	soldOutAt  time.Time
+	recent     []watchBuyer
+	recentSize int
+}
+
+// tick moves the per-second counts forward to now
+func (v *watchView) tick(now time.Time) {
+	sec := now.Unix()
+	for v.second < sec {
+		v.second++
+		v.peak = max(v.peak, v.counts[0])
+		copy(v.counts[1:], v.counts[:watchHistory-1])
+		v.counts[0] = 0
+	}
+}
+
+func (v *watchView) apply(ev saleEvent, now time.Time) {
+	v.tick(now)
+	switch ev.Type {
+	case "purchase":
+		v.purchases++
+		v.counts[0]++
+		v.info.Stock = ev.Remaining
+		if ev.Remaining == 0 && v.soldOutAt.IsZero() {
+			v.soldOutAt = now
+		}
+		if v.recentSize > 0 {
+			v.recent = append([]watchBuyer{{at: now, buyer: ev.Buyer, orderID: ev.OrderID, remaining: ev.Remaining}}, v.recent...)
+			if len(v.recent) > v.recentSize {
+				v.recent = v.recent[:v.recentSize]
+			}
+		}
+	case "purchase_cancelled", "order_expired", "overdraft_cancelled", "order_rejected":
+		v.returned++
+	case "order_confirmed":
+		v.confirmed++
+	}
+}
+
+// rate is the mean purchases per second over the last n whole seconds
+func (v *watchView) rate(n int) float64 {
+	var sum int64
+	for _, c := range v.counts[1 : n+1] {
+		sum += c
+	}
+	return float64(sum) / float64(n)
+}
+
+func (v *watchView) sparkline() string {
+	var top int64
+	for _, c := range v.counts {
+		top = max(top, c)
+	}
+	var b strings.Builder
+	for i := watchHistory - 1; i >= 0; i-- {
+		c := v.counts[i]
+		switch {
+		case c == 0:
+			b.WriteRune(' ')
+		case top == 0:
+			b.WriteRune(sparkBlocks[0])
+		default:
+			b.WriteRune(sparkBlocks[int(c*int64(len(sparkBlocks)-1)/top)])
+		}
+	}
+	return b.String()
+}
+
+func (v *watchView) render(now time.Time) []byte {
+	var b bytes.Buffer
+	// Home the cursor and clear the screen, so each frame replaces the last
+	b.WriteString("\033[H\033[2J")
+
+	fmt.Fprintf(&b, "=== Watching: %s ===  %s  (Ctrl-C to stop)\n\n", v.productID, now.Format("15:04:05"))
+	fmt.Fprintf(&b, "State:             %s\n", v.info.State(now))
+	if v.info.Tracked && v.info.InitialStock > 0 {
+		sold := v.info.InitialStock - v.info.Stock
+		fmt.Fprintf(&b, "Remaining Stock:   %d / %d  %s %.0f%% sold\n", v.info.Stock, v.info.InitialStock,
+			stockBar(v.info.Stock, v.info.InitialStock, 20), 100*float64(sold)/float64(v.info.InitialStock))
+	} else {
+		fmt.Fprintf(&b, "Remaining Stock:   %d\n", v.info.Stock)
+	}
+	fmt.Fprintf(&b, "Successful Buyers: %d\n", v.info.Buyers)
+	if !v.soldOutAt.IsZero() {
+		fmt.Fprintf(&b, "Sold Out:          %s, %s into the watch\n", v.soldOutAt.Format("15:04:05"), v.soldOutAt.Sub(v.started).Truncate(time.Second))
+	}
+
+	fmt.Fprintf(&b, "\nPurchases/s:       %d last second, %.1f over 10s, %d peak\n", v.counts[1], v.rate(10), v.peak)
+	fmt.Fprintf(&b, "Last %ds:          |%s|\n", watchHistory, v.sparkline())
+	fmt.Fprintf(&b, "Since %s:    %d purchases, %d confirmed, %d cancelled or expired\n",
+		v.started.Format("15:04:05"), v.purchases, v.confirmed, v.returned)
+
+	if v.recentSize > 0 {
+		fmt.Fprintf(&b, "\nRecent Buyers:\n")
+		if len(v.recent) == 0 {
+			fmt.Fprintf(&b, "  (none yet)\n")
+		} else {
+			w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "  TIME\tBUYER\tORDER\tREMAINING")
+			for _, r := range v.recent {
+				fmt.Fprintf(w, "  %s\t%s\t%s\t%d\n", r.at.Format("15:04:05"), r.buyer, r.orderID, r.remaining)
+			}
+			w.Flush()
+		}
+	}
+	return b.Bytes()
+}
+
+// stockBar draws the share of stock left as a bar of width cells
+func stockBar(stock, initial int64, width int) string {
+	filled := 0
+	if initial > 0 && stock > 0 {
+		filled = int(min(stock, initial) * int64(width) / initial)
+	}
+	return "[" + strings.Repeat("█", filled) + strings.Repeat("░", width-filled) + "]"
+}
+
+// watchProduct renders a live view of a product's sale until interrupted.
+// Purchase rates and buyers come from the flashsale_events channel, so
+// they only cover what happened since the watch started; pub/sub also
+// drops messages while the connection is down. The stock and buyer count
+// are read from the store on every refresh and are always exact.
+func watchProduct(ctx context.Context, client *redis.Client, st *store.RedisStore, productID string, opts watchOptions) {
+	ctx, cancel := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	info, err := st.ProductInfo(ctx, productID)
+	if errors.Is(err, store.ErrProductNotFound) {
+		fmt.Printf("Product '%s' not found\n", productID)
+		os.Exit(1)
+	} else if err != nil {
+		log.Fatalf("Failed to get product: %v", err)
+	}
+
+	channel := store.TenantPrefix(st.Tenant()) + eventsChannel
+	sub := client.Subscribe(ctx, channel)
+	defer sub.Close()
+	if _, err := sub.Receive(ctx); err != nil {
+		log.Fatalf("Failed to subscribe to %s: %v", channel, err)
+	}
+	// A large buffer rides out bursts while a frame is drawn
+	msgs := sub.Channel(redis.WithChannelSize(10000))
+
+	now := time.Now()
+	v := &watchView{productID: productID, started: now, info: info, second: now.Unix(), recentSize: opts.recent}
+	os.Stdout.Write(v.render(now))
+
+	ticker := time.NewTicker(opts.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			fmt.Println()
+			return
+		case msg, ok := <-msgs:
+			if !ok {
+				return
+			}
+			var ev saleEvent
+			if json.Unmarshal([]byte(msg.Payload), &ev) != nil || ev.ProductID != productID {
+				continue
+			}
+			v.apply(ev, time.Now())
+		case <-ticker.C:
+			now := time.Now()
+			if info, err := st.ProductInfo(ctx, productID); err == nil {
+				v.info = info
+				if info.Stock == 0 && v.purchases > 0 && v.soldOutAt.IsZero() {
+					v.soldOutAt = now
+				}
+			} else if ctx.Err() == nil {
+				log.Printf("Failed to refresh product: %v", err)
+			}
+			v.tick(now)
+			os.Stdout.Write(v.render(now))
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"chha/pkg/client"
+	"chha/pkg/protocol"
+)
+
+// maxRateLimitWait caps how long a purchase waits out RATE_LIMITED or BUSY
+// before the storefront gives up and shows the shopper the result
+const maxRateLimitWait = 3 * time.Second
+
+// shopClient is a storefront's pool of connections to the flash sale
+// server, with the purchase flow a shop wants on top
+type shopClient struct {
+	*client.Client
+	// signs is set when the storefront signs its shoppers' tokens, which
+	// looking up their orders needs
+	signs bool
+}
+
+// purchaseResult is the server's purchase response, also sent to the page
+type purchaseResult struct {
+	*client.PurchaseResult
+	// Recovered is set when the response was lost and the order was
+	// found among the user's orders instead
+	Recovered bool `json:"recovered,omitempty"`
+}
+
+// newShopClient returns a client of the server at addr. With authSecret,
+// the server's AUTH_HMAC_SECRET, every shopper gets a short-lived token; a
+// real storefront would get it from its identity provider instead.
+func newShopClient(addr, authSecret string) *shopClient {
+	opts := []client.Option{client.WithName("storefront")}
+	if authSecret != "" {
+		opts = append(opts, client.WithHMACSecret(authSecret))
+	}
+	return &shopClient{Client: client.New(addr, opts...), signs: authSecret != ""}
+}
+
+// Purchase buys one unit for userID under the click's idempotency key, so
+// servers with idempotency keys answer a retried click without selling a
+// second unit, and waits out short rate limits. Without them, a purchase
+// whose connection failed after it was sent may still have sold the unit,
+// so the user's orders are checked before trying again.
+func (c *shopClient) Purchase(ctx context.Context, productID, userID, key string) (*purchaseResult, error) {
+	started := time.Now()
+	for attempt := 0; ; attempt++ {
+		resp, err := c.PurchaseWithKey(ctx, productID, userID, key)
+		if errors.Is(err, client.ErrOutcomeUnknown) && attempt == 0 {
+			if order, lookupErr := c.findOrder(ctx, productID, userID, started); lookupErr != nil {
+				return nil, err
+			} else if order != nil {
+				return &purchaseResult{
+					PurchaseResult: &client.PurchaseResult{Status: protocol.STATUS_SUCCESS, OrderID: order.OrderID},
+					Recovered:      true,
+				}, nil
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		wait := time.Duration(resp.RetryAfterMs) * time.Millisecond
+		limited := resp.Status == protocol.STATUS_RATE_LIMITED || resp.Status == protocol.STATUS_BUSY
+		if !limited || time.Since(started)+wait > maxRateLimitWait {
+			return &purchaseResult{PurchaseResult: resp}, nil
+		}
+		select {
+		case <-ctx.Done():
+			return &purchaseResult{PurchaseResult: resp}, nil
+		case <-time.After(wait):
+		}
+	}
+}
+
+// findOrder returns the user's order of productID created since since,
+// if any. It needs purchase authentication, as GET_USER_ORDERS does.
+func (c *shopClient) findOrder(ctx context.Context, productID, userID string, since time.Time) (*client.UserOrder, error) {
+	if !c.signs {
+		return nil, errors.New("orders can't be looked up without AUTH_HMAC_SECRET")
+	}
+	orders, err := c.UserOrders(ctx, userID, 10)
+	if err != nil {
+		return nil, fmt.Errorf("find order: %w", err)
+	}
+	for _, o := range orders {
+		if o.ProductID == productID && o.CreatedAt >= since.Unix() {
+			return &o, nil
+		}
+	}
+	return nil, nil
+}
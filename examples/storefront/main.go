@@ -0,0 +1,411 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"chha/pkg/client"
+	"chha/pkg/protocol"
+)
+
+// Example storefront in front of the flash sale server.
+//
+// A buy button posts to /api/buy, which the storefront turns into an
+// ATTEMPT_PURCHASE. Every click carries an Idempotency-Key, so a shopper
+// clicking twice, or a browser retrying after a timeout, gets the first
+// result back instead of buying twice. The page then polls /api/orders/{id}
+// until the order settles. Stock updates reach the page over server-sent
+// events, fed by the events the server pushes and by polling GET_STOCK.
+
+const (
+	// idempotencyTTL is how long a purchase result is kept for its key
+	idempotencyTTL = 10 * time.Minute
+
+	shopperCookie = "shopper"
+)
+
+//go:embed index.html
+var indexHTML []byte
+
+func main() {
+	listenAddr := getEnv("LISTEN_ADDR", ":3000")
+	serverAddr := getEnv("SERVER_ADDR", "localhost:8080")
+
+	stockPoll, err := time.ParseDuration(getEnv("STOCK_POLL_INTERVAL", "5s"))
+	if err != nil || stockPoll <= 0 {
+		log.Fatalf("Invalid STOCK_POLL_INTERVAL: %s", os.Getenv("STOCK_POLL_INTERVAL"))
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	shop := newStorefront(newShopClient(serverAddr, os.Getenv("AUTH_HMAC_SECRET")))
+	go shop.subscribe(ctx)
+	go shop.pollStock(ctx, stockPoll)
+
+	srv := &http.Server{Addr: listenAddr, Handler: shop.routes()}
+	go func() {
+		<-ctx.Done()
+		shutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdown)
+	}()
+
+	log.Printf("Storefront on %s, buying from %s", listenAddr, serverAddr)
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Fatalf("Storefront failed: %v", err)
+	}
+}
+
+type storefront struct {
+	client *shopClient
+
+	mu      sync.Mutex
+	results map[string]*idempotentResult
+
+	stock *stockHub
+}
+
+func newStorefront(c *shopClient) *storefront {
+	return &storefront{
+		client:  c,
+		results: make(map[string]*idempotentResult),
+		stock:   newStockHub(),
+	}
+}
+
+// routes serves the page and the API it calls
+func (s *storefront) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(indexHTML)
+	})
+	mux.HandleFunc("GET /api/products", s.handleProducts)
+	mux.HandleFunc("POST /api/buy", s.handleBuy)
+	mux.HandleFunc("GET /api/orders/{id}", s.handleOrder)
+	mux.HandleFunc("POST /api/orders/{id}/pay", s.handlePay)
+	mux.HandleFunc("GET /api/stock", s.handleStockEvents)
+	return mux
+}
+
+// idempotentResult is the outcome of the first purchase made with a key.
+// Requests repeating the key wait on done and get the same outcome.
+type idempotentResult struct {
+	done    chan struct{}
+	result  *purchaseResult
+	err     error
+	expires time.Time
+}
+
+// handleBuy serves POST /api/buy {"product_id": ...}. The Idempotency-Key
+// header is required: the page makes one per click.
+func (s *storefront) handleBuy(w http.ResponseWriter, r *http.Request) {
+	userID := shopper(w, r)
+	key := r.Header.Get("Idempotency-Key")
+	if key == "" || len(key) > 128 {
+		writeJSONError(w, http.StatusBadRequest, "Idempotency-Key header is required")
+		return
+	}
+	var req struct {
+		ProductID string `json:"product_id"`
+		// VerificationToken is the page's captcha response, for servers
+		// with VERIFY_URL
+		VerificationToken string `json:"verification_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ProductID == "" {
+		writeJSONError(w, http.StatusBadRequest, "product_id is required")
+		return
+	}
+
+	slot := userID + "/" + req.ProductID + "/" + key
+	entry, first := s.claim(slot)
+	if first {
+		ctx := client.WithVerificationToken(r.Context(), req.VerificationToken)
+		entry.result, entry.err = s.client.Purchase(ctx, req.ProductID, userID, key)
+		if entry.err != nil {
+			// Only failures are forgotten, so the page can retry with the
+			// same key once the server is reachable again
+			s.mu.Lock()
+			delete(s.results, slot)
+			s.mu.Unlock()
+		}
+		close(entry.done)
+		if entry.err == nil && entry.result.Status == protocol.STATUS_SUCCESS {
+			s.stock.set(req.ProductID, entry.result.RemainingStock)
+		}
+	}
+
+	select {
+	case <-entry.done:
+	case <-r.Context().Done():
+		return
+	}
+	if entry.err != nil {
+		log.Printf("Purchase failed: product=%s user=%s: %v", req.ProductID, userID, entry.err)
+		writeJSONError(w, http.StatusBadGateway, "the sale is unreachable, try again")
+		return
+	}
+	if !first {
+		w.Header().Set("Idempotent-Replayed", "true")
+	}
+	writeJSON(w, http.StatusOK, entry.result)
+}
+
+// claim returns the result slot of key, and whether this request is the
+// first with it and has to fill it
+func (s *storefront) claim(key string) (*idempotentResult, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if entry, ok := s.results[key]; ok && now.Before(entry.expires) {
+		return entry, false
+	}
+	for k, entry := range s.results {
+		if now.After(entry.expires) {
+			delete(s.results, k)
+		}
+	}
+	entry := &idempotentResult{done: make(chan struct{}), expires: now.Add(idempotencyTTL)}
+	s.results[key] = entry
+	return entry, true
+}
+
+// handleOrder serves GET /api/orders/{id}, which the page polls until the
+// order is CONFIRMED, CANCELLED or EXPIRED. A queued purchase has no order
+// until the queue reaches it, so "order not found" means keep polling.
+func (s *storefront) handleOrder(w http.ResponseWriter, r *http.Request) {
+	order, err := s.client.Order(r.Context(), r.PathValue("id"), shopper(w, r))
+	if err != nil {
+		writeJSONError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, order)
+}
+
+// handlePay serves POST /api/orders/{id}/pay. Payment itself is out of
+// scope; the storefront confirms the order straight away.
+func (s *storefront) handlePay(w http.ResponseWriter, r *http.Request) {
+	order, err := s.client.ConfirmPayment(r.Context(), r.PathValue("id"), shopper(w, r))
+	if err != nil {
+		writeJSONError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, order)
+}
+
+func (s *storefront) handleProducts(w http.ResponseWriter, r *http.Request) {
+	products, err := s.client.Products(r.Context())
+	if err != nil {
+		writeJSONError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	for _, p := range products {
+		s.stock.track(p.ProductID, p.StockHint)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"products": products})
+}
+
+// handleStockEvents serves GET /api/stock as server-sent events, one
+// {"product_id", "stock"} object per change, starting with every known
+// product
+func (s *storefront) handleStockEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSONError(w, http.StatusInternalServerError, "streaming unsupported")
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	updates, current := s.stock.subscribe()
+	defer s.stock.unsubscribe(updates)
+
+	send := func(u stockUpdate) bool {
+		data, _ := json.Marshal(u)
+		if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+			return false
+		}
+		flusher.Flush()
+		return true
+	}
+	for _, u := range current {
+		if !send(u) {
+			return
+		}
+	}
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case u := <-updates:
+			if !send(u) {
+				return
+			}
+		}
+	}
+}
+
+// subscribe follows the stock events the server pushes. Events are missed
+// while the client reconnects, so pollStock still corrects the stock now
+// and then.
+func (s *storefront) subscribe(ctx context.Context) {
+	for ctx.Err() == nil {
+		events, err := s.client.Events(ctx)
+		if errors.Is(err, client.ErrNoEvents) {
+			log.Printf("Server pushes no events, stock is only polled")
+			return
+		}
+		if err != nil {
+			// Not up yet; the channel reconnects by itself once open
+			select {
+			case <-ctx.Done():
+			case <-time.After(5 * time.Second):
+			}
+			continue
+		}
+		for ev := range events {
+			if ev.Type == protocol.EVENT_STOCK {
+				s.stock.set(ev.ProductID, ev.Stock)
+			}
+		}
+	}
+}
+
+// pollStock reads the stock of every product shown so far
+func (s *storefront) pollStock(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, productID := range s.stock.products() {
+			if stock, err := s.client.Stock(ctx, productID); err == nil {
+				s.stock.set(productID, stock)
+			}
+		}
+	}
+}
+
+type stockUpdate struct {
+	ProductID string `json:"product_id"`
+	Stock     int64  `json:"stock"`
+}
+
+// stockHub keeps the last known stock per product and fans changes out to
+// the open event streams
+type stockHub struct {
+	mu    sync.Mutex
+	stock map[string]int64
+	subs  map[chan stockUpdate]struct{}
+}
+
+func newStockHub() *stockHub {
+	return &stockHub{
+		stock: make(map[string]int64),
+		subs:  make(map[chan stockUpdate]struct{}),
+	}
+}
+
+// track starts following a product without announcing it
+func (h *stockHub) track(productID string, stock int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.stock[productID]; !ok {
+		h.stock[productID] = stock
+	}
+}
+
+// set records a product's stock and announces it if it changed. Only
+// products already tracked are followed, so events of products the page
+// never listed are ignored.
+func (h *stockHub) set(productID string, stock int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if prev, ok := h.stock[productID]; !ok || prev == stock {
+		return
+	}
+	h.stock[productID] = stock
+	for ch := range h.subs {
+		select {
+		case ch <- stockUpdate{ProductID: productID, Stock: stock}:
+		default:
+			// A slow page misses this update and catches the next one
+		}
+	}
+}
+
+func (h *stockHub) products() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ids := make([]string, 0, len(h.stock))
+	for id := range h.stock {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func (h *stockHub) subscribe() (chan stockUpdate, []stockUpdate) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ch := make(chan stockUpdate, 64)
+	h.subs[ch] = struct{}{}
+	current := make([]stockUpdate, 0, len(h.stock))
+	for id, stock := range h.stock {
+		current = append(current, stockUpdate{ProductID: id, Stock: stock})
+	}
+	return ch, current
+}
+
+func (h *stockHub) unsubscribe(ch chan stockUpdate) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subs, ch)
+}
+
+// shopper returns the shopper's ID, assigning one in a cookie on the first
+// visit. A real storefront would use its login session.
+func shopper(w http.ResponseWriter, r *http.Request) string {
+	if c, err := r.Cookie(shopperCookie); err == nil && c.Value != "" {
+		return c.Value
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	id := "shopper_" + hex.EncodeToString(b)
+	http.SetCookie(w, &http.Cookie{Name: shopperCookie, Value: id, Path: "/", HttpOnly: true, SameSite: http.SameSiteStrictMode})
+	r.AddCookie(&http.Cookie{Name: shopperCookie, Value: id})
+	return id
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, map[string]string{"error": msg})
+}
+
+func getEnv(key, defaultValue string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+	return defaultValue
+}
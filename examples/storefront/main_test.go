@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+
+	"chha/internal/config"
+	"chha/internal/server"
+	"chha/internal/store"
+	"chha/pkg/client"
+	"chha/pkg/protocol"
+)
+
+// startSale runs a server on an in-process Redis, as cmd/demo does, with
+// stock units of each product on sale, and returns a storefront in front
+// of it
+func startSale(t *testing.T, stock int64, productIDs ...string) *httptest.Server {
+	t.Helper()
+	ctx := context.Background()
+
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+	st, err := store.NewRedisStore(ctx, rdb, store.RedisStoreOptions{})
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	specs := make([]store.ProductSpec, len(productIDs))
+	for i, id := range productIDs {
+		specs[i] = store.ProductSpec{ID: id, Stock: stock, UserLimit: 1}
+	}
+	if err := st.ImportProducts(ctx, specs); err != nil {
+		t.Fatalf("failed to init product: %v", err)
+	}
+
+	var opts config.Server
+	if err := config.Load(&opts); err != nil {
+		t.Fatalf("invalid configuration: %v", err)
+	}
+	opts.RedisAddr = mr.Addr()
+	opts.ListenAddr = "127.0.0.1:0"
+	opts.MetricsAddr = "127.0.0.1:0"
+	opts.DebugAddr = ""
+	srv, err := server.NewServer(opts, "")
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	srv.Start()
+	t.Cleanup(srv.Shutdown)
+
+	shop := newShopClient(srv.Addr().String(), "")
+	t.Cleanup(func() { shop.Close() })
+	web := httptest.NewServer(newStorefront(shop).routes())
+	t.Cleanup(web.Close)
+	return web
+}
+
+// buy posts one click of shopper to /api/buy
+func buy(t *testing.T, web *httptest.Server, shopper, productID, key string) (*http.Response, purchaseResult) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodPost, web.URL+"/api/buy", strings.NewReader(`{"product_id":"`+productID+`"}`))
+	req.AddCookie(&http.Cookie{Name: shopperCookie, Value: shopper})
+	if key != "" {
+		req.Header.Set("Idempotency-Key", key)
+	}
+	resp, err := web.Client().Do(req)
+	if err != nil {
+		t.Fatalf("POST /api/buy: %v", err)
+	}
+	defer resp.Body.Close()
+
+	result := purchaseResult{PurchaseResult: &client.PurchaseResult{}}
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			t.Fatalf("failed to decode purchase result: %v", err)
+		}
+	}
+	return resp, result
+}
+
+func TestBuyFlow(t *testing.T) {
+	web := startSale(t, 2, "tee", "mug")
+
+	if resp, _ := buy(t, web, "alice", "tee", ""); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("buy without Idempotency-Key: HTTP %d, want 400", resp.StatusCode)
+	}
+
+	resp, first := buy(t, web, "alice", "tee", "click-1")
+	if resp.StatusCode != http.StatusOK || first.Status != protocol.STATUS_SUCCESS || first.OrderID == "" {
+		t.Fatalf("first click: HTTP %d, %+v, want SUCCESS with an order", resp.StatusCode, first.PurchaseResult)
+	}
+	if first.RemainingStock != 1 {
+		t.Fatalf("remaining stock = %d, want 1", first.RemainingStock)
+	}
+
+	// A double click gets the first result back, not a second unit
+	resp, again := buy(t, web, "alice", "tee", "click-1")
+	if resp.Header.Get("Idempotent-Replayed") != "true" || again.OrderID != first.OrderID {
+		t.Fatalf("repeated click: replayed %q, order %q, want the replayed order %q",
+			resp.Header.Get("Idempotent-Replayed"), again.OrderID, first.OrderID)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, web.URL+"/api/orders/"+first.OrderID, nil)
+	req.AddCookie(&http.Cookie{Name: shopperCookie, Value: "alice"})
+	orderResp, err := web.Client().Do(req)
+	if err != nil {
+		t.Fatalf("GET /api/orders: %v", err)
+	}
+	var order client.OrderStatus
+	json.NewDecoder(orderResp.Body).Decode(&order)
+	orderResp.Body.Close()
+	if order.OrderID != first.OrderID || order.ProductID != "tee" {
+		t.Fatalf("order = %+v, want %s of tee", order, first.OrderID)
+	}
+
+	// The same key sent for another product buys it rather than replaying
+	// the first purchase
+	resp, mug := buy(t, web, "alice", "mug", "click-1")
+	if resp.Header.Get("Idempotent-Replayed") != "" || mug.Status != protocol.STATUS_SUCCESS || mug.OrderID == first.OrderID {
+		t.Fatalf("same key for mug: replayed %q, %+v, want a new SUCCESS",
+			resp.Header.Get("Idempotent-Replayed"), mug.PurchaseResult)
+	}
+
+	// A new click of the same shopper is a new purchase, refused by the
+	// per-user limit
+	if _, r := buy(t, web, "alice", "tee", "click-2"); r.Status == protocol.STATUS_SUCCESS {
+		t.Fatal("second unit sold past the per-user limit")
+	}
+
+	if _, r := buy(t, web, "bob", "tee", "click-1"); r.Status != protocol.STATUS_SUCCESS {
+		t.Fatalf("bob's click: %s, want SUCCESS", r.Status)
+	}
+	if _, r := buy(t, web, "carol", "tee", "click-1"); r.Status != protocol.STATUS_SOLD_OUT {
+		t.Fatalf("carol's click: %s, want SOLD_OUT", r.Status)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Example consumer-group reader for the flashsale:events stream.
+//
+// Run several copies with the same CONSUMER_GROUP and distinct
+// CONSUMER_NAME values to share the work. Each event is acknowledged only
+// after it has been handled, so a consumer that crashes mid-event leaves it
+// pending, and another consumer claims it after CLAIM_IDLE.
+
+const stream = "flashsale:events"
+
+func main() {
+	redisAddr := getEnv("REDIS_ADDR", "localhost:6379")
+	group := getEnv("CONSUMER_GROUP", "orders")
+	consumer := getEnv("CONSUMER_NAME", hostname())
+
+	claimIdle, err := time.ParseDuration(getEnv("CLAIM_IDLE", "30s"))
+	if err != nil {
+		log.Fatalf("Invalid CLAIM_IDLE: %v", err)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	client := redis.NewClient(&redis.Options{Addr: redisAddr})
+	defer client.Close()
+
+	// Create the group at the start of the stream so no history is skipped.
+	// MKSTREAM lets consumers start before the first purchase.
+	err = client.XGroupCreateMkStream(ctx, stream, group, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		log.Fatalf("Failed to create consumer group: %v", err)
+	}
+
+	log.Printf("Consuming %s as %s/%s", stream, group, consumer)
+
+	for ctx.Err() == nil {
+		// Take over events abandoned by crashed consumers first
+		claimed, _, err := client.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+			Stream:   stream,
+			Group:    group,
+			Consumer: consumer,
+			MinIdle:  claimIdle,
+			Start:    "0-0",
+			Count:    100,
+		}).Result()
+		if err != nil && ctx.Err() == nil {
+			log.Printf("XAUTOCLAIM failed: %v", err)
+		}
+		process(ctx, client, group, claimed)
+
+		// Then read new events, blocking up to 5s
+		streams, err := client.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    group,
+			Consumer: consumer,
+			Streams:  []string{stream, ">"},
+			Count:    100,
+			Block:    5 * time.Second,
+		}).Result()
+		if err == redis.Nil {
+			continue
+		} else if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("XREADGROUP failed: %v", err)
+				time.Sleep(time.Second)
+			}
+			continue
+		}
+
+		for _, s := range streams {
+			process(ctx, client, group, s.Messages)
+		}
+	}
+}
+
+// process handles each message and acknowledges it
+func process(ctx context.Context, client *redis.Client, group string, msgs []redis.XMessage) {
+	for _, msg := range msgs {
+		if err := handleEvent(msg.Values); err != nil {
+			// Leave it pending so it is retried after CLAIM_IDLE
+			log.Printf("Failed to handle event %s: %v", msg.ID, err)
+			continue
+		}
+
+		if err := client.XAck(ctx, stream, group, msg.ID).Err(); err != nil {
+			log.Printf("Failed to ack event %s: %v", msg.ID, err)
+		}
+	}
+}
+
+// handleEvent is where an order system would create the order. It must be
+// idempotent: an event can be delivered more than once if a consumer
+// crashes between handling and acknowledging it.
+func handleEvent(values map[string]interface{}) error {
+	switch values["type"] {
+	case "purchase":
+		log.Printf("Purchase: product=%v buyer=%v remaining=%v", values["product_id"], values["buyer"], values["remaining"])
+	case "overdraft_cancelled":
+		log.Printf("Overdraft cancelled: product=%v buyer=%v", values["product_id"], values["buyer"])
+	default:
+		log.Printf("Event: %v", values)
+	}
+	return nil
+}
+
+func hostname() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return "consumer"
+	}
+	return name
+}
+
+func getEnv(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
@@ -0,0 +1,302 @@
+// Package archive writes and reads sale data as JSON lines, optionally
+// compressed and split into parts so multi-gigabyte exports stay
+// manageable. Every part is independently decodable and its SHA-256 is
+// recorded in a manifest, so a truncated or corrupted copy is detected
+// before it is loaded. Parts can also be encrypted to age recipients, so
+// exports holding user IDs are unreadable without the operator's key;
+// checksums cover the encrypted bytes, so Verify needs no key.
+//
+// An archive directory looks like:
+//
+//	manifest.json
+//	orders.part-0001.jsonl.zst
+//	orders.part-0002.jsonl.zst
+//	events.part-0001.jsonl.zst
+package archive
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"filippo.io/age"
+	"github.com/klauspost/compress/zstd"
+)
+
+// ManifestName is the manifest file inside an archive directory
+const ManifestName = "manifest.json"
+
+// Compression selects the codec applied to each part
+type Compression string
+
+const (
+	None Compression = "none"
+	Gzip Compression = "gzip"
+	Zstd Compression = "zstd"
+)
+
+// ParseCompression validates a compression name
+func ParseCompression(s string) (Compression, error) {
+	switch c := Compression(s); c {
+	case None, Gzip, Zstd:
+		return c, nil
+	default:
+		return "", fmt.Errorf("unknown compression %q (want none, gzip or zstd)", s)
+	}
+}
+
+// Ext is the file name suffix appended after .jsonl
+func (c Compression) Ext() string {
+	switch c {
+	case Gzip:
+		return ".gz"
+	case Zstd:
+		return ".zst"
+	default:
+		return ""
+	}
+}
+
+// Options configures a Writer
+type Options struct {
+	Compression Compression
+	// PartSize starts a new part once this many uncompressed bytes have
+	// been written to the current one; 0 writes a single part
+	PartSize int64
+	// Recipients encrypt every part with age after compression; none
+	// writes plaintext
+	Recipients []age.Recipient
+}
+
+// EncryptionAge marks a data set whose parts are age encrypted
+const EncryptionAge = "age"
+
+// Part describes one file of an archived data set
+type Part struct {
+	Name    string `json:"name"`
+	Records int64  `json:"records"`
+	Bytes   int64  `json:"bytes"`
+	SHA256  string `json:"sha256"`
+}
+
+// File describes one data set, e.g. the orders of a product
+type File struct {
+	Name        string      `json:"name"`
+	Compression Compression `json:"compression"`
+	Encryption  string      `json:"encryption,omitempty"`
+	Records     int64       `json:"records"`
+	Parts       []Part      `json:"parts"`
+}
+
+// Manifest lists the contents of an archive directory
+type Manifest struct {
+	CreatedAt time.Time         `json:"created_at"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Files     []File            `json:"files"`
+}
+
+// Writer writes one data set as a sequence of parts. Records never span
+// parts.
+type Writer struct {
+	dir  string
+	name string
+	opts Options
+
+	file File
+
+	// current part
+	f       *os.File
+	hash    hash.Hash
+	counter *countingWriter
+	crypt   io.WriteCloser
+	enc     io.WriteCloser
+	written int64
+	records int64
+}
+
+// Create starts writing data set name into dir
+func Create(dir, name string, opts Options) (*Writer, error) {
+	if opts.Compression == "" {
+		opts.Compression = None
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create archive dir: %w", err)
+	}
+	file := File{Name: name, Compression: opts.Compression}
+	if len(opts.Recipients) > 0 {
+		file.Encryption = EncryptionAge
+	}
+	return &Writer{dir: dir, name: name, opts: opts, file: file}, nil
+}
+
+// WriteRecord appends v as one JSON line
+func (w *Writer) WriteRecord(v interface{}) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to marshal record: %w", err)
+	}
+
+	if w.f != nil && w.opts.PartSize > 0 && w.written+int64(len(line))+1 > w.opts.PartSize {
+		if err := w.finishPart(); err != nil {
+			return err
+		}
+	}
+	if w.f == nil {
+		if err := w.startPart(); err != nil {
+			return err
+		}
+	}
+
+	if _, err := w.enc.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write %s: %w", w.name, err)
+	}
+	w.written += int64(len(line)) + 1
+	w.records++
+	return nil
+}
+
+func (w *Writer) partName() string {
+	name := fmt.Sprintf("%s.part-%04d.jsonl%s", w.name, len(w.file.Parts)+1, w.opts.Compression.Ext())
+	if w.file.Encryption == EncryptionAge {
+		name += ".age"
+	}
+	return name
+}
+
+func (w *Writer) startPart() error {
+	f, err := os.OpenFile(filepath.Join(w.dir, w.partName()), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to create part: %w", err)
+	}
+
+	h := sha256.New()
+	counter := &countingWriter{w: io.MultiWriter(f, h)}
+
+	// Compress, then encrypt: ciphertext does not compress
+	var crypt io.WriteCloser = nopCloser{counter}
+	if w.file.Encryption == EncryptionAge {
+		crypt, err = age.Encrypt(counter, w.opts.Recipients...)
+		if err != nil {
+			f.Close()
+			return fmt.Errorf("failed to start encryption: %w", err)
+		}
+	}
+
+	var enc io.WriteCloser
+	switch w.opts.Compression {
+	case Gzip:
+		enc = gzip.NewWriter(crypt)
+	case Zstd:
+		enc, err = zstd.NewWriter(crypt)
+		if err != nil {
+			f.Close()
+			return fmt.Errorf("failed to create zstd writer: %w", err)
+		}
+	default:
+		enc = nopCloser{crypt}
+	}
+
+	w.f, w.hash, w.counter, w.crypt, w.enc = f, h, counter, crypt, enc
+	w.written, w.records = 0, 0
+	return nil
+}
+
+func (w *Writer) finishPart() error {
+	name := filepath.Base(w.f.Name())
+	if err := w.enc.Close(); err != nil {
+		w.f.Close()
+		return fmt.Errorf("failed to finish %s: %w", name, err)
+	}
+	if err := w.crypt.Close(); err != nil {
+		w.f.Close()
+		return fmt.Errorf("failed to finish %s: %w", name, err)
+	}
+	if err := w.f.Sync(); err != nil {
+		w.f.Close()
+		return fmt.Errorf("failed to sync %s: %w", name, err)
+	}
+	if err := w.f.Close(); err != nil {
+		return fmt.Errorf("failed to close %s: %w", name, err)
+	}
+
+	w.file.Parts = append(w.file.Parts, Part{
+		Name:    name,
+		Records: w.records,
+		Bytes:   w.counter.n,
+		SHA256:  hex.EncodeToString(w.hash.Sum(nil)),
+	})
+	w.file.Records += w.records
+	w.f = nil
+	return nil
+}
+
+// Close finishes the last part and returns the data set's manifest entry.
+// A data set without records has no parts.
+func (w *Writer) Close() (File, error) {
+	if w.f != nil {
+		if err := w.finishPart(); err != nil {
+			return File{}, err
+		}
+	}
+	return w.file, nil
+}
+
+// WriteManifest writes the manifest of dir. It is written last and
+// atomically, so an archive without a manifest is known to be incomplete.
+func WriteManifest(dir string, m Manifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(dir, ManifestName+".tmp")
+	if err := os.WriteFile(tmp, append(data, '\n'), 0o600); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	return os.Rename(tmp, filepath.Join(dir, ManifestName))
+}
+
+// ReadManifest loads the manifest of dir
+func ReadManifest(dir string) (Manifest, error) {
+	var m Manifest
+	data, err := os.ReadFile(filepath.Join(dir, ManifestName))
+	if err != nil {
+		return m, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return m, fmt.Errorf("corrupt manifest: %w", err)
+	}
+	return m, nil
+}
+
+// Find returns the data set called name
+func (m Manifest) Find(name string) (File, bool) {
+	for _, f := range m.Files {
+		if f.Name == name {
+			return f, true
+		}
+	}
+	return File{}, false
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
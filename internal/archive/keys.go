@@ -0,0 +1,76 @@
+package archive
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/agessh"
+)
+
+// ParseRecipient reads a public key to encrypt to: an age key
+// ("age1...") or an SSH key ("ssh-ed25519 ..." or "ssh-rsa ...", as in
+// authorized_keys)
+func ParseRecipient(s string) (age.Recipient, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "ssh-") {
+		r, err := agessh.ParseRecipient(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SSH recipient: %w", err)
+		}
+		return r, nil
+	}
+	r, err := age.ParseX25519Recipient(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid age recipient: %w", err)
+	}
+	return r, nil
+}
+
+// ReadRecipients reads a recipients file: one key per line, as accepted
+// by ParseRecipient, with # comments and blank lines ignored
+func ReadRecipients(path string) ([]age.Recipient, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read recipients: %w", err)
+	}
+	var recipients []age.Recipient
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r, err := ParseRecipient(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, i+1, err)
+		}
+		recipients = append(recipients, r)
+	}
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("%s has no recipients", path)
+	}
+	return recipients, nil
+}
+
+// ReadIdentities reads the private keys to decrypt with: an age identity
+// file, as written by age-keygen, or an unencrypted SSH private key
+func ReadIdentities(path string) ([]age.Identity, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read identity: %w", err)
+	}
+	if bytes.Contains(data, []byte("PRIVATE KEY-----")) {
+		id, err := agessh.ParseIdentity(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SSH identity %s: %w", path, err)
+		}
+		return []age.Identity{id}, nil
+	}
+	ids, err := age.ParseIdentities(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid age identity %s: %w", path, err)
+	}
+	return ids, nil
+}
@@ -0,0 +1,121 @@
+package archive
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"filippo.io/age"
+	"github.com/klauspost/compress/zstd"
+)
+
+// maxRecordSize bounds a single JSON line when reading
+const maxRecordSize = 16 * 1024 * 1024
+
+// Verify checks the size and checksum of every part listed in the manifest
+func Verify(dir string, m Manifest) error {
+	for _, f := range m.Files {
+		for _, p := range f.Parts {
+			if err := verifyPart(dir, p); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func verifyPart(dir string, p Part) error {
+	f, err := os.Open(filepath.Join(dir, p.Name))
+	if err != nil {
+		return fmt.Errorf("missing part: %w", err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", p.Name, err)
+	}
+	if n != p.Bytes {
+		return fmt.Errorf("%s: size %d, manifest says %d", p.Name, n, p.Bytes)
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != p.SHA256 {
+		return fmt.Errorf("%s: checksum mismatch", p.Name)
+	}
+	return nil
+}
+
+// ReadRecords calls fn with every JSON line of a data set, in order. Each
+// part is verified against its checksum before any of its records are
+// returned. The line is only valid until fn returns. An encrypted data set
+// needs the identity of one of its recipients in ids.
+func ReadRecords(dir string, file File, ids []age.Identity, fn func(line []byte) error) error {
+	switch file.Encryption {
+	case "":
+	case EncryptionAge:
+		if len(ids) == 0 {
+			return fmt.Errorf("%s is encrypted, an age identity is needed to read it", file.Name)
+		}
+	default:
+		return fmt.Errorf("%s: unknown encryption %q", file.Name, file.Encryption)
+	}
+
+	for _, p := range file.Parts {
+		if err := verifyPart(dir, p); err != nil {
+			return err
+		}
+		if err := readPart(dir, file, p, ids, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readPart(dir string, file File, p Part, ids []age.Identity, fn func(line []byte) error) error {
+	f, err := os.Open(filepath.Join(dir, p.Name))
+	if err != nil {
+		return fmt.Errorf("missing part: %w", err)
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if file.Encryption == EncryptionAge {
+		r, err = age.Decrypt(f, ids...)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt %s: %w", p.Name, err)
+		}
+	}
+	switch file.Compression {
+	case Gzip:
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return fmt.Errorf("failed to open %s: %w", p.Name, err)
+		}
+		defer gz.Close()
+		r = gz
+	case Zstd:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return fmt.Errorf("failed to open %s: %w", p.Name, err)
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxRecordSize)
+	for scanner.Scan() {
+		if err := fn(scanner.Bytes()); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read %s: %w", p.Name, err)
+	}
+	return nil
+}
@@ -0,0 +1,281 @@
+// Package auth verifies the JWTs buyers attach to purchase requests, so a
+// client can only buy as the user its token was issued to, or as an agent
+// buying on behalf of users. Tokens are
+// either HS256, signed with a secret shared with the issuer, or RS256 /
+// ES256, signed by an identity provider whose public keys are fetched from
+// a JWKS endpoint.
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Every error returned by Verify and Authorize wraps ErrUnauthorized
+var (
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrMissingToken = fmt.Errorf("%w: missing auth_token", ErrUnauthorized)
+	ErrExpired      = fmt.Errorf("%w: token expired", ErrUnauthorized)
+)
+
+// Leeway tolerates clock skew between the issuer and the server
+const Leeway = 30 * time.Second
+
+// Claims are the registered JWT claims this package checks
+type Claims struct {
+	Subject   string   `json:"sub"`
+	Issuer    string   `json:"iss,omitempty"`
+	Audience  audience `json:"aud,omitempty"`
+	ExpiresAt int64    `json:"exp,omitempty"`
+	NotBefore int64    `json:"nbf,omitempty"`
+	IssuedAt  int64    `json:"iat,omitempty"`
+	// Agent marks a partner principal allowed to purchase on behalf of
+	// other users; its subject is the agent ID
+	Agent bool `json:"agent,omitempty"`
+}
+
+// audience is a string or an array of strings on the wire
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*a = audience{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return err
+	}
+	*a = many
+	return nil
+}
+
+func (a audience) MarshalJSON() ([]byte, error) {
+	if len(a) == 1 {
+		return json.Marshal(a[0])
+	}
+	return json.Marshal([]string(a))
+}
+
+// Options configures a Verifier. At least one of Secret and JWKSURL must
+// be set.
+type Options struct {
+	// Secret verifies HS256 tokens
+	Secret []byte
+	// JWKSURL serves the public keys that verify RS256 and ES256 tokens
+	JWKSURL string
+	// JWKSRefresh is how often the key set is fetched again
+	JWKSRefresh time.Duration
+	// Issuer and Audience, when set, must match the token's iss and aud
+	Issuer   string
+	Audience string
+}
+
+// Verifier checks tokens against the configured keys
+type Verifier struct {
+	opts Options
+	jwks *keySet
+}
+
+// New creates a Verifier. With a JWKS URL the key set is fetched before
+// New returns, then refreshed in the background until ctx is done.
+func New(ctx context.Context, opts Options) (*Verifier, error) {
+	if len(opts.Secret) == 0 && opts.JWKSURL == "" {
+		return nil, errors.New("auth needs a secret or a JWKS URL")
+	}
+
+	v := &Verifier{opts: opts}
+	if opts.JWKSURL != "" {
+		ks := newKeySet(opts.JWKSURL)
+		if err := ks.refresh(ctx); err != nil {
+			return nil, err
+		}
+		go ks.run(ctx, opts.JWKSRefresh)
+		v.jwks = ks
+	}
+	return v, nil
+}
+
+// Authorize verifies token and checks that it was issued to userID. Agent
+// tokens are refused, so an agent cannot pass for a user of the same ID.
+func (v *Verifier) Authorize(token, userID string, now time.Time) error {
+	claims, err := v.Identify(token, now)
+	if err != nil {
+		return err
+	}
+	if claims.Subject != userID {
+		return fmt.Errorf("%w: token subject does not match user_id", ErrUnauthorized)
+	}
+	return nil
+}
+
+// Identify verifies a user token and returns its claims, whose subject is
+// the user. Agent tokens are refused, as by Authorize.
+func (v *Verifier) Identify(token string, now time.Time) (Claims, error) {
+	claims, err := v.Verify(token, now)
+	if err != nil {
+		return Claims{}, err
+	}
+	if claims.Agent {
+		return Claims{}, fmt.Errorf("%w: agent token used as user token", ErrUnauthorized)
+	}
+	return claims, nil
+}
+
+// AuthorizeAgent verifies an agent token and returns the agent ID
+func (v *Verifier) AuthorizeAgent(token string, now time.Time) (string, error) {
+	claims, err := v.Verify(token, now)
+	if err != nil {
+		return "", err
+	}
+	if !claims.Agent {
+		return "", fmt.Errorf("%w: not an agent token", ErrUnauthorized)
+	}
+	return claims.Subject, nil
+}
+
+type header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid,omitempty"`
+	Typ string `json:"typ,omitempty"`
+}
+
+// Verify checks the signature and time claims of token and returns its
+// claims
+func (v *Verifier) Verify(token string, now time.Time) (Claims, error) {
+	var claims Claims
+	if token == "" {
+		return claims, ErrMissingToken
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, fmt.Errorf("%w: malformed token", ErrUnauthorized)
+	}
+	var h header
+	if err := decodeSegment(parts[0], &h); err != nil {
+		return claims, fmt.Errorf("%w: malformed header", ErrUnauthorized)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, fmt.Errorf("%w: malformed signature", ErrUnauthorized)
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	if err := v.verifySignature(h, signed, sig); err != nil {
+		return claims, err
+	}
+
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return claims, fmt.Errorf("%w: malformed claims", ErrUnauthorized)
+	}
+	return claims, v.checkClaims(claims, now)
+}
+
+// verifySignature picks the key by algorithm, so an HS256 token is never
+// checked against a public key and "none" is never accepted
+func (v *Verifier) verifySignature(h header, signed, sig []byte) error {
+	switch h.Alg {
+	case "HS256":
+		if len(v.opts.Secret) == 0 {
+			break
+		}
+		mac := hmac.New(sha256.New, v.opts.Secret)
+		mac.Write(signed)
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return fmt.Errorf("%w: bad signature", ErrUnauthorized)
+		}
+		return nil
+
+	case "RS256", "ES256":
+		if v.jwks == nil {
+			break
+		}
+		keys := v.jwks.lookup(h.Kid, h.Alg)
+		if len(keys) == 0 {
+			return fmt.Errorf("%w: unknown key %q", ErrUnauthorized, h.Kid)
+		}
+		digest := sha256.Sum256(signed)
+		for _, key := range keys {
+			if verifyWithKey(key, digest[:], sig) {
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: bad signature", ErrUnauthorized)
+	}
+	return fmt.Errorf("%w: algorithm %q not accepted", ErrUnauthorized, h.Alg)
+}
+
+func verifyWithKey(key crypto.PublicKey, digest, sig []byte) bool {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, digest, sig) == nil
+	case *ecdsa.PublicKey:
+		// JWS ES256 signatures are r || s, 32 bytes each
+		if len(sig) != 64 {
+			return false
+		}
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		return ecdsa.Verify(k, digest, r, s)
+	}
+	return false
+}
+
+func (v *Verifier) checkClaims(c Claims, now time.Time) error {
+	if c.Subject == "" {
+		return fmt.Errorf("%w: token has no subject", ErrUnauthorized)
+	}
+	if c.ExpiresAt != 0 && now.After(time.Unix(c.ExpiresAt, 0).Add(Leeway)) {
+		return ErrExpired
+	}
+	if c.NotBefore != 0 && now.Add(Leeway).Before(time.Unix(c.NotBefore, 0)) {
+		return fmt.Errorf("%w: token not valid yet", ErrUnauthorized)
+	}
+	if v.opts.Issuer != "" && c.Issuer != v.opts.Issuer {
+		return fmt.Errorf("%w: unexpected issuer", ErrUnauthorized)
+	}
+	if v.opts.Audience != "" && !slices.Contains(c.Audience, v.opts.Audience) {
+		return fmt.Errorf("%w: unexpected audience", ErrUnauthorized)
+	}
+	return nil
+}
+
+// SignHS256 issues an HS256 token, for tools and load tests that share
+// the server's secret
+func SignHS256(secret []byte, claims Claims) (string, error) {
+	h, err := json.Marshal(header{Alg: "HS256", Typ: "JWT"})
+	if err != nil {
+		return "", err
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
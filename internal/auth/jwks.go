@@ -0,0 +1,214 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	jwksFetchTimeout = 10 * time.Second
+	jwksMaxBytes     = 1 << 20
+	// jwksMinRefetch limits refetches triggered by unknown key IDs, so a
+	// flood of forged kids cannot hammer the identity provider
+	jwksMinRefetch = 30 * time.Second
+)
+
+// jwk is one entry of a JWKS document
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type publicKey struct {
+	kid string
+	alg string
+	key crypto.PublicKey
+}
+
+// keySet caches the keys served by a JWKS endpoint
+type keySet struct {
+	url    string
+	client *http.Client
+
+	mu        sync.RWMutex
+	keys      []publicKey
+	fetchedAt time.Time
+	refetch   chan struct{}
+}
+
+func newKeySet(url string) *keySet {
+	return &keySet{
+		url:     url,
+		client:  &http.Client{Timeout: jwksFetchTimeout},
+		refetch: make(chan struct{}, 1),
+	}
+}
+
+// lookup returns the keys usable for alg, narrowed to kid when the token
+// names one. An unknown kid usually means the provider rotated its keys,
+// so it also schedules a refetch.
+func (ks *keySet) lookup(kid, alg string) []crypto.PublicKey {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	var out []crypto.PublicKey
+	for _, k := range ks.keys {
+		if k.alg == alg && (kid == "" || k.kid == kid) {
+			out = append(out, k.key)
+		}
+	}
+	if len(out) == 0 && kid != "" {
+		select {
+		case ks.refetch <- struct{}{}:
+		default:
+		}
+	}
+	return out
+}
+
+// run refreshes the key set every interval, and early when lookup saw an
+// unknown kid. Failed refreshes keep the previous keys.
+func (ks *keySet) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-ks.refetch:
+			ks.mu.RLock()
+			recent := time.Since(ks.fetchedAt) < jwksMinRefetch
+			ks.mu.RUnlock()
+			if recent {
+				continue
+			}
+		}
+		if err := ks.refresh(ctx); err != nil {
+			log.Printf("JWKS refresh failed, keeping %d cached keys: %v", ks.size(), err)
+		}
+	}
+}
+
+func (ks *keySet) size() int {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	return len(ks.keys)
+}
+
+func (ks *keySet) refresh(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ks.url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := ks.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to fetch JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to fetch JWKS: status %d", resp.StatusCode)
+	}
+
+	var doc struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, jwksMaxBytes)).Decode(&doc); err != nil {
+		return fmt.Errorf("invalid JWKS: %w", err)
+	}
+
+	keys := make([]publicKey, 0, len(doc.Keys))
+	for _, k := range doc.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pk, err := k.parse()
+		if err != nil {
+			// Skip keys we cannot use rather than rejecting the whole set
+			log.Printf("Ignoring JWKS key %q: %v", k.Kid, err)
+			continue
+		}
+		keys = append(keys, pk)
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("JWKS at %s has no usable RS256 or ES256 keys", ks.url)
+	}
+
+	ks.mu.Lock()
+	ks.keys = keys
+	ks.fetchedAt = time.Now()
+	ks.mu.Unlock()
+	return nil
+}
+
+func (k jwk) parse() (publicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		if k.Alg != "" && k.Alg != "RS256" {
+			return publicKey{}, fmt.Errorf("unsupported alg %q", k.Alg)
+		}
+		n, err := decodeInt(k.N)
+		if err != nil {
+			return publicKey{}, fmt.Errorf("bad modulus: %w", err)
+		}
+		e, err := decodeInt(k.E)
+		if err != nil || !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return publicKey{}, fmt.Errorf("bad exponent")
+		}
+		if n.BitLen() < 2048 {
+			return publicKey{}, fmt.Errorf("RSA key shorter than 2048 bits")
+		}
+		return publicKey{kid: k.Kid, alg: "RS256", key: &rsa.PublicKey{N: n, E: int(e.Int64())}}, nil
+
+	case "EC":
+		if k.Crv != "P-256" || (k.Alg != "" && k.Alg != "ES256") {
+			return publicKey{}, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeInt(k.X)
+		if err != nil {
+			return publicKey{}, fmt.Errorf("bad x: %w", err)
+		}
+		y, err := decodeInt(k.Y)
+		if err != nil {
+			return publicKey{}, fmt.Errorf("bad y: %w", err)
+		}
+		if !elliptic.P256().IsOnCurve(x, y) {
+			return publicKey{}, fmt.Errorf("point not on curve")
+		}
+		return publicKey{kid: k.Kid, alg: "ES256", key: &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}}, nil
+	}
+	return publicKey{}, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+func decodeInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, fmt.Errorf("empty")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
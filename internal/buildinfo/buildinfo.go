@@ -0,0 +1,66 @@
+// Package buildinfo describes the running binary. Release builds stamp
+// the values with ldflags:
+//
+//	go build -ldflags "-X chha/internal/buildinfo.Version=v1.4.0 -X chha/internal/buildinfo.Commit=$(git rev-parse HEAD)"
+//
+// Otherwise they are filled in from the VCS information the go tool embeds.
+package buildinfo
+
+import (
+	"runtime"
+	"runtime/debug"
+)
+
+// Set with -ldflags -X
+var (
+	Version   = ""
+	Commit    = ""
+	BuildTime = ""
+)
+
+// Info is the build description of this binary
+type Info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildTime string `json:"build_time,omitempty"`
+	Modified  bool   `json:"modified,omitempty"`
+	GoVersion string `json:"go_version"`
+}
+
+// Get returns the build info, preferring ldflags values
+func Get() Info {
+	info := Info{
+		Version:   Version,
+		Commit:    Commit,
+		BuildTime: BuildTime,
+		GoVersion: runtime.Version(),
+	}
+
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		if info.Version == "" && bi.Main.Version != "(devel)" {
+			info.Version = bi.Main.Version
+		}
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				if info.Commit == "" {
+					info.Commit = s.Value
+				}
+			case "vcs.time":
+				if info.BuildTime == "" {
+					info.BuildTime = s.Value
+				}
+			case "vcs.modified":
+				info.Modified = s.Value == "true"
+			}
+		}
+	}
+
+	if info.Version == "" {
+		info.Version = "dev"
+	}
+	if info.Commit == "" {
+		info.Commit = "unknown"
+	}
+	return info
+}
@@ -0,0 +1,267 @@
+// Package cluster lets server instances sharing one Redis find each other
+// and agree on a leader. Every instance keeps a record of itself alive
+// with heartbeats, and one of them holds the leader lease at a time, so
+// background jobs that only need to run once per fleet run on the leader
+// alone.
+package cluster
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// instancesKey is a sorted set of instance IDs scored by their last
+	// heartbeat in milliseconds
+	instancesKey = "cluster:instances"
+	// leaderKey holds the lease of the current leader
+	leaderKey = "cluster:leader"
+)
+
+func instanceKey(id string) string {
+	return fmt.Sprintf("cluster:instance:%s", id)
+}
+
+// Lua script renewing the leader lease if this instance holds it, or
+// taking it if nobody does. ARGV is the lease value and its TTL in
+// milliseconds. Returns 1 while this instance leads.
+var campaignScript = redis.NewScript(`
+local holder = redis.call("GET", KEYS[1])
+if holder == ARGV[1] then
+    redis.call("PEXPIRE", KEYS[1], ARGV[2])
+    return 1
+end
+if not holder then
+    redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+    return 1
+end
+return 0
+`)
+
+// Lua script giving up the leader lease only if it is still ours
+var resignScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+    return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// Instance is the record an instance registers
+type Instance struct {
+	ID      string `json:"id"`
+	Host    string `json:"host"`
+	Addr    string `json:"addr"`
+	Admin   string `json:"admin_addr"`
+	Version string `json:"version"`
+	Started int64  `json:"started"`
+	// Nonce tells two processes registering under the same ID apart
+	Nonce string `json:"nonce"`
+	// Heartbeat is when the record was last refreshed, in Unix seconds
+	Heartbeat int64 `json:"heartbeat"`
+	// Leader is filled in by Instances
+	Leader bool `json:"leader"`
+}
+
+// Options configure a Member
+type Options struct {
+	// Self is this instance's record; Self.ID must be unique in the fleet
+	Self Instance
+	// TTL is how long a record or the leader lease outlives the last
+	// heartbeat. Heartbeats are sent every TTL/3.
+	TTL time.Duration
+	// OnLeader, when set, is called each time this instance gains or loses
+	// the leadership
+	OnLeader func(leader bool)
+}
+
+// Member is one instance's membership in the cluster
+type Member struct {
+	client *redis.Client
+	opts   Options
+	// lease is the leader lease value, unique to this process
+	lease string
+	// warned is set once a duplicate ID was logged
+	warned bool
+
+	leader atomic.Bool
+}
+
+// New returns a member for opts.Self. Nothing is written to Redis until
+// Run starts.
+func New(client *redis.Client, opts Options) *Member {
+	nonce := make([]byte, 8)
+	rand.Read(nonce)
+	opts.Self.Nonce = hex.EncodeToString(nonce)
+	return &Member{
+		client: client,
+		opts:   opts,
+		lease:  opts.Self.ID + "/" + opts.Self.Nonce,
+	}
+}
+
+// IsLeader reports whether this instance held the leader lease at its
+// last heartbeat
+func (m *Member) IsLeader() bool {
+	return m.leader.Load()
+}
+
+// Run registers the instance and heartbeats until ctx is done, then
+// resigns the leadership and removes the record so a successor takes
+// over at once rather than after the TTL
+func (m *Member) Run(ctx context.Context) {
+	m.heartbeat(ctx)
+
+	ticker := time.NewTicker(m.opts.TTL / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			m.leave(context.WithoutCancel(ctx))
+			return
+		case <-ticker.C:
+			m.heartbeat(ctx)
+		}
+	}
+}
+
+// heartbeat refreshes the record and campaigns for the leader lease. A
+// failed heartbeat gives up leadership, since the lease may lapse before
+// the next one and another instance take over.
+func (m *Member) heartbeat(ctx context.Context) {
+	if err := m.register(ctx); err != nil {
+		log.Printf("Cluster heartbeat failed: %v", err)
+		m.setLeader(false)
+		return
+	}
+
+	leader, err := campaignScript.Run(ctx, m.client, []string{leaderKey}, m.lease, m.opts.TTL.Milliseconds()).Int()
+	if err != nil {
+		log.Printf("Cluster leader election failed: %v", err)
+		m.setLeader(false)
+		return
+	}
+	m.setLeader(leader == 1)
+}
+
+// register writes the record, warning when another live process holds
+// the same ID
+func (m *Member) register(ctx context.Context) error {
+	key := instanceKey(m.opts.Self.ID)
+	prev, err := m.client.Get(ctx, key).Bytes()
+	if err != nil && err != redis.Nil {
+		return fmt.Errorf("failed to read instance record: %w", err)
+	}
+	if err == nil {
+		var other Instance
+		if json.Unmarshal(prev, &other) == nil && other.Nonce != m.opts.Self.Nonce && !m.warned {
+			m.warned = true
+			log.Printf("WARNING: instance %s on %s is also registered as %s; instance IDs must be unique", other.Host, other.Addr, m.opts.Self.ID)
+		}
+	}
+
+	now := time.Now()
+	self := m.opts.Self
+	self.Heartbeat = now.Unix()
+	data, err := json.Marshal(self)
+	if err != nil {
+		return err
+	}
+
+	_, err = m.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, key, data, m.opts.TTL)
+		pipe.ZAdd(ctx, instancesKey, redis.Z{Score: float64(now.UnixMilli()), Member: self.ID})
+		// Forget instances that stopped without leaving
+		pipe.ZRemRangeByScore(ctx, instancesKey, "-inf", strconv.FormatInt(now.Add(-m.opts.TTL).UnixMilli(), 10))
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to register instance: %w", err)
+	}
+	return nil
+}
+
+func (m *Member) setLeader(leader bool) {
+	if m.leader.Swap(leader) == leader {
+		return
+	}
+	if leader {
+		log.Printf("Instance %s is now the cluster leader", m.opts.Self.ID)
+	} else {
+		log.Printf("Instance %s is no longer the cluster leader", m.opts.Self.ID)
+	}
+	if m.opts.OnLeader != nil {
+		m.opts.OnLeader(leader)
+	}
+}
+
+// leave removes the record and resigns the leadership
+func (m *Member) leave(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	m.setLeader(false)
+	if err := resignScript.Run(ctx, m.client, []string{leaderKey}, m.lease).Err(); err != nil {
+		log.Printf("Failed to resign cluster leadership: %v", err)
+	}
+	_, err := m.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, instanceKey(m.opts.Self.ID))
+		pipe.ZRem(ctx, instancesKey, m.opts.Self.ID)
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to deregister instance: %v", err)
+	}
+}
+
+// Instances returns the live instances, by ID, with the leader marked
+func Instances(ctx context.Context, client *redis.Client, ttl time.Duration) ([]Instance, error) {
+	since := strconv.FormatInt(time.Now().Add(-ttl).UnixMilli(), 10)
+	ids, err := client.ZRangeByScore(ctx, instancesKey, &redis.ZRangeBy{Min: since, Max: "+inf"}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list instances: %w", err)
+	}
+	lease, err := client.Get(ctx, leaderKey).Result()
+	if err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("failed to get leader: %w", err)
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = instanceKey(id)
+	}
+	records, err := client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get instances: %w", err)
+	}
+
+	instances := make([]Instance, 0, len(records))
+	for _, rec := range records {
+		s, ok := rec.(string)
+		if !ok {
+			// Expired between the two reads
+			continue
+		}
+		var inst Instance
+		if err := json.Unmarshal([]byte(s), &inst); err != nil {
+			continue
+		}
+		inst.Leader = lease == inst.ID+"/"+inst.Nonce
+		instances = append(instances, inst)
+	}
+	sort.Slice(instances, func(i, j int) bool { return instances[i].ID < instances[j].ID })
+	return instances, nil
+}
@@ -0,0 +1,207 @@
+// Package config holds the typed configuration of every binary. Fields are
+// filled from the environment variable named by their `env` tag, falling
+// back to an optional YAML or TOML file and then to the `default` tag,
+// then checked by the type's Validate method. Fields tagged
+// `secret:"true"` are redacted by Print.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Load fills cfg, a pointer to a config struct, from the environment and
+// validates it once every value parses. All failures of a step are
+// reported together, not just the first.
+func Load(cfg interface{ Validate() error }) error {
+	return LoadFile(cfg, "")
+}
+
+// LoadFile is Load with the settings of a config file, see readFile, under
+// the environment: a variable that is set overrides the file. An empty
+// path loads from the environment only.
+func LoadFile(cfg interface{ Validate() error }, path string) error {
+	lookup := os.LookupEnv
+	if path != "" {
+		values, err := readFile(path)
+		if err != nil {
+			return err
+		}
+		if err := checkKeys(cfg, values); err != nil {
+			return err
+		}
+		lookup = func(key string) (string, bool) {
+			if raw, ok := os.LookupEnv(key); ok && raw != "" {
+				return raw, true
+			}
+			raw, ok := values[key]
+			return raw, ok
+		}
+	}
+
+	if err := load(cfg, lookup); err != nil {
+		return err
+	}
+	return cfg.Validate()
+}
+
+func load(cfg interface{}, lookup func(string) (string, bool)) error {
+	v := reflect.ValueOf(cfg).Elem()
+	t := v.Type()
+
+	var errs []error
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		key := field.Tag.Get("env")
+		if key == "" {
+			continue
+		}
+
+		raw, ok := lookup(key)
+		if !ok || raw == "" {
+			raw, ok = field.Tag.Lookup("default")
+			if !ok {
+				continue
+			}
+		}
+		if err := set(v.Field(i), raw); err != nil {
+			errs = append(errs, fmt.Errorf("invalid %s %q: %w", key, raw, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+func set(f reflect.Value, raw string) error {
+	if f.Type() == durationType {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return errors.New("not a duration")
+		}
+		f.SetInt(int64(d))
+		return nil
+	}
+
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(raw)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return errors.New("not a boolean")
+		}
+		f.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return errors.New("not an integer")
+		}
+		f.SetInt(n)
+	case reflect.Float64:
+		x, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return errors.New("not a number")
+		}
+		f.SetFloat(x)
+	default:
+		return fmt.Errorf("unsupported type %s", f.Type())
+	}
+	return nil
+}
+
+// Print writes the effective configuration as KEY=value lines, in the
+// order the fields are declared. Secrets only show whether they are set.
+func Print(w io.Writer, cfg interface{}) {
+	v := reflect.ValueOf(cfg)
+	if v.Kind() == reflect.Pointer {
+		v = v.Elem()
+	}
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		key := field.Tag.Get("env")
+		if key == "" {
+			continue
+		}
+
+		value := fmt.Sprint(v.Field(i).Interface())
+		if field.Tag.Get("secret") == "true" && value != "" {
+			value = "<redacted>"
+		}
+		fmt.Fprintf(w, "%s=%s\n", key, value)
+	}
+}
+
+// validator collects validation failures so they can be reported together
+type validator struct {
+	errs []error
+}
+
+func (v *validator) check(ok bool, format string, args ...interface{}) {
+	if !ok {
+		v.errs = append(v.errs, fmt.Errorf(format, args...))
+	}
+}
+
+// addr checks a host:port listen or dial address; the host may be empty
+func (v *validator) addr(key, addr string) {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		v.errs = append(v.errs, fmt.Errorf("%s %q is not host:port", key, addr))
+		return
+	}
+	n, err := strconv.Atoi(port)
+	v.check(err == nil && n >= 0 && n <= 65535, "%s %q has an invalid port", key, addr)
+}
+
+// unixScheme prefixes a listen or dial address that is a unix socket path
+const unixScheme = "unix://"
+
+// Network splits a listen or dial address into its network and address:
+// "unix" and the socket path for unix:///path, else "tcp" and addr
+func Network(addr string) (network, address string) {
+	if path, ok := strings.CutPrefix(addr, unixScheme); ok {
+		return "unix", path
+	}
+	return "tcp", addr
+}
+
+// sockAddr checks a listen or dial address that may also be a unix socket
+func (v *validator) sockAddr(key, addr string) {
+	if network, path := Network(addr); network == "unix" {
+		v.check(strings.HasPrefix(path, "/"), "%s %q must name an absolute socket path, unix:///path", key, addr)
+		return
+	}
+	v.addr(key, addr)
+}
+
+// IsLoopback reports whether the listen address addr only accepts local
+// connections; an empty host listens on every interface
+func IsLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (v *validator) nonNegative(key string, d time.Duration) {
+	v.check(d >= 0, "%s must not be negative, got %v", key, d)
+}
+
+func (v *validator) err() error {
+	return errors.Join(v.errs...)
+}
@@ -0,0 +1,99 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// readFile reads a YAML (.yaml, .yml) or TOML (.toml) config file into
+// values keyed by environment variable name. Keys are matched case
+// insensitively and nested tables are joined with underscores, so
+//
+//	redis:
+//	  addr: localhost:6379
+//
+// and `redis_addr: localhost:6379` both set REDIS_ADDR.
+func readFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc map[string]interface{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &doc)
+	case ".toml":
+		err = toml.Unmarshal(data, &doc)
+	default:
+		return nil, fmt.Errorf("%s: unknown format, use .yaml, .yml or .toml", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	values := make(map[string]string)
+	if err := flatten(values, "", doc); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return values, nil
+}
+
+func flatten(values map[string]string, prefix string, doc map[string]interface{}) error {
+	var errs []error
+	for k, v := range doc {
+		key := strings.ToUpper(k)
+		if prefix != "" {
+			key = prefix + "_" + key
+		}
+
+		switch v := v.(type) {
+		case map[string]interface{}:
+			if err := flatten(values, key, v); err != nil {
+				errs = append(errs, err)
+			}
+		case []interface{}, nil:
+			errs = append(errs, fmt.Errorf("%s must be a single value", key))
+		case time.Time:
+			errs = append(errs, fmt.Errorf("%s must not be a date", key))
+		default:
+			if _, dup := values[key]; dup {
+				errs = append(errs, fmt.Errorf("%s is set twice", key))
+			}
+			values[key] = fmt.Sprint(v)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// checkKeys reports file keys that are not a setting of cfg
+func checkKeys(cfg interface{}, values map[string]string) error {
+	known := make(map[string]bool)
+	t := reflect.TypeOf(cfg).Elem()
+	for i := 0; i < t.NumField(); i++ {
+		if key := t.Field(i).Tag.Get("env"); key != "" {
+			known[key] = true
+		}
+	}
+
+	var unknown []string
+	for key := range values {
+		if !known[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) == 0 {
+		return nil
+	}
+	sort.Strings(unknown)
+	return fmt.Errorf("unknown settings in config file: %s", strings.Join(unknown, ", "))
+}
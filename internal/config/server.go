@@ -0,0 +1,523 @@
+package config
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"chha/internal/snowflake"
+	"chha/internal/store"
+)
+
+// metricNameRE matches a valid Prometheus metric name prefix
+var metricNameRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// Server configures cmd/server
+type Server struct {
+	RedisAddr   string `env:"REDIS_ADDR" default:"localhost:6379"`
+	ListenAddr  string `env:"LISTEN_ADDR" default:":8080"`
+	MetricsAddr string `env:"METRICS_ADDR" default:":9090"`
+	// DebugAddr serves net/http/pprof and /debug/diagnostics; empty
+	// disables it. Off loopback it needs ADMIN_TOKEN.
+	DebugAddr string `env:"DEBUG_ADDR"`
+	// MetricsProductLabels caps the products that get their own label in
+	// per-product metrics: the busiest over the last MetricsLabelRefresh,
+	// with the rest reported as "other"; 0 labels every product
+	MetricsProductLabels int           `env:"METRICS_PRODUCT_LABELS" default:"100"`
+	MetricsLabelRefresh  time.Duration `env:"METRICS_LABEL_REFRESH" default:"1m"`
+	// MetricsNamespace prefixes every metric name, so servers of several
+	// sales can share one Prometheus; empty leaves names unprefixed
+	MetricsNamespace string `env:"METRICS_NAMESPACE" default:"flashsale"`
+
+	// Redis client options
+	RedisPassword     string        `env:"REDIS_PASSWORD" secret:"true"`
+	RedisDB           int           `env:"REDIS_DB" default:"0"`
+	RedisPoolSize     int           `env:"REDIS_POOL_SIZE" default:"100"`
+	RedisMinIdleConns int           `env:"REDIS_MIN_IDLE_CONNS" default:"10"`
+	RedisDialTimeout  time.Duration `env:"REDIS_DIAL_TIMEOUT" default:"5s"`
+	RedisReadTimeout  time.Duration `env:"REDIS_READ_TIMEOUT" default:"3s"`
+	RedisWriteTimeout time.Duration `env:"REDIS_WRITE_TIMEOUT" default:"3s"`
+	// RedisEvalTimeout bounds each Redis call of a purchase, bundle or
+	// reservation, and the idempotency key checks ahead of it, so a slow
+	// Redis fails attempts fast rather than after REDIS_READ_TIMEOUT. A
+	// sharded purchase trying several shards gets it for every call; 0
+	// leaves it to REDIS_READ_TIMEOUT
+	RedisEvalTimeout time.Duration `env:"REDIS_EVAL_TIMEOUT" default:"1s"`
+	// RedisTLS connects to Redis over TLS, verified against the system roots
+	RedisTLS bool `env:"REDIS_TLS" default:"false"`
+	// RedisReplicaAddr serves stock queries, order lookups and the catalog
+	// while the server is read only; empty keeps reading from REDIS_ADDR
+	RedisReplicaAddr string `env:"REDIS_REPLICA_ADDR"`
+	// RedisClusterAddrs are seed nodes (comma-separated) of the Redis
+	// Cluster behind REDIS_ADDR; the script check then covers every master
+	RedisClusterAddrs string `env:"REDIS_CLUSTER_ADDRS"`
+
+	// TLSCertFile and TLSKeyFile serve client connections over TLS; both
+	// or neither must be set
+	TLSCertFile string `env:"TLS_CERT_FILE"`
+	TLSKeyFile  string `env:"TLS_KEY_FILE"`
+	// QUICAddr also serves clients over QUIC on this UDP address, with the
+	// TLS certificate; empty disables it. Experimental.
+	QUICAddr string `env:"QUIC_ADDR"`
+
+	// TenantsDir holds a YAML or TOML file per tenant the server hosts,
+	// named after its ID, see Tenant; empty hosts none
+	TenantsDir string `env:"TENANTS_DIR"`
+
+	// ConnectMode is what a client sees on connect: "open" answers any
+	// frame, "greeting" first sends MSG_SERVER_INFO, and "silent" sends
+	// nothing and closes the connection unless the first frame is a valid
+	// MSG_HELLO
+	ConnectMode string `env:"CONNECT_MODE" default:"open"`
+
+	// ConnReadTimeout closes client connections idle for this long, unless
+	// they wait on an admin operation or queued purchase
+	ConnReadTimeout time.Duration `env:"CONN_READ_TIMEOUT" default:"30s"`
+	// ConnWriteTimeout closes client connections that do not take a frame
+	// within this long, so a stalled reader cannot block its writers; 0
+	// waits forever
+	ConnWriteTimeout time.Duration `env:"CONN_WRITE_TIMEOUT" default:"10s"`
+	// ConnIdleTimeout closes client connections that neither sent nor were
+	// sent a frame for this long, even while they wait on an admin
+	// operation or queued purchase; 0 keeps them
+	ConnIdleTimeout time.Duration `env:"CONN_IDLE_TIMEOUT" default:"5m"`
+	// TCPKeepAliveIdle is how long a client connection is quiet before TCP
+	// keepalive probes start, TCPKeepAliveInterval the time between probes
+	// and TCPKeepAliveCount how many unanswered ones drop it; an idle of 0
+	// turns keepalive off
+	TCPKeepAliveIdle     time.Duration `env:"TCP_KEEPALIVE_IDLE" default:"15s"`
+	TCPKeepAliveInterval time.Duration `env:"TCP_KEEPALIVE_INTERVAL" default:"15s"`
+	TCPKeepAliveCount    int           `env:"TCP_KEEPALIVE_COUNT" default:"9"`
+	// ConnEpoll parks client connections waiting for their next frame on
+	// an epoll instance rather than a goroutine each (Linux only)
+	ConnEpoll bool `env:"CONN_EPOLL" default:"false"`
+	// MaxConnections closes new client connections on accept while this
+	// many are open; 0 is unlimited
+	MaxConnections int `env:"MAX_CONNECTIONS" default:"0"`
+	// FrameWorkers caps how many frames are processed at once across all
+	// connections, taking turns between connections; 0 is unlimited
+	FrameWorkers int `env:"FRAME_WORKERS" default:"0"`
+	// FrameQueueLimit is how many frames may wait for a FRAME_WORKERS
+	// worker before purchase attempts are answered busy instead of joining
+	// them; 0 lets every frame wait
+	FrameQueueLimit int `env:"FRAME_QUEUE_LIMIT" default:"0"`
+	// ConnMaxInFlight is how many requests a connection with request_ids
+	// has handled at once; 0 turns request_ids off
+	ConnMaxInFlight int `env:"CONN_MAX_IN_FLIGHT" default:"100"`
+	// LogLevel is "info", or "debug" to also log every connection opened
+	// and closed
+	LogLevel string `env:"LOG_LEVEL" default:"info"`
+
+	// ShutdownTimeout bounds how long the metrics listener is given to
+	// finish its requests on shutdown
+	ShutdownTimeout time.Duration `env:"SHUTDOWN_TIMEOUT" default:"5s"`
+	// GoAwayDeadline is how long connections that negotiated goaway are
+	// still served after MSG_GOAWAY, when draining or shutting down; 0
+	// sends none and closes connections once idle, as for other clients
+	GoAwayDeadline time.Duration `env:"GOAWAY_DEADLINE" default:"10s"`
+
+	// NodeID makes order IDs unique across servers sharing one Redis; every
+	// server must use a different value in [0, snowflake.MaxNode]
+	NodeID int64 `env:"NODE_ID" default:"0"`
+
+	// SlowLogInterval is how often SLOWLOG is polled; 0 disables polling
+	SlowLogInterval time.Duration `env:"SLOWLOG_POLL_INTERVAL" default:"10s"`
+	// ScriptCheckInterval is how often Redis is checked for every Lua
+	// script, reloading missing ones; 0 disables the check
+	ScriptCheckInterval time.Duration `env:"SCRIPT_CHECK_INTERVAL" default:"10s"`
+	// ShardRebalanceInterval is how often sharded products are checked for
+	// uneven stock; 0 disables rebalancing
+	ShardRebalanceInterval time.Duration `env:"SHARD_REBALANCE_INTERVAL" default:"1s"`
+	// ClusterTTL is how long the instance record and leader lease outlive
+	// the last heartbeat; 0 runs the background jobs on every server
+	ClusterTTL time.Duration `env:"CLUSTER_TTL" default:"15s"`
+	// ReadOnlyProbeInterval is how often a server that went read only
+	// because Redis refused writes tries a write again; 0 never goes read
+	// only unless told to through /admin/readonly
+	ReadOnlyProbeInterval time.Duration `env:"READ_ONLY_PROBE_INTERVAL" default:"1s"`
+
+	// OverdraftPercent is the share of a product's observed stock that may
+	// be granted provisionally while Redis is degraded; 0 disables it
+	OverdraftPercent float64 `env:"OVERDRAFT_PERCENT" default:"0"`
+	// OverdraftJournal persists provisional grants across restarts
+	OverdraftJournal string `env:"OVERDRAFT_JOURNAL"`
+
+	// BreakerErrorRate opens the circuit breaker once this share of the
+	// Redis calls of purchase attempts in a BREAKER_WINDOW failed on errors
+	// or timeouts, answering attempts without Redis until it recovers; 0
+	// disables the breaker
+	BreakerErrorRate float64 `env:"BREAKER_ERROR_RATE" default:"0"`
+	// BreakerMinRequests is how many calls a window needs before its
+	// error rate counts
+	BreakerMinRequests int64         `env:"BREAKER_MIN_REQUESTS" default:"20"`
+	BreakerWindow      time.Duration `env:"BREAKER_WINDOW" default:"10s"`
+	// BreakerCooldown is how often an open breaker lets an attempt
+	// through to probe Redis
+	BreakerCooldown time.Duration `env:"BREAKER_COOLDOWN" default:"5s"`
+
+	// EventsStreamMaxLen approximately caps the events stream length
+	EventsStreamMaxLen int64 `env:"EVENTS_STREAM_MAXLEN" default:"1000000"`
+	// StrictWaitAOF makes strict durability purchases also wait (up to
+	// this long) for Redis to fsync them to its AOF; 0 disables waiting
+	StrictWaitAOF time.Duration `env:"STRICT_WAIT_AOF" default:"0s"`
+	// PurchaseBatchWindow collects purchases of the same product arriving
+	// within this long into one Redis pipeline; 0 disables batching
+	PurchaseBatchWindow time.Duration `env:"PURCHASE_BATCH_WINDOW" default:"0s"`
+	// PurchaseBatchMax sends a batch early once it holds this many
+	PurchaseBatchMax int `env:"PURCHASE_BATCH_MAX" default:"64"`
+	// StockAllotment claims up to this many units of a product at a time
+	// and sells them from memory; 0 sells every unit through Redis
+	StockAllotment int64 `env:"STOCK_ALLOTMENT" default:"0"`
+	// StockAllotmentSync is how often allotted sales are recorded in Redis
+	// and unused allotments returned
+	StockAllotmentSync time.Duration `env:"STOCK_ALLOTMENT_SYNC" default:"1s"`
+	// StockAllotmentJournal is the file allotted sales are journaled to
+	// before they are answered, so they survive a crash
+	StockAllotmentJournal string `env:"STOCK_ALLOTMENT_JOURNAL"`
+
+	// KafkaBrokers enables the Kafka event sink (comma-separated)
+	KafkaBrokers string `env:"KAFKA_BROKERS"`
+	KafkaTopic   string `env:"KAFKA_TOPIC" default:"flashsale-events"`
+	// KafkaBufferPath holds events that could not be delivered to Kafka
+	KafkaBufferPath string `env:"KAFKA_BUFFER_PATH" default:"kafka-buffer.jsonl"`
+
+	// WebhookURLs enables purchase webhooks (comma-separated https URLs)
+	WebhookURLs string `env:"WEBHOOK_URLS"`
+	// WebhookSecret is the HMAC-SHA256 key used to sign webhook bodies
+	WebhookSecret string `env:"WEBHOOK_SECRET" secret:"true"`
+
+	// EventSchemaRegistryURL checks events against the latest JSON Schema
+	// registered for EventSchemaSubject before they reach Kafka or
+	// webhooks. EventSchemaMode "warn" logs mismatches and sends the event
+	// anyway, "enforce" holds it back.
+	EventSchemaRegistryURL string        `env:"EVENT_SCHEMA_REGISTRY_URL"`
+	EventSchemaSubject     string        `env:"EVENT_SCHEMA_SUBJECT" default:"flashsale-events-value"`
+	EventSchemaMode        string        `env:"EVENT_SCHEMA_MODE" default:"warn"`
+	EventSchemaRefresh     time.Duration `env:"EVENT_SCHEMA_REFRESH" default:"1m"`
+
+	// CatalogCacheTTL is how long MSG_LIST_PRODUCTS results are reused
+	CatalogCacheTTL time.Duration `env:"CATALOG_CACHE_TTL" default:"2s"`
+	// CachePrimeTimeout bounds the product scan that fills local caches
+	// before connections are accepted; 0 skips it
+	CachePrimeTimeout time.Duration `env:"CACHE_PRIME_TIMEOUT" default:"10s"`
+
+	// PaymentTTL holds purchased units as PENDING orders until payment is
+	// confirmed, releasing them after this long; 0 confirms immediately
+	PaymentTTL time.Duration `env:"PAYMENT_TTL" default:"0s"`
+	// ReservationTTL is how long MSG_RESERVE holds a unit for an external
+	// checkout to commit, the default and most a request may ask for; 0
+	// disables reservations
+	ReservationTTL time.Duration `env:"RESERVATION_TTL" default:"0s"`
+	// StaleOrderSweepInterval is how often the leader scans every order for
+	// PENDING ones past their deadline that the reaper missed, such as
+	// orders left by an earlier run with PAYMENT_TTL; 0 disables the sweep
+	StaleOrderSweepInterval time.Duration `env:"STALE_ORDER_SWEEP_INTERVAL" default:"5m"`
+
+	// ValueCodec is how buyers list entries are stored: plain user IDs, or
+	// json/msgpack records that also carry the order ID and time
+	ValueCodec string `env:"VALUE_CODEC" default:"plain"`
+
+	// WaitlistSize caps how many users wait for each sold out product, to
+	// be granted units freed by expired and cancelled orders; 0 disables it
+	WaitlistSize int64 `env:"WAITLIST_SIZE" default:"0"`
+	// SoldOutCacheTTL answers attempts for a product found sold out
+	// without Redis for this long, or until a restock is announced; 0
+	// disables the cache
+	SoldOutCacheTTL time.Duration `env:"SOLD_OUT_CACHE_TTL" default:"0s"`
+	// IdempotencyTTL is how long the response of a purchase sent with an
+	// idempotency_key is kept to answer retries with the same key; 0
+	// disables the keys
+	IdempotencyTTL time.Duration `env:"IDEMPOTENCY_TTL" default:"10m"`
+	// BlocklistRefresh reloads the blocklist this often, in case a change
+	// announced on its channel was missed; 0 relies on the announcements
+	BlocklistRefresh time.Duration `env:"BLOCKLIST_REFRESH" default:"1m"`
+
+	// AdminToken authorizes MSG_ADMIN_OP; admin operations are disabled
+	// when it is empty
+	AdminToken string `env:"ADMIN_TOKEN" secret:"true"`
+
+	// AuthHMACSecret and AuthJWKSURL require purchases to carry a JWT
+	// issued to their user_id: HS256 tokens are checked with the shared
+	// secret, RS256/ES256 ones with the keys served at the JWKS URL
+	AuthHMACSecret  string        `env:"AUTH_HMAC_SECRET" secret:"true"`
+	AuthJWKSURL     string        `env:"AUTH_JWKS_URL"`
+	AuthJWKSRefresh time.Duration `env:"AUTH_JWKS_REFRESH" default:"5m"`
+	// AuthIssuer and AuthAudience, when set, must match the iss and aud
+	// claims
+	AuthIssuer   string `env:"AUTH_ISSUER"`
+	AuthAudience string `env:"AUTH_AUDIENCE"`
+	// AuthOptional accepts purchases without an auth_token as anonymous
+	// while verifying the tokens that are sent, so load shedding can tell
+	// registered users apart. Anyone can then buy as any user_id.
+	AuthOptional bool `env:"AUTH_OPTIONAL" default:"false"`
+	// AuthSessionRequired refuses user-scoped frames on connections that
+	// have not bound a user with MSG_AUTH, so one connection cannot buy as
+	// many users
+	AuthSessionRequired bool `env:"AUTH_SESSION_REQUIRED" default:"false"`
+
+	// PoWDifficulty makes purchases carry a solved MSG_CHALLENGE with this
+	// many leading zero bits; 0 disables proof of work
+	PoWDifficulty int `env:"POW_DIFFICULTY" default:"0"`
+	// PoWTTL is how long a challenge can be solved and used
+	PoWTTL time.Duration `env:"POW_TTL" default:"2m"`
+	// PoWSecret signs challenges; servers behind one load balancer must
+	// share it. A random one is generated when empty.
+	PoWSecret string `env:"POW_SECRET" secret:"true"`
+
+	// VerifyURL checks the verification_token of every purchase, such as
+	// a captcha response, with a siteverify endpoint of Turnstile, hCaptcha
+	// or reCAPTCHA; empty disables verification
+	VerifyURL    string `env:"VERIFY_URL"`
+	VerifySecret string `env:"VERIFY_SECRET" secret:"true"`
+	// VerifyTimeout bounds one check with the provider
+	VerifyTimeout time.Duration `env:"VERIFY_TIMEOUT" default:"2s"`
+	// VerifyCacheTTL is how long a verdict on a user's token is reused; 0
+	// asks the provider every attempt
+	VerifyCacheTTL time.Duration `env:"VERIFY_CACHE_TTL" default:"5m"`
+	// VerifyFailOpen lets attempts through when the provider can't be
+	// reached, instead of turning them away
+	VerifyFailOpen bool `env:"VERIFY_FAIL_OPEN" default:"false"`
+
+	// UserRateLimit caps purchase attempts per user_id per UserRateWindow,
+	// across all connections and servers; 0 disables the limit
+	UserRateLimit  int64         `env:"USER_RATE_LIMIT" default:"0"`
+	UserRateWindow time.Duration `env:"USER_RATE_WINDOW" default:"1m"`
+	// AgentRateLimit caps purchase attempts per agent, whichever users
+	// they are for, per AgentRateWindow; 0 disables the limit
+	AgentRateLimit  int64         `env:"AGENT_RATE_LIMIT" default:"0"`
+	AgentRateWindow time.Duration `env:"AGENT_RATE_WINDOW" default:"1m"`
+
+	// SpeedFloor flags users whose last SpeedStreak attempts all came less
+	// than SpeedFloor apart, faster than a person can click; 0 disables
+	// speed detection. Flags last SpeedFlagTTL after the last fast attempt.
+	SpeedFloor   time.Duration `env:"SPEED_FLOOR" default:"0"`
+	SpeedStreak  int64         `env:"SPEED_STREAK" default:"20"`
+	SpeedFlagTTL time.Duration `env:"SPEED_FLAG_TTL" default:"10m"`
+	// SpeedRateLimit caps the attempts of flagged users per
+	// SpeedRateWindow, on top of their usual limits; 0 adds no limit
+	SpeedRateLimit  int64         `env:"SPEED_RATE_LIMIT" default:"0"`
+	SpeedRateWindow time.Duration `env:"SPEED_RATE_WINDOW" default:"1m"`
+	// SpeedPoWDifficulty makes flagged users solve challenges of at least
+	// this many bits, even with POW_DIFFICULTY off; 0 asks for none
+	SpeedPoWDifficulty int `env:"SPEED_POW_DIFFICULTY" default:"0"`
+	// SpeedHold holds the successful purchases of flagged users for
+	// manual review through /admin/holds
+	SpeedHold bool `env:"SPEED_HOLD" default:"false"`
+
+	// QueueDispatchInterval is how often queue mode products are checked
+	// for waiting tickets; 0 leaves dispatching to other servers
+	QueueDispatchInterval time.Duration `env:"QUEUE_DISPATCH_INTERVAL" default:"10ms"`
+	// QueueDispatchBatch caps the tickets one check grants per product
+	QueueDispatchBatch int `env:"QUEUE_DISPATCH_BATCH" default:"100"`
+
+	// ScalingCapacity is the purchase attempts per second one server is
+	// sized for; it enables scaling hints, 0 disables them
+	ScalingCapacity float64 `env:"SCALING_CAPACITY" default:"0"`
+	// ScalingQueueDepth is the queue mode backlog treated as full load; 0
+	// leaves the backlog out of the hint
+	ScalingQueueDepth int64 `env:"SCALING_QUEUE_DEPTH" default:"0"`
+	// ScalingThreshold is the share of capacity at which to scale up
+	ScalingThreshold float64       `env:"SCALING_THRESHOLD" default:"0.8"`
+	ScalingInterval  time.Duration `env:"SCALING_INTERVAL" default:"5s"`
+
+	// LoadShedInflight is the number of purchase attempts one server can
+	// have waiting on Redis before it sheds registered users' attempts; 0
+	// disables load shedding
+	LoadShedInflight int64 `env:"LOAD_SHED_INFLIGHT" default:"0"`
+	// LoadShedAnonymousAt is the share of LoadShedInflight at which
+	// anonymous attempts start being shed; all of them are shed at
+	// LoadShedInflight, before any registered attempt
+	LoadShedAnonymousAt float64 `env:"LOAD_SHED_ANONYMOUS_AT" default:"0.5"`
+}
+
+// AuthEnabled reports whether purchases need an auth_token
+func (c *Server) AuthEnabled() bool {
+	return c.AuthHMACSecret != "" || c.AuthJWKSURL != ""
+}
+
+// Validate checks addresses, ranges and options that depend on each other
+func (c *Server) Validate() error {
+	var v validator
+	v.check(c.RedisAddr != "", "REDIS_ADDR is required")
+	if c.RedisAddr != "" {
+		v.addr("REDIS_ADDR", c.RedisAddr)
+	}
+	if c.RedisReplicaAddr != "" {
+		v.addr("REDIS_REPLICA_ADDR", c.RedisReplicaAddr)
+	}
+	if c.RedisClusterAddrs != "" {
+		for _, addr := range strings.Split(c.RedisClusterAddrs, ",") {
+			v.addr("REDIS_CLUSTER_ADDRS", addr)
+		}
+	}
+	v.sockAddr("LISTEN_ADDR", c.ListenAddr)
+	v.addr("METRICS_ADDR", c.MetricsAddr)
+	v.check(c.MetricsNamespace == "" || metricNameRE.MatchString(c.MetricsNamespace),
+		"METRICS_NAMESPACE must be a Prometheus name ([a-zA-Z_][a-zA-Z0-9_]*), got %q", c.MetricsNamespace)
+	v.check(c.MetricsProductLabels >= 0, "METRICS_PRODUCT_LABELS must not be negative, got %d", c.MetricsProductLabels)
+	v.check(c.MetricsProductLabels == 0 || c.MetricsLabelRefresh >= time.Second,
+		"METRICS_LABEL_REFRESH must be at least 1s, got %v", c.MetricsLabelRefresh)
+	if c.DebugAddr != "" {
+		v.addr("DEBUG_ADDR", c.DebugAddr)
+		v.check(IsLoopback(c.DebugAddr) || c.AdminToken != "",
+			"DEBUG_ADDR %q is not a loopback address and needs ADMIN_TOKEN", c.DebugAddr)
+	}
+	v.check(c.RedisDB >= 0, "REDIS_DB must not be negative, got %d", c.RedisDB)
+	v.check(c.RedisPoolSize > 0, "REDIS_POOL_SIZE must be positive, got %d", c.RedisPoolSize)
+	v.check(c.RedisMinIdleConns >= 0 && c.RedisMinIdleConns <= c.RedisPoolSize,
+		"REDIS_MIN_IDLE_CONNS must be between 0 and REDIS_POOL_SIZE, got %d", c.RedisMinIdleConns)
+	v.nonNegative("REDIS_DIAL_TIMEOUT", c.RedisDialTimeout)
+	v.nonNegative("REDIS_READ_TIMEOUT", c.RedisReadTimeout)
+	v.nonNegative("REDIS_WRITE_TIMEOUT", c.RedisWriteTimeout)
+	v.nonNegative("REDIS_EVAL_TIMEOUT", c.RedisEvalTimeout)
+	v.check(c.RedisEvalTimeout == 0 || c.StrictWaitAOF == 0 || c.RedisEvalTimeout > c.StrictWaitAOF,
+		"REDIS_EVAL_TIMEOUT must be longer than STRICT_WAIT_AOF, got %v", c.RedisEvalTimeout)
+	v.check((c.TLSCertFile == "") == (c.TLSKeyFile == ""),
+		"TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	if c.QUICAddr != "" {
+		v.addr("QUIC_ADDR", c.QUICAddr)
+		v.check(c.TLSCertFile != "", "QUIC_ADDR needs TLS_CERT_FILE and TLS_KEY_FILE, QUIC is always encrypted")
+	}
+	v.check(!c.ConnEpoll || c.TLSCertFile == "",
+		"CONN_EPOLL does not support TLS_CERT_FILE, a TLS connection may hold read data epoll does not see")
+	v.check(c.ConnectMode == "open" || c.ConnectMode == "greeting" || c.ConnectMode == "silent",
+		"CONNECT_MODE must be open, greeting or silent, got %q", c.ConnectMode)
+	v.check(c.ConnReadTimeout >= time.Second,
+		"CONN_READ_TIMEOUT must be at least 1s, got %v", c.ConnReadTimeout)
+	v.nonNegative("CONN_WRITE_TIMEOUT", c.ConnWriteTimeout)
+	v.check(c.ConnIdleTimeout == 0 || c.ConnIdleTimeout >= c.ConnReadTimeout,
+		"CONN_IDLE_TIMEOUT must be 0 or at least CONN_READ_TIMEOUT, got %v", c.ConnIdleTimeout)
+	v.nonNegative("TCP_KEEPALIVE_IDLE", c.TCPKeepAliveIdle)
+	v.check(c.TCPKeepAliveIdle == 0 || c.TCPKeepAliveInterval >= time.Second,
+		"TCP_KEEPALIVE_INTERVAL must be at least 1s, got %v", c.TCPKeepAliveInterval)
+	v.check(c.TCPKeepAliveIdle == 0 || c.TCPKeepAliveCount >= 1,
+		"TCP_KEEPALIVE_COUNT must be at least 1, got %d", c.TCPKeepAliveCount)
+	v.check(c.MaxConnections >= 0, "MAX_CONNECTIONS must not be negative, got %d", c.MaxConnections)
+	v.check(c.FrameWorkers >= 0, "FRAME_WORKERS must not be negative, got %d", c.FrameWorkers)
+	v.check(c.FrameQueueLimit >= 0, "FRAME_QUEUE_LIMIT must not be negative, got %d", c.FrameQueueLimit)
+	v.check(c.FrameQueueLimit == 0 || c.FrameWorkers > 0, "FRAME_QUEUE_LIMIT needs FRAME_WORKERS")
+	v.check(c.ConnMaxInFlight >= 0, "CONN_MAX_IN_FLIGHT must not be negative, got %d", c.ConnMaxInFlight)
+	v.check(c.LogLevel == "info" || c.LogLevel == "debug", "LOG_LEVEL must be info or debug, got %q", c.LogLevel)
+	v.nonNegative("SHUTDOWN_TIMEOUT", c.ShutdownTimeout)
+	v.nonNegative("GOAWAY_DEADLINE", c.GoAwayDeadline)
+	v.check(c.NodeID >= 0 && c.NodeID <= snowflake.MaxNode,
+		"NODE_ID must be between 0 and %d, got %d", snowflake.MaxNode, c.NodeID)
+
+	v.nonNegative("SLOWLOG_POLL_INTERVAL", c.SlowLogInterval)
+	v.nonNegative("SCRIPT_CHECK_INTERVAL", c.ScriptCheckInterval)
+	v.nonNegative("SHARD_REBALANCE_INTERVAL", c.ShardRebalanceInterval)
+	v.check(c.ClusterTTL == 0 || c.ClusterTTL >= 3*time.Second,
+		"CLUSTER_TTL must be 0 or at least 3s, got %v", c.ClusterTTL)
+	v.nonNegative("READ_ONLY_PROBE_INTERVAL", c.ReadOnlyProbeInterval)
+	v.check(c.OverdraftPercent >= 0 && c.OverdraftPercent <= 100,
+		"OVERDRAFT_PERCENT must be between 0 and 100, got %v", c.OverdraftPercent)
+	v.check(c.BreakerErrorRate >= 0 && c.BreakerErrorRate <= 1,
+		"BREAKER_ERROR_RATE must be between 0 and 1, got %v", c.BreakerErrorRate)
+	if c.BreakerErrorRate > 0 {
+		v.check(c.BreakerMinRequests >= 1, "BREAKER_MIN_REQUESTS must be at least 1, got %d", c.BreakerMinRequests)
+		v.check(c.BreakerWindow > 0, "BREAKER_WINDOW must be positive, got %v", c.BreakerWindow)
+		v.check(c.BreakerCooldown > 0, "BREAKER_COOLDOWN must be positive, got %v", c.BreakerCooldown)
+	}
+	v.check(c.EventsStreamMaxLen > 0, "EVENTS_STREAM_MAXLEN must be positive, got %d", c.EventsStreamMaxLen)
+	v.nonNegative("STRICT_WAIT_AOF", c.StrictWaitAOF)
+	v.check(c.PurchaseBatchWindow >= 0 && c.PurchaseBatchWindow <= 100*time.Millisecond,
+		"PURCHASE_BATCH_WINDOW must be between 0 and 100ms, got %v", c.PurchaseBatchWindow)
+	v.check(c.PurchaseBatchMax >= 1, "PURCHASE_BATCH_MAX must be at least 1, got %d", c.PurchaseBatchMax)
+	v.check(c.StockAllotment >= 0, "STOCK_ALLOTMENT must not be negative, got %d", c.StockAllotment)
+	if c.StockAllotment > 0 {
+		v.check(c.StockAllotmentSync >= 10*time.Millisecond,
+			"STOCK_ALLOTMENT_SYNC must be at least 10ms, got %v", c.StockAllotmentSync)
+		v.check(c.StockAllotmentJournal != "", "STOCK_ALLOTMENT_JOURNAL is required with STOCK_ALLOTMENT")
+		// Returned allotments go back on sale, not to the waitlist
+		v.check(c.WaitlistSize == 0, "STOCK_ALLOTMENT cannot be used with WAITLIST_SIZE")
+	}
+
+	v.check(c.KafkaBrokers == "" || c.KafkaTopic != "", "KAFKA_TOPIC is required with KAFKA_BROKERS")
+	v.check(c.WebhookURLs == "" || c.WebhookSecret != "", "WEBHOOK_SECRET is required with WEBHOOK_URLS")
+
+	if c.EventSchemaRegistryURL != "" {
+		u, err := url.Parse(c.EventSchemaRegistryURL)
+		v.check(err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Host != "",
+			"EVENT_SCHEMA_REGISTRY_URL %q is not an http(s) URL", c.EventSchemaRegistryURL)
+		v.check(c.EventSchemaSubject != "", "EVENT_SCHEMA_SUBJECT is required with EVENT_SCHEMA_REGISTRY_URL")
+		v.check(c.EventSchemaMode == "warn" || c.EventSchemaMode == "enforce",
+			"EVENT_SCHEMA_MODE must be warn or enforce, got %q", c.EventSchemaMode)
+		v.check(c.EventSchemaRefresh >= 10*time.Second,
+			"EVENT_SCHEMA_REFRESH must be at least 10s, got %v", c.EventSchemaRefresh)
+	}
+
+	v.nonNegative("CATALOG_CACHE_TTL", c.CatalogCacheTTL)
+	v.nonNegative("CACHE_PRIME_TIMEOUT", c.CachePrimeTimeout)
+	v.check(c.PaymentTTL == 0 || c.PaymentTTL >= time.Second,
+		"PAYMENT_TTL must be 0 or at least 1s, got %v", c.PaymentTTL)
+	v.check(c.ReservationTTL == 0 || c.ReservationTTL >= time.Second,
+		"RESERVATION_TTL must be 0 or at least 1s, got %v", c.ReservationTTL)
+	v.nonNegative("STALE_ORDER_SWEEP_INTERVAL", c.StaleOrderSweepInterval)
+	v.check(c.WaitlistSize >= 0, "WAITLIST_SIZE must not be negative, got %d", c.WaitlistSize)
+	v.nonNegative("SOLD_OUT_CACHE_TTL", c.SoldOutCacheTTL)
+	// Sold out attempts must reach Redis to join the waitlist
+	v.check(c.SoldOutCacheTTL == 0 || c.WaitlistSize == 0, "SOLD_OUT_CACHE_TTL cannot be used with WAITLIST_SIZE")
+	v.nonNegative("IDEMPOTENCY_TTL", c.IdempotencyTTL)
+	v.nonNegative("BLOCKLIST_REFRESH", c.BlocklistRefresh)
+	_, err := store.ParseValueCodec(c.ValueCodec)
+	v.check(err == nil, "VALUE_CODEC: %v", err)
+
+	if c.AuthJWKSURL != "" {
+		u, err := url.Parse(c.AuthJWKSURL)
+		v.check(err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Host != "",
+			"AUTH_JWKS_URL %q is not an http(s) URL", c.AuthJWKSURL)
+		v.check(c.AuthJWKSRefresh >= time.Minute,
+			"AUTH_JWKS_REFRESH must be at least 1m, got %v", c.AuthJWKSRefresh)
+	}
+	v.check(!c.AuthOptional || c.AuthEnabled(), "AUTH_OPTIONAL needs AUTH_HMAC_SECRET or AUTH_JWKS_URL")
+	v.check(!c.AuthSessionRequired || c.AuthEnabled(), "AUTH_SESSION_REQUIRED needs AUTH_HMAC_SECRET or AUTH_JWKS_URL")
+	v.check(c.AuthHMACSecret == "" || len(c.AuthHMACSecret) >= 32,
+		"AUTH_HMAC_SECRET must be at least 32 bytes")
+
+	v.check(c.PoWDifficulty >= 0 && c.PoWDifficulty <= 32,
+		"POW_DIFFICULTY must be between 0 and 32, got %d", c.PoWDifficulty)
+	v.check((c.PoWDifficulty == 0 && c.SpeedPoWDifficulty == 0) || c.PoWTTL >= time.Second,
+		"POW_TTL must be at least 1s, got %v", c.PoWTTL)
+
+	if c.VerifyURL != "" {
+		u, err := url.Parse(c.VerifyURL)
+		v.check(err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Host != "",
+			"VERIFY_URL %q is not an http(s) URL", c.VerifyURL)
+		v.check(c.VerifySecret != "", "VERIFY_SECRET is required with VERIFY_URL")
+	}
+	v.check(c.VerifyTimeout > 0, "VERIFY_TIMEOUT must be positive, got %v", c.VerifyTimeout)
+	v.nonNegative("VERIFY_CACHE_TTL", c.VerifyCacheTTL)
+
+	v.check(c.UserRateLimit >= 0, "USER_RATE_LIMIT must not be negative, got %d", c.UserRateLimit)
+	v.check(c.UserRateLimit == 0 || c.UserRateWindow >= time.Second,
+		"USER_RATE_WINDOW must be at least 1s, got %v", c.UserRateWindow)
+	v.check(c.AgentRateLimit >= 0, "AGENT_RATE_LIMIT must not be negative, got %d", c.AgentRateLimit)
+	v.check(c.AgentRateLimit == 0 || c.AgentRateWindow >= time.Second,
+		"AGENT_RATE_WINDOW must be at least 1s, got %v", c.AgentRateWindow)
+	v.check(c.SpeedFloor == 0 || c.SpeedFloor >= time.Millisecond,
+		"SPEED_FLOOR must be 0 or at least 1ms, got %v", c.SpeedFloor)
+	v.check(c.SpeedFloor == 0 || c.SpeedStreak >= 1, "SPEED_STREAK must be at least 1, got %d", c.SpeedStreak)
+	v.check(c.SpeedFloor == 0 || c.SpeedFlagTTL >= time.Second,
+		"SPEED_FLAG_TTL must be at least 1s, got %v", c.SpeedFlagTTL)
+	v.check(c.SpeedRateLimit >= 0, "SPEED_RATE_LIMIT must not be negative, got %d", c.SpeedRateLimit)
+	v.check(c.SpeedRateLimit == 0 || c.SpeedRateWindow >= time.Second,
+		"SPEED_RATE_WINDOW must be at least 1s, got %v", c.SpeedRateWindow)
+	v.check(!c.SpeedHold || c.SpeedFloor > 0, "SPEED_HOLD needs SPEED_FLOOR")
+	v.check(c.SpeedPoWDifficulty >= 0 && c.SpeedPoWDifficulty <= 32,
+		"SPEED_POW_DIFFICULTY must be between 0 and 32, got %d", c.SpeedPoWDifficulty)
+
+	v.nonNegative("QUEUE_DISPATCH_INTERVAL", c.QueueDispatchInterval)
+	v.check(c.QueueDispatchBatch > 0, "QUEUE_DISPATCH_BATCH must be positive, got %d", c.QueueDispatchBatch)
+
+	v.check(c.LoadShedInflight >= 0, "LOAD_SHED_INFLIGHT must not be negative, got %d", c.LoadShedInflight)
+	v.check(c.LoadShedAnonymousAt >= 0 && c.LoadShedAnonymousAt < 1,
+		"LOAD_SHED_ANONYMOUS_AT must be in [0, 1), got %v", c.LoadShedAnonymousAt)
+	v.check(c.ScalingCapacity >= 0, "SCALING_CAPACITY must not be negative, got %v", c.ScalingCapacity)
+	v.check(c.ScalingQueueDepth >= 0, "SCALING_QUEUE_DEPTH must not be negative, got %d", c.ScalingQueueDepth)
+	v.check(c.ScalingThreshold > 0 && c.ScalingThreshold <= 1,
+		"SCALING_THRESHOLD must be in (0, 1], got %v", c.ScalingThreshold)
+	v.check(c.ScalingCapacity == 0 || c.ScalingInterval >= time.Second,
+		"SCALING_INTERVAL must be at least 1s, got %v", c.ScalingInterval)
+	return v.err()
+}
@@ -0,0 +1,190 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"chha/internal/store"
+)
+
+// Tenant is a merchant a server with TENANTS_DIR hosts. Its connections
+// name it in MSG_HELLO, and it sells under keys of its own. Its file sets
+// TENANT_TOKEN, optionally TENANT_RATE_LIMIT, and any of tenantSettings;
+// every other setting is the server's.
+type Tenant struct {
+	// ID is the file name without its extension
+	ID string
+	// Token authenticates the tenant's connections in MSG_HELLO
+	Token string `env:"TENANT_TOKEN" secret:"true"`
+	// RateLimit caps the purchase, bundle and reservation attempts per
+	// second each server takes for the tenant; 0 is unlimited
+	RateLimit int64 `env:"TENANT_RATE_LIMIT" default:"0"`
+	// Server is the server's configuration with the tenant's settings
+	Server Server
+}
+
+// tenantSettings are the server settings a tenant file may override: the
+// ones about how a merchant sells, as opposed to how the server runs
+var tenantSettings = map[string]bool{
+	"ADMIN_TOKEN":                true,
+	"AUTH_HMAC_SECRET":           true,
+	"AUTH_JWKS_URL":              true,
+	"AUTH_JWKS_REFRESH":          true,
+	"AUTH_ISSUER":                true,
+	"AUTH_AUDIENCE":              true,
+	"AUTH_OPTIONAL":              true,
+	"POW_DIFFICULTY":             true,
+	"POW_TTL":                    true,
+	"POW_SECRET":                 true,
+	"VERIFY_URL":                 true,
+	"VERIFY_SECRET":              true,
+	"VERIFY_TIMEOUT":             true,
+	"VERIFY_CACHE_TTL":           true,
+	"VERIFY_FAIL_OPEN":           true,
+	"USER_RATE_LIMIT":            true,
+	"USER_RATE_WINDOW":           true,
+	"AGENT_RATE_LIMIT":           true,
+	"AGENT_RATE_WINDOW":          true,
+	"SPEED_FLOOR":                true,
+	"SPEED_STREAK":               true,
+	"SPEED_FLAG_TTL":             true,
+	"SPEED_RATE_LIMIT":           true,
+	"SPEED_RATE_WINDOW":          true,
+	"SPEED_POW_DIFFICULTY":       true,
+	"SPEED_HOLD":                 true,
+	"PAYMENT_TTL":                true,
+	"RESERVATION_TTL":            true,
+	"STALE_ORDER_SWEEP_INTERVAL": true,
+	"WAITLIST_SIZE":              true,
+	"IDEMPOTENCY_TTL":            true,
+	"SOLD_OUT_CACHE_TTL":         true,
+	"CATALOG_CACHE_TTL":          true,
+	"BLOCKLIST_REFRESH":          true,
+	"EVENTS_STREAM_MAXLEN":       true,
+	"WEBHOOK_URLS":               true,
+	"WEBHOOK_SECRET":             true,
+	"QUEUE_DISPATCH_INTERVAL":    true,
+	"QUEUE_DISPATCH_BATCH":       true,
+}
+
+// LoadTenants reads the tenant files of base.TenantsDir, each applied over
+// base and validated. Failures of all files are reported together.
+func LoadTenants(base Server) ([]Tenant, error) {
+	if base.TenantsDir == "" {
+		return nil, nil
+	}
+	entries, err := os.ReadDir(base.TenantsDir)
+	if err != nil {
+		return nil, fmt.Errorf("TENANTS_DIR: %w", err)
+	}
+
+	var tenants []Tenant
+	var errs []error
+	for _, e := range entries {
+		ext := filepath.Ext(e.Name())
+		if e.IsDir() || (ext != ".yaml" && ext != ".yml" && ext != ".toml") {
+			continue
+		}
+		t, err := loadTenant(base, filepath.Join(base.TenantsDir, e.Name()), strings.TrimSuffix(e.Name(), ext))
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		tenants = append(tenants, t)
+	}
+	sort.Slice(tenants, func(i, j int) bool { return tenants[i].ID < tenants[j].ID })
+	for i := 1; i < len(tenants); i++ {
+		if tenants[i].ID == tenants[i-1].ID {
+			errs = append(errs, fmt.Errorf("tenant %s has more than one file", tenants[i].ID))
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return tenants, nil
+}
+
+func loadTenant(base Server, path, id string) (Tenant, error) {
+	if !store.ValidTenant(id) {
+		return Tenant{}, fmt.Errorf("%s: tenant ID %q must be lowercase letters, digits, - and _, at most 64", path, id)
+	}
+	values, err := readFile(path)
+	if err != nil {
+		return Tenant{}, err
+	}
+
+	t := Tenant{ID: id, Server: base}
+	var errs []error
+	var notTenant []string
+	for key := range values {
+		if !tenantSettings[key] && !strings.HasPrefix(key, "TENANT_") {
+			notTenant = append(notTenant, key)
+		}
+	}
+	if len(notTenant) > 0 {
+		sort.Strings(notTenant)
+		errs = append(errs, fmt.Errorf("settings of the whole server, not a tenant: %s", strings.Join(notTenant, ", ")))
+	}
+	if err := checkKeys(&t, onlyPrefixed(values, "TENANT_")); err != nil {
+		errs = append(errs, err)
+	}
+	if err := load(&t, lookupIn(values)); err != nil {
+		errs = append(errs, err)
+	}
+	if err := overlay(&t.Server, values); err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) == 0 {
+		var v validator
+		v.check(t.Token != "", "TENANT_TOKEN is required")
+		v.check(t.RateLimit >= 0, "TENANT_RATE_LIMIT must not be negative, got %d", t.RateLimit)
+		errs = append(errs, v.err(), t.Server.Validate())
+	}
+	if err := errors.Join(errs...); err != nil {
+		return Tenant{}, fmt.Errorf("%s: %w", path, err)
+	}
+	return t, nil
+}
+
+// overlay sets the fields of cfg that values has a setting for, leaving
+// the others as they are
+func overlay(cfg interface{}, values map[string]string) error {
+	v := reflect.ValueOf(cfg).Elem()
+	t := v.Type()
+
+	var errs []error
+	for i := 0; i < t.NumField(); i++ {
+		key := t.Field(i).Tag.Get("env")
+		raw, ok := values[key]
+		if key == "" || !ok {
+			continue
+		}
+		if err := set(v.Field(i), raw); err != nil {
+			errs = append(errs, fmt.Errorf("invalid %s %q: %w", key, raw, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func lookupIn(values map[string]string) func(string) (string, bool) {
+	return func(key string) (string, bool) {
+		raw, ok := values[key]
+		return raw, ok
+	}
+}
+
+// onlyPrefixed returns the values whose keys start with prefix
+func onlyPrefixed(values map[string]string, prefix string) map[string]string {
+	out := make(map[string]string)
+	for key, raw := range values {
+		if strings.HasPrefix(key, prefix) {
+			out[key] = raw
+		}
+	}
+	return out
+}
@@ -0,0 +1,203 @@
+package config
+
+import (
+	"time"
+
+	"chha/internal/store"
+)
+
+// Client configures the cmd/client benchmark
+type Client struct {
+	ServerAddr string `env:"SERVER_ADDR" default:"localhost:8080"`
+	ProductID  string `env:"PRODUCT_ID" default:"iphone15"`
+
+	// Clients is how many connections buy concurrently
+	Clients int `env:"CLIENTS" default:"10000"`
+	// Attempts is how many purchases each client attempts, unless
+	// Duration is set
+	Attempts int `env:"ATTEMPTS" default:"10"`
+	// Duration keeps every client attempting purchases this long instead
+	// of a fixed number of times, 0 to use Attempts
+	Duration time.Duration `env:"DURATION" default:"0"`
+	// LoadShape makes the run open-loop: attempts follow this rate over
+	// time, see ParseLoadShape in cmd/client, instead of every client
+	// attempting as fast as it is answered
+	LoadShape string `env:"LOAD_SHAPE"`
+	// ReuseConnections sends all of a client's attempts over one
+	// connection; without it every attempt dials and handshakes anew
+	ReuseConnections bool `env:"REUSE_CONNECTIONS" default:"true"`
+	// Stock is the units on sale when the run starts, which successful
+	// purchases are checked against; 0 reads it from the server with
+	// MSG_GET_STOCK
+	Stock int64 `env:"STOCK" default:"0"`
+	// SamplesFile receives the latency of every attempt as CSV when set
+	SamplesFile string `env:"SAMPLES_FILE"`
+	// OutputFile receives the results, as CSV if it ends in .csv and JSON
+	// otherwise
+	OutputFile string `env:"OUTPUT_FILE"`
+	// BaselineFile is the JSON results of an earlier run to compare with;
+	// the client exits 1 if throughput, p50 or p99 latency worsened by
+	// more than MaxRegression percent
+	BaselineFile  string  `env:"BASELINE_FILE"`
+	MaxRegression float64 `env:"MAX_REGRESSION" default:"10"`
+
+	// CoordinateAddr makes the client the coordinator of a distributed
+	// run: it listens here for Agents agents, splits the load between
+	// them, starts them together and merges their results
+	CoordinateAddr string `env:"COORDINATE_ADDR"`
+	Agents         int    `env:"AGENTS" default:"0"`
+	// StartDelay is how long after the last agent registers the run
+	// starts, so every agent learns the start time before it
+	StartDelay time.Duration `env:"START_DELAY" default:"3s"`
+	// CoordinatorAddr makes the client an agent of the coordinator
+	// listening there, running whatever share of the load it is given
+	CoordinatorAddr string `env:"COORDINATOR_ADDR"`
+
+	// PayloadEncoding is "json" or "msgpack"
+	PayloadEncoding string `env:"PAYLOAD_ENCODING" default:"json"`
+	// FrameCRC32 asks the server for checksummed frames
+	FrameCRC32 bool `env:"FRAME_CRC32" default:"false"`
+	// FrameTimestamps asks the server to timestamp every response, so the
+	// benchmark can tell server time from network time
+	FrameTimestamps bool `env:"FRAME_TIMESTAMPS" default:"true"`
+	// AuthHMACSecret signs an auth_token for every purchase
+	AuthHMACSecret string `env:"AUTH_HMAC_SECRET" secret:"true"`
+	// Tenant and TenantToken buy from a tenant of the server, see
+	// TENANTS_DIR
+	Tenant      string `env:"TENANT"`
+	TenantToken string `env:"TENANT_TOKEN" secret:"true"`
+	// QUIC connects to SERVER_ADDR as the server's QUIC_ADDR, trusting
+	// the certificates in QUICCAFile as well as the system roots
+	QUIC       bool   `env:"QUIC" default:"false"`
+	QUICCAFile string `env:"QUIC_CA_FILE"`
+}
+
+// Validate checks the server address, load and encoding
+func (c *Client) Validate() error {
+	var v validator
+	v.sockAddr("SERVER_ADDR", c.ServerAddr)
+	if network, _ := Network(c.ServerAddr); network == "unix" {
+		v.check(!c.QUIC, "QUIC needs a host:port SERVER_ADDR, not a unix socket")
+	}
+	v.check(c.ProductID != "", "PRODUCT_ID is required")
+	v.check(c.Clients > 0, "CLIENTS must be positive, got %d", c.Clients)
+	v.check(c.Attempts > 0, "ATTEMPTS must be positive, got %d", c.Attempts)
+	v.nonNegative("DURATION", c.Duration)
+	v.check(c.Stock >= 0, "STOCK must not be negative, got %d", c.Stock)
+	v.check(c.MaxRegression >= 0, "MAX_REGRESSION must not be negative, got %v", c.MaxRegression)
+	if c.CoordinateAddr != "" {
+		v.addr("COORDINATE_ADDR", c.CoordinateAddr)
+		v.check(c.Agents > 0, "AGENTS must be positive with COORDINATE_ADDR, got %d", c.Agents)
+		v.check(c.Clients >= c.Agents, "CLIENTS must be at least AGENTS, got %d for %d agents", c.Clients, c.Agents)
+		v.check(c.CoordinatorAddr == "", "COORDINATE_ADDR and COORDINATOR_ADDR are exclusive")
+		v.check(c.SamplesFile == "", "SAMPLES_FILE is written by the agents of a coordinated run, not the coordinator")
+	}
+	if c.CoordinatorAddr != "" {
+		v.addr("COORDINATOR_ADDR", c.CoordinatorAddr)
+	}
+	v.nonNegative("START_DELAY", c.StartDelay)
+	v.check(c.PayloadEncoding == "json" || c.PayloadEncoding == "msgpack",
+		"PAYLOAD_ENCODING must be json or msgpack, got %q", c.PayloadEncoding)
+	return v.err()
+}
+
+// Setup configures the cmd/setup admin tool
+type Setup struct {
+	RedisAddr string `env:"REDIS_ADDR" default:"localhost:6379"`
+	// AuthHMACSecret signs the tokens printed by issue-token
+	AuthHMACSecret string `env:"AUTH_HMAC_SECRET" secret:"true"`
+	// Tenant is the TENANTS_DIR tenant whose products are managed; empty
+	// for the server's own
+	Tenant string `env:"TENANT"`
+}
+
+// Validate checks the Redis address and tenant ID
+func (c *Setup) Validate() error {
+	var v validator
+	v.addr("REDIS_ADDR", c.RedisAddr)
+	v.check(c.Tenant == "" || store.ValidTenant(c.Tenant),
+		"TENANT must be lowercase letters, digits, - and _, at most 64, got %q", c.Tenant)
+	return v.err()
+}
+
+// Replay configures the cmd/replay recovery tool
+type Replay struct {
+	// TargetRedisAddr receives the rebuilt state; it should be empty
+	TargetRedisAddr string `env:"TARGET_REDIS_ADDR"`
+	// SourceRedisAddr is read when no archive is given
+	SourceRedisAddr string `env:"SOURCE_REDIS_ADDR" default:"localhost:6379"`
+	// ValueCodec encodes the rebuilt buyers lists, as VALUE_CODEC does for
+	// cmd/server
+	ValueCodec string `env:"VALUE_CODEC" default:"plain"`
+	// Tenant is the TENANTS_DIR tenant whose sales are replayed, read from
+	// and written under its keys; empty for the server's own
+	Tenant string `env:"TENANT"`
+}
+
+// Validate checks both addresses and that they differ. The target may be
+// empty for a dry run.
+func (c *Replay) Validate() error {
+	var v validator
+	if c.TargetRedisAddr != "" {
+		v.addr("TARGET_REDIS_ADDR", c.TargetRedisAddr)
+	}
+	v.addr("SOURCE_REDIS_ADDR", c.SourceRedisAddr)
+	v.check(c.TargetRedisAddr != c.SourceRedisAddr,
+		"TARGET_REDIS_ADDR must differ from SOURCE_REDIS_ADDR")
+	_, err := store.ParseValueCodec(c.ValueCodec)
+	v.check(err == nil, "VALUE_CODEC: %v", err)
+	v.check(c.Tenant == "" || store.ValidTenant(c.Tenant),
+		"TENANT must be lowercase letters, digits, - and _, at most 64, got %q", c.Tenant)
+	return v.err()
+}
+
+// Rollout configures the cmd/rollout restart orchestrator
+type Rollout struct {
+	// AdminToken is the ADMIN_TOKEN of the servers being restarted
+	AdminToken string `env:"ADMIN_TOKEN" secret:"true"`
+}
+
+// Validate checks the admin token is set, as /admin/drain requires it
+func (c *Rollout) Validate() error {
+	var v validator
+	v.check(c.AdminToken != "", "ADMIN_TOKEN is required")
+	return v.err()
+}
+
+// Persist configures the cmd/persist Postgres writer
+type Persist struct {
+	RedisAddr string `env:"REDIS_ADDR" default:"localhost:6379"`
+	// PostgresURL is the database the orders are written to, as a
+	// postgres:// URL or a key=value connection string
+	PostgresURL string `env:"POSTGRES_URL" secret:"true"`
+	// Tenant is the TENANTS_DIR tenant whose events are persisted; empty
+	// for the server's own
+	Tenant string `env:"TENANT"`
+	// ConsumerGroup is the events stream group the writers share;
+	// ConsumerName tells each writer apart, the host name if empty
+	ConsumerGroup string `env:"CONSUMER_GROUP" default:"postgres"`
+	ConsumerName  string `env:"CONSUMER_NAME"`
+	// BatchSize is how many events are written per transaction
+	BatchSize int64 `env:"PERSIST_BATCH_SIZE" default:"500"`
+	// ClaimIdle is how long an event read by another writer stays
+	// unacknowledged before this one takes it over
+	ClaimIdle time.Duration `env:"CLAIM_IDLE" default:"30s"`
+	// MetricsAddr serves /metrics when set
+	MetricsAddr string `env:"METRICS_ADDR"`
+}
+
+// Validate checks the addresses, database and batching
+func (c *Persist) Validate() error {
+	var v validator
+	v.addr("REDIS_ADDR", c.RedisAddr)
+	v.check(c.PostgresURL != "", "POSTGRES_URL is required")
+	v.check(c.Tenant == "" || store.ValidTenant(c.Tenant),
+		"TENANT must be lowercase letters, digits, - and _, at most 64, got %q", c.Tenant)
+	v.check(c.ConsumerGroup != "", "CONSUMER_GROUP is required")
+	v.check(c.BatchSize > 0, "PERSIST_BATCH_SIZE must be positive, got %d", c.BatchSize)
+	v.nonNegative("CLAIM_IDLE", c.ClaimIdle)
+	if c.MetricsAddr != "" {
+		v.addr("METRICS_ADDR", c.MetricsAddr)
+	}
+	return v.err()
+}
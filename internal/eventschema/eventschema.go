@@ -0,0 +1,163 @@
+// Package eventschema checks events against a schema registered for them
+// before they leave for downstream consumers, so a change to an event's
+// fields is caught where it is made instead of in a fulfillment service.
+// Schemas are JSON Schemas fetched from a registry speaking the Confluent
+// Schema Registry API, and refreshed in the background.
+package eventschema
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	fetchTimeout = 10 * time.Second
+	maxBytes     = 1 << 20
+)
+
+// ErrMismatch is wrapped by every error Validate returns for an event
+// that does not match the schema
+var ErrMismatch = errors.New("event does not match schema")
+
+// Options configure a Validator
+type Options struct {
+	// RegistryURL is the base URL of the schema registry
+	RegistryURL string
+	// Subject names the schema; its latest version is used
+	Subject string
+	// Refresh is how often the latest version is fetched again
+	Refresh time.Duration
+}
+
+// Validator checks events against the latest registered schema
+type Validator struct {
+	opts   Options
+	client *http.Client
+
+	mu      sync.RWMutex
+	schema  *schema
+	version int
+}
+
+// New creates a Validator. The schema is fetched before New returns, then
+// refreshed in the background until ctx is done.
+func New(ctx context.Context, opts Options) (*Validator, error) {
+	if opts.RegistryURL == "" || opts.Subject == "" {
+		return nil, errors.New("event schema needs a registry URL and a subject")
+	}
+
+	v := &Validator{opts: opts, client: &http.Client{Timeout: fetchTimeout}}
+	if err := v.refresh(ctx); err != nil {
+		return nil, err
+	}
+	go v.run(ctx)
+	return v, nil
+}
+
+// Version returns the registry version of the schema in use
+func (v *Validator) Version() int {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return v.version
+}
+
+// Validate checks a JSON encoded event. A mismatch is reported with every
+// field that broke the schema.
+func (v *Validator) Validate(event []byte) error {
+	var doc interface{}
+	dec := json.NewDecoder(bytes.NewReader(event))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return fmt.Errorf("invalid event JSON: %w", err)
+	}
+
+	v.mu.RLock()
+	s, version := v.schema, v.version
+	v.mu.RUnlock()
+
+	var errs []string
+	s.validate(doc, "", &errs)
+	if len(errs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%w %s v%d: %s", ErrMismatch, v.opts.Subject, version, strings.Join(errs, "; "))
+}
+
+// run refreshes the schema every Refresh. Failed refreshes keep the
+// schema in use.
+func (v *Validator) run(ctx context.Context) {
+	ticker := time.NewTicker(v.opts.Refresh)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		before := v.Version()
+		if err := v.refresh(ctx); err != nil {
+			log.Printf("Event schema refresh failed, keeping %s v%d: %v", v.opts.Subject, before, err)
+		} else if after := v.Version(); after != before {
+			log.Printf("Event schema %s updated from v%d to v%d", v.opts.Subject, before, after)
+		}
+	}
+}
+
+// registryResponse is the body of GET /subjects/{subject}/versions/latest
+type registryResponse struct {
+	Version    int    `json:"version"`
+	Schema     string `json:"schema"`
+	SchemaType string `json:"schemaType"`
+}
+
+func (v *Validator) refresh(ctx context.Context) error {
+	u := strings.TrimRight(v.opts.RegistryURL, "/") + "/subjects/" + url.PathEscape(v.opts.Subject) + "/versions/latest"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/vnd.schemaregistry.v1+json, application/json")
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to fetch event schema: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to fetch event schema %s: status %d", v.opts.Subject, resp.StatusCode)
+	}
+
+	var body registryResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxBytes)).Decode(&body); err != nil {
+		return fmt.Errorf("invalid schema registry response: %w", err)
+	}
+	switch body.SchemaType {
+	case "JSON":
+	case "":
+		// The registry omits the type for Avro, its default
+		return fmt.Errorf("event schema %s v%d is Avro, only JSON Schema is supported", v.opts.Subject, body.Version)
+	default:
+		return fmt.Errorf("event schema %s v%d is %s, only JSON Schema is supported", v.opts.Subject, body.Version, body.SchemaType)
+	}
+
+	s, err := compile([]byte(body.Schema))
+	if err != nil {
+		return fmt.Errorf("event schema %s v%d: %w", v.opts.Subject, body.Version, err)
+	}
+
+	v.mu.Lock()
+	v.schema = s
+	v.version = body.Version
+	v.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,487 @@
+package eventschema
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"math/big"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// schema is one compiled JSON Schema node. Only the validation keywords
+// events need are supported; annotations such as title, description and
+// format are ignored, as the spec allows.
+type schema struct {
+	always *bool // boolean schema, or nil
+
+	types    []string
+	enum     []interface{}
+	constVal *interface{}
+
+	properties           map[string]*schema
+	required             []string
+	additionalProperties *schema
+
+	items *schema
+
+	minimum, maximum                   *big.Float
+	exclusiveMinimum, exclusiveMaximum *big.Float
+	minLength, maxLength               int
+	pattern                            *regexp.Regexp
+
+	allOf, anyOf, oneOf []*schema
+	not                 *schema
+	ifS, thenS, elseS   *schema
+
+	// resolved is the target of $ref, checked alongside the other keywords
+	resolved *schema
+}
+
+// compiler turns a decoded schema document into schema nodes, resolving
+// local $refs against the document root
+type compiler struct {
+	root interface{}
+	refs map[string]*schema
+}
+
+func compile(doc []byte) (*schema, error) {
+	var root interface{}
+	dec := json.NewDecoder(strings.NewReader(string(doc)))
+	dec.UseNumber()
+	if err := dec.Decode(&root); err != nil {
+		return nil, fmt.Errorf("invalid JSON schema: %w", err)
+	}
+
+	c := &compiler{root: root, refs: make(map[string]*schema)}
+	return c.compile(root, "#")
+}
+
+func (c *compiler) compile(v interface{}, at string) (*schema, error) {
+	if b, ok := v.(bool); ok {
+		return &schema{always: &b}, nil
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s: schema must be an object or a boolean", at)
+	}
+
+	s := &schema{minLength: -1, maxLength: -1}
+	var err error
+
+	if ref, ok := m["$ref"].(string); ok {
+		target, err := c.resolve(ref)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", at, err)
+		}
+		s.resolved = target
+	}
+
+	switch t := m["type"].(type) {
+	case nil:
+	case string:
+		s.types = []string{t}
+	case []interface{}:
+		for _, e := range t {
+			name, ok := e.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s/type: must be a string or a list of strings", at)
+			}
+			s.types = append(s.types, name)
+		}
+	default:
+		return nil, fmt.Errorf("%s/type: must be a string or a list of strings", at)
+	}
+	for _, t := range s.types {
+		switch t {
+		case "null", "boolean", "object", "array", "number", "integer", "string":
+		default:
+			return nil, fmt.Errorf("%s/type: unknown type %q", at, t)
+		}
+	}
+
+	if e, ok := m["enum"]; ok {
+		list, ok := e.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s/enum: must be a list", at)
+		}
+		s.enum = list
+	}
+	if cv, ok := m["const"]; ok {
+		s.constVal = &cv
+	}
+
+	if p, ok := m["properties"]; ok {
+		props, ok := p.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s/properties: must be an object", at)
+		}
+		s.properties = make(map[string]*schema, len(props))
+		for name, sub := range props {
+			if s.properties[name], err = c.compile(sub, at+"/properties/"+name); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if r, ok := m["required"]; ok {
+		list, ok := r.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s/required: must be a list of strings", at)
+		}
+		for _, e := range list {
+			name, ok := e.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s/required: must be a list of strings", at)
+			}
+			s.required = append(s.required, name)
+		}
+	}
+	if s.additionalProperties, err = c.optional(m, "additionalProperties", at); err != nil {
+		return nil, err
+	}
+	if s.items, err = c.optional(m, "items", at); err != nil {
+		return nil, err
+	}
+
+	for _, kw := range []struct {
+		name string
+		dst  **big.Float
+	}{
+		{"minimum", &s.minimum},
+		{"maximum", &s.maximum},
+		{"exclusiveMinimum", &s.exclusiveMinimum},
+		{"exclusiveMaximum", &s.exclusiveMaximum},
+	} {
+		if raw, ok := m[kw.name]; ok {
+			n, ok := number(raw)
+			if !ok {
+				return nil, fmt.Errorf("%s/%s: must be a number", at, kw.name)
+			}
+			*kw.dst = n
+		}
+	}
+	for _, kw := range []struct {
+		name string
+		dst  *int
+	}{
+		{"minLength", &s.minLength},
+		{"maxLength", &s.maxLength},
+	} {
+		if raw, ok := m[kw.name]; ok {
+			n, err := strconv.Atoi(fmt.Sprint(raw))
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("%s/%s: must be a non-negative integer", at, kw.name)
+			}
+			*kw.dst = n
+		}
+	}
+	if p, ok := m["pattern"]; ok {
+		expr, ok := p.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s/pattern: must be a string", at)
+		}
+		if s.pattern, err = regexp.Compile(expr); err != nil {
+			return nil, fmt.Errorf("%s/pattern: %w", at, err)
+		}
+	}
+
+	for _, kw := range []struct {
+		name string
+		dst  *[]*schema
+	}{
+		{"allOf", &s.allOf},
+		{"anyOf", &s.anyOf},
+		{"oneOf", &s.oneOf},
+	} {
+		raw, ok := m[kw.name]
+		if !ok {
+			continue
+		}
+		list, ok := raw.([]interface{})
+		if !ok || len(list) == 0 {
+			return nil, fmt.Errorf("%s/%s: must be a non-empty list of schemas", at, kw.name)
+		}
+		for i, sub := range list {
+			cs, err := c.compile(sub, fmt.Sprintf("%s/%s/%d", at, kw.name, i))
+			if err != nil {
+				return nil, err
+			}
+			*kw.dst = append(*kw.dst, cs)
+		}
+	}
+	if s.not, err = c.optional(m, "not", at); err != nil {
+		return nil, err
+	}
+	if s.ifS, err = c.optional(m, "if", at); err != nil {
+		return nil, err
+	}
+	if s.thenS, err = c.optional(m, "then", at); err != nil {
+		return nil, err
+	}
+	if s.elseS, err = c.optional(m, "else", at); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (c *compiler) optional(m map[string]interface{}, key, at string) (*schema, error) {
+	raw, ok := m[key]
+	if !ok {
+		return nil, nil
+	}
+	return c.compile(raw, at+"/"+key)
+}
+
+// resolve compiles the target of a local reference such as
+// "#/$defs/purchase". Each target is compiled once, so recursive
+// references end up pointing at the same node.
+func (c *compiler) resolve(ref string) (*schema, error) {
+	if s, ok := c.refs[ref]; ok {
+		return s, nil
+	}
+	if ref != "#" && !strings.HasPrefix(ref, "#/") {
+		return nil, fmt.Errorf("$ref %q: only references within the schema are supported", ref)
+	}
+
+	node := c.root
+	if ref != "#" {
+		for _, part := range strings.Split(ref[2:], "/") {
+			part = strings.NewReplacer("~1", "/", "~0", "~").Replace(part)
+			m, ok := node.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("$ref %q does not resolve", ref)
+			}
+			if node, ok = m[part]; !ok {
+				return nil, fmt.Errorf("$ref %q does not resolve", ref)
+			}
+		}
+	}
+
+	// Register a placeholder first so a reference cycle stops here
+	s := &schema{}
+	c.refs[ref] = s
+	compiled, err := c.compile(node, ref)
+	if err != nil {
+		return nil, err
+	}
+	*s = *compiled
+	return s, nil
+}
+
+// validate appends a message for each way v, decoded with UseNumber,
+// breaks the schema. at is the JSON pointer of v within the event.
+func (s *schema) validate(v interface{}, at string, errs *[]string) {
+	fail := func(format string, args ...interface{}) {
+		*errs = append(*errs, pointer(at)+": "+fmt.Sprintf(format, args...))
+	}
+
+	if s.always != nil {
+		if !*s.always {
+			fail("not allowed")
+		}
+		return
+	}
+	if s.resolved != nil {
+		s.resolved.validate(v, at, errs)
+	}
+
+	if len(s.types) > 0 && !hasType(v, s.types) {
+		fail("expected %s, got %s", strings.Join(s.types, " or "), typeOf(v))
+		return
+	}
+	if s.enum != nil && !contains(s.enum, v) {
+		fail("%s is not one of the allowed values", describe(v))
+	}
+	if s.constVal != nil && !equal(*s.constVal, v) {
+		fail("must be %s, got %s", describe(*s.constVal), describe(v))
+	}
+
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for _, name := range s.required {
+			if _, ok := val[name]; !ok {
+				fail("missing required field %q", name)
+			}
+		}
+		// Sorted, so the same event is always reported the same way
+		for _, name := range slices.Sorted(maps.Keys(val)) {
+			fv := val[name]
+			if ps, ok := s.properties[name]; ok {
+				ps.validate(fv, at+"/"+name, errs)
+			} else if s.additionalProperties != nil {
+				s.additionalProperties.validate(fv, at+"/"+name, errs)
+			}
+		}
+	case []interface{}:
+		if s.items != nil {
+			for i, e := range val {
+				s.items.validate(e, at+"/"+strconv.Itoa(i), errs)
+			}
+		}
+	case json.Number:
+		n, _ := number(val)
+		if s.minimum != nil && n.Cmp(s.minimum) < 0 {
+			fail("%s is less than %s", val, s.minimum.Text('g', -1))
+		}
+		if s.maximum != nil && n.Cmp(s.maximum) > 0 {
+			fail("%s is greater than %s", val, s.maximum.Text('g', -1))
+		}
+		if s.exclusiveMinimum != nil && n.Cmp(s.exclusiveMinimum) <= 0 {
+			fail("%s is not greater than %s", val, s.exclusiveMinimum.Text('g', -1))
+		}
+		if s.exclusiveMaximum != nil && n.Cmp(s.exclusiveMaximum) >= 0 {
+			fail("%s is not less than %s", val, s.exclusiveMaximum.Text('g', -1))
+		}
+	case string:
+		n := utf8.RuneCountInString(val)
+		if s.minLength >= 0 && n < s.minLength {
+			fail("shorter than %d characters", s.minLength)
+		}
+		if s.maxLength >= 0 && n > s.maxLength {
+			fail("longer than %d characters", s.maxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(val) {
+			fail("%q does not match %s", val, s.pattern)
+		}
+	}
+
+	for _, sub := range s.allOf {
+		sub.validate(v, at, errs)
+	}
+	if len(s.anyOf) > 0 && countMatches(s.anyOf, v, at) == 0 {
+		fail("matches none of anyOf")
+	}
+	if len(s.oneOf) > 0 {
+		if n := countMatches(s.oneOf, v, at); n != 1 {
+			fail("matches %d of oneOf, want exactly 1", n)
+		}
+	}
+	if s.not != nil && s.not.matches(v, at) {
+		fail("matches a schema it must not")
+	}
+	if s.ifS != nil {
+		if s.ifS.matches(v, at) {
+			if s.thenS != nil {
+				s.thenS.validate(v, at, errs)
+			}
+		} else if s.elseS != nil {
+			s.elseS.validate(v, at, errs)
+		}
+	}
+}
+
+func (s *schema) matches(v interface{}, at string) bool {
+	var errs []string
+	s.validate(v, at, &errs)
+	return len(errs) == 0
+}
+
+func countMatches(list []*schema, v interface{}, at string) int {
+	n := 0
+	for _, s := range list {
+		if s.matches(v, at) {
+			n++
+		}
+	}
+	return n
+}
+
+func pointer(at string) string {
+	if at == "" {
+		return "/"
+	}
+	return at
+}
+
+func hasType(v interface{}, types []string) bool {
+	actual := typeOf(v)
+	for _, t := range types {
+		if t == actual || (t == "number" && actual == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+func typeOf(v interface{}) string {
+	switch val := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case json.Number:
+		if n, ok := number(val); ok && n.IsInt() {
+			return "integer"
+		}
+		return "number"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+func number(v interface{}) (*big.Float, bool) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return nil, false
+	}
+	f, _, err := big.ParseFloat(string(n), 10, 128, big.ToNearestEven)
+	return f, err == nil
+}
+
+func contains(list []interface{}, v interface{}) bool {
+	for _, e := range list {
+		if equal(e, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// equal compares decoded JSON values, numbers by value so 1 equals 1.0
+func equal(a, b interface{}) bool {
+	switch av := a.(type) {
+	case json.Number:
+		an, _ := number(av)
+		bn, ok := number(b)
+		return ok && an.Cmp(bn) == 0
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for k, e := range av {
+			if other, ok := bv[k]; !ok || !equal(e, other) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for i := range av {
+			if !equal(av[i], bv[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return a == b
+}
+
+func describe(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
@@ -0,0 +1,157 @@
+// Package hdr is a High Dynamic Range histogram: it counts values in
+// buckets whose width grows with the value, so every quantile is exact to
+// a fixed number of significant digits whether values are microseconds or
+// minutes, in a fixed amount of memory.
+//
+// Values below 2^subBits each have their own bucket. Above that, every
+// power of two is split into 2^(subBits-1) buckets of equal width.
+package hdr
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"sync/atomic"
+)
+
+// Histogram counts non-negative values up to a highest trackable value.
+// It is safe for concurrent use; Record never blocks.
+type Histogram struct {
+	subBits uint
+	highest int64
+	counts  []atomic.Int64
+
+	total atomic.Int64
+	sum   atomic.Int64
+	min   atomic.Int64
+	max   atomic.Int64
+}
+
+// New returns a histogram tracking values from 0 to highest to the given
+// number of significant digits, 1 to 5. Larger values are counted as
+// highest.
+func New(highest int64, digits int) (*Histogram, error) {
+	if digits < 1 || digits > 5 {
+		return nil, fmt.Errorf("significant digits must be between 1 and 5, got %d", digits)
+	}
+	if highest < 1 {
+		return nil, fmt.Errorf("highest trackable value must be positive, got %d", highest)
+	}
+	// Buckets are at most 1/2^(subBits-1) of their value wide, which is
+	// no more than 10^-digits
+	subBits := uint(math.Ceil(math.Log2(2 * math.Pow10(digits))))
+	h := &Histogram{subBits: subBits, highest: highest}
+	h.counts = make([]atomic.Int64, h.index(highest)+1)
+	h.min.Store(math.MaxInt64)
+	return h, nil
+}
+
+// index returns the bucket of v
+func (h *Histogram) index(v int64) int {
+	linear := int64(1) << h.subBits
+	if v < linear {
+		return int(v)
+	}
+	b := uint(bits.Len64(uint64(v))) - h.subBits
+	half := linear >> 1
+	return int(linear + int64(b-1)*half + (v>>b - half))
+}
+
+// bucket returns the lowest value and width of bucket i
+func (h *Histogram) bucket(i int) (low, width int64) {
+	linear := int64(1) << h.subBits
+	if int64(i) < linear {
+		return int64(i), 1
+	}
+	half := linear >> 1
+	j := int64(i) - linear
+	b := uint(j/half) + 1
+	return (j%half + half) << b, int64(1) << b
+}
+
+// Record counts one value
+func (h *Histogram) Record(v int64) {
+	h.RecordN(v, 1)
+}
+
+// RecordN counts n occurrences of a value, as when merging the buckets of
+// another histogram read with Each
+func (h *Histogram) RecordN(v, n int64) {
+	if n <= 0 {
+		return
+	}
+	v = min(max(v, 0), h.highest)
+	h.counts[h.index(v)].Add(n)
+	h.total.Add(n)
+	h.sum.Add(v * n)
+	for {
+		m := h.min.Load()
+		if v >= m || h.min.CompareAndSwap(m, v) {
+			break
+		}
+	}
+	for {
+		m := h.max.Load()
+		if v <= m || h.max.CompareAndSwap(m, v) {
+			break
+		}
+	}
+}
+
+// Count returns how many values were recorded
+func (h *Histogram) Count() int64 {
+	return h.total.Load()
+}
+
+// Min returns the smallest value recorded, 0 if none was
+func (h *Histogram) Min() int64 {
+	if h.Count() == 0 {
+		return 0
+	}
+	return h.min.Load()
+}
+
+// Max returns the largest value recorded
+func (h *Histogram) Max() int64 {
+	return h.max.Load()
+}
+
+// Mean returns the exact mean of the values recorded
+func (h *Histogram) Mean() float64 {
+	n := h.Count()
+	if n == 0 {
+		return 0
+	}
+	return float64(h.sum.Load()) / float64(n)
+}
+
+// ValueAtQuantile returns the value at quantile q, 0 to 1: the largest
+// value in the bucket holding that rank, but no more than Max
+func (h *Histogram) ValueAtQuantile(q float64) int64 {
+	n := h.Count()
+	if n == 0 {
+		return 0
+	}
+	rank := int64(math.Ceil(min(max(q, 0), 1) * float64(n)))
+	rank = max(rank, 1)
+	var seen int64
+	for i := range h.counts {
+		seen += h.counts[i].Load()
+		if seen >= rank {
+			low, width := h.bucket(i)
+			return min(low+width-1, h.Max())
+		}
+	}
+	return h.Max()
+}
+
+// Each calls fn with the value range and count of every bucket holding
+// values, lowest first. high is inclusive.
+func (h *Histogram) Each(fn func(low, high, count int64)) {
+	for i := range h.counts {
+		if c := h.counts[i].Load(); c > 0 {
+			low, width := h.bucket(i)
+			fn(low, low+width-1, c)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package persist
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+//go:embed migrations/*.sql
+var migrations embed.FS
+
+// migrateLock is the advisory lock that keeps writers starting together
+// from applying a migration twice
+const migrateLock = 0x666c61736873616c // "flashsal"
+
+// Migrate applies the migrations the database does not have yet, each in
+// a transaction of its own, and returns how many it applied. Migrations
+// are the files of migrations/, applied in the order of the version their
+// names start with; schema_migrations records the applied ones.
+func Migrate(ctx context.Context, db *pgxpool.Pool) (int, error) {
+	conn, err := db.Acquire(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to connect: %w", err)
+	}
+	defer conn.Release()
+
+	if _, err := conn.Exec(ctx, "SELECT pg_advisory_lock($1)", int64(migrateLock)); err != nil {
+		return 0, fmt.Errorf("failed to lock migrations: %w", err)
+	}
+	defer conn.Exec(context.WithoutCancel(ctx), "SELECT pg_advisory_unlock($1)", int64(migrateLock))
+
+	_, err = conn.Exec(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+    version    INTEGER     PRIMARY KEY,
+    name       TEXT        NOT NULL,
+    applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+)`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+
+	applied := make(map[int]bool)
+	rows, err := conn.Query(ctx, "SELECT version FROM schema_migrations")
+	if err != nil {
+		return 0, fmt.Errorf("failed to read schema_migrations: %w", err)
+	}
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		applied[version] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to read schema_migrations: %w", err)
+	}
+
+	files, err := migrationFiles()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, m := range files {
+		if applied[m.version] {
+			continue
+		}
+		sql, err := migrations.ReadFile("migrations/" + m.name)
+		if err != nil {
+			return n, err
+		}
+
+		tx, err := conn.Begin(ctx)
+		if err != nil {
+			return n, err
+		}
+		// Without arguments the file is sent as one simple query, so it
+		// may hold several statements
+		if _, err := tx.Exec(ctx, string(sql)); err != nil {
+			tx.Rollback(ctx)
+			return n, fmt.Errorf("migration %s failed: %w", m.name, err)
+		}
+		if _, err := tx.Exec(ctx, "INSERT INTO schema_migrations (version, name) VALUES ($1, $2)", m.version, m.name); err != nil {
+			tx.Rollback(ctx)
+			return n, fmt.Errorf("failed to record migration %s: %w", m.name, err)
+		}
+		if err := tx.Commit(ctx); err != nil {
+			return n, fmt.Errorf("migration %s failed: %w", m.name, err)
+		}
+		log.Printf("Applied migration %s", m.name)
+		n++
+	}
+	return n, nil
+}
+
+type migration struct {
+	version int
+	name    string
+}
+
+// migrationFiles lists the embedded migrations by version
+func migrationFiles() ([]migration, error) {
+	entries, err := fs.ReadDir(migrations, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	var files []migration
+	for _, e := range entries {
+		prefix, _, _ := strings.Cut(e.Name(), "_")
+		version, err := strconv.Atoi(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s does not start with a version", e.Name())
+		}
+		files = append(files, migration{version: version, name: e.Name()})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].version < files[j].version })
+	return files, nil
+}
@@ -0,0 +1,38 @@
+-- Orders and the events that made them, written from the Redis events
+-- stream by cmd/persist. tenant is '' for the server's own sales.
+
+CREATE TABLE orders (
+    tenant      TEXT        NOT NULL DEFAULT '',
+    order_id    TEXT        NOT NULL,
+    product_id  TEXT        NOT NULL,
+    user_id     TEXT        NOT NULL,
+    agent_id    TEXT,
+    bundle_id   TEXT,
+    status      TEXT        NOT NULL,
+    created_at  TIMESTAMPTZ NOT NULL,
+    updated_at  TIMESTAMPTZ NOT NULL,
+    -- Stream ID of the event that set status, so an event applied late
+    -- never overwrites a newer status
+    event_ms    BIGINT      NOT NULL,
+    event_seq   BIGINT      NOT NULL,
+    PRIMARY KEY (tenant, order_id)
+);
+
+CREATE INDEX orders_user ON orders (tenant, user_id, created_at DESC);
+CREATE INDEX orders_product_status ON orders (tenant, product_id, status);
+
+-- Every event of the stream, orders or not, e.g. restocks
+CREATE TABLE sale_events (
+    tenant          TEXT        NOT NULL DEFAULT '',
+    event_id        TEXT        NOT NULL,
+    type            TEXT        NOT NULL,
+    product_id      TEXT,
+    order_id        TEXT,
+    status          TEXT,
+    previous_status TEXT,
+    occurred_at     TIMESTAMPTZ NOT NULL,
+    fields          JSONB       NOT NULL,
+    PRIMARY KEY (tenant, event_id)
+);
+
+CREATE INDEX sale_events_order ON sale_events (tenant, order_id) WHERE order_id IS NOT NULL;
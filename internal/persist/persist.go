@@ -0,0 +1,367 @@
+// Package persist writes the orders of the Redis events stream to
+// Postgres, a durable system of record behind the Redis hot path. Writers
+// read the stream in a consumer group, so several can share the work, and
+// acknowledge events only once their transaction committed: a writer that
+// stops leaves its events pending, to be read again on restart or taken
+// over by another writer. Every write is idempotent, so an event applied
+// twice changes nothing.
+package persist
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/redis/go-redis/v9"
+
+	"chha/internal/store"
+)
+
+const (
+	// readBlock is how long a read waits for new events
+	readBlock = 5 * time.Second
+	// maxBackoff caps the wait between attempts to write a failed batch
+	maxBackoff = 30 * time.Second
+)
+
+// Options configures a Writer
+type Options struct {
+	// Tenant is the tenant whose stream is read and whose rows are
+	// written; empty for the server's own
+	Tenant string
+	// Group is the consumer group the writers share, and Consumer names
+	// this one within it
+	Group    string
+	Consumer string
+	// BatchSize is how many events are written per transaction
+	BatchSize int64
+	// ClaimIdle is how long an event read by another writer stays
+	// unacknowledged before this one takes it over; 0 never takes any
+	ClaimIdle time.Duration
+}
+
+// Writer persists the events stream to Postgres
+type Writer struct {
+	db      *pgxpool.Pool
+	rdb     *redis.Client
+	opts    Options
+	stream  string
+	metrics *metrics
+}
+
+// New creates a writer. The database must have been migrated with Migrate.
+func New(db *pgxpool.Pool, rdb *redis.Client, opts Options) *Writer {
+	return &Writer{
+		db:      db,
+		rdb:     rdb,
+		opts:    opts,
+		stream:  store.TenantPrefix(opts.Tenant) + store.EventsStream,
+		metrics: newMetrics(),
+	}
+}
+
+// Stream is the events stream the writer reads
+func (w *Writer) Stream() string {
+	return w.stream
+}
+
+// MetricsHandler serves the writer's metrics
+func (w *Writer) MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(w.metrics.registry, promhttp.HandlerOpts{})
+}
+
+// Run persists events until ctx ends. The group starts at the beginning
+// of the stream, so the first writer persists what the stream still holds.
+func (w *Writer) Run(ctx context.Context) error {
+	err := w.rdb.XGroupCreateMkStream(ctx, w.stream, w.opts.Group, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return fmt.Errorf("failed to create consumer group: %w", err)
+	}
+
+	// Events this writer read but did not acknowledge before it stopped
+	for ctx.Err() == nil {
+		msgs, err := w.read(ctx, "0", -1)
+		if err != nil {
+			return err
+		}
+		if len(msgs) == 0 {
+			break
+		}
+		w.persist(ctx, msgs)
+	}
+
+	for ctx.Err() == nil {
+		if w.opts.ClaimIdle > 0 {
+			claimed, _, err := w.rdb.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+				Stream:   w.stream,
+				Group:    w.opts.Group,
+				Consumer: w.opts.Consumer,
+				MinIdle:  w.opts.ClaimIdle,
+				Start:    "0-0",
+				Count:    w.opts.BatchSize,
+			}).Result()
+			if err != nil && ctx.Err() == nil {
+				log.Printf("Failed to claim idle events: %v", err)
+			}
+			w.persist(ctx, claimed)
+		}
+
+		msgs, err := w.read(ctx, ">", readBlock)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("Failed to read events: %v", err)
+				sleep(ctx, time.Second)
+			}
+			continue
+		}
+		w.persist(ctx, msgs)
+	}
+	return nil
+}
+
+// read reads a batch of the group from id, ">" for new events and "0" for
+// those pending for this writer
+func (w *Writer) read(ctx context.Context, id string, block time.Duration) ([]redis.XMessage, error) {
+	streams, err := w.rdb.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    w.opts.Group,
+		Consumer: w.opts.Consumer,
+		Streams:  []string{w.stream, id},
+		Count:    w.opts.BatchSize,
+		Block:    block,
+	}).Result()
+	if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var msgs []redis.XMessage
+	for _, s := range streams {
+		msgs = append(msgs, s.Messages...)
+	}
+	return msgs, nil
+}
+
+// persist writes a batch, trying again until it commits or ctx ends, and
+// acknowledges it
+func (w *Writer) persist(ctx context.Context, msgs []redis.XMessage) {
+	if len(msgs) == 0 {
+		return
+	}
+	for backoff := time.Second; ; backoff = min(backoff*2, maxBackoff) {
+		start := time.Now()
+		last, err := w.write(ctx, msgs)
+		if err == nil {
+			w.metrics.batchDuration.Observe(time.Since(start).Seconds())
+			w.metrics.persisted.Add(float64(len(msgs)))
+			if !last.IsZero() {
+				w.metrics.lastEvent.Set(float64(last.Unix()))
+			}
+			break
+		}
+		w.metrics.failures.Inc()
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("Failed to persist %d events, retrying in %v: %v", len(msgs), backoff, err)
+		if !sleep(ctx, backoff) {
+			return
+		}
+	}
+
+	ids := make([]string, len(msgs))
+	for i, msg := range msgs {
+		ids[i] = msg.ID
+	}
+	// Committed rows are acknowledged even while stopping; a lost ack
+	// only means the events are written again
+	ackCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+	defer cancel()
+	if err := w.rdb.XAck(ackCtx, w.stream, w.opts.Group, ids...).Err(); err != nil {
+		log.Printf("Failed to acknowledge %d persisted events: %v", len(ids), err)
+	}
+}
+
+// insertEvent records an event once, whatever happens to its order later
+const insertEvent = `INSERT INTO sale_events (tenant, event_id, type, product_id, order_id, status, previous_status, occurred_at, fields)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+ON CONFLICT (tenant, event_id) DO NOTHING`
+
+// upsertOrder creates an order or moves it to the event's status, unless
+// the order already reflects a later event. Its creation time is that of
+// its earliest event, the purchase once it has been applied.
+const upsertOrder = `INSERT INTO orders (tenant, order_id, product_id, user_id, agent_id, bundle_id, status, created_at, updated_at, event_ms, event_seq)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $8, $9, $10)
+ON CONFLICT (tenant, order_id) DO UPDATE SET
+    agent_id   = COALESCE(orders.agent_id, EXCLUDED.agent_id),
+    bundle_id  = COALESCE(orders.bundle_id, EXCLUDED.bundle_id),
+    created_at = LEAST(orders.created_at, EXCLUDED.created_at),
+    status     = CASE WHEN (orders.event_ms, orders.event_seq) < (EXCLUDED.event_ms, EXCLUDED.event_seq) THEN EXCLUDED.status ELSE orders.status END,
+    updated_at = CASE WHEN (orders.event_ms, orders.event_seq) < (EXCLUDED.event_ms, EXCLUDED.event_seq) THEN EXCLUDED.updated_at ELSE orders.updated_at END,
+    event_ms   = GREATEST(orders.event_ms, EXCLUDED.event_ms),
+    event_seq  = CASE WHEN (orders.event_ms, orders.event_seq) < (EXCLUDED.event_ms, EXCLUDED.event_seq) THEN EXCLUDED.event_seq ELSE orders.event_seq END`
+
+// write writes a batch in one transaction and returns the time of its
+// latest event
+func (w *Writer) write(ctx context.Context, msgs []redis.XMessage) (time.Time, error) {
+	var last time.Time
+	batch := &pgx.Batch{}
+	for _, msg := range msgs {
+		e, err := parseEvent(msg)
+		if err != nil {
+			// Cannot be written however often it is tried
+			log.Printf("Skipping event %s: %v", msg.ID, err)
+			continue
+		}
+		batch.Queue(insertEvent, w.opts.Tenant, msg.ID, e.typ, e.productID, e.orderID, e.status, e.previousStatus, e.at, e.fields)
+		if e.order() {
+			batch.Queue(upsertOrder, w.opts.Tenant, e.orderID, e.productID, e.userID, e.agentID, e.bundleID, e.status, e.at, e.ms, e.seq)
+		}
+		if e.at.After(last) {
+			last = e.at
+		}
+	}
+	if batch.Len() == 0 {
+		return last, nil
+	}
+
+	tx, err := w.db.Begin(ctx)
+	if err != nil {
+		return last, err
+	}
+	defer tx.Rollback(context.WithoutCancel(ctx))
+	if err := tx.SendBatch(ctx, batch).Close(); err != nil {
+		return last, err
+	}
+	return last, tx.Commit(ctx)
+}
+
+// event is a stream entry in the form of the rows it is written as.
+// Optional fields are nil when the entry has none.
+type event struct {
+	ms, seq        int64
+	typ            string
+	productID      *string
+	orderID        *string
+	userID         *string
+	agentID        *string
+	bundleID       *string
+	status         *string
+	previousStatus *string
+	at             time.Time
+	fields         []byte
+}
+
+// order reports whether the event sets the status of an order, which all
+// order events carry along with the buyer and product
+func (e event) order() bool {
+	return e.orderID != nil && e.status != nil && e.userID != nil && e.productID != nil
+}
+
+func parseEvent(msg redis.XMessage) (event, error) {
+	msStr, seqStr, ok := strings.Cut(msg.ID, "-")
+	ms, err1 := strconv.ParseInt(msStr, 10, 64)
+	seq, err2 := strconv.ParseInt(seqStr, 10, 64)
+	if !ok || err1 != nil || err2 != nil {
+		return event{}, fmt.Errorf("invalid stream ID %q", msg.ID)
+	}
+	fields, err := json.Marshal(msg.Values)
+	if err != nil {
+		return event{}, err
+	}
+
+	e := event{
+		ms:             ms,
+		seq:            seq,
+		typ:            field(msg.Values, "type"),
+		productID:      optional(msg.Values, "product_id"),
+		orderID:        optional(msg.Values, "order_id"),
+		userID:         optional(msg.Values, "buyer"),
+		agentID:        optional(msg.Values, "agent"),
+		bundleID:       optional(msg.Values, "bundle_id"),
+		status:         optional(msg.Values, "status"),
+		previousStatus: optional(msg.Values, "previous_status"),
+		// The stream ID is when the event was appended, the closest to
+		// its own time that every event has
+		at:     time.UnixMilli(ms).UTC(),
+		fields: fields,
+	}
+	if e.typ == "" {
+		return event{}, fmt.Errorf("no type")
+	}
+	if ts, err := strconv.ParseInt(field(msg.Values, "timestamp"), 10, 64); err == nil && ts > 0 {
+		e.at = time.Unix(ts, 0).UTC()
+	}
+	return e, nil
+}
+
+func field(values map[string]interface{}, key string) string {
+	s, _ := values[key].(string)
+	return s
+}
+
+func optional(values map[string]interface{}, key string) *string {
+	if s := field(values, key); s != "" {
+		return &s
+	}
+	return nil
+}
+
+// sleep waits d, or less if ctx ends first, and reports whether it waited
+// the whole d
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// metrics are the writer's own, served by MetricsHandler
+type metrics struct {
+	registry      *prometheus.Registry
+	persisted     prometheus.Counter
+	failures      prometheus.Counter
+	batchDuration prometheus.Histogram
+	lastEvent     prometheus.Gauge
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		persisted: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "flashsale",
+			Name:      "persist_events_total",
+			Help:      "Events of the stream written to Postgres, including ones written again after a redelivery.",
+		}),
+		failures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "flashsale",
+			Name:      "persist_failures_total",
+			Help:      "Batches whose transaction failed and was tried again.",
+		}),
+		batchDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "flashsale",
+			Name:      "persist_batch_seconds",
+			Help:      "Time to write one batch of events to Postgres.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 2, 14),
+		}),
+		lastEvent: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "flashsale",
+			Name:      "persist_last_event_timestamp_seconds",
+			Help:      "Time of the latest event written; how far it trails now is how far Postgres is behind.",
+		}),
+	}
+	m.registry.MustRegister(m.persisted, m.failures, m.batchDuration, m.lastEvent)
+	return m
+}
@@ -0,0 +1,145 @@
+// Package quicnet carries the flash sale protocol over QUIC. Every
+// bidirectional stream is one protocol connection, framed exactly as over
+// TCP, so the server serves it with the same handler. The streams of one
+// QUIC connection are delivered independently: a lost packet only stalls
+// the stream it belongs to, not every connection of the client.
+package quicnet
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// ALPN is the application protocol both sides negotiate
+const ALPN = "flashsale"
+
+// Config are the QUIC settings of both sides. Keepalives hold the
+// connection open while its streams wait on events or admin operations.
+func Config() *quic.Config {
+	return &quic.Config{
+		MaxIdleTimeout:     time.Minute,
+		KeepAlivePeriod:    15 * time.Second,
+		MaxIncomingStreams: 1000,
+	}
+}
+
+// TLSConfig returns a copy of base for QUIC, which needs TLS 1.3 and the
+// ALPN; a nil base verifies against the system roots
+func TLSConfig(base *tls.Config) *tls.Config {
+	c := &tls.Config{}
+	if base != nil {
+		c = base.Clone()
+	}
+	c.NextProtos = []string{ALPN}
+	c.MinVersion = tls.VersionTLS13
+	return c
+}
+
+// Conn is a QUIC stream as a net.Conn
+type Conn struct {
+	*quic.Stream
+	conn *quic.Conn
+}
+
+// NewConn wraps stream, opened on conn
+func NewConn(conn *quic.Conn, stream *quic.Stream) *Conn {
+	return &Conn{Stream: stream, conn: conn}
+}
+
+func (c *Conn) LocalAddr() net.Addr  { return c.conn.LocalAddr() }
+func (c *Conn) RemoteAddr() net.Addr { return c.conn.RemoteAddr() }
+
+// Read reads from the stream. The peer closing the whole QUIC connection
+// without an error ends the stream as io.EOF, like a TCP close.
+func (c *Conn) Read(p []byte) (int, error) {
+	n, err := c.Stream.Read(p)
+	var appErr *quic.ApplicationError
+	if errors.As(err, &appErr) && appErr.Remote && appErr.ErrorCode == 0 {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// Close ends both directions of the stream; closing a QUIC stream only
+// ends the sending side
+func (c *Conn) Close() error {
+	c.Stream.CancelRead(0)
+	return c.Stream.Close()
+}
+
+// Dialer opens streams on one QUIC connection to Addr, dialled on first
+// use and again once it fails. It is safe for concurrent use.
+type Dialer struct {
+	Addr string
+	TLS  *tls.Config
+
+	mu     sync.Mutex
+	conn   *quic.Conn
+	closed bool
+}
+
+// ErrDialerClosed is returned by Dial once the Dialer is closed
+var ErrDialerClosed = errors.New("quic dialer closed")
+
+// Dial opens a stream. The server only learns of it once something is
+// written, which the protocol's first frame does.
+func (d *Dialer) Dial(ctx context.Context) (*Conn, error) {
+	conn, err := d.connection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		d.forget(conn)
+		return nil, err
+	}
+	return NewConn(conn, stream), nil
+}
+
+// connection is the shared QUIC connection, dialled unless it is open
+func (d *Dialer) connection(ctx context.Context) (*quic.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return nil, ErrDialerClosed
+	}
+	if d.conn != nil && d.conn.Context().Err() == nil {
+		return d.conn, nil
+	}
+	conn, err := quic.DialAddr(ctx, d.Addr, TLSConfig(d.TLS), Config())
+	if err != nil {
+		return nil, err
+	}
+	d.conn = conn
+	return conn, nil
+}
+
+// forget drops conn after a failure, so the next Dial dials again
+func (d *Dialer) forget(conn *quic.Conn) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.conn == conn {
+		conn.CloseWithError(0, "")
+		d.conn = nil
+	}
+}
+
+// Close closes the QUIC connection and its streams
+func (d *Dialer) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.closed = true
+	if d.conn == nil {
+		return nil
+	}
+	err := d.conn.CloseWithError(0, "")
+	d.conn = nil
+	return err
+}
@@ -0,0 +1,361 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"chha/internal/store"
+	"chha/pkg/protocol"
+)
+
+// adminProgressInterval limits how often progress frames are sent per
+// operation; stage changes are always sent
+const adminProgressInterval = 250 * time.Millisecond
+
+// AdminOpRequest starts a long-running admin operation. OpID is chosen by
+// the client and tags every progress and result frame of the operation.
+type AdminOpRequest struct {
+	OpID       string `json:"op_id"`
+	Op         string `json:"op"`
+	ProductID  string `json:"product_id,omitempty"`
+	AdminToken string `json:"admin_token"`
+}
+
+// AdminOpResponse is the final frame of an operation
+type AdminOpResponse struct {
+	Status string      `json:"status"`
+	OpID   string      `json:"op_id,omitempty"`
+	Result interface{} `json:"result,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+// OpProgress is sent as MSG_OP_PROGRESS while an operation runs. Percent
+// is omitted while the total amount of work is unknown.
+type OpProgress struct {
+	OpID    string   `json:"op_id"`
+	Stage   string   `json:"stage"`
+	Done    int64    `json:"done"`
+	Total   int64    `json:"total,omitempty"`
+	Percent *float64 `json:"percent,omitempty"`
+}
+
+// CancelOpRequest cancels a running operation on the same connection
+type CancelOpRequest struct {
+	OpID string `json:"op_id"`
+}
+
+// session is the per-connection state needed once frames are no longer
+// strictly request/response: operations write frames from their own
+// goroutines, so writes are serialized.
+type session struct {
+	conn    net.Conn
+	writeMu sync.Mutex
+	// lastActive is when a frame was last read or written, in Unix
+	// nanoseconds, for the idle reaper
+	lastActive atomic.Int64
+
+	// proto is set by MSG_HELLO before any other frame is handled
+	proto protocolState
+	// goAwayBy is the deadline sent in MSG_GOAWAY, zero until one is sent.
+	// Only the connection's own goroutine uses it.
+	goAwayBy time.Time
+
+	// inFlight holds a token for every request being handled concurrently
+	// with request_ids, nil without them. Only the connection's own
+	// goroutine sets it.
+	inFlight chan struct{}
+
+	opsMu sync.Mutex
+	ops   map[string]context.CancelFunc
+	opsWg sync.WaitGroup
+	// tickets are queued purchases awaiting MSG_QUEUE_RESULT
+	tickets map[string]bool
+	// identity is the user bound with MSG_AUTH, nil until then
+	identity atomic.Pointer[identity]
+}
+
+func newSession(conn net.Conn) *session {
+	sess := &session{conn: conn, ops: make(map[string]context.CancelFunc), tickets: make(map[string]bool)}
+	sess.touch()
+	return sess
+}
+
+func (sess *session) touch() {
+	sess.lastActive.Store(time.Now().UnixNano())
+}
+
+func (sess *session) addTicket(ticketID string) {
+	sess.opsMu.Lock()
+	sess.tickets[ticketID] = true
+	sess.opsMu.Unlock()
+}
+
+func (sess *session) removeTicket(ticketID string) {
+	sess.opsMu.Lock()
+	delete(sess.tickets, ticketID)
+	sess.opsMu.Unlock()
+}
+
+// write sends a frame the server pushes, not answering a request
+func (sess *session) write(s *Server, msgType byte, c codec, payload []byte) error {
+	return sess.reply(s, msgType, c, payload, 0, protocol.Timing{})
+}
+
+// reply sends a frame answering a request: requestID is its REQUEST_ID,
+// timing carries its ClientSent and ServerReceived, and ServerSent is set
+// here
+func (sess *session) reply(s *Server, msgType byte, c codec, payload []byte, requestID uint32, timing protocol.Timing) error {
+	sess.writeMu.Lock()
+	defer sess.writeMu.Unlock()
+	now := time.Now()
+	if timeout := s.config().ConnWriteTimeout; timeout > 0 {
+		sess.conn.SetWriteDeadline(now.Add(timeout))
+	} else {
+		sess.conn.SetWriteDeadline(time.Time{})
+	}
+	timing.ServerSent = now.UnixMicro()
+	err := protocol.WriteFrame(sess.conn, sess.proto.framing(), protocol.Frame{
+		Type:      msgType,
+		Encoding:  c.ID(),
+		RequestID: requestID,
+		Timing:    timing,
+		Payload:   payload,
+	})
+	if err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			s.metrics.connectionsClosed.WithLabelValues("write_timeout").Inc()
+			// A frame may be half written, nothing after it can be sent
+			sess.conn.Close()
+		}
+		return err
+	}
+	sess.touch()
+	return nil
+}
+
+// running reports whether any operation is in progress, a request is
+// being handled or a queued purchase is awaiting its result, in which case
+// an idle read deadline is not a reason to drop the connection
+func (sess *session) running() bool {
+	if len(sess.inFlight) > 0 {
+		return true
+	}
+	sess.opsMu.Lock()
+	defer sess.opsMu.Unlock()
+	return len(sess.ops) > 0 || len(sess.tickets) > 0
+}
+
+// close cancels every operation and waits for them, and for requests
+// still being handled, to finish. It returns the queued purchases still
+// awaiting a result.
+func (sess *session) close() []string {
+	sess.opsMu.Lock()
+	for _, cancel := range sess.ops {
+		cancel()
+	}
+	tickets := make([]string, 0, len(sess.tickets))
+	for id := range sess.tickets {
+		tickets = append(tickets, id)
+	}
+	sess.opsMu.Unlock()
+	sess.opsWg.Wait()
+	return tickets
+}
+
+// adminOps are the operations available through MSG_ADMIN_OP
+var adminOps = map[string]func(s *Server, ctx context.Context, req AdminOpRequest, progress store.ProgressFunc) (interface{}, error){
+	"audit_duplicates": (*Server).opAuditDuplicates,
+	"balance_report":   (*Server).opBalanceReport,
+}
+
+// startAdminOp validates an MSG_ADMIN_OP request and runs the operation in
+// its own goroutine, so MSG_CANCEL_OP can still be read meanwhile
+func (s *Server) startAdminOp(sess *session, c codec, payload []byte) {
+	reply := func(resp AdminOpResponse) {
+		data, _ := c.Marshal(resp)
+		if err := sess.write(s, protocol.MSG_ADMIN_OP, c, data); err != nil {
+			log.Printf("Write error to %s: %v", sess.conn.RemoteAddr(), err)
+		}
+	}
+
+	var req AdminOpRequest
+	if err := c.Unmarshal(payload, &req); err != nil {
+		reply(AdminOpResponse{Status: protocol.STATUS_ERROR, Error: "invalid json"})
+		return
+	}
+	if s.opts.AdminToken == "" ||
+		subtle.ConstantTimeCompare([]byte(req.AdminToken), []byte(s.opts.AdminToken)) != 1 {
+		reply(AdminOpResponse{Status: protocol.STATUS_ERROR, OpID: req.OpID, Error: "unauthorized"})
+		return
+	}
+	run, ok := adminOps[req.Op]
+	if req.OpID == "" || !ok {
+		reply(AdminOpResponse{Status: protocol.STATUS_ERROR, OpID: req.OpID, Error: "missing op_id or unknown op"})
+		return
+	}
+
+	ctx, cancel := context.WithCancel(withCommandTags(s.ctx, "none", "admin_"+req.Op))
+	sess.opsMu.Lock()
+	if _, dup := sess.ops[req.OpID]; dup {
+		sess.opsMu.Unlock()
+		cancel()
+		reply(AdminOpResponse{Status: protocol.STATUS_ERROR, OpID: req.OpID, Error: "op_id already running"})
+		return
+	}
+	sess.ops[req.OpID] = cancel
+	sess.opsWg.Add(1)
+	sess.opsMu.Unlock()
+
+	log.Printf("Admin op started: op=%s op_id=%s from %s", req.Op, req.OpID, sess.conn.RemoteAddr())
+
+	go func() {
+		defer sess.opsWg.Done()
+		defer func() {
+			sess.opsMu.Lock()
+			delete(sess.ops, req.OpID)
+			sess.opsMu.Unlock()
+			cancel()
+		}()
+
+		result, err := run(s, ctx, req, s.progressReporter(sess, c, req.OpID))
+		switch {
+		case errors.Is(ctx.Err(), context.Canceled):
+			log.Printf("Admin op cancelled: op=%s op_id=%s", req.Op, req.OpID)
+			reply(AdminOpResponse{Status: protocol.STATUS_ERROR, OpID: req.OpID, Error: "cancelled"})
+		case err != nil:
+			log.Printf("Admin op failed: op=%s op_id=%s: %v", req.Op, req.OpID, err)
+			reply(AdminOpResponse{Status: protocol.STATUS_ERROR, OpID: req.OpID, Error: err.Error()})
+		default:
+			reply(AdminOpResponse{Status: protocol.STATUS_SUCCESS, OpID: req.OpID, Result: result})
+		}
+	}()
+}
+
+// progressReporter returns a ProgressFunc that sends MSG_OP_PROGRESS
+// frames, throttled to adminProgressInterval within a stage
+func (s *Server) progressReporter(sess *session, c codec, opID string) store.ProgressFunc {
+	var (
+		lastStage string
+		lastSent  time.Time
+	)
+	return func(p store.Progress) {
+		if p.Stage == lastStage && time.Since(lastSent) < adminProgressInterval {
+			return
+		}
+		lastStage, lastSent = p.Stage, time.Now()
+
+		frame := OpProgress{OpID: opID, Stage: p.Stage, Done: p.Done, Total: p.Total}
+		if p.Total > 0 {
+			pct := float64(p.Done) * 100 / float64(p.Total)
+			frame.Percent = &pct
+		}
+		data, _ := c.Marshal(frame)
+		sess.write(s, protocol.MSG_OP_PROGRESS, c, data)
+	}
+}
+
+// handleCancelOp serves MSG_CANCEL_OP. The operation itself answers with a
+// final "cancelled" frame once it has stopped.
+func (s *Server) handleCancelOp(sess *session, c codec, payload []byte) []byte {
+	var req CancelOpRequest
+	if err := c.Unmarshal(payload, &req); err != nil {
+		data, _ := c.Marshal(AdminOpResponse{Status: protocol.STATUS_ERROR, Error: "invalid json"})
+		return data
+	}
+
+	sess.opsMu.Lock()
+	cancel, ok := sess.ops[req.OpID]
+	sess.opsMu.Unlock()
+	if !ok {
+		data, _ := c.Marshal(AdminOpResponse{Status: protocol.STATUS_ERROR, OpID: req.OpID, Error: "no such operation"})
+		return data
+	}
+
+	cancel()
+	data, _ := c.Marshal(AdminOpResponse{Status: protocol.STATUS_SUCCESS, OpID: req.OpID})
+	return data
+}
+
+// opAuditDuplicates is the streaming version of `setup audit-duplicates`
+func (s *Server) opAuditDuplicates(ctx context.Context, req AdminOpRequest, progress store.ProgressFunc) (interface{}, error) {
+	auditor, ok := s.store.(store.Auditor)
+	if !ok {
+		return nil, fmt.Errorf("store does not support audits")
+	}
+	if req.ProductID == "" {
+		return nil, fmt.Errorf("missing product_id")
+	}
+
+	dups, err := auditor.AuditDuplicates(ctx, req.ProductID, progress)
+	if err != nil {
+		return nil, err
+	}
+
+	type duplicate struct {
+		UserID       string   `json:"user_id"`
+		Grants       int      `json:"grants"`
+		BuyerEntries int      `json:"buyer_entries"`
+		Events       int      `json:"events"`
+		Orders       []string `json:"orders"`
+	}
+	out := make([]duplicate, 0, len(dups))
+	for _, d := range dups {
+		orders := make([]string, 0, len(d.Orders))
+		for _, o := range d.Orders {
+			orders = append(orders, o.ID)
+		}
+		out = append(out, duplicate{
+			UserID:       d.UserID,
+			Grants:       d.Grants(),
+			BuyerEntries: d.BuyerEntries,
+			Events:       d.Events,
+			Orders:       orders,
+		})
+	}
+	return map[string]interface{}{"duplicates": out}, nil
+}
+
+// opBalanceReport checks stock + net sold against initial stock for every
+// product
+func (s *Server) opBalanceReport(ctx context.Context, req AdminOpRequest, progress store.ProgressFunc) (interface{}, error) {
+	ids, err := s.store.ListProducts(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	type balance struct {
+		ProductID    string `json:"product_id"`
+		InitialStock int64  `json:"initial_stock"`
+		Stock        int64  `json:"stock"`
+		Sold         int64  `json:"sold"`
+		Returned     int64  `json:"returned"`
+		Balanced     bool   `json:"balanced"`
+	}
+	report := make([]balance, 0, len(ids))
+	for i, id := range ids {
+		info, err := s.store.ProductInfo(ctx, id)
+		if errors.Is(err, store.ErrProductNotFound) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		report = append(report, balance{
+			ProductID:    id,
+			InitialStock: info.InitialStock,
+			Stock:        info.Stock,
+			Sold:         info.Sold,
+			Returned:     info.Returned,
+			Balanced:     info.Balanced(),
+		})
+		progress(store.Progress{Stage: "products", Done: int64(i + 1), Total: int64(len(ids))})
+	}
+	return map[string]interface{}{"products": report}, nil
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"chha/internal/store"
+)
+
+// adminOrder is an order in the /admin/holds and /admin/orders responses.
+// Times are Unix seconds.
+type adminOrder struct {
+	OrderID         string `json:"order_id"`
+	ProductID       string `json:"product_id"`
+	UserID          string `json:"user_id"`
+	AgentID         string `json:"agent_id,omitempty"`
+	Status          string `json:"status"`
+	HeldFrom        string `json:"held_from,omitempty"`
+	Reason          string `json:"reason,omitempty"`
+	CreatedAt       int64  `json:"created_at"`
+	HeldAt          int64  `json:"held_at,omitempty"`
+	PaymentDeadline int64  `json:"payment_deadline,omitempty"`
+	FulfilledAt     int64  `json:"fulfilled_at,omitempty"`
+	// RemainingStock is set on a rejection, the stock after the unit
+	// was returned
+	RemainingStock *int64 `json:"remaining_stock,omitempty"`
+}
+
+func newAdminOrder(o store.Order) adminOrder {
+	r := adminOrder{
+		OrderID:   o.ID,
+		ProductID: o.ProductID,
+		UserID:    o.UserID,
+		AgentID:   o.AgentID,
+		Status:    o.Status,
+		HeldFrom:  o.HeldFrom,
+		Reason:    o.HoldReason,
+		CreatedAt: o.CreatedAt.Unix(),
+	}
+	if !o.HeldAt.IsZero() {
+		r.HeldAt = o.HeldAt.Unix()
+	}
+	if o.Status == store.OrderPending && !o.ExpiresAt.IsZero() {
+		r.PaymentDeadline = o.ExpiresAt.Unix()
+	}
+	if !o.FulfilledAt.IsZero() {
+		r.FulfilledAt = o.FulfilledAt.Unix()
+	}
+	return r
+}
+
+// handleFulfillOrder serves POST /admin/orders/{id}/fulfill, called by the
+// fulfillment system once a CONFIRMED order shipped. Fulfilling it again
+// succeeds, so the call can be retried.
+func (s *Server) handleFulfillOrder(w http.ResponseWriter, r *http.Request) {
+	if !s.adminAuthorized(w, r) {
+		return
+	}
+	fulfiller, ok := s.store.(store.OrderFulfiller)
+	if !ok {
+		writeJSONError(w, http.StatusNotImplemented, "the store does not support order fulfillment")
+		return
+	}
+	if s.readOnly() {
+		writeJSONError(w, http.StatusServiceUnavailable, readOnlyError)
+		return
+	}
+
+	order, err := fulfiller.FulfillOrder(withCommandTags(r.Context(), "none", "admin_fulfill_order"), r.PathValue("id"))
+	switch {
+	case errors.Is(err, store.ErrOrderNotFound):
+		writeJSONError(w, http.StatusNotFound, err.Error())
+		return
+	case errors.Is(err, store.ErrInvalidTransition):
+		writeJSONError(w, http.StatusConflict, err.Error())
+		return
+	case err != nil:
+		log.Printf("Admin fulfill order failed: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	s.metrics.ordersFulfilled.Inc()
+	log.Printf("Order fulfilled: product=%s user=%s order=%s", order.ProductID, order.UserID, order.ID)
+
+	go s.emitEvent(order.ProductID, true, map[string]interface{}{
+		"type":            "order_fulfilled",
+		"product_id":      order.ProductID,
+		"buyer":           order.UserID,
+		"order_id":        order.ID,
+		"status":          store.OrderFulfilled,
+		"previous_status": store.OrderConfirmed,
+		"timestamp":       time.Now().Unix(),
+	})
+
+	writeJSON(w, http.StatusOK, newAdminOrder(order))
+}
@@ -0,0 +1,315 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"chha/internal/store"
+)
+
+const (
+	// adminBuyersLimit is the default page size of the buyers endpoint
+	adminBuyersLimit = 100
+	// adminBuyersMaxLimit caps the page size of the buyers endpoint
+	adminBuyersMaxLimit = 1000
+)
+
+// createProductRequest is the body of POST /admin/products. SaleStart and
+// SaleEnd are Unix seconds, 0 leaving that side open.
+type createProductRequest struct {
+	ProductID string `json:"product_id"`
+	Stock     int64  `json:"stock"`
+	Shards    int    `json:"shards,omitempty"`
+	SaleStart int64  `json:"sale_start,omitempty"`
+	SaleEnd   int64  `json:"sale_end,omitempty"`
+}
+
+// stockRequest is the body of POST /admin/products/{id}/stock. Exactly one
+// of Stock, the units that should remain, and Add, which may be negative,
+// is set.
+type stockRequest struct {
+	Stock *int64 `json:"stock,omitempty"`
+	Add   *int64 `json:"add,omitempty"`
+}
+
+// stockResponse reports a stock change
+type stockResponse struct {
+	ProductID string `json:"product_id"`
+	Previous  int64  `json:"previous"`
+	Stock     int64  `json:"stock"`
+}
+
+// productAdmin returns the store's product management, answering 501 if it
+// has none, and 503 while the server is read only since every product
+// change is a write
+func (s *Server) productAdmin(w http.ResponseWriter, write bool) (store.ProductAdmin, bool) {
+	pa, ok := s.store.(store.ProductAdmin)
+	if !ok {
+		writeJSONError(w, http.StatusNotImplemented, "the store does not support product management")
+		return nil, false
+	}
+	if write && s.readOnly() {
+		writeJSONError(w, http.StatusServiceUnavailable, readOnlyError)
+		return nil, false
+	}
+	return pa, true
+}
+
+// handleProducts serves /admin/products: GET lists every product and POST
+// creates one. Listing needs no token, like /metrics on the same address,
+// but creating needs ADMIN_TOKEN.
+func (s *Server) handleProducts(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.handleListProducts(w, r)
+	case http.MethodPost:
+		s.handleCreateProduct(w, r)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// handleCreateProduct creates a product, refusing with 409 one that
+// already exists rather than wiping its buyers as `setup init` would
+func (s *Server) handleCreateProduct(w http.ResponseWriter, r *http.Request) {
+	if !s.adminAuthorized(w, r) {
+		return
+	}
+	pa, ok := s.productAdmin(w, true)
+	if !ok {
+		return
+	}
+
+	var req createProductRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	switch {
+	case req.ProductID == "":
+		writeJSONError(w, http.StatusBadRequest, "product_id is required")
+		return
+	case req.Stock < 0:
+		writeJSONError(w, http.StatusBadRequest, "stock must not be negative")
+		return
+	case req.Shards == 1 || req.Shards < 0 || req.Shards > store.MaxShards:
+		writeJSONError(w, http.StatusBadRequest, "shards must be 0 or between 2 and "+strconv.Itoa(store.MaxShards))
+		return
+	case req.SaleStart != 0 && req.SaleEnd != 0 && req.SaleEnd <= req.SaleStart:
+		writeJSONError(w, http.StatusBadRequest, "sale_end must be after sale_start")
+		return
+	}
+
+	ctx := withCommandTags(r.Context(), req.ProductID, "admin_create_product")
+	_, err := s.store.ProductInfo(ctx, req.ProductID)
+	if err == nil {
+		writeJSONError(w, http.StatusConflict, "product already exists")
+		return
+	} else if !errors.Is(err, store.ErrProductNotFound) {
+		log.Printf("Admin create product failed: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if req.Shards > 0 {
+		err = pa.InitShardedProduct(ctx, req.ProductID, req.Stock, req.Shards)
+	} else {
+		err = s.store.InitProduct(ctx, req.ProductID, req.Stock)
+	}
+	if err == nil && (req.SaleStart != 0 || req.SaleEnd != 0) {
+		err = pa.SetSaleWindow(ctx, req.ProductID, unixOrZero(req.SaleStart), unixOrZero(req.SaleEnd))
+	}
+	if err != nil {
+		log.Printf("Admin create product failed: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	log.Printf("Product %s created with %d units through the admin API", req.ProductID, req.Stock)
+
+	s.writeProductStatus(w, r, req.ProductID, http.StatusCreated)
+}
+
+// handleProduct serves GET /admin/products/{id}
+func (s *Server) handleProduct(w http.ResponseWriter, r *http.Request) {
+	if !s.adminAuthorized(w, r) {
+		return
+	}
+	s.writeProductStatus(w, r, r.PathValue("id"), http.StatusOK)
+}
+
+// handleProductStock serves POST /admin/products/{id}/stock, which sets or
+// adds to a product's stock mid-sale without touching its buyers
+func (s *Server) handleProductStock(w http.ResponseWriter, r *http.Request) {
+	if !s.adminAuthorized(w, r) {
+		return
+	}
+	pa, ok := s.productAdmin(w, true)
+	if !ok {
+		return
+	}
+
+	var req stockRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if (req.Stock == nil) == (req.Add == nil) {
+		writeJSONError(w, http.StatusBadRequest, "exactly one of stock and add is required")
+		return
+	}
+	if req.Stock != nil && *req.Stock < 0 {
+		writeJSONError(w, http.StatusBadRequest, "stock must not be negative")
+		return
+	}
+
+	productID := r.PathValue("id")
+	ctx := withCommandTags(r.Context(), productID, "admin_stock")
+	var change store.StockChange
+	var err error
+	if req.Stock != nil {
+		change, err = pa.SetStock(ctx, productID, *req.Stock)
+	} else {
+		change, err = pa.AddStock(ctx, productID, *req.Add)
+	}
+	switch {
+	case errors.Is(err, store.ErrProductNotFound):
+		writeJSONError(w, http.StatusNotFound, err.Error())
+		return
+	case errors.Is(err, store.ErrInsufficientStock), errors.Is(err, store.ErrSaleClosed):
+		writeJSONError(w, http.StatusConflict, err.Error())
+		return
+	case err != nil:
+		log.Printf("Admin stock change failed: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if s.soldOut != nil && change.Stock > 0 {
+		s.soldOut.forget(productID)
+	}
+	log.Printf("Stock of %s changed from %d to %d through the admin API", productID, change.Previous, change.Stock)
+
+	writeJSON(w, http.StatusOK, stockResponse{
+		ProductID: productID,
+		Previous:  change.Previous,
+		Stock:     change.Stock,
+	})
+}
+
+// handleProductPause serves /admin/products/{id}/pause: POST pauses the
+// sale, so purchases and bundles of the product answer PAUSED, and DELETE
+// resumes it
+func (s *Server) handleProductPause(w http.ResponseWriter, r *http.Request) {
+	if !s.adminAuthorized(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	pa, ok := s.productAdmin(w, true)
+	if !ok {
+		return
+	}
+
+	productID := r.PathValue("id")
+	ctx := withCommandTags(r.Context(), productID, "admin_pause")
+	if _, err := s.store.ProductInfo(ctx, productID); errors.Is(err, store.ErrProductNotFound) {
+		writeJSONError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	paused := r.Method == http.MethodPost
+	if err := pa.SetPaused(ctx, productID, paused); err != nil {
+		log.Printf("Admin pause failed: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if paused {
+		log.Printf("Sale of %s paused through the admin API", productID)
+	} else {
+		log.Printf("Sale of %s resumed through the admin API", productID)
+	}
+
+	s.writeProductStatus(w, r, productID, http.StatusOK)
+}
+
+// handleProductBuyers serves GET /admin/products/{id}/buyers, a page of
+// buyers oldest first. cursor is the next_cursor of the previous page and
+// limit defaults to adminBuyersLimit.
+func (s *Server) handleProductBuyers(w http.ResponseWriter, r *http.Request) {
+	if !s.adminAuthorized(w, r) {
+		return
+	}
+	pa, ok := s.productAdmin(w, false)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	var offset int64
+	if cursor := query.Get("cursor"); cursor != "" {
+		n, err := strconv.ParseInt(cursor, 10, 64)
+		if err != nil || n < 0 {
+			writeJSONError(w, http.StatusBadRequest, "invalid cursor")
+			return
+		}
+		offset = n
+	}
+	limit := int64(adminBuyersLimit)
+	if l := query.Get("limit"); l != "" {
+		n, err := strconv.ParseInt(l, 10, 64)
+		if err != nil || n <= 0 {
+			writeJSONError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+		limit = min(n, adminBuyersMaxLimit)
+	}
+
+	productID := r.PathValue("id")
+	ctx := withCommandTags(r.Context(), productID, "admin_buyers")
+	if _, err := s.store.ProductInfo(ctx, productID); errors.Is(err, store.ErrProductNotFound) {
+		writeJSONError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	records, next, total, err := pa.BuyerPage(ctx, productID, offset, limit)
+	if err != nil {
+		log.Printf("Admin buyers failed: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	resp := map[string]interface{}{
+		"buyers": records,
+		"total":  total,
+	}
+	if next >= 0 {
+		resp["next_cursor"] = strconv.FormatInt(next, 10)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// writeProductStatus answers with the product's current status
+func (s *Server) writeProductStatus(w http.ResponseWriter, r *http.Request, productID string, code int) {
+	ctx := withCommandTags(r.Context(), productID, "admin_product")
+	info, err := s.store.ProductInfo(ctx, productID)
+	if errors.Is(err, store.ErrProductNotFound) {
+		writeJSONError(w, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		log.Printf("Admin product failed: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, code, newProductStatus(info, time.Now()))
+}
+
+func unixOrZero(sec int64) time.Time {
+	if sec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(sec, 0)
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"chha/internal/store"
+)
+
+// blocklist is this server's copy of the store's blocklist, so blocked
+// connections and purchases are turned away without Redis. It is loaded
+// again whenever a change is announced on store.BlocklistChannel, and
+// every BLOCKLIST_REFRESH in case an announcement was missed.
+type blocklist struct {
+	mu    sync.RWMutex
+	users map[string]bool
+	// nets holds the blocked networks by prefix length, so an address is
+	// looked up once per length in use
+	nets map[int]map[netip.Prefix]bool
+}
+
+// set replaces the blocked users and networks
+func (b *blocklist) set(list store.Blocklist) {
+	users := make(map[string]bool, len(list.Users))
+	for _, u := range list.Users {
+		users[u] = true
+	}
+	nets := make(map[int]map[netip.Prefix]bool)
+	for _, p := range list.Networks {
+		p = p.Masked()
+		if nets[p.Bits()] == nil {
+			nets[p.Bits()] = make(map[netip.Prefix]bool)
+		}
+		nets[p.Bits()][p] = true
+	}
+
+	b.mu.Lock()
+	b.users, b.nets = users, nets
+	b.mu.Unlock()
+}
+
+// userBlocked reports whether any of ids is blocked
+func (b *blocklist) userBlocked(ids ...string) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, id := range ids {
+		if id != "" && b.users[id] {
+			return true
+		}
+	}
+	return false
+}
+
+// addrBlocked reports whether the address of a connection is in a
+// blocked network
+func (b *blocklist) addrBlocked(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	ip, ok := netip.AddrFromSlice(tcp.IP)
+	if !ok {
+		return false
+	}
+	ip = ip.Unmap()
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for bits, nets := range b.nets {
+		if bits > ip.BitLen() {
+			continue
+		}
+		if p, err := ip.Prefix(bits); err == nil && nets[p] {
+			return true
+		}
+	}
+	return false
+}
+
+// loadBlocklist replaces the copy with the store's blocklist, and closes
+// the open connections from networks it blocks
+func (s *Server) loadBlocklist(bl store.Blocklists) error {
+	list, err := bl.Blocklist(withCommandTags(s.ctx, "none", "blocklist"))
+	if err != nil {
+		return err
+	}
+	s.blocks.set(list)
+	s.debugf("Loaded blocklist: %d users, %d networks", len(list.Users), len(list.Networks))
+
+	for _, sess := range s.drain.all() {
+		if s.blocks.addrBlocked(sess.conn.RemoteAddr()) {
+			log.Printf("Closing connection from blocked address %s", sess.conn.RemoteAddr())
+			s.metrics.connectionsClosed.WithLabelValues("blocked").Inc()
+			sess.conn.Close()
+		}
+	}
+	return nil
+}
+
+// blocklistLoop loads the blocklist again on every announced change and
+// every BLOCKLIST_REFRESH
+func (s *Server) blocklistLoop(bl store.Blocklists) {
+	defer s.wg.Done()
+
+	sub := s.redis.Subscribe(s.ctx, s.keyPrefix+store.BlocklistChannel)
+	defer sub.Close()
+	// Changes made before the subscription are in the load below
+	if _, err := sub.Receive(s.ctx); err != nil && !errors.Is(err, s.ctx.Err()) {
+		log.Printf("Failed to subscribe to blocklist changes: %v", err)
+	}
+	if err := s.loadBlocklist(bl); err != nil {
+		log.Printf("Failed to load blocklist: %v", err)
+	}
+
+	var refresh <-chan time.Time
+	if s.opts.BlocklistRefresh > 0 {
+		ticker := time.NewTicker(s.opts.BlocklistRefresh)
+		defer ticker.Stop()
+		refresh = ticker.C
+	}
+
+	ch := sub.Channel()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ch:
+		case <-refresh:
+		}
+		if err := s.loadBlocklist(bl); err != nil {
+			log.Printf("Failed to load blocklist: %v", err)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"chha/pkg/protocol"
+)
+
+// errBreakerOpen is the error of an attempt the circuit breaker kept from
+// Redis
+var errBreakerOpen = errors.New("redis unavailable, try again")
+
+// circuitBreaker keeps purchase attempts from a Redis that fails them, so
+// they fail at once instead of each waiting out a timeout. It opens once
+// BREAKER_ERROR_RATE of at least BREAKER_MIN_REQUESTS calls in a
+// BREAKER_WINDOW failed on Redis errors or timeouts, counting the purchase
+// scripts and the idempotency key checks ahead of them. While open, one
+// attempt per BREAKER_COOLDOWN goes through as a probe, and the first call
+// to succeed closes it.
+type circuitBreaker struct {
+	rate        float64
+	minRequests int64
+	window      time.Duration
+	cooldown    time.Duration
+	metrics     *Metrics
+
+	// open is read by every attempt, so a closed breaker costs no lock
+	open atomic.Bool
+
+	mu sync.Mutex
+	// windowStart begins the window total and failures count in; a window
+	// starts with the first failure after the last one ended
+	windowStart time.Time
+	total       atomic.Int64
+	failures    int64
+	// probeAt is when the breaker opened or last let a probe through
+	probeAt time.Time
+}
+
+func newCircuitBreaker(rate float64, minRequests int64, window, cooldown time.Duration, metrics *Metrics) *circuitBreaker {
+	return &circuitBreaker{rate: rate, minRequests: minRequests, window: window, cooldown: cooldown, metrics: metrics}
+}
+
+// tripped reports whether an attempt must be kept from Redis. An open
+// breaker lets one attempt per cooldown through to find out whether Redis
+// recovered.
+func (b *circuitBreaker) tripped(now time.Time) bool {
+	if !b.open.Load() {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.open.Load() || now.Sub(b.probeAt) >= b.cooldown {
+		b.probeAt = now
+		return false
+	}
+	return true
+}
+
+// record counts the outcome of a call, failed when it failed on a Redis
+// error or timeout rather than with an answer
+func (b *circuitBreaker) record(failed bool, now time.Time) {
+	if !failed {
+		b.total.Add(1)
+		if b.open.Load() {
+			b.close()
+		}
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.open.Load() {
+		// A failed probe waits out another cooldown
+		b.probeAt = now
+		return
+	}
+	if now.Sub(b.windowStart) >= b.window {
+		b.windowStart = now
+		b.total.Store(0)
+		b.failures = 0
+	}
+	total := b.total.Add(1)
+	b.failures++
+	if total >= b.minRequests && float64(b.failures) >= b.rate*float64(total) {
+		b.open.Store(true)
+		b.probeAt = now
+		b.metrics.breakerOpen.Set(1)
+		b.metrics.breakerTrips.Inc()
+		log.Printf("WARNING: Circuit breaker open, %d of %d purchase calls failed on Redis", b.failures, total)
+	}
+}
+
+// retryAfter is how long until the next probe may go through, or the whole
+// cooldown if one should go through now
+func (b *circuitBreaker) retryAfter(now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if wait := b.cooldown - now.Sub(b.probeAt); wait > 0 {
+		return wait
+	}
+	return b.cooldown
+}
+
+// close lets every attempt through again
+func (b *circuitBreaker) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.open.Load() {
+		return
+	}
+	b.open.Store(false)
+	b.windowStart = time.Time{}
+	b.total.Store(0)
+	b.failures = 0
+	b.metrics.breakerOpen.Set(0)
+	log.Printf("Circuit breaker closed, Redis is answering purchases again")
+}
+
+// withEvalTimeout bounds a Redis call of a purchase attempt by
+// REDIS_EVAL_TIMEOUT
+func (s *Server) withEvalTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.opts.RedisEvalTimeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, s.opts.RedisEvalTimeout)
+}
+
+// recordRedis counts the outcome of a Redis call of a purchase attempt
+// with the breaker, if any
+func (s *Server) recordRedis(err error) {
+	if s.breaker != nil {
+		s.breaker.record(err != nil && isDegradedError(err), time.Now())
+	}
+}
+
+// breakerResponse answers an attempt the breaker kept from Redis: SOLD_OUT
+// for a product last seen sold out and not restocked since, even past the
+// sold out cache TTL, a provisional grant from overdraft if allowed, and
+// otherwise a busy answer to retry after the next probe
+func (s *Server) breakerResponse(sess *session, c codec, req PurchaseRequest, overdraft bool) []byte {
+	if s.soldOut != nil && s.soldOut.seen(req.ProductID) {
+		s.metrics.breakerRejected.WithLabelValues("sold_out").Inc()
+		data, _ := c.Marshal(PurchaseResponse{Status: protocol.STATUS_SOLD_OUT})
+		return data
+	}
+	if overdraft && s.overdraft != nil {
+		if data, ok := s.grantOverdraft(c, req); ok {
+			s.metrics.breakerRejected.WithLabelValues("overdraft").Inc()
+			return data
+		}
+	}
+	return s.breakerBusy(sess, c)
+}
+
+// breakerBusy answers an attempt the breaker kept from Redis with BUSY, or
+// ERROR without backpressure. The retry delay runs past the next probe,
+// spread over half a cooldown so the clients told to wait don't all come
+// back at once.
+func (s *Server) breakerBusy(sess *session, c codec) []byte {
+	answer := "error"
+	if sess.proto.has(protocol.CAP_BACKPRESSURE) {
+		answer = "busy"
+	}
+	s.metrics.breakerRejected.WithLabelValues(answer).Inc()
+	retryAfter := s.breaker.retryAfter(time.Now()) + rand.N(s.breaker.cooldown/2+1)
+	return busyResponse(sess, c, protocol.STATUS_ERROR, errBreakerOpen.Error(), retryAfter)
+}
@@ -0,0 +1,222 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"chha/internal/store"
+	"chha/pkg/protocol"
+)
+
+// PurchaseBundleRequest buys one unit of every listed product, or none
+type PurchaseBundleRequest struct {
+	ProductIDs []string `json:"product_ids"`
+	UserID     string   `json:"user_id"`
+	AuthToken  string   `json:"auth_token,omitempty"`
+	// PoWChallenge must be issued for the first product of the bundle
+	PoWChallenge string `json:"pow_challenge,omitempty"`
+	PoWSolution  string `json:"pow_solution,omitempty"`
+	// VerificationToken is checked once for the whole bundle
+	VerificationToken string `json:"verification_token,omitempty"`
+}
+
+// BundleItemResponse is the order created for one product of a bundle
+type BundleItemResponse struct {
+	ProductID      string `json:"product_id"`
+	OrderID        string `json:"order_id"`
+	RemainingStock int64  `json:"remaining_stock"`
+}
+
+// PurchaseBundleResponse answers MSG_PURCHASE_BUNDLE. A SOLD_OUT bundle
+// bought nothing; SoldOutProduct is the product that was out.
+type PurchaseBundleResponse struct {
+	Status          string               `json:"status"`
+	BundleID        string               `json:"bundle_id,omitempty"`
+	Items           []BundleItemResponse `json:"items,omitempty"`
+	PaymentDeadline int64                `json:"payment_deadline,omitempty"`
+	SoldOutProduct  string               `json:"sold_out_product,omitempty"`
+	RetryAfterMs    int64                `json:"retry_after_ms,omitempty"`
+	Error           string               `json:"error,omitempty"`
+}
+
+// handlePurchaseBundle serves MSG_PURCHASE_BUNDLE. A bundle goes through
+// the same authentication, load shedding, proof of work and rate limit as
+// one purchase attempt, then a single script buys every product or none.
+func (s *Server) handlePurchaseBundle(sess *session, c codec, payload []byte) []byte {
+	fail := func(msg string) []byte {
+		data, _ := c.Marshal(PurchaseBundleResponse{Status: protocol.STATUS_ERROR, Error: msg})
+		return data
+	}
+
+	if s.scaler != nil {
+		s.scaler.attempts.Add(1)
+	}
+
+	var req PurchaseBundleRequest
+	if err := c.Unmarshal(payload, &req); err != nil {
+		return fail("invalid json")
+	}
+	user, bound, err := s.sessionUser(sess, req.UserID)
+	if err != nil {
+		s.metrics.purchasesUnauthorized.Inc()
+		return fail(err.Error())
+	}
+	req.UserID = user
+	if len(req.ProductIDs) == 0 || req.UserID == "" {
+		return fail("missing product_ids or user_id")
+	}
+	for _, id := range req.ProductIDs {
+		if id == "" {
+			return fail("empty product_id in bundle")
+		}
+	}
+
+	bundler, ok := s.store.(store.BundlePurchaser)
+	if !ok {
+		return fail("bundle purchases are not supported by this store")
+	}
+
+	if _, err := s.authorizePurchase(PurchaseRequest{UserID: req.UserID, AuthToken: req.AuthToken}, bound); err != nil {
+		s.metrics.purchasesUnauthorized.Inc()
+		return fail(err.Error())
+	}
+	if s.blocks != nil && s.blocks.userBlocked(req.UserID) {
+		s.metrics.purchasesBlocked.Inc()
+		data, _ := c.Marshal(PurchaseBundleResponse{Status: protocol.STATUS_BLOCKED, Error: "user is blocked"})
+		return data
+	}
+	if s.breaker != nil && s.breaker.tripped(time.Now()) {
+		return s.breakerBusy(sess, c)
+	}
+	bundleKey := strings.Join(req.ProductIDs, "+")
+	if s.shedder != nil {
+		if !s.shedder.admit(bundleKey, s.purchaseTier(req.AuthToken != "" || bound)) {
+			return s.shedResponse(sess, c)
+		}
+		defer s.shedder.done()
+	}
+	flagged := s.checkSpeed(req.UserID)
+	if difficulty := s.powDifficulty(flagged); difficulty > 0 {
+		if difficulty > s.opts.PoWDifficulty {
+			s.metrics.speedActions.WithLabelValues("challenged").Inc()
+		}
+		if err := s.pow.verify(req.UserID, req.ProductIDs[0], req.PoWChallenge, req.PoWSolution, difficulty, time.Now()); err != nil {
+			s.metrics.powRejected.Inc()
+			return fail(err.Error())
+		}
+	}
+	if data, limited := s.throttle(c, req.UserID, "", flagged); limited {
+		return data
+	}
+	if s.verifier != nil {
+		err := s.verifyPurchase(VerifyRequest{
+			ProductID: bundleKey,
+			UserID:    req.UserID,
+			Token:     req.VerificationToken,
+			RemoteIP:  remoteIP(sess.conn.RemoteAddr()),
+		})
+		if err != nil {
+			return fail(err.Error())
+		}
+	}
+
+	ctx, cancel := s.withEvalTimeout(withCommandTags(s.ctx, bundleKey, "purchase_bundle"))
+	defer cancel()
+	result, err := bundler.AttemptBundlePurchase(ctx, req.ProductIDs, req.UserID)
+	s.recordRedis(err)
+	switch {
+	case errors.Is(err, store.ErrNotDurable):
+		log.Printf("Strict bundle purchase not confirmed durable: bundle=%s user=%s: %v", result.BundleID, req.UserID, err)
+		s.metrics.bundlePurchases.WithLabelValues("error").Inc()
+		return fail("purchase not confirmed durable, check order status")
+	case errors.Is(err, store.ErrSalePaused):
+		s.metrics.bundlePurchases.WithLabelValues("paused").Inc()
+		data, _ := c.Marshal(PurchaseBundleResponse{
+			Status: protocol.STATUS_PAUSED,
+			Error:  err.Error(),
+		})
+		return data
+	case errors.Is(err, store.ErrUserLimitReached):
+		s.metrics.bundlePurchases.WithLabelValues("limit_reached").Inc()
+		data, _ := c.Marshal(PurchaseBundleResponse{
+			Status: protocol.STATUS_LIMIT_REACHED,
+			Error:  err.Error(),
+		})
+		return data
+	case errors.Is(err, store.ErrSaleNotStarted):
+		s.metrics.bundlePurchases.WithLabelValues("not_on_sale").Inc()
+		data, _ := c.Marshal(PurchaseBundleResponse{
+			Status: protocol.STATUS_NOT_ON_SALE,
+			Error:  err.Error(),
+		})
+		return data
+	case errors.Is(err, store.ErrSaleEnded):
+		s.metrics.bundlePurchases.WithLabelValues("ended").Inc()
+		data, _ := c.Marshal(PurchaseBundleResponse{
+			Status: protocol.STATUS_ENDED,
+			Error:  err.Error(),
+		})
+		return data
+	case errors.Is(err, store.ErrNotEligible):
+		s.metrics.bundlePurchases.WithLabelValues("not_eligible").Inc()
+		data, _ := c.Marshal(PurchaseBundleResponse{
+			Status: protocol.STATUS_NOT_ELIGIBLE,
+			Error:  err.Error(),
+		})
+		return data
+	case err != nil:
+		s.noteWriteError(err)
+		s.metrics.bundlePurchases.WithLabelValues("error").Inc()
+		return fail(err.Error())
+	case !result.Success:
+		s.metrics.bundlePurchases.WithLabelValues("sold_out").Inc()
+		data, _ := c.Marshal(PurchaseBundleResponse{
+			Status:         protocol.STATUS_SOLD_OUT,
+			SoldOutProduct: result.SoldOut,
+		})
+		return data
+	}
+
+	s.metrics.bundlePurchases.WithLabelValues("success").Inc()
+	resp := PurchaseBundleResponse{
+		Status:   protocol.STATUS_SUCCESS,
+		BundleID: result.BundleID,
+		Items:    make([]BundleItemResponse, len(result.Items)),
+	}
+	if !result.PaymentDeadline.IsZero() {
+		resp.PaymentDeadline = result.PaymentDeadline.Unix()
+	}
+	for i, item := range result.Items {
+		resp.Items[i] = BundleItemResponse{
+			ProductID:      item.ProductID,
+			OrderID:        item.OrderID,
+			RemainingStock: item.Remaining,
+		}
+		if s.overdraft != nil {
+			s.overdraft.observe(item.ProductID, item.Remaining)
+		}
+	}
+	go s.publishBundleEvents(req.UserID, result)
+
+	data, _ := c.Marshal(resp)
+	return data
+}
+
+// publishBundleEvents records a purchase event per product of a bundle,
+// each carrying the bundle ID
+func (s *Server) publishBundleEvents(userID string, result store.BundleResult) {
+	for _, item := range result.Items {
+		s.emitEvent(item.ProductID, !item.Recorded, map[string]interface{}{
+			"type":       "purchase",
+			"product_id": item.ProductID,
+			"buyer":      userID,
+			"order_id":   item.OrderID,
+			"status":     result.OrderStatus(),
+			"remaining":  item.Remaining,
+			"timestamp":  time.Now().Unix(),
+			"bundle_id":  result.BundleID,
+		})
+	}
+}
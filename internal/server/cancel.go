@@ -0,0 +1,105 @@
+package server
+
+import (
+	"log"
+	"time"
+
+	"chha/internal/store"
+	"chha/pkg/protocol"
+)
+
+// CancelPurchaseRequest cancels a purchase and returns the unit to stock
+type CancelPurchaseRequest struct {
+	ProductID string `json:"product_id"`
+	UserID    string `json:"user_id"`
+	OrderID   string `json:"order_id"`
+	// AuthToken is a JWT issued to UserID, required when auth is enabled
+	// and the session is not bound to the user
+	AuthToken string `json:"auth_token,omitempty"`
+}
+
+// handleCancelPurchase serves MSG_CANCEL_PURCHASE
+func (s *Server) handleCancelPurchase(sess *session, c codec, payload []byte) []byte {
+	var req CancelPurchaseRequest
+	if err := c.Unmarshal(payload, &req); err != nil {
+		resp := PurchaseResponse{
+			Status: protocol.STATUS_ERROR,
+			Error:  "invalid json",
+		}
+		data, _ := c.Marshal(resp)
+		return data
+	}
+	user, bound, err := s.sessionUser(sess, req.UserID)
+	if err != nil {
+		data, _ := c.Marshal(PurchaseResponse{Status: protocol.STATUS_ERROR, Error: err.Error()})
+		return data
+	}
+	req.UserID = user
+
+	if req.ProductID == "" || req.UserID == "" || req.OrderID == "" {
+		resp := PurchaseResponse{
+			Status: protocol.STATUS_ERROR,
+			Error:  "missing product_id, user_id or order_id",
+		}
+		data, _ := c.Marshal(resp)
+		return data
+	}
+	if err := s.authorizeUser(req.AuthToken, req.UserID, bound); err != nil {
+		data, _ := c.Marshal(PurchaseResponse{Status: protocol.STATUS_ERROR, OrderID: req.OrderID, Error: err.Error()})
+		return data
+	}
+
+	ctx := withCommandTags(s.ctx, req.ProductID, "cancel_purchase")
+	result, err := s.store.CancelPurchase(ctx, req.ProductID, req.UserID, req.OrderID)
+	if err != nil {
+		resp := PurchaseResponse{
+			Status:  protocol.STATUS_ERROR,
+			OrderID: req.OrderID,
+			Error:   err.Error(),
+		}
+		data, _ := c.Marshal(resp)
+		return data
+	}
+
+	s.metrics.purchasesCancelled.Inc()
+	log.Printf("Purchase cancelled: product=%s user=%s order=%s", req.ProductID, req.UserID, req.OrderID)
+	go s.emitEvent(req.ProductID, true, map[string]interface{}{
+		"type":            "purchase_cancelled",
+		"product_id":      req.ProductID,
+		"buyer":           req.UserID,
+		"order_id":        req.OrderID,
+		"status":          store.OrderCancelled,
+		"previous_status": result.Previous,
+		"remaining":       result.Remaining,
+		"timestamp":       time.Now().Unix(),
+	})
+	if result.Grant != nil {
+		go s.publishWaitlistGrant(req.OrderID, result.Grant)
+	}
+
+	resp := PurchaseResponse{
+		Status:         protocol.STATUS_SUCCESS,
+		RemainingStock: result.Remaining,
+		OrderID:        req.OrderID,
+	}
+	data, _ := c.Marshal(resp)
+	return data
+}
+
+// publishWaitlistGrant records the purchase event of a unit freed by order
+// freedID and granted to the next waitlisted user. It is a regular purchase
+// event, so order systems need nothing new, marked with the freed order.
+func (s *Server) publishWaitlistGrant(freedID string, g *store.WaitlistGrant) {
+	s.metrics.waitlistGrants.Inc()
+	log.Printf("Waitlist grant: product=%s user=%s order=%s freed by %s", g.Order.ProductID, g.Order.UserID, g.Order.ID, freedID)
+	s.emitEvent(g.Order.ProductID, !g.Recorded, map[string]interface{}{
+		"type":        "purchase",
+		"product_id":  g.Order.ProductID,
+		"buyer":       g.Order.UserID,
+		"order_id":    g.Order.ID,
+		"status":      g.Order.Status,
+		"remaining":   g.Remaining,
+		"timestamp":   g.Order.CreatedAt.Unix(),
+		"freed_order": freedID,
+	})
+}
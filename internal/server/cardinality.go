@@ -0,0 +1,150 @@
+package server
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"chha/internal/shardmap"
+)
+
+// otherLabel stands for every value past a labelCap's limit
+const otherLabel = "other"
+
+// labelCapTracked bounds the values a labelCap counts between refreshes,
+// so a flood of made-up product IDs cannot grow it without limit
+const labelCapTracked = 10000
+
+// labelCap bounds the values one metric label takes. Until the first
+// refresh the first limit values seen keep their own; after each refresh
+// it is the limit busiest values since the previous one. Everything else
+// is reported as "other". Values that lose their label have their series
+// deleted through onDrop, so they stop being exported.
+type labelCap struct {
+	limit int
+	// always are values that never count against the limit
+	always map[string]bool
+	onDrop func(value string)
+
+	// labeled is replaced, never changed, so label reads it without a lock
+	labeled atomic.Pointer[map[string]bool]
+	// counts are the uses of each value since the last refresh, sharded so
+	// observations of different products don't contend for one lock
+	counts atomic.Pointer[shardmap.Map[int64]]
+
+	// mu orders the replacements of labeled
+	mu sync.Mutex
+}
+
+func newLabelCap(limit int, always []string, onDrop func(string)) *labelCap {
+	lc := &labelCap{limit: limit, always: make(map[string]bool), onDrop: onDrop}
+	for _, v := range always {
+		lc.always[v] = true
+	}
+	labeled := make(map[string]bool)
+	lc.labeled.Store(&labeled)
+	lc.counts.Store(shardmap.New[int64](shardmap.DefaultShards, nil))
+	return lc
+}
+
+// label counts one use of value and returns the label to report it as
+func (lc *labelCap) label(value string) string {
+	if lc == nil || lc.always[value] {
+		return value
+	}
+
+	counts := lc.counts.Load()
+	inc := func(n *int64) { *n++ }
+	// The size check races with other new values, so the bound may be
+	// passed by the observations in flight
+	if !counts.Load(value, inc) && counts.Len() < labelCapTracked {
+		counts.Do(value, inc)
+	}
+
+	labeled := *lc.labeled.Load()
+	if labeled[value] {
+		return value
+	}
+	if len(labeled) >= lc.limit {
+		return otherLabel
+	}
+	return lc.admit(value)
+}
+
+// admit gives value its own label now rather than at the next refresh, if
+// there is still room
+func (lc *labelCap) admit(value string) string {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	labeled := *lc.labeled.Load()
+	if labeled[value] {
+		return value
+	}
+	if len(labeled) >= lc.limit {
+		return otherLabel
+	}
+	next := make(map[string]bool, len(labeled)+1)
+	for v := range labeled {
+		next[v] = true
+	}
+	next[value] = true
+	lc.labeled.Store(&next)
+	return value
+}
+
+// refresh relabels the busiest values since the last refresh
+func (lc *labelCap) refresh() {
+	// A use counted in the old map after it was read is lost, which only
+	// ever costs a value one observation
+	old := lc.counts.Swap(shardmap.New[int64](shardmap.DefaultShards, nil))
+	counts := make(map[string]int64, old.Len())
+	old.Range(func(v string, n *int64) { counts[v] = *n })
+
+	lc.mu.Lock()
+	prev := *lc.labeled.Load()
+	values := make([]string, 0, len(counts))
+	for v := range counts {
+		values = append(values, v)
+	}
+	sort.Slice(values, func(i, j int) bool {
+		if counts[values[i]] != counts[values[j]] {
+			return counts[values[i]] > counts[values[j]]
+		}
+		return values[i] < values[j]
+	})
+	if len(values) > lc.limit {
+		values = values[:lc.limit]
+	}
+	next := make(map[string]bool, len(values))
+	for _, v := range values {
+		next[v] = true
+	}
+	lc.labeled.Store(&next)
+	lc.mu.Unlock()
+
+	for v := range prev {
+		if !next[v] && lc.onDrop != nil {
+			lc.onDrop(v)
+		}
+	}
+}
+
+// labelCapLoop refreshes the product label cap every
+// METRICS_LABEL_REFRESH
+func (s *Server) labelCapLoop() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.opts.MetricsLabelRefresh)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			s.metrics.productLabels.refresh()
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"chha/internal/store"
+	"chha/pkg/protocol"
+)
+
+const (
+	catalogDefaultLimit = 50
+	catalogMaxLimit     = 200
+)
+
+// ListProductsRequest asks for one page of the catalog. Cursor is the
+// next_cursor of the previous page, empty for the first page.
+type ListProductsRequest struct {
+	Cursor string `json:"cursor,omitempty"`
+	Limit  int    `json:"limit,omitempty"`
+}
+
+// ListProductsResponse is one page of the catalog
+type ListProductsResponse struct {
+	Status     string         `json:"status"`
+	Products   []catalogEntry `json:"products,omitempty"`
+	NextCursor string         `json:"next_cursor,omitempty"`
+	Error      string         `json:"error,omitempty"`
+}
+
+// catalogEntry is the public view of a product. StockHint comes from the
+// catalog cache and may lag the real stock by up to the cache TTL.
+type catalogEntry struct {
+	ProductID string `json:"product_id"`
+	State     string `json:"state"`
+	StockHint int64  `json:"stock_hint"`
+	SaleStart int64  `json:"sale_start,omitempty"`
+	SaleEnd   int64  `json:"sale_end,omitempty"`
+}
+
+// catalog caches the product listing so a burst of clients browsing before
+// a sale costs one SCAN per TTL instead of one per request
+type catalog struct {
+	// source is the store to list from, see Server.reads
+	source func() store.Store
+	ttl    time.Duration
+
+	mu       sync.Mutex
+	entries  []catalogEntry // sorted by product ID
+	loadedAt time.Time
+}
+
+func newCatalog(source func() store.Store, ttl time.Duration) *catalog {
+	return &catalog{source: source, ttl: ttl}
+}
+
+// list returns the cached entries, reloading them once older than ttl.
+// Callers arriving during a reload wait for it rather than starting their
+// own.
+func (c *catalog) list(ctx context.Context) ([]catalogEntry, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.entries != nil && time.Since(c.loadedAt) < c.ttl {
+		return c.entries, nil
+	}
+
+	infos, err := c.source().ListProductInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return c.fill(infos, time.Now()), nil
+}
+
+// prime fills the cache from infos listed at now, so the first listing
+// after start-up needs no reload
+func (c *catalog) prime(infos []store.ProductInfo, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.fill(infos, now)
+}
+
+// fill replaces the cached entries with infos listed at now. c.mu must be
+// held.
+func (c *catalog) fill(infos []store.ProductInfo, now time.Time) []catalogEntry {
+	entries := make([]catalogEntry, 0, len(infos))
+	for _, info := range infos {
+		state := info.State(now)
+		if state == store.StateEnded {
+			continue
+		}
+
+		e := catalogEntry{
+			ProductID: info.ID,
+			State:     state,
+			StockHint: info.Stock,
+		}
+		if !info.SaleStart.IsZero() {
+			e.SaleStart = info.SaleStart.Unix()
+		}
+		if !info.SaleEnd.IsZero() {
+			e.SaleEnd = info.SaleEnd.Unix()
+		}
+		entries = append(entries, e)
+	}
+
+	c.entries = entries
+	c.loadedAt = now
+	return entries
+}
+
+// page returns up to limit entries after cursor, and the cursor of the
+// following page if there is one
+func (c *catalog) page(ctx context.Context, cursor string, limit int) ([]catalogEntry, string, error) {
+	entries, err := c.list(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+
+	start := sort.Search(len(entries), func(i int) bool {
+		return entries[i].ProductID > cursor
+	})
+	end := min(start+limit, len(entries))
+
+	page := entries[start:end]
+	if end < len(entries) {
+		return page, page[len(page)-1].ProductID, nil
+	}
+	return page, "", nil
+}
+
+// handleCatalog serves MSG_LIST_PRODUCTS, listing products that are
+// on sale or scheduled. Ended products are left out.
+func (s *Server) handleCatalog(c codec, payload []byte) []byte {
+	var req ListProductsRequest
+	if len(payload) > 0 {
+		if err := c.Unmarshal(payload, &req); err != nil {
+			data, _ := c.Marshal(ListProductsResponse{
+				Status: protocol.STATUS_ERROR,
+				Error:  "invalid json",
+			})
+			return data
+		}
+	}
+
+	limit := req.Limit
+	if limit <= 0 {
+		limit = catalogDefaultLimit
+	}
+	limit = min(limit, catalogMaxLimit)
+
+	ctx := withCommandTags(s.ctx, "none", "list_products")
+	products, next, err := s.catalog.page(ctx, req.Cursor, limit)
+	if err != nil {
+		data, _ := c.Marshal(ListProductsResponse{
+			Status: protocol.STATUS_ERROR,
+			Error:  err.Error(),
+		})
+		return data
+	}
+
+	data, _ := c.Marshal(ListProductsResponse{
+		Status:     protocol.STATUS_SUCCESS,
+		Products:   products,
+		NextCursor: next,
+	})
+	return data
+}
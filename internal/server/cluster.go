@@ -0,0 +1,76 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+
+	"chha/internal/buildinfo"
+	"chha/internal/cluster"
+)
+
+// newClusterMember registers this server in the instance registry under
+// its NODE_ID, which already has to be unique per server
+func (s *Server) newClusterMember() *cluster.Member {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return cluster.New(s.redis, cluster.Options{
+		Self: cluster.Instance{
+			ID:      strconv.FormatInt(s.opts.NodeID, 10),
+			Host:    host,
+			Addr:    s.opts.ListenAddr,
+			Admin:   s.opts.MetricsAddr,
+			Version: buildinfo.Get().Version,
+			Started: s.drain.started.Unix(),
+		},
+		TTL: s.opts.ClusterTTL,
+		OnLeader: func(leader bool) {
+			if leader {
+				s.metrics.clusterLeader.Set(1)
+			} else {
+				s.metrics.clusterLeader.Set(0)
+			}
+		},
+	})
+}
+
+// isLeader reports whether this server should run the jobs only one
+// server in the fleet needs to, e.g. the order reaper. Without
+// CLUSTER_TTL every server runs them.
+func (s *Server) isLeader() bool {
+	return s.cluster == nil || s.cluster.IsLeader()
+}
+
+// handleCluster serves GET /admin/cluster, the live instances and which
+// one leads. Like /admin/drain it needs ADMIN_TOKEN.
+func (s *Server) handleCluster(w http.ResponseWriter, r *http.Request) {
+	if !s.adminAuthorized(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if s.cluster == nil {
+		writeJSONError(w, http.StatusNotFound, "cluster coordination is disabled")
+		return
+	}
+
+	ctx := withCommandTags(r.Context(), "none", "admin_cluster")
+	instances, err := cluster.Instances(ctx, s.redis, s.opts.ClusterTTL)
+	if err != nil {
+		log.Printf("Admin cluster failed: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if instances == nil {
+		instances = []cluster.Instance{}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"instances": instances,
+	})
+}
@@ -0,0 +1,26 @@
+package server
+
+import "net"
+
+// connParker parks connections waiting for their next frame without a
+// goroutine each, see connpark_linux.go. A million connections opened
+// ahead of a sale mostly wait, and each waiting goroutine keeps a stack.
+type connParker interface {
+	// Wrap takes ownership of conn and returns the connection to serve,
+	// which can park if it implements parkable
+	Wrap(conn net.Conn) (net.Conn, error)
+	// Close releases the parker once every wrapped connection is closed
+	Close() error
+}
+
+// parkable is a connection its connParker can park
+type parkable interface {
+	net.Conn
+	// park hands the connection over until it is readable, its read
+	// deadline passes or it is closed, then runs resume on a new
+	// goroutine. It reports false, and never runs resume, when something
+	// is waiting to be read already or the connection cannot park.
+	park(resume func()) bool
+	// NetConn is the connection the parker wrapped
+	NetConn() net.Conn
+}
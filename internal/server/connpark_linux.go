@@ -0,0 +1,298 @@
+//go:build linux
+
+package server
+
+// Epoll connection parking (CONN_EPOLL). A connection waiting for its next
+// frame normally holds a goroutine blocked in Read, with its stack. Parked,
+// it is only registered on one shared epoll instance, which the parker's
+// loop waits on; once the socket is readable, its read deadline passes or
+// it is closed, a new goroutine picks the connection up where it parked.
+//
+// Limitations: TLS connections cannot park, and a connection that is
+// woken and finds nothing to read, the rare timer race below, blocks in
+// Read as without parking.
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sys/unix"
+)
+
+// epollStop is the id of the eventfd that stops the loop
+const epollStop = 0
+
+// epollParker parks connections on one epoll instance
+type epollParker struct {
+	fd     int
+	wakeFd int
+	parked prometheus.Gauge
+	done   chan struct{}
+
+	mu     sync.Mutex
+	nextID uint64
+	conns  map[uint64]*epollConn
+}
+
+func newConnParker(parked prometheus.Gauge) (connParker, error) {
+	fd, err := unix.EpollCreate1(unix.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("epoll_create1: %w", err)
+	}
+	wakeFd, err := unix.Eventfd(0, unix.EFD_CLOEXEC|unix.EFD_NONBLOCK)
+	if err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("eventfd: %w", err)
+	}
+	if err := unix.EpollCtl(fd, unix.EPOLL_CTL_ADD, wakeFd, &unix.EpollEvent{Events: unix.EPOLLIN}); err != nil {
+		unix.Close(wakeFd)
+		unix.Close(fd)
+		return nil, fmt.Errorf("epoll_ctl: %w", err)
+	}
+
+	p := &epollParker{
+		fd:     fd,
+		wakeFd: wakeFd,
+		parked: parked,
+		done:   make(chan struct{}),
+		nextID: epollStop,
+		conns:  make(map[uint64]*epollConn),
+	}
+	go p.loop()
+	return p, nil
+}
+
+// Wrap keeps the socket in the netpoller, which still does every read and
+// write; the parker only watches it while the connection is parked
+func (p *epollParker) Wrap(conn net.Conn) (net.Conn, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		conn.Close()
+		return nil, fmt.Errorf("unsupported connection type %T", conn)
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	fd := -1
+	if err := raw.Control(func(s uintptr) { fd = int(s) }); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	p.mu.Lock()
+	p.nextID++
+	id := p.nextID
+	p.mu.Unlock()
+	return &epollConn{Conn: conn, p: p, id: id, fd: fd}, nil
+}
+
+// loop wakes the connections epoll reports until Close signals the eventfd
+func (p *epollParker) loop() {
+	defer close(p.done)
+
+	events := make([]unix.EpollEvent, 256)
+	for {
+		n, err := unix.EpollWait(p.fd, events, -1)
+		if errors.Is(err, unix.EINTR) {
+			continue
+		}
+		if err != nil {
+			log.Printf("epoll loop stopped: %v", err)
+			return
+		}
+		for _, ev := range events[:n] {
+			// The id is split over the event's two 32-bit data fields
+			id := uint64(uint32(ev.Fd)) | uint64(uint32(ev.Pad))<<32
+			if id == epollStop {
+				return
+			}
+			p.mu.Lock()
+			c := p.conns[id]
+			p.mu.Unlock()
+			if c != nil {
+				c.wake()
+			}
+		}
+	}
+}
+
+// arm watches c until its socket is readable once. An id rather than the
+// fd identifies it, so an event for a closed fd never wakes the connection
+// that got its number next.
+func (p *epollParker) arm(c *epollConn) error {
+	ev := &unix.EpollEvent{
+		Events: unix.EPOLLIN | unix.EPOLLRDHUP | unix.EPOLLONESHOT,
+		Fd:     int32(c.id),
+		Pad:    int32(c.id >> 32),
+	}
+	if c.registered {
+		return unix.EpollCtl(p.fd, unix.EPOLL_CTL_MOD, c.fd, ev)
+	}
+
+	p.mu.Lock()
+	p.conns[c.id] = c
+	p.mu.Unlock()
+	if err := unix.EpollCtl(p.fd, unix.EPOLL_CTL_ADD, c.fd, ev); err != nil {
+		p.forget(c)
+		return err
+	}
+	c.registered = true
+	return nil
+}
+
+// remove stops watching c, before its fd is closed
+func (p *epollParker) remove(c *epollConn) {
+	unix.EpollCtl(p.fd, unix.EPOLL_CTL_DEL, c.fd, nil)
+	p.forget(c)
+}
+
+func (p *epollParker) forget(c *epollConn) {
+	p.mu.Lock()
+	delete(p.conns, c.id)
+	p.mu.Unlock()
+}
+
+// Close stops the loop and releases the epoll instance. Every connection
+// must be closed first.
+func (p *epollParker) Close() error {
+	one := []byte{1, 0, 0, 0, 0, 0, 0, 0}
+	if _, err := unix.Write(p.wakeFd, one); err != nil {
+		return fmt.Errorf("eventfd write: %w", err)
+	}
+	<-p.done
+	unix.Close(p.wakeFd)
+	return unix.Close(p.fd)
+}
+
+// epollConn is a connection that parks on an epollParker. Its socket is
+// only watched by the parker while resume is set.
+type epollConn struct {
+	net.Conn
+	p  *epollParker
+	id uint64
+	fd int
+
+	mu         sync.Mutex
+	registered bool
+	closed     bool
+	deadline   time.Time
+	timer      *time.Timer
+	resume     func()
+}
+
+func (c *epollConn) NetConn() net.Conn { return c.Conn }
+
+func (c *epollConn) park(resume func()) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return false
+	}
+
+	// A client that already sent its next frame reads on at once, without
+	// an epoll round trip
+	fds := []unix.PollFd{{Fd: int32(c.fd), Events: unix.POLLIN}}
+	if n, err := unix.Poll(fds, 0); err != nil || n > 0 {
+		return false
+	}
+	if err := c.p.arm(c); err != nil {
+		return false
+	}
+
+	c.resume = resume
+	c.p.parked.Inc()
+	c.startTimer()
+	return true
+}
+
+// startTimer wakes the parked connection at its read deadline, so the read
+// it resumes with times out as it would have without parking
+func (c *epollConn) startTimer() {
+	if c.deadline.IsZero() {
+		return
+	}
+	d := time.Until(c.deadline)
+	if c.timer == nil {
+		c.timer = time.AfterFunc(d, c.wake)
+		return
+	}
+	c.timer.Reset(d)
+}
+
+// takeResume ends the park, returning what resumes the connection, nil
+// unless it was parked
+func (c *epollConn) takeResume() func() {
+	resume := c.resume
+	c.resume = nil
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	if resume != nil {
+		c.p.parked.Dec()
+	}
+	return resume
+}
+
+// wake resumes the connection if it is parked. A timer that fired just as
+// the socket became readable may wake the next park early; the connection
+// then waits in Read until its deadline.
+func (c *epollConn) wake() {
+	c.mu.Lock()
+	resume := c.takeResume()
+	c.mu.Unlock()
+	if resume != nil {
+		go resume()
+	}
+}
+
+// SetReadDeadline moves the timer of a parked connection too, so a
+// deadline set to wake it, as draining does, wakes it
+func (c *epollConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	if c.resume != nil {
+		if t.IsZero() && c.timer != nil {
+			c.timer.Stop()
+		} else if !t.IsZero() {
+			c.startTimer()
+		}
+	}
+	c.mu.Unlock()
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *epollConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// Close closes the connection, resuming it if parked so its read fails
+// and it is torn down
+func (c *epollConn) Close() error {
+	c.mu.Lock()
+	var resume func()
+	if !c.closed {
+		c.closed = true
+		if c.registered {
+			c.p.remove(c)
+		}
+		resume = c.takeResume()
+	}
+	c.mu.Unlock()
+
+	err := c.Conn.Close()
+	if resume != nil {
+		go resume()
+	}
+	return err
+}
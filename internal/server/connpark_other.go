@@ -0,0 +1,13 @@
+//go:build !linux
+
+package server
+
+import (
+	"errors"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func newConnParker(parked prometheus.Gauge) (connParker, error) {
+	return nil, errors.New("CONN_EPOLL is only supported on Linux")
+}
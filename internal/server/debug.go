@@ -0,0 +1,117 @@
+package server
+
+import (
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"time"
+
+	"chha/internal/buildinfo"
+	"chha/internal/config"
+)
+
+// newDebugServer serves net/http/pprof and /debug/diagnostics on
+// DEBUG_ADDR, apart from the metrics listener so profiling can stay off
+// the network. On a loopback address anyone on the host may use it;
+// otherwise requests need ADMIN_TOKEN as a bearer token.
+func (s *Server) newDebugServer() *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/diagnostics", s.handleDiagnostics)
+
+	var handler http.Handler = mux
+	if !config.IsLoopback(s.opts.DebugAddr) {
+		handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if s.adminAuthorized(w, r) {
+				mux.ServeHTTP(w, r)
+			}
+		})
+	}
+	// No WriteTimeout: CPU profiles and traces stream for as long as asked
+	return &http.Server{
+		Addr:              s.opts.DebugAddr,
+		Handler:           handler,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+}
+
+// diagnostics is the /debug/diagnostics dump
+type diagnostics struct {
+	Version     string    `json:"version"`
+	Uptime      string    `json:"uptime"`
+	Goroutines  int       `json:"goroutines"`
+	GOMAXPROCS  int       `json:"gomaxprocs"`
+	Connections int       `json:"connections"`
+	Draining    bool      `json:"draining"`
+	NetworkPath string    `json:"network_path"`
+	RedisPool   poolStats `json:"redis_pool"`
+	Memory      memStats  `json:"memory"`
+}
+
+// poolStats is redis.PoolStats with JSON names
+type poolStats struct {
+	Hits       uint32 `json:"hits"`
+	Misses     uint32 `json:"misses"`
+	Timeouts   uint32 `json:"timeouts"`
+	TotalConns uint32 `json:"total_conns"`
+	IdleConns  uint32 `json:"idle_conns"`
+	StaleConns uint32 `json:"stale_conns"`
+	PoolSize   int    `json:"pool_size"`
+}
+
+type memStats struct {
+	HeapAlloc   uint64 `json:"heap_alloc_bytes"`
+	HeapInuse   uint64 `json:"heap_inuse_bytes"`
+	Sys         uint64 `json:"sys_bytes"`
+	NumGC       uint32 `json:"num_gc"`
+	LastGCPause string `json:"last_gc_pause"`
+	PauseTotal  string `json:"gc_pause_total"`
+	HeapObjects uint64 `json:"heap_objects"`
+	StackInuse  uint64 `json:"stack_inuse_bytes"`
+}
+
+// handleDiagnostics serves GET /debug/diagnostics, a snapshot of the
+// runtime, open connections and the Redis connection pool
+func (s *Server) handleDiagnostics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	pool := s.redis.PoolStats()
+
+	writeJSON(w, http.StatusOK, diagnostics{
+		Version:     buildinfo.Get().Version,
+		Uptime:      time.Since(s.drain.started).Truncate(time.Second).String(),
+		Goroutines:  runtime.NumGoroutine(),
+		GOMAXPROCS:  runtime.GOMAXPROCS(0),
+		Connections: s.drain.count(),
+		Draining:    s.drain.draining.Load(),
+		NetworkPath: s.connPath.Name(),
+		RedisPool: poolStats{
+			Hits:       pool.Hits,
+			Misses:     pool.Misses,
+			Timeouts:   pool.Timeouts,
+			TotalConns: pool.TotalConns,
+			IdleConns:  pool.IdleConns,
+			StaleConns: pool.StaleConns,
+			PoolSize:   s.opts.RedisPoolSize,
+		},
+		Memory: memStats{
+			HeapAlloc:   ms.HeapAlloc,
+			HeapInuse:   ms.HeapInuse,
+			Sys:         ms.Sys,
+			NumGC:       ms.NumGC,
+			LastGCPause: time.Duration(ms.PauseNs[(ms.NumGC+255)%256]).String(),
+			PauseTotal:  time.Duration(ms.PauseTotalNs).String(),
+			HeapObjects: ms.HeapObjects,
+			StackInuse:  ms.StackInuse,
+		},
+	})
+}
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"chha/internal/buildinfo"
+	"chha/pkg/protocol"
+)
+
+// drainState tracks open connections so the server can be drained before
+// a restart. A draining server closes new connections on accept and every
+// open one once it is idle: between frames, with no admin operation or
+// queued purchase outstanding. Connections that negotiated goaway are sent
+// MSG_GOAWAY instead and served until its deadline, so their clients can
+// move to another server before the connection closes.
+type drainState struct {
+	draining atomic.Bool
+	started  time.Time
+
+	mu    sync.Mutex
+	conns map[*session]struct{}
+	// reason is the GOAWAY reason of the current drain
+	reason string
+}
+
+func newDrainState() *drainState {
+	return &drainState{started: time.Now(), conns: make(map[*session]struct{})}
+}
+
+func (d *drainState) add(sess *session) {
+	d.mu.Lock()
+	d.conns[sess] = struct{}{}
+	d.mu.Unlock()
+}
+
+func (d *drainState) remove(sess *session) {
+	d.mu.Lock()
+	delete(d.conns, sess)
+	d.mu.Unlock()
+}
+
+func (d *drainState) count() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.conns)
+}
+
+// all returns every open connection
+func (d *drainState) all() []*session {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	conns := make([]*session, 0, len(d.conns))
+	for sess := range d.conns {
+		conns = append(conns, sess)
+	}
+	return conns
+}
+
+// idleSince returns the connections with no frame read or written since
+// cutoff
+func (d *drainState) idleSince(cutoff time.Time) []*session {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var idle []*session
+	for sess := range d.conns {
+		if sess.lastActive.Load() < cutoff.UnixNano() {
+			idle = append(idle, sess)
+		}
+	}
+	return idle
+}
+
+// start begins draining and wakes every connection blocked reading its next
+// frame, so idle ones close and the others are sent MSG_GOAWAY now rather
+// than on their read timeout. With the io_uring path a deadline does not
+// interrupt a read already in flight, so those connections only notice on
+// their read timeout. A drain already under way keeps its reason.
+func (d *drainState) start(reason string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.draining.CompareAndSwap(false, true) {
+		return false
+	}
+	d.reason = reason
+	for sess := range d.conns {
+		sess.conn.SetReadDeadline(time.Now())
+	}
+	return true
+}
+
+func (d *drainState) goAwayReason() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.reason
+}
+
+// keepDraining reports whether a draining server still serves sess. Connections
+// that negotiated goaway are sent MSG_GOAWAY the first time and kept until
+// its deadline, which then bounds the read deadline; others are kept only
+// while running. It is called from the connection's goroutine, after the
+// read deadline for the next frame is set.
+func (s *Server) keepDraining(sess *session) bool {
+	if !sess.proto.has(protocol.CAP_GOAWAY) || s.opts.GoAwayDeadline <= 0 {
+		return sess.running()
+	}
+
+	now := time.Now()
+	if sess.goAwayBy.IsZero() {
+		reason := s.drain.goAwayReason()
+		sess.goAwayBy = now.Add(s.opts.GoAwayDeadline)
+		data, _ := json.Marshal(protocol.GoAway{Reason: reason, Deadline: sess.goAwayBy.Unix()})
+		if err := sess.write(s, protocol.MSG_GOAWAY, jsonCodec{}, data); err != nil {
+			return false
+		}
+		s.metrics.goAwaySent.WithLabelValues(reason).Inc()
+		s.debugf("Sent GOAWAY to %s (%s)", sess.conn.RemoteAddr(), reason)
+	}
+	if !now.Before(sess.goAwayBy) {
+		s.metrics.connectionsClosed.WithLabelValues("goaway_deadline").Inc()
+		return false
+	}
+	if now.Add(s.config().ConnReadTimeout).After(sess.goAwayBy) {
+		sess.conn.SetReadDeadline(sess.goAwayBy)
+	}
+	return true
+}
+
+// waitGoAway gives connections sent MSG_GOAWAY until its deadline to
+// close on their own, and returns early once none are left
+func (s *Server) waitGoAway() {
+	deadline := time.Now().Add(s.opts.GoAwayDeadline)
+	for s.drain.count() > 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// drainStatus is the /admin/drain view of the server
+type drainStatus struct {
+	Draining    bool   `json:"draining"`
+	Connections int    `json:"connections"`
+	StartedAt   int64  `json:"started_at"`
+	Version     string `json:"version"`
+}
+
+// handleDrain serves /admin/drain for rolling restarts: GET reports
+// whether the server is draining and how many connections are left, POST
+// starts draining and DELETE admits connections again. It needs
+// ADMIN_TOKEN as a bearer token and is disabled without one.
+func (s *Server) handleDrain(w http.ResponseWriter, r *http.Request) {
+	if !s.adminAuthorized(w, r) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if s.drain.start(protocol.GOAWAY_DRAINING) {
+			log.Printf("Draining - %d connections open, new connections are refused", s.drain.count())
+		}
+	case http.MethodDelete:
+		if s.drain.draining.CompareAndSwap(true, false) {
+			log.Printf("Drain cancelled, accepting connections")
+		}
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, drainStatus{
+		Draining:    s.drain.draining.Load(),
+		Connections: s.drain.count(),
+		StartedAt:   s.drain.started.Unix(),
+		Version:     buildinfo.Get().Version,
+	})
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/vmihailenco/msgpack/v5"
+
+	"chha/pkg/protocol"
+)
+
+// codec marshals request and response payloads. Every codec maps fields
+// by their json tags, so one set of structs serves all encodings.
+type codec interface {
+	ID() byte
+	Name() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// codecs are the encodings a client can choose per frame
+var codecs = map[byte]codec{
+	protocol.ENCODING_JSON:    jsonCodec{},
+	protocol.ENCODING_MSGPACK: msgpackCodec{},
+}
+
+// codecByName looks up an encoding advertised in MSG_HELLO
+func codecByName(name string) (codec, bool) {
+	for _, c := range codecs {
+		if c.Name() == name {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ID() byte                                   { return protocol.ENCODING_JSON }
+func (jsonCodec) Name() string                               { return "json" }
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) ID() byte     { return protocol.ENCODING_MSGPACK }
+func (msgpackCodec) Name() string { return "msgpack" }
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.GetEncoder()
+	defer msgpack.PutEncoder(enc)
+
+	enc.Reset(&buf)
+	enc.SetCustomStructTag("json")
+	enc.UseCompactInts(true)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	dec := msgpack.GetDecoder()
+	defer msgpack.PutDecoder(dec)
+
+	dec.Reset(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	return dec.Decode(v)
+}
@@ -0,0 +1,207 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"chha/internal/store"
+	"chha/pkg/protocol"
+)
+
+// eventBacklog is how many MSG_EVENT frames wait for a connection before
+// later ones are dropped, so a slow client can't hold up the others
+const eventBacklog = 256
+
+// saleStateInterval is how often sale states are compared with the
+// catalog while any connection wants events
+const saleStateInterval = time.Second
+
+// eventHub fans stock and sale state events out to the connections that
+// negotiated events
+type eventHub struct {
+	metrics *Metrics
+
+	mu   sync.Mutex
+	subs map[*session]*eventSub
+
+	// states are the sale states last seen in the catalog, only used by
+	// eventsLoop
+	states map[string]string
+}
+
+// eventSub is one connection's subscription. products is nil for every
+// product.
+type eventSub struct {
+	products map[string]bool
+	events   chan protocol.Event
+}
+
+func newEventHub(metrics *Metrics) *eventHub {
+	return &eventHub{metrics: metrics, subs: make(map[*session]*eventSub)}
+}
+
+// subscribe starts pushing events to sess from a goroutine of its own,
+// until unsubscribe
+func (h *eventHub) subscribe(s *Server, sess *session, products []string) {
+	sub := &eventSub{events: make(chan protocol.Event, eventBacklog)}
+	if len(products) > 0 {
+		sub.products = make(map[string]bool, len(products))
+		for _, id := range products {
+			sub.products[id] = true
+		}
+	}
+	h.mu.Lock()
+	h.subs[sess] = sub
+	h.mu.Unlock()
+
+	go func() {
+		for ev := range sub.events {
+			data, _ := json.Marshal(ev)
+			if err := sess.write(s, protocol.MSG_EVENT, jsonCodec{}, data); err != nil {
+				log.Printf("Failed to push event to %s: %v", sess.conn.RemoteAddr(), err)
+				return
+			}
+		}
+	}()
+}
+
+// unsubscribe stops the events of a closing connection
+func (h *eventHub) unsubscribe(sess *session) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if sub, ok := h.subs[sess]; ok {
+		delete(h.subs, sess)
+		close(sub.events)
+	}
+}
+
+// empty reports whether no connection wants events
+func (h *eventHub) empty() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subs) == 0
+}
+
+// publish queues ev for every connection that wants its product
+func (h *eventHub) publish(ev protocol.Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, sub := range h.subs {
+		if sub.products != nil && !sub.products[ev.ProductID] {
+			continue
+		}
+		select {
+		case sub.events <- ev:
+			h.metrics.eventsPushed.Inc()
+		default:
+			h.metrics.eventsDropped.Inc()
+		}
+	}
+}
+
+// eventsLoop turns the purchase events and restocks of every server into
+// MSG_EVENT frames, and checks sale states against the catalog every
+// saleStateInterval while any connection wants events
+func (s *Server) eventsLoop() {
+	defer s.wg.Done()
+
+	sub := s.redis.Subscribe(s.ctx, s.keyPrefix+EVENTS_CHANNEL, s.keyPrefix+store.RestockChannel)
+	defer sub.Close()
+	ticker := time.NewTicker(saleStateInterval)
+	defer ticker.Stop()
+
+	ch := sub.Channel()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case msg := <-ch:
+			if s.events.empty() {
+				continue
+			}
+			if msg.Channel == s.keyPrefix+store.RestockChannel {
+				s.publishRestock(msg.Payload)
+				continue
+			}
+			var event struct {
+				Type      string `json:"type"`
+				ProductID string `json:"product_id"`
+				Remaining int64  `json:"remaining"`
+				Timestamp int64  `json:"timestamp"`
+			}
+			if json.Unmarshal([]byte(msg.Payload), &event) == nil && event.Type == "purchase" {
+				s.events.publish(protocol.Event{
+					Type:      protocol.EVENT_STOCK,
+					ProductID: event.ProductID,
+					Stock:     event.Remaining,
+					Timestamp: event.Timestamp,
+				})
+			}
+		case <-ticker.C:
+			if s.events.empty() {
+				// Whoever subscribes next starts from fresh states
+				s.events.states = nil
+				continue
+			}
+			s.publishSaleStates()
+		}
+	}
+}
+
+// publishRestock sends the stock of a product whose units went back on
+// sale. Restocks carry no stock, so it is read.
+func (s *Server) publishRestock(productID string) {
+	ctx := withCommandTags(s.ctx, productID, "events")
+	stock, err := s.reads().GetStock(ctx, productID)
+	if err != nil {
+		log.Printf("Failed to read stock of %s for events: %v", productID, err)
+		return
+	}
+	s.events.publish(protocol.Event{
+		Type:      protocol.EVENT_STOCK,
+		ProductID: productID,
+		Stock:     stock,
+		Timestamp: time.Now().Unix(),
+	})
+}
+
+// publishSaleStates sends the products whose state in the catalog changed
+// since the last check. Ended products leave the catalog. The first check
+// only records the states.
+func (s *Server) publishSaleStates() {
+	ctx := withCommandTags(s.ctx, "none", "events")
+	entries, err := s.catalog.list(ctx)
+	if err != nil {
+		log.Printf("Failed to list products for events: %v", err)
+		return
+	}
+
+	now := time.Now().Unix()
+	primed := s.events.states != nil
+	states := make(map[string]string, len(entries))
+	for _, e := range entries {
+		states[e.ProductID] = e.State
+		if primed && s.events.states[e.ProductID] != e.State {
+			s.events.publish(protocol.Event{
+				Type:      protocol.EVENT_SALE_STATE,
+				ProductID: e.ProductID,
+				Stock:     e.StockHint,
+				State:     e.State,
+				Timestamp: now,
+			})
+		}
+	}
+	for id := range s.events.states {
+		if _, ok := states[id]; !ok {
+			s.events.publish(protocol.Event{
+				Type:      protocol.EVENT_SALE_STATE,
+				ProductID: id,
+				State:     store.StateEnded,
+				Timestamp: now,
+			})
+		}
+	}
+	s.events.states = states
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"chha/internal/eventschema"
+)
+
+// schemaLogInterval limits mismatch logs to one per event type per
+// interval, so a broken event type at sale volume can't flood the log
+const schemaLogInterval = 10 * time.Second
+
+// schemaCheck holds events that don't match the registered schema back
+// from the sinks, or only reports them in warn mode
+type schemaCheck struct {
+	validator *eventschema.Validator
+	enforce   bool
+	metrics   *Metrics
+
+	mu     sync.Mutex
+	logged map[string]time.Time
+}
+
+func newSchemaCheck(v *eventschema.Validator, enforce bool, metrics *Metrics) *schemaCheck {
+	return &schemaCheck{validator: v, enforce: enforce, metrics: metrics, logged: make(map[string]time.Time)}
+}
+
+// allow reports whether event may be published to the sinks
+func (c *schemaCheck) allow(event map[string]interface{}) bool {
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Failed to marshal event: %v", err)
+		return false
+	}
+	err = c.validator.Validate(data)
+	if err == nil {
+		return true
+	}
+
+	eventType, _ := event["type"].(string)
+	c.metrics.eventSchemaMismatches.WithLabelValues(eventType).Inc()
+	if c.shouldLog(eventType) {
+		if c.enforce {
+			log.Printf("ERROR: %s event held back from sinks: %v", eventType, err)
+		} else {
+			log.Printf("WARNING: %s event published despite schema mismatch: %v", eventType, err)
+		}
+	}
+	return !c.enforce
+}
+
+func (c *schemaCheck) shouldLog(eventType string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if last, ok := c.logged[eventType]; ok && time.Since(last) < schemaLogInterval {
+		return false
+	}
+	c.logged[eventType] = time.Now()
+	return true
+}
+
+// publishToSinks hands event to every sink, once it passes the schema
+// check if one is configured
+func (s *Server) publishToSinks(productID string, event map[string]interface{}) {
+	if len(s.sinks) == 0 {
+		return
+	}
+	if s.schemaCheck != nil && !s.schemaCheck.allow(event) {
+		return
+	}
+	for _, sink := range s.sinks {
+		sink.Publish(productID, event)
+	}
+}
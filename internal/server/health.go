@@ -0,0 +1,86 @@
+package server
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"chha/internal/store"
+)
+
+// readyTimeout bounds the Redis round trips of one readiness check
+const readyTimeout = 2 * time.Second
+
+// handleHealthz serves GET /healthz, the liveness probe. It only shows the
+// process is serving HTTP: a broken Redis link is a reason to stop routing
+// traffic here, which /readyz reports, not to restart the server.
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handleReadyz serves GET /readyz, the readiness probe. The server is
+// ready when it is not draining and the store can serve purchases: for
+// Redis, it answers PING and still has the purchase script loaded.
+func (s *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if s.drain.draining.Load() {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "draining"})
+		return
+	}
+
+	if hc, ok := s.store.(store.HealthChecker); ok {
+		ctx, cancel := context.WithTimeout(withCommandTags(r.Context(), "none", "readiness"), readyTimeout)
+		defer cancel()
+		if err := hc.CheckHealth(ctx); err != nil {
+			log.Printf("Readiness check failed: %v", err)
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "unavailable", "error": err.Error()})
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// scriptCheckLoop reloads Lua scripts Redis lost between readiness checks.
+// A restarted or replaced node, or a failover to a replica that never
+// loaded them, otherwise fails every purchase with NOSCRIPT until a probe
+// happens to notice.
+func (s *Server) scriptCheckLoop(syncer store.ScriptSyncer) {
+	defer s.wg.Done()
+
+	ctx := withCommandTags(s.ctx, "none", "script_check")
+	ticker := time.NewTicker(s.opts.ScriptCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		nodes, err := syncer.SyncScripts(ctx)
+		// Nodes that left the cluster drop out of the gauge
+		s.metrics.scriptsMissing.Reset()
+		outOfSync := 0
+		for node, missing := range nodes {
+			s.metrics.scriptsMissing.WithLabelValues(node).Set(float64(missing))
+			if missing > 0 {
+				outOfSync++
+				s.metrics.scriptReloads.Add(float64(missing))
+				log.Printf("WARNING: %d Lua scripts missing from Redis node %s, loading them again", missing, node)
+			}
+		}
+		s.metrics.scriptNodesMissing.Set(float64(outOfSync))
+		if err != nil {
+			log.Printf("Script check failed: %v", err)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+
+	"chha/internal/buildinfo"
+	"chha/pkg/protocol"
+)
+
+// supportedCapabilities are the optional protocol features a client can
+// ask for in MSG_HELLO. Features that change the frame format are only
+// switched on once both sides have agreed to them.
+var supportedCapabilities = map[string]bool{
+	protocol.CAP_CONTENT_ENCODING: true,
+	protocol.CAP_FRAME_CRC32:      true,
+	protocol.CAP_QUEUE_RESULTS:    true,
+	protocol.CAP_TIMESTAMPS:       true,
+	protocol.CAP_GOAWAY:           true,
+	protocol.CAP_EVENTS:           true,
+	protocol.CAP_BACKPRESSURE:     true,
+	// Only agreed while IDEMPOTENCY_TTL or CONN_MAX_IN_FLIGHT is set, see
+	// offers
+	protocol.CAP_IDEMPOTENCY_KEYS: true,
+	protocol.CAP_REQUEST_IDS:      true,
+}
+
+// offers reports whether a capability can be agreed with the current
+// configuration
+func (s *Server) offers(capability string) bool {
+	switch capability {
+	case protocol.CAP_IDEMPOTENCY_KEYS:
+		return s.idempotencyKeys() != nil
+	case protocol.CAP_REQUEST_IDS:
+		return s.opts.ConnMaxInFlight > 0
+	}
+	return supportedCapabilities[capability]
+}
+
+// CONNECT_MODE values
+const (
+	connectOpen     = "open"
+	connectGreeting = "greeting"
+	connectSilent   = "silent"
+)
+
+// greet sends MSG_SERVER_INFO as soon as a connection opens in greeting
+// mode, in the protocol 1.0 frame format since nothing is negotiated yet
+func (s *Server) greet(sess *session) error {
+	info := s.serverInfo()
+	info.Status = protocol.STATUS_SUCCESS
+	data, _ := json.Marshal(info)
+	return sess.write(s, protocol.MSG_SERVER_INFO, jsonCodec{}, data)
+}
+
+// silenced reports whether a connection in silent mode must be closed
+// without a reply: its first frame is not MSG_HELLO, or the HELLO failed.
+// Scanners then learn nothing, not even that this is a flash sale server.
+func (s *Server) silenced(sess *session, first bool, msgType byte) bool {
+	if s.opts.ConnectMode != connectSilent || !first {
+		return false
+	}
+	if msgType != protocol.MSG_HELLO {
+		s.metrics.connectionsSilenced.Inc()
+		return true
+	}
+	return false
+}
+
+// protocolState is what a connection negotiated with MSG_HELLO
+type protocolState struct {
+	minor        int
+	capabilities map[string]bool
+	// eventProducts limits MSG_EVENT to these products, with events
+	eventProducts []string
+	// tenant is the server of the tenant named in MSG_HELLO, nil for none
+	tenant *Server
+}
+
+// has reports whether a capability was negotiated
+func (p protocolState) has(capability string) bool {
+	return p.capabilities[capability]
+}
+
+// framing is the frame format implied by the negotiated capabilities
+func (p protocolState) framing() protocol.Framing {
+	return protocol.Framing{
+		Encoding:   p.has(protocol.CAP_CONTENT_ENCODING),
+		RequestIDs: p.has(protocol.CAP_REQUEST_IDS),
+		CRC:        p.has(protocol.CAP_FRAME_CRC32),
+		Timestamps: p.has(protocol.CAP_TIMESTAMPS),
+	}
+}
+
+// handleHello serves MSG_HELLO. It must be the first frame of a
+// connection, so nothing has been exchanged in a format the client may
+// not understand. proto is the negotiated state, to be applied once the
+// response is sent. ok is false when the connection should be closed
+// after the response instead.
+func (s *Server) handleHello(sess *session, payload []byte, first bool) (response []byte, proto *protocolState, ok bool) {
+	reply := func(resp protocol.HelloResponse) []byte {
+		data, _ := json.Marshal(resp)
+		return data
+	}
+
+	var req protocol.HelloRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return reply(protocol.HelloResponse{Status: protocol.STATUS_ERROR, Error: "invalid json"}), nil, true
+	}
+	if !first {
+		return reply(protocol.HelloResponse{Status: protocol.STATUS_ERROR, Error: "hello must be the first frame"}), nil, true
+	}
+
+	if req.ProtocolVersion != protocol.PROTOCOL_VERSION {
+		log.Printf("Rejected protocol %d.%d from %s (%s)", req.ProtocolVersion, req.ProtocolMinor, sess.conn.RemoteAddr(), req.Client)
+		return reply(protocol.HelloResponse{
+			Status:            protocol.STATUS_ERROR,
+			ProtocolVersion:   protocol.PROTOCOL_VERSION,
+			ProtocolMinor:     protocol.PROTOCOL_MINOR,
+			Capabilities:      []string{},
+			SupportedVersions: []int{protocol.PROTOCOL_VERSION},
+			Error:             fmt.Sprintf("unsupported protocol version %d", req.ProtocolVersion),
+		}), nil, false
+	}
+
+	srv, err := s.helloTenant(req.Tenant, req.TenantToken)
+	if err != nil {
+		s.metrics.tenantRejected.Inc()
+		log.Printf("Rejected tenant %q from %s", req.Tenant, sess.conn.RemoteAddr())
+		return reply(protocol.HelloResponse{
+			Status:          protocol.STATUS_ERROR,
+			ProtocolVersion: protocol.PROTOCOL_VERSION,
+			ProtocolMinor:   protocol.PROTOCOL_MINOR,
+			Capabilities:    []string{},
+			Error:           err.Error(),
+		}), nil, false
+	}
+
+	proto = &protocolState{
+		minor:        min(req.ProtocolMinor, protocol.PROTOCOL_MINOR),
+		capabilities: make(map[string]bool),
+	}
+	if srv != s {
+		proto.tenant = srv
+	}
+	agreed := []string{}
+	for _, c := range req.Capabilities {
+		if srv.offers(c) && !proto.capabilities[c] {
+			proto.capabilities[c] = true
+			agreed = append(agreed, c)
+		}
+	}
+	sort.Strings(agreed)
+	if proto.has(protocol.CAP_EVENTS) {
+		proto.eventProducts = req.EventProducts
+	}
+
+	var encodings []string
+	if proto.has(protocol.CAP_CONTENT_ENCODING) {
+		for _, name := range req.Encodings {
+			if _, ok := codecByName(name); ok {
+				encodings = append(encodings, name)
+			}
+		}
+	}
+
+	resp := protocol.HelloResponse{
+		Status:          protocol.STATUS_SUCCESS,
+		ProtocolVersion: protocol.PROTOCOL_VERSION,
+		ProtocolMinor:   proto.minor,
+		Capabilities:    agreed,
+		Encodings:       encodings,
+		ServerVersion:   buildinfo.Get().Version,
+	}
+	if proto.has(protocol.CAP_REQUEST_IDS) {
+		resp.MaxInFlight = s.opts.ConnMaxInFlight
+	}
+	return reply(resp), proto, true
+}
@@ -0,0 +1,200 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"chha/internal/store"
+)
+
+// holdReasonSpeed is the reason of orders held because their buyer was
+// flagged by speed detection
+const holdReasonSpeed = "speed_flagged"
+
+const (
+	// adminHoldsLimit is the default page size of /admin/holds
+	adminHoldsLimit = 100
+	// adminHoldsMaxLimit caps the page size of /admin/holds
+	adminHoldsMaxLimit = 1000
+)
+
+// holdPurchase holds the new order of a flagged user for review when
+// SPEED_HOLD is set. A failed hold leaves the order as it is, like a
+// failed speed check.
+func (s *Server) holdPurchase(productID, userID, orderID string) (store.Order, bool) {
+	reviewer, ok := s.store.(store.OrderReviewer)
+	if !ok || !s.opts.SpeedHold {
+		return store.Order{}, false
+	}
+	ctx := withCommandTags(s.ctx, productID, "hold_order")
+	order, err := reviewer.HoldOrder(ctx, orderID, holdReasonSpeed)
+	if err != nil {
+		log.Printf("Failed to hold order=%s of flagged user=%s, leaving it: %v", orderID, userID, err)
+		return store.Order{}, false
+	}
+	s.metrics.ordersHeld.Inc()
+	log.Printf("Order held for review: product=%s user=%s order=%s (%s)", productID, userID, orderID, holdReasonSpeed)
+	return order, true
+}
+
+// publishHold records the order_held event of an order. It must follow
+// the order's purchase event, which replay needs to see first.
+func (s *Server) publishHold(order store.Order) {
+	s.emitEvent(order.ProductID, true, map[string]interface{}{
+		"type":            "order_held",
+		"product_id":      order.ProductID,
+		"buyer":           order.UserID,
+		"order_id":        order.ID,
+		"status":          store.OrderHeld,
+		"previous_status": order.HeldFrom,
+		"held_from":       order.HeldFrom,
+		"reason":          order.HoldReason,
+		"timestamp":       order.HeldAt.Unix(),
+	})
+}
+
+// orderReviewer returns the store's order reviews, answering 501 if it has
+// none, and 503 for a decision while the server is read only
+func (s *Server) orderReviewer(w http.ResponseWriter, write bool) (store.OrderReviewer, bool) {
+	reviewer, ok := s.store.(store.OrderReviewer)
+	if !ok {
+		writeJSONError(w, http.StatusNotImplemented, "the store does not support order holds")
+		return nil, false
+	}
+	if write && s.readOnly() {
+		writeJSONError(w, http.StatusServiceUnavailable, readOnlyError)
+		return nil, false
+	}
+	return reviewer, true
+}
+
+// handleHolds serves GET /admin/holds, the orders held for review, held
+// longest first, up to ?limit
+func (s *Server) handleHolds(w http.ResponseWriter, r *http.Request) {
+	if !s.adminAuthorized(w, r) {
+		return
+	}
+	reviewer, ok := s.orderReviewer(w, false)
+	if !ok {
+		return
+	}
+
+	limit := adminHoldsLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > adminHoldsMaxLimit {
+			writeJSONError(w, http.StatusBadRequest, "limit must be between 1 and "+strconv.Itoa(adminHoldsMaxLimit))
+			return
+		}
+		limit = n
+	}
+
+	orders, err := reviewer.HeldOrders(withCommandTags(r.Context(), "none", "admin_held_orders"), limit)
+	if err != nil {
+		log.Printf("Admin held orders failed: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	out := make([]adminOrder, len(orders))
+	for i, o := range orders {
+		out[i] = newAdminOrder(o)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"orders": out})
+}
+
+// handleApproveHold serves POST /admin/holds/{id}/approve. The order goes
+// back to the status it was held from; a PENDING one gets the time it had
+// left to pay.
+func (s *Server) handleApproveHold(w http.ResponseWriter, r *http.Request) {
+	if !s.adminAuthorized(w, r) {
+		return
+	}
+	reviewer, ok := s.orderReviewer(w, true)
+	if !ok {
+		return
+	}
+
+	orderID := r.PathValue("id")
+	order, err := reviewer.ApproveOrder(withCommandTags(r.Context(), "none", "admin_approve_order"), orderID)
+	if err != nil {
+		writeReviewError(w, "approve", err)
+		return
+	}
+	s.metrics.orderReviews.WithLabelValues("approved").Inc()
+	log.Printf("Held order approved: product=%s user=%s order=%s, now %s", order.ProductID, order.UserID, order.ID, order.Status)
+
+	resp := newAdminOrder(order)
+	event := map[string]interface{}{
+		"type":            "order_approved",
+		"product_id":      order.ProductID,
+		"buyer":           order.UserID,
+		"order_id":        order.ID,
+		"status":          order.Status,
+		"previous_status": store.OrderHeld,
+		"timestamp":       time.Now().Unix(),
+	}
+	if resp.PaymentDeadline > 0 {
+		event["payment_deadline"] = resp.PaymentDeadline
+	}
+	go s.emitEvent(order.ProductID, true, event)
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleRejectHold serves POST /admin/holds/{id}/reject. The unit goes back
+// on sale, or to the next waitlisted user, and the order_rejected event
+// tells the buyer's systems.
+func (s *Server) handleRejectHold(w http.ResponseWriter, r *http.Request) {
+	if !s.adminAuthorized(w, r) {
+		return
+	}
+	reviewer, ok := s.orderReviewer(w, true)
+	if !ok {
+		return
+	}
+
+	orderID := r.PathValue("id")
+	order, result, err := reviewer.RejectOrder(withCommandTags(r.Context(), "none", "admin_reject_order"), orderID)
+	if err != nil {
+		writeReviewError(w, "reject", err)
+		return
+	}
+	s.metrics.orderReviews.WithLabelValues("rejected").Inc()
+	log.Printf("Held order rejected: product=%s user=%s order=%s, stock now %d", order.ProductID, order.UserID, order.ID, result.Remaining)
+
+	go s.emitEvent(order.ProductID, true, map[string]interface{}{
+		"type":            "order_rejected",
+		"product_id":      order.ProductID,
+		"buyer":           order.UserID,
+		"order_id":        order.ID,
+		"status":          store.OrderRejected,
+		"previous_status": store.OrderHeld,
+		"reason":          order.HoldReason,
+		"remaining":       result.Remaining,
+		"timestamp":       time.Now().Unix(),
+	})
+	if result.Grant != nil {
+		go s.publishWaitlistGrant(order.ID, result.Grant)
+	}
+
+	resp := newAdminOrder(order)
+	resp.RemainingStock = &result.Remaining
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func writeReviewError(w http.ResponseWriter, decision string, err error) {
+	switch {
+	case errors.Is(err, store.ErrOrderNotFound):
+		writeJSONError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, store.ErrOrderNotHeld):
+		writeJSONError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, store.ErrProductNotFound):
+		writeJSONError(w, http.StatusConflict, "the order's product no longer exists")
+	default:
+		log.Printf("Admin %s order failed: %v", decision, err)
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+	}
+}
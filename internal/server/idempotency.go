@@ -0,0 +1,107 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+
+	"chha/internal/store"
+	"chha/pkg/protocol"
+)
+
+// maxIdempotencyKeyLen bounds the idempotency_key of a purchase
+const maxIdempotencyKeyLen = 128
+
+// idempotencyKeys returns the store's idempotency keys, or nil when
+// IDEMPOTENCY_TTL is 0 or the store has none
+func (s *Server) idempotencyKeys() store.IdempotencyKeys {
+	if s.opts.IdempotencyTTL <= 0 {
+		return nil
+	}
+	keys, _ := s.store.(store.IdempotencyKeys)
+	return keys
+}
+
+// replayPurchase answers an attempt whose idempotency key was seen
+// before. It runs ahead of proof of work and rate limits, which a retry
+// may no longer pass. ok is false for a key not seen yet.
+func (s *Server) replayPurchase(c codec, req PurchaseRequest) (data []byte, ok bool) {
+	ctx, cancel := s.withEvalTimeout(withCommandTags(s.ctx, req.ProductID, "idempotency"))
+	defer cancel()
+	found, saved, err := s.idempotencyKeys().IdempotencyKey(ctx, req.ProductID, req.UserID, req.IdempotencyKey)
+	s.recordRedis(err)
+	if err != nil {
+		log.Printf("Failed to check idempotency key of user=%s: %v", req.UserID, err)
+		data, _ := c.Marshal(PurchaseResponse{Status: protocol.STATUS_ERROR, Error: "failed to check idempotency key"})
+		return data, true
+	}
+	if !found {
+		return nil, false
+	}
+	return s.replayed(c, saved), true
+}
+
+// claimPurchase reserves the idempotency key of an attempt about to reach
+// the store. ok is false if another attempt claimed it first, and data is
+// then the answer.
+func (s *Server) claimPurchase(c codec, req PurchaseRequest) (data []byte, ok bool) {
+	ctx, cancel := s.withEvalTimeout(withCommandTags(s.ctx, req.ProductID, "idempotency"))
+	defer cancel()
+	ok, saved, err := s.idempotencyKeys().ClaimIdempotencyKey(ctx, req.ProductID, req.UserID, req.IdempotencyKey, s.opts.IdempotencyTTL)
+	s.recordRedis(err)
+	if err != nil {
+		log.Printf("Failed to claim idempotency key of user=%s: %v", req.UserID, err)
+		data, _ := c.Marshal(PurchaseResponse{Status: protocol.STATUS_ERROR, Error: "failed to check idempotency key"})
+		return data, false
+	}
+	if !ok {
+		return s.replayed(c, saved), false
+	}
+	return nil, true
+}
+
+// replayed is the response saved for a key, or ERROR_IN_PROGRESS while
+// its attempt has none. An attempt whose server died before saving stays
+// in progress until the key expires, as it may have bought.
+func (s *Server) replayed(c codec, saved []byte) []byte {
+	s.metrics.purchasesReplayed.Inc()
+	var resp PurchaseResponse
+	if len(saved) == 0 || json.Unmarshal(saved, &resp) != nil {
+		resp = PurchaseResponse{Status: protocol.STATUS_ERROR, Error: protocol.ERROR_IN_PROGRESS}
+	} else {
+		resp.Replayed = true
+	}
+	data, _ := c.Marshal(resp)
+	return data
+}
+
+// settlePurchase saves the response of an attempt that claimed its key,
+// data as sent to the client, and storeErr the store's error if any.
+// Attempts the store turned away without buying release the key instead,
+// so a retry once the sale starts or resumes, or the limit allows, tries
+// again. So do those that failed without running the script, because the
+// purchase never reached Redis or Redis refused the write; only an ERROR
+// that may have bought is kept.
+func (s *Server) settlePurchase(c codec, req PurchaseRequest, data []byte, storeErr error) {
+	ctx := withCommandTags(s.ctx, req.ProductID, "idempotency")
+	keys := s.idempotencyKeys()
+	var resp PurchaseResponse
+	if err := c.Unmarshal(data, &resp); err != nil {
+		log.Printf("Failed to save idempotency key of user=%s: %v", req.UserID, err)
+		return
+	}
+	var err error
+	switch {
+	case resp.Status == protocol.STATUS_PAUSED, resp.Status == protocol.STATUS_LIMIT_REACHED, resp.Status == protocol.STATUS_NOT_ON_SALE,
+		resp.Status == protocol.STATUS_ENDED, resp.Status == protocol.STATUS_NOT_ELIGIBLE,
+		// An overdraft grant answers SUCCESS and is kept
+		resp.Status == protocol.STATUS_ERROR && storeErr != nil && (isUnsentError(storeErr) || isWriteRefusedError(storeErr)):
+		err = keys.ReleaseIdempotencyKey(ctx, req.ProductID, req.UserID, req.IdempotencyKey)
+	default:
+		saved, _ := json.Marshal(resp)
+		err = keys.SaveIdempotencyKey(ctx, req.ProductID, req.UserID, req.IdempotencyKey, saved, s.opts.IdempotencyTTL)
+	}
+	if err != nil {
+		// The key stays in progress until it expires: safe, if unhelpful
+		log.Printf("Failed to settle idempotency key of user=%s: %v", req.UserID, err)
+	}
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+
+	"chha/internal/config"
+	"chha/internal/store"
+	"chha/pkg/protocol"
+)
+
+// newIdempotencyServer is just enough of a Server to claim and settle
+// idempotency keys, on a store backed by miniredis
+func newIdempotencyServer(t *testing.T) *Server {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+	st, err := store.NewRedisStore(context.Background(), rdb, store.RedisStoreOptions{})
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	return &Server{
+		ctx:     context.Background(),
+		opts:    config.Server{IdempotencyTTL: time.Minute},
+		metrics: newMetrics("test"),
+		store:   st,
+	}
+}
+
+// TestSettlePurchase keeps the key of an attempt that may have bought and
+// releases those of attempts that certainly did not
+func TestSettlePurchase(t *testing.T) {
+	c := jsonCodec{}
+	for _, tc := range []struct {
+		name     string
+		resp     PurchaseResponse
+		storeErr error
+		kept     bool
+	}{
+		{"success", PurchaseResponse{Status: protocol.STATUS_SUCCESS, OrderID: "1"}, nil, true},
+		{"sold out", PurchaseResponse{Status: protocol.STATUS_SOLD_OUT}, nil, true},
+		{"paused", PurchaseResponse{Status: protocol.STATUS_PAUSED}, store.ErrSalePaused, false},
+		{"timed out", PurchaseResponse{Status: protocol.STATUS_ERROR}, fmt.Errorf("redis error: %w", context.DeadlineExceeded), true},
+		{"not durable", PurchaseResponse{Status: protocol.STATUS_ERROR}, fmt.Errorf("%w: fsync timed out", store.ErrNotDurable), true},
+		{"write refused", PurchaseResponse{Status: protocol.STATUS_ERROR}, refusedError(t, "READONLY You can't write against a read only replica."), false},
+		{"never sent", PurchaseResponse{Status: protocol.STATUS_ERROR}, fmt.Errorf("redis error: %w", redis.ErrPoolTimeout), false},
+		{"overdraft grant", PurchaseResponse{Status: protocol.STATUS_SUCCESS, Provisional: true}, fmt.Errorf("redis error: %w", redis.ErrPoolTimeout), true},
+	} {
+		s := newIdempotencyServer(t)
+		req := PurchaseRequest{ProductID: "p", UserID: "u", IdempotencyKey: "k"}
+		if _, ok := s.claimPurchase(c, req); !ok {
+			t.Fatalf("%s: key already claimed", tc.name)
+		}
+		data, _ := c.Marshal(tc.resp)
+		s.settlePurchase(c, req, data, tc.storeErr)
+
+		found, _, err := s.idempotencyKeys().IdempotencyKey(s.ctx, req.ProductID, req.UserID, req.IdempotencyKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found != tc.kept {
+			t.Errorf("%s: key kept = %v, want %v", tc.name, found, tc.kept)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package server
+
+import "time"
+
+// idleReapInterval is how often open connections are checked against
+// CONN_IDLE_TIMEOUT
+const idleReapInterval = 10 * time.Second
+
+// idleReaperLoop closes connections with no frame either way for
+// CONN_IDLE_TIMEOUT. The read deadline already drops quiet connections,
+// but not ones waiting on an admin operation or queued purchase, which
+// keep reading past it; without the reaper a client that went away
+// without a FIN would pin its goroutine for as long as that wait lasts.
+func (s *Server) idleReaperLoop() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(idleReapInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		timeout := s.config().ConnIdleTimeout
+		if timeout <= 0 {
+			continue
+		}
+		for _, sess := range s.drain.idleSince(time.Now().Add(-timeout)) {
+			s.debugf("Closing idle connection from %s", sess.conn.RemoteAddr())
+			s.metrics.connectionsClosed.WithLabelValues("idle").Inc()
+			// Close also ends a read in flight on the io_uring path,
+			// which a deadline does not
+			sess.conn.Close()
+		}
+	}
+}
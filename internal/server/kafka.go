@@ -0,0 +1,288 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	kafkaQueueSize     = 10000
+	kafkaBatchSize     = 100
+	kafkaBatchTimeout  = 100 * time.Millisecond
+	kafkaDrainInterval = time.Second
+	kafkaWriteTimeout  = 10 * time.Second
+)
+
+// eventSink receives every event emitted by the server, after it has been
+// written to the events stream
+type eventSink interface {
+	Publish(productID string, event map[string]interface{})
+	Close() error
+}
+
+// KafkaSink publishes events to a Kafka topic keyed by product ID. Writes
+// require acknowledgement from all in-sync replicas, and batches that fail
+// are spilled to a local buffer file and retried until the brokers accept
+// them, giving at-least-once delivery for events that reached the sink.
+type KafkaSink struct {
+	writer     *kafka.Writer
+	bufferPath string
+	metrics    *Metrics
+
+	queue chan kafka.Message
+	done  chan struct{} // closed once writeLoop has flushed the queue
+	wg    sync.WaitGroup
+
+	// mu serializes access to the buffer file
+	mu sync.Mutex
+
+	// closeMu guards queue against sends after Close
+	closeMu sync.RWMutex
+	closed  bool
+}
+
+// newKafkaSink creates a sink for the given comma-separated broker list
+func newKafkaSink(brokers, topic, bufferPath string, metrics *Metrics) *KafkaSink {
+	k := &KafkaSink{
+		writer: &kafka.Writer{
+			Addr:         kafka.TCP(strings.Split(brokers, ",")...),
+			Topic:        topic,
+			Balancer:     &kafka.Hash{},
+			RequiredAcks: kafka.RequireAll,
+			MaxAttempts:  3,
+			// Batching happens in writeLoop, don't wait again in the writer
+			BatchSize:    kafkaBatchSize,
+			BatchTimeout: time.Millisecond,
+			WriteTimeout: kafkaWriteTimeout,
+		},
+		bufferPath: bufferPath,
+		metrics:    metrics,
+		queue:      make(chan kafka.Message, kafkaQueueSize),
+		done:       make(chan struct{}),
+	}
+
+	k.wg.Add(2)
+	go k.writeLoop()
+	go k.drainLoop()
+	return k
+}
+
+// Publish queues an event without blocking. If the queue is full the event
+// goes straight to the disk buffer.
+func (k *KafkaSink) Publish(productID string, event map[string]interface{}) {
+	value, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Failed to marshal kafka event: %v", err)
+		return
+	}
+
+	msg := kafka.Message{Key: []byte(productID), Value: value}
+
+	k.closeMu.RLock()
+	defer k.closeMu.RUnlock()
+
+	if k.closed {
+		k.spill([]kafka.Message{msg})
+		return
+	}
+
+	select {
+	case k.queue <- msg:
+	default:
+		k.spill([]kafka.Message{msg})
+	}
+}
+
+// writeLoop sends queued events in batches
+func (k *KafkaSink) writeLoop() {
+	defer k.wg.Done()
+	defer close(k.done)
+
+	batch := make([]kafka.Message, 0, kafkaBatchSize)
+	timer := time.NewTimer(kafkaBatchTimeout)
+	defer timer.Stop()
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := k.write(batch); err != nil {
+			log.Printf("Kafka write failed, buffering %d events: %v", len(batch), err)
+			k.spill(batch)
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case msg, ok := <-k.queue:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, msg)
+			if len(batch) >= kafkaBatchSize {
+				flush()
+			}
+		case <-timer.C:
+			flush()
+			timer.Reset(kafkaBatchTimeout)
+		}
+	}
+}
+
+func (k *KafkaSink) write(msgs []kafka.Message) error {
+	ctx, cancel := context.WithTimeout(context.Background(), kafkaWriteTimeout)
+	defer cancel()
+
+	if err := k.writer.WriteMessages(ctx, msgs...); err != nil {
+		k.metrics.kafkaFailures.Add(float64(len(msgs)))
+		return err
+	}
+	k.metrics.kafkaPublished.Add(float64(len(msgs)))
+	return nil
+}
+
+// spill appends messages to the buffer file for later delivery
+func (k *KafkaSink) spill(msgs []kafka.Message) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	f, err := os.OpenFile(k.bufferPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		log.Printf("ERROR: kafka buffer unavailable, dropping %d events: %v", len(msgs), err)
+		k.metrics.kafkaDropped.Add(float64(len(msgs)))
+		return
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	for _, msg := range msgs {
+		line, _ := json.Marshal(bufferedMessage{Key: string(msg.Key), Value: msg.Value})
+		w.Write(append(line, '\n'))
+	}
+	if err := w.Flush(); err != nil {
+		log.Printf("ERROR: kafka buffer write failed, dropping %d events: %v", len(msgs), err)
+		k.metrics.kafkaDropped.Add(float64(len(msgs)))
+		return
+	}
+	f.Sync()
+	k.metrics.kafkaBuffered.Add(float64(len(msgs)))
+}
+
+// bufferedMessage is one line of the buffer file
+type bufferedMessage struct {
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value"`
+}
+
+// drainLoop periodically retries buffered events
+func (k *KafkaSink) drainLoop() {
+	defer k.wg.Done()
+
+	ticker := time.NewTicker(kafkaDrainInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-k.done:
+			// One last attempt so a clean shutdown leaves nothing behind
+			if err := k.drain(); err != nil {
+				log.Printf("Kafka buffer drain failed: %v", err)
+			}
+			return
+		case <-ticker.C:
+			if err := k.drain(); err != nil {
+				log.Printf("Kafka buffer drain failed: %v", err)
+			}
+		}
+	}
+}
+
+// drain sends the buffer file to Kafka and truncates it on success
+func (k *KafkaSink) drain() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	msgs, err := readKafkaBuffer(k.bufferPath)
+	if err != nil || len(msgs) == 0 {
+		return err
+	}
+
+	for start := 0; start < len(msgs); start += kafkaBatchSize {
+		end := min(start+kafkaBatchSize, len(msgs))
+		if err := k.write(msgs[start:end]); err != nil {
+			// Keep what is left for the next attempt
+			return rewriteKafkaBuffer(k.bufferPath, msgs[start:])
+		}
+	}
+
+	log.Printf("Kafka buffer drained (%d events)", len(msgs))
+	return os.Remove(k.bufferPath)
+}
+
+// Close flushes queued events and stops the sink. Events still buffered
+// on disk are delivered on the next start.
+func (k *KafkaSink) Close() error {
+	k.closeMu.Lock()
+	k.closed = true
+	close(k.queue)
+	k.closeMu.Unlock()
+
+	k.wg.Wait()
+	return k.writer.Close()
+}
+
+func readKafkaBuffer(path string) ([]kafka.Message, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to open kafka buffer: %w", err)
+	}
+	defer f.Close()
+
+	var msgs []kafka.Message
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var bm bufferedMessage
+		if err := json.Unmarshal(scanner.Bytes(), &bm); err != nil {
+			log.Printf("Skipping corrupt kafka buffer entry: %v", err)
+			continue
+		}
+		msgs = append(msgs, kafka.Message{Key: []byte(bm.Key), Value: bm.Value})
+	}
+	return msgs, scanner.Err()
+}
+
+func rewriteKafkaBuffer(path string, msgs []kafka.Message) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to rewrite kafka buffer: %w", err)
+	}
+
+	w := bufio.NewWriter(f)
+	for _, msg := range msgs {
+		line, _ := json.Marshal(bufferedMessage{Key: string(msg.Key), Value: msg.Value})
+		w.Write(append(line, '\n'))
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to rewrite kafka buffer: %w", err)
+	}
+	f.Sync()
+	f.Close()
+
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	pingProbeInterval = 5 * time.Second
+	slowLogBatchSize  = 128
+)
+
+// probeLoop periodically PINGs Redis so EvalSha latency can be compared
+// against a baseline that contains only the network round trip
+func (s *Server) probeLoop() {
+	defer s.wg.Done()
+
+	ctx := withCommandTags(s.ctx, "none", "ping_probe")
+	ticker := time.NewTicker(pingProbeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		start := time.Now()
+		if err := s.redis.Ping(ctx).Err(); err != nil {
+			log.Printf("Redis ping failed: %v", err)
+			continue
+		}
+		s.metrics.redisPingRTT.Observe(time.Since(start).Seconds())
+	}
+}
+
+// slowLogLoop polls the Redis SLOWLOG for purchase script executions
+func (s *Server) slowLogLoop(interval time.Duration) {
+	defer s.wg.Done()
+
+	ctx := withCommandTags(s.ctx, "none", "slowlog_poll")
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	lastID := int64(-1)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		entries, err := s.redis.SlowLogGet(ctx, slowLogBatchSize).Result()
+		if err != nil {
+			log.Printf("Failed to read slowlog: %v", err)
+			continue
+		}
+
+		lastID = slowLogCursor(entries, lastID)
+		for _, entry := range correlateSlowLog(entries, s.luaHash, lastID) {
+			s.metrics.slowScripts.Inc()
+			s.metrics.scriptExecDuration.Observe(entry.Duration.Seconds())
+			log.Printf("Slow purchase script: slowlog_id=%d exec=%v at=%s client=%s",
+				entry.ID, entry.Duration, entry.Time.Format(time.RFC3339), entry.ClientAddr)
+		}
+
+		if len(entries) > 0 {
+			lastID = entries[0].ID
+		}
+	}
+}
+
+// slowLogCursor is the ID entries are new after. SLOWLOG IDs start over
+// when Redis restarts or fails over to a replica, so a newest entry below
+// lastID means every entry is new.
+func slowLogCursor(entries []redis.SlowLog, lastID int64) int64 {
+	if len(entries) > 0 && entries[0].ID < lastID {
+		return -1
+	}
+	return lastID
+}
+
+// correlateSlowLog returns the slowlog entries newer than lastID that are
+// executions of the script with the given SHA, oldest first. Redis returns
+// entries newest first, so the result is reversed.
+func correlateSlowLog(entries []redis.SlowLog, sha string, lastID int64) []redis.SlowLog {
+	var matched []redis.SlowLog
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		if entry.ID <= lastID || len(entry.Args) < 2 {
+			continue
+		}
+		if strings.EqualFold(entry.Args[0], "evalsha") && strings.EqualFold(entry.Args[1], sha) {
+			matched = append(matched, entry)
+		}
+	}
+	return matched
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// slowLog is a SLOWLOG GET answer holding executions of sha with the
+// given IDs, newest first as Redis returns them
+func slowLog(sha string, ids ...int64) []redis.SlowLog {
+	entries := make([]redis.SlowLog, len(ids))
+	for i, id := range ids {
+		entries[i] = redis.SlowLog{ID: id, Args: []string{"evalsha", sha, "15"}}
+	}
+	return entries
+}
+
+func TestSlowLogRestart(t *testing.T) {
+	const sha = "abc"
+	lastID := int64(-1)
+	poll := func(entries []redis.SlowLog) int {
+		lastID = slowLogCursor(entries, lastID)
+		n := len(correlateSlowLog(entries, sha, lastID))
+		if len(entries) > 0 {
+			lastID = entries[0].ID
+		}
+		return n
+	}
+
+	if n := poll(slowLog(sha, 41, 40)); n != 2 {
+		t.Fatalf("first poll: %d new entries, want 2", n)
+	}
+	if n := poll(slowLog(sha, 42, 41, 40)); n != 1 {
+		t.Fatalf("second poll: %d new entries, want 1", n)
+	}
+	// Redis restarted and numbers its slowlog from 0 again
+	if n := poll(slowLog(sha, 1, 0)); n != 2 {
+		t.Fatalf("poll after a restart: %d new entries, want 2", n)
+	}
+	if n := poll(slowLog(sha, 2, 1, 0)); n != 1 {
+		t.Fatalf("poll after the restart: %d new entries, want 1", n)
+	}
+}
@@ -0,0 +1,701 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics holds the Prometheus collectors exported by the server
+type Metrics struct {
+	registry *prometheus.Registry
+	// productLabels caps the product label values, nil when uncapped
+	productLabels *labelCap
+
+	// Client-observed EvalSha latency (network RTT + Redis execution)
+	evalShaDuration prometheus.Histogram
+	// Purchases sent together in one pipeline with PURCHASE_BATCH_WINDOW
+	purchaseBatchSize prometheus.Histogram
+	// Redis-side script execution time, taken from SLOWLOG entries
+	scriptExecDuration prometheus.Histogram
+	slowScripts        prometheus.Counter
+	// Lua scripts found missing from Redis at the last script check, and
+	// reloads done by the checks
+	scriptsMissing     *prometheus.GaugeVec
+	scriptNodesMissing prometheus.Gauge
+	scriptReloads      prometheus.Counter
+	// Baseline round trip to Redis measured with PING
+	redisPingRTT prometheus.Histogram
+
+	// Per-command instrumentation recorded by redisHook
+	redisCommandDuration *prometheus.HistogramVec
+	redisErrors          *prometheus.CounterVec
+	redisTimeouts        *prometheus.CounterVec
+	redisRetries         *prometheus.CounterVec
+
+	// Provisional purchases granted and reconciled in overdraft mode
+	overdraftGrants    prometheus.Counter
+	overdraftConfirmed prometheus.Counter
+	overdraftCancelled prometheus.Counter
+
+	// Events that could not be appended to the durable stream
+	eventStreamFailures prometheus.Counter
+
+	// Kafka sink delivery
+	kafkaPublished prometheus.Counter
+	kafkaFailures  prometheus.Counter
+	kafkaBuffered  prometheus.Counter
+	kafkaDropped   prometheus.Counter
+
+	// Webhook delivery, by endpoint host
+	webhookDelivered    *prometheus.CounterVec
+	webhookFailures     *prometheus.CounterVec
+	webhookDeadLettered *prometheus.CounterVec
+
+	// Events that did not match the registered schema, by event type
+	eventSchemaMismatches *prometheus.CounterVec
+
+	// Outcomes of PENDING orders in payment hold mode
+	ordersConfirmed prometheus.Counter
+	ordersExpired   prometheus.Counter
+	// Expired orders the stale order sweep found missing from the pending
+	// index
+	ordersUnindexed prometheus.Counter
+	// Sales closed by this server once they ended
+	salesClosed prometheus.Counter
+	// Purchases cancelled by their buyer through MSG_CANCEL_PURCHASE
+	purchasesCancelled prometheus.Counter
+	// Units held through MSG_RESERVE, and reservations released through
+	// MSG_RELEASE; commits count as confirmed orders
+	reservationsMade     prometheus.Counter
+	reservationsReleased prometheus.Counter
+	// Sold out attempts answered with a waitlist position, and freed units
+	// granted to waitlisted users
+	purchasesWaitlisted prometheus.Counter
+	waitlistGrants      prometheus.Counter
+	// Attempts answered SOLD_OUT from the sold out cache
+	soldOutCacheHits prometheus.Counter
+	// Purchases answered from the response saved for their idempotency key
+	purchasesReplayed prometheus.Counter
+
+	// MSG_EVENT frames queued for connections, and those dropped because
+	// the connection fell behind
+	eventsPushed  prometheus.Counter
+	eventsDropped prometheus.Counter
+
+	// Frames rejected because their CRC trailer did not match
+	frameChecksumErrors prometheus.Counter
+
+	// 1 while this server holds the cluster leader lease
+	clusterLeader prometheus.Gauge
+	// 1 while the server is read only, and the writes it refused meanwhile
+	readOnly         prometheus.Gauge
+	readOnlyRejected prometheus.Counter
+	// Circuit breaker state, how often it opened, and the attempts it
+	// answered without Redis, by answer
+	breakerOpen     prometheus.Gauge
+	breakerTrips    prometheus.Counter
+	breakerRejected *prometheus.CounterVec
+
+	// Latest scaling hint sample, see scaling.go
+	scalingLoad        prometheus.Gauge
+	scalingAttemptRate prometheus.Gauge
+	scalingShedRatio   prometheus.Gauge
+	scalingQueueDepth  prometheus.Gauge
+	scalingHint        prometheus.Gauge
+
+	// Purchase attempts shed under load, and let through, by tier; see shed.go
+	loadShed         *prometheus.CounterVec
+	loadShedAdmitted *prometheus.CounterVec
+	loadShedInflight prometheus.Gauge
+
+	// Open client connections, and connections turned away on accept
+	connectionsOpen     prometheus.Gauge
+	connectionsRejected *prometheus.CounterVec
+	// QUIC connections accepted, each carrying one or more streams
+	quicConnections prometheus.Counter
+	// Client connections parked on CONN_EPOLL's epoll instance
+	connectionsParked prometheus.Gauge
+	// Time frames waited for a FRAME_WORKERS worker
+	frameWait prometheus.Histogram
+	// Purchase attempts answered busy for FRAME_QUEUE_LIMIT
+	frameQueueRejected prometheus.Counter
+	// Connections closed without a reply in CONNECT_MODE=silent
+	connectionsSilenced prometheus.Counter
+	// Purchase, bundle and reservation attempts of each tenant, those over
+	// TENANT_RATE_LIMIT, and MSG_HELLO frames naming no tenant of ours
+	tenantAttempts    *prometheus.CounterVec
+	tenantRateLimited *prometheus.CounterVec
+	tenantRejected    prometheus.Counter
+	// Open connections closed by the server for stalling, by reason
+	connectionsClosed *prometheus.CounterVec
+	// MSG_GOAWAY frames sent, by reason
+	goAwaySent *prometheus.CounterVec
+	// Purchases rejected because their auth_token was missing or invalid
+	purchasesUnauthorized prometheus.Counter
+	// MSG_AUTH frames, by result
+	sessionAuths *prometheus.CounterVec
+	// Purchase and bundle attempts of blocked users and agents
+	purchasesBlocked prometheus.Counter
+	// Proof of work challenges issued, and purchases rejected for a
+	// missing, expired or wrong solution
+	powChallenges prometheus.Counter
+	powRejected   prometheus.Counter
+	// Purchase attempts over the per-user rate limit
+	purchasesRateLimited prometheus.Counter
+	// Users flagged for attempting faster than SPEED_FLOOR, and the
+	// attempts of flagged users rate limited or challenged for it
+	speedFlagged prometheus.Counter
+	speedActions *prometheus.CounterVec
+	// Verifier verdicts by result, and attempts answered from the cache
+	purchaseVerifications *prometheus.CounterVec
+	verifyCacheHits       prometheus.Counter
+	// Purchases of flagged users held for review, and reviews by decision
+	ordersHeld   prometheus.Counter
+	orderReviews *prometheus.CounterVec
+	// Orders marked FULFILLED through /admin/orders
+	ordersFulfilled prometheus.Counter
+	// Purchase attempts made by agents on behalf of users
+	agentPurchases prometheus.Counter
+	// Bundle purchase attempts by result
+	bundlePurchases *prometheus.CounterVec
+	// Purchase attempts queued on queue mode products, and queued tickets
+	// granted by this server's dispatcher by result
+	purchasesQueued prometheus.Counter
+	queueDispatched *prometheus.CounterVec
+
+	buildInfo *prometheus.GaugeVec
+}
+
+// latencyBuckets covers 50µs to ~1.6s, which spans a healthy local Redis
+// through a badly degraded one
+var latencyBuckets = prometheus.ExponentialBuckets(0.00005, 2, 16)
+
+// newMetrics creates and registers all server collectors, their names
+// prefixed with namespace
+func newMetrics(namespace string) *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		evalShaDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "evalsha_duration_seconds",
+			Help:      "Client-observed latency of purchase script EVALSHA calls, including network round trip.",
+			Buckets:   latencyBuckets,
+		}),
+		purchaseBatchSize: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "purchase_batch_size",
+			Help:      "Purchase scripts sent to Redis in one pipeline when PURCHASE_BATCH_WINDOW is set.",
+			Buckets:   prometheus.ExponentialBuckets(1, 2, 8),
+		}),
+		scriptExecDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "lua_script_exec_seconds",
+			Help:      "Redis-side execution time of the purchase script, as reported by SLOWLOG.",
+			Buckets:   latencyBuckets,
+		}),
+		scriptsMissing: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "lua_scripts_missing",
+			Help:      "Lua scripts each Redis node was missing at the last SCRIPT_CHECK_INTERVAL check.",
+		}, []string{"node"}),
+		scriptNodesMissing: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "lua_script_nodes_out_of_sync",
+			Help:      "Redis nodes missing Lua scripts at the last SCRIPT_CHECK_INTERVAL check.",
+		}),
+		scriptReloads: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "lua_script_reloads_total",
+			Help:      "Lua scripts loaded again after Redis lost them.",
+		}),
+		slowScripts: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "lua_slowlog_entries_total",
+			Help:      "Number of purchase script executions that appeared in the Redis SLOWLOG.",
+		}),
+		redisPingRTT: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "redis_ping_rtt_seconds",
+			Help:      "Round trip time of PING probes to Redis, used as the network baseline.",
+			Buckets:   latencyBuckets,
+		}),
+		redisCommandDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "redis_command_duration_seconds",
+			Help:      "Latency of Redis commands including retries, by command, operation and product.",
+			Buckets:   latencyBuckets,
+		}, []string{"command", "operation", "product"}),
+		redisErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "redis_command_errors_total",
+			Help:      "Redis commands that failed after retries, by command and operation.",
+		}, []string{"command", "operation"}),
+		redisTimeouts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "redis_command_timeouts_total",
+			Help:      "Redis commands that failed with a timeout, by command and operation.",
+		}, []string{"command", "operation"}),
+		redisRetries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "redis_command_retries_total",
+			Help:      "Retry attempts made for Redis commands, by command.",
+		}, []string{"command"}),
+		overdraftGrants: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "overdraft_grants_total",
+			Help:      "Provisional purchases granted from local overdraft while Redis was degraded.",
+		}),
+		overdraftConfirmed: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "overdraft_confirmed_total",
+			Help:      "Provisional purchases that fit in real stock during reconciliation.",
+		}),
+		overdraftCancelled: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "overdraft_cancelled_total",
+			Help:      "Provisional purchases cancelled during reconciliation because stock ran out.",
+		}),
+		eventStreamFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "event_stream_failures_total",
+			Help:      "Events that could not be appended to the flashsale:events stream.",
+		}),
+		kafkaPublished: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "kafka_events_published_total",
+			Help:      "Events acknowledged by the Kafka brokers.",
+		}),
+		kafkaFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "kafka_events_failed_total",
+			Help:      "Event writes to Kafka that failed and will be retried.",
+		}),
+		kafkaBuffered: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "kafka_events_buffered_total",
+			Help:      "Events spilled to the local disk buffer during a broker outage.",
+		}),
+		kafkaDropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "kafka_events_dropped_total",
+			Help:      "Events lost because neither Kafka nor the disk buffer accepted them.",
+		}),
+		webhookDelivered: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "webhook_deliveries_total",
+			Help:      "Webhook POSTs acknowledged with a 2xx response.",
+		}, []string{"endpoint"}),
+		webhookFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "webhook_attempt_failures_total",
+			Help:      "Webhook delivery attempts that failed, including ones later retried.",
+		}, []string{"endpoint"}),
+		webhookDeadLettered: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "webhook_dead_lettered_total",
+			Help:      "Webhook events moved to the dead-letter list after exhausting retries.",
+		}, []string{"endpoint"}),
+		eventSchemaMismatches: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "event_schema_mismatches_total",
+			Help:      "Events that did not match the registered schema, held back from the sinks with EVENT_SCHEMA_MODE=enforce.",
+		}, []string{"type"}),
+		ordersConfirmed: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "orders_confirmed_total",
+			Help:      "PENDING orders confirmed through MSG_CONFIRM_PAYMENT.",
+		}),
+		ordersExpired: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "orders_expired_total",
+			Help:      "PENDING orders expired by the reaper or the stale order sweep, their stock restored.",
+		}),
+		ordersUnindexed: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "orders_unindexed_total",
+			Help:      "Expired orders the stale order sweep found missing from the pending index.",
+		}),
+		salesClosed: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "sales_closed_total",
+			Help:      "Sales this server closed once they ended, freezing their stock.",
+		}),
+		purchasesCancelled: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "purchases_cancelled_total",
+			Help:      "Purchases cancelled by the buyer, their stock restored.",
+		}),
+		reservationsMade: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "reservations_made_total",
+			Help:      "Units held for an external checkout through MSG_RESERVE.",
+		}),
+		reservationsReleased: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "reservations_released_total",
+			Help:      "Reservations released through MSG_RELEASE, their stock restored.",
+		}),
+		purchasesWaitlisted: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "purchases_waitlisted_total",
+			Help:      "Sold out purchase attempts answered with a waitlist position.",
+		}),
+		purchasesReplayed: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "purchases_replayed_total",
+			Help:      "Purchase attempts repeating an idempotency key, answered without buying again.",
+		}),
+		eventsPushed: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "events_pushed_total",
+			Help:      "EVENT frames pushed to connections that asked for events.",
+		}),
+		eventsDropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "events_dropped_total",
+			Help:      "EVENT frames dropped because their connection had too many waiting.",
+		}),
+		soldOutCacheHits: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "sold_out_cache_hits_total",
+			Help:      "Purchase attempts answered SOLD_OUT from the local sold out cache, without Redis.",
+		}),
+		waitlistGrants: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "waitlist_grants_total",
+			Help:      "Units freed by expired or cancelled orders and granted to the next waitlisted user.",
+		}),
+		frameChecksumErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "frame_checksum_errors_total",
+			Help:      "Frames with a bad CRC trailer; each one resets its connection.",
+		}),
+		purchasesUnauthorized: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "purchases_unauthorized_total",
+			Help:      "Purchase attempts rejected for a missing, invalid or mismatched auth_token.",
+		}),
+		sessionAuths: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "session_auths_total",
+			Help:      "MSG_AUTH frames binding a connection to a user, by result: ok or rejected.",
+		}, []string{"result"}),
+		purchasesBlocked: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "purchases_blocked_total",
+			Help:      "Purchase and bundle attempts rejected because the user or agent is on the blocklist.",
+		}),
+		powChallenges: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "pow_challenges_issued_total",
+			Help:      "Proof of work challenges handed out through MSG_CHALLENGE.",
+		}),
+		powRejected: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "pow_rejected_total",
+			Help:      "Purchase attempts rejected for a missing, expired or invalid proof of work.",
+		}),
+		purchasesRateLimited: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "purchases_rate_limited_total",
+			Help:      "Purchase attempts rejected because the user exceeded USER_RATE_LIMIT.",
+		}),
+		speedFlagged: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "speed_flagged_total",
+			Help:      "Users flagged for SPEED_STREAK purchase attempts in a row under SPEED_FLOOR apart.",
+		}),
+		speedActions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "speed_actions_total",
+			Help:      "Purchase attempts of flagged users rate limited or challenged, by action.",
+		}, []string{"action"}),
+		purchaseVerifications: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "purchase_verifications_total",
+			Help:      "Purchase and bundle attempts checked by the verifier, by result: passed, failed or error.",
+		}, []string{"result"}),
+		verifyCacheHits: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "verify_cache_hits_total",
+			Help:      "Purchase and bundle attempts judged by a verdict cached for VERIFY_CACHE_TTL.",
+		}),
+		ordersHeld: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "orders_held_total",
+			Help:      "Purchases of flagged users held for manual review with SPEED_HOLD.",
+		}),
+		orderReviews: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "order_reviews_total",
+			Help:      "Held orders reviewed through /admin/holds, by decision: approved or rejected.",
+		}, []string{"decision"}),
+		ordersFulfilled: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "orders_fulfilled_total",
+			Help:      "Confirmed orders marked fulfilled through /admin/orders.",
+		}),
+		agentPurchases: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "agent_purchase_attempts_total",
+			Help:      "Purchase attempts made by authenticated agents on behalf of users.",
+		}),
+		bundlePurchases: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "bundle_purchases_total",
+			Help:      "Bundle purchase attempts by result: success, sold_out, paused, limit_reached, not_on_sale, ended, not_eligible or error.",
+		}, []string{"result"}),
+		purchasesQueued: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "purchases_queued_total",
+			Help:      "Purchase attempts queued on products in queue mode.",
+		}),
+		queueDispatched: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "queue_dispatched_total",
+			Help:      "Queued purchase attempts granted by this server's dispatcher, by result.",
+		}, []string{"result"}),
+		scalingLoad: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "scaling_load_ratio",
+			Help:      "Share of SCALING_CAPACITY in use: the larger of the attempt rate and queue backlog shares.",
+		}),
+		scalingAttemptRate: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "scaling_attempt_rate",
+			Help:      "Purchase attempts per second over the last scaling interval.",
+		}),
+		scalingShedRatio: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "scaling_shed_ratio",
+			Help:      "Share of purchase attempts rejected by rate limits or load shedding over the last scaling interval.",
+		}),
+		scalingQueueDepth: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "scaling_queue_depth",
+			Help:      "Queued purchase tickets waiting across all queue mode products.",
+		}),
+		scalingHint: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "scaling_hint",
+			Help:      "1 while the load is at or over SCALING_THRESHOLD, 0 otherwise.",
+		}),
+		loadShed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "load_shed_total",
+			Help:      "Purchase attempts shed because too many were waiting on Redis, by product and tier.",
+		}, []string{"product", "tier"}),
+		loadShedAdmitted: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "load_shed_admitted_total",
+			Help:      "Purchase attempts let through by load shedding, by tier.",
+		}, []string{"tier"}),
+		loadShedInflight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "load_shed_inflight",
+			Help:      "Purchase attempts let through by load shedding and still running.",
+		}),
+		connectionsOpen: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "connections_open",
+			Help:      "Client connections currently open.",
+		}),
+		frameWait: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "frame_wait_seconds",
+			Help:      "Time frames waited for one of the FRAME_WORKERS workers.",
+			Buckets:   latencyBuckets,
+		}),
+		frameQueueRejected: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "frame_queue_rejected_total",
+			Help:      "Purchase, bundle and reservation frames answered busy because FRAME_QUEUE_LIMIT frames were waiting for a worker.",
+		}),
+		tenantAttempts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "tenant_attempts_total",
+			Help:      "Purchase, bundle and reservation attempts, by tenant.",
+		}, []string{"tenant"}),
+		tenantRateLimited: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "tenant_rate_limited_total",
+			Help:      "Attempts answered RATE_LIMITED for TENANT_RATE_LIMIT, by tenant.",
+		}, []string{"tenant"}),
+		tenantRejected: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "tenant_rejected_total",
+			Help:      "HELLO frames refused for an unknown tenant or an invalid tenant token.",
+		}),
+		quicConnections: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "quic_connections_total",
+			Help:      "QUIC connections accepted on QUIC_ADDR; each of their streams is counted as a client connection.",
+		}),
+		connectionsParked: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "connections_parked",
+			Help:      "Client connections waiting for their next frame on the CONN_EPOLL epoll instance, without a goroutine.",
+		}),
+		connectionsRejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "connections_rejected_total",
+			Help:      "Client connections closed on accept, by reason: draining, max_connections or blocked.",
+		}, []string{"reason"}),
+		connectionsClosed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "connections_closed_total",
+			Help:      "Open client connections closed by the server, by reason: write_timeout, idle, goaway_deadline or blocked.",
+		}, []string{"reason"}),
+		goAwaySent: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "goaway_sent_total",
+			Help:      "GOAWAY frames sent to clients, by reason: draining or shutdown.",
+		}, []string{"reason"}),
+		connectionsSilenced: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "connections_silenced_total",
+			Help:      "Connections closed without a reply because their first frame was not a valid HELLO, in silent mode.",
+		}),
+		clusterLeader: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "cluster_leader",
+			Help:      "1 while this server is the cluster leader and runs the fleet-wide background jobs.",
+		}),
+		readOnly: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "read_only",
+			Help:      "1 while the server refuses purchases because Redis refused writes or an operator said so.",
+		}),
+		readOnlyRejected: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "read_only_rejected_total",
+			Help:      "Purchases, bundles, payment confirmations and cancellations answered READ_ONLY.",
+		}),
+		breakerOpen: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "breaker_open",
+			Help:      "1 while the circuit breaker keeps purchase scripts from a failing Redis.",
+		}),
+		breakerTrips: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "breaker_trips_total",
+			Help:      "Times the circuit breaker opened on the Redis error rate of purchase attempts.",
+		}),
+		breakerRejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "breaker_rejected_total",
+			Help:      "Purchase and bundle attempts answered without Redis while the circuit breaker was open, by answer: busy, error, sold_out or overdraft.",
+		}, []string{"answer"}),
+		buildInfo: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "build_info",
+			Help:      "Always 1, labelled with the server build.",
+		}, []string{"version", "commit", "go_version"}),
+	}
+
+	m.registry.MustRegister(
+		m.evalShaDuration,
+		m.purchaseBatchSize,
+		m.scriptExecDuration,
+		m.slowScripts,
+		m.scriptsMissing,
+		m.scriptNodesMissing,
+		m.scriptReloads,
+		m.redisPingRTT,
+		m.redisCommandDuration,
+		m.redisErrors,
+		m.redisTimeouts,
+		m.redisRetries,
+		m.overdraftGrants,
+		m.overdraftConfirmed,
+		m.overdraftCancelled,
+		m.eventStreamFailures,
+		m.kafkaPublished,
+		m.kafkaFailures,
+		m.kafkaBuffered,
+		m.kafkaDropped,
+		m.webhookDelivered,
+		m.webhookFailures,
+		m.webhookDeadLettered,
+		m.eventSchemaMismatches,
+		m.ordersConfirmed,
+		m.ordersExpired,
+		m.ordersUnindexed,
+		m.salesClosed,
+		m.purchasesCancelled,
+		m.reservationsMade,
+		m.reservationsReleased,
+		m.purchasesWaitlisted,
+		m.soldOutCacheHits,
+		m.purchasesReplayed,
+		m.eventsPushed,
+		m.eventsDropped,
+		m.waitlistGrants,
+		m.frameChecksumErrors,
+		m.clusterLeader,
+		m.readOnly,
+		m.readOnlyRejected,
+		m.breakerOpen,
+		m.breakerTrips,
+		m.breakerRejected,
+		m.scalingLoad,
+		m.scalingAttemptRate,
+		m.scalingShedRatio,
+		m.scalingQueueDepth,
+		m.scalingHint,
+		m.loadShed,
+		m.loadShedAdmitted,
+		m.loadShedInflight,
+		m.connectionsOpen,
+		m.quicConnections,
+		m.connectionsParked,
+		m.frameWait,
+		m.frameQueueRejected,
+		m.tenantAttempts,
+		m.tenantRateLimited,
+		m.tenantRejected,
+		m.connectionsRejected,
+		m.connectionsSilenced,
+		m.connectionsClosed,
+		m.goAwaySent,
+		m.purchasesUnauthorized,
+		m.sessionAuths,
+		m.purchasesBlocked,
+		m.powChallenges,
+		m.powRejected,
+		m.purchasesRateLimited,
+		m.speedFlagged,
+		m.speedActions,
+		m.purchaseVerifications,
+		m.verifyCacheHits,
+		m.ordersHeld,
+		m.orderReviews,
+		m.ordersFulfilled,
+		m.agentPurchases,
+		m.bundlePurchases,
+		m.purchasesQueued,
+		m.queueDispatched,
+		m.buildInfo,
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+
+	return m
+}
+
+// capProductLabels limits the product label to the limit busiest
+// products, see labelCap
+func (m *Metrics) capProductLabels(limit int) {
+	m.productLabels = newLabelCap(limit, []string{"none"}, func(product string) {
+		m.redisCommandDuration.DeletePartialMatch(prometheus.Labels{"product": product})
+		m.loadShed.DeletePartialMatch(prometheus.Labels{"product": product})
+	})
+}
+
+// Handler returns the HTTP handler serving the metrics endpoint
+func (m *Metrics) Handler() http.Handler {
+	// Exemplars are only served to scrapers asking for OpenMetrics
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{EnableOpenMetrics: true})
+}
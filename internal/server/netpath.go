@@ -0,0 +1,13 @@
+package server
+
+import "net"
+
+// connPath moves accepted connections onto the network path the server was
+// built with: the Go netpoller by default, io_uring with -tags iouring
+type connPath interface {
+	Name() string
+	// Wrap takes ownership of conn and returns the connection to serve
+	Wrap(conn net.Conn) (net.Conn, error)
+	// Close releases the path once every wrapped connection is closed
+	Close() error
+}
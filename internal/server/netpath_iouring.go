@@ -0,0 +1,482 @@
+//go:build linux && iouring
+
+package server
+
+// Experimental io_uring network path. Reads and writes of every connection
+// are submitted to one shared ring instead of going through the netpoller,
+// which trades a syscall per I/O for a syscall per submission batch once
+// the kernel is busy. Build with `go build -tags iouring ./cmd/server` and
+// compare against the default build with cmd/client, or BenchmarkConnPath
+// run with and without the tag.
+//
+// Limitations: a deadline only applies to I/O started after it was set,
+// and every Write is submitted on its own (no batching across frames yet).
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	uringEntries = 4096
+
+	uringOpNop         = 0
+	uringOpAsyncCancel = 14
+	uringOpSend        = 26
+	uringOpRecv        = 27
+
+	uringEnterGetEvents = 1
+
+	uringOffSQRing = 0
+	uringOffCQRing = 0x8000000
+	uringOffSQEs   = 0x10000000
+
+	// uringStop is the user_data of the NOP that ends the completion loop
+	uringStop = math.MaxUint64
+)
+
+// Kernel ABI structs, see include/uapi/linux/io_uring.h
+type uringSQOffsets struct {
+	head, tail, ringMask, ringEntries, flags, dropped, array, resv1 uint32
+	userAddr                                                        uint64
+}
+
+type uringCQOffsets struct {
+	head, tail, ringMask, ringEntries, overflow, cqes, flags, resv1 uint32
+	userAddr                                                        uint64
+}
+
+type uringParams struct {
+	sqEntries, cqEntries, flags, sqThreadCPU, sqThreadIdle, features, wqFd uint32
+	resv                                                                   [3]uint32
+	sqOff                                                                  uringSQOffsets
+	cqOff                                                                  uringCQOffsets
+}
+
+type uringSQE struct {
+	opcode      uint8
+	flags       uint8
+	ioprio      uint16
+	fd          int32
+	off         uint64
+	addr        uint64
+	len         uint32
+	opFlags     uint32
+	userData    uint64
+	bufIndex    uint16
+	personality uint16
+	spliceFdIn  int32
+	addr3       uint64
+	pad         uint64
+}
+
+type uringCQE struct {
+	userData uint64
+	res      int32
+	flags    uint32
+}
+
+// uring is one io_uring instance. Submissions are serialized by submitMu;
+// a single goroutine reaps completions and hands each result to the
+// goroutine waiting for it.
+type uring struct {
+	fd                      int
+	sqRing, cqRing, sqesMem []byte
+
+	sqHead, sqTail *uint32
+	sqMask         uint32
+	sqArray        []uint32
+	sqes           []uringSQE
+
+	cqHead, cqTail *uint32
+	cqMask         uint32
+	cqes           []uringCQE
+
+	submitMu sync.Mutex
+	nextID   uint64
+
+	waitMu  sync.Mutex
+	waiters map[uint64]chan int32
+
+	done chan struct{}
+}
+
+func newURing(entries uint32) (*uring, error) {
+	var p uringParams
+	fd, _, errno := unix.Syscall(unix.SYS_IO_URING_SETUP, uintptr(entries), uintptr(unsafe.Pointer(&p)), 0)
+	if errno != 0 {
+		return nil, fmt.Errorf("io_uring_setup: %w", errno)
+	}
+
+	r := &uring{fd: int(fd), waiters: make(map[uint64]chan int32), done: make(chan struct{})}
+	fail := func(err error) (*uring, error) {
+		r.unmap()
+		unix.Close(r.fd)
+		return nil, err
+	}
+
+	var err error
+	r.sqRing, err = unix.Mmap(r.fd, uringOffSQRing, int(p.sqOff.array+p.sqEntries*4),
+		unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err != nil {
+		return fail(fmt.Errorf("mmap sq ring: %w", err))
+	}
+	r.cqRing, err = unix.Mmap(r.fd, uringOffCQRing, int(p.cqOff.cqes+p.cqEntries*uint32(unsafe.Sizeof(uringCQE{}))),
+		unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err != nil {
+		return fail(fmt.Errorf("mmap cq ring: %w", err))
+	}
+	r.sqesMem, err = unix.Mmap(r.fd, uringOffSQEs, int(p.sqEntries*uint32(unsafe.Sizeof(uringSQE{}))),
+		unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err != nil {
+		return fail(fmt.Errorf("mmap sqes: %w", err))
+	}
+
+	r.sqHead = (*uint32)(unsafe.Pointer(&r.sqRing[p.sqOff.head]))
+	r.sqTail = (*uint32)(unsafe.Pointer(&r.sqRing[p.sqOff.tail]))
+	r.sqMask = *(*uint32)(unsafe.Pointer(&r.sqRing[p.sqOff.ringMask]))
+	r.sqArray = unsafe.Slice((*uint32)(unsafe.Pointer(&r.sqRing[p.sqOff.array])), p.sqEntries)
+	r.sqes = unsafe.Slice((*uringSQE)(unsafe.Pointer(&r.sqesMem[0])), p.sqEntries)
+
+	r.cqHead = (*uint32)(unsafe.Pointer(&r.cqRing[p.cqOff.head]))
+	r.cqTail = (*uint32)(unsafe.Pointer(&r.cqRing[p.cqOff.tail]))
+	r.cqMask = *(*uint32)(unsafe.Pointer(&r.cqRing[p.cqOff.ringMask]))
+	r.cqes = unsafe.Slice((*uringCQE)(unsafe.Pointer(&r.cqRing[p.cqOff.cqes])), p.cqEntries)
+
+	go r.completionLoop()
+	return r, nil
+}
+
+func (r *uring) unmap() {
+	for _, m := range [][]byte{r.sqRing, r.cqRing, r.sqesMem} {
+		if m != nil {
+			unix.Munmap(m)
+		}
+	}
+}
+
+func (r *uring) enter(toSubmit, minComplete, flags uint32) (int, error) {
+	for {
+		n, _, errno := unix.Syscall6(unix.SYS_IO_URING_ENTER, uintptr(r.fd),
+			uintptr(toSubmit), uintptr(minComplete), uintptr(flags), 0, 0)
+		switch errno {
+		case 0:
+			return int(n), nil
+		case unix.EINTR:
+			continue
+		case unix.EAGAIN, unix.EBUSY:
+			// Completion queue is backed up; let the reaper catch up
+			time.Sleep(50 * time.Microsecond)
+			continue
+		default:
+			return 0, errno
+		}
+	}
+}
+
+// submit queues one SQE filled in by fill. With wait set, the returned
+// channel receives the completion's result.
+func (r *uring) submit(fill func(sqe *uringSQE), wait bool) (uint64, chan int32, error) {
+	r.submitMu.Lock()
+	defer r.submitMu.Unlock()
+
+	r.nextID++
+	id := r.nextID
+
+	var ch chan int32
+	if wait {
+		ch = make(chan int32, 1)
+		r.waitMu.Lock()
+		r.waiters[id] = ch
+		r.waitMu.Unlock()
+	}
+
+	// Every SQE is submitted right away, so the queue only fills if the
+	// kernel stops consuming it
+	tail := *r.sqTail
+	if tail-atomic.LoadUint32(r.sqHead) >= uint32(len(r.sqes)) {
+		r.forget(id)
+		return 0, nil, errors.New("io_uring submission queue full")
+	}
+
+	idx := tail & r.sqMask
+	sqe := &r.sqes[idx]
+	*sqe = uringSQE{}
+	fill(sqe)
+	if sqe.userData == 0 {
+		sqe.userData = id
+	}
+	r.sqArray[idx] = idx
+	atomic.StoreUint32(r.sqTail, tail+1)
+
+	if _, err := r.enter(1, 0, 0); err != nil {
+		r.forget(id)
+		return 0, nil, fmt.Errorf("io_uring_enter: %w", err)
+	}
+	return id, ch, nil
+}
+
+func (r *uring) forget(id uint64) {
+	r.waitMu.Lock()
+	delete(r.waiters, id)
+	r.waitMu.Unlock()
+}
+
+// cancel asks the kernel to abort the operation id; its waiter then gets
+// -ECANCELED, or the real result if it completed first
+func (r *uring) cancel(id uint64) {
+	r.submit(func(sqe *uringSQE) {
+		sqe.opcode = uringOpAsyncCancel
+		sqe.fd = -1
+		sqe.addr = id
+	}, false)
+}
+
+func (r *uring) completionLoop() {
+	defer close(r.done)
+
+	for {
+		if _, err := r.enter(0, 1, uringEnterGetEvents); err != nil {
+			log.Printf("io_uring completion loop stopped: %v", err)
+			return
+		}
+
+		head := *r.cqHead
+		tail := atomic.LoadUint32(r.cqTail)
+		stop := false
+		for ; head != tail; head++ {
+			cqe := r.cqes[head&r.cqMask]
+			if cqe.userData == uringStop {
+				stop = true
+				continue
+			}
+			r.waitMu.Lock()
+			ch := r.waiters[cqe.userData]
+			delete(r.waiters, cqe.userData)
+			r.waitMu.Unlock()
+			if ch != nil {
+				ch <- cqe.res
+			}
+		}
+		atomic.StoreUint32(r.cqHead, head)
+
+		if stop {
+			return
+		}
+	}
+}
+
+// Close stops the completion loop and releases the ring. Every connection
+// must be closed first.
+func (r *uring) Close() error {
+	if _, _, err := r.submit(func(sqe *uringSQE) {
+		sqe.opcode = uringOpNop
+		sqe.userData = uringStop
+	}, false); err != nil {
+		return err
+	}
+	<-r.done
+	r.unmap()
+	return unix.Close(r.fd)
+}
+
+// uringPath moves accepted TCP connections onto a shared ring
+type uringPath struct {
+	ring *uring
+}
+
+func newConnPath() (connPath, error) {
+	ring, err := newURing(uringEntries)
+	if err != nil {
+		return nil, err
+	}
+	return &uringPath{ring: ring}, nil
+}
+
+func (p *uringPath) Name() string { return "io_uring" }
+func (p *uringPath) Close() error { return p.ring.Close() }
+
+// Wrap duplicates the socket out of the netpoller and closes the original
+func (p *uringPath) Wrap(conn net.Conn) (net.Conn, error) {
+	defer conn.Close()
+
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil, fmt.Errorf("unsupported connection type %T", conn)
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	fd := -1
+	var dupErr error
+	if err := raw.Control(func(s uintptr) {
+		fd, dupErr = unix.FcntlInt(s, unix.F_DUPFD_CLOEXEC, 0)
+	}); err != nil {
+		return nil, err
+	}
+	if dupErr != nil {
+		return nil, fmt.Errorf("dup: %w", dupErr)
+	}
+
+	return &uringConn{
+		ring:     p.ring,
+		fd:       fd,
+		local:    conn.LocalAddr(),
+		remote:   conn.RemoteAddr(),
+		inflight: make(map[uint64]struct{}),
+	}, nil
+}
+
+// uringConn is a net.Conn whose reads and writes go through the ring
+type uringConn struct {
+	ring          *uring
+	fd            int
+	local, remote net.Addr
+
+	mu            sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+	closed        bool
+	inflight      map[uint64]struct{}
+}
+
+func (c *uringConn) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	n, err := c.do("read", b, uringOpRecv, 0)
+	if err == nil && n == 0 {
+		return 0, io.EOF
+	}
+	return n, err
+}
+
+func (c *uringConn) Write(b []byte) (int, error) {
+	var written int
+	for written < len(b) {
+		n, err := c.do("write", b[written:], uringOpSend, unix.MSG_NOSIGNAL)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// do runs one recv or send and waits for it, honouring the deadline set
+// when it started
+func (c *uringConn) do(op string, b []byte, opcode uint8, opFlags uint32) (int, error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return 0, c.opError(op, net.ErrClosed)
+	}
+	deadline := c.readDeadline
+	if opcode == uringOpSend {
+		deadline = c.writeDeadline
+	}
+	if !deadline.IsZero() && !time.Now().Before(deadline) {
+		c.mu.Unlock()
+		return 0, c.opError(op, os.ErrDeadlineExceeded)
+	}
+
+	id, done, err := c.ring.submit(func(sqe *uringSQE) {
+		sqe.opcode = opcode
+		sqe.fd = int32(c.fd)
+		sqe.addr = uint64(uintptr(unsafe.Pointer(&b[0])))
+		sqe.len = uint32(len(b))
+		sqe.opFlags = opFlags
+	}, true)
+	if err != nil {
+		c.mu.Unlock()
+		return 0, c.opError(op, err)
+	}
+	c.inflight[id] = struct{}{}
+	c.mu.Unlock()
+
+	var timer *time.Timer
+	if !deadline.IsZero() {
+		timer = time.AfterFunc(time.Until(deadline), func() { c.ring.cancel(id) })
+	}
+	res := <-done
+	if timer != nil {
+		timer.Stop()
+	}
+	// The kernel wrote into b until the completion arrived
+	runtime.KeepAlive(b)
+
+	c.mu.Lock()
+	delete(c.inflight, id)
+	closed := c.closed
+	c.mu.Unlock()
+
+	switch {
+	case res >= 0:
+		return int(res), nil
+	case syscall.Errno(-res) == unix.ECANCELED && closed:
+		return 0, c.opError(op, net.ErrClosed)
+	case syscall.Errno(-res) == unix.ECANCELED:
+		return 0, c.opError(op, os.ErrDeadlineExceeded)
+	default:
+		return 0, c.opError(op, os.NewSyscallError(op, syscall.Errno(-res)))
+	}
+}
+
+func (c *uringConn) opError(op string, err error) error {
+	return &net.OpError{Op: op, Net: c.local.Network(), Source: c.local, Addr: c.remote, Err: err}
+}
+
+// Close aborts pending I/O and closes the socket. The ring holds its own
+// reference to the file, so in-flight operations end with ECANCELED.
+func (c *uringConn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return c.opError("close", net.ErrClosed)
+	}
+	c.closed = true
+	for id := range c.inflight {
+		c.ring.cancel(id)
+	}
+	c.mu.Unlock()
+	return unix.Close(c.fd)
+}
+
+func (c *uringConn) LocalAddr() net.Addr  { return c.local }
+func (c *uringConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *uringConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline, c.writeDeadline = t, t
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *uringConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *uringConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,16 @@
+//go:build !(linux && iouring)
+
+package server
+
+import "net"
+
+// netpollPath serves connections as accepted
+type netpollPath struct{}
+
+func newConnPath() (connPath, error) {
+	return netpollPath{}, nil
+}
+
+func (netpollPath) Name() string                         { return "netpoll" }
+func (netpollPath) Wrap(conn net.Conn) (net.Conn, error) { return conn, nil }
+func (netpollPath) Close() error                         { return nil }
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+)
+
+// benchFrameSize is about a purchase attempt and its response
+const benchFrameSize = 128
+
+// BenchmarkConnPath round-trips frames over loopback connections served on
+// the network path of the build, so running it with and without -tags
+// iouring compares the two:
+//
+//	go test -run '^$' -bench ConnPath -cpu 1,8 ./internal/server
+//	go test -run '^$' -bench ConnPath -cpu 1,8 -tags iouring ./internal/server
+func BenchmarkConnPath(b *testing.B) {
+	path, err := newConnPath()
+	if err != nil {
+		b.Skipf("network path unavailable: %v", err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	var conns sync.WaitGroup
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			wrapped, err := path.Wrap(conn)
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			conns.Add(1)
+			go func() {
+				defer conns.Done()
+				defer wrapped.Close()
+				buf := make([]byte, benchFrameSize)
+				for {
+					if _, err := io.ReadFull(wrapped, buf); err != nil {
+						return
+					}
+					if _, err := wrapped.Write(buf); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	b.Run(path.Name(), func(b *testing.B) {
+		b.SetBytes(2 * benchFrameSize)
+		b.RunParallel(func(pb *testing.PB) {
+			conn, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			defer conn.Close()
+			buf := make([]byte, benchFrameSize)
+			for pb.Next() {
+				if _, err := conn.Write(buf); err != nil {
+					b.Error(err)
+					return
+				}
+				if _, err := io.ReadFull(conn, buf); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+	})
+
+	ln.Close()
+	conns.Wait()
+	path.Close()
+}
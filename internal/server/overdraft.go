@@ -0,0 +1,336 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"chha/internal/shardmap"
+	"chha/internal/store"
+	"chha/pkg/protocol"
+)
+
+const overdraftReconcileInterval = time.Second
+
+// overdraftGrant is a purchase granted from local counters while Redis was
+// unavailable. It is provisional until reconciled against Redis.
+type overdraftGrant struct {
+	ProductID string    `json:"product_id"`
+	UserID    string    `json:"user_id"`
+	GrantedAt time.Time `json:"granted_at"`
+}
+
+// overdraftQuota is the local view of a product used to size its budget
+type overdraftQuota struct {
+	peak    int64 // highest remaining stock observed
+	last    int64 // remaining stock at the last successful Redis call
+	pending int   // unreconciled local grants
+}
+
+// Overdraft grants a bounded number of provisional purchases per product
+// when Redis is degraded, and later replays them against Redis. Grants
+// that no longer fit in the real stock are the newest ones (replay is
+// oldest first) and are cancelled.
+type Overdraft struct {
+	percent     float64
+	journalPath string
+
+	// quotas is updated after every purchase, so it is sharded instead of
+	// sharing mu. When both are needed, mu is taken first.
+	quotas *shardmap.Map[overdraftQuota]
+
+	mu      sync.Mutex
+	pending []overdraftGrant
+}
+
+// newOverdraft creates an overdraft manager allowing percent of each
+// product's observed stock to be granted locally. Pending grants are
+// loaded from journalPath if it is set.
+func newOverdraft(percent float64, journalPath string) (*Overdraft, error) {
+	o := &Overdraft{
+		percent:     percent,
+		journalPath: journalPath,
+		quotas: shardmap.New(shardmap.DefaultShards, func() *overdraftQuota {
+			return &overdraftQuota{last: -1}
+		}),
+	}
+
+	if journalPath == "" {
+		return o, nil
+	}
+
+	pending, err := readOverdraftJournal(journalPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, g := range pending {
+		o.quotas.Do(g.ProductID, func(q *overdraftQuota) { q.pending++ })
+	}
+	o.pending = pending
+	if len(pending) > 0 {
+		log.Printf("WARNING: loaded %d unreconciled overdraft grants from %s", len(pending), journalPath)
+	}
+	return o, nil
+}
+
+// observe records the remaining stock reported by Redis for a product
+func (o *Overdraft) observe(productID string, remaining int64) {
+	o.quotas.Do(productID, func(q *overdraftQuota) {
+		q.last = remaining
+		q.peak = max(q.peak, remaining)
+	})
+}
+
+// grant tries to hand out one provisional unit. It refuses products that
+// were last seen sold out, have never been seen, or whose budget of
+// percent of peak stock is already in use.
+func (o *Overdraft) grant(productID, userID string) (bool, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var (
+		granted bool
+		err     error
+	)
+	o.quotas.Do(productID, func(q *overdraftQuota) {
+		budget := int(float64(q.peak) * o.percent / 100)
+		if q.last <= 0 || q.pending >= budget {
+			return
+		}
+
+		g := overdraftGrant{ProductID: productID, UserID: userID, GrantedAt: time.Now()}
+		if err = o.appendJournal(g); err != nil {
+			return
+		}
+
+		q.pending++
+		o.pending = append(o.pending, g)
+		granted = true
+	})
+	return granted, err
+}
+
+// oldest returns the oldest pending grant
+func (o *Overdraft) oldest() (overdraftGrant, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if len(o.pending) == 0 {
+		return overdraftGrant{}, false
+	}
+	return o.pending[0], true
+}
+
+// resolve removes the oldest pending grant once it has been replayed
+func (o *Overdraft) resolve() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	g := o.pending[0]
+	o.pending = o.pending[1:]
+	o.quotas.Do(g.ProductID, func(q *overdraftQuota) { q.pending-- })
+	return o.rewriteJournal()
+}
+
+func (o *Overdraft) appendJournal(g overdraftGrant) error {
+	if o.journalPath == "" {
+		return nil
+	}
+
+	f, err := os.OpenFile(o.journalPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open overdraft journal: %w", err)
+	}
+	defer f.Close()
+
+	line, _ := json.Marshal(g)
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write overdraft journal: %w", err)
+	}
+	return f.Sync()
+}
+
+// rewriteJournal replaces the journal with the current pending grants
+func (o *Overdraft) rewriteJournal() error {
+	if o.journalPath == "" {
+		return nil
+	}
+
+	tmp := o.journalPath + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to rewrite overdraft journal: %w", err)
+	}
+
+	w := bufio.NewWriter(f)
+	for _, g := range o.pending {
+		line, _ := json.Marshal(g)
+		w.Write(append(line, '\n'))
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to rewrite overdraft journal: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to rewrite overdraft journal: %w", err)
+	}
+	f.Close()
+
+	return os.Rename(tmp, o.journalPath)
+}
+
+func readOverdraftJournal(path string) ([]overdraftGrant, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to open overdraft journal: %w", err)
+	}
+	defer f.Close()
+
+	var grants []overdraftGrant
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var g overdraftGrant
+		if err := json.Unmarshal(scanner.Bytes(), &g); err != nil {
+			return nil, fmt.Errorf("corrupt overdraft journal entry: %w", err)
+		}
+		grants = append(grants, g)
+	}
+	return grants, scanner.Err()
+}
+
+// grantOverdraft hands out a provisional purchase if budget allows,
+// returning the response to send
+func (s *Server) grantOverdraft(c codec, req PurchaseRequest) ([]byte, bool) {
+	ok, err := s.overdraft.grant(req.ProductID, req.UserID)
+	if err != nil {
+		log.Printf("Overdraft grant failed: %v", err)
+		return nil, false
+	}
+	if !ok {
+		return nil, false
+	}
+
+	s.metrics.overdraftGrants.Inc()
+	log.Printf("WARNING: Redis degraded, granted PROVISIONAL purchase from overdraft: product=%s user=%s",
+		req.ProductID, req.UserID)
+
+	data, _ := c.Marshal(PurchaseResponse{
+		Status:      protocol.STATUS_SUCCESS,
+		Provisional: true,
+	})
+	return data, true
+}
+
+// isDegradedError reports whether a store error indicates Redis is
+// unreachable or overloaded, as opposed to a bad request or reply
+func isDegradedError(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, redis.ErrClosed) ||
+		isTimeoutError(err) ||
+		isRetryableRedisError(err)
+}
+
+// isUnsentError reports whether a store error proves the purchase never
+// reached Redis, so granting it from overdraft cannot sell twice. A
+// timeout or dropped connection may come after the script ran, and is
+// only degraded.
+func isUnsentError(err error) bool {
+	return isRetryableRedisError(err)
+}
+
+// reconcileLoop replays provisional grants against Redis, oldest first
+func (s *Server) reconcileLoop() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(overdraftReconcileInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for {
+			g, ok := s.overdraft.oldest()
+			if !ok {
+				break
+			}
+
+			ctx := withCommandTags(s.ctx, g.ProductID, "overdraft_reconcile")
+			result, err := s.store.AttemptPurchase(ctx, g.ProductID, g.UserID)
+			limited := errors.Is(err, store.ErrUserLimitReached)
+			closed := errors.Is(err, store.ErrSaleNotStarted) || errors.Is(err, store.ErrSaleEnded) ||
+				errors.Is(err, store.ErrNotEligible)
+			if err != nil && !limited && !closed {
+				// Still degraded, try again next tick
+				break
+			}
+
+			if limited {
+				s.metrics.overdraftCancelled.Inc()
+				log.Printf("WARNING: overdraft grant CANCELLED (per-user limit): product=%s user=%s granted_at=%s",
+					g.ProductID, g.UserID, g.GrantedAt.Format(time.RFC3339Nano))
+				s.recordOverdraftCancellation(ctx, g)
+			} else if closed {
+				s.metrics.overdraftCancelled.Inc()
+				log.Printf("WARNING: overdraft grant CANCELLED (not on sale to user): product=%s user=%s granted_at=%s",
+					g.ProductID, g.UserID, g.GrantedAt.Format(time.RFC3339Nano))
+				s.recordOverdraftCancellation(ctx, g)
+			} else if result.Queued {
+				// The product went into queue mode; the dispatcher settles
+				// the grant and emits its purchase event
+				log.Printf("Overdraft grant queued: product=%s user=%s ticket=%s position=%d",
+					g.ProductID, g.UserID, result.OrderID, result.QueuePosition)
+			} else if result.Success {
+				s.metrics.overdraftConfirmed.Inc()
+				log.Printf("Overdraft grant confirmed: product=%s user=%s order=%s", g.ProductID, g.UserID, result.OrderID)
+				go s.publishEvent(g.ProductID, g.UserID, "", result)
+			} else {
+				s.metrics.overdraftCancelled.Inc()
+				log.Printf("WARNING: overdraft grant CANCELLED (oversold): product=%s user=%s granted_at=%s",
+					g.ProductID, g.UserID, g.GrantedAt.Format(time.RFC3339Nano))
+				s.recordOverdraftCancellation(ctx, g)
+			}
+
+			if err := s.overdraft.resolve(); err != nil {
+				log.Printf("Failed to update overdraft journal: %v", err)
+			}
+		}
+	}
+}
+
+// recordOverdraftCancellation keeps a durable list of cancelled grants and
+// emits an event so the affected users can be notified
+func (s *Server) recordOverdraftCancellation(ctx context.Context, g overdraftGrant) {
+	event := map[string]interface{}{
+		"type":       "overdraft_cancelled",
+		"product_id": g.ProductID,
+		"buyer":      g.UserID,
+		"granted_at": g.GrantedAt.Unix(),
+		"timestamp":  time.Now().Unix(),
+	}
+
+	data, _ := json.Marshal(event)
+	key := s.keyPrefix + fmt.Sprintf("product:%s:overdraft_cancelled", g.ProductID)
+	if err := s.redis.LPush(ctx, key, data).Err(); err != nil {
+		log.Printf("Failed to record overdraft cancellation: %v", err)
+	}
+	s.emitEvent(g.ProductID, true, event)
+}
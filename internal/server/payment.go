@@ -0,0 +1,190 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"chha/internal/store"
+	"chha/pkg/protocol"
+)
+
+const (
+	orderReaperInterval = time.Second
+	orderReaperBatch    = 500
+)
+
+// ConfirmPaymentRequest confirms payment for a PENDING order
+type ConfirmPaymentRequest struct {
+	OrderID string `json:"order_id"`
+	UserID  string `json:"user_id"`
+	// AuthToken is a JWT issued to UserID, required when auth is enabled
+	// and the session is not bound to the user
+	AuthToken string `json:"auth_token,omitempty"`
+}
+
+// ConfirmPaymentResponse is the result of a payment confirmation
+type ConfirmPaymentResponse struct {
+	Status      string `json:"status"`
+	OrderID     string `json:"order_id,omitempty"`
+	OrderStatus string `json:"order_status,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// handleConfirmPayment serves MSG_CONFIRM_PAYMENT
+func (s *Server) handleConfirmPayment(sess *session, c codec, payload []byte) []byte {
+	var req ConfirmPaymentRequest
+	if err := c.Unmarshal(payload, &req); err != nil {
+		data, _ := c.Marshal(ConfirmPaymentResponse{
+			Status: protocol.STATUS_ERROR,
+			Error:  "invalid json",
+		})
+		return data
+	}
+	user, bound, err := s.sessionUser(sess, req.UserID)
+	if err != nil {
+		data, _ := c.Marshal(ConfirmPaymentResponse{Status: protocol.STATUS_ERROR, Error: err.Error()})
+		return data
+	}
+	req.UserID = user
+
+	if req.OrderID == "" || req.UserID == "" {
+		data, _ := c.Marshal(ConfirmPaymentResponse{
+			Status: protocol.STATUS_ERROR,
+			Error:  "missing order_id or user_id",
+		})
+		return data
+	}
+	if err := s.authorizeUser(req.AuthToken, req.UserID, bound); err != nil {
+		data, _ := c.Marshal(ConfirmPaymentResponse{Status: protocol.STATUS_ERROR, OrderID: req.OrderID, Error: err.Error()})
+		return data
+	}
+
+	ctx := withCommandTags(s.ctx, "none", "confirm_payment")
+	order, err := s.store.ConfirmPayment(ctx, req.OrderID, req.UserID)
+	if err != nil {
+		resp := ConfirmPaymentResponse{
+			Status:  protocol.STATUS_ERROR,
+			OrderID: req.OrderID,
+			Error:   err.Error(),
+		}
+		if errors.Is(err, store.ErrOrderExpired) {
+			resp.OrderStatus = store.OrderExpired
+		} else if errors.Is(err, store.ErrOrderHeld) {
+			resp.OrderStatus = store.OrderHeld
+		}
+		data, _ := c.Marshal(resp)
+		return data
+	}
+
+	s.metrics.ordersConfirmed.Inc()
+	go s.emitEvent(order.ProductID, true, map[string]interface{}{
+		"type":            "order_confirmed",
+		"product_id":      order.ProductID,
+		"buyer":           order.UserID,
+		"order_id":        order.ID,
+		"status":          store.OrderConfirmed,
+		"previous_status": store.OrderPending,
+		"timestamp":       time.Now().Unix(),
+	})
+
+	data, _ := c.Marshal(ConfirmPaymentResponse{
+		Status:      protocol.STATUS_SUCCESS,
+		OrderID:     order.ID,
+		OrderStatus: order.Status,
+	})
+	return data
+}
+
+// orderReaperLoop expires PENDING orders whose payment deadline passed and
+// puts their stock back on sale. Only the cluster leader reaps; expiry is
+// atomic per order, so two servers overlapping during a handover is safe.
+func (s *Server) orderReaperLoop() {
+	defer s.wg.Done()
+
+	ctx := withCommandTags(s.ctx, "none", "order_reaper")
+	ticker := time.NewTicker(orderReaperInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if !s.isLeader() {
+			continue
+		}
+
+		for {
+			expired, err := s.store.ExpireOrders(ctx, orderReaperBatch)
+			if err != nil {
+				log.Printf("Order reaper failed: %v", err)
+			}
+
+			s.publishExpired(expired)
+			if len(expired) > 0 {
+				log.Printf("Expired %d unpaid orders, stock restored", len(expired))
+			}
+
+			// A full batch likely means more are waiting
+			if err != nil || len(expired) < orderReaperBatch {
+				break
+			}
+		}
+	}
+}
+
+// staleOrderSweepLoop expires the PENDING orders past their deadline that
+// the reaper cannot see: orders missing from the pending index, or left
+// while no server ran with PAYMENT_TTL. It scans every order, so it runs
+// far less often than the reaper, and only on the leader.
+func (s *Server) staleOrderSweepLoop(sweeper store.StaleSweeper) {
+	defer s.wg.Done()
+
+	ctx := withCommandTags(s.ctx, "none", "stale_order_sweep")
+	ticker := time.NewTicker(s.opts.StaleOrderSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if !s.isLeader() {
+			continue
+		}
+
+		sweep, err := sweeper.ExpireStaleOrders(ctx, nil)
+		if err != nil {
+			log.Printf("Stale order sweep failed: %v", err)
+		}
+		s.publishExpired(sweep.Expired)
+		s.metrics.ordersUnindexed.Add(float64(sweep.Unindexed))
+		if len(sweep.Expired) > 0 {
+			log.Printf("Stale order sweep expired %d unpaid orders, %d missing from the pending index",
+				len(sweep.Expired), sweep.Unindexed)
+		}
+	}
+}
+
+// publishExpired publishes the events of expired orders. The expire script
+// already recorded them in the events stream.
+func (s *Server) publishExpired(expired []store.ExpiredOrder) {
+	for _, order := range expired {
+		s.metrics.ordersExpired.Inc()
+		s.emitEvent(order.ProductID, false, map[string]interface{}{
+			"type":            "order_expired",
+			"product_id":      order.ProductID,
+			"buyer":           order.UserID,
+			"order_id":        order.ID,
+			"status":          store.OrderExpired,
+			"previous_status": store.OrderPending,
+			"timestamp":       time.Now().Unix(),
+		})
+		if order.Grant != nil {
+			s.publishWaitlistGrant(order.ID, order.Grant)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"chha/pkg/protocol"
+)
+
+// ChallengeRequest asks for a proof of work puzzle for one purchase
+type ChallengeRequest struct {
+	ProductID string `json:"product_id"`
+	UserID    string `json:"user_id"`
+}
+
+// ChallengeResponse carries a puzzle. The client must find a solution for
+// which protocol.PoWValid holds and send both with its purchase attempt
+// before ExpiresAt.
+type ChallengeResponse struct {
+	Status     string `json:"status"`
+	Challenge  string `json:"challenge,omitempty"`
+	Difficulty int    `json:"difficulty,omitempty"`
+	ExpiresAt  int64  `json:"expires_at,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+var (
+	errPoWRequired = errors.New(protocol.ERROR_POW_REQUIRED)
+	errPoWInvalid  = errors.New("invalid proof of work")
+	errPoWExpired  = errors.New("proof of work challenge expired")
+)
+
+// powIssuer hands out and checks MSG_CHALLENGE puzzles. Challenges are
+// stateless: everything needed to check one is in the string, bound to
+// the user and product by an HMAC, so any server sharing the secret can
+// verify a challenge another one issued.
+type powIssuer struct {
+	secret []byte
+	ttl    time.Duration
+}
+
+func newPoWIssuer(secret string, ttl time.Duration) (*powIssuer, error) {
+	key := []byte(secret)
+	if secret == "" {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, fmt.Errorf("failed to generate proof of work secret: %w", err)
+		}
+		log.Printf("WARNING: POW_SECRET not set, challenges are only accepted by this server")
+	}
+	return &powIssuer{secret: key, ttl: ttl}, nil
+}
+
+// issue returns a challenge of the form
+// "<expires>.<difficulty>.<nonce>.<mac>"
+func (p *powIssuer) issue(userID, productID string, difficulty int, now time.Time) (string, time.Time, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", time.Time{}, err
+	}
+	expires := now.Add(p.ttl).Truncate(time.Second)
+	body := fmt.Sprintf("%d.%d.%s", expires.Unix(), difficulty, hex.EncodeToString(nonce))
+	return body + "." + p.mac(body, userID, productID), expires, nil
+}
+
+func (p *powIssuer) mac(body, userID, productID string) string {
+	m := hmac.New(sha256.New, p.secret)
+	// Length-prefixed so "a"+"bc" and "ab"+"c" sign differently
+	fmt.Fprintf(m, "%s|%d:%s|%d:%s", body, len(userID), userID, len(productID), productID)
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// verify checks that challenge was issued to this user and product, has
+// not expired, is of at least minDifficulty and is solved by solution
+func (p *powIssuer) verify(userID, productID, challenge, solution string, minDifficulty int, now time.Time) error {
+	if challenge == "" {
+		return errPoWRequired
+	}
+
+	fields := strings.Split(challenge, ".")
+	if len(fields) != 4 {
+		return errPoWInvalid
+	}
+	body := strings.Join(fields[:3], ".")
+	if !hmac.Equal([]byte(fields[3]), []byte(p.mac(body, userID, productID))) {
+		return errPoWInvalid
+	}
+
+	expires, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return errPoWInvalid
+	}
+	if now.Unix() > expires {
+		return errPoWExpired
+	}
+	// A challenge issued before the difficulty was raised is not enough
+	difficulty, err := strconv.Atoi(fields[1])
+	if err != nil || difficulty < minDifficulty {
+		return errPoWInvalid
+	}
+	if !protocol.PoWValid(challenge, solution, difficulty) {
+		return errPoWInvalid
+	}
+	return nil
+}
+
+// handleChallenge serves MSG_CHALLENGE
+func (s *Server) handleChallenge(sess *session, c codec, payload []byte) []byte {
+	var req ChallengeRequest
+	if err := c.Unmarshal(payload, &req); err != nil {
+		data, _ := c.Marshal(ChallengeResponse{Status: protocol.STATUS_ERROR, Error: "invalid json"})
+		return data
+	}
+	user, _, err := s.sessionUser(sess, req.UserID)
+	if err != nil {
+		data, _ := c.Marshal(ChallengeResponse{Status: protocol.STATUS_ERROR, Error: err.Error()})
+		return data
+	}
+	req.UserID = user
+	if req.ProductID == "" || req.UserID == "" {
+		data, _ := c.Marshal(ChallengeResponse{Status: protocol.STATUS_ERROR, Error: "missing product_id or user_id"})
+		return data
+	}
+	if s.pow == nil {
+		data, _ := c.Marshal(ChallengeResponse{Status: protocol.STATUS_ERROR, Error: "proof of work is disabled"})
+		return data
+	}
+
+	difficulty := s.powDifficulty(s.speedFlagged(req.UserID))
+	challenge, expires, err := s.pow.issue(req.UserID, req.ProductID, difficulty, time.Now())
+	if err != nil {
+		data, _ := c.Marshal(ChallengeResponse{Status: protocol.STATUS_ERROR, Error: err.Error()})
+		return data
+	}
+	s.metrics.powChallenges.Inc()
+
+	data, _ := c.Marshal(ChallengeResponse{
+		Status:     protocol.STATUS_SUCCESS,
+		Challenge:  challenge,
+		Difficulty: difficulty,
+		ExpiresAt:  expires.Unix(),
+	})
+	return data
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"chha/internal/store"
+)
+
+// primeCaches fills the product caches from one scan of the products, so
+// the first requests after a restart do not each pay a round trip for a
+// product this server has not seen yet: the catalog with its metadata and
+// sale windows, the store's shard layouts, and the sold out cache. Sales
+// with an end the closer does not know of yet are scheduled to close. The
+// scan gets CACHE_PRIME_TIMEOUT; if it fails the caches fill on demand.
+func (s *Server) primeCaches() {
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(withCommandTags(s.ctx, "none", "cache_prime"), s.opts.CachePrimeTimeout)
+	defer cancel()
+
+	var restocks uint64
+	if s.soldOut != nil {
+		restocks = s.soldOut.restocks.Load()
+	}
+	infos, err := s.store.ListProductInfo(ctx)
+	if err != nil {
+		log.Printf("WARNING: failed to prime caches, filling them on demand: %v", err)
+		return
+	}
+
+	now := time.Now()
+	s.catalog.prime(infos, now)
+	if primer, ok := s.store.(store.CachePrimer); ok {
+		if err := primer.PrimeCaches(ctx, infos); err != nil {
+			log.Printf("WARNING: failed to prime store caches: %v", err)
+		}
+	}
+	if closer, ok := s.store.(store.SaleCloser); ok {
+		if err := closer.ScheduleCloses(ctx, infos); err != nil {
+			log.Printf("WARNING: failed to schedule sale closes: %v", err)
+		}
+	}
+	soldOut := 0
+	if s.soldOut != nil {
+		for _, info := range infos {
+			if info.State(now) == store.StateSoldOut {
+				s.soldOut.mark(info.ID, restocks, now)
+				soldOut++
+			}
+		}
+	}
+	log.Printf("Primed caches for %d products (%d sold out) in %v", len(infos), soldOut, time.Since(start).Round(time.Millisecond))
+}
@@ -0,0 +1,287 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"time"
+
+	"chha/internal/store"
+	"chha/pkg/protocol"
+)
+
+// GetStockRequest asks for the remaining stock of a product
+type GetStockRequest struct {
+	ProductID string `json:"product_id"`
+}
+
+// GetStockResponse reports a product's remaining stock
+type GetStockResponse struct {
+	Status    string `json:"status"`
+	ProductID string `json:"product_id,omitempty"`
+	Stock     int64  `json:"stock"`
+	Error     string `json:"error,omitempty"`
+}
+
+// GetOrderStatusRequest asks for the status of the user's order
+type GetOrderStatusRequest struct {
+	OrderID string `json:"order_id"`
+	UserID  string `json:"user_id"`
+}
+
+// GetOrderStatusResponse reports the state of one order
+type GetOrderStatusResponse struct {
+	Status          string `json:"status"`
+	OrderID         string `json:"order_id,omitempty"`
+	ProductID       string `json:"product_id,omitempty"`
+	OrderStatus     string `json:"order_status,omitempty"`
+	CreatedAt       int64  `json:"created_at,omitempty"`
+	PaymentDeadline int64  `json:"payment_deadline,omitempty"`
+	// AgentID is the agent that bought on the user's behalf, if any
+	AgentID string `json:"agent_id,omitempty"`
+	// BundleID is set if the order is part of a bundle purchase
+	BundleID string `json:"bundle_id,omitempty"`
+	// QueuePosition is set while the order is a QUEUED purchase attempt
+	QueuePosition int64  `json:"queue_position,omitempty"`
+	Error         string `json:"error,omitempty"`
+}
+
+// ticketStatus answers MSG_GET_ORDER_STATUS for a queued purchase attempt
+// of the user that has no order yet. ok is false if there is no such
+// ticket, or it was granted and now has its order.
+func (s *Server) ticketStatus(ctx context.Context, c codec, ticketID, userID string) (data []byte, ok bool) {
+	q, ok := s.store.(store.Queue)
+	if !ok {
+		return nil, false
+	}
+	t, err := q.QueueTicket(ctx, ticketID)
+	if err != nil || t.UserID != userID || t.Status == store.TicketSuccess {
+		return nil, false
+	}
+
+	resp := GetOrderStatusResponse{
+		Status:      protocol.STATUS_SUCCESS,
+		OrderID:     t.ID,
+		ProductID:   t.ProductID,
+		OrderStatus: t.Status,
+		AgentID:     t.AgentID,
+	}
+	switch t.Status {
+	case store.TicketSoldOut:
+		resp.Status = protocol.STATUS_SOLD_OUT
+	case store.TicketLimitReached:
+		resp.Status = protocol.STATUS_LIMIT_REACHED
+	default:
+		resp.QueuePosition = t.Position
+	}
+	data, _ = c.Marshal(resp)
+	return data, true
+}
+
+// Page sizes of MSG_GET_USER_ORDERS
+const (
+	USER_ORDERS_DEFAULT_LIMIT = 50
+	USER_ORDERS_MAX_LIMIT     = 500
+)
+
+// GetUserOrdersRequest asks for a user's orders across all products. It
+// must carry the admin token, or an auth token issued to user_id.
+type GetUserOrdersRequest struct {
+	UserID     string `json:"user_id"`
+	Limit      int    `json:"limit,omitempty"`
+	AdminToken string `json:"admin_token,omitempty"`
+	AuthToken  string `json:"auth_token,omitempty"`
+}
+
+// UserOrder is one entry of GetUserOrdersResponse
+type UserOrder struct {
+	OrderID         string `json:"order_id"`
+	ProductID       string `json:"product_id"`
+	OrderStatus     string `json:"order_status"`
+	Quantity        int64  `json:"quantity"`
+	CreatedAt       int64  `json:"created_at"`
+	PaymentDeadline int64  `json:"payment_deadline,omitempty"`
+	AgentID         string `json:"agent_id,omitempty"`
+	BundleID        string `json:"bundle_id,omitempty"`
+}
+
+// GetUserOrdersResponse lists a user's orders, newest first
+type GetUserOrdersResponse struct {
+	Status string      `json:"status"`
+	UserID string      `json:"user_id,omitempty"`
+	Orders []UserOrder `json:"orders,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+// handleGetStock serves MSG_GET_STOCK. The stock is read directly from
+// Redis, unlike the cached catalog, and costs a single GET for unsharded
+// products so clients may poll it.
+func (s *Server) handleGetStock(c codec, payload []byte) []byte {
+	var req GetStockRequest
+	if err := c.Unmarshal(payload, &req); err != nil {
+		data, _ := c.Marshal(GetStockResponse{Status: protocol.STATUS_ERROR, Error: "invalid json"})
+		return data
+	}
+	if req.ProductID == "" {
+		data, _ := c.Marshal(GetStockResponse{Status: protocol.STATUS_ERROR, Error: "missing product_id"})
+		return data
+	}
+
+	ctx := withCommandTags(s.ctx, req.ProductID, "get_stock")
+	stock, err := s.reads().GetStock(ctx, req.ProductID)
+	if err != nil {
+		data, _ := c.Marshal(GetStockResponse{
+			Status:    protocol.STATUS_ERROR,
+			ProductID: req.ProductID,
+			Error:     err.Error(),
+		})
+		return data
+	}
+
+	data, _ := c.Marshal(GetStockResponse{
+		Status:    protocol.STATUS_SUCCESS,
+		ProductID: req.ProductID,
+		Stock:     stock,
+	})
+	return data
+}
+
+// handleGetOrderStatus serves MSG_GET_ORDER_STATUS, letting a client that
+// lost its connection mid-purchase find out whether the order exists.
+// Orders of other users are reported as not found.
+func (s *Server) handleGetOrderStatus(sess *session, c codec, payload []byte) []byte {
+	var req GetOrderStatusRequest
+	if err := c.Unmarshal(payload, &req); err != nil {
+		data, _ := c.Marshal(GetOrderStatusResponse{Status: protocol.STATUS_ERROR, Error: "invalid json"})
+		return data
+	}
+	user, _, err := s.sessionUser(sess, req.UserID)
+	if err != nil {
+		data, _ := c.Marshal(GetOrderStatusResponse{Status: protocol.STATUS_ERROR, Error: err.Error()})
+		return data
+	}
+	req.UserID = user
+	if req.OrderID == "" || req.UserID == "" {
+		data, _ := c.Marshal(GetOrderStatusResponse{Status: protocol.STATUS_ERROR, Error: "missing order_id or user_id"})
+		return data
+	}
+
+	ctx := withCommandTags(s.ctx, "none", "get_order_status")
+	order, err := s.reads().GetOrder(ctx, req.OrderID)
+	if errors.Is(err, store.ErrOrderNotFound) {
+		if data, ok := s.ticketStatus(ctx, c, req.OrderID, req.UserID); ok {
+			return data
+		}
+		// The ticket may have been dispatched since the first read
+		order, err = s.reads().GetOrder(ctx, req.OrderID)
+	}
+	if err == nil && order.UserID != req.UserID {
+		err = store.ErrOrderNotFound
+	}
+	if err != nil {
+		resp := GetOrderStatusResponse{
+			Status:  protocol.STATUS_ERROR,
+			OrderID: req.OrderID,
+			Error:   err.Error(),
+		}
+		if !errors.Is(err, store.ErrOrderNotFound) {
+			resp.Error = "failed to get order status"
+		}
+		data, _ := c.Marshal(resp)
+		return data
+	}
+
+	resp := GetOrderStatusResponse{
+		Status:      protocol.STATUS_SUCCESS,
+		OrderID:     order.ID,
+		ProductID:   order.ProductID,
+		OrderStatus: order.Status,
+		CreatedAt:   order.CreatedAt.Unix(),
+		AgentID:     order.AgentID,
+		BundleID:    order.BundleID,
+	}
+	if order.Status == store.OrderPending && !order.ExpiresAt.IsZero() {
+		resp.PaymentDeadline = order.ExpiresAt.Unix()
+	}
+	data, _ := c.Marshal(resp)
+	return data
+}
+
+// handleGetUserOrders serves MSG_GET_USER_ORDERS for support tooling,
+// which holds the admin token, and for users holding an auth token or an
+// authenticated session. With neither configured the message is disabled,
+// since user IDs alone are easy to guess.
+func (s *Server) handleGetUserOrders(sess *session, c codec, payload []byte) []byte {
+	var req GetUserOrdersRequest
+	if err := c.Unmarshal(payload, &req); err != nil {
+		data, _ := c.Marshal(GetUserOrdersResponse{Status: protocol.STATUS_ERROR, Error: "invalid json"})
+		return data
+	}
+	admin := s.opts.AdminToken != "" &&
+		subtle.ConstantTimeCompare([]byte(req.AdminToken), []byte(s.opts.AdminToken)) == 1
+	// Support tooling looks up any user, on any connection
+	bound := false
+	if !admin {
+		user, ok, err := s.sessionUser(sess, req.UserID)
+		if err != nil {
+			data, _ := c.Marshal(GetUserOrdersResponse{Status: protocol.STATUS_ERROR, Error: err.Error()})
+			return data
+		}
+		req.UserID, bound = user, ok
+	}
+	if req.UserID == "" {
+		data, _ := c.Marshal(GetUserOrdersResponse{Status: protocol.STATUS_ERROR, Error: "missing user_id"})
+		return data
+	}
+
+	history, ok := s.reads().(store.OrderHistory)
+	if !ok {
+		data, _ := c.Marshal(GetUserOrdersResponse{Status: protocol.STATUS_ERROR, Error: "user orders not supported by store"})
+		return data
+	}
+
+	if !admin && !bound && (s.auth == nil || s.auth.Authorize(req.AuthToken, req.UserID, time.Now()) != nil) {
+		data, _ := c.Marshal(GetUserOrdersResponse{Status: protocol.STATUS_ERROR, Error: "unauthorized"})
+		return data
+	}
+
+	limit := req.Limit
+	if limit <= 0 {
+		limit = USER_ORDERS_DEFAULT_LIMIT
+	}
+	limit = min(limit, USER_ORDERS_MAX_LIMIT)
+
+	ctx := withCommandTags(s.ctx, "none", "get_user_orders")
+	orders, err := history.UserOrders(ctx, req.UserID, limit)
+	if err != nil {
+		data, _ := c.Marshal(GetUserOrdersResponse{
+			Status: protocol.STATUS_ERROR,
+			UserID: req.UserID,
+			Error:  "failed to get user orders",
+		})
+		return data
+	}
+
+	resp := GetUserOrdersResponse{
+		Status: protocol.STATUS_SUCCESS,
+		UserID: req.UserID,
+		Orders: make([]UserOrder, 0, len(orders)),
+	}
+	for _, o := range orders {
+		uo := UserOrder{
+			OrderID:     o.ID,
+			ProductID:   o.ProductID,
+			OrderStatus: o.Status,
+			Quantity:    o.Quantity,
+			CreatedAt:   o.CreatedAt.Unix(),
+			AgentID:     o.AgentID,
+			BundleID:    o.BundleID,
+		}
+		if o.Status == store.OrderPending && !o.ExpiresAt.IsZero() {
+			uo.PaymentDeadline = o.ExpiresAt.Unix()
+		}
+		resp.Orders = append(resp.Orders, uo)
+	}
+	data, _ := c.Marshal(resp)
+	return data
+}
@@ -0,0 +1,168 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"chha/internal/store"
+	"chha/pkg/protocol"
+)
+
+// queueProductsRefresh is how often the dispatcher re-reads which products
+// are in queue mode
+const queueProductsRefresh = time.Second
+
+// queueWaiter is a connection waiting for a queued purchase's result
+type queueWaiter struct {
+	sess *session
+	c    codec
+}
+
+// queueWaiters maps ticket IDs queued on this server's connections to the
+// connection that should receive MSG_QUEUE_RESULT
+type queueWaiters struct {
+	mu sync.Mutex
+	m  map[string]queueWaiter
+}
+
+func (w *queueWaiters) add(ticketID string, sess *session, c codec) {
+	w.mu.Lock()
+	w.m[ticketID] = queueWaiter{sess: sess, c: c}
+	w.mu.Unlock()
+	sess.addTicket(ticketID)
+}
+
+func (w *queueWaiters) take(ticketID string) (queueWaiter, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	waiter, ok := w.m[ticketID]
+	delete(w.m, ticketID)
+	return waiter, ok
+}
+
+// drop forgets the tickets of a closed connection
+func (w *queueWaiters) drop(ticketIDs []string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, id := range ticketIDs {
+		delete(w.m, id)
+	}
+}
+
+// queuedResponse answers a purchase attempt that was queued, remembering
+// the connection if it asked for MSG_QUEUE_RESULT
+func (s *Server) queuedResponse(sess *session, c codec, result store.PurchaseResult) []byte {
+	s.metrics.purchasesQueued.Inc()
+	if sess != nil && sess.proto.has(protocol.CAP_QUEUE_RESULTS) {
+		s.queueWaiters.add(result.OrderID, sess, c)
+	}
+
+	data, _ := c.Marshal(PurchaseResponse{
+		Status:        protocol.STATUS_QUEUED,
+		OrderID:       result.OrderID,
+		QueuePosition: result.QueuePosition,
+	})
+	return data
+}
+
+// queueDispatchLoop grants queued purchases. Every server may run it: a
+// product's queue is only dispatched by one of them at a time.
+func (s *Server) queueDispatchLoop(q store.Queue) {
+	defer s.wg.Done()
+
+	ctx := withCommandTags(s.ctx, "none", "queue_dispatch")
+	ticker := time.NewTicker(s.opts.QueueDispatchInterval)
+	defer ticker.Stop()
+
+	var products []string
+	var refreshed time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if time.Since(refreshed) >= queueProductsRefresh {
+			ids, err := q.QueuedProducts(ctx)
+			if err != nil {
+				log.Printf("Failed to list queued products: %v", err)
+				continue
+			}
+			products, refreshed = ids, time.Now()
+		}
+
+		for _, productID := range products {
+			tickets, err := q.DispatchQueue(withCommandTags(ctx, productID, "queue_dispatch"), productID, s.opts.QueueDispatchBatch)
+			if err != nil {
+				log.Printf("Queue dispatch failed for %s: %v", productID, err)
+			}
+			for _, t := range tickets {
+				s.metrics.queueDispatched.WithLabelValues(t.Status).Inc()
+				if t.Status == store.TicketSuccess {
+					result := store.PurchaseResult{
+						Success:   true,
+						Remaining: t.Remaining,
+						Recorded:  t.Recorded,
+						OrderID:   t.ID,
+					}
+					if t.PaymentDeadline > 0 {
+						result.PaymentDeadline = time.Unix(t.PaymentDeadline, 0)
+					}
+					go s.publishEvent(productID, t.UserID, t.AgentID, result)
+				}
+			}
+		}
+	}
+}
+
+// queueResultsLoop pushes each dispatched ticket, whichever server
+// dispatched it, to the connection of this server that queued it
+func (s *Server) queueResultsLoop() {
+	defer s.wg.Done()
+
+	sub := s.redis.Subscribe(s.ctx, s.keyPrefix+store.QueueResultsChannel)
+	defer sub.Close()
+
+	ch := sub.Channel()
+	for {
+		var msg *redis.Message
+		select {
+		case <-s.ctx.Done():
+			return
+		case msg = <-ch:
+		}
+
+		var t store.Ticket
+		if err := json.Unmarshal([]byte(msg.Payload), &t); err != nil {
+			log.Printf("Invalid queue result: %v", err)
+			continue
+		}
+		waiter, ok := s.queueWaiters.take(t.ID)
+		if !ok {
+			continue
+		}
+		waiter.sess.removeTicket(t.ID)
+
+		resp := PurchaseResponse{Status: protocol.STATUS_SOLD_OUT, OrderID: t.ID}
+		switch t.Status {
+		case store.TicketSuccess:
+			resp.Status = protocol.STATUS_SUCCESS
+			resp.RemainingStock = t.Remaining
+			resp.PaymentDeadline = t.PaymentDeadline
+		case store.TicketLimitReached:
+			resp.Status = protocol.STATUS_LIMIT_REACHED
+		}
+		data, _ := waiter.c.Marshal(resp)
+		// A slow client must not hold up results for everyone else
+		go func() {
+			if err := waiter.sess.write(s, protocol.MSG_QUEUE_RESULT, waiter.c, data); err != nil {
+				log.Printf("Failed to push queue result to %s: %v", waiter.sess.conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"log"
+	"net"
+
+	"github.com/quic-go/quic-go"
+
+	"chha/internal/quicnet"
+)
+
+// listenQUIC opens the experimental QUIC listener on QUIC_ADDR, with the
+// client TLS certificate
+func (s *Server) listenQUIC() error {
+	ln, err := quic.ListenAddr(s.opts.QUICAddr, quicnet.TLSConfig(s.tlsConfig), quicnet.Config())
+	if err != nil {
+		return err
+	}
+	s.quicListener = ln
+	log.Printf("WARNING: experimental QUIC listener enabled - Address: %s", ln.Addr())
+	return nil
+}
+
+// refusal is why a connection from addr is turned away on accept, empty
+// to serve it
+func (s *Server) refusal(addr net.Addr) string {
+	if s.drain.draining.Load() {
+		return "draining"
+	}
+	if limit := s.config().MaxConnections; limit > 0 && s.drain.count() >= limit {
+		return "max_connections"
+	}
+	if s.blocks != nil && s.blocks.addrBlocked(addr) {
+		return "blocked"
+	}
+	return ""
+}
+
+// quicAcceptLoop accepts QUIC connections, whose streams serveQUIC serves
+func (s *Server) quicAcceptLoop() {
+	defer s.wg.Done()
+
+	for {
+		qc, err := s.quicListener.Accept(s.ctx)
+		if err != nil {
+			if s.ctx.Err() != nil {
+				return
+			}
+			log.Printf("QUIC accept error: %v", err)
+			continue
+		}
+		if s.blocks != nil && s.blocks.addrBlocked(qc.RemoteAddr()) {
+			s.metrics.connectionsRejected.WithLabelValues("blocked").Inc()
+			qc.CloseWithError(0, "")
+			continue
+		}
+		s.metrics.quicConnections.Inc()
+
+		s.wg.Add(1)
+		go s.serveQUIC(qc)
+	}
+}
+
+// serveQUIC serves every stream a client opens on qc as a connection of
+// its own, through the same checks as a TCP accept. A stream speaks the
+// protocol exactly as a TCP connection does, TLS aside, which QUIC does
+// itself. qc is closed once it accepts no more streams, when the client
+// closed it or the server is stopping.
+func (s *Server) serveQUIC(qc *quic.Conn) {
+	defer s.wg.Done()
+	defer qc.CloseWithError(0, "")
+
+	for {
+		stream, err := qc.AcceptStream(s.ctx)
+		if err != nil {
+			return
+		}
+		conn := quicnet.NewConn(qc, stream)
+		if reason := s.refusal(conn.RemoteAddr()); reason != "" {
+			s.metrics.connectionsRejected.WithLabelValues(reason).Inc()
+			conn.Close()
+			continue
+		}
+
+		s.wg.Add(1)
+		go s.handleConnection(conn)
+	}
+}
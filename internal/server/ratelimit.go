@@ -0,0 +1,68 @@
+package server
+
+import (
+	"log"
+
+	"chha/internal/store"
+	"chha/pkg/protocol"
+)
+
+// throttle counts a purchase attempt against the user's rate limit, the
+// agent's if it is made by one and the flagged limit if the user attempts
+// too fast, and returns the RATE_LIMITED response if any is over. Limits
+// are shared by every connection and server through Redis. A failed check
+// lets the attempt through: the purchase itself will fail if Redis is
+// down.
+func (s *Server) throttle(c codec, userID, agentID string, flagged bool) ([]byte, bool) {
+	ctx := withCommandTags(s.ctx, "none", "rate_limit")
+	if detector, ok := s.store.(store.SpeedDetector); ok && flagged && s.opts.SpeedRateLimit > 0 {
+		decision, err := detector.AllowFlaggedAttempt(ctx, userID, s.opts.SpeedRateLimit, s.opts.SpeedRateWindow)
+		if err != nil {
+			log.Printf("Flagged rate limit check failed for user=%s, allowing attempt: %v", userID, err)
+		} else if !decision.Allowed {
+			s.metrics.speedActions.WithLabelValues("rate_limited").Inc()
+			return s.rateLimited(c, decision), true
+		}
+	}
+
+	limiter, ok := s.store.(store.RateLimiter)
+	if !ok {
+		return nil, false
+	}
+	cfg := s.config()
+
+	if agentID != "" && cfg.AgentRateLimit > 0 {
+		decision, err := limiter.AllowAgentAttempt(ctx, agentID, cfg.AgentRateLimit, cfg.AgentRateWindow)
+		if err != nil {
+			log.Printf("Rate limit check failed for agent=%s, allowing attempt: %v", agentID, err)
+		} else if !decision.Allowed {
+			return s.rateLimited(c, decision), true
+		}
+	}
+
+	if cfg.UserRateLimit <= 0 {
+		return nil, false
+	}
+	decision, err := limiter.AllowAttempt(ctx, userID, cfg.UserRateLimit, cfg.UserRateWindow)
+	if err != nil {
+		log.Printf("Rate limit check failed for user=%s, allowing attempt: %v", userID, err)
+		return nil, false
+	}
+	if decision.Allowed {
+		return nil, false
+	}
+	return s.rateLimited(c, decision), true
+}
+
+func (s *Server) rateLimited(c codec, decision store.RateDecision) []byte {
+	s.metrics.purchasesRateLimited.Inc()
+	if s.scaler != nil {
+		s.scaler.shed.Add(1)
+	}
+	data, _ := c.Marshal(PurchaseResponse{
+		Status:       protocol.STATUS_RATE_LIMITED,
+		Error:        "too many purchase attempts",
+		RetryAfterMs: decision.RetryAfter.Milliseconds(),
+	})
+	return data
+}
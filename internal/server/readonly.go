@@ -0,0 +1,198 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"chha/internal/store"
+	"chha/pkg/protocol"
+)
+
+// readOnlyProbeKey is written to find out whether Redis takes writes
+// again, and expires on its own
+const readOnlyProbeKey = "flashsale:probe:write"
+
+// readOnlyError is the error of a write refused in read only mode
+const readOnlyError = "sales are paused, the store is read only"
+
+// writeMessages are the frames refused in read only mode
+var writeMessages = map[byte]bool{
+	protocol.MSG_ATTEMPT_PURCHASE: true,
+	protocol.MSG_PURCHASE_BUNDLE:  true,
+	protocol.MSG_CONFIRM_PAYMENT:  true,
+	protocol.MSG_CANCEL_PURCHASE:  true,
+	protocol.MSG_RESERVE:          true,
+	protocol.MSG_COMMIT:           true,
+	protocol.MSG_RELEASE:          true,
+}
+
+// readOnlyState is whether the server refuses writes. manual is set and
+// cleared through /admin/readonly; auto is set when a purchase finds Redis
+// refusing writes and cleared by readOnlyLoop once a probe write succeeds.
+type readOnlyState struct {
+	manual atomic.Bool
+	auto   atomic.Bool
+
+	mu     sync.Mutex
+	since  time.Time
+	reason string
+}
+
+func (ro *readOnlyState) active() bool {
+	return ro.manual.Load() || ro.auto.Load()
+}
+
+// enter records why the server went read only, unless it already was
+func (ro *readOnlyState) enter(wasActive bool, reason string) {
+	if wasActive {
+		return
+	}
+	ro.mu.Lock()
+	ro.since = time.Now()
+	ro.reason = reason
+	ro.mu.Unlock()
+}
+
+// readOnly reports whether writes are refused
+func (s *Server) readOnly() bool {
+	return s.ro.active()
+}
+
+// reads is the store queries use: the replica while read only, if
+// REDIS_REPLICA_ADDR is set, since the primary may be gone altogether
+func (s *Server) reads() store.Store {
+	if s.replica != nil && s.readOnly() {
+		return s.replica
+	}
+	return s.store
+}
+
+// readOnlyResponse answers a write frame in read only mode
+func (s *Server) readOnlyResponse(c codec) []byte {
+	s.metrics.readOnlyRejected.Inc()
+	data, _ := c.Marshal(PurchaseResponse{
+		Status: protocol.STATUS_READ_ONLY,
+		Error:  readOnlyError,
+	})
+	return data
+}
+
+// noteWriteError switches to read only mode when a purchase failed because
+// Redis answered and refused the write. Timeouts and an unreachable Redis
+// say nothing about whether it takes writes; the circuit breaker handles
+// those once they are frequent enough.
+func (s *Server) noteWriteError(err error) {
+	if s.opts.ReadOnlyProbeInterval == 0 || !isWriteRefusedError(err) {
+		return
+	}
+
+	was := s.ro.active()
+	if s.ro.auto.Swap(true) {
+		return
+	}
+	s.ro.enter(was, err.Error())
+	s.metrics.readOnly.Set(1)
+	log.Printf("WARNING: Redis write failed, read only mode until it takes writes again: %v", err)
+}
+
+// isWriteRefusedError reports whether Redis answered but refused to write:
+// a primary demoted to replica, a failing persistence or a full memory
+func isWriteRefusedError(err error) bool {
+	return redis.IsReadOnlyError(err) ||
+		redis.IsOOMError(err) ||
+		redis.HasErrorPrefix(err, "MISCONF") ||
+		redis.HasErrorPrefix(err, "NOREPLICAS")
+}
+
+// readOnlyLoop tries a write every READ_ONLY_PROBE_INTERVAL while the
+// server is read only on its own, and leaves read only mode once Redis
+// takes it
+func (s *Server) readOnlyLoop() {
+	defer s.wg.Done()
+
+	ctx := withCommandTags(s.ctx, "none", "read_only_probe")
+	ticker := time.NewTicker(s.opts.ReadOnlyProbeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if !s.ro.auto.Load() {
+			continue
+		}
+
+		node := strconv.FormatInt(s.opts.NodeID, 10)
+		if err := s.redis.Set(ctx, readOnlyProbeKey, node, 10*time.Second).Err(); err != nil {
+			continue
+		}
+		s.ro.auto.Store(false)
+		if !s.ro.manual.Load() {
+			s.metrics.readOnly.Set(0)
+		}
+		log.Printf("Redis takes writes again, leaving read only mode")
+	}
+}
+
+// readOnlyStatus is the /admin/readonly view of the server
+type readOnlyStatus struct {
+	ReadOnly bool `json:"read_only"`
+	// Manual is set through this endpoint; Automatic is set on a refused
+	// write and clears on its own
+	Manual    bool   `json:"manual"`
+	Automatic bool   `json:"automatic"`
+	Since     int64  `json:"since,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+	Replica   bool   `json:"replica"`
+}
+
+// handleReadOnly serves /admin/readonly: GET reports whether the server
+// is read only and why, POST makes it read only until DELETE. DELETE also
+// clears automatic read only mode, which the next refused write sets
+// again. It needs ADMIN_TOKEN as a bearer token.
+func (s *Server) handleReadOnly(w http.ResponseWriter, r *http.Request) {
+	if !s.adminAuthorized(w, r) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		was := s.ro.active()
+		if !s.ro.manual.Swap(true) {
+			s.ro.enter(was, "set by operator")
+			s.metrics.readOnly.Set(1)
+			log.Printf("Read only mode set by operator, purchases are refused")
+		}
+	case http.MethodDelete:
+		manual, auto := s.ro.manual.Swap(false), s.ro.auto.Swap(false)
+		if manual || auto {
+			s.metrics.readOnly.Set(0)
+			log.Printf("Read only mode cleared by operator, accepting purchases")
+		}
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	status := readOnlyStatus{
+		ReadOnly:  s.ro.active(),
+		Manual:    s.ro.manual.Load(),
+		Automatic: s.ro.auto.Load(),
+		Replica:   s.replica != nil,
+	}
+	if status.ReadOnly {
+		s.ro.mu.Lock()
+		status.Since, status.Reason = s.ro.since.Unix(), s.ro.reason
+		s.ro.mu.Unlock()
+	}
+	writeJSON(w, http.StatusOK, status)
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+
+	"chha/internal/config"
+)
+
+// newReadOnlyServer is just enough of a Server for the read only state
+func newReadOnlyServer() *Server {
+	return &Server{
+		opts:    config.Server{ReadOnlyProbeInterval: time.Second},
+		metrics: newMetrics("test"),
+		ro:      &readOnlyState{},
+	}
+}
+
+// refusedError is the error Redis answers a write with, taken from
+// miniredis so it is parsed as go-redis parses the real one
+func refusedError(t *testing.T, msg string) error {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	mr.SetError(msg)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr(), MaxRetries: -1})
+	defer rdb.Close()
+	err := rdb.Set(context.Background(), "k", "v", 0).Err()
+	if err == nil {
+		t.Fatal("write succeeded")
+	}
+	return fmt.Errorf("redis error: %w", err)
+}
+
+func TestNoteWriteErrorTimeout(t *testing.T) {
+	s := newReadOnlyServer()
+	s.noteWriteError(fmt.Errorf("redis error: %w", context.DeadlineExceeded))
+	if s.ro.auto.Load() {
+		t.Fatal("a timed out eval switched the server to read only")
+	}
+}
+
+func TestNoteWriteErrorUnreachable(t *testing.T) {
+	mr := miniredis.RunT(t)
+	addr := mr.Addr()
+	mr.Close()
+	rdb := redis.NewClient(&redis.Options{Addr: addr, MaxRetries: -1})
+	defer rdb.Close()
+	err := rdb.Set(context.Background(), "k", "v", 0).Err()
+	if err == nil {
+		t.Fatal("write to a closed Redis succeeded")
+	}
+
+	s := newReadOnlyServer()
+	s.noteWriteError(fmt.Errorf("redis error: %w", err))
+	if s.ro.auto.Load() {
+		t.Fatalf("an unreachable Redis (%v) switched the server to read only", err)
+	}
+}
+
+func TestNoteWriteErrorRefused(t *testing.T) {
+	for _, msg := range []string{
+		"READONLY You can't write against a read only replica.",
+		"OOM command not allowed when used memory > 'maxmemory'.",
+		"MISCONF Redis is configured to save RDB snapshots, but it's currently unable to persist to disk.",
+		"NOREPLICAS Not enough good replicas to write.",
+	} {
+		s := newReadOnlyServer()
+		s.noteWriteError(refusedError(t, msg))
+		if !s.ro.auto.Load() || !s.readOnly() {
+			t.Errorf("%q did not switch the server to read only", msg)
+		}
+	}
+}
+
+func TestNoteWriteErrorProbeOff(t *testing.T) {
+	s := newReadOnlyServer()
+	s.opts.ReadOnlyProbeInterval = 0
+	s.noteWriteError(refusedError(t, "READONLY You can't write against a read only replica."))
+	if s.ro.auto.Load() {
+		t.Fatal("switched to read only with READ_ONLY_PROBE_INTERVAL=0")
+	}
+}
+
+// TestReadOnlyLoop stays read only while Redis refuses writes and leaves
+// read only mode once the probe write goes through
+func TestReadOnlyLoop(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr(), MaxRetries: -1})
+	defer rdb.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := newReadOnlyServer()
+	s.opts.ReadOnlyProbeInterval = 10 * time.Millisecond
+	s.redis, s.ctx = rdb, ctx
+
+	s.noteWriteError(refusedError(t, "READONLY You can't write against a read only replica."))
+	mr.SetError("READONLY You can't write against a read only replica.")
+	s.wg.Add(1)
+	go s.readOnlyLoop()
+	defer func() {
+		cancel()
+		s.wg.Wait()
+	}()
+
+	time.Sleep(5 * s.opts.ReadOnlyProbeInterval)
+	if !s.readOnly() {
+		t.Fatal("left read only mode while Redis refuses writes")
+	}
+
+	mr.SetError("")
+	deadline := time.Now().Add(5 * time.Second)
+	for s.readOnly() {
+		if time.Now().After(deadline) {
+			t.Fatal("still read only after Redis took writes again")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if v, err := rdb.Get(context.Background(), readOnlyProbeKey).Result(); err != nil || v != "0" {
+		t.Fatalf("probe key %q, %v, want the node ID", v, err)
+	}
+}
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	redisMaxRetries      = 3
+	redisMinRetryBackoff = 8 * time.Millisecond
+	redisMaxRetryBackoff = 512 * time.Millisecond
+	redisSlowCommand     = 50 * time.Millisecond
+)
+
+// commandTags identifies which product and server operation a Redis
+// command was issued for
+type commandTags struct {
+	product   string
+	operation string
+}
+
+type commandTagsKey struct{}
+
+// withCommandTags attaches product/operation tags to every Redis command
+// issued with the returned context
+func withCommandTags(ctx context.Context, product, operation string) context.Context {
+	return context.WithValue(ctx, commandTagsKey{}, commandTags{product: product, operation: operation})
+}
+
+// tagsFromContext returns the command tags on ctx, or "none" placeholders
+func tagsFromContext(ctx context.Context) commandTags {
+	if tags, ok := ctx.Value(commandTagsKey{}).(commandTags); ok {
+		return tags
+	}
+	return commandTags{product: "none", operation: "none"}
+}
+
+// redisHook instruments every command sent through the Redis client. It
+// also owns retrying: go-redis retries below the hook chain where attempts
+// are invisible, so the client is created with retries disabled and the
+// hook retries only errors that guarantee the command never ran.
+type redisHook struct {
+	metrics *Metrics
+}
+
+var _ redis.Hook = (*redisHook)(nil)
+
+func (h *redisHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (h *redisHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		tags := tagsFromContext(ctx)
+		name := cmd.Name()
+
+		start := time.Now()
+		err := h.process(ctx, name, func() error { return next(ctx, cmd) })
+		elapsed := time.Since(start)
+
+		h.observe(ctx, tags, name, elapsed, err)
+		if elapsed >= redisSlowCommand {
+			trace := ""
+			if id := traceIDFromContext(ctx); id != "" {
+				trace = " trace=" + id
+			}
+			log.Printf("Slow redis command: cmd=%s product=%s op=%s took=%v err=%v%s",
+				name, tags.product, tags.operation, elapsed, err, trace)
+		}
+		return err
+	}
+}
+
+func (h *redisHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		tags := tagsFromContext(ctx)
+
+		start := time.Now()
+		err := h.process(ctx, "pipeline", func() error { return next(ctx, cmds) })
+		h.observe(ctx, tags, "pipeline", time.Since(start), err)
+		return err
+	}
+}
+
+// process runs fn, retrying with jittered exponential backoff while the
+// error is safe to retry
+func (h *redisHook) process(ctx context.Context, name string, fn func() error) error {
+	var err error
+	for attempt := 0; attempt <= redisMaxRetries; attempt++ {
+		if attempt > 0 {
+			h.metrics.redisRetries.WithLabelValues(name).Inc()
+			if sleepErr := sleepCtx(ctx, retryBackoff(attempt)); sleepErr != nil {
+				return err
+			}
+		}
+
+		err = fn()
+		if err == nil || !isRetryableRedisError(err) {
+			return err
+		}
+	}
+	return err
+}
+
+// observe records latency and error classification for one command
+func (h *redisHook) observe(ctx context.Context, tags commandTags, name string, elapsed time.Duration, err error) {
+	observeTraced(ctx, h.metrics.redisCommandDuration.
+		WithLabelValues(name, tags.operation, h.metrics.productLabels.label(tags.product)),
+		elapsed.Seconds())
+
+	if err == nil || err == redis.Nil {
+		return
+	}
+
+	h.metrics.redisErrors.WithLabelValues(name, tags.operation).Inc()
+	if isTimeoutError(err) {
+		h.metrics.redisTimeouts.WithLabelValues(name, tags.operation).Inc()
+	}
+}
+
+// isRetryableRedisError reports whether err means the command was rejected
+// before Redis executed it, so sending it again cannot apply it twice
+func isRetryableRedisError(err error) bool {
+	if errors.Is(err, redis.ErrPoolTimeout) {
+		return true
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+
+	return redis.IsLoadingError(err) ||
+		redis.IsTryAgainError(err) ||
+		redis.IsMasterDownError(err) ||
+		redis.IsClusterDownError(err) ||
+		redis.IsMaxClientsError(err)
+}
+
+// isTimeoutError reports whether err is a network or context timeout
+func isTimeoutError(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return strings.Contains(err.Error(), "i/o timeout")
+}
+
+// retryBackoff returns the jittered delay before the given retry attempt
+func retryBackoff(attempt int) time.Duration {
+	backoff := redisMinRetryBackoff << uint(attempt-1)
+	if backoff > redisMaxRetryBackoff || backoff <= 0 {
+		backoff = redisMaxRetryBackoff
+	}
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+// sleepCtx sleeps for d or until ctx is done
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"chha/internal/config"
+)
+
+// liveConfig holds the settings that can change while the server runs.
+// Fields carry the env tag of the config.Server setting they come from.
+type liveConfig struct {
+	UserRateLimit    int64         `env:"USER_RATE_LIMIT"`
+	UserRateWindow   time.Duration `env:"USER_RATE_WINDOW"`
+	AgentRateLimit   int64         `env:"AGENT_RATE_LIMIT"`
+	AgentRateWindow  time.Duration `env:"AGENT_RATE_WINDOW"`
+	ConnReadTimeout  time.Duration `env:"CONN_READ_TIMEOUT"`
+	ConnWriteTimeout time.Duration `env:"CONN_WRITE_TIMEOUT"`
+	ConnIdleTimeout  time.Duration `env:"CONN_IDLE_TIMEOUT"`
+	MaxConnections   int           `env:"MAX_CONNECTIONS"`
+	LogLevel         string        `env:"LOG_LEVEL"`
+}
+
+func newLiveConfig(opts config.Server) *liveConfig {
+	return &liveConfig{
+		UserRateLimit:    opts.UserRateLimit,
+		UserRateWindow:   opts.UserRateWindow,
+		AgentRateLimit:   opts.AgentRateLimit,
+		AgentRateWindow:  opts.AgentRateWindow,
+		ConnReadTimeout:  opts.ConnReadTimeout,
+		ConnWriteTimeout: opts.ConnWriteTimeout,
+		ConnIdleTimeout:  opts.ConnIdleTimeout,
+		MaxConnections:   opts.MaxConnections,
+		LogLevel:         opts.LogLevel,
+	}
+}
+
+// config returns the live settings, safe to call from any goroutine
+func (s *Server) config() *liveConfig {
+	return s.live.Load()
+}
+
+// debugf logs only with LOG_LEVEL=debug
+func (s *Server) debugf(format string, args ...interface{}) {
+	if s.config().LogLevel == "debug" {
+		log.Printf(format, args...)
+	}
+}
+
+// Reload reads the configuration again, from the environment and the
+// -config file, and applies the settings in liveConfig. Open connections
+// are kept. Other settings that changed are reported but only take
+// effect on restart.
+func (s *Server) Reload() ([]string, error) {
+	var opts config.Server
+	if err := config.LoadFile(&opts, s.configFile); err != nil {
+		return nil, err
+	}
+
+	next := newLiveConfig(opts)
+	changed := diffSettings(s.config(), next)
+	s.live.Store(next)
+	if len(changed) > 0 {
+		log.Printf("Configuration reloaded: %s", strings.Join(changed, ", "))
+	} else {
+		log.Printf("Configuration reloaded, nothing changed")
+	}
+
+	// Everything not in liveConfig was fixed at start-up
+	live := make(map[string]bool)
+	t := reflect.TypeOf(liveConfig{})
+	for i := 0; i < t.NumField(); i++ {
+		live[t.Field(i).Tag.Get("env")] = true
+	}
+	var pending []string
+	for _, key := range diffKeys(&s.opts, &opts) {
+		if !live[key] {
+			pending = append(pending, key)
+		}
+	}
+	if len(pending) > 0 {
+		log.Printf("WARNING: %s changed, restart to apply", strings.Join(pending, ", "))
+	}
+	return changed, nil
+}
+
+// diffSettings lists the settings of b that differ from a, as KEY=value
+func diffSettings(a, b *liveConfig) []string {
+	va, vb := reflect.ValueOf(a).Elem(), reflect.ValueOf(b).Elem()
+	var changed []string
+	for i := 0; i < va.NumField(); i++ {
+		if va.Field(i).Interface() != vb.Field(i).Interface() {
+			changed = append(changed, fmt.Sprintf("%s=%v", va.Type().Field(i).Tag.Get("env"), vb.Field(i).Interface()))
+		}
+	}
+	return changed
+}
+
+// diffKeys lists the env keys of the config.Server settings that differ
+func diffKeys(a, b *config.Server) []string {
+	va, vb := reflect.ValueOf(a).Elem(), reflect.ValueOf(b).Elem()
+	var keys []string
+	for i := 0; i < va.NumField(); i++ {
+		key := va.Type().Field(i).Tag.Get("env")
+		if key != "" && va.Field(i).Interface() != vb.Field(i).Interface() {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// handleReload serves POST /admin/reload, the same as sending SIGHUP. It
+// needs ADMIN_TOKEN as a bearer token.
+func (s *Server) handleReload(w http.ResponseWriter, r *http.Request) {
+	if !s.adminAuthorized(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	changed, err := s.Reload()
+	if err != nil {
+		log.Printf("Configuration reload failed, keeping the current settings: %v", err)
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if changed == nil {
+		changed = []string{}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"changed": changed,
+	})
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"log"
+	"time"
+
+	"chha/internal/store"
+	"chha/pkg/protocol"
+)
+
+// ReserveRequest holds a unit for an external checkout. It is checked like
+// a purchase, and its PENDING order is the reservation, committed with
+// MSG_COMMIT or given back with MSG_RELEASE.
+type ReserveRequest struct {
+	PurchaseRequest
+	// TTLSeconds shortens the hold below RESERVATION_TTL, which it cannot
+	// exceed; 0 holds for RESERVATION_TTL
+	TTLSeconds int64 `json:"ttl_seconds,omitempty"`
+}
+
+// ReleaseRequest gives a reserved unit back before its hold ends
+type ReleaseRequest struct {
+	OrderID string `json:"order_id"`
+	UserID  string `json:"user_id"`
+	// AuthToken is a JWT issued to UserID, required when auth is enabled
+	// and the session is not bound to the user
+	AuthToken string `json:"auth_token,omitempty"`
+}
+
+// handleReserve serves MSG_RESERVE. The answer is that of a purchase, with
+// the order ID naming the reservation and the payment deadline its end.
+func (s *Server) handleReserve(sess *session, c codec, payload []byte) []byte {
+	if _, ok := s.store.(store.Reserver); !ok || s.opts.ReservationTTL <= 0 {
+		data, _ := c.Marshal(PurchaseResponse{Status: protocol.STATUS_ERROR, Error: "reservations are disabled"})
+		return data
+	}
+
+	var req ReserveRequest
+	if err := c.Unmarshal(payload, &req); err != nil {
+		data, _ := c.Marshal(PurchaseResponse{Status: protocol.STATUS_ERROR, Error: "invalid json"})
+		return data
+	}
+	if req.TTLSeconds < 0 {
+		data, _ := c.Marshal(PurchaseResponse{Status: protocol.STATUS_ERROR, Error: "ttl_seconds must not be negative"})
+		return data
+	}
+
+	ttl := s.opts.ReservationTTL
+	if req.TTLSeconds > 0 && req.TTLSeconds < int64(ttl/time.Second) {
+		ttl = time.Duration(req.TTLSeconds) * time.Second
+	}
+	return s.attemptPurchase(sess, c, payload, ttl)
+}
+
+// handleRelease serves MSG_RELEASE, putting the unit of a reservation
+// back on sale or granting it to the next waitlisted user
+func (s *Server) handleRelease(sess *session, c codec, payload []byte) []byte {
+	reserver, ok := s.store.(store.Reserver)
+	if !ok {
+		data, _ := c.Marshal(PurchaseResponse{Status: protocol.STATUS_ERROR, Error: "reservations are disabled"})
+		return data
+	}
+
+	var req ReleaseRequest
+	if err := c.Unmarshal(payload, &req); err != nil {
+		data, _ := c.Marshal(PurchaseResponse{Status: protocol.STATUS_ERROR, Error: "invalid json"})
+		return data
+	}
+	user, bound, err := s.sessionUser(sess, req.UserID)
+	if err != nil {
+		data, _ := c.Marshal(PurchaseResponse{Status: protocol.STATUS_ERROR, Error: err.Error()})
+		return data
+	}
+	req.UserID = user
+	if req.OrderID == "" || req.UserID == "" {
+		data, _ := c.Marshal(PurchaseResponse{Status: protocol.STATUS_ERROR, Error: "missing order_id or user_id"})
+		return data
+	}
+	if err := s.authorizeUser(req.AuthToken, req.UserID, bound); err != nil {
+		data, _ := c.Marshal(PurchaseResponse{Status: protocol.STATUS_ERROR, OrderID: req.OrderID, Error: err.Error()})
+		return data
+	}
+
+	ctx := withCommandTags(s.ctx, "none", "release")
+	order, result, err := reserver.ReleaseReservation(ctx, req.OrderID, req.UserID)
+	if err != nil {
+		data, _ := c.Marshal(PurchaseResponse{
+			Status:  protocol.STATUS_ERROR,
+			OrderID: req.OrderID,
+			Error:   err.Error(),
+		})
+		return data
+	}
+
+	s.metrics.reservationsReleased.Inc()
+	log.Printf("Reservation released: product=%s user=%s order=%s", order.ProductID, order.UserID, order.ID)
+	go s.emitEvent(order.ProductID, true, map[string]interface{}{
+		"type":            "purchase_cancelled",
+		"product_id":      order.ProductID,
+		"buyer":           order.UserID,
+		"order_id":        order.ID,
+		"status":          store.OrderCancelled,
+		"previous_status": result.Previous,
+		"remaining":       result.Remaining,
+		"timestamp":       time.Now().Unix(),
+	})
+	if result.Grant != nil {
+		go s.publishWaitlistGrant(order.ID, result.Grant)
+	}
+
+	data, _ := c.Marshal(PurchaseResponse{
+		Status:         protocol.STATUS_SUCCESS,
+		RemainingStock: result.Remaining,
+		OrderID:        order.ID,
+	})
+	return data
+}
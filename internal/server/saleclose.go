@@ -0,0 +1,53 @@
+package server
+
+import (
+	"log"
+	"time"
+
+	"chha/internal/store"
+)
+
+const (
+	saleCloseInterval = time.Second
+	saleCloseBatch    = 100
+)
+
+// saleCloseLoop closes sales once their end passes: their remaining stock
+// is frozen and a sale_closed event published. Only the cluster leader
+// closes; closing is atomic per product, so overlapping leaders close each
+// sale once.
+func (s *Server) saleCloseLoop(closer store.SaleCloser) {
+	defer s.wg.Done()
+
+	ctx := withCommandTags(s.ctx, "none", "sale_close")
+	ticker := time.NewTicker(saleCloseInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if !s.isLeader() {
+			continue
+		}
+
+		closed, err := closer.CloseEndedSales(ctx, time.Now(), saleCloseBatch)
+		if err != nil {
+			log.Printf("Sale closer failed: %v", err)
+		}
+		for _, sale := range closed {
+			s.metrics.salesClosed.Inc()
+			log.Printf("Sale of %s closed: %d units sold, %d left unsold", sale.ProductID, sale.Sold, sale.Remaining)
+			// The close script already recorded the event in the stream
+			s.emitEvent(sale.ProductID, false, map[string]interface{}{
+				"type":       "sale_closed",
+				"product_id": sale.ProductID,
+				"remaining":  sale.Remaining,
+				"sold":       sale.Sold,
+				"timestamp":  sale.ClosedAt.Unix(),
+			})
+		}
+	}
+}
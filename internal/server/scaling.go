@@ -0,0 +1,154 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"chha/internal/store"
+)
+
+// scaler turns the purchase attempt rate into a scaling hint. Every
+// SCALING_INTERVAL the attempts seen by this server are compared with
+// SCALING_CAPACITY, and the queue mode backlog with SCALING_QUEUE_DEPTH;
+// the larger share is the load. The hint is up once the load reaches
+// SCALING_THRESHOLD, so the fleet grows before it is saturated rather
+// than after.
+type scaler struct {
+	capacity   float64
+	queueDepth int64
+	threshold  float64
+	interval   time.Duration
+
+	attempts atomic.Int64
+	shed     atomic.Int64
+
+	mu   sync.Mutex
+	last scalingStatus
+}
+
+// scalingStatus is the latest sample, served at /scaling
+type scalingStatus struct {
+	// Load is the share of capacity in use, the value to scale on
+	Load float64 `json:"load"`
+	// ScaleUp is set while Load is at or over Threshold
+	ScaleUp     bool    `json:"scale_up"`
+	Threshold   float64 `json:"threshold"`
+	AttemptRate float64 `json:"attempt_rate"`
+	Capacity    float64 `json:"capacity"`
+	// ShedRatio is the share of attempts rejected by rate limits or load
+	// shedding
+	ShedRatio  float64 `json:"shed_ratio"`
+	QueueDepth int64   `json:"queue_depth"`
+	SampledAt  int64   `json:"sampled_at"`
+}
+
+func newScaler(capacity float64, queueDepth int64, threshold float64, interval time.Duration) *scaler {
+	return &scaler{
+		capacity:   capacity,
+		queueDepth: queueDepth,
+		threshold:  threshold,
+		interval:   interval,
+		last:       scalingStatus{Threshold: threshold, Capacity: capacity},
+	}
+}
+
+func (sc *scaler) status() scalingStatus {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.last
+}
+
+// scalingLoop samples the load every interval and announces changes of
+// the hint to the event sinks
+func (s *Server) scalingLoop() {
+	defer s.wg.Done()
+
+	sc := s.scaler
+	ctx := withCommandTags(s.ctx, "none", "scaling_sample")
+	ticker := time.NewTicker(sc.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		attempts, shed := sc.attempts.Swap(0), sc.shed.Swap(0)
+		st := scalingStatus{
+			Threshold:   sc.threshold,
+			Capacity:    sc.capacity,
+			AttemptRate: float64(attempts) / sc.interval.Seconds(),
+			SampledAt:   time.Now().Unix(),
+		}
+		st.Load = st.AttemptRate / sc.capacity
+		if attempts > 0 {
+			st.ShedRatio = float64(shed) / float64(attempts)
+		}
+		if q, ok := s.store.(store.Queue); ok && sc.queueDepth > 0 {
+			depth, err := q.QueueDepth(ctx)
+			if err != nil {
+				log.Printf("Failed to sample queue depth: %v", err)
+			}
+			st.QueueDepth = depth
+			st.Load = max(st.Load, float64(depth)/float64(sc.queueDepth))
+		}
+		st.ScaleUp = st.Load >= sc.threshold
+
+		sc.mu.Lock()
+		changed := st.ScaleUp != sc.last.ScaleUp
+		sc.last = st
+		sc.mu.Unlock()
+
+		s.metrics.scalingLoad.Set(st.Load)
+		s.metrics.scalingAttemptRate.Set(st.AttemptRate)
+		s.metrics.scalingShedRatio.Set(st.ShedRatio)
+		s.metrics.scalingQueueDepth.Set(float64(st.QueueDepth))
+		if st.ScaleUp {
+			s.metrics.scalingHint.Set(1)
+		} else {
+			s.metrics.scalingHint.Set(0)
+		}
+
+		if changed {
+			log.Printf("Scaling hint changed - scale_up: %v, load: %.2f, attempts/s: %.0f, queue depth: %d",
+				st.ScaleUp, st.Load, st.AttemptRate, st.QueueDepth)
+			s.publishScalingHint(st)
+		}
+	}
+}
+
+// publishScalingHint sends a scaling_hint event to the sinks. It is not
+// a sale event, so it skips the events stream.
+func (s *Server) publishScalingHint(st scalingStatus) {
+	event := map[string]interface{}{
+		"type":         "scaling_hint",
+		"scale_up":     st.ScaleUp,
+		"load":         st.Load,
+		"threshold":    st.Threshold,
+		"attempt_rate": st.AttemptRate,
+		"shed_ratio":   st.ShedRatio,
+		"queue_depth":  st.QueueDepth,
+		"node_id":      s.opts.NodeID,
+		"timestamp":    st.SampledAt,
+	}
+	s.publishToSinks("", event)
+}
+
+// handleScaling serves GET /scaling, shaped for the KEDA metrics-api
+// scaler: point valueLocation at "load" and target the threshold
+func (s *Server) handleScaling(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if s.scaler == nil {
+		writeJSONError(w, http.StatusNotFound, "scaling hints are disabled")
+		return
+	}
+	writeJSON(w, http.StatusOK, s.scaler.status())
+}
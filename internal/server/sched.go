@@ -0,0 +1,104 @@
+package server
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"chha/pkg/protocol"
+)
+
+// frameScheduler bounds how many frames are processed at once, across all
+// connections, to FRAME_WORKERS. A connection reads its next frame only
+// after answering the previous one, so it waits with at most one frame,
+// or CONN_MAX_IN_FLIGHT with request_ids. Handing each free worker to the
+// longest waiting frame therefore serves connections in turns: a gateway
+// pipelining thousands of frames gets a bounded share like any other
+// connection, and its backlog stays in its own socket.
+type frameScheduler struct {
+	mu      sync.Mutex
+	free    int
+	waiting []chan struct{}
+}
+
+func newFrameScheduler(workers int) *frameScheduler {
+	return &frameScheduler{free: workers}
+}
+
+// acquire waits for a worker. Every acquire must be followed by release.
+func (fs *frameScheduler) acquire() {
+	fs.tryAcquire(0)
+}
+
+// tryAcquire is acquire, unless limit is above 0 and that many frames are
+// waiting already; it reports whether it got a worker
+func (fs *frameScheduler) tryAcquire(limit int) bool {
+	fs.mu.Lock()
+	if fs.free > 0 && len(fs.waiting) == 0 {
+		fs.free--
+		fs.mu.Unlock()
+		return true
+	}
+	if limit > 0 && len(fs.waiting) >= limit {
+		fs.mu.Unlock()
+		return false
+	}
+	ready := make(chan struct{})
+	fs.waiting = append(fs.waiting, ready)
+	fs.mu.Unlock()
+	<-ready
+	return true
+}
+
+// release hands the worker to the connection that has waited longest
+func (fs *frameScheduler) release() {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if len(fs.waiting) == 0 {
+		fs.free++
+		return
+	}
+	ready := fs.waiting[0]
+	fs.waiting[0] = nil
+	fs.waiting = fs.waiting[1:]
+	close(ready)
+}
+
+// processFrame runs processMessage, on a worker when FRAME_WORKERS is set.
+// Past FRAME_QUEUE_LIMIT waiting frames, purchase attempts are answered
+// busy rather than waiting in line behind them.
+func (s *Server) processFrame(sess *session, c codec, msgType byte, payload []byte) []byte {
+	if s.frames == nil {
+		return s.processMessage(sess, c, msgType, payload)
+	}
+	start := time.Now()
+	limit := 0
+	switch msgType {
+	case protocol.MSG_ATTEMPT_PURCHASE, protocol.MSG_PURCHASE_BUNDLE, protocol.MSG_RESERVE:
+		limit = s.opts.FrameQueueLimit
+	}
+	if !s.frames.tryAcquire(limit) {
+		s.metrics.frameQueueRejected.Inc()
+		return s.shedResponse(sess, c)
+	}
+	defer s.frames.release()
+	s.metrics.frameWait.Observe(time.Since(start).Seconds())
+	return s.processMessage(sess, c, msgType, payload)
+}
+
+// startRequest handles a frame of a connection with request_ids in its own
+// goroutine, so the connection reads on while it runs. It waits for a free
+// slot first once CONN_MAX_IN_FLIGHT requests are running, leaving later
+// frames in the socket.
+func (s *Server) startRequest(sess *session, c codec, frame protocol.Frame, timing protocol.Timing) {
+	sess.inFlight <- struct{}{}
+	sess.opsWg.Add(1)
+	go func() {
+		defer sess.opsWg.Done()
+		defer func() { <-sess.inFlight }()
+		response := s.processFrame(sess, c, frame.Type, frame.Payload)
+		if err := sess.reply(s, frame.Type, c, response, frame.RequestID, timing); err != nil {
+			log.Printf("Write error to %s: %v", sess.conn.RemoteAddr(), err)
+		}
+	}()
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitForWaiting waits until n frames wait for a worker of fs
+func waitForWaiting(t *testing.T, fs *frameScheduler, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		fs.mu.Lock()
+		waiting := len(fs.waiting)
+		fs.mu.Unlock()
+		if waiting >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d frames waiting, want %d", waiting, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestFrameSchedulerTurns pipelines frames from one connection on a single
+// worker while another connection sends one frame. The second connection
+// must be served as soon as the frame in progress is done, not after the
+// whole pipeline.
+func TestFrameSchedulerTurns(t *testing.T) {
+	const pipelined = 100
+	fs := newFrameScheduler(1)
+
+	var mu sync.Mutex
+	var served []string
+	serve := func(conn string) {
+		mu.Lock()
+		served = append(served, conn)
+		mu.Unlock()
+	}
+
+	started := make(chan struct{})
+	queued := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		// A connection reads its next frame only after answering the
+		// previous one, so it acquires once per frame
+		for i := 0; i < pipelined; i++ {
+			fs.acquire()
+			serve("pipeline")
+			if i == 0 {
+				close(started)
+				<-queued
+			}
+			fs.release()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		<-started
+		fs.acquire()
+		serve("single")
+		fs.release()
+	}()
+
+	<-started
+	waitForWaiting(t, fs, 1)
+	close(queued)
+	wg.Wait()
+
+	if len(served) != pipelined+1 {
+		t.Fatalf("served %d frames, want %d", len(served), pipelined+1)
+	}
+	for i, conn := range served {
+		if conn == "single" {
+			if i != 1 {
+				t.Fatalf("single frame served after %d pipelined frames, want 1", i)
+			}
+			return
+		}
+	}
+	t.Fatal("single frame never served")
+}
+
+// TestFrameSchedulerQueueLimit refuses frames past the waiting limit
+// without taking a worker
+func TestFrameSchedulerQueueLimit(t *testing.T) {
+	fs := newFrameScheduler(1)
+	fs.acquire()
+
+	done := make(chan bool)
+	go func() { done <- fs.tryAcquire(1) }()
+	waitForWaiting(t, fs, 1)
+
+	if fs.tryAcquire(1) {
+		t.Fatal("tryAcquire past the limit got a worker")
+	}
+
+	fs.release()
+	if !<-done {
+		t.Fatal("waiting frame did not get the released worker")
+	}
+	fs.release()
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.free != 1 || len(fs.waiting) != 0 {
+		t.Fatalf("free = %d with %d waiting, want 1 with 0", fs.free, len(fs.waiting))
+	}
+}
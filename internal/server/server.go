@@ -0,0 +1,1385 @@
+// Package server is the flash sale TCP server: the purchase protocol, the
+// admin and metrics HTTP endpoints and the background jobs around the
+// store. cmd/server runs it; cmd/demo embeds it.
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/redis/go-redis/v9"
+
+	"chha/internal/auth"
+	"chha/internal/buildinfo"
+	"chha/internal/cluster"
+	"chha/internal/config"
+	"chha/internal/eventschema"
+	"chha/internal/snowflake"
+	"chha/internal/store"
+	"chha/pkg/protocol"
+)
+
+const (
+	// Event destinations
+	EVENTS_STREAM  = store.EventsStream
+	EVENTS_CHANNEL = "flashsale_events"
+)
+
+// PurchaseRequest represents a purchase attempt
+type PurchaseRequest struct {
+	ProductID string `json:"product_id"`
+	UserID    string `json:"user_id"`
+	// AuthToken is a JWT issued to UserID, required when auth is enabled
+	AuthToken string `json:"auth_token,omitempty"`
+	// AgentToken replaces AuthToken when a partner agent buys on behalf
+	// of UserID
+	AgentToken string `json:"agent_token,omitempty"`
+	// PoWChallenge and PoWSolution answer MSG_CHALLENGE, required when
+	// proof of work is enforced
+	PoWChallenge string `json:"pow_challenge,omitempty"`
+	PoWSolution  string `json:"pow_solution,omitempty"`
+	// Traceparent is the W3C trace context of the attempt, if the client
+	// traces it; its trace ID becomes the exemplar of the latencies
+	Traceparent string `json:"traceparent,omitempty"`
+	// IdempotencyKey, when set, makes the attempt safe to retry: a later
+	// attempt of the user with the same key gets this one's response
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+	// VerificationToken is checked by the server's verifier, e.g. a
+	// captcha response, when one is configured
+	VerificationToken string `json:"verification_token,omitempty"`
+}
+
+// PurchaseResponse represents the result of a purchase attempt
+type PurchaseResponse struct {
+	Status         string `json:"status"`
+	RemainingStock int64  `json:"remaining_stock,omitempty"`
+	OrderID        string `json:"order_id,omitempty"`
+	// PaymentDeadline is the Unix time by which a PENDING order must be
+	// confirmed with MSG_CONFIRM_PAYMENT, or a reservation committed
+	PaymentDeadline int64  `json:"payment_deadline,omitempty"`
+	Error           string `json:"error,omitempty"`
+	// Provisional marks a purchase granted from overdraft while Redis was
+	// degraded; it may still be cancelled during reconciliation
+	Provisional bool `json:"provisional,omitempty"`
+	// RetryAfterMs is set with STATUS_RATE_LIMITED and STATUS_BUSY
+	RetryAfterMs int64 `json:"retry_after_ms,omitempty"`
+	// QueuePosition is set with STATUS_QUEUED; 1 is next in line
+	QueuePosition int64 `json:"queue_position,omitempty"`
+	// WaitlistPosition is set with STATUS_SOLD_OUT when the user joined the
+	// waitlist; 1 is next in line
+	WaitlistPosition int64 `json:"waitlist_position,omitempty"`
+	// Held marks a purchase held for manual review: the unit is reserved,
+	// but the order cannot be paid until it is approved
+	Held bool `json:"held,omitempty"`
+	// Replayed marks the saved response of an earlier attempt with the
+	// same idempotency key
+	Replayed bool `json:"replayed,omitempty"`
+}
+
+// Server manages the flash sale engine
+type Server struct {
+	redis    *redis.Client
+	store    store.Store
+	listener net.Listener
+	wg       sync.WaitGroup
+	ctx      context.Context
+	cancel   context.CancelFunc
+	luaHash  string
+	metrics  *Metrics
+	httpSrv  *http.Server
+	opts     config.Server
+
+	// debugSrv is nil unless DEBUG_ADDR is set
+	debugSrv *http.Server
+	// scriptCluster is nil unless REDIS_CLUSTER_ADDRS is set
+	scriptCluster *redis.ClusterClient
+
+	// overdraft is nil unless OverdraftPercent is set
+	overdraft *Overdraft
+	// sinks receive every emitted event, e.g. Kafka
+	sinks []eventSink
+	// schemaCheck is nil unless EVENT_SCHEMA_REGISTRY_URL is set
+	schemaCheck *schemaCheck
+	// catalog serves MSG_LIST_PRODUCTS from a short-lived cache
+	catalog *catalog
+	// connPath does connection I/O, see netpath.go
+	connPath connPath
+	// parker is nil unless CONN_EPOLL is set, see connpark.go
+	parker connParker
+	// auth is nil unless AUTH_HMAC_SECRET or AUTH_JWKS_URL is set
+	auth *auth.Verifier
+	// pow is nil unless POW_DIFFICULTY is set
+	pow *powIssuer
+	// queueWaiters are connections waiting for queued purchases
+	queueWaiters *queueWaiters
+	// events are the connections that asked for MSG_EVENT
+	events *eventHub
+	// drain tracks open connections for /admin/drain
+	drain *drainState
+	// tlsConfig is nil unless TLS_CERT_FILE is set
+	tlsConfig *tls.Config
+	// quicListener is nil unless QUIC_ADDR is set
+	quicListener *quic.Listener
+	// scaler is nil unless SCALING_CAPACITY is set
+	scaler *scaler
+	// shedder is nil unless LOAD_SHED_INFLIGHT is set
+	shedder *shedder
+	// frames is nil unless FRAME_WORKERS is set
+	frames *frameScheduler
+	// soldOut is nil unless SOLD_OUT_CACHE_TTL is set
+	soldOut *soldOutCache
+	// blocks is nil unless the store keeps a blocklist
+	blocks *blocklist
+	// verifier is nil unless VERIFY_URL is set or SetVerifier was called,
+	// and verified unless VERIFY_CACHE_TTL is set too
+	verifier PurchaseVerifier
+	verified *verifyCache
+	// breaker is nil unless BREAKER_ERROR_RATE is set
+	breaker *circuitBreaker
+	// cluster is nil unless CLUSTER_TTL is set
+	cluster *cluster.Member
+	// ro is whether purchases are refused, see readonly.go; tenants share
+	// it with the server hosting them
+	ro *readOnlyState
+	// replica is nil unless REDIS_REPLICA_ADDR is set
+	replica store.Store
+
+	// live holds the settings Reload can change, see reload.go
+	live atomic.Pointer[liveConfig]
+	// configFile is the -config file Reload reads again
+	configFile string
+
+	// tenants are the servers of the tenants this one hosts, nil for a
+	// tenant's own server, see tenant.go
+	tenants map[string]*Server
+	// tenant is set on a tenant's server, whose keys, streams and
+	// channels all start with keyPrefix
+	tenant    *tenantState
+	keyPrefix string
+}
+
+// NewServer creates a new flash sale server. configFile is where opts were
+// loaded from, if anywhere, for Reload.
+func NewServer(opts config.Server, configFile string) (*Server, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	metrics := newMetrics(opts.MetricsNamespace)
+	if opts.MetricsProductLabels > 0 {
+		metrics.capProductLabels(opts.MetricsProductLabels)
+	}
+
+	// Connect to Redis. Retries are handled by redisHook so they can be
+	// counted, hence MaxRetries -1 disables the built-in retry loop.
+	redisOpts := &redis.Options{
+		Addr:         opts.RedisAddr,
+		Password:     opts.RedisPassword,
+		DB:           opts.RedisDB,
+		PoolSize:     opts.RedisPoolSize,
+		MinIdleConns: opts.RedisMinIdleConns,
+		DialTimeout:  opts.RedisDialTimeout,
+		ReadTimeout:  opts.RedisReadTimeout,
+		WriteTimeout: opts.RedisWriteTimeout,
+		MaxRetries:   -1,
+		// Context deadlines such as REDIS_EVAL_TIMEOUT cut reads short
+		ContextTimeoutEnabled: true,
+	}
+	if opts.RedisTLS {
+		redisOpts.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	rdb := redis.NewClient(redisOpts)
+	rdb.AddHook(&redisHook{metrics: metrics})
+
+	// Test connection
+	if err := rdb.Ping(ctx).Err(); err != nil {
+		cancel()
+		return nil, fmt.Errorf("redis connection failed: %w", err)
+	}
+
+	// Only the script check goes to the cluster's masters directly
+	var scriptCluster *redis.ClusterClient
+	if opts.RedisClusterAddrs != "" {
+		scriptCluster = redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:        strings.Split(opts.RedisClusterAddrs, ","),
+			Password:     opts.RedisPassword,
+			DialTimeout:  opts.RedisDialTimeout,
+			ReadTimeout:  opts.RedisReadTimeout,
+			WriteTimeout: opts.RedisWriteTimeout,
+			TLSConfig:    redisOpts.TLSConfig,
+			PoolSize:     2,
+		})
+	}
+
+	orderIDs, err := snowflake.New(opts.NodeID)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	// Load Lua script
+	storeOpts := store.RedisStoreOptions{
+		EventsMaxLen:     opts.EventsStreamMaxLen,
+		StrictWaitAOF:    opts.StrictWaitAOF,
+		OrderIDs:         orderIDs,
+		PaymentTTL:       opts.PaymentTTL,
+		ValueCodec:       store.ValueCodecs[opts.ValueCodec],
+		WaitlistSize:     opts.WaitlistSize,
+		BatchWindow:      opts.PurchaseBatchWindow,
+		BatchMax:         opts.PurchaseBatchMax,
+		Allotment:        opts.StockAllotment,
+		AllotmentNode:    strconv.FormatInt(opts.NodeID, 10),
+		AllotmentJournal: opts.StockAllotmentJournal,
+		ScriptCluster:    scriptCluster,
+		CallTimeout:      opts.RedisEvalTimeout,
+		OnBatch: func(size int) {
+			metrics.purchaseBatchSize.Observe(float64(size))
+		},
+	}
+	rs, err := store.NewRedisStore(withCommandTags(ctx, "none", "script_load"), rdb, storeOpts)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	// A replica that is down is no reason not to start; queries then keep
+	// reading from the primary
+	var replica store.Store
+	if opts.RedisReplicaAddr != "" {
+		replicaOpts := *redisOpts
+		replicaOpts.Addr = opts.RedisReplicaAddr
+		replicaOpts.MinIdleConns = 0
+		rr := redis.NewClient(&replicaOpts)
+		rr.AddHook(&redisHook{metrics: metrics})
+		replica, err = store.NewRedisStore(withCommandTags(ctx, "none", "script_load"), rr, store.RedisStoreOptions{
+			OrderIDs:   orderIDs,
+			PaymentTTL: opts.PaymentTTL,
+			ValueCodec: store.ValueCodecs[opts.ValueCodec],
+		})
+		if err != nil {
+			log.Printf("WARNING: Redis replica %s unavailable, read only mode reads from the primary: %v", opts.RedisReplicaAddr, err)
+			rr.Close()
+			replica = nil
+		}
+	}
+
+	verifier, err := newPurchaseAuth(ctx, opts)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	pow, err := newPurchasePoW(opts)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	var overdraft *Overdraft
+	if opts.OverdraftPercent > 0 {
+		overdraft, err = newOverdraft(opts.OverdraftPercent, opts.OverdraftJournal)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		log.Printf("WARNING: overdraft mode enabled (%.2f%% of stock may be oversold while Redis is degraded)", opts.OverdraftPercent)
+		if opts.OverdraftJournal == "" {
+			log.Printf("WARNING: OVERDRAFT_JOURNAL not set, provisional grants are lost on restart")
+		}
+	}
+
+	var tlsConfig *tls.Config
+	if opts.TLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.TLSCertFile, opts.TLSKeyFile)
+		if err != nil {
+			cancel()
+			return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+		log.Printf("TLS enabled for client connections")
+	}
+
+	// Create the client listener, a unix socket for unix:// addresses;
+	// accepted TCP connections inherit its keepalive
+	lc := net.ListenConfig{KeepAliveConfig: net.KeepAliveConfig{
+		Enable:   opts.TCPKeepAliveIdle > 0,
+		Idle:     opts.TCPKeepAliveIdle,
+		Interval: opts.TCPKeepAliveInterval,
+		Count:    opts.TCPKeepAliveCount,
+	}}
+	if opts.TCPKeepAliveIdle == 0 {
+		lc.KeepAlive = -1
+	}
+	network, address := config.Network(opts.ListenAddr)
+	if network == "unix" {
+		if err := removeStaleSocket(address); err != nil {
+			cancel()
+			return nil, err
+		}
+	}
+	ln, err := lc.Listen(ctx, network, address)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to listen: %w", err)
+	}
+
+	s := &Server{
+		redis:    rdb,
+		store:    rs,
+		listener: ln,
+		ctx:      ctx,
+		cancel:   cancel,
+		luaHash:  rs.PurchaseScriptSHA(),
+		metrics:  metrics,
+		opts:     opts,
+
+		scriptCluster: scriptCluster,
+
+		overdraft: overdraft,
+		auth:      verifier,
+		pow:       pow,
+
+		queueWaiters: &queueWaiters{m: make(map[string]queueWaiter)},
+		events:       newEventHub(metrics),
+		drain:        newDrainState(),
+		tlsConfig:    tlsConfig,
+		configFile:   configFile,
+		replica:      replica,
+		ro:           &readOnlyState{},
+	}
+	s.initCaches()
+	if opts.FrameWorkers > 0 {
+		s.frames = newFrameScheduler(opts.FrameWorkers)
+	}
+	if opts.ClusterTTL > 0 {
+		s.cluster = s.newClusterMember()
+	}
+	if opts.ScalingCapacity > 0 {
+		s.scaler = newScaler(opts.ScalingCapacity, opts.ScalingQueueDepth, opts.ScalingThreshold, opts.ScalingInterval)
+	}
+	if opts.LoadShedInflight > 0 {
+		s.shedder = newShedder(opts.LoadShedInflight, opts.LoadShedAnonymousAt, metrics)
+		log.Printf("Load shedding enabled - In flight: %d, Anonymous from: %.0f%%", opts.LoadShedInflight, opts.LoadShedAnonymousAt*100)
+	}
+
+	if opts.KafkaBrokers != "" {
+		s.sinks = append(s.sinks, newKafkaSink(opts.KafkaBrokers, opts.KafkaTopic, opts.KafkaBufferPath, metrics))
+		log.Printf("Kafka event sink enabled - Brokers: %s, Topic: %s", opts.KafkaBrokers, opts.KafkaTopic)
+	}
+
+	if err := s.addWebhookSink(); err != nil {
+		cancel()
+		ln.Close()
+		return nil, err
+	}
+
+	if opts.BreakerErrorRate > 0 {
+		s.breaker = newCircuitBreaker(opts.BreakerErrorRate, opts.BreakerMinRequests, opts.BreakerWindow, opts.BreakerCooldown, metrics)
+		log.Printf("Circuit breaker enabled - Error rate: %v of at least %d calls in %v, Cooldown: %v",
+			opts.BreakerErrorRate, opts.BreakerMinRequests, opts.BreakerWindow, opts.BreakerCooldown)
+	}
+
+	s.initVerifier()
+
+	if opts.EventSchemaRegistryURL != "" {
+		v, err := eventschema.New(ctx, eventschema.Options{
+			RegistryURL: opts.EventSchemaRegistryURL,
+			Subject:     opts.EventSchemaSubject,
+			Refresh:     opts.EventSchemaRefresh,
+		})
+		if err != nil {
+			cancel()
+			ln.Close()
+			return nil, fmt.Errorf("failed to load event schema: %w", err)
+		}
+		s.schemaCheck = newSchemaCheck(v, opts.EventSchemaMode == "enforce", metrics)
+		log.Printf("Event schema check enabled - Subject: %s v%d, Mode: %s", opts.EventSchemaSubject, v.Version(), opts.EventSchemaMode)
+	}
+
+	if err := s.loadTenants(storeOpts); err != nil {
+		cancel()
+		ln.Close()
+		return nil, err
+	}
+
+	s.connPath, err = newConnPath()
+	if err != nil {
+		cancel()
+		ln.Close()
+		return nil, fmt.Errorf("failed to set up network path: %w", err)
+	}
+	if s.connPath.Name() != "netpoll" {
+		log.Printf("WARNING: experimental %s network path enabled", s.connPath.Name())
+	}
+	if opts.ConnEpoll {
+		if s.connPath.Name() != "netpoll" {
+			cancel()
+			ln.Close()
+			return nil, fmt.Errorf("CONN_EPOLL does not support the %s network path", s.connPath.Name())
+		}
+		s.parker, err = newConnParker(metrics.connectionsParked)
+		if err != nil {
+			cancel()
+			ln.Close()
+			return nil, fmt.Errorf("failed to set up epoll: %w", err)
+		}
+		log.Printf("WARNING: experimental epoll connection parking enabled")
+	}
+
+	if opts.QUICAddr != "" {
+		if err := s.listenQUIC(); err != nil {
+			cancel()
+			ln.Close()
+			return nil, fmt.Errorf("failed to listen on QUIC: %w", err)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", s.metrics.Handler())
+	s.addSaleRoutes(mux)
+	mux.HandleFunc("/admin/drain", s.handleDrain)
+	mux.HandleFunc("/admin/reload", s.handleReload)
+	mux.HandleFunc("/admin/cluster", s.handleCluster)
+	mux.HandleFunc("/admin/readonly", s.handleReadOnly)
+	mux.HandleFunc("/version", s.handleVersion)
+	mux.HandleFunc("/healthz", s.handleHealthz)
+	mux.HandleFunc("/readyz", s.handleReadyz)
+	mux.HandleFunc("/scaling", s.handleScaling)
+	mux.HandleFunc("/admin/shedding", s.handleShedding)
+	mux.HandleFunc("/tenants/{tenant}/admin/", s.handleTenantAdmin)
+	s.httpSrv = &http.Server{
+		Addr:              opts.MetricsAddr,
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	if opts.DebugAddr != "" {
+		s.debugSrv = s.newDebugServer()
+		log.Printf("Debug listener enabled - Address: %s", opts.DebugAddr)
+	}
+
+	info := buildinfo.Get()
+	metrics.buildInfo.WithLabelValues(info.Version, info.Commit, info.GoVersion).Set(1)
+
+	log.Printf("Server initialized - Version: %s (%s), Listening on %s, Redis: %s, Metrics: %s",
+		info.Version, info.Commit, opts.ListenAddr, opts.RedisAddr, opts.MetricsAddr)
+	return s, nil
+}
+
+// addSaleRoutes adds the admin routes of products, holds and orders,
+// which a tenant's server serves under /tenants/{tenant}
+func (s *Server) addSaleRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/admin/products", s.handleProducts)
+	mux.HandleFunc("GET /admin/products/{id}", s.handleProduct)
+	mux.HandleFunc("POST /admin/products/{id}/stock", s.handleProductStock)
+	mux.HandleFunc("/admin/products/{id}/pause", s.handleProductPause)
+	mux.HandleFunc("GET /admin/products/{id}/buyers", s.handleProductBuyers)
+	mux.HandleFunc("GET /admin/holds", s.handleHolds)
+	mux.HandleFunc("POST /admin/holds/{id}/approve", s.handleApproveHold)
+	mux.HandleFunc("POST /admin/holds/{id}/reject", s.handleRejectHold)
+	mux.HandleFunc("POST /admin/orders/{id}/fulfill", s.handleFulfillOrder)
+}
+
+// newPurchaseAuth returns the verifier of purchase tokens, nil unless
+// AUTH_HMAC_SECRET or AUTH_JWKS_URL is set
+func newPurchaseAuth(ctx context.Context, opts config.Server) (*auth.Verifier, error) {
+	if !opts.AuthEnabled() {
+		return nil, nil
+	}
+	verifier, err := auth.New(ctx, auth.Options{
+		Secret:      []byte(opts.AuthHMACSecret),
+		JWKSURL:     opts.AuthJWKSURL,
+		JWKSRefresh: opts.AuthJWKSRefresh,
+		Issuer:      opts.AuthIssuer,
+		Audience:    opts.AuthAudience,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up auth: %w", err)
+	}
+	log.Printf("Purchase authentication enabled")
+	if opts.AuthOptional {
+		log.Printf("WARNING: AUTH_OPTIONAL set, purchases without an auth_token are accepted as anonymous")
+	}
+	if opts.AuthSessionRequired {
+		log.Printf("Authenticated sessions required, connections must send AUTH before acting as a user")
+	}
+	return verifier, nil
+}
+
+// newPurchasePoW returns the proof of work issuer, nil unless
+// POW_DIFFICULTY or SPEED_POW_DIFFICULTY is set
+func newPurchasePoW(opts config.Server) (*powIssuer, error) {
+	if opts.PoWDifficulty <= 0 && opts.SpeedPoWDifficulty <= 0 {
+		return nil, nil
+	}
+	pow, err := newPoWIssuer(opts.PoWSecret, opts.PoWTTL)
+	if err != nil {
+		return nil, err
+	}
+	if opts.PoWDifficulty > 0 {
+		log.Printf("Proof of work enabled - Difficulty: %d bits, TTL: %v", opts.PoWDifficulty, opts.PoWTTL)
+	}
+	return pow, nil
+}
+
+// initCaches sets up the caches in front of the store and the live
+// settings
+func (s *Server) initCaches() {
+	s.catalog = newCatalog(s.reads, s.opts.CatalogCacheTTL)
+	if s.opts.SoldOutCacheTTL > 0 {
+		s.soldOut = newSoldOutCache(s.opts.SoldOutCacheTTL)
+	}
+	if _, ok := s.store.(store.Blocklists); ok {
+		s.blocks = &blocklist{}
+	}
+	s.live.Store(newLiveConfig(s.opts))
+}
+
+// addWebhookSink adds the WEBHOOK_URLS sink, if set
+func (s *Server) addWebhookSink() error {
+	if s.opts.WebhookURLs == "" {
+		return nil
+	}
+	wh, err := newWebhookSink(s.opts.WebhookURLs, s.opts.WebhookSecret, s.redis, s.keyPrefix+WEBHOOK_DEAD_LETTER, s.metrics)
+	if err != nil {
+		return err
+	}
+	s.sinks = append(s.sinks, wh)
+	log.Printf("Webhooks enabled - %d endpoints", len(wh.endpoints))
+	return nil
+}
+
+// initVerifier sets up the VERIFY_URL verifier, if set
+func (s *Server) initVerifier() {
+	if s.opts.VerifyURL != "" {
+		s.SetVerifier(newSiteVerifier(s.opts.VerifyURL, s.opts.VerifySecret, s.opts.VerifyTimeout))
+		log.Printf("Purchase verification enabled - URL: %s, Fail open: %v", s.opts.VerifyURL, s.opts.VerifyFailOpen)
+	}
+}
+
+// Start begins accepting connections
+func (s *Server) Start() {
+	if s.opts.CachePrimeTimeout > 0 {
+		s.primeCaches()
+		for _, t := range s.tenants {
+			t.primeCaches()
+		}
+	}
+
+	if s.cluster != nil {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.cluster.Run(withCommandTags(s.ctx, "none", "cluster_heartbeat"))
+		}()
+	}
+
+	s.startSaleLoops()
+	for _, t := range s.tenants {
+		t.startSaleLoops()
+	}
+
+	s.wg.Add(1)
+	go s.acceptLoop()
+
+	if s.quicListener != nil {
+		s.wg.Add(1)
+		go s.quicAcceptLoop()
+	}
+
+	s.wg.Add(1)
+	go s.probeLoop()
+
+	s.wg.Add(1)
+	go s.idleReaperLoop()
+
+	if s.opts.ReadOnlyProbeInterval > 0 {
+		s.wg.Add(1)
+		go s.readOnlyLoop()
+	}
+
+	if s.metrics.productLabels != nil {
+		s.wg.Add(1)
+		go s.labelCapLoop()
+	}
+
+	if syncer, ok := s.store.(store.ScriptSyncer); ok && s.opts.ScriptCheckInterval > 0 {
+		s.wg.Add(1)
+		go s.scriptCheckLoop(syncer)
+	}
+
+	if s.opts.SlowLogInterval > 0 {
+		s.wg.Add(1)
+		go s.slowLogLoop(s.opts.SlowLogInterval)
+	}
+
+	if s.overdraft != nil {
+		s.wg.Add(1)
+		go s.reconcileLoop()
+	}
+
+	if s.scaler != nil {
+		s.wg.Add(1)
+		go s.scalingLoop()
+	}
+
+	go func() {
+		if err := s.httpSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Printf("Metrics listener error: %v", err)
+		}
+	}()
+
+	if s.debugSrv != nil {
+		go func() {
+			if err := s.debugSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Printf("Debug listener error: %v", err)
+			}
+		}()
+	}
+}
+
+// startSaleLoops starts the background jobs around the store, the ones a
+// tenant's server runs too
+func (s *Server) startSaleLoops() {
+	// Blocked networks are turned away from the first connection on
+	if bl, ok := s.store.(store.Blocklists); ok {
+		if err := s.loadBlocklist(bl); err != nil {
+			log.Printf("Failed to load blocklist, starting without it: %v", err)
+		}
+		s.wg.Add(1)
+		go s.blocklistLoop(bl)
+	}
+
+	if s.opts.PaymentTTL > 0 || s.opts.ReservationTTL > 0 {
+		s.wg.Add(1)
+		go s.orderReaperLoop()
+	}
+
+	if sweeper, ok := s.store.(store.StaleSweeper); ok && s.opts.StaleOrderSweepInterval > 0 {
+		s.wg.Add(1)
+		go s.staleOrderSweepLoop(sweeper)
+	}
+
+	if q, ok := s.store.(store.Queue); ok {
+		if s.opts.QueueDispatchInterval > 0 {
+			s.wg.Add(1)
+			go s.queueDispatchLoop(q)
+		}
+		s.wg.Add(1)
+		go s.queueResultsLoop()
+	}
+
+	if s.soldOut != nil {
+		s.wg.Add(1)
+		go s.restockLoop()
+	}
+
+	if closer, ok := s.store.(store.SaleCloser); ok {
+		s.wg.Add(1)
+		go s.saleCloseLoop(closer)
+	}
+
+	s.wg.Add(1)
+	go s.eventsLoop()
+
+	if as, ok := s.store.(store.AllotmentSyncer); ok && s.opts.StockAllotment > 0 {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			as.RunAllotmentSync(withCommandTags(s.ctx, "none", "allotment_sync"), s.opts.StockAllotmentSync)
+		}()
+	}
+
+	if rb, ok := s.store.(store.Rebalancer); ok && s.opts.ShardRebalanceInterval > 0 {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			rb.RunShardRebalancer(withCommandTags(s.ctx, "none", "shard_rebalance"), s.opts.ShardRebalanceInterval, s.isLeader)
+		}()
+	}
+}
+
+// Addr returns the address the server accepts client connections on,
+// which tells callers the port when LISTEN_ADDR asked for any
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// acceptLoop handles incoming connections
+func (s *Server) acceptLoop() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			select {
+			case <-s.ctx.Done():
+				return
+			default:
+				log.Printf("Accept error: %v", err)
+				continue
+			}
+		}
+
+		if reason := s.refusal(conn.RemoteAddr()); reason != "" {
+			s.metrics.connectionsRejected.WithLabelValues(reason).Inc()
+			conn.Close()
+			continue
+		}
+
+		conn, err = s.connPath.Wrap(conn)
+		if err != nil {
+			log.Printf("Failed to move connection to %s: %v", s.connPath.Name(), err)
+			continue
+		}
+		if s.parker != nil {
+			if conn, err = s.parker.Wrap(conn); err != nil {
+				log.Printf("Failed to set up epoll for connection: %v", err)
+				continue
+			}
+		}
+		if s.tlsConfig != nil {
+			conn = tls.Server(conn, s.tlsConfig)
+		}
+
+		s.wg.Add(1)
+		go s.handleConnection(conn)
+	}
+}
+
+// handleConnection processes a single client connection
+func (s *Server) handleConnection(conn net.Conn) {
+	s.debugf("New connection from %s", conn.RemoteAddr())
+
+	sess := newSession(conn)
+	s.drain.add(sess)
+	s.metrics.connectionsOpen.Inc()
+
+	if s.opts.ConnectMode == connectGreeting {
+		if err := s.greet(sess); err != nil {
+			log.Printf("Write error to %s: %v", conn.RemoteAddr(), err)
+			s.endConnection(sess)
+			return
+		}
+	}
+	s.serveFrames(sess, true, false)
+}
+
+// endConnection tears down a connection handleConnection set up
+func (s *Server) endConnection(sess *session) {
+	defer s.wg.Done()
+	defer sess.conn.Close()
+	defer func() { s.serving(sess).queueWaiters.drop(sess.close()) }()
+	defer func() { s.serving(sess).events.unsubscribe(sess) }()
+
+	s.drain.remove(sess)
+	s.metrics.connectionsOpen.Dec()
+}
+
+// serveFrames reads and answers the frames of sess until the connection
+// ends, then tears it down. A parkable connection waiting for its next
+// frame returns early, parked, and runs serveFrames again with resumed
+// set once it wakes, going straight to the read it parked before.
+func (s *Server) serveFrames(sess *session, first, resumed bool) {
+	parked := false
+	defer func() {
+		if !parked {
+			s.endConnection(sess)
+		}
+	}()
+
+	conn := sess.conn
+	for ; ; first = false {
+		if !resumed {
+			select {
+			case <-s.ctx.Done():
+				return
+			default:
+			}
+
+			// Set read deadline
+			conn.SetReadDeadline(time.Now().Add(s.config().ConnReadTimeout))
+
+			// Checked after the deadline is set, so a drain starting now
+			// either is seen here or wakes the read below
+			if s.drain.draining.Load() && !s.keepDraining(sess) {
+				return
+			}
+
+			if pc, ok := conn.(parkable); ok {
+				first := first
+				if pc.park(func() { s.serveFrames(sess, first, true) }) {
+					parked = true
+					return
+				}
+			}
+		}
+		resumed = false
+
+		// Read TLV frame
+		frame, err := protocol.ReadFrame(conn, sess.proto.framing())
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() && (sess.running() || s.drain.draining.Load() && sess.proto.has(protocol.CAP_GOAWAY) ||
+				!s.drain.draining.Load() && sess.proto.has(protocol.CAP_EVENTS)) {
+				// Client is waiting on an admin operation or for
+				// events, or is to be sent MSG_GOAWAY and served until
+				// its deadline
+				continue
+			}
+			if errors.Is(err, protocol.ErrChecksum) {
+				// Nothing after a corrupt frame can be trusted, reset
+				// rather than guess where the next frame starts
+				s.metrics.frameChecksumErrors.Inc()
+				raw := conn
+				if pc, ok := conn.(parkable); ok {
+					raw = pc.NetConn()
+				}
+				if tcp, ok := raw.(*net.TCPConn); ok {
+					tcp.SetLinger(0)
+				}
+			}
+			if err != io.EOF {
+				log.Printf("Read error from %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		sess.touch()
+		msgType, payload := frame.Type, frame.Payload
+		timing := protocol.Timing{ClientSent: frame.Timing.ClientSent, ServerReceived: time.Now().UnixMicro()}
+		if s.silenced(sess, first, msgType) {
+			return
+		}
+
+		c, ok := codecs[frame.Encoding]
+		if !ok {
+			data, _ := json.Marshal(PurchaseResponse{Status: protocol.STATUS_ERROR, Error: "unknown encoding"})
+			if err := sess.reply(s, msgType, jsonCodec{}, data, frame.RequestID, timing); err != nil {
+				return
+			}
+			continue
+		}
+
+		// Admin operations answer asynchronously with their own frames
+		var response []byte
+		srv := s.serving(sess)
+		switch msgType {
+		case protocol.MSG_ADMIN_OP:
+			srv.startAdminOp(sess, c, payload)
+			continue
+		case protocol.MSG_CANCEL_OP:
+			response = srv.handleCancelOp(sess, c, payload)
+		case protocol.MSG_HELLO:
+			// Always JSON, in the frame format the client opened with
+			response, proto, ok := s.handleHello(sess, payload, first)
+			if s.opts.ConnectMode == connectSilent && proto == nil {
+				s.metrics.connectionsSilenced.Inc()
+				return
+			}
+			if err := sess.reply(s, msgType, jsonCodec{}, response, frame.RequestID, timing); err != nil || !ok {
+				return
+			}
+			if proto != nil {
+				sess.proto = *proto
+				if proto.has(protocol.CAP_REQUEST_IDS) {
+					sess.inFlight = make(chan struct{}, s.opts.ConnMaxInFlight)
+				}
+				if proto.has(protocol.CAP_EVENTS) {
+					srv = s.serving(sess)
+					srv.events.subscribe(srv, sess, proto.eventProducts)
+				}
+			}
+			continue
+		default:
+			if sess.inFlight != nil {
+				srv.startRequest(sess, c, frame, timing)
+				continue
+			}
+			response = srv.processFrame(sess, c, msgType, payload)
+		}
+
+		// Send response
+		if err := sess.reply(s, msgType, c, response, frame.RequestID, timing); err != nil {
+			log.Printf("Write error to %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+	}
+}
+
+// processMessage handles a single message
+func (s *Server) processMessage(sess *session, c codec, msgType byte, payload []byte) []byte {
+	if writeMessages[msgType] && s.readOnly() {
+		return s.readOnlyResponse(c)
+	}
+	if data, limited := s.limitTenant(c, msgType); limited {
+		return data
+	}
+
+	switch msgType {
+	case protocol.MSG_ATTEMPT_PURCHASE:
+		return s.handlePurchaseAttempt(sess, c, payload)
+	case protocol.MSG_LIST_PRODUCTS:
+		return s.handleCatalog(c, payload)
+	case protocol.MSG_SERVER_INFO:
+		return s.handleServerInfo(c)
+	case protocol.MSG_CONFIRM_PAYMENT:
+		return s.handleConfirmPayment(sess, c, payload)
+	case protocol.MSG_CANCEL_PURCHASE:
+		return s.handleCancelPurchase(sess, c, payload)
+	case protocol.MSG_GET_STOCK:
+		return s.handleGetStock(c, payload)
+	case protocol.MSG_GET_ORDER_STATUS:
+		return s.handleGetOrderStatus(sess, c, payload)
+	case protocol.MSG_CHALLENGE:
+		return s.handleChallenge(sess, c, payload)
+	case protocol.MSG_GET_USER_ORDERS:
+		return s.handleGetUserOrders(sess, c, payload)
+	case protocol.MSG_PURCHASE_BUNDLE:
+		return s.handlePurchaseBundle(sess, c, payload)
+	case protocol.MSG_RESERVE:
+		return s.handleReserve(sess, c, payload)
+	case protocol.MSG_COMMIT:
+		// A reservation is a PENDING order; committing is paying for it
+		return s.handleConfirmPayment(sess, c, payload)
+	case protocol.MSG_RELEASE:
+		return s.handleRelease(sess, c, payload)
+	case protocol.MSG_AUTH:
+		return s.handleAuth(sess, c, payload)
+	default:
+		resp := PurchaseResponse{
+			Status: protocol.STATUS_ERROR,
+			Error:  "unknown message type",
+		}
+		data, _ := c.Marshal(resp)
+		return data
+	}
+}
+
+// handlePurchaseAttempt processes a purchase attempt
+func (s *Server) handlePurchaseAttempt(sess *session, c codec, payload []byte) []byte {
+	return s.attemptPurchase(sess, c, payload, 0)
+}
+
+// attemptPurchase runs a purchase attempt through every check and then the
+// store. A hold makes it a reservation expiring after hold.
+func (s *Server) attemptPurchase(sess *session, c codec, payload []byte, hold time.Duration) (out []byte) {
+	if s.scaler != nil {
+		s.scaler.attempts.Add(1)
+	}
+
+	var req PurchaseRequest
+	if err := c.Unmarshal(payload, &req); err != nil {
+		resp := PurchaseResponse{
+			Status: protocol.STATUS_ERROR,
+			Error:  "invalid json",
+		}
+		data, _ := c.Marshal(resp)
+		return data
+	}
+
+	user, bound, err := s.sessionUser(sess, req.UserID)
+	if err != nil {
+		s.metrics.purchasesUnauthorized.Inc()
+		data, _ := c.Marshal(PurchaseResponse{Status: protocol.STATUS_ERROR, Error: err.Error()})
+		return data
+	}
+	req.UserID = user
+
+	// Validate request
+	if req.ProductID == "" || req.UserID == "" {
+		resp := PurchaseResponse{
+			Status: protocol.STATUS_ERROR,
+			Error:  "missing product_id or user_id",
+		}
+		data, _ := c.Marshal(resp)
+		return data
+	}
+	if len(req.IdempotencyKey) > maxIdempotencyKeyLen {
+		data, _ := c.Marshal(PurchaseResponse{
+			Status: protocol.STATUS_ERROR,
+			Error:  "idempotency_key is too long",
+		})
+		return data
+	}
+	keyed := req.IdempotencyKey != "" && s.idempotencyKeys() != nil
+	if keyed && hold > 0 {
+		// A reservation and a purchase never answer each other's retries
+		req.IdempotencyKey = "reserve:" + req.IdempotencyKey
+	}
+
+	// Only the token's subject may buy as user_id, or an agent on their
+	// behalf. Checked before the script runs, so rejected requests cost no
+	// Redis round trip.
+	agentID, err := s.authorizePurchase(req, bound)
+	if err != nil {
+		s.metrics.purchasesUnauthorized.Inc()
+		resp := PurchaseResponse{
+			Status: protocol.STATUS_ERROR,
+			Error:  err.Error(),
+		}
+		data, _ := c.Marshal(resp)
+		return data
+	}
+
+	if s.blocks != nil && s.blocks.userBlocked(req.UserID, agentID) {
+		s.metrics.purchasesBlocked.Inc()
+		data, _ := c.Marshal(PurchaseResponse{Status: protocol.STATUS_BLOCKED, Error: "user is blocked"})
+		return data
+	}
+
+	// Ahead of the idempotency key, which is also read from Redis
+	if s.breaker != nil && s.breaker.tripped(time.Now()) {
+		return s.breakerResponse(sess, c, req, agentID == "" && hold == 0)
+	}
+
+	if keyed {
+		if data, ok := s.replayPurchase(c, req); ok {
+			return data
+		}
+	}
+
+	// Nothing past this point can turn a sold out product into a sale
+	var restocks uint64
+	if s.soldOut != nil {
+		if s.soldOut.soldOut(req.ProductID, time.Now()) {
+			s.metrics.soldOutCacheHits.Inc()
+			data, _ := c.Marshal(PurchaseResponse{Status: protocol.STATUS_SOLD_OUT})
+			return data
+		}
+		restocks = s.soldOut.restocks.Load()
+	}
+
+	if s.shedder != nil {
+		if !s.shedder.admit(req.ProductID, s.purchaseTier(req.AuthToken != "" || agentID != "" || bound)) {
+			return s.shedResponse(sess, c)
+		}
+		defer s.shedder.done()
+	}
+
+	flagged := s.checkSpeed(req.UserID)
+
+	// Bots pay for every attempt with CPU time; checking costs one hash
+	if difficulty := s.powDifficulty(flagged); difficulty > 0 {
+		if difficulty > s.opts.PoWDifficulty {
+			s.metrics.speedActions.WithLabelValues("challenged").Inc()
+		}
+		if err := s.pow.verify(req.UserID, req.ProductID, req.PoWChallenge, req.PoWSolution, difficulty, time.Now()); err != nil {
+			s.metrics.powRejected.Inc()
+			resp := PurchaseResponse{
+				Status: protocol.STATUS_ERROR,
+				Error:  err.Error(),
+			}
+			data, _ := c.Marshal(resp)
+			return data
+		}
+	}
+
+	if data, limited := s.throttle(c, req.UserID, agentID, flagged); limited {
+		return data
+	}
+
+	if s.verifier != nil {
+		err := s.verifyPurchase(VerifyRequest{
+			ProductID: req.ProductID,
+			UserID:    req.UserID,
+			Token:     req.VerificationToken,
+			RemoteIP:  remoteIP(sess.conn.RemoteAddr()),
+		})
+		if err != nil {
+			data, _ := c.Marshal(PurchaseResponse{Status: protocol.STATUS_ERROR, Error: err.Error()})
+			return data
+		}
+	}
+
+	// A retry racing this attempt waits for its response
+	if keyed {
+		if data, ok := s.claimPurchase(c, req); !ok {
+			return data
+		}
+		defer func() { s.settlePurchase(c, req, out, err) }()
+	}
+
+	// Execute atomic purchase
+	evalStart := time.Now()
+	command := "purchase"
+	if hold > 0 {
+		command = "reserve"
+	}
+	// The store bounds each of its Redis calls by REDIS_EVAL_TIMEOUT; a
+	// sharded purchase makes several
+	ctx := withTraceparent(withCommandTags(s.ctx, req.ProductID, command), req.Traceparent)
+	if agentID != "" {
+		s.metrics.agentPurchases.Inc()
+	}
+	var result store.PurchaseResult
+	switch {
+	case hold > 0:
+		result, err = s.store.(store.Reserver).Reserve(ctx, req.ProductID, req.UserID, agentID, hold)
+	case agentID != "":
+		result, err = s.store.(store.AgentPurchaser).AttemptAgentPurchase(ctx, req.ProductID, req.UserID, agentID)
+	default:
+		result, err = s.store.AttemptPurchase(ctx, req.ProductID, req.UserID)
+	}
+	observeTraced(ctx, s.metrics.evalShaDuration, time.Since(evalStart).Seconds())
+	s.recordRedis(err)
+
+	if errors.Is(err, store.ErrNotDurable) {
+		log.Printf("Strict purchase not confirmed durable: product=%s user=%s: %v", req.ProductID, req.UserID, err)
+		resp := PurchaseResponse{
+			Status: protocol.STATUS_ERROR,
+			Error:  "purchase not confirmed durable, check order status",
+		}
+		data, _ := c.Marshal(resp)
+		return data
+	}
+
+	if errors.Is(err, store.ErrSalePaused) {
+		data, _ := c.Marshal(PurchaseResponse{
+			Status: protocol.STATUS_PAUSED,
+			Error:  err.Error(),
+		})
+		return data
+	}
+
+	if errors.Is(err, store.ErrUserLimitReached) {
+		data, _ := c.Marshal(PurchaseResponse{
+			Status: protocol.STATUS_LIMIT_REACHED,
+			Error:  err.Error(),
+		})
+		return data
+	}
+
+	if errors.Is(err, store.ErrSaleNotStarted) {
+		data, _ := c.Marshal(PurchaseResponse{
+			Status: protocol.STATUS_NOT_ON_SALE,
+			Error:  err.Error(),
+		})
+		return data
+	}
+
+	if errors.Is(err, store.ErrSaleEnded) {
+		data, _ := c.Marshal(PurchaseResponse{
+			Status: protocol.STATUS_ENDED,
+			Error:  err.Error(),
+		})
+		return data
+	}
+
+	if errors.Is(err, store.ErrNotEligible) {
+		data, _ := c.Marshal(PurchaseResponse{
+			Status: protocol.STATUS_NOT_ELIGIBLE,
+			Error:  err.Error(),
+		})
+		return data
+	}
+
+	if err != nil {
+		s.noteWriteError(err)
+
+		// Provisional grants are replayed as plain purchases, which would
+		// lose the agent or the reservation, so neither is granted from
+		// overdraft. Nor is an attempt Redis may have run: its replay
+		// would sell the user a second unit.
+		if s.overdraft != nil && agentID == "" && hold == 0 && isUnsentError(err) {
+			if data, ok := s.grantOverdraft(c, req); ok {
+				return data
+			}
+		}
+
+		resp := PurchaseResponse{
+			Status: protocol.STATUS_ERROR,
+			Error:  err.Error(),
+		}
+		data, _ := c.Marshal(resp)
+		return data
+	}
+
+	if result.Queued {
+		return s.queuedResponse(sess, c, result)
+	}
+
+	if s.overdraft != nil {
+		s.overdraft.observe(req.ProductID, result.Remaining)
+	}
+
+	var resp PurchaseResponse
+	if result.Success {
+		if hold > 0 {
+			s.metrics.reservationsMade.Inc()
+		}
+		resp = PurchaseResponse{
+			Status:         protocol.STATUS_SUCCESS,
+			RemainingStock: result.Remaining,
+			OrderID:        result.OrderID,
+		}
+
+		// Flagged users keep the unit, but not the order, until reviewed
+		var held store.Order
+		if flagged {
+			held, resp.Held = s.holdPurchase(req.ProductID, req.UserID, result.OrderID)
+		}
+		if !result.PaymentDeadline.IsZero() && !resp.Held {
+			resp.PaymentDeadline = result.PaymentDeadline.Unix()
+		}
+
+		// Publish event (async). Strict durability products already have
+		// the event in the stream, written by the purchase script.
+		go func() {
+			s.publishEvent(req.ProductID, req.UserID, agentID, result)
+			if resp.Held {
+				s.publishHold(held)
+			}
+		}()
+	} else {
+		resp = PurchaseResponse{
+			Status:           protocol.STATUS_SOLD_OUT,
+			WaitlistPosition: result.WaitlistPosition,
+		}
+		if result.WaitlistPosition > 0 {
+			s.metrics.purchasesWaitlisted.Inc()
+		}
+		if s.soldOut != nil {
+			s.soldOut.mark(req.ProductID, restocks, time.Now())
+		}
+	}
+
+	data, _ := c.Marshal(resp)
+	return data
+}
+
+// authorizePurchase checks the request's token and returns the agent
+// buying on the user's behalf, if any. Without auth anyone may buy as any
+// user, so there is no way to tell agents apart and agent tokens are
+// refused. A bound session already proved the user, and buys for no one
+// else.
+func (s *Server) authorizePurchase(req PurchaseRequest, bound bool) (string, error) {
+	if bound {
+		if req.AgentToken != "" {
+			return "", errors.New("agent purchases cannot be made on an authenticated session")
+		}
+		return "", nil
+	}
+	if req.AgentToken == "" {
+		if s.auth == nil || (req.AuthToken == "" && s.opts.AuthOptional) {
+			return "", nil
+		}
+		return "", s.auth.Authorize(req.AuthToken, req.UserID, time.Now())
+	}
+
+	if s.auth == nil {
+		return "", errors.New("agent purchases need purchase authentication")
+	}
+	if _, ok := s.store.(store.AgentPurchaser); !ok {
+		return "", errors.New("agent purchases are not supported by this store")
+	}
+	return s.auth.AuthorizeAgent(req.AgentToken, time.Now())
+}
+
+// publishEvent records a purchase event. result.Recorded means it is
+// already in the events stream and only needs to go out on pub/sub.
+func (s *Server) publishEvent(productID, userID, agentID string, result store.PurchaseResult) {
+	event := map[string]interface{}{
+		"type":       "purchase",
+		"product_id": productID,
+		"buyer":      userID,
+		"order_id":   result.OrderID,
+		"status":     result.OrderStatus(),
+		"remaining":  result.Remaining,
+		"timestamp":  time.Now().Unix(),
+	}
+	if agentID != "" {
+		event["agent"] = agentID
+	}
+	s.emitEvent(productID, !result.Recorded, event)
+}
+
+// emitEvent appends an event to the durable events stream (if toStream),
+// then publishes it on pub/sub for live subscribers. The stream is the
+// source of truth: pub/sub drops messages when nobody is subscribed.
+func (s *Server) emitEvent(productID string, toStream bool, event map[string]interface{}) {
+	ctx := withCommandTags(s.ctx, productID, "publish_event")
+	if s.tenant != nil {
+		event["tenant"] = s.tenant.id
+	}
+
+	if toStream {
+		err := s.redis.XAdd(ctx, &redis.XAddArgs{
+			Stream: s.keyPrefix + EVENTS_STREAM,
+			MaxLen: s.opts.EventsStreamMaxLen,
+			Approx: true,
+			Values: event,
+		}).Err()
+		if err != nil {
+			s.metrics.eventStreamFailures.Inc()
+			log.Printf("Failed to append event to stream: %v", err)
+		}
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Failed to marshal event: %v", err)
+		return
+	}
+
+	if err := s.redis.Publish(ctx, s.keyPrefix+EVENTS_CHANNEL, data).Err(); err != nil {
+		log.Printf("Failed to publish event: %v", err)
+	}
+
+	s.publishToSinks(productID, event)
+}
+
+// Shutdown gracefully shuts down the server
+func (s *Server) Shutdown() {
+	log.Println("Shutting down server...")
+	if s.opts.GoAwayDeadline > 0 {
+		// Clients that negotiated goaway get its deadline to move
+		s.drain.start(protocol.GOAWAY_SHUTDOWN)
+		if n := s.drain.count(); n > 0 {
+			log.Printf("Draining %d connections for up to %v", n, s.opts.GoAwayDeadline)
+			s.waitGoAway()
+		}
+	}
+	s.cancel()
+	s.listener.Close()
+	if s.quicListener != nil {
+		s.quicListener.Close()
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.opts.ShutdownTimeout)
+	defer cancel()
+	s.httpSrv.Shutdown(shutdownCtx)
+	if s.debugSrv != nil {
+		// Close rather than wait: a running CPU profile would hold it open
+		s.debugSrv.Close()
+	}
+
+	s.wg.Wait()
+	s.stopTenants()
+	if err := s.connPath.Close(); err != nil {
+		log.Printf("Failed to close %s network path: %v", s.connPath.Name(), err)
+	}
+	if s.parker != nil {
+		if err := s.parker.Close(); err != nil {
+			log.Printf("Failed to close epoll: %v", err)
+		}
+	}
+	for _, sink := range s.sinks {
+		if err := sink.Close(); err != nil {
+			log.Printf("Failed to close event sink: %v", err)
+		}
+	}
+	s.redis.Close()
+	if s.scriptCluster != nil {
+		s.scriptCluster.Close()
+	}
+	log.Println("Server stopped")
+}
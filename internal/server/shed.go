@@ -0,0 +1,226 @@
+package server
+
+import (
+	"math/rand/v2"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"chha/internal/shardmap"
+	"chha/pkg/protocol"
+)
+
+// Purchase attempt tiers, shed in this order
+const (
+	tierAnonymous  = "anonymous"
+	tierRegistered = "registered"
+)
+
+// shedRetryAfter is the mean retry delay suggested to shed attempts. It is
+// jittered by half either way so shed clients don't come back together.
+const shedRetryAfter = time.Second
+
+// shedder sheds purchase attempts at random once too many are waiting on
+// Redis. The load is the attempts in flight over capacity. Anonymous
+// attempts are shed with a probability rising from 0 at anonymousAt to 1
+// at full load; registered ones only past full load, rising to 1 at twice
+// the capacity. Every decision is counted per product and tier.
+type shedder struct {
+	capacity    float64
+	anonymousAt float64
+	metrics     *Metrics
+
+	inflight atomic.Int64
+
+	// counts are keyed by shedKey, so concurrent attempts on different
+	// products don't contend for one lock
+	counts *shardmap.Map[shedCount]
+}
+
+type shedCount struct {
+	product  string
+	tier     string
+	admitted int64
+	shed     int64
+}
+
+func shedKey(productID, tier string) string {
+	return tier + "\x00" + productID
+}
+
+func newShedder(capacity int64, anonymousAt float64, metrics *Metrics) *shedder {
+	return &shedder{
+		capacity:    float64(capacity),
+		anonymousAt: anonymousAt,
+		metrics:     metrics,
+		counts:      shardmap.New[shedCount](shardmap.DefaultShards, nil),
+	}
+}
+
+// probability returns the share of tier's attempts to shed at load
+func (sh *shedder) probability(tier string, load float64) float64 {
+	var p float64
+	if tier == tierAnonymous {
+		p = (load - sh.anonymousAt) / (1 - sh.anonymousAt)
+	} else {
+		p = load - 1
+	}
+	return min(max(p, 0), 1)
+}
+
+// admit decides whether an attempt may go on. Admitted attempts count as
+// in flight until done is called.
+func (sh *shedder) admit(productID, tier string) bool {
+	load := float64(sh.inflight.Load()) / sh.capacity
+	p := sh.probability(tier, load)
+	shed := p > 0 && rand.Float64() < p
+
+	sh.record(productID, tier, shed)
+	if shed {
+		sh.metrics.loadShed.WithLabelValues(sh.metrics.productLabels.label(productID), tier).Inc()
+		return false
+	}
+	sh.metrics.loadShedAdmitted.WithLabelValues(tier).Inc()
+	sh.metrics.loadShedInflight.Set(float64(sh.inflight.Add(1)))
+	return true
+}
+
+func (sh *shedder) done() {
+	sh.metrics.loadShedInflight.Set(float64(sh.inflight.Add(-1)))
+}
+
+func (sh *shedder) record(productID, tier string, shed bool) {
+	count := func(c *shedCount) {
+		if c.product == "" {
+			c.product, c.tier = productID, tier
+		}
+		if shed {
+			c.shed++
+		} else {
+			c.admitted++
+		}
+	}
+
+	if sh.counts.Load(shedKey(productID, tier), count) {
+		return
+	}
+	// Product IDs come from clients; past the bound they share a row. The
+	// check races with other new products, so the bound may be passed by
+	// the attempts still in flight.
+	if sh.counts.Len() >= labelCapTracked {
+		productID = otherLabel
+	}
+	sh.counts.Do(shedKey(productID, tier), count)
+}
+
+// shedStatus is served at /admin/shedding
+type shedStatus struct {
+	Inflight int64   `json:"inflight"`
+	Capacity int64   `json:"capacity"`
+	Load     float64 `json:"load"`
+	// Tiers are the totals of each tier and its current shed probability
+	Tiers map[string]shedTierStatus `json:"tiers"`
+	// Products are the counts per product and tier, most shed first
+	Products []shedProductStatus `json:"products"`
+}
+
+type shedTierStatus struct {
+	Probability float64 `json:"probability"`
+	Admitted    int64   `json:"admitted"`
+	Shed        int64   `json:"shed"`
+}
+
+type shedProductStatus struct {
+	ProductID string `json:"product_id"`
+	Tier      string `json:"tier"`
+	Admitted  int64  `json:"admitted"`
+	Shed      int64  `json:"shed"`
+}
+
+func (sh *shedder) status() shedStatus {
+	inflight := sh.inflight.Load()
+	st := shedStatus{
+		Inflight: inflight,
+		Capacity: int64(sh.capacity),
+		Load:     float64(inflight) / sh.capacity,
+		Tiers:    make(map[string]shedTierStatus),
+		Products: []shedProductStatus{},
+	}
+	for _, tier := range []string{tierAnonymous, tierRegistered} {
+		st.Tiers[tier] = shedTierStatus{Probability: sh.probability(tier, st.Load)}
+	}
+
+	sh.counts.Range(func(_ string, c *shedCount) {
+		t := st.Tiers[c.tier]
+		t.Admitted += c.admitted
+		t.Shed += c.shed
+		st.Tiers[c.tier] = t
+		st.Products = append(st.Products, shedProductStatus{ProductID: c.product, Tier: c.tier, Admitted: c.admitted, Shed: c.shed})
+	})
+
+	sort.Slice(st.Products, func(i, j int) bool {
+		a, b := st.Products[i], st.Products[j]
+		if a.Shed != b.Shed {
+			return a.Shed > b.Shed
+		}
+		if a.ProductID != b.ProductID {
+			return a.ProductID < b.ProductID
+		}
+		return a.Tier < b.Tier
+	})
+	return st
+}
+
+// purchaseTier is the tier of an authorized attempt: registered when it
+// carried a verified user or agent token or came on an authenticated
+// session, anonymous otherwise
+func (s *Server) purchaseTier(authenticated bool) string {
+	if s.auth != nil && authenticated {
+		return tierRegistered
+	}
+	return tierAnonymous
+}
+
+// shedResponse answers a shed attempt: BUSY with backpressure, and
+// RATE_LIMITED otherwise, so older clients back off as they do for rate
+// limits
+func (s *Server) shedResponse(sess *session, c codec) []byte {
+	if s.scaler != nil {
+		s.scaler.shed.Add(1)
+	}
+	retryAfter := shedRetryAfter/2 + rand.N(shedRetryAfter)
+	return busyResponse(sess, c, protocol.STATUS_RATE_LIMITED, "server overloaded", retryAfter)
+}
+
+// busyResponse answers an attempt the server had no capacity for with BUSY
+// on connections that negotiated backpressure, and with fallback, the
+// status they got before it, on others
+func busyResponse(sess *session, c codec, fallback, reason string, retryAfter time.Duration) []byte {
+	status := fallback
+	if sess.proto.has(protocol.CAP_BACKPRESSURE) {
+		status = protocol.STATUS_BUSY
+	}
+	data, _ := c.Marshal(PurchaseResponse{
+		Status:       status,
+		Error:        reason,
+		RetryAfterMs: max(retryAfter.Milliseconds(), 1),
+	})
+	return data
+}
+
+// handleShedding serves GET /admin/shedding
+func (s *Server) handleShedding(w http.ResponseWriter, r *http.Request) {
+	if !s.adminAuthorized(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if s.shedder == nil {
+		writeJSONError(w, http.StatusNotFound, "load shedding is disabled")
+		return
+	}
+	writeJSON(w, http.StatusOK, s.shedder.status())
+}
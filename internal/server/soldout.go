@@ -0,0 +1,92 @@
+package server
+
+import (
+	"sync/atomic"
+	"time"
+
+	"chha/internal/shardmap"
+	"chha/internal/store"
+)
+
+// soldOutCacheSize bounds the products a soldOutCache holds. The purchase
+// script reports unknown products as sold out too, so made-up product IDs
+// must not grow it without limit.
+const soldOutCacheSize = 10000
+
+// soldOutCache remembers products the purchase script found sold out, so
+// later attempts are answered without a Redis round trip. An entry lasts
+// SOLD_OUT_CACHE_TTL, and is dropped as soon as any server announces a
+// restock of the product on store.RestockChannel. The TTL bounds how long
+// a restock announced while the subscription was reconnecting goes unseen.
+type soldOutCache struct {
+	ttl time.Duration
+	// restocks counts announcements, so a sold out result read before one
+	// arrived is not cached after it
+	restocks atomic.Uint64
+
+	// until holds when each entry expires, sharded so purchases of
+	// different products don't contend for one lock. A zero time is an
+	// entry mark created but refused to set.
+	until *shardmap.Map[time.Time]
+}
+
+func newSoldOutCache(ttl time.Duration) *soldOutCache {
+	return &soldOutCache{ttl: ttl, until: shardmap.New[time.Time](shardmap.DefaultShards, nil)}
+}
+
+// soldOut reports whether productID was found sold out within the TTL
+func (c *soldOutCache) soldOut(productID string, now time.Time) bool {
+	var until time.Time
+	c.until.Load(productID, func(t *time.Time) { until = *t })
+	return now.Before(until)
+}
+
+// seen reports whether productID was found sold out and not restocked
+// since, however long ago
+func (c *soldOutCache) seen(productID string) bool {
+	var until time.Time
+	c.until.Load(productID, func(t *time.Time) { until = *t })
+	return !until.IsZero()
+}
+
+// mark caches productID as sold out, unless a restock was announced since
+// restocks was read. The check is made under the shard lock forget takes
+// after counting the restock, so the entry is either refused or dropped.
+func (c *soldOutCache) mark(productID string, restocks uint64, now time.Time) {
+	if c.until.Len() >= soldOutCacheSize && !c.until.Load(productID, func(*time.Time) {}) {
+		c.until.DeleteIf(func(_ string, until *time.Time) bool { return !now.Before(*until) })
+		if c.until.Len() >= soldOutCacheSize {
+			return
+		}
+	}
+	c.until.Do(productID, func(until *time.Time) {
+		if c.restocks.Load() == restocks {
+			*until = now.Add(c.ttl)
+		}
+	})
+}
+
+// forget drops productID after a restock
+func (c *soldOutCache) forget(productID string) {
+	c.restocks.Add(1)
+	c.until.Delete(productID)
+}
+
+// restockLoop drops cached sold out products as restocks are announced
+func (s *Server) restockLoop() {
+	defer s.wg.Done()
+
+	sub := s.redis.Subscribe(s.ctx, s.keyPrefix+store.RestockChannel)
+	defer sub.Close()
+
+	ch := sub.Channel()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case msg := <-ch:
+			s.soldOut.forget(msg.Payload)
+			s.debugf("Restock of %s announced, dropped from the sold out cache", msg.Payload)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"log"
+
+	"chha/internal/store"
+)
+
+// checkSpeed records a purchase attempt of userID for impossible-speed
+// detection and reports whether the user is flagged. A failed check lets
+// the attempt through unflagged, like a failed rate limit check.
+func (s *Server) checkSpeed(userID string) bool {
+	detector, ok := s.store.(store.SpeedDetector)
+	if !ok || s.opts.SpeedFloor <= 0 {
+		return false
+	}
+	ctx := withCommandTags(s.ctx, "none", "speed_check")
+	verdict, err := detector.RecordAttempt(ctx, userID, store.SpeedRule{
+		Floor:   s.opts.SpeedFloor,
+		Streak:  s.opts.SpeedStreak,
+		FlagFor: s.opts.SpeedFlagTTL,
+	})
+	if err != nil {
+		log.Printf("Speed check failed for user=%s, allowing attempt: %v", userID, err)
+		return false
+	}
+	if verdict.NewlyFlagged {
+		s.metrics.speedFlagged.Inc()
+		log.Printf("Flagged user=%s - %d attempts in a row under %v", userID, s.opts.SpeedStreak, s.opts.SpeedFloor)
+	}
+	return verdict.Flagged
+}
+
+// speedFlagged reports whether userID is flagged, without counting an
+// attempt
+func (s *Server) speedFlagged(userID string) bool {
+	detector, ok := s.store.(store.SpeedDetector)
+	if !ok || s.opts.SpeedFloor <= 0 || s.opts.SpeedPoWDifficulty <= 0 {
+		return false
+	}
+	flagged, err := detector.SpeedFlagged(withCommandTags(s.ctx, "none", "speed_check"), userID)
+	if err != nil {
+		log.Printf("Speed flag check failed for user=%s: %v", userID, err)
+		return false
+	}
+	return flagged
+}
+
+// powDifficulty is the proof of work a purchase needs, in bits: flagged
+// users get at least SPEED_POW_DIFFICULTY. 0 means none is needed.
+func (s *Server) powDifficulty(flagged bool) int {
+	if flagged && s.opts.SpeedPoWDifficulty > s.opts.PoWDifficulty {
+		return s.opts.SpeedPoWDifficulty
+	}
+	return s.opts.PoWDifficulty
+}
@@ -0,0 +1,238 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"chha/internal/config"
+	"chha/internal/store"
+	"chha/pkg/protocol"
+)
+
+// tenantState sets the server of a TENANTS_DIR tenant apart. Such a server
+// sells from its own store, under the tenant's key prefix, with its own
+// caches, auth and events, and shares the Redis connection, metrics, load
+// shedding and breaker of the server hosting it. It has no listener: the
+// hosting server takes its connections and hands their frames over once
+// their MSG_HELLO names the tenant.
+type tenantState struct {
+	id    string
+	token string
+	// limit is nil unless TENANT_RATE_LIMIT is set
+	limit *tokenBucket
+	// admin serves the tenant's /tenants/{tenant}/admin/ routes
+	admin http.Handler
+}
+
+// tenantLimited are the frames TENANT_RATE_LIMIT counts
+var tenantLimited = map[byte]bool{
+	protocol.MSG_ATTEMPT_PURCHASE: true,
+	protocol.MSG_PURCHASE_BUNDLE:  true,
+	protocol.MSG_RESERVE:          true,
+}
+
+// loadTenants creates the servers of the TENANTS_DIR tenants, with store
+// options like those of the hosting server's store
+func (s *Server) loadTenants(storeOpts store.RedisStoreOptions) error {
+	tenants, err := config.LoadTenants(s.opts)
+	if err != nil {
+		return fmt.Errorf("failed to load tenants: %w", err)
+	}
+	if len(tenants) == 0 {
+		return nil
+	}
+
+	s.tenants = make(map[string]*Server, len(tenants))
+	for _, t := range tenants {
+		ts, err := s.newTenant(t, storeOpts)
+		if err != nil {
+			s.stopTenants()
+			return fmt.Errorf("tenant %s: %w", t.ID, err)
+		}
+		s.tenants[t.ID] = ts
+	}
+	log.Printf("Multi-tenancy enabled - %d tenants from %s", len(s.tenants), s.opts.TenantsDir)
+	return nil
+}
+
+// newTenant creates the server of a tenant
+func (s *Server) newTenant(t config.Tenant, storeOpts store.RedisStoreOptions) (*Server, error) {
+	opts := t.Server
+	storeOpts.Tenant = t.ID
+	storeOpts.EventsMaxLen = opts.EventsStreamMaxLen
+	storeOpts.PaymentTTL = opts.PaymentTTL
+	storeOpts.ValueCodec = store.ValueCodecs[opts.ValueCodec]
+	storeOpts.WaitlistSize = opts.WaitlistSize
+	rs, err := store.NewRedisStore(withCommandTags(s.ctx, "none", "script_load"), s.redis, storeOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	verifier, err := newPurchaseAuth(ctx, opts)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	pow, err := newPurchasePoW(opts)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	ts := &Server{
+		redis:   s.redis,
+		store:   rs,
+		ctx:     ctx,
+		cancel:  cancel,
+		luaHash: rs.PurchaseScriptSHA(),
+		metrics: s.metrics,
+		opts:    opts,
+
+		auth: verifier,
+		pow:  pow,
+
+		queueWaiters: &queueWaiters{m: make(map[string]queueWaiter)},
+		events:       newEventHub(s.metrics),
+		drain:        s.drain,
+		scaler:       s.scaler,
+		shedder:      s.shedder,
+		frames:       s.frames,
+		breaker:      s.breaker,
+		cluster:      s.cluster,
+		schemaCheck:  s.schemaCheck,
+		ro:           s.ro,
+
+		tenant:    &tenantState{id: t.ID, token: t.Token},
+		keyPrefix: store.TenantPrefix(t.ID),
+	}
+	ts.initCaches()
+	for _, sink := range s.sinks {
+		if _, ok := sink.(*KafkaSink); ok {
+			ts.sinks = append(ts.sinks, sink)
+		}
+	}
+	if err := ts.addWebhookSink(); err != nil {
+		cancel()
+		return nil, err
+	}
+	ts.initVerifier()
+	if t.RateLimit > 0 {
+		ts.tenant.limit = newTokenBucket(t.RateLimit)
+	}
+
+	mux := http.NewServeMux()
+	ts.addSaleRoutes(mux)
+	ts.tenant.admin = http.StripPrefix("/tenants/"+t.ID, mux)
+
+	log.Printf("Tenant %s loaded - Rate limit: %d/s, Admin: %v", t.ID, t.RateLimit, opts.AdminToken != "")
+	return ts, nil
+}
+
+// stopTenants stops the jobs of the tenants' servers and closes their
+// webhook sinks; the Kafka sink is the hosting server's
+func (s *Server) stopTenants() {
+	for _, t := range s.tenants {
+		t.cancel()
+		t.wg.Wait()
+		for _, sink := range t.sinks {
+			if wh, ok := sink.(*WebhookSink); ok {
+				if err := wh.Close(); err != nil {
+					log.Printf("Failed to close webhook sink of tenant %s: %v", t.tenant.id, err)
+				}
+			}
+		}
+	}
+}
+
+// serving is the server of the tenant a connection named in MSG_HELLO, or
+// s for one that named none
+func (s *Server) serving(sess *session) *Server {
+	if sess.proto.tenant != nil {
+		return sess.proto.tenant
+	}
+	return s
+}
+
+// helloTenant is the server of the tenant of a MSG_HELLO, s when it names
+// none. Unknown tenants and wrong tokens get the same error, so neither
+// tells which tenants exist.
+func (s *Server) helloTenant(id, token string) (*Server, error) {
+	if id == "" {
+		return s, nil
+	}
+	t, ok := s.tenants[id]
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(t.tenant.token)) != 1 {
+		return nil, errors.New("unknown tenant or invalid tenant token")
+	}
+	return t, nil
+}
+
+// limitTenant counts an attempt against TENANT_RATE_LIMIT and returns the
+// RATE_LIMITED response if the tenant is over it
+func (s *Server) limitTenant(c codec, msgType byte) ([]byte, bool) {
+	if s.tenant == nil || !tenantLimited[msgType] {
+		return nil, false
+	}
+	s.metrics.tenantAttempts.WithLabelValues(s.tenant.id).Inc()
+	if s.tenant.limit == nil {
+		return nil, false
+	}
+	wait, ok := s.tenant.limit.take(time.Now())
+	if ok {
+		return nil, false
+	}
+	s.metrics.tenantRateLimited.WithLabelValues(s.tenant.id).Inc()
+	data, _ := c.Marshal(PurchaseResponse{
+		Status:       protocol.STATUS_RATE_LIMITED,
+		Error:        "tenant rate limit exceeded",
+		RetryAfterMs: max(wait.Milliseconds(), 1),
+	})
+	return data, true
+}
+
+// handleTenantAdmin serves /tenants/{tenant}/admin/..., the product, hold
+// and order routes of /admin/ for a tenant, with its ADMIN_TOKEN
+func (s *Server) handleTenantAdmin(w http.ResponseWriter, r *http.Request) {
+	t, ok := s.tenants[r.PathValue("tenant")]
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "unknown tenant")
+		return
+	}
+	t.tenant.admin.ServeHTTP(w, r)
+}
+
+// tokenBucket allows rate events a second, in bursts of up to rate
+type tokenBucket struct {
+	rate float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int64) *tokenBucket {
+	return &tokenBucket{rate: float64(rate), tokens: float64(rate)}
+}
+
+// take takes a token if there is one, and otherwise reports how long until
+// there is
+func (b *tokenBucket) take(now time.Time) (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.last.IsZero() {
+		b.tokens = min(b.rate, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0, true
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second)), false
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"chha/pkg/protocol"
+)
+
+// The server has no tracer of its own. A client that traces its requests
+// sends the W3C traceparent of the attempt, and the server attaches its
+// trace ID to the latency it observes as an exemplar, so a slow bucket on
+// a dashboard leads to the client's trace of a request it holds.
+
+type traceIDKey struct{}
+
+// withTraceparent carries the trace ID of traceparent to every Redis
+// command issued with the returned context. A missing or malformed value
+// leaves ctx untraced.
+func withTraceparent(ctx context.Context, traceparent string) context.Context {
+	if traceparent == "" {
+		return ctx
+	}
+	id, ok := protocol.TraceID(traceparent)
+	if !ok {
+		return ctx
+	}
+	return context.WithValue(ctx, traceIDKey{}, id)
+}
+
+// traceIDFromContext returns the trace ID on ctx, or ""
+func traceIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(traceIDKey{}).(string)
+	return id
+}
+
+// observeTraced records v, with the trace of ctx as its exemplar when
+// there is one
+func observeTraced(ctx context.Context, o prometheus.Observer, v float64) {
+	if id := traceIDFromContext(ctx); id != "" {
+		if eo, ok := o.(prometheus.ExemplarObserver); ok {
+			eo.ObserveWithExemplar(v, prometheus.Labels{"trace_id": id})
+			return
+		}
+	}
+	o.Observe(v)
+}
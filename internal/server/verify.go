@@ -0,0 +1,209 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"chha/pkg/protocol"
+)
+
+// verifyCacheSize bounds the user and token pairs a verifyCache holds
+const verifyCacheSize = 10000
+
+// VerifyRequest is what a PurchaseVerifier gets to judge an attempt by
+type VerifyRequest struct {
+	ProductID string
+	UserID    string
+	// Token is the verification_token of the attempt, e.g. a captcha
+	// response; empty when none was sent
+	Token string
+	// RemoteIP is the address of the connection the attempt came on
+	RemoteIP string
+}
+
+// PurchaseVerifier decides whether an attempt may reach the store, e.g. by
+// checking a captcha token with its provider. ok is false for an attempt
+// that failed verification; err is set when it could not be checked, and
+// VERIFY_FAIL_OPEN decides then. Verify is called concurrently, under a
+// context that ends after VERIFY_TIMEOUT.
+type PurchaseVerifier interface {
+	Verify(ctx context.Context, req VerifyRequest) (ok bool, err error)
+}
+
+// SetVerifier makes every purchase and bundle attempt pass v before it
+// reaches the store, in place of the VERIFY_URL verifier. It must be
+// called before Start.
+func (s *Server) SetVerifier(v PurchaseVerifier) {
+	s.verifier = v
+	if v != nil && s.opts.VerifyCacheTTL > 0 {
+		s.verified = newVerifyCache(s.opts.VerifyCacheTTL)
+	}
+}
+
+// verifyPurchase runs the verifier on an attempt. The error is the one to
+// send the client, ERROR_VERIFICATION_REQUIRED when no token was sent.
+func (s *Server) verifyPurchase(req VerifyRequest) error {
+	key := req.UserID + "\x00" + req.Token
+	if s.verified != nil {
+		if ok, found := s.verified.get(key, time.Now()); found {
+			s.metrics.verifyCacheHits.Inc()
+			return verifyResult(req, ok)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(s.ctx, s.opts.VerifyTimeout)
+	defer cancel()
+	ok, err := s.verifier.Verify(ctx, req)
+	if err != nil {
+		s.metrics.purchaseVerifications.WithLabelValues("error").Inc()
+		log.Printf("Failed to verify purchase of user=%s: %v", req.UserID, err)
+		if s.opts.VerifyFailOpen {
+			return nil
+		}
+		return errors.New("verification unavailable, try again")
+	}
+	if ok {
+		s.metrics.purchaseVerifications.WithLabelValues("passed").Inc()
+	} else {
+		s.metrics.purchaseVerifications.WithLabelValues("failed").Inc()
+	}
+	if s.verified != nil {
+		s.verified.put(key, ok, time.Now())
+	}
+	return verifyResult(req, ok)
+}
+
+// verifyResult is the error of a verdict
+func verifyResult(req VerifyRequest, ok bool) error {
+	switch {
+	case ok:
+		return nil
+	case req.Token == "":
+		return errors.New(protocol.ERROR_VERIFICATION_REQUIRED)
+	default:
+		return errors.New("verification failed")
+	}
+}
+
+// remoteIP is the host of addr, or "" if it has none
+func remoteIP(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return ""
+	}
+	return host
+}
+
+// verifyCache remembers verdicts so repeated attempts with one token, such
+// as a shopper clicking buy again, don't each ask the provider. Entries
+// last VERIFY_CACHE_TTL; failures to check are not cached.
+type verifyCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]verifyEntry
+}
+
+type verifyEntry struct {
+	ok    bool
+	until time.Time
+}
+
+func newVerifyCache(ttl time.Duration) *verifyCache {
+	return &verifyCache{ttl: ttl, entries: make(map[string]verifyEntry)}
+}
+
+// get returns the cached verdict of key, if any
+func (c *verifyCache) get(key string, now time.Time) (ok, found bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, found := c.entries[key]
+	if !found || !now.Before(e.until) {
+		return false, false
+	}
+	return e.ok, true
+}
+
+// put caches the verdict of key. A full cache drops expired entries, and
+// skips key if that frees nothing.
+func (c *verifyCache) put(key string, ok bool, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= verifyCacheSize {
+		for k, e := range c.entries {
+			if !now.Before(e.until) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= verifyCacheSize {
+			return
+		}
+	}
+	c.entries[key] = verifyEntry{ok: ok, until: now.Add(c.ttl)}
+}
+
+// siteVerifier checks tokens with a siteverify endpoint, the API of
+// Cloudflare Turnstile, hCaptcha and reCAPTCHA: a form POST of secret,
+// response and remoteip answered with {"success": bool}
+type siteVerifier struct {
+	url    string
+	secret string
+	client *http.Client
+}
+
+func newSiteVerifier(endpoint, secret string, timeout time.Duration) *siteVerifier {
+	return &siteVerifier{url: endpoint, secret: secret, client: &http.Client{Timeout: timeout}}
+}
+
+func (v *siteVerifier) Verify(ctx context.Context, req VerifyRequest) (bool, error) {
+	if req.Token == "" {
+		return false, nil
+	}
+	form := url.Values{"secret": {v.secret}, "response": {req.Token}}
+	if req.RemoteIP != "" {
+		form.Set("remoteip", req.RemoteIP)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, v.url, strings.NewReader(form.Encode()))
+	if err != nil {
+		return false, err
+	}
+	httpReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := v.client.Do(httpReq)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return false, fmt.Errorf("siteverify returned %s", resp.Status)
+	}
+	var result struct {
+		Success    bool     `json:"success"`
+		ErrorCodes []string `json:"error-codes"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&result); err != nil {
+		return false, fmt.Errorf("decode siteverify response: %w", err)
+	}
+	for _, code := range result.ErrorCodes {
+		// Our own misconfiguration fails every shopper, so it is an error
+		// rather than a verdict
+		if code == "missing-input-secret" || code == "invalid-input-secret" {
+			return false, fmt.Errorf("siteverify rejected the secret: %s", code)
+		}
+	}
+	return result.Success, nil
+}
@@ -0,0 +1,197 @@
+package server
+
+import (
+	"net/http"
+	"sort"
+
+	"chha/internal/buildinfo"
+	"chha/internal/store"
+	"chha/pkg/protocol"
+)
+
+// ServerInfo describes the build and capabilities of a server. It is
+// served at /version and in response to MSG_SERVER_INFO.
+type ServerInfo struct {
+	Status string `json:"status,omitempty"`
+	buildinfo.Info
+	Protocol ProtocolInfo `json:"protocol"`
+	// Features lists the optional subsystems enabled by configuration
+	Features []string `json:"features"`
+}
+
+// ProtocolInfo is the wire protocol supported by a server
+type ProtocolInfo struct {
+	Version  int      `json:"version"`
+	Minor    int      `json:"minor"`
+	Messages []string `json:"messages"`
+	// Capabilities can be requested with MSG_HELLO
+	Capabilities []string `json:"capabilities"`
+	MaxFrameSize int      `json:"max_frame_size"`
+}
+
+// serverInfo builds the ServerInfo for this server
+func (s *Server) serverInfo() ServerInfo {
+	messages := make([]string, 0, len(protocol.MessageNames))
+	for t := 0; t <= 0xff; t++ {
+		if name, ok := protocol.MessageNames[byte(t)]; ok {
+			messages = append(messages, name)
+		}
+	}
+
+	capabilities := make([]string, 0, len(supportedCapabilities))
+	for c := range supportedCapabilities {
+		if !s.offers(c) {
+			continue
+		}
+		capabilities = append(capabilities, c)
+	}
+	sort.Strings(capabilities)
+
+	return ServerInfo{
+		Info: buildinfo.Get(),
+		Protocol: ProtocolInfo{
+			Version:      protocol.PROTOCOL_VERSION,
+			Minor:        protocol.PROTOCOL_MINOR,
+			Messages:     messages,
+			Capabilities: capabilities,
+			MaxFrameSize: protocol.MAX_FRAME_SIZE,
+		},
+		Features: s.features(),
+	}
+}
+
+// features reports which optional subsystems are enabled
+func (s *Server) features() []string {
+	features := []string{}
+	if s.overdraft != nil {
+		features = append(features, "overdraft")
+	}
+	if s.opts.PaymentTTL > 0 {
+		features = append(features, "payment_hold")
+	}
+	if _, ok := s.store.(store.Reserver); ok && s.opts.ReservationTTL > 0 {
+		features = append(features, "reservations")
+	}
+	if _, ok := s.store.(store.BundlePurchaser); ok {
+		features = append(features, "bundles")
+	}
+	if s.opts.WaitlistSize > 0 {
+		features = append(features, "waitlist")
+	}
+	if s.soldOut != nil {
+		features = append(features, "sold_out_cache")
+	}
+	if s.opts.AdminToken != "" {
+		features = append(features, "admin_ops")
+		if _, ok := s.store.(store.ProductAdmin); ok {
+			features = append(features, "product_admin")
+		}
+	}
+	if s.auth != nil {
+		features = append(features, "purchase_auth", "auth_sessions")
+		if s.opts.AuthOptional {
+			features = append(features, "anonymous_purchases")
+		}
+		if s.opts.AuthSessionRequired {
+			features = append(features, "sessions_required")
+		}
+		if _, ok := s.store.(store.AgentPurchaser); ok {
+			features = append(features, "agent_purchases")
+		}
+	}
+	if s.auth != nil || s.opts.AdminToken != "" {
+		features = append(features, "user_orders")
+	}
+	if s.shedder != nil {
+		features = append(features, "load_shedding")
+	}
+	if s.breaker != nil {
+		features = append(features, "circuit_breaker")
+	}
+	if s.opts.PoWDifficulty > 0 {
+		features = append(features, "proof_of_work")
+	}
+	if _, ok := s.store.(store.OrderFulfiller); ok {
+		features = append(features, "order_fulfillment")
+	}
+	if _, ok := s.store.(store.SpeedDetector); ok && s.opts.SpeedFloor > 0 {
+		features = append(features, "speed_detection")
+		if _, ok := s.store.(store.OrderReviewer); ok && s.opts.SpeedHold {
+			features = append(features, "order_holds")
+		}
+	}
+	if s.config().UserRateLimit > 0 {
+		features = append(features, "user_rate_limit")
+	}
+	if s.config().AgentRateLimit > 0 {
+		features = append(features, "agent_rate_limit")
+	}
+	if _, ok := s.store.(store.Queue); ok && s.opts.QueueDispatchInterval > 0 {
+		features = append(features, "queue_dispatch")
+	}
+	if s.opts.StrictWaitAOF > 0 {
+		features = append(features, "strict_waitaof")
+	}
+	if s.opts.PurchaseBatchWindow > 0 {
+		features = append(features, "purchase_batching")
+	}
+	if s.opts.StockAllotment > 0 {
+		features = append(features, "stock_allotment")
+	}
+	if s.opts.ShardRebalanceInterval > 0 {
+		features = append(features, "shard_rebalance")
+	}
+	if s.cluster != nil {
+		features = append(features, "cluster")
+	}
+	if s.replica != nil {
+		features = append(features, "read_replica")
+	}
+	if s.tlsConfig != nil {
+		features = append(features, "tls")
+	}
+	if s.opts.ConnectMode != connectOpen {
+		features = append(features, "connect_"+s.opts.ConnectMode)
+	}
+	if s.scaler != nil {
+		features = append(features, "scaling_hints")
+	}
+	if s.schemaCheck != nil {
+		features = append(features, "event_schema")
+	}
+	if s.connPath.Name() != "netpoll" {
+		features = append(features, s.connPath.Name())
+	}
+	if s.parker != nil {
+		features = append(features, "epoll")
+	}
+	if s.quicListener != nil {
+		features = append(features, "quic")
+	}
+	for _, sink := range s.sinks {
+		switch sink.(type) {
+		case *KafkaSink:
+			features = append(features, "kafka")
+		case *WebhookSink:
+			features = append(features, "webhooks")
+		}
+	}
+	return features
+}
+
+// handleServerInfo serves MSG_SERVER_INFO
+func (s *Server) handleServerInfo(c codec) []byte {
+	info := s.serverInfo()
+	info.Status = protocol.STATUS_SUCCESS
+	data, _ := c.Marshal(info)
+	return data
+}
+
+// handleVersion serves GET /version
+func (s *Server) handleVersion(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, s.serverInfo())
+}
@@ -0,0 +1,262 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// WEBHOOK_DEAD_LETTER holds deliveries that exhausted their retries
+	WEBHOOK_DEAD_LETTER = "webhooks:dead_letter"
+
+	webhookQueueSize      = 10000
+	webhookWorkers        = 8
+	webhookMaxAttempts    = 6
+	webhookRequestTimeout = 5 * time.Second
+	webhookMinBackoff     = 500 * time.Millisecond
+	webhookMaxBackoff     = 30 * time.Second
+)
+
+// webhookEndpoint is one configured receiver
+type webhookEndpoint struct {
+	url   string
+	label string // host only, used as the metrics label
+}
+
+// webhookDelivery is one event bound for one endpoint
+type webhookDelivery struct {
+	endpoint *webhookEndpoint
+	body     []byte
+}
+
+// WebhookSink POSTs every purchase event to a set of HTTPS endpoints. Each
+// body is signed with HMAC-SHA256 over "<timestamp>.<body>" so receivers
+// can verify it came from us and reject replays. Failed deliveries are
+// retried with exponential backoff, then pushed to WEBHOOK_DEAD_LETTER.
+type WebhookSink struct {
+	endpoints []*webhookEndpoint
+	secret    []byte
+	client    *http.Client
+	redis     *redis.Client
+	metrics   *Metrics
+	// deadLetterKey is WEBHOOK_DEAD_LETTER, under the tenant's prefix if any
+	deadLetterKey string
+
+	queue chan webhookDelivery
+	wg    sync.WaitGroup
+
+	// stop interrupts retry backoff once Close has been called
+	stop   context.Context
+	cancel context.CancelFunc
+
+	// closeMu guards queue against sends after Close
+	closeMu sync.RWMutex
+	closed  bool
+}
+
+// newWebhookSink creates a sink for the given comma-separated endpoint list.
+// Only https URLs are accepted, since the payload identifies buyers.
+func newWebhookSink(urls, secret string, rdb *redis.Client, deadLetter string, metrics *Metrics) (*WebhookSink, error) {
+	if secret == "" {
+		return nil, fmt.Errorf("WEBHOOK_SECRET is required when webhooks are enabled")
+	}
+
+	var endpoints []*webhookEndpoint
+	for _, raw := range strings.Split(urls, ",") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		u, err := url.Parse(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid webhook url %q: %w", raw, err)
+		}
+		if u.Scheme != "https" || u.Host == "" {
+			return nil, fmt.Errorf("webhook url %q must be https", raw)
+		}
+		endpoints = append(endpoints, &webhookEndpoint{url: raw, label: u.Host})
+	}
+	if len(endpoints) == 0 {
+		return nil, fmt.Errorf("no webhook urls configured")
+	}
+
+	stop, cancel := context.WithCancel(context.Background())
+	w := &WebhookSink{
+		endpoints:     endpoints,
+		secret:        []byte(secret),
+		client:        &http.Client{Timeout: webhookRequestTimeout},
+		redis:         rdb,
+		metrics:       metrics,
+		deadLetterKey: deadLetter,
+		queue:         make(chan webhookDelivery, webhookQueueSize),
+		stop:          stop,
+		cancel:        cancel,
+	}
+
+	for i := 0; i < webhookWorkers; i++ {
+		w.wg.Add(1)
+		go w.worker()
+	}
+	return w, nil
+}
+
+// webhookEventTypes are the event types delivered to webhooks
+var webhookEventTypes = map[string]bool{"purchase": true, "scaling_hint": true}
+
+// Publish queues a purchase or scaling hint event for every endpoint
+// without blocking. Other event types are ignored. If the queue is full the delivery goes
+// straight to the dead-letter list.
+func (w *WebhookSink) Publish(productID string, event map[string]interface{}) {
+	if t, _ := event["type"].(string); !webhookEventTypes[t] {
+		return
+	}
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Failed to marshal webhook event: %v", err)
+		return
+	}
+
+	w.closeMu.RLock()
+	defer w.closeMu.RUnlock()
+
+	for _, ep := range w.endpoints {
+		d := webhookDelivery{endpoint: ep, body: body}
+		if w.closed {
+			w.deadLetter(d, 0, "server shutting down")
+			continue
+		}
+		select {
+		case w.queue <- d:
+		default:
+			w.deadLetter(d, 0, "delivery queue full")
+		}
+	}
+}
+
+func (w *WebhookSink) worker() {
+	defer w.wg.Done()
+
+	for d := range w.queue {
+		if w.stop.Err() != nil {
+			w.deadLetter(d, 0, "server shutting down")
+			continue
+		}
+		w.deliver(d)
+	}
+}
+
+// deliver POSTs d until it succeeds, gets a non-retryable response, or runs
+// out of attempts
+func (w *WebhookSink) deliver(d webhookDelivery) {
+	backoff := webhookMinBackoff
+
+	for attempt := 1; ; attempt++ {
+		retry, err := w.post(d)
+		if err == nil {
+			w.metrics.webhookDelivered.WithLabelValues(d.endpoint.label).Inc()
+			return
+		}
+		w.metrics.webhookFailures.WithLabelValues(d.endpoint.label).Inc()
+
+		if !retry || attempt >= webhookMaxAttempts {
+			log.Printf("Webhook delivery to %s failed after %d attempts: %v", d.endpoint.label, attempt, err)
+			w.deadLetter(d, attempt, err.Error())
+			return
+		}
+
+		select {
+		case <-w.stop.Done():
+			w.deadLetter(d, attempt, err.Error())
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, webhookMaxBackoff)
+	}
+}
+
+// post makes one delivery attempt. retry reports whether a failure is worth
+// trying again: network errors, 429 and 5xx are, other 4xx are not.
+func (w *WebhookSink) post(d webhookDelivery) (retry bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, d.endpoint.url, bytes.NewReader(d.body))
+	if err != nil {
+		return false, err
+	}
+
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Flashsale-Timestamp", ts)
+	req.Header.Set("X-Flashsale-Signature", "sha256="+w.sign(ts, d.body))
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("endpoint returned %s", resp.Status)
+	default:
+		return false, fmt.Errorf("endpoint returned %s", resp.Status)
+	}
+}
+
+func (w *WebhookSink) sign(ts string, body []byte) string {
+	mac := hmac.New(sha256.New, w.secret)
+	mac.Write([]byte(ts))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// deadLetter records an undeliverable event in Redis for inspection and
+// manual replay
+func (w *WebhookSink) deadLetter(d webhookDelivery, attempts int, reason string) {
+	w.metrics.webhookDeadLettered.WithLabelValues(d.endpoint.label).Inc()
+
+	entry, _ := json.Marshal(map[string]interface{}{
+		"url":       d.endpoint.url,
+		"event":     json.RawMessage(d.body),
+		"attempts":  attempts,
+		"error":     reason,
+		"failed_at": time.Now().Unix(),
+	})
+
+	ctx := withCommandTags(context.Background(), "none", "webhook_dead_letter")
+	if err := w.redis.LPush(ctx, w.deadLetterKey, entry).Err(); err != nil {
+		log.Printf("ERROR: failed to dead-letter webhook for %s, event lost: %v", d.endpoint.label, err)
+	}
+}
+
+// Close stops accepting events and waits for in-flight requests. Deliveries
+// still queued or in backoff are dead-lettered instead of retried, so
+// shutdown is not held up by a slow endpoint.
+func (w *WebhookSink) Close() error {
+	w.closeMu.Lock()
+	w.closed = true
+	close(w.queue)
+	w.closeMu.Unlock()
+
+	w.cancel()
+	w.wg.Wait()
+	return nil
+}
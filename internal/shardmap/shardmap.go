@@ -0,0 +1,135 @@
+// Package shardmap provides a string-keyed map split into independently
+// locked shards, for per-product state touched on every request. Goroutines
+// working on different products rarely share a lock, where a single mutex
+// around a plain map would serialize the whole server.
+package shardmap
+
+import (
+	"hash/maphash"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultShards suits up to a few thousand concurrently active keys
+const DefaultShards = 64
+
+// Map holds one *V per key. Values are only accessed under their shard's
+// lock, through Do and Range.
+type Map[V any] struct {
+	seed   maphash.Seed
+	init   func() *V
+	shards []shard[V]
+	mask   uint64
+	// n counts the keys, so bounded maps need not lock every shard to
+	// check their size
+	n atomic.Int64
+}
+
+type shard[V any] struct {
+	mu sync.Mutex
+	m  map[string]*V
+	// Keep neighbouring locks off the same cache line
+	_ [48]byte
+}
+
+// New creates a map with shards rounded up to a power of two. init creates
+// the value of a key seen for the first time; nil means a zero V.
+func New[V any](shards int, init func() *V) *Map[V] {
+	n := 1
+	for n < shards {
+		n <<= 1
+	}
+	if init == nil {
+		init = func() *V { return new(V) }
+	}
+
+	m := &Map[V]{
+		seed:   maphash.MakeSeed(),
+		init:   init,
+		shards: make([]shard[V], n),
+		mask:   uint64(n - 1),
+	}
+	for i := range m.shards {
+		m.shards[i].m = make(map[string]*V)
+	}
+	return m
+}
+
+func (m *Map[V]) shard(key string) *shard[V] {
+	return &m.shards[maphash.String(m.seed, key)&m.mask]
+}
+
+// Do calls fn with the value of key, creating it if needed, while holding
+// only that key's shard lock. fn must not call back into m.
+func (m *Map[V]) Do(key string, fn func(v *V)) {
+	s := m.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v, ok := s.m[key]
+	if !ok {
+		v = m.init()
+		s.m[key] = v
+		m.n.Add(1)
+	}
+	fn(v)
+}
+
+// Load calls fn with the value of key if it exists and reports whether it
+// did
+func (m *Map[V]) Load(key string, fn func(v *V)) bool {
+	s := m.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v, ok := s.m[key]
+	if ok {
+		fn(v)
+	}
+	return ok
+}
+
+// Delete removes key
+func (m *Map[V]) Delete(key string) {
+	s := m.shard(key)
+	s.mu.Lock()
+	if _, ok := s.m[key]; ok {
+		delete(s.m, key)
+		m.n.Add(-1)
+	}
+	s.mu.Unlock()
+}
+
+// DeleteIf removes every key for which drop returns true, locking one
+// shard at a time. drop must not call back into m.
+func (m *Map[V]) DeleteIf(drop func(key string, v *V) bool) {
+	for i := range m.shards {
+		s := &m.shards[i]
+		s.mu.Lock()
+		for k, v := range s.m {
+			if drop(k, v) {
+				delete(s.m, k)
+				m.n.Add(-1)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// Range calls fn for every key, locking one shard at a time, so it is not
+// a consistent snapshot across shards. fn must not call back into m.
+func (m *Map[V]) Range(fn func(key string, v *V)) {
+	for i := range m.shards {
+		s := &m.shards[i]
+		s.mu.Lock()
+		for k, v := range s.m {
+			fn(k, v)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// Len returns the number of keys, without locking any shard
+func (m *Map[V]) Len() int {
+	return int(m.n.Load())
+}
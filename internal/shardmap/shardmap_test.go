@@ -0,0 +1,121 @@
+package shardmap
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+type counter struct {
+	n int64
+}
+
+func TestMap(t *testing.T) {
+	m := New[counter](4, nil)
+	for i := 0; i < 100; i++ {
+		m.Do(fmt.Sprintf("p%d", i%10), func(c *counter) { c.n++ })
+	}
+	if got := m.Len(); got != 10 {
+		t.Fatalf("Len() = %d, want 10", got)
+	}
+
+	var n int64
+	if !m.Load("p3", func(c *counter) { n = c.n }) || n != 10 {
+		t.Fatalf("Load(p3) = %d, want 10", n)
+	}
+	if m.Load("missing", func(*counter) {}) {
+		t.Fatal("Load(missing) found a value")
+	}
+
+	m.Delete("p3")
+	m.Delete("p3")
+	m.DeleteIf(func(key string, _ *counter) bool { return key == "p4" || key == "p5" })
+	if got := m.Len(); got != 7 {
+		t.Fatalf("Len() after deletes = %d, want 7", got)
+	}
+
+	var total int64
+	m.Range(func(_ string, c *counter) { total += c.n })
+	if total != 70 {
+		t.Fatalf("Range total = %d, want 70", total)
+	}
+}
+
+func TestMapConcurrent(t *testing.T) {
+	m := New[counter](DefaultShards, nil)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				m.Do(fmt.Sprintf("p%d", i%50), func(c *counter) { c.n++ })
+			}
+		}()
+	}
+	wg.Wait()
+
+	var total int64
+	m.Range(func(_ string, c *counter) { total += c.n })
+	if total != 8000 || m.Len() != 50 {
+		t.Fatalf("total = %d over %d keys, want 8000 over 50", total, m.Len())
+	}
+}
+
+// mutexMap is the single mutex around a plain map that Map replaces
+type mutexMap struct {
+	mu sync.Mutex
+	m  map[string]*counter
+}
+
+func (mm *mutexMap) Do(key string, fn func(c *counter)) {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	c, ok := mm.m[key]
+	if !ok {
+		c = &counter{}
+		mm.m[key] = c
+	}
+	fn(c)
+}
+
+func benchKeys(n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("product-%d", i)
+	}
+	return keys
+}
+
+// benchmarkDo updates counters from every P at once, each goroutine
+// walking the keys from its own offset as concurrent purchases of
+// different products would
+func benchmarkDo(b *testing.B, keys []string, do func(key string, fn func(c *counter))) {
+	var offset atomic.Int64
+	b.RunParallel(func(pb *testing.PB) {
+		i := int(offset.Add(7919))
+		for pb.Next() {
+			do(keys[i%len(keys)], func(c *counter) { c.n++ })
+			i++
+		}
+	})
+}
+
+func BenchmarkMutexMap(b *testing.B) {
+	for _, n := range []int{1, 16, 1024} {
+		b.Run(fmt.Sprintf("keys=%d", n), func(b *testing.B) {
+			mm := &mutexMap{m: make(map[string]*counter)}
+			benchmarkDo(b, benchKeys(n), mm.Do)
+		})
+	}
+}
+
+func BenchmarkMap(b *testing.B) {
+	for _, n := range []int{1, 16, 1024} {
+		b.Run(fmt.Sprintf("keys=%d", n), func(b *testing.B) {
+			m := New[counter](DefaultShards, nil)
+			benchmarkDo(b, benchKeys(n), m.Do)
+		})
+	}
+}
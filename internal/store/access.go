@@ -0,0 +1,97 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrNotEligible is returned by purchases of a user who is not on the
+// product's allowlist before the sale opens to everyone
+var ErrNotEligible = errors.New("not on the allowlist of this sale")
+
+// allowlistBatch caps the users added by one SADD
+const allowlistBatch = 1000
+
+// allowlistKey is the set of users allowed to buy a product before its
+// sale_start, from the early_start in its meta. A product with one and no
+// sale_start only sells to them.
+func (r *RedisStore) allowlistKey(productID string) string {
+	return r.key(fmt.Sprintf("product:%s:allowlist", productID))
+}
+
+// LoadAllowlist adds users to a product's allowlist, or replaces it with
+// them, and returns its size. A replaced list is built aside and renamed
+// over the old one, so purchases never see it half loaded.
+func (r *RedisStore) LoadAllowlist(ctx context.Context, productID string, users []string, replace bool) (int64, error) {
+	key := r.allowlistKey(productID)
+	if replace {
+		key += ":loading"
+		if err := r.client.Del(ctx, key).Err(); err != nil {
+			return 0, fmt.Errorf("failed to load allowlist: %w", err)
+		}
+	}
+
+	_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i := 0; i < len(users); i += allowlistBatch {
+			batch := users[i:min(i+allowlistBatch, len(users))]
+			members := make([]interface{}, len(batch))
+			for j, u := range batch {
+				members[j] = u
+			}
+			pipe.SAdd(ctx, key, members...)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to load allowlist: %w", err)
+	}
+
+	if replace {
+		if len(users) == 0 {
+			err = r.client.Del(ctx, r.allowlistKey(productID)).Err()
+		} else {
+			err = r.client.Rename(ctx, key, r.allowlistKey(productID)).Err()
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to replace allowlist: %w", err)
+		}
+	}
+	n, err := r.client.SCard(ctx, r.allowlistKey(productID)).Result()
+	if err != nil {
+		return 0, fmt.Errorf("failed to count allowlist: %w", err)
+	}
+	return n, nil
+}
+
+// ClearAllowlist drops a product's allowlist and early start, opening it
+// to everyone from its sale_start
+func (r *RedisStore) ClearAllowlist(ctx context.Context, productID string) error {
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, r.allowlistKey(productID))
+		pipe.HDel(ctx, r.metaKey(productID), "early_start")
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to clear allowlist: %w", err)
+	}
+	return nil
+}
+
+// SetEarlyStart sets when allowlisted users may start buying a product; a
+// zero time removes it, and they then wait for the sale_start too
+func (r *RedisStore) SetEarlyStart(ctx context.Context, productID string, at time.Time) error {
+	var err error
+	if at.IsZero() {
+		err = r.client.HDel(ctx, r.metaKey(productID), "early_start").Err()
+	} else {
+		err = r.client.HSet(ctx, r.metaKey(productID), "early_start", at.Unix()).Err()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to set early start: %w", err)
+	}
+	return nil
+}
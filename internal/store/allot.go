@@ -0,0 +1,613 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// AllotmentSyncer is implemented by stores that sell stock claimed into
+// memory and record the sales in the background
+type AllotmentSyncer interface {
+	// RunAllotmentSync records allotted sales every interval and returns
+	// allotments that went unused for a whole interval. When ctx is done
+	// it records what is left, returns every allotment and stops.
+	RunAllotmentSync(ctx context.Context, interval time.Duration)
+}
+
+var _ AllotmentSyncer = (*RedisStore)(nil)
+
+// allottedKey holds, per server, the units of a product claimed into that
+// server's memory and neither recorded as sold nor returned yet
+func (r *RedisStore) allottedKey(productID string) string {
+	return r.key(fmt.Sprintf("product:%s:allotted", productID))
+}
+
+// allotmentRetry is how long a product that cannot be allotted goes
+// through the purchase script before claiming is tried again
+const allotmentRetry = shardInfoTTL
+
+// allotRecordBatch caps the sales recorded by one script call
+const allotRecordBatch = 100
+
+// allotmentFinalSync bounds recording and returning allotments on shutdown
+const allotmentFinalSync = 10 * time.Second
+
+// Lua script claiming up to ARGV[2] units of a product for server ARGV[1].
+// Returns the units claimed and the generation of the product they belong
+// to. Sharded products, products in queue mode, strict durability mode,
+// paused, outside their sale window at time ARGV[3], only on sale to
+// their allowlist, with a per-user limit or part of a sale event, and
+// unknown products are not allotted and return -1: their scripts check
+// each buyer against Redis, which an allotted sale never reaches.
+var claimScript = newScript(`
+if redis.call("EXISTS", KEYS[2]) == 1 or redis.call("EXISTS", KEYS[3]) == 1 or redis.call("EXISTS", KEYS[4]) == 1 or
+    redis.call("EXISTS", KEYS[6]) == 1 or redis.call("HEXISTS", KEYS[7], "sale_event") == 1 or
+    redis.call("HEXISTS", KEYS[7], "per_user_limit") == 1 then
+    return {-1, ""}
+end
+local window = redis.call("HMGET", KEYS[7], "sale_start", "sale_end")
+local now = tonumber(ARGV[3])
+if (window[1] and now < tonumber(window[1])) or (window[2] and now >= tonumber(window[2])) or
+    (not window[1] and redis.call("EXISTS", KEYS[8]) == 1) then
+    return {-1, ""}
+end
+local stock = tonumber(redis.call("GET", KEYS[1]))
+if not stock then
+    return {-1, ""}
+end
+local generation = redis.call("HGET", KEYS[7], "generation") or "0"
+local n = math.min(stock, tonumber(ARGV[2]))
+if n <= 0 then
+    return {0, generation}
+end
+redis.call("DECRBY", KEYS[1], n)
+redis.call("HINCRBY", KEYS[5], ARGV[1], n)
+return {n, generation}
+`)
+
+// Lua script putting up to ARGV[2] unsold units of server ARGV[1]'s
+// allotment back into stock. Returns the units returned.
+var returnAllotmentScript = newScript(`
+local held = tonumber(redis.call("HGET", KEYS[2], ARGV[1])) or 0
+local n = math.min(held, tonumber(ARGV[2]))
+if n <= 0 then
+    return 0
+end
+if redis.call("HINCRBY", KEYS[2], ARGV[1], -n) == 0 then
+    redis.call("HDEL", KEYS[2], ARGV[1])
+end
+if redis.call("EXISTS", KEYS[1]) == 1 then
+    redis.call("INCRBY", KEYS[1], n)
+end
+return n
+`)
+
+// Lua script recording sales made from server ARGV[1]'s allotment of
+// generation ARGV[6], built on grant. KEYS[9] is the user units hash and
+// KEYS[10] onwards the order and user orders keys of each sale, and
+// ARGV[7] onwards its user, order, agent and time. Sales whose order
+// exists were recorded before, by a sync whose result was lost or ahead
+// of a crash, and are skipped. Each other sale takes a unit the server
+// holds of the current generation, or else one from stock, as for sales
+// of an allotment the product was initialized again under; with no stock
+// left its order is written CANCELLED and an allotment_cancelled event
+// appended. Returns the cancelled orders.
+var recordAllottedScript = newScript(grantLua + `
+local n = (#KEYS - 9) / 2
+local held = 0
+if (redis.call("HGET", KEYS[3], "generation") or "0") == ARGV[6] then
+    held = tonumber(redis.call("HGET", KEYS[8], ARGV[1])) or 0
+end
+local used = 0
+local cancelled = {}
+for i = 0, n - 1 do
+    local order = KEYS[10 + 2 * i]
+    local user, id, agent, now = ARGV[7 + 4 * i], ARGV[8 + 4 * i], ARGV[9 + 4 * i], ARGV[10 + 4 * i]
+    local stock = tonumber(redis.call("GET", KEYS[1])) or 0
+    if redis.call("EXISTS", order) == 1 then
+        -- recorded already
+    elseif used < held or stock > 0 then
+        local allotted = used < held
+        if allotted then
+            used = used + 1
+            stock = 1
+        end
+        grant({
+            stock = KEYS[1],
+            buyers = KEYS[2],
+            meta = KEYS[3],
+            pending = KEYS[4],
+            waitlist = KEYS[5],
+            order = order,
+            user_orders = KEYS[11 + 2 * i],
+            strict = KEYS[6],
+            events = KEYS[7],
+            user_units = KEYS[9],
+        }, {
+            user = user,
+            order = id,
+            agent = agent,
+            now = now,
+            ttl = ARGV[2],
+            codec = ARGV[3],
+            maxlen = ARGV[4],
+            product = ARGV[5],
+            allotted = allotted,
+        }, stock)
+    else
+        redis.call("HSET", order,
+            "order_id", id,
+            "product_id", ARGV[5],
+            "user_id", user,
+            "quantity", 1,
+            "status", "CANCELLED",
+            "created_at", now,
+            "cancelled_at", now,
+            "cancel_reason", "allotment_stale")
+        if agent ~= "" then
+            redis.call("HSET", order, "agent_id", agent)
+        end
+        redis.call("ZADD", KEYS[11 + 2 * i], now, id)
+        redis.call("XADD", KEYS[7], "MAXLEN", "~", ARGV[4], "*",
+            "type", "allotment_cancelled",
+            "product_id", ARGV[5],
+            "buyer", user,
+            "order_id", id,
+            "status", "CANCELLED",
+            "timestamp", now)
+        table.insert(cancelled, id)
+    end
+end
+if used > 0 and redis.call("HINCRBY", KEYS[8], ARGV[1], -used) == 0 then
+    redis.call("HDEL", KEYS[8], ARGV[1])
+end
+return cancelled
+`)
+
+// allotments are the units this process claimed per product
+type allotments struct {
+	size int64
+	node string
+	// journal holds every sale until it is recorded
+	journal *allotJournal
+	// closed is set once the final sync started; purchases then go
+	// through the purchase script
+	closed atomic.Bool
+
+	mu       sync.Mutex
+	products map[string]*allotment
+}
+
+// allotment is the claimed stock of one product. Units are either
+// remaining, being journaled or sold and waiting in sales to be recorded;
+// together they are what Redis counts as this server's allotment.
+type allotment struct {
+	mu        sync.Mutex
+	remaining int64
+	// generation is the product generation the remaining units belong to
+	generation string
+	sales      []allottedSale
+	// journaling counts the sales waiting for the journal
+	journaling int
+	// used is set by every sale and cleared by every sync
+	used bool
+	// retryAt is set while the product cannot be allotted
+	retryAt time.Time
+	// gone is set once forgetIdle dropped it from allotments
+	gone bool
+}
+
+type allottedSale struct {
+	userID, orderID, agentID string
+	at                       int64
+	generation               string
+}
+
+func (a *allotments) get(productID string) *allotment {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	al, ok := a.products[productID]
+	if !ok {
+		al = &allotment{}
+		a.products[productID] = al
+	}
+	return al
+}
+
+// forgetIdle drops al, the allotment of productID, once it holds nothing,
+// so products that were never on sale here do not pile up
+func (a *allotments) forgetIdle(productID string, al *allotment) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	if al.remaining == 0 && len(al.sales) == 0 && al.journaling == 0 && !time.Now().Before(al.retryAt) && a.products[productID] == al {
+		delete(a.products, productID)
+		al.gone = true
+		a.journal.release(productID)
+	}
+}
+
+// dropStale forgets the remaining units of the allotment of productID if
+// they belong to a generation older than generation: initializing the
+// product again dropped them from Redis
+func (a *allotments) dropStale(productID string, generation string) {
+	a.mu.Lock()
+	al, ok := a.products[productID]
+	a.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	if al.remaining > 0 && olderGeneration(al.generation, generation) {
+		log.Printf("Dropping %d allotted units of %s, the product was initialized again", al.remaining, productID)
+		al.remaining = 0
+		al.generation = ""
+	}
+}
+
+// newGeneration returns the generation of a product initialized now.
+// Generations only grow, even across a reset.
+func newGeneration() string {
+	return strconv.FormatInt(time.Now().UnixNano(), 10)
+}
+
+// olderGeneration reports whether generation a came before b. Products
+// initialized before generations were kept are generation 0.
+func olderGeneration(a, b string) bool {
+	x, _ := strconv.ParseInt(a, 10, 64)
+	y, _ := strconv.ParseInt(b, 10, 64)
+	return x < y
+}
+
+// allottedPurchase sells a unit of productID from this process's
+// allotment, claiming a new one first if it is used up. The sale is
+// journaled before it is answered. ok is false when the purchase must go
+// through the purchase script instead: the product cannot be allotted,
+// Redis has no stock left to claim, the journal failed, or allotments are
+// being returned for shutdown.
+func (r *RedisStore) allottedPurchase(ctx context.Context, productID, userID, orderID, agentID string) (PurchaseResult, bool, error) {
+	al := r.allot.get(productID)
+	al.mu.Lock()
+	for al.gone {
+		al.mu.Unlock()
+		al = r.allot.get(productID)
+		al.mu.Lock()
+	}
+
+	if r.allot.closed.Load() || time.Now().Before(al.retryAt) {
+		al.mu.Unlock()
+		return PurchaseResult{}, false, nil
+	}
+	if al.remaining == 0 {
+		n, generation, err := r.claimAllotment(ctx, productID)
+		if err != nil || n <= 0 {
+			if n < 0 {
+				al.retryAt = time.Now().Add(allotmentRetry)
+			}
+			al.mu.Unlock()
+			return PurchaseResult{}, false, err
+		}
+		al.remaining = n
+		al.generation = generation
+	}
+
+	al.remaining--
+	al.journaling++
+	now := time.Now()
+	sale := allottedSale{userID: userID, orderID: orderID, agentID: agentID, at: now.Unix(), generation: al.generation}
+	al.mu.Unlock()
+
+	err := r.allot.journal.sale(journaledSale{ProductID: productID, Generation: sale.generation, UserID: userID,
+		OrderID: orderID, AgentID: agentID, At: sale.at})
+
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	al.journaling--
+	if err != nil {
+		// The unit is still held in Redis, unless it went stale meanwhile
+		if al.generation == sale.generation {
+			al.remaining++
+		}
+		return PurchaseResult{}, false, nil
+	}
+	al.used = true
+	al.sales = append(al.sales, sale)
+
+	res := PurchaseResult{Success: true, Remaining: al.remaining, OrderID: orderID}
+	if r.opts.PaymentTTL > 0 {
+		res.PaymentDeadline = now.Add(r.opts.PaymentTTL)
+	}
+	return res, true, nil
+}
+
+// claimAllotment claims units of productID, journaling the claim first so
+// a crash cannot strand them. n is -1 if the product cannot be allotted.
+func (r *RedisStore) claimAllotment(ctx context.Context, productID string) (n int64, generation string, err error) {
+	if err := r.allot.journal.claim(productID); err != nil {
+		return 0, "", nil
+	}
+
+	ctx, cancel := r.callContext(ctx)
+	defer cancel()
+	res, err := claimScript.Run(ctx, r.client,
+		[]string{r.stockKey(productID), r.shardsKey(productID), r.queueModeKey(productID), r.strictKey(productID), r.allottedKey(productID),
+			r.pausedKey(productID), r.metaKey(productID), r.allowlistKey(productID)},
+		r.allot.node, r.allot.size, time.Now().Unix(),
+	).Slice()
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to claim stock: %w", err)
+	}
+	if len(res) != 2 {
+		return 0, "", fmt.Errorf("invalid lua response")
+	}
+	n, _ = res[0].(int64)
+	generation, _ = res[1].(string)
+	return n, generation, nil
+}
+
+// saleHalted reports whether a product's sale is paused or outside its
+// sale window, or the product joined a sale event or got a per-user
+// limit, so its allotments should go back, and the product's generation
+func (r *RedisStore) saleHalted(ctx context.Context, productID string) (bool, string, error) {
+	var paused *redis.IntCmd
+	var window *redis.SliceCmd
+	_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		paused = pipe.Exists(ctx, r.pausedKey(productID))
+		window = pipe.HMGet(ctx, r.metaKey(productID), "sale_start", "sale_end", "sale_event", "generation", "per_user_limit")
+		return nil
+	})
+	if err != nil {
+		return false, "", err
+	}
+	vals := window.Val()
+	generation, _ := vals[3].(string)
+	_, event := vals[2].(string)
+	if _, limited := vals[4].(string); paused.Val() == 1 || event || limited {
+		return true, generation, nil
+	}
+	var info ProductInfo
+	if start, ok := vals[0].(string); ok {
+		info.SaleStart = parseUnix(start)
+	}
+	if end, ok := vals[1].(string); ok {
+		info.SaleEnd = parseUnix(end)
+	}
+	state := info.State(time.Now())
+	return state == StateScheduled || state == StateEnded, generation, nil
+}
+
+// RunAllotmentSync records allotted sales and returns idle allotments
+// every interval until ctx is done. Allotments of a product initialized
+// again stop selling once its restock announcement arrives.
+func (r *RedisStore) RunAllotmentSync(ctx context.Context, interval time.Duration) {
+	if r.allot == nil {
+		return
+	}
+
+	sub := r.client.Subscribe(ctx, r.key(RestockChannel))
+	defer sub.Close()
+	announced := sub.Channel()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			r.allot.closed.Store(true)
+			final, cancel := context.WithTimeout(context.WithoutCancel(ctx), allotmentFinalSync)
+			r.syncAllotments(final, true)
+			cancel()
+			return
+		case msg, ok := <-announced:
+			if ok {
+				r.checkGeneration(ctx, msg.Payload)
+			}
+		case <-ticker.C:
+			r.syncAllotments(ctx, false)
+		}
+	}
+}
+
+// checkGeneration drops the allotment of productID if the product was
+// initialized again since it was claimed
+func (r *RedisStore) checkGeneration(ctx context.Context, productID string) {
+	r.allot.mu.Lock()
+	_, ok := r.allot.products[productID]
+	r.allot.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	generation, err := r.client.HGet(ctx, r.metaKey(productID), "generation").Result()
+	if err == redis.Nil {
+		generation = "0"
+	} else if err != nil {
+		// The next sync checks again
+		return
+	}
+	r.allot.dropStale(productID, generation)
+}
+
+// syncAllotments records the sales of every allotment. Allotments not
+// used since the last sync, of paused products or products outside their
+// sale window, or all of them with returnAll, go back into stock.
+// Allotments of an older generation than their product are dropped.
+func (r *RedisStore) syncAllotments(ctx context.Context, returnAll bool) {
+	r.allot.mu.Lock()
+	ids := make([]string, 0, len(r.allot.products))
+	for id := range r.allot.products {
+		ids = append(ids, id)
+	}
+	r.allot.mu.Unlock()
+	sort.Strings(ids)
+
+	for _, productID := range ids {
+		// Failing to tell counts as open; recording fails then too
+		halted, generation, err := r.saleHalted(ctx, productID)
+		if err == nil {
+			r.allot.dropStale(productID, generation)
+		}
+
+		al := r.allot.get(productID)
+		al.mu.Lock()
+		sales := al.sales
+		al.sales = nil
+		var unsold int64
+		if returnAll || halted || !al.used {
+			unsold = al.remaining
+			al.remaining = 0
+		}
+		al.used = false
+		al.mu.Unlock()
+
+		// Returned first, so sales of an older generation can be recorded
+		// from the units
+		returned := true
+		if unsold > 0 {
+			if err := r.returnAllotment(ctx, productID, unsold); err != nil {
+				log.Printf("Failed to return %d allotted units of %s: %v", unsold, productID, err)
+				returned = false
+				if !returnAll {
+					al.mu.Lock()
+					al.remaining += unsold
+					al.mu.Unlock()
+				}
+			}
+		}
+		if err := r.recordAllotted(ctx, productID, sales); err != nil {
+			log.Printf("Failed to record %d allotted sales of %s, retrying next sync: %v", len(sales), productID, err)
+			al.mu.Lock()
+			al.sales = append(sales, al.sales...)
+			al.mu.Unlock()
+		}
+		if returned {
+			r.allot.forgetIdle(productID, al)
+		}
+	}
+
+	if err := r.allot.journal.compact(); err != nil {
+		log.Printf("Failed to compact allotment journal: %v", err)
+	}
+}
+
+// recordAllotted writes the buyer entries, orders and counters of sales
+// made from this process's allotment of productID, and drops them from the
+// journal. Sales recorded without a unit are cancelled and logged.
+func (r *RedisStore) recordAllotted(ctx context.Context, productID string, sales []allottedSale) error {
+	for len(sales) > 0 {
+		// A batch is recorded against one generation
+		size := 1
+		for size < min(len(sales), allotRecordBatch) && sales[size].generation == sales[0].generation {
+			size++
+		}
+		batch := sales[:size]
+
+		keys := []string{r.stockKey(productID), r.buyersKey(productID), r.metaKey(productID), r.key(pendingOrdersKey),
+			r.waitlistKey(productID), r.strictKey(productID), r.key(EventsStream), r.allottedKey(productID), r.userUnitsKey(productID)}
+		args := []interface{}{r.allot.node, int64(r.opts.PaymentTTL.Seconds()), r.opts.ValueCodec.Name(), r.opts.EventsMaxLen, productID,
+			batch[0].generation}
+		for _, s := range batch {
+			keys = append(keys, r.orderKey(s.orderID), r.userOrdersKey(s.userID))
+			args = append(args, s.userID, s.orderID, s.agentID, s.at)
+		}
+
+		cancelled, err := recordAllottedScript.Run(ctx, r.client, keys, args...).StringSlice()
+		if err != nil {
+			return fmt.Errorf("failed to record allotted sales: %w", err)
+		}
+		if len(cancelled) > 0 {
+			log.Printf("WARNING: cancelled %d allotted sales of %s, sold after the product was initialized again with none of its new stock left: %v",
+				len(cancelled), productID, cancelled)
+		}
+		r.allot.journal.recorded(batch)
+		sales = sales[len(batch):]
+	}
+	return nil
+}
+
+// recoverAllotments records the sales journaled by a previous run of this
+// server and returns every unit it still holds, before anything is sold
+func (r *RedisStore) recoverAllotments(ctx context.Context) error {
+	sales, claimed := r.allot.journal.pending()
+	if len(sales) == 0 && len(claimed) == 0 {
+		return nil
+	}
+
+	byProduct := make(map[string][]allottedSale)
+	for _, s := range sales {
+		byProduct[s.ProductID] = append(byProduct[s.ProductID], allottedSale{userID: s.UserID, orderID: s.OrderID,
+			agentID: s.AgentID, at: s.At, generation: s.Generation})
+	}
+	for productID, sales := range byProduct {
+		if err := r.recordAllotted(ctx, productID, sales); err != nil {
+			return err
+		}
+	}
+
+	var returned int64
+	for _, productID := range claimed {
+		n, err := r.ReclaimAllotment(ctx, productID, r.allot.node)
+		if err != nil {
+			return err
+		}
+		returned += n
+		r.allot.journal.release(productID)
+	}
+	log.Printf("Recovered %d journaled allotted sales and returned %d held units of %d products", len(sales), returned, len(claimed))
+	return r.allot.journal.compact()
+}
+
+// returnAllotment puts n unsold units of this process's allotment of
+// productID back into stock
+func (r *RedisStore) returnAllotment(ctx context.Context, productID string, n int64) error {
+	returned, err := returnAllotmentScript.Run(ctx, r.client,
+		[]string{r.stockKey(productID), r.allottedKey(productID)}, r.allot.node, n).Int64()
+	if err != nil {
+		return fmt.Errorf("failed to return allotment: %w", err)
+	}
+	if returned > 0 {
+		r.announceRestock(ctx, productID)
+	}
+	return nil
+}
+
+// ReclaimAllotment returns every unit node holds of productID to stock.
+// A server does so itself for its journaled claims when it starts again;
+// this is for a server that will not, or lost its journal, whose sales
+// never recorded are then lost and their units sold again.
+func (r *RedisStore) ReclaimAllotment(ctx context.Context, productID, node string) (int64, error) {
+	returned, err := returnAllotmentScript.Run(ctx, r.client,
+		[]string{r.stockKey(productID), r.allottedKey(productID)}, node, int64(1<<62)).Int64()
+	if err != nil {
+		return 0, fmt.Errorf("failed to reclaim allotment: %w", err)
+	}
+	if returned > 0 {
+		r.announceRestock(ctx, productID)
+	}
+	return returned, nil
+}
+
+// Allotments returns the units each server holds of productID
+func (r *RedisStore) Allotments(ctx context.Context, productID string) (map[string]int64, error) {
+	fields, err := r.client.HGetAll(ctx, r.allottedKey(productID)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get allotments: %w", err)
+	}
+	held := make(map[string]int64, len(fields))
+	for node, v := range fields {
+		held[node], _ = strconv.ParseInt(v, 10, 64)
+	}
+	return held, nil
+}
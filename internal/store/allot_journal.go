@@ -0,0 +1,272 @@
+package store
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+)
+
+// allotJournal keeps every allotted sale on disk from before it is
+// answered until it is recorded in Redis, and the products this process
+// claimed allotments of, so a server that stopped without syncing records
+// its sales and returns its allotments when it starts again. Sales waiting
+// for the disk are written and synced together.
+type allotJournal struct {
+	path string
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	f    *os.File
+	// buf holds the lines appended since the last write; queued counts
+	// every line appended and synced those on disk
+	buf     []byte
+	queued  uint64
+	synced  uint64
+	syncing bool
+	// err is set once writing failed, and allotted sales stop
+	err error
+	// sales are the journaled sales not recorded yet, by order ID
+	sales map[string]journaledSale
+	// claimed are the products this process may hold an allotment of
+	claimed map[string]bool
+	// shrunk is set once entries were dropped since the last compaction
+	shrunk bool
+}
+
+type journaledSale struct {
+	ProductID  string `json:"product_id"`
+	Generation string `json:"generation"`
+	UserID     string `json:"user_id"`
+	OrderID    string `json:"order_id"`
+	AgentID    string `json:"agent_id,omitempty"`
+	At         int64  `json:"at"`
+}
+
+// journalEntry is one line of the journal, either a claim or a sale
+type journalEntry struct {
+	Claim string         `json:"claim,omitempty"`
+	Sale  *journaledSale `json:"sale,omitempty"`
+}
+
+// openAllotJournal loads the journal at path, creating it if needed
+func openAllotJournal(path string) (*allotJournal, error) {
+	j := &allotJournal{path: path, sales: make(map[string]journaledSale), claimed: make(map[string]bool)}
+	j.cond = sync.NewCond(&j.mu)
+	if err := j.load(); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open allotment journal: %w", err)
+	}
+	j.f = f
+	return j, nil
+}
+
+func (j *allotJournal) load() error {
+	f, err := os.Open(j.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to open allotment journal: %w", err)
+	}
+	defer f.Close()
+
+	var corrupt error
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Only the last line may be cut short, by a crash while a sale
+		// that was never answered was written
+		if corrupt != nil {
+			return corrupt
+		}
+		var e journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			corrupt = fmt.Errorf("corrupt allotment journal entry: %w", err)
+			continue
+		}
+		if e.Claim != "" {
+			j.claimed[e.Claim] = true
+		}
+		if e.Sale != nil {
+			j.sales[e.Sale.OrderID] = *e.Sale
+		}
+	}
+	if corrupt != nil {
+		log.Printf("WARNING: ignoring the cut short last entry of allotment journal %s", j.path)
+	}
+	return scanner.Err()
+}
+
+// claim journals that this process is about to claim units of productID
+func (j *allotJournal) claim(productID string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.claimed[productID] {
+		return nil
+	}
+
+	line, _ := json.Marshal(journalEntry{Claim: productID})
+	j.claimed[productID] = true
+	if err := j.appendLocked(line); err != nil {
+		delete(j.claimed, productID)
+		return err
+	}
+	return nil
+}
+
+// sale journals s, returning once it is on disk
+func (j *allotJournal) sale(s journaledSale) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	line, _ := json.Marshal(journalEntry{Sale: &s})
+	j.sales[s.OrderID] = s
+	if err := j.appendLocked(line); err != nil {
+		delete(j.sales, s.OrderID)
+		return err
+	}
+	return nil
+}
+
+// appendLocked appends line and waits until it is synced, writing it
+// along with every line queued behind the write in progress
+func (j *allotJournal) appendLocked(line []byte) error {
+	if j.err != nil {
+		return j.err
+	}
+	j.buf = append(append(j.buf, line...), '\n')
+	j.queued++
+	seq := j.queued
+
+	for j.synced < seq && j.err == nil {
+		if j.syncing {
+			j.cond.Wait()
+			continue
+		}
+		buf, upTo, f := j.buf, j.queued, j.f
+		j.buf = nil
+		j.syncing = true
+		j.mu.Unlock()
+		_, err := f.Write(buf)
+		if err == nil {
+			err = f.Sync()
+		}
+		j.mu.Lock()
+		j.syncing = false
+		if err != nil {
+			j.err = fmt.Errorf("failed to write allotment journal: %w", err)
+			log.Printf("WARNING: %v; products are no longer sold from allotments", j.err)
+		} else {
+			j.synced = upTo
+		}
+		j.cond.Broadcast()
+	}
+	return j.err
+}
+
+// recorded drops sales now recorded in Redis
+func (j *allotJournal) recorded(sales []allottedSale) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, s := range sales {
+		delete(j.sales, s.orderID)
+	}
+	j.shrunk = j.shrunk || len(sales) > 0
+}
+
+// release drops the claim of productID once this process holds nothing
+// of it
+func (j *allotJournal) release(productID string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.claimed[productID] {
+		delete(j.claimed, productID)
+		j.shrunk = true
+	}
+}
+
+// pending returns the sales not recorded yet, oldest first, and the
+// claimed products
+func (j *allotJournal) pending() ([]journaledSale, []string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	sales := make([]journaledSale, 0, len(j.sales))
+	for _, s := range j.sales {
+		sales = append(sales, s)
+	}
+	sort.Slice(sales, func(a, b int) bool {
+		if sales[a].At != sales[b].At {
+			return sales[a].At < sales[b].At
+		}
+		return sales[a].OrderID < sales[b].OrderID
+	})
+	claimed := make([]string, 0, len(j.claimed))
+	for id := range j.claimed {
+		claimed = append(claimed, id)
+	}
+	sort.Strings(claimed)
+	return sales, claimed
+}
+
+// compact rewrites the journal with only the claims and sales still
+// pending, if any were dropped
+func (j *allotJournal) compact() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for j.syncing {
+		j.cond.Wait()
+	}
+	if j.err != nil || !j.shrunk {
+		return j.err
+	}
+
+	tmp := j.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to rewrite allotment journal: %w", err)
+	}
+
+	w := bufio.NewWriter(f)
+	for id := range j.claimed {
+		line, _ := json.Marshal(journalEntry{Claim: id})
+		w.Write(append(line, '\n'))
+	}
+	for _, s := range j.sales {
+		line, _ := json.Marshal(journalEntry{Sale: &s})
+		w.Write(append(line, '\n'))
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to rewrite allotment journal: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to rewrite allotment journal: %w", err)
+	}
+	f.Close()
+	if err := os.Rename(tmp, j.path); err != nil {
+		return fmt.Errorf("failed to rewrite allotment journal: %w", err)
+	}
+
+	next, err := os.OpenFile(j.path, os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		j.err = fmt.Errorf("failed to open allotment journal: %w", err)
+		log.Printf("WARNING: %v; products are no longer sold from allotments", j.err)
+		return j.err
+	}
+	j.f.Close()
+	j.f = next
+	// Lines queued but not written yet are in the new journal already
+	j.buf = nil
+	j.synced = j.queued
+	j.shrunk = false
+	j.cond.Broadcast()
+	return nil
+}
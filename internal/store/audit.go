@@ -0,0 +1,222 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const auditBatchSize = 1000
+
+// Auditor is implemented by stores that can cross-check their purchase
+// records after a sale
+type Auditor interface {
+	AuditDuplicates(ctx context.Context, productID string, progress ProgressFunc) ([]DuplicateBuyer, error)
+}
+
+var _ Auditor = (*RedisStore)(nil)
+
+// DuplicateBuyer is a user who was granted a product more than once,
+// according to at least one of the buyers list, orders or events stream
+type DuplicateBuyer struct {
+	UserID string
+	// BuyerEntries is how often the user appears in the buyers list(s)
+	BuyerEntries int
+	// Events is how many purchase events name the user
+	Events int
+	// Orders are the user's orders for the product, oldest first
+	Orders []Order
+}
+
+// Grants is the best estimate of how many units the user received
+func (d DuplicateBuyer) Grants() int {
+	return max(d.BuyerEntries, d.Events, len(d.Orders))
+}
+
+// AuditDuplicates cross-references the buyers list(s), the order records
+// and the events stream of a product and returns every user granted more
+// than one unit, sorted by user ID. Orders and events are found with SCAN
+// and XRANGE in batches, so this is safe but slow on a live Redis.
+// Progress is reported per batch through progress.
+func (r *RedisStore) AuditDuplicates(ctx context.Context, productID string, progress ProgressFunc) ([]DuplicateBuyer, error) {
+	users := make(map[string]*DuplicateBuyer)
+	user := func(id string) *DuplicateBuyer {
+		d, ok := users[id]
+		if !ok {
+			d = &DuplicateBuyer{UserID: id}
+			users[id] = d
+		}
+		return d
+	}
+
+	buyers, err := r.Buyers(ctx, productID)
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range buyers {
+		user(b).BuyerEntries++
+	}
+	progress.report("buyers", int64(len(buyers)), int64(len(buyers)))
+
+	orders, err := r.productOrders(ctx, productID, progress)
+	if err != nil {
+		return nil, err
+	}
+	for _, o := range orders {
+		d := user(o.UserID)
+		d.Orders = append(d.Orders, o)
+	}
+
+	err = r.scanPurchaseEvents(ctx, productID, progress, func(buyer string) {
+		user(buyer).Events++
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var dups []DuplicateBuyer
+	for _, d := range users {
+		if d.Grants() > 1 {
+			dups = append(dups, *d)
+		}
+	}
+	sort.Slice(dups, func(i, j int) bool { return dups[i].UserID < dups[j].UserID })
+	return dups, nil
+}
+
+// ProductOrders returns every order of a product, oldest first
+func (r *RedisStore) ProductOrders(ctx context.Context, productID string) ([]Order, error) {
+	return r.productOrders(ctx, productID, nil)
+}
+
+func (r *RedisStore) productOrders(ctx context.Context, productID string, progress ProgressFunc) ([]Order, error) {
+	var orders []Order
+	var scanned int64
+
+	iter := r.client.Scan(ctx, 0, r.orderKey("*"), auditBatchSize).Iterator()
+	var keys []string
+	flush := func() error {
+		if len(keys) == 0 {
+			return nil
+		}
+		cmds, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, key := range keys {
+				pipe.HMGet(ctx, key, "order_id", "product_id", "user_id", "quantity", "status", "created_at", "agent_id", "bundle_id")
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to get orders: %w", err)
+		}
+		for _, cmd := range cmds {
+			vals := cmd.(*redis.SliceCmd).Val()
+			field := func(i int) string {
+				s, _ := vals[i].(string)
+				return s
+			}
+			if field(1) != productID {
+				continue
+			}
+			o := Order{
+				ID:        field(0),
+				ProductID: productID,
+				UserID:    field(2),
+				AgentID:   field(6),
+				BundleID:  field(7),
+				Status:    field(4),
+				CreatedAt: parseUnix(field(5)),
+			}
+			o.Quantity, _ = strconv.ParseInt(field(3), 10, 64)
+			orders = append(orders, o)
+		}
+		scanned += int64(len(keys))
+		progress.report("orders", scanned, 0)
+		keys = keys[:0]
+		return nil
+	}
+
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+		if len(keys) >= auditBatchSize {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("failed to scan orders: %w", err)
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+
+	// Snowflake IDs sort by creation time
+	sort.Slice(orders, func(i, j int) bool {
+		a, _ := strconv.ParseInt(orders[i].ID, 10, 64)
+		b, _ := strconv.ParseInt(orders[j].ID, 10, 64)
+		return a < b
+	})
+	return orders, nil
+}
+
+// scanPurchaseEvents calls fn with the buyer of every purchase event of a
+// product still in the events stream
+func (r *RedisStore) scanPurchaseEvents(ctx context.Context, productID string, progress ProgressFunc, fn func(buyer string)) error {
+	return r.scanEvents(ctx, productID, progress, func(id string, fields map[string]interface{}) error {
+		if fields["type"] == "purchase" {
+			if buyer, ok := fields["buyer"].(string); ok {
+				fn(buyer)
+			}
+		}
+		return nil
+	})
+}
+
+// ProductEvents calls fn with every event of a product still in the
+// events stream, oldest first
+func (r *RedisStore) ProductEvents(ctx context.Context, productID string, fn func(id string, fields map[string]interface{}) error) error {
+	return r.scanEvents(ctx, productID, nil, fn)
+}
+
+// Events calls fn with every event still in the events stream, oldest
+// first
+func (r *RedisStore) Events(ctx context.Context, fn func(id string, fields map[string]interface{}) error) error {
+	return r.scanEvents(ctx, "", nil, fn)
+}
+
+// scanEvents walks the events stream in batches; an empty productID
+// matches every product
+func (r *RedisStore) scanEvents(ctx context.Context, productID string, progress ProgressFunc, fn func(id string, fields map[string]interface{}) error) error {
+	total, err := r.client.XLen(ctx, r.key(EventsStream)).Result()
+	if err != nil {
+		return fmt.Errorf("failed to read events stream: %w", err)
+	}
+
+	var read int64
+	start := "-"
+	for {
+		msgs, err := r.client.XRangeN(ctx, r.key(EventsStream), start, "+", auditBatchSize).Result()
+		if err != nil {
+			return fmt.Errorf("failed to read events stream: %w", err)
+		}
+
+		for _, msg := range msgs {
+			if productID == "" || msg.Values["product_id"] == productID {
+				if err := fn(msg.ID, msg.Values); err != nil {
+					return err
+				}
+			}
+		}
+
+		read += int64(len(msgs))
+		progress.report("events", read, max(total, read))
+
+		if len(msgs) < auditBatchSize {
+			return nil
+		}
+		start = "(" + msgs[len(msgs)-1].ID
+	}
+}
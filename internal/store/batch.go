@@ -0,0 +1,102 @@
+package store
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// defaultBatchMax caps a purchase batch when BatchMax is not set
+const defaultBatchMax = 64
+
+// purchaseBatcher collects purchase scripts for the same stock key that
+// arrive within a window and sends them to Redis in one pipeline. Every
+// script still runs atomically on its own, in arrival order; only the
+// round trips are shared.
+type purchaseBatcher struct {
+	client  *redis.Client
+	window  time.Duration
+	max     int
+	onBatch func(size int)
+
+	mu      sync.Mutex
+	pending map[string]*purchaseBatch
+}
+
+type purchaseBatch struct {
+	ctx  context.Context
+	cmds []*redis.Cmd
+	done chan struct{}
+}
+
+func newPurchaseBatcher(client *redis.Client, opts RedisStoreOptions) *purchaseBatcher {
+	max := opts.BatchMax
+	if max <= 0 {
+		max = defaultBatchMax
+	}
+	return &purchaseBatcher{
+		client:  client,
+		window:  opts.BatchWindow,
+		max:     max,
+		onBatch: opts.OnBatch,
+		pending: make(map[string]*purchaseBatch),
+	}
+}
+
+// do adds cmd to the open batch of key, or opens one, and waits for the
+// batch to run. The batch runs with the context of its first command,
+// without its cancellation, so one caller giving up does not fail the
+// others.
+func (b *purchaseBatcher) do(ctx context.Context, key string, cmd *redis.Cmd) error {
+	b.mu.Lock()
+	batch, ok := b.pending[key]
+	if !ok {
+		batch = &purchaseBatch{ctx: context.WithoutCancel(ctx), done: make(chan struct{})}
+		b.pending[key] = batch
+		time.AfterFunc(b.window, func() { b.flush(key, batch) })
+	}
+	batch.cmds = append(batch.cmds, cmd)
+	full := len(batch.cmds) >= b.max
+	b.mu.Unlock()
+
+	if full {
+		b.flush(key, batch)
+	}
+
+	select {
+	case <-batch.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return cmd.Err()
+}
+
+// flush runs batch if it is still the open batch of key; a batch that
+// filled up is flushed by its last caller before its timer fires
+func (b *purchaseBatcher) flush(key string, batch *purchaseBatch) {
+	b.mu.Lock()
+	if b.pending[key] != batch {
+		b.mu.Unlock()
+		return
+	}
+	delete(b.pending, key)
+	b.mu.Unlock()
+
+	if b.onBatch != nil {
+		b.onBatch(len(batch.cmds))
+	}
+	// Each caller reads its own result and error from its Cmd; a failed
+	// pipeline sets the error on all of them
+	if len(batch.cmds) == 1 {
+		b.client.Process(batch.ctx, batch.cmds[0])
+	} else {
+		pipe := b.client.Pipeline()
+		for _, cmd := range batch.cmds {
+			pipe.Process(batch.ctx, cmd)
+		}
+		pipe.Exec(batch.ctx)
+	}
+	close(batch.done)
+}
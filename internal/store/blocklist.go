@@ -0,0 +1,104 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"sort"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// BlocklistChannel is published on whenever the blocklist changes, so
+// servers load it again
+const BlocklistChannel = "flashsale:blocklist"
+
+// blockedUsersKey and blockedNetsKey hold the blocked user IDs and the
+// blocked networks in CIDR notation
+const (
+	blockedUsersKey = "blocklist:users"
+	blockedNetsKey  = "blocklist:networks"
+)
+
+// Blocklist is the users and networks that may not buy
+type Blocklist struct {
+	Users    []string
+	Networks []netip.Prefix
+}
+
+// Blocklists is implemented by stores keeping a blocklist
+type Blocklists interface {
+	// Blocklist returns every blocked user and network
+	Blocklist(ctx context.Context) (Blocklist, error)
+}
+
+var _ Blocklists = (*RedisStore)(nil)
+
+// Blocklist returns every blocked user and network, sorted. Entries that
+// no longer parse are skipped.
+func (r *RedisStore) Blocklist(ctx context.Context) (Blocklist, error) {
+	var users, nets *redis.StringSliceCmd
+	_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		users = pipe.SMembers(ctx, r.key(blockedUsersKey))
+		nets = pipe.SMembers(ctx, r.key(blockedNetsKey))
+		return nil
+	})
+	if err != nil {
+		return Blocklist{}, fmt.Errorf("failed to get blocklist: %w", err)
+	}
+
+	b := Blocklist{Users: users.Val()}
+	sort.Strings(b.Users)
+	for _, s := range nets.Val() {
+		if p, err := netip.ParsePrefix(s); err == nil {
+			b.Networks = append(b.Networks, p)
+		}
+	}
+	sort.Slice(b.Networks, func(i, j int) bool {
+		return b.Networks[i].String() < b.Networks[j].String()
+	})
+	return b, nil
+}
+
+// Block adds users and networks to the blocklist and announces the change
+func (r *RedisStore) Block(ctx context.Context, b Blocklist) error {
+	return r.changeBlocklist(ctx, b, true)
+}
+
+// Unblock removes users and networks from the blocklist and announces the
+// change
+func (r *RedisStore) Unblock(ctx context.Context, b Blocklist) error {
+	return r.changeBlocklist(ctx, b, false)
+}
+
+func (r *RedisStore) changeBlocklist(ctx context.Context, b Blocklist, add bool) error {
+	users := make([]interface{}, len(b.Users))
+	for i, u := range b.Users {
+		users[i] = u
+	}
+	nets := make([]interface{}, len(b.Networks))
+	for i, p := range b.Networks {
+		nets[i] = p.Masked().String()
+	}
+
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		switch {
+		case add && len(users) > 0:
+			pipe.SAdd(ctx, r.key(blockedUsersKey), users...)
+		case len(users) > 0:
+			pipe.SRem(ctx, r.key(blockedUsersKey), users...)
+		}
+		switch {
+		case add && len(nets) > 0:
+			pipe.SAdd(ctx, r.key(blockedNetsKey), nets...)
+		case len(nets) > 0:
+			pipe.SRem(ctx, r.key(blockedNetsKey), nets...)
+		}
+		pipe.Publish(ctx, r.key(BlocklistChannel), "changed")
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to change blocklist: %w", err)
+	}
+	return nil
+}
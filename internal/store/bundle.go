@@ -0,0 +1,254 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// MaxBundleSize caps how many products one bundle purchase can contain
+const MaxBundleSize = 10
+
+// ErrBundleNotSupported is returned for bundles containing a product the
+// bundle script cannot buy atomically with the others
+var ErrBundleNotSupported = errors.New("product cannot be bought in a bundle")
+
+// Lua script buying one unit of every product of a bundle, or none. Every
+// stock key is checked before any is decremented, so a bundle with one
+// sold out product changes nothing. Each product then gets its own order
+// through grant, tagged with the bundle ID ARGV[6].
+//
+// KEYS[1..3] are the pending orders index, the user's order index and the
+// events stream, followed by 10 keys per product: stock, buyers, order,
+// meta, strict, waitlist, queue mode flag, paused flag, user units and
+// allowlist. ARGV[1..6] are the user,
+// events stream cap, time, payment TTL, value codec and bundle ID,
+// followed by the product and order ID of each product.
+//
+// Returns {1, remaining, recorded, ...} with a pair per product, or
+// {0, i} if product i is sold out, {-1, i} if it is in queue mode,
+// {-2, i} if its sale is paused, {-3, i} if the user reached its
+// per-user limit, {-7, i} if they bought in its sale event or the bundle
+// has another product of that event, {-4, i} or {-5, i} before or after its sale window, and
+// {-6, i} if the user is not on its allowlist.
+var bundleScript = newScript(grantLua + `
+local n = (#KEYS - 3) / 10
+local stocks = {}
+local events = {}
+for i = 1, n do
+    local k = 3 + (i - 1) * 10
+    local closed = sale_closed(KEYS[k + 4], KEYS[k + 10], ARGV[1], ARGV[3])
+    if closed > 0 then
+        return {-3 - closed, i}
+    end
+    if redis.call("EXISTS", KEYS[k + 7]) == 1 then
+        return {-1, i}
+    end
+    if redis.call("EXISTS", KEYS[k + 8]) == 1 then
+        return {-2, i}
+    end
+    local limited = user_limit_reached(KEYS[k + 4], KEYS[k + 9], ARGV[1])
+    if limited == "event" then
+        return {-7, i}
+    elseif limited then
+        return {-3, i}
+    end
+    local event = redis.call("HGET", KEYS[k + 4], "sale_event")
+    if event then
+        if events[event] then
+            return {-7, i}
+        end
+        events[event] = true
+    end
+    local stock = tonumber(redis.call("GET", KEYS[k + 1]))
+    if not stock or stock <= 0 then
+        return {0, i}
+    end
+    stocks[i] = stock
+end
+
+local result = {1}
+for i = 1, n do
+    local k = 3 + (i - 1) * 10
+    local a = 6 + (i - 1) * 2
+    local remaining, recorded = grant({
+        stock = KEYS[k + 1],
+        buyers = KEYS[k + 2],
+        order = KEYS[k + 3],
+        meta = KEYS[k + 4],
+        strict = KEYS[k + 5],
+        waitlist = KEYS[k + 6],
+        user_units = KEYS[k + 9],
+        pending = KEYS[1],
+        user_orders = KEYS[2],
+        events = KEYS[3],
+    }, {
+        user = ARGV[1],
+        maxlen = ARGV[2],
+        now = ARGV[3],
+        ttl = ARGV[4],
+        codec = ARGV[5],
+        bundle = ARGV[6],
+        product = ARGV[a + 1],
+        order = ARGV[a + 2],
+        agent = "",
+    }, stocks[i])
+    table.insert(result, remaining)
+    table.insert(result, recorded)
+end
+return result
+`)
+
+// BundleItem is the order created for one product of a bundle
+type BundleItem struct {
+	ProductID string
+	OrderID   string
+	// Remaining is the product's stock after the purchase
+	Remaining int64
+	// Recorded is true when the item's purchase event is already in the
+	// events stream
+	Recorded bool
+}
+
+// BundleResult is the outcome of a bundle purchase attempt
+type BundleResult struct {
+	// Success is false when any product of the bundle is sold out, in
+	// which case nothing was bought and SoldOut is that product
+	Success  bool
+	SoldOut  string
+	BundleID string
+	Items    []BundleItem
+	// PaymentDeadline is set when the orders are PENDING
+	PaymentDeadline time.Time
+}
+
+// OrderStatus is the status of the orders a successful bundle created
+func (b BundleResult) OrderStatus() string {
+	if b.PaymentDeadline.IsZero() {
+		return OrderConfirmed
+	}
+	return OrderPending
+}
+
+// BundlePurchaser is implemented by stores that can buy several products
+// atomically
+type BundlePurchaser interface {
+	// AttemptBundlePurchase buys one unit of each product for userID, or
+	// nothing if any of them is sold out
+	AttemptBundlePurchase(ctx context.Context, productIDs []string, userID string) (BundleResult, error)
+}
+
+var _ BundlePurchaser = (*RedisStore)(nil)
+
+// AttemptBundlePurchase runs the bundle script over every product of the
+// bundle. A single script can only see the keys it is given, so sharded
+// products, whose purchases pick a shard as they go, cannot be bundled;
+// neither can products in queue mode.
+func (r *RedisStore) AttemptBundlePurchase(ctx context.Context, productIDs []string, userID string) (BundleResult, error) {
+	if len(productIDs) == 0 || len(productIDs) > MaxBundleSize {
+		return BundleResult{}, fmt.Errorf("a bundle must have 1 to %d products, got %d", MaxBundleSize, len(productIDs))
+	}
+
+	bundleID := strconv.FormatInt(r.opts.OrderIDs.Next(), 10)
+	keys := []string{r.key(pendingOrdersKey), r.userOrdersKey(userID), r.key(EventsStream)}
+	args := []interface{}{
+		userID,
+		r.opts.EventsMaxLen,
+		time.Now().Unix(),
+		int64(r.opts.PaymentTTL.Seconds()),
+		r.opts.ValueCodec.Name(),
+		bundleID,
+	}
+	items := make([]BundleItem, len(productIDs))
+	seen := make(map[string]bool, len(productIDs))
+	for i, productID := range productIDs {
+		if seen[productID] {
+			return BundleResult{}, fmt.Errorf("product %s is in the bundle twice", productID)
+		}
+		seen[productID] = true
+
+		si, err := r.shardLayout(ctx, productID)
+		if err != nil {
+			return BundleResult{}, fmt.Errorf("redis error: %w", err)
+		}
+		if si.count > 0 {
+			return BundleResult{}, fmt.Errorf("%w: %s is sharded", ErrBundleNotSupported, productID)
+		}
+
+		orderID := strconv.FormatInt(r.opts.OrderIDs.Next(), 10)
+		items[i] = BundleItem{ProductID: productID, OrderID: orderID}
+		keys = append(keys, r.stockKey(productID), r.buyersKey(productID), r.orderKey(orderID), r.metaKey(productID),
+			r.strictKey(productID), r.waitlistKey(productID), r.queueModeKey(productID), r.pausedKey(productID),
+			r.userUnitsKey(productID), r.allowlistKey(productID))
+		args = append(args, productID, orderID)
+	}
+
+	cmd, pinned, release, err := r.durableConn(ctx, productIDs...)
+	if err != nil {
+		return BundleResult{}, fmt.Errorf("redis error: %w", err)
+	}
+	defer release()
+
+	res, err := bundleScript.Run(ctx, cmd, keys, args...).Int64Slice()
+	if err != nil {
+		return BundleResult{}, fmt.Errorf("redis error: %w", err)
+	}
+	if len(res) < 2 {
+		return BundleResult{}, fmt.Errorf("invalid lua response")
+	}
+
+	switch res[0] {
+	case 1:
+	case 0, -1, -2, -3, -4, -5, -6, -7:
+		i := int(res[1]) - 1
+		if i < 0 || i >= len(productIDs) {
+			return BundleResult{}, fmt.Errorf("invalid lua response")
+		}
+		if res[0] == -1 {
+			return BundleResult{}, fmt.Errorf("%w: %s is in queue mode", ErrBundleNotSupported, productIDs[i])
+		}
+		if res[0] == -2 {
+			return BundleResult{}, fmt.Errorf("%w: %s", ErrSalePaused, productIDs[i])
+		}
+		if res[0] == -3 {
+			return BundleResult{}, fmt.Errorf("%w: %s", ErrUserLimitReached, productIDs[i])
+		}
+		if res[0] == -4 {
+			return BundleResult{}, fmt.Errorf("%w: %s", ErrSaleNotStarted, productIDs[i])
+		}
+		if res[0] == -5 {
+			return BundleResult{}, fmt.Errorf("%w: %s", ErrSaleEnded, productIDs[i])
+		}
+		if res[0] == -6 {
+			return BundleResult{}, fmt.Errorf("%w: %s", ErrNotEligible, productIDs[i])
+		}
+		if res[0] == -7 {
+			return BundleResult{}, fmt.Errorf("%w: %s", ErrSaleEventLimitReached, productIDs[i])
+		}
+		return BundleResult{SoldOut: productIDs[i]}, nil
+	default:
+		return BundleResult{}, fmt.Errorf("invalid lua response")
+	}
+	if len(res) != 1+2*len(items) {
+		return BundleResult{}, fmt.Errorf("invalid lua response")
+	}
+
+	result := BundleResult{Success: true, BundleID: bundleID, Items: items}
+	recorded := false
+	for i := range items {
+		items[i].Remaining = res[1+2*i]
+		items[i].Recorded = res[2+2*i] == 1
+		recorded = recorded || items[i].Recorded
+	}
+	if r.opts.PaymentTTL > 0 {
+		result.PaymentDeadline = time.Now().Add(r.opts.PaymentTTL)
+	}
+	if recorded && r.opts.StrictWaitAOF > 0 {
+		if err := r.confirmDurable(ctx, cmd, pinned, productIDs...); err != nil {
+			return result, fmt.Errorf("%w: %v", ErrNotDurable, err)
+		}
+	}
+	return result, nil
+}
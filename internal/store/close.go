@@ -0,0 +1,144 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// closingSalesKey is a sorted set of the products whose sale has an end,
+// scored by it, until the sale closer closes them
+const closingSalesKey = "sales:closing"
+
+// ErrSaleClosed is returned when changing the stock of a product whose
+// sale was closed
+var ErrSaleClosed = errors.New("sale is closed")
+
+// Lua script closing the sale of product ARGV[1] once its sale_end in the
+// meta hash (KEYS[1]) has passed by ARGV[2]: the product leaves the
+// closing index (KEYS[2]), and the stock left in its stock keys (KEYS[5..])
+// and allotments (KEYS[4]) is recorded as closed_stock with a sale_closed
+// event in the events stream (KEYS[3]). Orders expired or cancelled later
+// return their units to the stock and to closed_stock. A product whose end
+// moved later since it was read stays in the index under its new end.
+// Returns {closed, remaining, sold}.
+var closeSaleScript = newScript(`
+local ends = tonumber(redis.call("HGET", KEYS[1], "sale_end"))
+if ends and ends > tonumber(ARGV[2]) then
+    return {0, 0, 0}
+end
+redis.call("ZREM", KEYS[2], ARGV[1])
+if not ends or redis.call("HEXISTS", KEYS[1], "closed_at") == 1 then
+    return {0, 0, 0}
+end
+local remaining = 0
+for i = 5, #KEYS do
+    remaining = remaining + (tonumber(redis.call("GET", KEYS[i])) or 0)
+end
+for _, n in ipairs(redis.call("HVALS", KEYS[4])) do
+    remaining = remaining + tonumber(n)
+end
+local counts = redis.call("HMGET", KEYS[1], "sold", "returned")
+local sold = (tonumber(counts[1]) or 0) - (tonumber(counts[2]) or 0)
+redis.call("HSET", KEYS[1], "closed_at", ARGV[2], "closed_stock", remaining)
+redis.call("XADD", KEYS[3], "MAXLEN", "~", ARGV[3], "*",
+    "type", "sale_closed",
+    "product_id", ARGV[1],
+    "remaining", remaining,
+    "sold", sold,
+    "timestamp", ARGV[2])
+return {1, remaining, sold}
+`)
+
+// ClosedSale is a sale the closer closed
+type ClosedSale struct {
+	ProductID string
+	// Remaining is the stock left unsold, frozen at close
+	Remaining int64
+	// Sold is the net units sold
+	Sold     int64
+	ClosedAt time.Time
+}
+
+// SaleCloser is implemented by stores that close sales once they end
+type SaleCloser interface {
+	// ScheduleCloses tracks the sale ends of products whose window was set
+	// before sales were closed, so they close too
+	ScheduleCloses(ctx context.Context, infos []ProductInfo) error
+	// CloseEndedSales closes up to limit sales that ended by now
+	CloseEndedSales(ctx context.Context, now time.Time, limit int) ([]ClosedSale, error)
+}
+
+var _ SaleCloser = (*RedisStore)(nil)
+
+// scheduleClose queues the commands tracking a product's sale end on pipe,
+// a zero end untracking it. A new end reopens a closed sale.
+func (r *RedisStore) scheduleClose(ctx context.Context, pipe redis.Pipeliner, productID string, end time.Time) {
+	pipe.HDel(ctx, r.metaKey(productID), "closed_at", "closed_stock")
+	if end.IsZero() {
+		pipe.ZRem(ctx, r.key(closingSalesKey), productID)
+		return
+	}
+	pipe.ZAdd(ctx, r.key(closingSalesKey), redis.Z{Score: float64(end.Unix()), Member: productID})
+}
+
+// ScheduleCloses adds the products with a sale end that are neither closed
+// nor tracked yet to the closing index
+func (r *RedisStore) ScheduleCloses(ctx context.Context, infos []ProductInfo) error {
+	var members []redis.Z
+	for _, info := range infos {
+		if !info.SaleEnd.IsZero() && info.ClosedAt.IsZero() {
+			members = append(members, redis.Z{Score: float64(info.SaleEnd.Unix()), Member: info.ID})
+		}
+	}
+	if len(members) == 0 {
+		return nil
+	}
+	if err := r.client.ZAddNX(ctx, r.key(closingSalesKey), members...).Err(); err != nil {
+		return fmt.Errorf("failed to schedule sale closes: %w", err)
+	}
+	return nil
+}
+
+// CloseEndedSales runs the close script on the products the closing index
+// says ended by now. Closing is atomic per product, so two closers
+// overlapping during a leader handover close each sale once.
+func (r *RedisStore) CloseEndedSales(ctx context.Context, now time.Time, limit int) ([]ClosedSale, error) {
+	ids, err := r.client.ZRangeByScore(ctx, r.key(closingSalesKey), &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(now.Unix(), 10),
+		Count: int64(limit),
+	}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read closing sales: %w", err)
+	}
+
+	var closed []ClosedSale
+	for _, id := range ids {
+		count, err := r.shardCount(ctx, id)
+		if err != nil {
+			return closed, err
+		}
+		keys := []string{r.metaKey(id), r.key(closingSalesKey), r.key(EventsStream), r.allottedKey(id)}
+		if count == 0 {
+			keys = append(keys, r.stockKey(id))
+		} else {
+			keys = append(keys, r.shardStockKeys(id, count)...)
+		}
+		res, err := closeSaleScript.Run(ctx, r.client, keys, id, now.Unix(), r.opts.EventsMaxLen).Int64Slice()
+		if err != nil {
+			return closed, fmt.Errorf("failed to close sale of %s: %w", id, err)
+		}
+		if len(res) != 3 {
+			return closed, fmt.Errorf("invalid lua response")
+		}
+		if res[0] == 1 {
+			closed = append(closed, ClosedSale{ProductID: id, Remaining: res[1], Sold: res[2], ClosedAt: time.Unix(now.Unix(), 0)})
+		}
+	}
+	return closed, nil
+}
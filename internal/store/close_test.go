@@ -0,0 +1,126 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// closeSale sells units of a product with a sale end and closes the sale
+// after the end, returning the orders sold
+func closeSale(t *testing.T, st *RedisStore, productID string, stock int64, units int) []string {
+	t.Helper()
+	ctx := context.Background()
+	end := time.Now().Add(time.Hour)
+	if err := st.ImportProducts(ctx, []ProductSpec{{ID: productID, Stock: stock, SaleEnd: end}}); err != nil {
+		t.Fatalf("failed to init product: %v", err)
+	}
+
+	var orders []string
+	for i := 0; i < units; i++ {
+		res, err := st.AttemptPurchase(ctx, productID, fmt.Sprintf("user%d", i))
+		if err != nil || !res.Success {
+			t.Fatalf("purchase %d: %+v, %v", i, res, err)
+		}
+		orders = append(orders, res.OrderID)
+	}
+
+	closed, err := st.CloseEndedSales(ctx, end.Add(time.Minute), 10)
+	if err != nil {
+		t.Fatalf("failed to close sales: %v", err)
+	}
+	if len(closed) != 1 || closed[0].ProductID != productID {
+		t.Fatalf("closed %+v, want %s", closed, productID)
+	}
+	want := ClosedSale{ProductID: productID, Remaining: stock - int64(units), Sold: int64(units)}
+	if got := closed[0]; got.Remaining != want.Remaining || got.Sold != want.Sold {
+		t.Fatalf("closed %+v, want %d remaining and %d sold", got, want.Remaining, want.Sold)
+	}
+	return orders
+}
+
+func TestCloseEndedSales(t *testing.T) {
+	ctx := context.Background()
+	st, _ := newTestStore(t, RedisStoreOptions{})
+	closeSale(t, st, "tee", 5, 2)
+
+	info := productInfo(t, st, "tee")
+	if info.ClosedAt.IsZero() || info.ClosedStock != 3 {
+		t.Fatalf("closed at %v with %d unsold, want a close with 3", info.ClosedAt, info.ClosedStock)
+	}
+
+	// The product left the closing index, and a closed sale closes once
+	closed, err := st.CloseEndedSales(ctx, time.Now().Add(2*time.Hour), 10)
+	if err != nil || len(closed) != 0 {
+		t.Fatalf("second close: %+v, %v, want nothing closed", closed, err)
+	}
+
+	if _, err := st.AddStock(ctx, "tee", 1); !errors.Is(err, ErrSaleClosed) {
+		t.Fatalf("restock of a closed sale: %v, want ErrSaleClosed", err)
+	}
+}
+
+func TestCloseEndedSalesNotYet(t *testing.T) {
+	ctx := context.Background()
+	st, _ := newTestStore(t, RedisStoreOptions{})
+	end := time.Now().Add(time.Hour)
+	if err := st.ImportProducts(ctx, []ProductSpec{{ID: "tee", Stock: 5, SaleEnd: end}}); err != nil {
+		t.Fatal(err)
+	}
+	closed, err := st.CloseEndedSales(ctx, end.Add(-time.Minute), 10)
+	if err != nil || len(closed) != 0 {
+		t.Fatalf("close before the end: %+v, %v, want nothing closed", closed, err)
+	}
+	if info := productInfo(t, st, "tee"); !info.ClosedAt.IsZero() {
+		t.Fatalf("closed at %v before the end", info.ClosedAt)
+	}
+}
+
+// TestExpireAfterClose returns the unit of an order expired after the
+// close to the stock and to closed_stock, keeping the product balanced
+func TestExpireAfterClose(t *testing.T) {
+	ctx := context.Background()
+	st, _ := newTestStore(t, RedisStoreOptions{PaymentTTL: time.Minute})
+	orders := closeSale(t, st, "tee", 5, 2)
+
+	// Move the payment deadline of the first order into the past
+	past := time.Now().Add(-time.Second).Unix()
+	st.client.HSet(ctx, st.orderKey(orders[0]), "expires_at", past)
+	st.client.ZAdd(ctx, st.key(pendingOrdersKey), redis.Z{Score: float64(past), Member: orders[0]})
+
+	expired, err := st.ExpireOrders(ctx, 10)
+	if err != nil || len(expired) != 1 || expired[0].Order.ID != orders[0] {
+		t.Fatalf("expired %+v, %v, want %s", expired, err, orders[0])
+	}
+
+	info := productInfo(t, st, "tee")
+	if info.Stock != 4 || info.ClosedStock != 4 || info.Returned != 1 {
+		t.Fatalf("stock %d, closed stock %d, returned %d, want 4, 4 and 1", info.Stock, info.ClosedStock, info.Returned)
+	}
+	checkBalance(t, info)
+}
+
+// TestCancelAfterClose is TestExpireAfterClose for cancellations
+func TestCancelAfterClose(t *testing.T) {
+	ctx := context.Background()
+	st, _ := newTestStore(t, RedisStoreOptions{})
+	orders := closeSale(t, st, "tee", 5, 2)
+
+	res, err := st.CancelPurchase(ctx, "tee", "user0", orders[0])
+	if err != nil || res.Remaining != 4 {
+		t.Fatalf("cancel: %+v, %v, want 4 remaining", res, err)
+	}
+	if _, err := st.CancelPurchase(ctx, "tee", "user0", orders[0]); !errors.Is(err, ErrNotCancellable) {
+		t.Fatalf("second cancel: %v, want ErrNotCancellable", err)
+	}
+
+	info := productInfo(t, st, "tee")
+	if info.Stock != 4 || info.ClosedStock != 4 || info.Returned != 1 {
+		t.Fatalf("stock %d, closed stock %d, returned %d, want 4, 4 and 1", info.Stock, info.ClosedStock, info.Returned)
+	}
+	checkBalance(t, info)
+}
@@ -0,0 +1,120 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// BuyerRecord is one entry of a buyers list
+type BuyerRecord struct {
+	UserID    string `json:"user_id"`
+	OrderID   string `json:"order_id,omitempty"`
+	Quantity  int64  `json:"quantity,omitempty"`
+	CreatedAt int64  `json:"created_at,omitempty"`
+}
+
+// ValueCodec encodes the records kept in Redis lists. The purchase script
+// writes buyer entries itself, so every codec has a Lua twin in
+// purchaseScript selected by Name.
+type ValueCodec interface {
+	Name() string
+	EncodeBuyer(b BuyerRecord) (string, error)
+	DecodeBuyer(entry string) (BuyerRecord, error)
+}
+
+// ValueCodecs are the available codecs by name. "plain" stores the bare
+// user ID, the format used before codecs existed.
+var ValueCodecs = map[string]ValueCodec{
+	"plain":   plainCodec{},
+	"json":    jsonValueCodec{},
+	"msgpack": msgpackValueCodec{},
+}
+
+// ParseValueCodec looks up a codec by name
+func ParseValueCodec(name string) (ValueCodec, error) {
+	c, ok := ValueCodecs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown value codec %q (want plain, json or msgpack)", name)
+	}
+	return c, nil
+}
+
+// DecodeBuyer decodes a buyers list entry written by any codec. Lists may
+// mix formats after the codec is changed, so the format is detected from
+// the entry rather than taken from the configured codec. User IDs are
+// free-form, so an entry that only looks like a record is a plain ID.
+func DecodeBuyer(entry string) BuyerRecord {
+	if c := detectCodec(entry); c != nil {
+		if b, err := c.DecodeBuyer(entry); err == nil && b.UserID != "" {
+			return b
+		}
+	}
+	return BuyerRecord{UserID: entry, Quantity: 1}
+}
+
+func detectCodec(entry string) ValueCodec {
+	if entry == "" {
+		return nil
+	}
+	switch b := entry[0]; {
+	case b == '{':
+		return jsonValueCodec{}
+	case b >= 0x80 && b <= 0x8f, b == 0xde, b == 0xdf:
+		// msgpack fixmap, map16, map32; never the first byte of UTF-8 text
+		return msgpackValueCodec{}
+	}
+	return nil
+}
+
+type plainCodec struct{}
+
+func (plainCodec) Name() string { return "plain" }
+
+func (plainCodec) EncodeBuyer(b BuyerRecord) (string, error) { return b.UserID, nil }
+
+func (plainCodec) DecodeBuyer(entry string) (BuyerRecord, error) {
+	return BuyerRecord{UserID: entry, Quantity: 1}, nil
+}
+
+type jsonValueCodec struct{}
+
+func (jsonValueCodec) Name() string { return "json" }
+
+func (jsonValueCodec) EncodeBuyer(b BuyerRecord) (string, error) {
+	data, err := json.Marshal(b)
+	return string(data), err
+}
+
+func (jsonValueCodec) DecodeBuyer(entry string) (BuyerRecord, error) {
+	var b BuyerRecord
+	if err := json.Unmarshal([]byte(entry), &b); err != nil {
+		return b, fmt.Errorf("corrupt buyer entry: %w", err)
+	}
+	return b, nil
+}
+
+type msgpackValueCodec struct{}
+
+func (msgpackValueCodec) Name() string { return "msgpack" }
+
+func (msgpackValueCodec) EncodeBuyer(b BuyerRecord) (string, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	enc.UseCompactInts(true)
+	err := enc.Encode(b)
+	return buf.String(), err
+}
+
+func (msgpackValueCodec) DecodeBuyer(entry string) (BuyerRecord, error) {
+	var b BuyerRecord
+	dec := msgpack.NewDecoder(bytes.NewReader([]byte(entry)))
+	dec.SetCustomStructTag("json")
+	if err := dec.Decode(&b); err != nil {
+		return b, fmt.Errorf("corrupt buyer entry: %w", err)
+	}
+	return b, nil
+}
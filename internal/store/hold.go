@@ -0,0 +1,157 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrOrderNotHeld is returned when approving or rejecting an order that is
+// not HELD
+var ErrOrderNotHeld = errors.New("order is not held")
+
+// heldOrdersKey is a sorted set of HELD order IDs scored by when they were
+// held, the manual review queue
+const heldOrdersKey = "orders:held"
+
+// OrderReviewer is implemented by stores that can hold successful
+// purchases for manual review. A HELD order keeps its unit and buyer
+// entry, and cannot be paid, cancelled or expired until a reviewer
+// approves or rejects it.
+type OrderReviewer interface {
+	// HoldOrder holds a PENDING or CONFIRMED order
+	HoldOrder(ctx context.Context, orderID, reason string) (Order, error)
+	// HeldOrders returns up to limit HELD orders, held longest first
+	HeldOrders(ctx context.Context, limit int) ([]Order, error)
+	// ApproveOrder returns a HELD order to the status it was held from
+	ApproveOrder(ctx context.Context, orderID string) (Order, error)
+	// RejectOrder ends a HELD order as REJECTED and returns its unit, like
+	// a cancellation
+	RejectOrder(ctx context.Context, orderID string) (Order, CancelResult, error)
+}
+
+var _ OrderReviewer = (*RedisStore)(nil)
+
+// Lua script holding a PENDING or CONFIRMED order: it leaves the pending
+// set, so the reaper cannot expire it under review, and joins the held
+// set. expires_at is kept, and the time left to pay is given back on
+// approval. ARGV is the order ID, now and the reason. Returns the status
+// the order had, or NOT_FOUND.
+var holdScript = newScript(`
+local status = redis.call("HGET", KEYS[1], "status")
+if not status then
+    return "NOT_FOUND"
+end
+if status ~= "PENDING" and status ~= "CONFIRMED" then
+    return status
+end
+redis.call("HSET", KEYS[1], "status", "HELD", "held_from", status, "held_at", ARGV[2], "hold_reason", ARGV[3])
+redis.call("ZREM", KEYS[2], ARGV[1])
+redis.call("ZADD", KEYS[3], ARGV[2], ARGV[1])
+return status
+`)
+
+// Lua script approving a HELD order. A PENDING one gets a new deadline,
+// the time it had left to pay when it was held. ARGV is the order ID and
+// now. Returns the status the order had, or NOT_FOUND.
+var approveScript = newScript(`
+local f = redis.call("HMGET", KEYS[1], "status", "held_from", "held_at", "expires_at")
+if not f[1] then
+    return "NOT_FOUND"
+end
+if f[1] ~= "HELD" then
+    return f[1]
+end
+redis.call("HSET", KEYS[1], "status", f[2], "approved_at", ARGV[2])
+redis.call("ZREM", KEYS[3], ARGV[1])
+if f[2] == "PENDING" then
+    local left = math.max(tonumber(f[4] or 0) - tonumber(f[3] or 0), 0)
+    local deadline = tonumber(ARGV[2]) + left
+    redis.call("HSET", KEYS[1], "expires_at", deadline)
+    redis.call("ZADD", KEYS[2], deadline, ARGV[1])
+end
+return "HELD"
+`)
+
+// HoldOrder holds a PENDING or CONFIRMED order for review
+func (r *RedisStore) HoldOrder(ctx context.Context, orderID, reason string) (Order, error) {
+	status, err := holdScript.Run(ctx, r.client,
+		[]string{r.orderKey(orderID), r.key(pendingOrdersKey), r.key(heldOrdersKey)},
+		orderID, time.Now().Unix(), reason,
+	).Text()
+	if err != nil {
+		return Order{}, fmt.Errorf("failed to hold order: %w", err)
+	}
+	switch status {
+	case OrderPending, OrderConfirmed:
+		return r.GetOrder(ctx, orderID)
+	case "NOT_FOUND":
+		return Order{}, ErrOrderNotFound
+	default:
+		return Order{}, fmt.Errorf("order is %s and cannot be held", status)
+	}
+}
+
+// HeldOrders returns the review queue, held longest first
+func (r *RedisStore) HeldOrders(ctx context.Context, limit int) ([]Order, error) {
+	ids, err := r.client.ZRange(ctx, r.key(heldOrdersKey), 0, int64(limit)-1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get held orders: %w", err)
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	byID, err := r.Orders(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	orders := make([]Order, 0, len(ids))
+	for _, id := range ids {
+		if o, ok := byID[id]; ok {
+			orders = append(orders, o)
+		}
+	}
+	return orders, nil
+}
+
+// ApproveOrder returns a HELD order to PENDING or CONFIRMED
+func (r *RedisStore) ApproveOrder(ctx context.Context, orderID string) (Order, error) {
+	status, err := approveScript.Run(ctx, r.client,
+		[]string{r.orderKey(orderID), r.key(pendingOrdersKey), r.key(heldOrdersKey)},
+		orderID, time.Now().Unix(),
+	).Text()
+	if err != nil {
+		return Order{}, fmt.Errorf("failed to approve order: %w", err)
+	}
+	switch status {
+	case OrderHeld:
+		return r.GetOrder(ctx, orderID)
+	case "NOT_FOUND":
+		return Order{}, ErrOrderNotFound
+	default:
+		return Order{}, fmt.Errorf("%w: %s", ErrOrderNotHeld, status)
+	}
+}
+
+// RejectOrder rejects a HELD order. Its unit goes back on sale, or to the
+// next waitlisted user, as when the buyer cancels.
+func (r *RedisStore) RejectOrder(ctx context.Context, orderID string) (Order, CancelResult, error) {
+	order, err := r.GetOrder(ctx, orderID)
+	if err != nil {
+		return Order{}, CancelResult{}, err
+	}
+	if order.Status != OrderHeld {
+		return Order{}, CancelResult{}, fmt.Errorf("%w: %s", ErrOrderNotHeld, order.Status)
+	}
+
+	result, err := r.cancelOrder(ctx, order.ProductID, order.UserID, orderID, "reject")
+	if errors.Is(err, ErrNotCancellable) {
+		// Approved or rejected by another reviewer meanwhile
+		return Order{}, CancelResult{}, ErrOrderNotHeld
+	} else if err != nil {
+		return Order{}, CancelResult{}, err
+	}
+	order.Status = OrderRejected
+	return order, result, nil
+}
@@ -0,0 +1,84 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// IdempotencyKeys is implemented by stores that remember the response of
+// a purchase by the key its client sent with it, so a retried purchase is
+// answered again instead of buying a second unit. Keys are per product
+// and user.
+type IdempotencyKeys interface {
+	// ClaimIdempotencyKey reserves key for an attempt about to be made,
+	// for ttl. If it was claimed before, ok is false and saved is its
+	// response, or empty while that attempt has not saved one.
+	ClaimIdempotencyKey(ctx context.Context, productID, userID, key string, ttl time.Duration) (ok bool, saved []byte, err error)
+	// SaveIdempotencyKey stores the response of the attempt that claimed
+	// key, for ttl
+	SaveIdempotencyKey(ctx context.Context, productID, userID, key string, response []byte, ttl time.Duration) error
+	// ReleaseIdempotencyKey forgets a claimed key whose attempt was turned
+	// away before buying, so a retry makes a new one
+	ReleaseIdempotencyKey(ctx context.Context, productID, userID, key string) error
+	// IdempotencyKey returns what ClaimIdempotencyKey would, without
+	// claiming: whether key was claimed, and its response if saved
+	IdempotencyKey(ctx context.Context, productID, userID, key string) (found bool, saved []byte, err error)
+}
+
+var _ IdempotencyKeys = (*RedisStore)(nil)
+
+// idempotencyKey holds the response of a user's purchase of productID by
+// its key, so a key reused for another product buys it rather than
+// replaying the first. It is empty while the attempt runs.
+func (r *RedisStore) idempotencyKey(productID, userID, key string) string {
+	return r.key(fmt.Sprintf("idempotency:%s:%s:%s", productID, userID, key))
+}
+
+// ClaimIdempotencyKey sets the key only if it is not set yet
+func (r *RedisStore) ClaimIdempotencyKey(ctx context.Context, productID, userID, key string, ttl time.Duration) (bool, []byte, error) {
+	ok, err := r.client.SetNX(ctx, r.idempotencyKey(productID, userID, key), "", ttl).Result()
+	if err != nil {
+		return false, nil, fmt.Errorf("failed to claim idempotency key: %w", err)
+	}
+	if ok {
+		return true, nil, nil
+	}
+	// Claimed by another attempt, which may have finished or expired since
+	found, saved, err := r.IdempotencyKey(ctx, productID, userID, key)
+	if err != nil || found {
+		return false, saved, err
+	}
+	return r.ClaimIdempotencyKey(ctx, productID, userID, key, ttl)
+}
+
+// SaveIdempotencyKey overwrites the claim with the response
+func (r *RedisStore) SaveIdempotencyKey(ctx context.Context, productID, userID, key string, response []byte, ttl time.Duration) error {
+	if err := r.client.Set(ctx, r.idempotencyKey(productID, userID, key), response, ttl).Err(); err != nil {
+		return fmt.Errorf("failed to save idempotency key: %w", err)
+	}
+	return nil
+}
+
+// ReleaseIdempotencyKey deletes the claim
+func (r *RedisStore) ReleaseIdempotencyKey(ctx context.Context, productID, userID, key string) error {
+	if err := r.client.Del(ctx, r.idempotencyKey(productID, userID, key)).Err(); err != nil {
+		return fmt.Errorf("failed to release idempotency key: %w", err)
+	}
+	return nil
+}
+
+// IdempotencyKey reads the key
+func (r *RedisStore) IdempotencyKey(ctx context.Context, productID, userID, key string) (bool, []byte, error) {
+	saved, err := r.client.Get(ctx, r.idempotencyKey(productID, userID, key)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return false, nil, nil
+	}
+	if err != nil {
+		return false, nil, fmt.Errorf("failed to get idempotency key: %w", err)
+	}
+	return true, saved, nil
+}
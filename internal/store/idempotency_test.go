@@ -0,0 +1,48 @@
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyKeys(t *testing.T) {
+	ctx := context.Background()
+	st, _ := newTestStore(t, RedisStoreOptions{})
+	const ttl = time.Minute
+
+	ok, _, err := st.ClaimIdempotencyKey(ctx, "tee", "alice", "k", ttl)
+	if err != nil || !ok {
+		t.Fatalf("first claim: %v, %v, want claimed", ok, err)
+	}
+	// A retry while the attempt runs finds it in progress
+	ok, saved, err := st.ClaimIdempotencyKey(ctx, "tee", "alice", "k", ttl)
+	if err != nil || ok || len(saved) != 0 {
+		t.Fatalf("claim in progress: %v, %q, %v, want refused with no response", ok, saved, err)
+	}
+
+	// The same key is another purchase for another product or user
+	for _, other := range [][2]string{{"mug", "alice"}, {"tee", "bob"}} {
+		if ok, _, err := st.ClaimIdempotencyKey(ctx, other[0], other[1], "k", ttl); err != nil || !ok {
+			t.Fatalf("claim for %v: %v, %v, want claimed", other, ok, err)
+		}
+	}
+
+	if err := st.SaveIdempotencyKey(ctx, "tee", "alice", "k", []byte(`{"status":"SUCCESS"}`), ttl); err != nil {
+		t.Fatal(err)
+	}
+	ok, saved, err = st.ClaimIdempotencyKey(ctx, "tee", "alice", "k", ttl)
+	if err != nil || ok || string(saved) != `{"status":"SUCCESS"}` {
+		t.Fatalf("claim after save: %v, %q, %v, want the saved response", ok, saved, err)
+	}
+
+	if err := st.ReleaseIdempotencyKey(ctx, "mug", "alice", "k"); err != nil {
+		t.Fatal(err)
+	}
+	if found, _, err := st.IdempotencyKey(ctx, "mug", "alice", "k"); err != nil || found {
+		t.Fatalf("released key: found %v, %v, want gone", found, err)
+	}
+	if ok, _, err := st.ClaimIdempotencyKey(ctx, "mug", "alice", "k", ttl); err != nil || !ok {
+		t.Fatalf("claim after release: %v, %v, want claimed", ok, err)
+	}
+}
@@ -0,0 +1,113 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ProductSpec is one product to initialize with ImportProducts
+type ProductSpec struct {
+	ID     string
+	Stock  int64
+	Shards int
+	// SaleStart and SaleEnd are zero for an open side of the window
+	SaleStart time.Time
+	SaleEnd   time.Time
+	// UserLimit caps the units each user can hold, 0 for no cap
+	UserLimit int64
+	// SaleEvent makes the product part of a sale event, see SetSaleEvent
+	SaleEvent string
+	// Paused starts the product paused. A paused product stays paused
+	// without it.
+	Paused bool
+}
+
+// ExistingProducts returns which of the given products are initialized,
+// in one pipeline
+func (r *RedisStore) ExistingProducts(ctx context.Context, ids []string) (map[string]bool, error) {
+	cmds, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, id := range ids {
+			pipe.Exists(ctx, r.stockKey(id), r.shardsKey(id))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to check products: %w", err)
+	}
+
+	existing := make(map[string]bool)
+	for i, cmd := range cmds {
+		if cmd.(*redis.IntCmd).Val() > 0 {
+			existing[ids[i]] = true
+		}
+	}
+	return existing, nil
+}
+
+// ImportProducts initializes every product, with its sale window,
+// per-user limit, sale event and paused flag, in one MULTI/EXEC
+// transaction: either all of them are written or none. Products that exist are replaced as by InitProduct,
+// losing their buyers.
+func (r *RedisStore) ImportProducts(ctx context.Context, specs []ProductSpec) error {
+	for _, p := range specs {
+		if p.Shards == 1 || p.Shards > MaxShards {
+			return fmt.Errorf("product %s: shard count must be between 2 and %d", p.ID, MaxShards)
+		}
+	}
+
+	// The keys to drop depend on each product's current shard count
+	cmds, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, p := range specs {
+			pipe.Get(ctx, r.shardsKey(p.ID))
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return fmt.Errorf("failed to get shard counts: %w", err)
+	}
+	counts := make([]int, len(specs))
+	for i, cmd := range cmds {
+		counts[i], err = cmd.(*redis.StringCmd).Int()
+		if err != nil && err != redis.Nil {
+			return fmt.Errorf("failed to get shard count of %s: %w", specs[i].ID, err)
+		}
+	}
+
+	_, err = r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, p := range specs {
+			r.initCommands(ctx, pipe, p.ID, p.Stock, p.Shards, r.productKeysFor(p.ID, counts[i]))
+
+			key := r.metaKey(p.ID)
+			pipe.HDel(ctx, key, "sale_start", "sale_end", "per_user_limit", "sale_event")
+			if !p.SaleStart.IsZero() {
+				pipe.HSet(ctx, key, "sale_start", p.SaleStart.Unix())
+			}
+			if !p.SaleEnd.IsZero() {
+				pipe.HSet(ctx, key, "sale_end", p.SaleEnd.Unix())
+			}
+			if p.UserLimit > 0 {
+				pipe.HSet(ctx, key, "per_user_limit", p.UserLimit)
+			}
+			if p.SaleEvent != "" {
+				pipe.HSet(ctx, key, "sale_event", p.SaleEvent)
+			}
+			if p.Paused {
+				pipe.Set(ctx, r.pausedKey(p.ID), 1, 0)
+			}
+			r.scheduleClose(ctx, pipe, p.ID, p.SaleEnd)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to import products: %w", err)
+	}
+
+	for _, p := range specs {
+		r.shards.Delete(p.ID)
+		r.announceRestock(ctx, p.ID)
+	}
+	return nil
+}
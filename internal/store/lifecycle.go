@@ -0,0 +1,98 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// ErrInvalidTransition is returned when an order cannot move from its
+// status to the one asked for
+var ErrInvalidTransition = errors.New("invalid order transition")
+
+// OrderGranted is where every order starts: the purchase script took its
+// unit. It is never stored, the script writes the order straight out of it
+// as PENDING (payment pending) or CONFIRMED.
+const OrderGranted = "GRANTED"
+
+// OrderFulfilled is the status of a CONFIRMED order that was shipped or
+// handed over. It is final: the unit is gone and cannot be cancelled back.
+const OrderFulfilled = "FULFILLED"
+
+// orderTransitions is the order lifecycle, every status an order can move
+// to from each status. The Lua scripts enforce it; replay and tools check
+// against it with CanTransition.
+//
+//	GRANTED → PENDING, CONFIRMED          purchase, with or without PAYMENT_TTL
+//	PENDING → CONFIRMED                   payment confirmed in time
+//	PENDING → EXPIRED                     deadline passed, stock restored
+//	PENDING, CONFIRMED → CANCELLED        cancelled by the buyer, stock restored
+//	PENDING, CONFIRMED → HELD             held for manual review
+//	HELD → PENDING, CONFIRMED             approved, back to the status it left
+//	HELD → REJECTED                       rejected, stock restored
+//	CONFIRMED → FULFILLED                 shipped or handed over
+var orderTransitions = map[string][]string{
+	OrderGranted:   {OrderPending, OrderConfirmed},
+	OrderPending:   {OrderConfirmed, OrderExpired, OrderCancelled, OrderHeld},
+	OrderConfirmed: {OrderFulfilled, OrderCancelled, OrderHeld},
+	OrderHeld:      {OrderPending, OrderConfirmed, OrderRejected},
+}
+
+// CanTransition reports whether an order can move from one status to
+// another
+func CanTransition(from, to string) bool {
+	return slices.Contains(orderTransitions[from], to)
+}
+
+// OrderHoldsUnit reports whether an order with the status keeps its unit
+// and buyer entry: every status but those that returned the unit
+func OrderHoldsUnit(status string) bool {
+	switch status {
+	case OrderPending, OrderConfirmed, OrderHeld, OrderFulfilled:
+		return true
+	}
+	return false
+}
+
+// OrderFulfiller is implemented by stores that track orders past payment
+type OrderFulfiller interface {
+	// FulfillOrder moves a CONFIRMED order to FULFILLED. An order already
+	// FULFILLED succeeds again, so callers can retry.
+	FulfillOrder(ctx context.Context, orderID string) (Order, error)
+}
+
+var _ OrderFulfiller = (*RedisStore)(nil)
+
+// Lua script fulfilling a CONFIRMED order. ARGV is now. Returns the status
+// the order had, or NOT_FOUND.
+var fulfillScript = newScript(`
+local status = redis.call("HGET", KEYS[1], "status")
+if not status then
+    return "NOT_FOUND"
+end
+if status == "CONFIRMED" then
+    redis.call("HSET", KEYS[1], "status", "FULFILLED", "fulfilled_at", ARGV[1])
+end
+return status
+`)
+
+// FulfillOrder marks a CONFIRMED order FULFILLED
+func (r *RedisStore) FulfillOrder(ctx context.Context, orderID string) (Order, error) {
+	status, err := fulfillScript.Run(ctx, r.client,
+		[]string{r.orderKey(orderID)},
+		time.Now().Unix(),
+	).Text()
+	if err != nil {
+		return Order{}, fmt.Errorf("failed to fulfill order: %w", err)
+	}
+	switch status {
+	case OrderConfirmed, OrderFulfilled:
+		return r.GetOrder(ctx, orderID)
+	case "NOT_FOUND":
+		return Order{}, ErrOrderNotFound
+	default:
+		return Order{}, fmt.Errorf("%w: %s order cannot be %s", ErrInvalidTransition, status, OrderFulfilled)
+	}
+}
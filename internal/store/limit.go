@@ -0,0 +1,72 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrUserLimitReached is returned by purchases of a user who already holds
+// as many units of the product as its per-user limit allows
+var ErrUserLimitReached = errors.New("per-user limit reached")
+
+// ErrSaleEventLimitReached is returned by purchases of a user who already
+// bought a product of the same sale event. It is an ErrUserLimitReached.
+var ErrSaleEventLimitReached = fmt.Errorf("%w in this sale event", ErrUserLimitReached)
+
+// userUnitsKey is a hash of the units each user holds of a product whose
+// meta has a per_user_limit. Grants increment it and cancellations and
+// expiries decrement it, inside the same scripts. Only units granted while
+// a limit is set are counted.
+func (r *RedisStore) userUnitsKey(productID string) string {
+	return r.key(fmt.Sprintf("product:%s:user_units", productID))
+}
+
+// saleEventBuyersKey is a set of the users holding a unit of any product
+// of a sale event. Products join an event through the sale_event field of
+// their meta; the scripts check and fill the set of the event they read
+// there, and cancellations and expiries of the orders granted under it
+// take the user out again.
+func (r *RedisStore) saleEventBuyersKey(eventID string) string {
+	return r.key(fmt.Sprintf("sale_event:%s:buyers", eventID))
+}
+
+// SetSaleEvent makes a product part of sale event eventID, in which each
+// user can buy one unit across all its products, or takes it out of its
+// event with an empty eventID. Units sold before it joined do not count.
+func (r *RedisStore) SetSaleEvent(ctx context.Context, productID, eventID string) error {
+	exists, err := r.client.Exists(ctx, r.metaKey(productID)).Result()
+	if err != nil {
+		return fmt.Errorf("failed to check product: %w", err)
+	}
+	if exists == 0 {
+		return ErrProductNotFound
+	}
+	if eventID == "" {
+		err = r.client.HDel(ctx, r.metaKey(productID), "sale_event").Err()
+	} else {
+		err = r.client.HSet(ctx, r.metaKey(productID), "sale_event", eventID).Err()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to set sale event: %w", err)
+	}
+	return nil
+}
+
+// SaleEventBuyers counts the users who bought in a sale event
+func (r *RedisStore) SaleEventBuyers(ctx context.Context, eventID string) (int64, error) {
+	n, err := r.client.SCard(ctx, r.saleEventBuyersKey(eventID)).Result()
+	if err != nil {
+		return 0, fmt.Errorf("failed to count sale event buyers: %w", err)
+	}
+	return n, nil
+}
+
+// ResetSaleEvent forgets who bought in a sale event, so every user can buy
+// in it again, as after initializing its products anew
+func (r *RedisStore) ResetSaleEvent(ctx context.Context, eventID string) error {
+	if err := r.client.Del(ctx, r.saleEventBuyersKey(eventID)).Err(); err != nil {
+		return fmt.Errorf("failed to reset sale event: %w", err)
+	}
+	return nil
+}
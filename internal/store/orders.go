@@ -0,0 +1,497 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrOrderNotFound is returned when an order ID is unknown
+var ErrOrderNotFound = errors.New("order not found")
+
+// ErrOrderExpired is returned when confirming an order whose payment
+// deadline has passed
+var ErrOrderExpired = errors.New("order expired")
+
+// ErrOrderNotPending is returned when confirming an order that is neither
+// PENDING nor already CONFIRMED
+var ErrOrderNotPending = errors.New("order is not pending")
+
+// ErrNotCancellable is returned when cancelling an order that is already
+// EXPIRED, CANCELLED or FULFILLED, or is HELD for review
+var ErrNotCancellable = errors.New("order cannot be cancelled")
+
+// ErrOrderHeld is returned when confirming payment of an order HELD for
+// review
+var ErrOrderHeld = errors.New("order is held for review")
+
+// Order statuses. Orders start PENDING when a payment TTL is configured
+// or they are reservations, and CONFIRMED otherwise; see orderTransitions
+// in lifecycle.go for how they move on.
+const (
+	OrderPending   = "PENDING"
+	OrderConfirmed = "CONFIRMED"
+	OrderExpired   = "EXPIRED"
+	OrderCancelled = "CANCELLED"
+	OrderHeld      = "HELD"
+	OrderRejected  = "REJECTED"
+)
+
+// pendingOrdersKey is a sorted set of PENDING order IDs scored by their
+// payment deadline
+const pendingOrdersKey = "orders:pending"
+
+// Lua script confirming payment of a PENDING order. Confirming an already
+// CONFIRMED order succeeds again so clients can retry safely. An order
+// past its deadline is refused even if the reaper has not expired it yet.
+var confirmScript = newScript(`
+local f = redis.call("HMGET", KEYS[1], "user_id", "status", "expires_at")
+if not f[1] or f[1] ~= ARGV[1] then
+    return "NOT_FOUND"
+end
+if f[2] ~= "PENDING" then
+    return f[2]
+end
+if tonumber(f[3]) <= tonumber(ARGV[3]) then
+    return "EXPIRED"
+end
+redis.call("HSET", KEYS[1], "status", "CONFIRMED", "confirmed_at", ARGV[3])
+redis.call("ZREM", KEYS[2], ARGV[2])
+return "CONFIRMED"
+`)
+
+// Lua script expiring one PENDING order past its deadline: the unit goes
+// back to the stock key it came from, counted as returned, and the buyer
+// entry the purchase recorded is removed (orders older than value codecs
+// have none and fall back to the bare user ID). Stock is only restored if
+// the product still exists. If ARGV[3], the head of the waitlist when it
+// was read, is still waiting, the unit is granted to them straight away as
+// order ARGV[4], so nobody outside the waitlist can take it first; a user
+// at the product's per-user limit leaves the waitlist empty-handed. Once
+// the sale has ended nobody is granted the unit, and once it is closed the
+// unit also raises its closed_stock. The expiry and any grant are recorded in the events stream in the same step,
+// so an expiry run without a server, as by setup expire-stale, leaves the
+// same events. Returns {expired, granted, remaining, recorded}.
+var expireScript = newScript(grantLua + `
+local f = redis.call("HMGET", KEYS[1], "status", "expires_at", "user_id", "buyer_entry")
+if f[1] ~= "PENDING" then
+    redis.call("ZREM", KEYS[2], ARGV[1])
+    return {0, 0, 0, 0}
+end
+if tonumber(f[2]) > tonumber(ARGV[2]) then
+    return {0, 0, 0, 0}
+end
+redis.call("HSET", KEYS[1], "status", "EXPIRED", "expired_at", ARGV[2])
+redis.call("ZREM", KEYS[2], ARGV[1])
+redis.call("XADD", KEYS[10], "MAXLEN", "~", ARGV[7], "*",
+    "type", "order_expired",
+    "product_id", ARGV[8],
+    "buyer", f[3],
+    "order_id", ARGV[1],
+    "status", "EXPIRED",
+    "previous_status", "PENDING",
+    "timestamp", ARGV[2])
+redis.call("LREM", KEYS[4], 1, f[4] or f[3])
+release_user_unit(KEYS[11], KEYS[1], f[3])
+if redis.call("EXISTS", KEYS[3]) == 1 then
+    local stock = redis.call("INCR", KEYS[3])
+    redis.call("HINCRBY", KEYS[5], "returned", 1)
+    return_closed_unit(KEYS[5])
+    if ARGV[3] ~= "" and not sale_ended(KEYS[5], ARGV[2]) and redis.call("ZREM", KEYS[6], ARGV[3]) == 1 and
+        not user_limit_reached(KEYS[5], KEYS[11], ARGV[3]) then
+        local remaining, recorded = grant({
+            stock = KEYS[3],
+            buyers = KEYS[4],
+            meta = KEYS[5],
+            pending = KEYS[2],
+            waitlist = KEYS[6],
+            order = KEYS[7],
+            user_orders = KEYS[8],
+            strict = KEYS[9],
+            events = KEYS[10],
+            user_units = KEYS[11],
+        }, {
+            user = ARGV[3],
+            order = ARGV[4],
+            ttl = ARGV[5],
+            codec = ARGV[6],
+            maxlen = ARGV[7],
+            product = ARGV[8],
+            now = ARGV[2],
+            agent = "",
+            freed = ARGV[1],
+            record = true,
+        }, stock)
+        return {1, 1, remaining, recorded}
+    end
+end
+return {1, 0, 0, 0}
+`)
+
+// Lua script cancelling a purchase. The order must belong to the user and
+// product, and the user must still be in the buyers list the order was
+// recorded in; only then is the unit returned to its stock key and counted
+// as returned. Like expiring, the unit goes to ARGV[5] as order ARGV[6] if
+// they are still waiting and below the per-user limit, and the sale has not
+// ended; a closed sale counts the unit into its closed_stock. With ARGV[10]
+// set to
+// "reject" it rejects a HELD order instead, which is otherwise the same,
+// and with "release" it only cancels a PENDING order.
+// Returns {status, remaining, granted, recorded, from}, from indexing
+// cancelledFrom.
+var cancelScript = newScript(grantLua + `
+local f = redis.call("HMGET", KEYS[1], "user_id", "product_id", "status", "buyer_entry")
+if f[1] ~= ARGV[1] or f[2] ~= ARGV[2] then
+    return {-1, 0, 0, 0, 0}
+end
+local reject = ARGV[10] == "reject"
+if reject then
+    if f[3] ~= "HELD" then
+        return {-2, 0, 0, 0, 0}
+    end
+elseif f[3] ~= "PENDING" and (f[3] ~= "CONFIRMED" or ARGV[10] == "release") then
+    return {-2, 0, 0, 0, 0}
+end
+if redis.call("EXISTS", KEYS[3]) == 0 then
+    return {-3, 0, 0, 0, 0}
+end
+if redis.call("LREM", KEYS[4], 1, f[4] or ARGV[1]) == 0 then
+    return {-1, 0, 0, 0, 0}
+end
+local from = ({PENDING = 0, CONFIRMED = 1, HELD = 2})[f[3]]
+if reject then
+    redis.call("HSET", KEYS[1], "status", "REJECTED", "rejected_at", ARGV[4])
+    redis.call("ZREM", KEYS[12], ARGV[3])
+else
+    redis.call("HSET", KEYS[1], "status", "CANCELLED", "cancelled_at", ARGV[4])
+end
+redis.call("ZREM", KEYS[2], ARGV[3])
+redis.call("HINCRBY", KEYS[5], "returned", 1)
+release_user_unit(KEYS[11], KEYS[1], ARGV[1])
+local stock = redis.call("INCR", KEYS[3])
+return_closed_unit(KEYS[5])
+if ARGV[5] ~= "" and not sale_ended(KEYS[5], ARGV[4]) and redis.call("ZREM", KEYS[6], ARGV[5]) == 1 and
+    not user_limit_reached(KEYS[5], KEYS[11], ARGV[5]) then
+    local remaining, recorded = grant({
+        stock = KEYS[3],
+        buyers = KEYS[4],
+        meta = KEYS[5],
+        pending = KEYS[2],
+        waitlist = KEYS[6],
+        order = KEYS[7],
+        user_orders = KEYS[8],
+        strict = KEYS[9],
+        events = KEYS[10],
+        user_units = KEYS[11],
+    }, {
+        user = ARGV[5],
+        order = ARGV[6],
+        ttl = ARGV[7],
+        codec = ARGV[8],
+        maxlen = ARGV[9],
+        product = ARGV[2],
+        now = ARGV[4],
+        agent = "",
+        freed = ARGV[3],
+    }, stock)
+    return {1, remaining, 1, recorded, from}
+end
+return {1, stock, 0, 0, from}
+`)
+
+// cancelledFrom are the statuses the cancel script reports an order had
+var cancelledFrom = []string{OrderPending, OrderConfirmed, OrderHeld}
+
+// Order is the record created by a successful purchase
+type Order struct {
+	ID        string
+	ProductID string
+	UserID    string
+	// AgentID is the agent that purchased on behalf of UserID, if any
+	AgentID string
+	// BundleID is set on the orders of a bundle purchase
+	BundleID  string
+	Quantity  int64
+	Status    string
+	CreatedAt time.Time
+	// ExpiresAt is the payment deadline of a PENDING order
+	ExpiresAt time.Time
+
+	// HeldFrom is the status a HELD order returns to once approved, with
+	// HeldAt and HoldReason saying when and why it was held
+	HeldFrom   string
+	HeldAt     time.Time
+	HoldReason string
+
+	// FulfilledAt is when a FULFILLED order was fulfilled
+	FulfilledAt time.Time
+}
+
+func (r *RedisStore) orderKey(orderID string) string {
+	return r.key(fmt.Sprintf("order:%s", orderID))
+}
+
+// userOrdersKey is a sorted set of a user's order IDs scored by purchase
+// time, across all products
+func (r *RedisStore) userOrdersKey(userID string) string {
+	return r.key(fmt.Sprintf("user:%s:orders", userID))
+}
+
+// OrderHistory is implemented by stores that index orders by user
+type OrderHistory interface {
+	// UserOrders returns up to limit of the user's orders, newest first
+	UserOrders(ctx context.Context, userID string, limit int) ([]Order, error)
+}
+
+var _ OrderHistory = (*RedisStore)(nil)
+
+// GetOrder returns the order with the given ID
+func (r *RedisStore) GetOrder(ctx context.Context, orderID string) (Order, error) {
+	fields, err := r.client.HGetAll(ctx, r.orderKey(orderID)).Result()
+	if err != nil {
+		return Order{}, fmt.Errorf("failed to get order: %w", err)
+	}
+	if len(fields) == 0 {
+		return Order{}, ErrOrderNotFound
+	}
+	return orderFromFields(orderID, fields), nil
+}
+
+// Orders returns the orders with the given IDs in one pipeline, keyed by
+// ID. Orders that don't exist are left out.
+func (r *RedisStore) Orders(ctx context.Context, ids []string) (map[string]Order, error) {
+	cmds := make([]*redis.MapStringStringCmd, len(ids))
+	_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, id := range ids {
+			cmds[i] = pipe.HGetAll(ctx, r.orderKey(id))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get orders: %w", err)
+	}
+
+	orders := make(map[string]Order, len(ids))
+	for i, cmd := range cmds {
+		if fields := cmd.Val(); len(fields) > 0 {
+			orders[ids[i]] = orderFromFields(ids[i], fields)
+		}
+	}
+	return orders, nil
+}
+
+// UserOrders returns the orders in the user's index, whatever their
+// status. Orders created before the index existed are not listed.
+func (r *RedisStore) UserOrders(ctx context.Context, userID string, limit int) ([]Order, error) {
+	ids, err := r.client.ZRevRange(ctx, r.userOrdersKey(userID), 0, int64(limit)-1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user orders: %w", err)
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	cmds := make([]*redis.MapStringStringCmd, len(ids))
+	_, err = r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, id := range ids {
+			cmds[i] = pipe.HGetAll(ctx, r.orderKey(id))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user orders: %w", err)
+	}
+
+	orders := make([]Order, 0, len(ids))
+	for i, cmd := range cmds {
+		if fields := cmd.Val(); len(fields) > 0 {
+			orders = append(orders, orderFromFields(ids[i], fields))
+		}
+	}
+	return orders, nil
+}
+
+func orderFromFields(orderID string, fields map[string]string) Order {
+	order := Order{
+		ID:        orderID,
+		ProductID: fields["product_id"],
+		UserID:    fields["user_id"],
+		AgentID:   fields["agent_id"],
+		BundleID:  fields["bundle_id"],
+		Status:    fields["status"],
+		CreatedAt: parseUnix(fields["created_at"]),
+		ExpiresAt: parseUnix(fields["expires_at"]),
+
+		HeldFrom:   fields["held_from"],
+		HeldAt:     parseUnix(fields["held_at"]),
+		HoldReason: fields["hold_reason"],
+
+		FulfilledAt: parseUnix(fields["fulfilled_at"]),
+	}
+	order.Quantity, _ = strconv.ParseInt(fields["quantity"], 10, 64)
+	return order
+}
+
+// ConfirmPayment confirms a PENDING order. Orders belonging to another
+// user are reported as not found.
+func (r *RedisStore) ConfirmPayment(ctx context.Context, orderID, userID string) (Order, error) {
+	status, err := confirmScript.Run(ctx, r.client,
+		[]string{r.orderKey(orderID), r.key(pendingOrdersKey)},
+		userID, orderID, time.Now().Unix(),
+	).Text()
+	if err != nil {
+		return Order{}, fmt.Errorf("failed to confirm payment: %w", err)
+	}
+
+	switch status {
+	case OrderConfirmed:
+		return r.GetOrder(ctx, orderID)
+	case "NOT_FOUND":
+		return Order{}, ErrOrderNotFound
+	case OrderExpired:
+		return Order{}, ErrOrderExpired
+	case OrderHeld:
+		return Order{}, ErrOrderHeld
+	default:
+		return Order{}, fmt.Errorf("%w: %s", ErrOrderNotPending, status)
+	}
+}
+
+// ExpireOrders expires PENDING orders past their deadline, oldest deadline
+// first. Several servers may run it concurrently: the expire script checks
+// the order state, so each order is restocked once.
+func (r *RedisStore) ExpireOrders(ctx context.Context, limit int) ([]ExpiredOrder, error) {
+	now := time.Now()
+	ids, err := r.client.ZRangeByScore(ctx, r.key(pendingOrdersKey), &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(now.Unix(), 10),
+		Count: int64(limit),
+	}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get pending orders: %w", err)
+	}
+
+	var expired []ExpiredOrder
+	for _, id := range ids {
+		fields, err := r.client.HMGet(ctx, r.orderKey(id), "stock_key", "buyers_key", "product_id").Result()
+		if err != nil {
+			return expired, fmt.Errorf("failed to get order: %w", err)
+		}
+		stock, _ := fields[0].(string)
+		buyers, _ := fields[1].(string)
+		productID, _ := fields[2].(string)
+		if stock == "" || buyers == "" || productID == "" {
+			// Order record is gone, drop it from the index
+			r.client.ZRem(ctx, r.key(pendingOrdersKey), id)
+			continue
+		}
+
+		head, err := r.waitlistHead(ctx, productID)
+		if err != nil {
+			return expired, err
+		}
+		grantKeys, grantArgs, grantID := r.grantArgs(productID, head)
+
+		res, err := expireScript.Run(ctx, r.client,
+			append([]string{r.orderKey(id), r.key(pendingOrdersKey), stock, buyers, r.metaKey(productID)}, grantKeys...),
+			append([]interface{}{id, now.Unix()}, append(grantArgs, productID)...)...,
+		).Int64Slice()
+		if err != nil {
+			return expired, fmt.Errorf("failed to expire order: %w", err)
+		}
+		if len(res) != 4 {
+			return expired, fmt.Errorf("invalid lua response")
+		}
+		if res[0] == 0 {
+			continue
+		}
+
+		order, err := r.GetOrder(ctx, id)
+		if err != nil {
+			return expired, err
+		}
+		e := ExpiredOrder{Order: order}
+		if res[1] == 1 {
+			e.Grant = r.waitlistGrant(productID, head, grantID, now, res[2], res[3])
+		} else {
+			r.announceRestock(ctx, productID)
+		}
+		expired = append(expired, e)
+	}
+	return expired, nil
+}
+
+// CancelPurchase cancels a PENDING or CONFIRMED order and puts its unit
+// back on sale, or hands it to the next waitlisted user, and reports the
+// product's remaining stock. Orders of other users or products are
+// reported as not found.
+func (r *RedisStore) CancelPurchase(ctx context.Context, productID, userID, orderID string) (CancelResult, error) {
+	return r.cancelOrder(ctx, productID, userID, orderID, "cancel")
+}
+
+// cancelOrder runs the cancel script in mode "cancel", "reject" or
+// "release"
+func (r *RedisStore) cancelOrder(ctx context.Context, productID, userID, orderID, mode string) (CancelResult, error) {
+	fields, err := r.client.HMGet(ctx, r.orderKey(orderID), "stock_key", "buyers_key").Result()
+	if err != nil {
+		return CancelResult{}, fmt.Errorf("failed to get order: %w", err)
+	}
+	stock, _ := fields[0].(string)
+	buyers, _ := fields[1].(string)
+	if stock == "" || buyers == "" {
+		return CancelResult{}, ErrOrderNotFound
+	}
+
+	head, err := r.waitlistHead(ctx, productID)
+	if err != nil {
+		return CancelResult{}, err
+	}
+	grantKeys, grantArgs, grantID := r.grantArgs(productID, head)
+
+	now := time.Now()
+	res, err := cancelScript.Run(ctx, r.client,
+		append(append([]string{r.orderKey(orderID), r.key(pendingOrdersKey), stock, buyers, r.metaKey(productID)}, grantKeys...), r.key(heldOrdersKey)),
+		append(append([]interface{}{userID, productID, orderID, now.Unix()}, grantArgs...), mode)...,
+	).Int64Slice()
+	if err != nil {
+		return CancelResult{}, fmt.Errorf("failed to %s order: %w", mode, err)
+	}
+	if len(res) != 5 {
+		return CancelResult{}, fmt.Errorf("invalid lua response")
+	}
+
+	switch res[0] {
+	case 1:
+	case -1:
+		return CancelResult{}, ErrOrderNotFound
+	case -2:
+		if mode == "release" {
+			return CancelResult{}, ErrOrderNotPending
+		}
+		return CancelResult{}, ErrNotCancellable
+	case -3:
+		return CancelResult{}, ErrProductNotFound
+	default:
+		return CancelResult{}, fmt.Errorf("invalid lua response")
+	}
+
+	result := CancelResult{Remaining: res[1], Previous: cancelledFrom[res[4]]}
+	if res[2] == 1 {
+		result.Grant = r.waitlistGrant(productID, head, grantID, now, res[1], res[3])
+	} else {
+		r.announceRestock(ctx, productID)
+	}
+	// A sharded order restocked one shard, report the product total
+	if stock != r.stockKey(productID) {
+		r.shards.Delete(productID)
+		result.Remaining, err = r.GetStock(ctx, productID)
+		if err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
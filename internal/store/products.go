@@ -0,0 +1,262 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Product states reported by ProductInfo.State
+const (
+	StateActive    = "ACTIVE"
+	StateSoldOut   = "SOLD_OUT"
+	StateScheduled = "SCHEDULED"
+	StateEnded     = "ENDED"
+	StatePaused    = "PAUSED"
+)
+
+// ProductInfo is a snapshot of a product and its metadata
+type ProductInfo struct {
+	ID           string
+	Stock        int64
+	Buyers       int64
+	InitialStock int64
+	// Sold counts every unit ever taken by a purchase and Returned every
+	// unit put back by a cancellation or expiry; neither is decremented.
+	// Tracked is false for products initialized before the counters.
+	Sold     int64
+	Returned int64
+	Tracked  bool
+	Shards   int
+	Strict   bool
+	// Allotted is the stock servers claimed into memory with allotments
+	// and have neither sold nor returned yet
+	Allotted int64
+	// SaleStart and SaleEnd are zero when that side of the window is open
+	SaleStart time.Time
+	SaleEnd   time.Time
+	// Paused is set while purchases are refused, see SetPaused
+	Paused bool
+	// UserLimit caps the units each user can hold, 0 for no cap
+	UserLimit int64
+	// Allowlisted counts the users on the allowlist, who may buy from
+	// EarlyStart, or zero when that is unset, before SaleStart
+	Allowlisted int64
+	EarlyStart  time.Time
+	// SaleEvent is the sale event the product is part of, if any
+	SaleEvent string
+	// ClosedAt is when the sale closer closed the ended sale, zero while
+	// it is not closed, and ClosedStock the stock it left unsold, raised
+	// by orders expired or cancelled since
+	ClosedAt    time.Time
+	ClosedStock int64
+}
+
+// State derives the product's sale state at now
+func (p ProductInfo) State(now time.Time) string {
+	switch {
+	case !p.SaleStart.IsZero() && now.Before(p.SaleStart):
+		return StateScheduled
+	case !p.SaleEnd.IsZero() && !now.Before(p.SaleEnd):
+		return StateEnded
+	case p.Paused:
+		return StatePaused
+	case p.Stock+p.Allotted <= 0:
+		return StateSoldOut
+	default:
+		return StateActive
+	}
+}
+
+// NetSold is the number of units currently held by buyers
+func (p ProductInfo) NetSold() int64 {
+	return p.Sold - p.Returned
+}
+
+// Balanced reports whether stock accounts for every unit: the initial
+// stock equals what is left, in Redis or allotted to servers, plus what
+// buyers hold. Stock and counters are
+// read separately, so only trust the result once no purchases are in
+// flight. Untracked products always balance.
+func (p ProductInfo) Balanced() bool {
+	return !p.Tracked || p.Stock+p.Allotted+p.NetSold() == p.InitialStock
+}
+
+// Window formats the sale window for display
+func (p ProductInfo) Window() string {
+	if p.SaleStart.IsZero() && p.SaleEnd.IsZero() {
+		return "-"
+	}
+
+	format := func(t time.Time) string {
+		if t.IsZero() {
+			return "open"
+		}
+		return t.Local().Format("2006-01-02 15:04")
+	}
+	return format(p.SaleStart) + " → " + format(p.SaleEnd)
+}
+
+func (r *RedisStore) metaKey(productID string) string {
+	return r.key(fmt.Sprintf("product:%s:meta", productID))
+}
+
+// ListProducts returns the IDs of all initialized products, sorted. Keys are
+// walked with SCAN so a large keyspace never blocks Redis.
+func (r *RedisStore) ListProducts(ctx context.Context) ([]string, error) {
+	seen := make(map[string]struct{})
+
+	iter := r.client.Scan(ctx, 0, r.key("product:*"), 1000).Iterator()
+	for iter.Next(ctx) {
+		key := strings.TrimPrefix(iter.Val(), r.key("product:"))
+		for _, suffix := range []string{":stock", ":shards"} {
+			if id, ok := strings.CutSuffix(key, suffix); ok {
+				seen[id] = struct{}{}
+			}
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("failed to scan products: %w", err)
+	}
+
+	ids := make([]string, 0, len(seen))
+	for id := range seen {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// ProductInfo returns a snapshot of one product
+func (r *RedisStore) ProductInfo(ctx context.Context, productID string) (ProductInfo, error) {
+	stock, err := r.GetStock(ctx, productID)
+	if err != nil {
+		return ProductInfo{}, err
+	}
+
+	buyers, err := r.BuyerCount(ctx, productID)
+	if err != nil {
+		return ProductInfo{}, err
+	}
+
+	shards, err := r.shardCount(ctx, productID)
+	if err != nil {
+		return ProductInfo{}, err
+	}
+
+	strict, err := r.StrictDurability(ctx, productID)
+	if err != nil {
+		return ProductInfo{}, err
+	}
+
+	paused, err := r.Paused(ctx, productID)
+	if err != nil {
+		return ProductInfo{}, err
+	}
+
+	allowlisted, err := r.client.SCard(ctx, r.allowlistKey(productID)).Result()
+	if err != nil {
+		return ProductInfo{}, fmt.Errorf("failed to count allowlist: %w", err)
+	}
+
+	meta, err := r.client.HGetAll(ctx, r.metaKey(productID)).Result()
+	if err != nil {
+		return ProductInfo{}, fmt.Errorf("failed to get metadata: %w", err)
+	}
+
+	allotments, err := r.Allotments(ctx, productID)
+	if err != nil {
+		return ProductInfo{}, err
+	}
+
+	info := ProductInfo{
+		ID:     productID,
+		Stock:  stock,
+		Buyers: buyers,
+		Shards: shards,
+		Strict: strict,
+		Paused: paused,
+
+		Allowlisted: allowlisted,
+	}
+	for _, n := range allotments {
+		info.Allotted += n
+	}
+	info.InitialStock, _ = strconv.ParseInt(meta["initial_stock"], 10, 64)
+	_, info.Tracked = meta["sold"]
+	info.Sold, _ = strconv.ParseInt(meta["sold"], 10, 64)
+	info.Returned, _ = strconv.ParseInt(meta["returned"], 10, 64)
+	info.SaleStart = parseUnix(meta["sale_start"])
+	info.SaleEnd = parseUnix(meta["sale_end"])
+	info.UserLimit, _ = strconv.ParseInt(meta["per_user_limit"], 10, 64)
+	info.EarlyStart = parseUnix(meta["early_start"])
+	info.SaleEvent = meta["sale_event"]
+	info.ClosedAt = parseUnix(meta["closed_at"])
+	info.ClosedStock, _ = strconv.ParseInt(meta["closed_stock"], 10, 64)
+	return info, nil
+}
+
+// ListProductInfo returns snapshots of every product
+func (r *RedisStore) ListProductInfo(ctx context.Context) ([]ProductInfo, error) {
+	ids, err := r.ListProducts(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]ProductInfo, 0, len(ids))
+	for _, id := range ids {
+		info, err := r.ProductInfo(ctx, id)
+		if err == ErrProductNotFound {
+			// Deleted between SCAN and lookup
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// ErrSaleNotStarted and ErrSaleEnded are returned by purchases of a
+// product outside its sale window
+var (
+	ErrSaleNotStarted = errors.New("sale has not started")
+	ErrSaleEnded      = errors.New("sale has ended")
+)
+
+// SetSaleWindow records the sale window of a product, which the purchase,
+// bundle and claim scripts check. A zero time leaves that side of the
+// window open. The sale is closed once its end passes, and a closed sale
+// given a new window is open again.
+func (r *RedisStore) SetSaleWindow(ctx context.Context, productID string, start, end time.Time) error {
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		key := r.metaKey(productID)
+		pipe.HDel(ctx, key, "sale_start", "sale_end")
+		if !start.IsZero() {
+			pipe.HSet(ctx, key, "sale_start", start.Unix())
+		}
+		if !end.IsZero() {
+			pipe.HSet(ctx, key, "sale_end", end.Unix())
+		}
+		r.scheduleClose(ctx, pipe, productID, end)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set sale window: %w", err)
+	}
+	return nil
+}
+
+func parseUnix(s string) time.Time {
+	sec, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || sec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(sec, 0)
+}
@@ -0,0 +1,350 @@
+package store
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// QueueResultsChannel is the pub/sub channel every dispatched ticket is
+// announced on, as a JSON encoded Ticket
+const QueueResultsChannel = "flashsale:queue:results"
+
+// queueProductsKey is the set of products that are, or recently were, in
+// queue mode, so dispatchers know where to look
+const queueProductsKey = "queue:products"
+
+const (
+	// queuedTicketTTL bounds how long a ticket can wait; it only matters
+	// for tickets whose queue was dropped by init or reset
+	queuedTicketTTL = 24 * time.Hour
+	// ticketResultTTL is how long a dispatched ticket can still be polled
+	ticketResultTTL = time.Hour
+	// dispatchLockTTL bounds how long a product's queue stays locked by a
+	// dispatcher that died
+	dispatchLockTTL = 5 * time.Second
+)
+
+// Ticket statuses. A dispatched ticket ends up SUCCESS, in which case the
+// order of the same ID exists, SOLD_OUT, or LIMIT_REACHED if the user
+// reached the product's per-user limit while waiting.
+const (
+	TicketQueued       = "QUEUED"
+	TicketSuccess      = "SUCCESS"
+	TicketSoldOut      = "SOLD_OUT"
+	TicketLimitReached = "LIMIT_REACHED"
+)
+
+// ErrTicketNotFound is returned for unknown or expired tickets
+var ErrTicketNotFound = errors.New("ticket not found")
+
+// Ticket is a purchase attempt waiting in, or dispatched from, a product's
+// queue. Its ID is the ID of the order it creates on success.
+type Ticket struct {
+	ID        string `json:"ticket_id"`
+	ProductID string `json:"product_id"`
+	UserID    string `json:"user_id"`
+	AgentID   string `json:"agent_id,omitempty"`
+	Status    string `json:"status"`
+	// Position is 1 for the next ticket to be dispatched; 0 once dispatched
+	Position int64 `json:"position,omitempty"`
+	// Remaining and PaymentDeadline are those of the dispatched purchase
+	Remaining       int64 `json:"remaining,omitempty"`
+	PaymentDeadline int64 `json:"payment_deadline,omitempty"`
+	// Recorded is PurchaseResult.Recorded of the dispatched purchase; it is
+	// only known to the dispatcher
+	Recorded bool `json:"-"`
+}
+
+// Queue is implemented by stores that can grant purchases in arrival order
+type Queue interface {
+	// SetQueueMode turns queue mode on or off for a product. Tickets
+	// already queued are still dispatched after it is turned off.
+	SetQueueMode(ctx context.Context, productID string, on bool) error
+	// QueueTicket returns a ticket and its current position
+	QueueTicket(ctx context.Context, ticketID string) (Ticket, error)
+	// QueuedProducts returns the products that may have queued tickets
+	QueuedProducts(ctx context.Context) ([]string, error)
+	// DispatchQueue grants up to limit tickets of a product in queue order
+	// and returns them. It does nothing while another dispatcher holds the
+	// product's queue.
+	DispatchQueue(ctx context.Context, productID string, limit int) ([]Ticket, error)
+	// QueueDepth returns how many tickets wait across all products
+	QueueDepth(ctx context.Context) (int64, error)
+}
+
+var _ Queue = (*RedisStore)(nil)
+
+func (r *RedisStore) queueModeKey(productID string) string {
+	return r.key(fmt.Sprintf("product:%s:queued", productID))
+}
+
+func (r *RedisStore) queueKey(productID string) string {
+	return r.key(fmt.Sprintf("product:%s:queue", productID))
+}
+
+func (r *RedisStore) queueLockKey(productID string) string {
+	return r.key(fmt.Sprintf("product:%s:queue:lock", productID))
+}
+
+func (r *RedisStore) queueTicketKey(ticketID string) string {
+	return r.key(fmt.Sprintf("queue:ticket:%s", ticketID))
+}
+
+// Lua script finishing the ticket at the head of a queue: it is popped,
+// its result recorded and announced, and the dispatched counter that
+// positions are computed from advanced, all in one step. The head check
+// keeps a dispatcher whose lock expired from finishing a ticket twice.
+var finishTicketScript = newScript(`
+if redis.call("LINDEX", KEYS[1], 0) ~= ARGV[1] then
+    return 0
+end
+redis.call("LPOP", KEYS[1])
+redis.call("HINCRBY", KEYS[3], "queue_out", 1)
+if redis.call("EXISTS", KEYS[2]) == 1 then
+    redis.call("HSET", KEYS[2], "status", ARGV[2], "dispatched_at", ARGV[3])
+    redis.call("EXPIRE", KEYS[2], ARGV[4])
+end
+redis.call("PUBLISH", ARGV[5], ARGV[6])
+return 1
+`)
+
+// Lua script releasing a dispatch lock only if it is still ours
+var unlockScript = newScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+    return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// SetQueueMode turns queue mode on or off for a product. In queue mode
+// purchase attempts get a ticket and a position, and stock is granted by
+// DispatchQueue in the order the tickets were issued.
+func (r *RedisStore) SetQueueMode(ctx context.Context, productID string, on bool) error {
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		if on {
+			pipe.Set(ctx, r.queueModeKey(productID), 1, 0)
+			pipe.SAdd(ctx, r.key(queueProductsKey), productID)
+		} else {
+			// Dispatchers drop the product from the set once its queue drains
+			pipe.Del(ctx, r.queueModeKey(productID))
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set queue mode: %w", err)
+	}
+	return nil
+}
+
+// QueueMode reports whether a product is in queue mode and how many
+// tickets are waiting
+func (r *RedisStore) QueueMode(ctx context.Context, productID string) (bool, int64, error) {
+	var on *redis.IntCmd
+	var length *redis.IntCmd
+	_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		on = pipe.Exists(ctx, r.queueModeKey(productID))
+		length = pipe.LLen(ctx, r.queueKey(productID))
+		return nil
+	})
+	if err != nil {
+		return false, 0, fmt.Errorf("failed to get queue mode: %w", err)
+	}
+	return on.Val() == 1, length.Val(), nil
+}
+
+// QueueTicket returns a ticket. The position of a QUEUED ticket is worked
+// out from the product's enqueued and dispatched counters, so it costs two
+// reads however long the queue is.
+func (r *RedisStore) QueueTicket(ctx context.Context, ticketID string) (Ticket, error) {
+	fields, err := r.client.HGetAll(ctx, r.queueTicketKey(ticketID)).Result()
+	if err != nil {
+		return Ticket{}, fmt.Errorf("failed to get ticket: %w", err)
+	}
+	if len(fields) == 0 {
+		return Ticket{}, ErrTicketNotFound
+	}
+
+	t := Ticket{
+		ID:        ticketID,
+		ProductID: fields["product_id"],
+		UserID:    fields["user_id"],
+		AgentID:   fields["agent_id"],
+		Status:    fields["status"],
+	}
+	if t.Status == TicketQueued {
+		out, err := r.client.HGet(ctx, r.metaKey(t.ProductID), "queue_out").Int64()
+		if err != nil && err != redis.Nil {
+			return Ticket{}, fmt.Errorf("failed to get ticket: %w", err)
+		}
+		seq, _ := strconv.ParseInt(fields["seq"], 10, 64)
+		t.Position = max(seq-out, 1)
+	}
+	return t, nil
+}
+
+// QueuedProducts returns the products that may have queued tickets
+func (r *RedisStore) QueuedProducts(ctx context.Context) ([]string, error) {
+	ids, err := r.client.SMembers(ctx, r.key(queueProductsKey)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list queued products: %w", err)
+	}
+	return ids, nil
+}
+
+// QueueDepth sums the queue lengths of every product that may have queued
+// tickets
+func (r *RedisStore) QueueDepth(ctx context.Context) (int64, error) {
+	ids, err := r.QueuedProducts(ctx)
+	if err != nil || len(ids) == 0 {
+		return 0, err
+	}
+
+	lengths := make([]*redis.IntCmd, len(ids))
+	_, err = r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, id := range ids {
+			lengths[i] = pipe.LLen(ctx, r.queueKey(id))
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to get queue depth: %w", err)
+	}
+	var depth int64
+	for _, n := range lengths {
+		depth += n.Val()
+	}
+	return depth, nil
+}
+
+// DispatchQueue grants up to limit of a product's tickets, head first. One
+// dispatcher at a time holds a product's queue, so tickets are purchased
+// strictly in order even with every server dispatching. A ticket is only
+// popped after its purchase, and the purchase is skipped if its order
+// already exists, so a dispatcher dying in between neither loses nor
+// doubles a ticket.
+func (r *RedisStore) DispatchQueue(ctx context.Context, productID string, limit int) ([]Ticket, error) {
+	// Tickets of a paused product wait for it to resume
+	if paused, err := r.Paused(ctx, productID); err != nil || paused {
+		return nil, err
+	}
+
+	head, err := r.client.LIndex(ctx, r.queueKey(productID), 0).Result()
+	if err == redis.Nil {
+		return nil, r.retireQueue(ctx, productID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read queue: %w", err)
+	}
+
+	token := make([]byte, 16)
+	rand.Read(token)
+	lock := hex.EncodeToString(token)
+	ok, err := r.client.SetNX(ctx, r.queueLockKey(productID), lock, dispatchLockTTL).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock queue: %w", err)
+	}
+	if !ok {
+		return nil, nil
+	}
+	defer unlockScript.Run(context.WithoutCancel(ctx), r.client, []string{r.queueLockKey(productID)}, lock)
+
+	var dispatched []Ticket
+	for len(dispatched) < limit {
+		t, err := r.dispatchTicket(ctx, productID, head)
+		if err != nil {
+			return dispatched, err
+		}
+		dispatched = append(dispatched, t)
+
+		head, err = r.client.LIndex(ctx, r.queueKey(productID), 0).Result()
+		if err == redis.Nil {
+			break
+		}
+		if err != nil {
+			return dispatched, fmt.Errorf("failed to read queue: %w", err)
+		}
+	}
+	return dispatched, nil
+}
+
+// dispatchTicket purchases for the ticket at the head of the queue and
+// finishes it
+func (r *RedisStore) dispatchTicket(ctx context.Context, productID, ticketID string) (Ticket, error) {
+	fields, err := r.client.HMGet(ctx, r.queueTicketKey(ticketID), "user_id", "agent_id").Result()
+	if err != nil {
+		return Ticket{}, fmt.Errorf("failed to get ticket: %w", err)
+	}
+	userID, _ := fields[0].(string)
+	agentID, _ := fields[1].(string)
+	t := Ticket{ID: ticketID, ProductID: productID, UserID: userID, AgentID: agentID, Status: TicketSoldOut}
+
+	switch order, err := r.GetOrder(ctx, ticketID); {
+	case err == nil:
+		// Purchased by a dispatcher that died before finishing the ticket
+		t.UserID, t.AgentID = order.UserID, order.AgentID
+		t.Status = TicketSuccess
+		if order.Status == OrderPending {
+			t.PaymentDeadline = order.ExpiresAt.Unix()
+		}
+	case !errors.Is(err, ErrOrderNotFound):
+		return Ticket{}, err
+	case userID == "":
+		// The ticket hash expired; nobody is waiting for it
+	default:
+		result, err := r.purchase(ctx, productID, userID, ticketID, purchaseOpts{agentID: agentID, dispatch: true})
+		if errors.Is(err, ErrUserLimitReached) {
+			t.Status = TicketLimitReached
+			break
+		}
+		if errors.Is(err, ErrSaleEnded) || errors.Is(err, ErrNotEligible) {
+			// Nobody is granted a unit once the sale ended, nor a user
+			// taken off the allowlist while waiting
+			break
+		}
+		if err != nil && !errors.Is(err, ErrNotDurable) {
+			return Ticket{}, err
+		}
+		if result.Success {
+			t.Status = TicketSuccess
+			t.Remaining = result.Remaining
+			t.Recorded = result.Recorded
+			if !result.PaymentDeadline.IsZero() {
+				t.PaymentDeadline = result.PaymentDeadline.Unix()
+			}
+		}
+	}
+
+	msg, _ := json.Marshal(t)
+	err = finishTicketScript.Run(ctx, r.client,
+		[]string{r.queueKey(productID), r.queueTicketKey(ticketID), r.metaKey(productID)},
+		ticketID, t.Status, time.Now().Unix(), int64(ticketResultTTL.Seconds()), r.key(QueueResultsChannel), msg,
+	).Err()
+	if err != nil {
+		return Ticket{}, fmt.Errorf("failed to finish ticket: %w", err)
+	}
+	return t, nil
+}
+
+// retireQueue forgets a product whose queue is empty and no longer in queue
+// mode. A ticket enqueued just before queue mode was turned off is still
+// found: the purchase script enqueues in the same step as its mode check.
+func (r *RedisStore) retireQueue(ctx context.Context, productID string) error {
+	n, err := r.client.Exists(ctx, r.queueModeKey(productID)).Result()
+	if err != nil {
+		return fmt.Errorf("failed to get queue mode: %w", err)
+	}
+	if n == 0 {
+		if err := r.client.SRem(ctx, r.key(queueProductsKey), productID).Err(); err != nil {
+			return fmt.Errorf("failed to retire queue: %w", err)
+		}
+	}
+	return nil
+}
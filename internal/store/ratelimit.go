@@ -0,0 +1,96 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// RateLimiter is implemented by stores that can throttle purchase
+// attempts per user, and per agent, across every server sharing the store
+type RateLimiter interface {
+	AllowAttempt(ctx context.Context, userID string, limit int64, window time.Duration) (RateDecision, error)
+	AllowAgentAttempt(ctx context.Context, agentID string, limit int64, window time.Duration) (RateDecision, error)
+}
+
+var _ RateLimiter = (*RedisStore)(nil)
+
+// RateDecision is the outcome of one AllowAttempt call
+type RateDecision struct {
+	Allowed bool
+	// RetryAfter estimates when the next attempt would be allowed; zero
+	// when Allowed
+	RetryAfter time.Duration
+}
+
+func (r *RedisStore) rateLimitKey(userID string) string {
+	return r.key(fmt.Sprintf("ratelimit:user:%s", userID))
+}
+
+func (r *RedisStore) agentRateLimitKey(agentID string) string {
+	return r.key(fmt.Sprintf("ratelimit:agent:%s", agentID))
+}
+
+// Lua script for a sliding window counter: the previous fixed window's
+// count is weighted by how much of it still overlaps the sliding window,
+// which approximates a true sliding log in O(1) memory per user. ARGV is
+// limit, window and now, both in milliseconds. Rejected attempts are not
+// counted, so a client hammering the limit still gets through once its
+// older attempts age out.
+var rateLimitScript = newScript(`
+local limit = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local start = now - (now % window)
+
+local f = redis.call("HMGET", KEYS[1], "start", "cur", "prev")
+local cur, prev = tonumber(f[2]) or 0, tonumber(f[3]) or 0
+if tonumber(f[1]) ~= start then
+    if tonumber(f[1]) == start - window then
+        prev = cur
+    else
+        prev = 0
+    end
+    cur = 0
+end
+
+local elapsed = now - start
+if prev * (window - elapsed) / window + cur < limit then
+    redis.call("HSET", KEYS[1], "start", start, "cur", cur + 1, "prev", prev)
+    redis.call("PEXPIRE", KEYS[1], window * 2)
+    return {1, 0}
+end
+
+-- Time until the weighted count drops below the limit
+local retry
+if cur < limit then
+    retry = window * (1 - (limit - cur) / prev) - elapsed
+else
+    retry = (window - elapsed) + window * (1 - limit / cur)
+end
+return {0, math.ceil(retry) + 1}
+`)
+
+// AllowAttempt counts one purchase attempt of userID against limit
+// attempts per window and reports whether it may go ahead
+func (r *RedisStore) AllowAttempt(ctx context.Context, userID string, limit int64, window time.Duration) (RateDecision, error) {
+	return r.allowAttempt(ctx, r.rateLimitKey(userID), limit, window)
+}
+
+// AllowAgentAttempt counts one purchase attempt of agentID, made for any
+// user, against the agent's own limit
+func (r *RedisStore) AllowAgentAttempt(ctx context.Context, agentID string, limit int64, window time.Duration) (RateDecision, error) {
+	return r.allowAttempt(ctx, r.agentRateLimitKey(agentID), limit, window)
+}
+
+func (r *RedisStore) allowAttempt(ctx context.Context, key string, limit int64, window time.Duration) (RateDecision, error) {
+	res, err := rateLimitScript.Run(ctx, r.client, []string{key},
+		limit, window.Milliseconds(), time.Now().UnixMilli()).Int64Slice()
+	if err != nil {
+		return RateDecision{}, fmt.Errorf("rate limit check failed: %w", err)
+	}
+	if res[0] == 1 {
+		return RateDecision{Allowed: true}, nil
+	}
+	return RateDecision{RetryAfter: time.Duration(res[1]) * time.Millisecond}, nil
+}
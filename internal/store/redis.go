@@ -0,0 +1,1006 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"chha/internal/snowflake"
+)
+
+// EventsStream is the Redis stream holding durable purchase events
+const EventsStream = "flashsale:events"
+
+// aofBarrierKey is written to confirm the AOF fsync of a strict purchase
+// that was not made on a pinned connection
+const aofBarrierKey = "flashsale:aof_barrier"
+
+// grantLua defines grant, which takes one unit off stock key k.stock for
+// user a.user and records it as order a.order: the buyer entry, encoded
+// with value codec a.codec, the order record, the sold counter and the
+// user's order index are all written. With a payment TTL (a.ttl > 0) the
+// order is PENDING and indexed by its deadline so the reaper can find it.
+// For products in strict durability mode the purchase event is appended to
+// the events stream too, so the stock decrement and its record are one
+// atomic write; a.freed, if set, is the order whose unit was handed on,
+// and a.bundle the bundle purchase the order is part of. The caller has checked that stock (the current
+// value of k.stock) is positive, unless a.allotted is set: the unit was
+// then already taken from k.stock into a server's allotment and is not
+// taken again. It returns the stock left and 1 if the
+// event was recorded. It is shared by the purchase script and the scripts
+// that hand freed units to the waitlist. Grants of a product with a
+// per-user limit are counted per user in k.user_units, and the buyers of a
+// product in a sale event join the event's buyers set.
+const grantLua = `
+-- sale_event_key is the buyers set of a sale event, in the tenant of key.
+-- It is the one key the scripts name themselves: the event is only known
+-- from the product's meta hash, read in the same step.
+local function sale_event_key(key, event)
+    return (string.match(key, "^tenant:[^:]+:") or "") .. "sale_event:" .. event .. ":buyers"
+end
+
+-- user_limit_reached returns "limit" if user holds as many units of the
+-- product as its per_user_limit allows, "event" if they bought a product
+-- of the sale event it is part of, and false otherwise
+local function user_limit_reached(meta, units, user)
+    local policy = redis.call("HMGET", meta, "per_user_limit", "sale_event")
+    if policy[2] and redis.call("SISMEMBER", sale_event_key(meta, policy[2]), user) == 1 then
+        return "event"
+    end
+    local limit = tonumber(policy[1])
+    if limit and (tonumber(redis.call("HGET", units, user)) or 0) >= limit then
+        return "limit"
+    end
+    return false
+end
+
+-- sale_closed returns 1 before the product's sale_start and 2 from its
+-- sale_end on, 0 while its sale window is open to user. Before the
+-- sale_start, or always without one, a product with an allowlist sells
+-- only to its members, from the early_start; others get 3.
+local function sale_closed(meta, allowlist, user, now)
+    local window = redis.call("HMGET", meta, "sale_start", "sale_end", "early_start")
+    now = tonumber(now)
+    if window[2] and now >= tonumber(window[2]) then
+        return 2
+    end
+    local start = tonumber(window[1])
+    if start and now >= start then
+        return 0
+    end
+    if redis.call("EXISTS", allowlist) == 0 then
+        if start then
+            return 1
+        end
+        return 0
+    end
+    local early = tonumber(window[3])
+    if (start and not early) or (early and now < early) then
+        return 1
+    end
+    if redis.call("SISMEMBER", allowlist, user) == 0 then
+        return 3
+    end
+    return 0
+end
+
+-- sale_ended reports whether the product's sale_end has passed by now.
+-- Units freed after it are not granted to the waitlist.
+local function sale_ended(meta, now)
+    local ends = tonumber(redis.call("HGET", meta, "sale_end"))
+    return ends ~= nil and tonumber(now) >= ends
+end
+
+-- return_closed_unit counts a unit a closed sale got back into its
+-- closed_stock, which then keeps matching the stock left
+local function return_closed_unit(meta)
+    if redis.call("HEXISTS", meta, "closed_at") == 1 then
+        redis.call("HINCRBY", meta, "closed_stock", 1)
+    end
+end
+
+-- release_user_unit uncounts a unit user gave back by cancelling or not
+-- paying, and lets them buy in the sale event the order was part of again
+local function release_user_unit(units, order, user)
+    if redis.call("HEXISTS", units, user) == 1 and redis.call("HINCRBY", units, user, -1) <= 0 then
+        redis.call("HDEL", units, user)
+    end
+    local event = redis.call("HGET", order, "sale_event")
+    if event then
+        redis.call("SREM", sale_event_key(order, event), user)
+    end
+end
+
+local function grant(k, a, stock)
+    local entry = a.user
+    if a.codec == "json" or a.codec == "msgpack" then
+        local record = {
+            user_id = a.user,
+            order_id = a.order,
+            quantity = 1,
+            created_at = tonumber(a.now),
+        }
+        if a.codec == "json" then
+            entry = cjson.encode(record)
+        else
+            entry = cmsgpack.pack(record)
+        end
+    end
+
+    if not a.allotted then
+        redis.call("DECR", k.stock)
+    end
+    redis.call("LPUSH", k.buyers, entry)
+    redis.call("HINCRBY", k.meta, "sold", 1)
+    if redis.call("HEXISTS", k.meta, "per_user_limit") == 1 then
+        redis.call("HINCRBY", k.user_units, a.user, 1)
+    end
+    local event = redis.call("HGET", k.meta, "sale_event")
+    if event then
+        redis.call("SADD", sale_event_key(k.meta, event), a.user)
+        redis.call("HSET", k.order, "sale_event", event)
+    end
+
+    local ttl = tonumber(a.ttl)
+    local status = "CONFIRMED"
+    if ttl > 0 then
+        status = "PENDING"
+        local expires = tonumber(a.now) + ttl
+        redis.call("HSET", k.order, "expires_at", expires)
+        redis.call("ZADD", k.pending, expires, a.order)
+    end
+    redis.call("HSET", k.order,
+        "order_id", a.order,
+        "product_id", a.product,
+        "user_id", a.user,
+        "quantity", 1,
+        "status", status,
+        "created_at", a.now,
+        "stock_key", k.stock,
+        "buyers_key", k.buyers,
+        "buyer_entry", entry)
+    if a.agent ~= "" then
+        redis.call("HSET", k.order, "agent_id", a.agent)
+    end
+    if a.bundle then
+        redis.call("HSET", k.order, "bundle_id", a.bundle)
+    end
+    redis.call("ZADD", k.user_orders, a.now, a.order)
+    -- A user who got a unit no longer waits for one
+    redis.call("ZREM", k.waitlist, a.user)
+
+    -- a.record puts the event in the stream even without strict durability
+    local recorded = 0
+    if a.record or redis.call("EXISTS", k.strict) == 1 then
+        local event = {
+            "type", "purchase",
+            "product_id", a.product,
+            "buyer", a.user,
+            "order_id", a.order,
+            "status", status,
+            "remaining", stock - 1,
+            "timestamp", a.now}
+        if a.agent ~= "" then
+            table.insert(event, "agent")
+            table.insert(event, a.agent)
+        end
+        if a.freed then
+            table.insert(event, "freed_order")
+            table.insert(event, a.freed)
+        end
+        if a.bundle then
+            table.insert(event, "bundle_id")
+            table.insert(event, a.bundle)
+        end
+        redis.call("XADD", k.events, "MAXLEN", "~", a.maxlen, "*", unpack(event))
+        recorded = 1
+    end
+    return stock - 1, recorded
+end
+`
+
+// Lua script for atomic purchase, built on grant. Products in queue mode
+// (KEYS[9]) only enqueue the attempt as ticket ARGV[5] and return its
+// position; the dispatcher later runs the script again with the queue
+// bypassed (ARGV[8] == "1"). ARGV[10] is the agent buying on behalf of the
+// user, if any, recorded on the order and its event. ARGV[7] names the
+// value codec the buyer entry is written with; the entry is kept on the
+// order so cancelling and expiring can remove exactly that entry. A
+// paused product (KEYS[13]) returns 3 without queueing the attempt, and a
+// user holding as many units as the product's per-user limit allows
+// returns 4, checked again when the queue reaches them, as is a user who
+// bought in the product's sale event, who gets 8. Outside the sale
+// window in the product's meta hash it returns 5 before the start and 6
+// from the end on, and 7 to a user not on the allowlist (KEYS[15]) of a
+// product not yet open to everyone. Reservations (ARGV[11] == "1") can't
+// wait in a queue, so a product in queue mode returns 9 to them.
+const purchaseScript = grantLua + `
+local closed = sale_closed(KEYS[7], KEYS[15], ARGV[1], ARGV[4])
+if closed > 0 then
+    return {4 + closed, 0, 0}
+end
+if redis.call("EXISTS", KEYS[13]) == 1 then
+    return {3, 0, 0}
+end
+local limited = user_limit_reached(KEYS[7], KEYS[14], ARGV[1])
+if limited == "event" then
+    return {8, 0, 0}
+elseif limited then
+    return {4, 0, 0}
+end
+
+local stock = tonumber(redis.call("GET", KEYS[1]))
+
+if ARGV[11] == "1" and redis.call("EXISTS", KEYS[9]) == 1 then
+    return {9, 0, 0}
+end
+if ARGV[8] ~= "1" and redis.call("EXISTS", KEYS[9]) == 1 then
+    -- Nobody is turned away while attempts are still waiting, since
+    -- expiries and cancellations may free units for them
+    if (stock and stock > 0) or redis.call("LLEN", KEYS[10]) > 0 then
+        local seq = redis.call("HINCRBY", KEYS[7], "queue_in", 1)
+        redis.call("RPUSH", KEYS[10], ARGV[5])
+        redis.call("HSET", KEYS[11],
+            "product_id", ARGV[2],
+            "user_id", ARGV[1],
+            "status", "QUEUED",
+            "seq", seq,
+            "enqueued_at", ARGV[4])
+        if ARGV[10] ~= "" then
+            redis.call("HSET", KEYS[11], "agent_id", ARGV[10])
+        end
+        redis.call("EXPIRE", KEYS[11], ARGV[9])
+        local out = tonumber(redis.call("HGET", KEYS[7], "queue_out")) or 0
+        return {2, seq - out, 0}
+    end
+    return {0, 0, 0}
+end
+
+if stock and stock > 0 then
+    local remaining, recorded = grant({
+        stock = KEYS[1],
+        buyers = KEYS[2],
+        strict = KEYS[3],
+        events = KEYS[4],
+        order = KEYS[5],
+        pending = KEYS[6],
+        meta = KEYS[7],
+        user_orders = KEYS[8],
+        waitlist = KEYS[12],
+        user_units = KEYS[14],
+    }, {
+        user = ARGV[1],
+        product = ARGV[2],
+        maxlen = ARGV[3],
+        now = ARGV[4],
+        order = ARGV[5],
+        ttl = ARGV[6],
+        codec = ARGV[7],
+        agent = ARGV[10],
+    }, stock)
+    return {1, remaining, recorded}
+else
+    return {0, 0, 0}
+end
+`
+
+// RedisStoreOptions tunes a RedisStore
+type RedisStoreOptions struct {
+	// EventsMaxLen approximately caps the events stream when the purchase
+	// script appends to it (default 1000000)
+	EventsMaxLen int64
+	// StrictWaitAOF makes strict durability purchases wait up to this long
+	// for Redis to fsync them to the AOF (WAITAOF); 0 disables waiting
+	StrictWaitAOF time.Duration
+	// OrderIDs generates order IDs; processes sharing a Redis need
+	// generators with distinct nodes (default node 0)
+	OrderIDs *snowflake.Generator
+	// PaymentTTL makes purchases create PENDING orders that must be
+	// confirmed within this long or are expired and restocked; 0 creates
+	// CONFIRMED orders directly
+	PaymentTTL time.Duration
+	// ValueCodec encodes buyers list entries (default plain user IDs).
+	// Readers detect the format per entry, so it can be changed on a live
+	// product once every server understands the new format.
+	ValueCodec ValueCodec
+	// WaitlistSize caps how many users can wait for a sold out product.
+	// Waitlisted users are granted units freed by expired and cancelled
+	// orders in arrival order; 0 disables the waitlist.
+	WaitlistSize int64
+	// BatchWindow collects purchases of the same stock key arriving within
+	// this long and sends them in one pipeline, at the cost of up to this
+	// much added latency; 0 sends each on its own. With StrictWaitAOF,
+	// purchases of strict products are sent on their own, on a pinned
+	// connection.
+	BatchWindow time.Duration
+	// BatchMax sends a batch early once it holds this many purchases
+	// (default 64)
+	BatchMax int
+	// OnBatch, when set, is called with the size of every batch sent
+	OnBatch func(size int)
+	// Allotment claims up to this many units of a product at a time into
+	// this process and sells them from memory, recording the sales in the
+	// background with RunAllotmentSync; 0 sells every unit through Redis
+	Allotment int64
+	// AllotmentNode names this process in the allotments kept in Redis
+	// and must differ between servers sharing one Redis
+	AllotmentNode string
+	// AllotmentJournal is the file allotted sales are journaled to before
+	// they are answered, required with Allotment. Sales and allotments a
+	// previous run left in it are recorded and returned on start.
+	AllotmentJournal string
+	// ScriptCluster, if set, is the Redis Cluster behind the client, whose
+	// masters SyncScripts checks
+	ScriptCluster *redis.ClusterClient
+	// Tenant keeps every key, stream and channel of the store under
+	// TenantPrefix(Tenant), apart from those of other tenants; empty uses
+	// the unprefixed keys
+	Tenant string
+	// CallTimeout bounds each Redis round trip of a purchase on its own,
+	// so a sharded purchase trying several shards gets the full timeout
+	// for every call; 0 leaves calls to the client's read timeout
+	CallTimeout time.Duration
+}
+
+// RedisStore keeps inventory in Redis and purchases through a Lua script.
+// Products may optionally be sharded across several stock keys.
+type RedisStore struct {
+	client      *redis.Client
+	opts        RedisStoreOptions
+	purchaseSHA string
+	// prefix is TenantPrefix(opts.Tenant)
+	prefix string
+	shards sync.Map // product ID -> *shardInfo
+	strict sync.Map // product ID -> *strictInfo, only with StrictWaitAOF
+	// batcher is nil unless BatchWindow is set
+	batcher *purchaseBatcher
+	// allot is nil unless Allotment is set
+	allot *allotments
+}
+
+var _ Store = (*RedisStore)(nil)
+
+// NewRedisStore loads the Lua scripts into Redis and returns a store
+// backed by client
+func NewRedisStore(ctx context.Context, client *redis.Client, opts RedisStoreOptions) (*RedisStore, error) {
+	if opts.EventsMaxLen <= 0 {
+		opts.EventsMaxLen = 1000000
+	}
+	if opts.OrderIDs == nil {
+		opts.OrderIDs, _ = snowflake.New(0)
+	}
+	if opts.ValueCodec == nil {
+		opts.ValueCodec = plainCodec{}
+	}
+
+	if opts.PaymentTTL > 0 && opts.PaymentTTL < time.Second {
+		return nil, fmt.Errorf("payment TTL must be at least 1s, got %v", opts.PaymentTTL)
+	}
+	if opts.Tenant != "" && !ValidTenant(opts.Tenant) {
+		return nil, fmt.Errorf("invalid tenant %q", opts.Tenant)
+	}
+
+	sha, err := client.ScriptLoad(ctx, purchaseScript).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load lua script: %w", err)
+	}
+	// Loaded up front so their first calls need not send the script body
+	for _, script := range helperScripts {
+		if err := script.Load(ctx, client).Err(); err != nil {
+			return nil, fmt.Errorf("failed to load lua script: %w", err)
+		}
+	}
+
+	r := &RedisStore{
+		client:      client,
+		opts:        opts,
+		purchaseSHA: sha,
+		prefix:      TenantPrefix(opts.Tenant),
+	}
+	if opts.BatchWindow > 0 {
+		r.batcher = newPurchaseBatcher(client, opts)
+	}
+	if opts.Allotment > 0 {
+		if opts.AllotmentJournal == "" {
+			return nil, errors.New("allotments need a journal")
+		}
+		journal, err := openAllotJournal(opts.AllotmentJournal)
+		if err != nil {
+			return nil, err
+		}
+		r.allot = &allotments{size: opts.Allotment, node: opts.AllotmentNode, journal: journal, products: make(map[string]*allotment)}
+		if err := r.recoverAllotments(ctx); err != nil {
+			return nil, fmt.Errorf("failed to recover allotments: %w", err)
+		}
+	}
+	return r, nil
+}
+
+// PurchaseScriptSHA returns the SHA1 of the loaded purchase script, which is
+// how its executions appear in SLOWLOG and MONITOR output
+func (r *RedisStore) PurchaseScriptSHA() string {
+	return r.purchaseSHA
+}
+
+// CheckHealth pings Redis and checks the purchase script is still loaded.
+// Redis forgets scripts when it restarts or fails over to a replica that
+// never loaded them, or on SCRIPT FLUSH, and purchases then fail with
+// NOSCRIPT; the script is loaded again if so.
+func (r *RedisStore) CheckHealth(ctx context.Context) error {
+	if err := r.client.Ping(ctx).Err(); err != nil {
+		return fmt.Errorf("redis ping failed: %w", err)
+	}
+	exists, err := r.client.ScriptExists(ctx, r.purchaseSHA).Result()
+	if err != nil {
+		return fmt.Errorf("failed to check lua script: %w", err)
+	}
+	if len(exists) == 1 && exists[0] {
+		return nil
+	}
+
+	log.Printf("WARNING: purchase script %s missing from Redis, loading it again", r.purchaseSHA)
+	sha, err := r.client.ScriptLoad(ctx, purchaseScript).Result()
+	if err != nil {
+		return fmt.Errorf("purchase script missing and reload failed: %w", err)
+	}
+	if sha != r.purchaseSHA {
+		return fmt.Errorf("purchase script reloaded as %s, expected %s", sha, r.purchaseSHA)
+	}
+	return nil
+}
+
+func (r *RedisStore) stockKey(productID string) string {
+	return r.key(fmt.Sprintf("product:%s:stock", productID))
+}
+
+func (r *RedisStore) buyersKey(productID string) string {
+	return r.key(fmt.Sprintf("product:%s:buyers", productID))
+}
+
+func (r *RedisStore) strictKey(productID string) string {
+	return r.key(fmt.Sprintf("product:%s:strict", productID))
+}
+
+// AttemptPurchase runs the purchase script against the product's keys, or
+// against one of its shards if the product is sharded. Products in queue
+// mode return a queued result instead.
+func (r *RedisStore) AttemptPurchase(ctx context.Context, productID, userID string) (PurchaseResult, error) {
+	orderID := strconv.FormatInt(r.opts.OrderIDs.Next(), 10)
+	return r.purchase(ctx, productID, userID, orderID, purchaseOpts{})
+}
+
+// AttemptAgentPurchase is AttemptPurchase made by agentID on behalf of
+// userID. The user is the buyer; the agent is recorded on the order.
+func (r *RedisStore) AttemptAgentPurchase(ctx context.Context, productID, userID, agentID string) (PurchaseResult, error) {
+	orderID := strconv.FormatInt(r.opts.OrderIDs.Next(), 10)
+	return r.purchase(ctx, productID, userID, orderID, purchaseOpts{agentID: agentID})
+}
+
+// purchaseOpts are the variations of a purchase
+type purchaseOpts struct {
+	// agentID is empty unless an agent is buying for the user
+	agentID string
+	// dispatch bypasses queue mode and the waitlist, for the queue
+	// dispatcher
+	dispatch bool
+	// hold makes a reservation: a PENDING order expiring after hold in
+	// place of the payment TTL, never queued or waitlisted
+	hold time.Duration
+}
+
+// ttl is how long the order waits for payment, 0 for none
+func (o purchaseOpts) ttl(paymentTTL time.Duration) time.Duration {
+	if o.hold > 0 {
+		return o.hold
+	}
+	return paymentTTL
+}
+
+// purchase creates order orderID if stock is left, or adds the user to the
+// waitlist
+func (r *RedisStore) purchase(ctx context.Context, productID, userID, orderID string, o purchaseOpts) (PurchaseResult, error) {
+	// Allotted units are sold under the payment TTL, so reservations go
+	// to the shared stock
+	if r.allot != nil && !o.dispatch && o.hold == 0 {
+		result, ok, err := r.allottedPurchase(ctx, productID, userID, orderID, o.agentID)
+		if err != nil || ok {
+			return result, err
+		}
+	}
+
+	si, err := r.shardLayout(ctx, productID)
+	if err != nil {
+		return PurchaseResult{}, fmt.Errorf("redis error: %w", err)
+	}
+
+	var result PurchaseResult
+	if si.count > 0 {
+		result, err = r.attemptShardedPurchase(ctx, productID, userID, orderID, si, o)
+	} else {
+		result, err = r.evalPurchase(ctx, productID, r.stockKey(productID), r.buyersKey(productID), userID, orderID, o)
+	}
+	if err != nil || result.Success || result.Queued || o.dispatch || o.hold > 0 {
+		return result, err
+	}
+
+	// Sold out. Units freed later go to the waitlist in order; a sold out
+	// answer stands even if joining fails.
+	result.WaitlistPosition, err = r.joinWaitlist(ctx, productID, userID, si.count > 0)
+	if err != nil {
+		log.Printf("Failed to waitlist user=%s for %s: %v", userID, productID, err)
+	}
+	return result, nil
+}
+
+// evalPurchase executes the purchase script against one stock/buyers pair,
+// creating order orderID on success
+func (r *RedisStore) evalPurchase(ctx context.Context, productID, stock, buyers, userID, orderID string, o purchaseOpts) (PurchaseResult, error) {
+	cmd, pinned, release, err := r.durableConn(ctx, productID)
+	if err != nil {
+		return PurchaseResult{}, fmt.Errorf("redis error: %w", err)
+	}
+	defer release()
+
+	keys := []string{stock, buyers, r.strictKey(productID), r.key(EventsStream), r.orderKey(orderID), r.key(pendingOrdersKey), r.metaKey(productID), r.userOrdersKey(userID),
+		r.queueModeKey(productID), r.queueKey(productID), r.queueTicketKey(orderID), r.waitlistKey(productID), r.pausedKey(productID), r.userUnitsKey(productID),
+		r.allowlistKey(productID)}
+	args := []interface{}{
+		userID,
+		productID,
+		r.opts.EventsMaxLen,
+		time.Now().Unix(),
+		orderID,
+		int64(o.ttl(r.opts.PaymentTTL).Seconds()),
+		r.opts.ValueCodec.Name(),
+		o.dispatch,
+		int64(queuedTicketTTL.Seconds()),
+		o.agentID,
+		o.hold > 0,
+	}
+
+	var result interface{}
+	callCtx, cancel := r.callContext(ctx)
+	defer cancel()
+	if r.batcher != nil && !pinned {
+		evalArgs := make([]interface{}, 0, 3+len(keys)+len(args))
+		evalArgs = append(evalArgs, "evalsha", r.purchaseSHA, len(keys))
+		for _, k := range keys {
+			evalArgs = append(evalArgs, k)
+		}
+		evalCmd := redis.NewCmd(callCtx, append(evalArgs, args...)...)
+		err = r.batcher.do(callCtx, stock, evalCmd)
+		result = evalCmd.Val()
+	} else {
+		result, err = cmd.EvalSha(callCtx, r.purchaseSHA, keys, args...).Result()
+	}
+	if err != nil {
+		return PurchaseResult{}, fmt.Errorf("redis error: %w", err)
+	}
+
+	// Parse Lua result
+	arr, ok := result.([]interface{})
+	if !ok || len(arr) != 3 {
+		return PurchaseResult{}, fmt.Errorf("invalid lua response")
+	}
+
+	success, ok1 := arr[0].(int64)
+	remaining, ok2 := arr[1].(int64)
+	recorded, ok3 := arr[2].(int64)
+	if !ok1 || !ok2 || !ok3 {
+		return PurchaseResult{}, fmt.Errorf("invalid lua response")
+	}
+
+	switch success {
+	case 2:
+		return PurchaseResult{OrderID: orderID, Queued: true, QueuePosition: remaining}, nil
+	case 3:
+		return PurchaseResult{}, ErrSalePaused
+	case 4:
+		return PurchaseResult{}, ErrUserLimitReached
+	case 5:
+		return PurchaseResult{}, ErrSaleNotStarted
+	case 6:
+		return PurchaseResult{}, ErrSaleEnded
+	case 7:
+		return PurchaseResult{}, ErrNotEligible
+	case 8:
+		return PurchaseResult{}, ErrSaleEventLimitReached
+	case 9:
+		return PurchaseResult{}, ErrNotReservable
+	}
+	res := PurchaseResult{
+		Success:   success == 1,
+		Remaining: remaining,
+		Recorded:  recorded == 1,
+	}
+	if res.Success {
+		res.OrderID = orderID
+		if ttl := o.ttl(r.opts.PaymentTTL); ttl > 0 {
+			res.PaymentDeadline = time.Now().Add(ttl)
+		}
+	}
+	if res.Recorded && r.opts.StrictWaitAOF > 0 {
+		if err := r.confirmDurable(ctx, cmd, pinned, productID); err != nil {
+			return res, fmt.Errorf("%w: %v", ErrNotDurable, err)
+		}
+	}
+	return res, nil
+}
+
+// callContext bounds one Redis round trip of a purchase by CallTimeout
+func (r *RedisStore) callContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if r.opts.CallTimeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, r.opts.CallTimeout)
+}
+
+// strictInfo is the strict durability mode of a product as last read
+type strictInfo struct {
+	strict   bool
+	loadedAt time.Time
+}
+
+// strictMode reports whether productID is in strict durability mode,
+// read from Redis at most shardInfoTTL ago
+func (r *RedisStore) strictMode(ctx context.Context, productID string) (bool, error) {
+	if v, ok := r.strict.Load(productID); ok {
+		if si := v.(*strictInfo); time.Since(si.loadedAt) < shardInfoTTL {
+			return si.strict, nil
+		}
+	}
+	ctx, cancel := r.callContext(ctx)
+	defer cancel()
+	strict, err := r.StrictDurability(ctx, productID)
+	if err != nil {
+		return false, err
+	}
+	r.strict.Store(productID, &strictInfo{strict: strict, loadedAt: time.Now()})
+	return strict, nil
+}
+
+// durableConn returns the connection to buy productIDs on. WAITAOF only
+// covers writes made on the same connection, so with StrictWaitAOF a
+// purchase of any strict product pins one; others share the pool and may
+// be batched. release must be called once the purchase is done.
+func (r *RedisStore) durableConn(ctx context.Context, productIDs ...string) (cmd cmdProcessor, pinned bool, release func(), err error) {
+	if r.opts.StrictWaitAOF > 0 {
+		for _, productID := range productIDs {
+			strict, err := r.strictMode(ctx, productID)
+			if err != nil {
+				return nil, false, nil, err
+			}
+			if strict {
+				conn := r.client.Conn()
+				return conn, true, func() { conn.Close() }, nil
+			}
+		}
+	}
+	return r.client, false, func() {}, nil
+}
+
+// confirmDurable waits until a recorded purchase made on cmd is fsynced to
+// the AOF. A purchase that was not pinned, because its product turned
+// strict after strictMode last read it, is confirmed by a write to
+// aofBarrierKey on a pinned connection instead: the AOF is fsynced in
+// order, so the later write being fsynced means the purchase is.
+func (r *RedisStore) confirmDurable(ctx context.Context, cmd cmdProcessor, pinned bool, productIDs ...string) error {
+	if pinned {
+		ctx, cancel := r.callContext(ctx)
+		defer cancel()
+		return waitAOF(ctx, cmd, r.opts.StrictWaitAOF)
+	}
+	for _, productID := range productIDs {
+		r.strict.Delete(productID)
+	}
+	conn := r.client.Conn()
+	defer conn.Close()
+	incrCtx, cancel := r.callContext(ctx)
+	err := conn.Incr(incrCtx, r.key(aofBarrierKey)).Err()
+	cancel()
+	if err != nil {
+		return err
+	}
+	waitCtx, cancel := r.callContext(ctx)
+	defer cancel()
+	return waitAOF(waitCtx, conn, r.opts.StrictWaitAOF)
+}
+
+// cmdProcessor is satisfied by both *redis.Client and a pinned *redis.Conn
+type cmdProcessor interface {
+	redis.Cmdable
+	Process(ctx context.Context, cmd redis.Cmder) error
+}
+
+// waitAOF blocks until Redis reports the connection's writes fsynced to
+// its local AOF, or timeout elapses
+func waitAOF(ctx context.Context, conn cmdProcessor, timeout time.Duration) error {
+	cmd := redis.NewIntSliceCmd(ctx, "waitaof", 1, 0, timeout.Milliseconds())
+	if err := conn.Process(ctx, cmd); err != nil {
+		return err
+	}
+
+	acks, err := cmd.Result()
+	if err != nil {
+		return err
+	}
+	if len(acks) < 1 || acks[0] < 1 {
+		return fmt.Errorf("aof fsync not acknowledged within %v", timeout)
+	}
+	return nil
+}
+
+// GetStock returns the stock counter, or the sum of all shard counters for
+// a sharded product. ErrProductNotFound is returned if neither exists.
+func (r *RedisStore) GetStock(ctx context.Context, productID string) (int64, error) {
+	shardStocks, err := r.ShardStocks(ctx, productID)
+	if err != nil {
+		return 0, err
+	}
+	if shardStocks != nil {
+		var total int64
+		for _, v := range shardStocks {
+			total += v
+		}
+		return total, nil
+	}
+
+	stock, err := r.client.Get(ctx, r.stockKey(productID)).Int64()
+	if err == redis.Nil {
+		return 0, ErrProductNotFound
+	} else if err != nil {
+		return 0, fmt.Errorf("failed to get stock: %w", err)
+	}
+	return stock, nil
+}
+
+// Buyers returns the user IDs in the buyers list, most recent first
+func (r *RedisStore) Buyers(ctx context.Context, productID string) ([]string, error) {
+	records, err := r.BuyerRecords(ctx, productID)
+	if err != nil {
+		return nil, err
+	}
+
+	buyers := make([]string, len(records))
+	for i, b := range records {
+		buyers[i] = b.UserID
+	}
+	return buyers, nil
+}
+
+// BuyerRecords returns the decoded buyers list, most recent first. Sharded
+// products keep one list per shard, which are concatenated in shard order.
+// Entries written by the plain codec only carry the user ID.
+func (r *RedisStore) BuyerRecords(ctx context.Context, productID string) ([]BuyerRecord, error) {
+	keys, err := r.buyerKeys(ctx, productID)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []BuyerRecord
+	for _, key := range keys {
+		list, err := r.client.LRange(ctx, key, 0, -1).Result()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get buyers: %w", err)
+		}
+		for _, entry := range list {
+			records = append(records, DecodeBuyer(entry))
+		}
+	}
+	return records, nil
+}
+
+// BuyerCount returns the total length of the product's buyers lists
+func (r *RedisStore) BuyerCount(ctx context.Context, productID string) (int64, error) {
+	keys, err := r.buyerKeys(ctx, productID)
+	if err != nil {
+		return 0, err
+	}
+
+	var total int64
+	for _, key := range keys {
+		count, err := r.client.LLen(ctx, key).Result()
+		if err != nil {
+			return 0, fmt.Errorf("failed to get buyer count: %w", err)
+		}
+		total += count
+	}
+	return total, nil
+}
+
+// BuyerPage returns up to limit buyers starting at offset, oldest first so
+// new purchases do not shift earlier pages, along with the offset of the
+// next page, -1 after the last one, and the total. Sharded products page
+// through their shards in order.
+func (r *RedisStore) BuyerPage(ctx context.Context, productID string, offset, limit int64) ([]BuyerRecord, int64, int64, error) {
+	keys, err := r.buyerKeys(ctx, productID)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	cmds, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, key := range keys {
+			pipe.LLen(ctx, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("failed to get buyer count: %w", err)
+	}
+	lengths := make([]int64, len(keys))
+	var total int64
+	for i, cmd := range cmds {
+		lengths[i] = cmd.(*redis.IntCmd).Val()
+		total += lengths[i]
+	}
+
+	records := []BuyerRecord{}
+	skip := offset
+	for i, key := range keys {
+		if int64(len(records)) >= limit {
+			break
+		}
+		if skip >= lengths[i] {
+			skip -= lengths[i]
+			continue
+		}
+		// Lists are pushed on the left, so the oldest entries are at the end
+		want := limit - int64(len(records))
+		list, err := r.client.LRange(ctx, key, -(skip + want), -(skip + 1)).Result()
+		if err != nil {
+			return nil, 0, 0, fmt.Errorf("failed to get buyers: %w", err)
+		}
+		for j := len(list) - 1; j >= 0; j-- {
+			records = append(records, DecodeBuyer(list[j]))
+		}
+		skip = 0
+	}
+
+	next := offset + int64(len(records))
+	if next >= total {
+		next = -1
+	}
+	return records, next, total, nil
+}
+
+// buyerKeys returns every buyers list key of a product
+func (r *RedisStore) buyerKeys(ctx context.Context, productID string) ([]string, error) {
+	count, err := r.shardCount(ctx, productID)
+	if err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		return []string{r.buyersKey(productID)}, nil
+	}
+
+	keys := make([]string, count)
+	for i := range keys {
+		keys[i] = r.shardBuyersKey(productID, i)
+	}
+	return keys, nil
+}
+
+// productKeys returns every key making up a product's current layout
+func (r *RedisStore) productKeys(ctx context.Context, productID string) ([]string, error) {
+	count, err := r.shardCount(ctx, productID)
+	if err != nil {
+		return nil, err
+	}
+	return r.productKeysFor(productID, count), nil
+}
+
+// productKeysFor is productKeys for a product with the given shard count
+func (r *RedisStore) productKeysFor(productID string, shards int) []string {
+	keys := []string{r.stockKey(productID), r.buyersKey(productID), r.shardsKey(productID), r.queueKey(productID), r.waitlistKey(productID),
+		r.allottedKey(productID), r.userUnitsKey(productID)}
+	for i := 0; i < shards; i++ {
+		keys = append(keys, r.shardStockKey(productID, i), r.shardBuyersKey(productID, i))
+	}
+	return keys
+}
+
+// SetStrictDurability turns strict durability mode on or off for a product.
+// In strict mode SUCCESS is only returned once the purchase event is in the
+// events stream, written atomically with the stock decrement.
+func (r *RedisStore) SetStrictDurability(ctx context.Context, productID string, strict bool) error {
+	var err error
+	if strict {
+		err = r.client.Set(ctx, r.strictKey(productID), 1, 0).Err()
+	} else {
+		err = r.client.Del(ctx, r.strictKey(productID)).Err()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to set durability mode: %w", err)
+	}
+	if r.opts.StrictWaitAOF > 0 {
+		r.strict.Store(productID, &strictInfo{strict: strict, loadedAt: time.Now()})
+	}
+	return nil
+}
+
+// StrictDurability reports whether a product is in strict durability mode
+func (r *RedisStore) StrictDurability(ctx context.Context, productID string) (bool, error) {
+	n, err := r.client.Exists(ctx, r.strictKey(productID)).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to get durability mode: %w", err)
+	}
+	return n == 1, nil
+}
+
+// InitProduct sets the stock counter and clears the buyers list
+func (r *RedisStore) InitProduct(ctx context.Context, productID string, stock int64) error {
+	return r.initProduct(ctx, productID, stock, 0)
+}
+
+// initCommands queues the commands replacing a product's old keys with a
+// fresh layout of stock units on pipe
+func (r *RedisStore) initCommands(ctx context.Context, pipe redis.Pipeliner, productID string, stock int64, shards int, oldKeys []string) {
+	pipe.Del(ctx, oldKeys...)
+	// The queue and waitlist were dropped with the old keys, so positions
+	// restart
+	pipe.HDel(ctx, r.metaKey(productID), "queue_in", "queue_out", "waitlist_seq")
+	pipe.HSet(ctx, r.metaKey(productID),
+		"initial_stock", stock,
+		"created_at", time.Now().Unix(),
+		"sold", 0,
+		"returned", 0,
+		"generation", newGeneration(),
+	)
+	if shards == 0 {
+		pipe.Set(ctx, r.stockKey(productID), stock, 0)
+		return
+	}
+
+	pipe.Set(ctx, r.shardsKey(productID), shards, 0)
+	base, extra := stock/int64(shards), stock%int64(shards)
+	for i := 0; i < shards; i++ {
+		shardStock := base
+		if int64(i) < extra {
+			shardStock++
+		}
+		pipe.Set(ctx, r.shardStockKey(productID, i), shardStock, 0)
+	}
+}
+
+// initProduct replaces the product's previous layout with a fresh one.
+// shards == 0 creates a single unsharded stock key.
+func (r *RedisStore) initProduct(ctx context.Context, productID string, stock int64, shards int) error {
+	oldKeys, err := r.productKeys(ctx, productID)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		r.initCommands(ctx, pipe, productID, stock, shards, oldKeys)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to init product: %w", err)
+	}
+
+	r.shards.Delete(productID)
+	r.announceRestock(ctx, productID)
+	return nil
+}
+
+// ResetProduct deletes the stock counters, buyers lists and settings
+func (r *RedisStore) ResetProduct(ctx context.Context, productID string) error {
+	keys, err := r.productKeys(ctx, productID)
+	if err != nil {
+		return err
+	}
+	keys = append(keys, r.strictKey(productID), r.queueModeKey(productID), r.pausedKey(productID), r.metaKey(productID),
+		r.allowlistKey(productID))
+	if err := r.client.Del(ctx, keys...).Err(); err != nil {
+		return fmt.Errorf("failed to reset product: %w", err)
+	}
+
+	r.shards.Delete(productID)
+	return nil
+}
@@ -0,0 +1,152 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// newTestStore returns a store on an in-process Redis, with the Redis so
+// tests can look at keys or make it fail
+func newTestStore(t *testing.T, opts RedisStoreOptions) (*RedisStore, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr(), MaxRetries: -1})
+	t.Cleanup(func() { rdb.Close() })
+	st, err := NewRedisStore(context.Background(), rdb, opts)
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	return st, mr
+}
+
+// productInfo reads a product, failing the test if it can't
+func productInfo(t *testing.T, st *RedisStore, productID string) ProductInfo {
+	t.Helper()
+	info, err := st.ProductInfo(context.Background(), productID)
+	if err != nil {
+		t.Fatalf("failed to read %s: %v", productID, err)
+	}
+	return info
+}
+
+// checkBalance fails the test unless every unit of the product is either
+// in stock or sold and not returned
+func checkBalance(t *testing.T, info ProductInfo) {
+	t.Helper()
+	if info.InitialStock != info.Stock+info.Sold-info.Returned {
+		t.Errorf("%s: initial stock %d != stock %d + sold %d - returned %d",
+			info.ID, info.InitialStock, info.Stock, info.Sold, info.Returned)
+	}
+}
+
+// buyAll makes one purchase per user and returns how many succeeded
+func buyAll(t *testing.T, st *RedisStore, productID string, users int) int64 {
+	t.Helper()
+	var won int64
+	for i := 0; i < users; i++ {
+		res, err := st.AttemptPurchase(context.Background(), productID, fmt.Sprintf("user%d", i))
+		if err != nil {
+			t.Fatalf("purchase of user%d: %v", i, err)
+		}
+		if res.Success {
+			won++
+		}
+	}
+	return won
+}
+
+// verify fails the test unless the product holds every invariant
+func verify(t *testing.T, st *RedisStore, productID string) Verification {
+	t.Helper()
+	v, err := st.VerifyProduct(context.Background(), productID, nil)
+	if err != nil {
+		t.Fatalf("failed to verify %s: %v", productID, err)
+	}
+	if !v.OK() {
+		t.Errorf("%s: %+v", productID, v.Discrepancies)
+	}
+	return v
+}
+
+func TestAttemptPurchase(t *testing.T) {
+	ctx := context.Background()
+	st, _ := newTestStore(t, RedisStoreOptions{})
+	if err := st.ImportProducts(ctx, []ProductSpec{{ID: "tee", Stock: 3, UserLimit: 1}}); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := st.AttemptPurchase(ctx, "tee", "alice")
+	if err != nil || !res.Success || res.OrderID == "" || res.Remaining != 2 {
+		t.Fatalf("first purchase: %+v, %v, want SUCCESS with 2 left", res, err)
+	}
+	if order, err := st.GetOrder(ctx, res.OrderID); err != nil || order.UserID != "alice" || order.Status != OrderConfirmed {
+		t.Fatalf("order %+v, %v, want alice's CONFIRMED order", order, err)
+	}
+	if _, err := st.AttemptPurchase(ctx, "tee", "alice"); !errors.Is(err, ErrUserLimitReached) {
+		t.Fatalf("second purchase of alice: %v, want ErrUserLimitReached", err)
+	}
+
+	if won := buyAll(t, st, "tee", 10); won != 2 {
+		t.Fatalf("%d more units sold, want the 2 left", won)
+	}
+	if v := verify(t, st, "tee"); v.Info.Stock != 0 || v.BuyerUnits != 3 {
+		t.Fatalf("stock %d with %d units held, want 0 and 3", v.Info.Stock, v.BuyerUnits)
+	}
+}
+
+func TestAttemptPurchasePaused(t *testing.T) {
+	ctx := context.Background()
+	st, _ := newTestStore(t, RedisStoreOptions{})
+	if err := st.ImportProducts(ctx, []ProductSpec{{ID: "tee", Stock: 3, Paused: true}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.AttemptPurchase(ctx, "tee", "alice"); !errors.Is(err, ErrSalePaused) {
+		t.Fatalf("purchase while paused: %v, want ErrSalePaused", err)
+	}
+	if info := productInfo(t, st, "tee"); info.Stock != 3 {
+		t.Fatalf("stock %d after a paused purchase, want 3", info.Stock)
+	}
+}
+
+// TestShardedPurchase sells every unit of a sharded product, whichever
+// shards the buyers land on, with each Redis call under its own timeout
+func TestShardedPurchase(t *testing.T) {
+	ctx := context.Background()
+	st, _ := newTestStore(t, RedisStoreOptions{CallTimeout: time.Second})
+	if err := st.ImportProducts(ctx, []ProductSpec{{ID: "tee", Stock: 10, Shards: 4, UserLimit: 1}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if won := buyAll(t, st, "tee", 30); won != 10 {
+		t.Fatalf("%d units sold, want 10", won)
+	}
+	v := verify(t, st, "tee")
+	for shard, stock := range v.ShardStocks {
+		if stock != 0 {
+			t.Errorf("shard %d has %d units left, want 0", shard, stock)
+		}
+	}
+	checkBalance(t, v.Info)
+}
+
+// TestPurchaseWriteRefused returns the Redis error, so servers can tell
+// attempts that never ran from outcomes
+func TestPurchaseWriteRefused(t *testing.T) {
+	ctx := context.Background()
+	st, mr := newTestStore(t, RedisStoreOptions{})
+	if err := st.ImportProducts(ctx, []ProductSpec{{ID: "tee", Stock: 3}}); err != nil {
+		t.Fatal(err)
+	}
+	mr.SetError("READONLY You can't write against a read only replica.")
+	_, err := st.AttemptPurchase(ctx, "tee", "alice")
+	var rerr redis.Error
+	if !errors.As(err, &rerr) {
+		t.Fatalf("purchase on a read only Redis: %v, want its Redis error", err)
+	}
+}
@@ -0,0 +1,142 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrProductExists is returned by WriteProjection when the target already
+// has data for the product
+var ErrProductExists = errors.New("product already exists")
+
+// Projection is the state of one product rebuilt from its events
+type Projection struct {
+	ProductID string
+	// InitialStock is 0 when unknown, in which case no stock key is written
+	InitialStock int64
+	Sold         int64
+	Returned     int64
+	// Orders are oldest first and are all added to their user's order index.
+	// PENDING and CONFIRMED orders hold a unit and put their user in the
+	// buyers list.
+	Orders []Order
+}
+
+// Event is one entry of the events stream
+type Event struct {
+	ID     string
+	Fields map[string]interface{}
+}
+
+// WriteProjection writes p as an unsharded product. It refuses to touch a
+// product that already has keys, so it is only meant for a fresh Redis.
+// Orders and buyers are written first and the metadata last: a product
+// without metadata was not fully replayed.
+func (r *RedisStore) WriteProjection(ctx context.Context, p Projection) error {
+	n, err := r.client.Exists(ctx, r.metaKey(p.ProductID), r.stockKey(p.ProductID),
+		r.buyersKey(p.ProductID), r.shardsKey(p.ProductID)).Result()
+	if err != nil {
+		return fmt.Errorf("failed to check product: %w", err)
+	}
+	if n > 0 {
+		return fmt.Errorf("%w: %s", ErrProductExists, p.ProductID)
+	}
+
+	for start := 0; start < len(p.Orders); start += auditBatchSize {
+		batch := p.Orders[start:min(start+auditBatchSize, len(p.Orders))]
+		_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, o := range batch {
+				entry, err := r.opts.ValueCodec.EncodeBuyer(BuyerRecord{
+					UserID:    o.UserID,
+					OrderID:   o.ID,
+					Quantity:  o.Quantity,
+					CreatedAt: o.CreatedAt.Unix(),
+				})
+				if err != nil {
+					return err
+				}
+				key := r.orderKey(o.ID)
+				pipe.HSet(ctx, key,
+					"order_id", o.ID,
+					"product_id", o.ProductID,
+					"user_id", o.UserID,
+					"quantity", o.Quantity,
+					"status", o.Status,
+					"created_at", o.CreatedAt.Unix(),
+					"stock_key", r.stockKey(p.ProductID),
+					"buyers_key", r.buyersKey(p.ProductID),
+					"buyer_entry", entry)
+				if !o.ExpiresAt.IsZero() {
+					pipe.HSet(ctx, key, "expires_at", o.ExpiresAt.Unix())
+				}
+				if o.AgentID != "" {
+					pipe.HSet(ctx, key, "agent_id", o.AgentID)
+				}
+				if o.BundleID != "" {
+					pipe.HSet(ctx, key, "bundle_id", o.BundleID)
+				}
+				if o.Status == OrderHeld {
+					pipe.HSet(ctx, key, "held_from", o.HeldFrom, "held_at", o.HeldAt.Unix(), "hold_reason", o.HoldReason)
+					pipe.ZAdd(ctx, r.key(heldOrdersKey), redis.Z{Score: float64(o.HeldAt.Unix()), Member: o.ID})
+				}
+				if o.Status == OrderFulfilled {
+					pipe.HSet(ctx, key, "fulfilled_at", o.FulfilledAt.Unix())
+				}
+				pipe.ZAdd(ctx, r.userOrdersKey(o.UserID), redis.Z{Score: float64(o.CreatedAt.Unix()), Member: o.ID})
+				if o.Status == OrderPending {
+					pipe.ZAdd(ctx, r.key(pendingOrdersKey), redis.Z{Score: float64(o.ExpiresAt.Unix()), Member: o.ID})
+				}
+				if OrderHoldsUnit(o.Status) {
+					// LPUSH in purchase order, as the purchase script does
+					pipe.LPush(ctx, r.buyersKey(p.ProductID), entry)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to write orders: %w", err)
+		}
+	}
+
+	_, err = r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, r.metaKey(p.ProductID),
+			"sold", p.Sold,
+			"returned", p.Returned,
+		)
+		if p.InitialStock > 0 {
+			pipe.HSet(ctx, r.metaKey(p.ProductID), "initial_stock", p.InitialStock)
+			pipe.Set(ctx, r.stockKey(p.ProductID), p.InitialStock-p.Sold+p.Returned, 0)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write product: %w", err)
+	}
+	if p.InitialStock > 0 {
+		r.announceRestock(ctx, p.ProductID)
+	}
+	return nil
+}
+
+// AppendEvents adds events to the events stream under their original IDs.
+// Redis rejects IDs not greater than the stream's last one, so events must
+// be appended in order to a stream that is empty or older.
+func (r *RedisStore) AppendEvents(ctx context.Context, events []Event) error {
+	_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, e := range events {
+			pipe.XAdd(ctx, &redis.XAddArgs{
+				Stream: r.key(EventsStream),
+				ID:     e.ID,
+				Values: e.Fields,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to append events: %w", err)
+	}
+	return nil
+}
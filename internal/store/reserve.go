@@ -0,0 +1,60 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrNotReservable is returned when reserving a unit of a product in queue
+// mode, whose units are only sold in queue order
+var ErrNotReservable = errors.New("product cannot be reserved")
+
+// Reserver is implemented by stores that hold units for an external
+// checkout. A reservation is a PENDING order with a deadline of its own:
+// ConfirmPayment commits it, and one neither committed nor released by
+// then is expired like an unpaid order, and its unit put back on sale.
+type Reserver interface {
+	// Reserve takes one unit for userID, bought by agentID if not empty,
+	// as a PENDING order expiring after ttl
+	Reserve(ctx context.Context, productID, userID, agentID string, ttl time.Duration) (PurchaseResult, error)
+	// ReleaseReservation cancels a PENDING order of userID and restores
+	// its stock or grants it to a waitlisted user
+	ReleaseReservation(ctx context.Context, orderID, userID string) (Order, CancelResult, error)
+}
+
+var _ Reserver = (*RedisStore)(nil)
+
+// Reserve runs the purchase script like AttemptPurchase, with ttl as the
+// payment deadline. Allotments, queues and the waitlist are skipped: a
+// sold out product just reports it.
+func (r *RedisStore) Reserve(ctx context.Context, productID, userID, agentID string, ttl time.Duration) (PurchaseResult, error) {
+	if ttl < time.Second {
+		return PurchaseResult{}, fmt.Errorf("reservation TTL must be at least 1s, got %v", ttl)
+	}
+	orderID := strconv.FormatInt(r.opts.OrderIDs.Next(), 10)
+	return r.purchase(ctx, productID, userID, orderID, purchaseOpts{agentID: agentID, hold: ttl})
+}
+
+// ReleaseReservation cancels a PENDING order. Orders of other users are
+// reported as not found, and ones already committed, expired or cancelled
+// as not pending.
+func (r *RedisStore) ReleaseReservation(ctx context.Context, orderID, userID string) (Order, CancelResult, error) {
+	productID, err := r.client.HGet(ctx, r.orderKey(orderID), "product_id").Result()
+	if err == redis.Nil {
+		return Order{}, CancelResult{}, ErrOrderNotFound
+	} else if err != nil {
+		return Order{}, CancelResult{}, fmt.Errorf("failed to get order: %w", err)
+	}
+
+	result, err := r.cancelOrder(ctx, productID, userID, orderID, "release")
+	if err != nil {
+		return Order{}, CancelResult{}, err
+	}
+	order, err := r.GetOrder(ctx, orderID)
+	return order, result, err
+}
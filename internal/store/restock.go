@@ -0,0 +1,20 @@
+package store
+
+import (
+	"context"
+	"log"
+)
+
+// RestockChannel is the pub/sub channel a product ID is published on when
+// units of it go back on sale: an order expires or is cancelled with
+// nobody on the waitlist to take the unit, or the product is set up again
+const RestockChannel = "flashsale:restock"
+
+// announceRestock publishes productID on RestockChannel. Listeners only
+// use it to drop cached state early, so a failure is logged and otherwise
+// ignored.
+func (r *RedisStore) announceRestock(ctx context.Context, productID string) {
+	if err := r.client.Publish(ctx, r.key(RestockChannel), productID).Err(); err != nil {
+		log.Printf("Failed to announce restock of %s: %v", productID, err)
+	}
+}
@@ -0,0 +1,94 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ScriptSyncer is implemented by stores that run Lua scripts, to check
+// that Redis still has all of them loaded
+type ScriptSyncer interface {
+	// SyncScripts loads every script Redis is missing and returns how
+	// many were missing on each node checked, by address
+	SyncScripts(ctx context.Context) (map[string]int, error)
+}
+
+var _ ScriptSyncer = (*RedisStore)(nil)
+
+// helperScripts are the scripts run through redis.Script, which fall back
+// to EVAL on NOSCRIPT. That costs a round trip with the whole script
+// body on every call until something loads it again. Every one is
+// declared with newScript, so none is left out of the check.
+var helperScripts []*redis.Script
+
+// newScript declares a helper script, loaded by NewRedisStore and checked
+// by SyncScripts
+func newScript(src string) *redis.Script {
+	s := redis.NewScript(src)
+	helperScripts = append(helperScripts, s)
+	return s
+}
+
+// SyncScripts checks the purchase script and every helper script with one
+// SCRIPT EXISTS and loads the missing ones. Unlike the helpers, purchases
+// fail outright while the purchase script is missing. With ScriptCluster
+// every master of the cluster is checked, so a replaced node or a
+// promoted replica gets the scripts before a purchase lands on it.
+func (r *RedisStore) SyncScripts(ctx context.Context) (map[string]int, error) {
+	if r.opts.ScriptCluster == nil {
+		missing, err := syncScripts(ctx, r.client, r.purchaseSHA)
+		return map[string]int{r.client.Options().Addr: missing}, err
+	}
+
+	var mu sync.Mutex
+	nodes := make(map[string]int)
+	err := r.opts.ScriptCluster.ForEachMaster(ctx, func(ctx context.Context, node *redis.Client) error {
+		missing, err := syncScripts(ctx, node, r.purchaseSHA)
+		mu.Lock()
+		nodes[node.Options().Addr] = missing
+		mu.Unlock()
+		if err != nil {
+			return fmt.Errorf("%s: %w", node.Options().Addr, err)
+		}
+		return nil
+	})
+	return nodes, err
+}
+
+// syncScripts loads the scripts node is missing and returns how many
+func syncScripts(ctx context.Context, node redis.Scripter, purchaseSHA string) (int, error) {
+	shas := make([]string, 0, len(helperScripts)+1)
+	shas = append(shas, purchaseSHA)
+	for _, s := range helperScripts {
+		shas = append(shas, s.Hash())
+	}
+
+	exists, err := node.ScriptExists(ctx, shas...).Result()
+	if err != nil {
+		return 0, fmt.Errorf("failed to check lua scripts: %w", err)
+	}
+	if len(exists) != len(shas) {
+		return 0, fmt.Errorf("invalid SCRIPT EXISTS response")
+	}
+
+	var missing int
+	for i, ok := range exists {
+		if ok {
+			continue
+		}
+		missing++
+		if i == 0 {
+			if err := node.ScriptLoad(ctx, purchaseScript).Err(); err != nil {
+				return missing, fmt.Errorf("failed to reload purchase script: %w", err)
+			}
+			continue
+		}
+		if err := helperScripts[i-1].Load(ctx, node).Err(); err != nil {
+			return missing, fmt.Errorf("failed to reload lua script %s: %w", shas[i], err)
+		}
+	}
+	return missing, nil
+}
@@ -0,0 +1,341 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// MaxShards caps how many stock keys a product can be split into
+	MaxShards = 256
+
+	// shardInfoTTL bounds how stale the locally cached shard layout and
+	// per-shard stock hints may become
+	shardInfoTTL = 5 * time.Second
+)
+
+// Lua script that redistributes stock evenly across all shard keys of a
+// product, returning the total
+var rebalanceScript = newScript(`
+local n = #KEYS
+local total = 0
+local vals = {}
+for i = 1, n do
+    local v = tonumber(redis.call("GET", KEYS[i])) or 0
+    vals[i] = v
+    total = total + v
+end
+
+local base = math.floor(total / n)
+local extra = total % n
+for i = 1, n do
+    local want = base
+    if i <= extra then
+        want = want + 1
+    end
+    if vals[i] ~= want then
+        redis.call("SET", KEYS[i], want)
+    end
+end
+return total
+`)
+
+// Rebalancer is implemented by stores that need a background job to keep
+// sharded stock evenly spread
+type Rebalancer interface {
+	RunShardRebalancer(ctx context.Context, interval time.Duration, active func() bool)
+}
+
+var _ Rebalancer = (*RedisStore)(nil)
+
+// shardInfo is the cached layout of one product. remaining holds the last
+// stock value this process saw per shard and is only a routing hint.
+type shardInfo struct {
+	count     int
+	remaining []atomic.Int64
+	loadedAt  time.Time
+}
+
+func (si *shardInfo) total() int64 {
+	var sum int64
+	for i := range si.remaining {
+		sum += si.remaining[i].Load()
+	}
+	return sum
+}
+
+// order returns the shards to try for a purchase: shards believed to have
+// stock in random order, or one random shard if all look empty
+func (si *shardInfo) order() []int {
+	var candidates []int
+	for i := range si.remaining {
+		if si.remaining[i].Load() > 0 {
+			candidates = append(candidates, i)
+		}
+	}
+	if len(candidates) == 0 {
+		return []int{rand.Intn(si.count)}
+	}
+
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	return candidates
+}
+
+func (r *RedisStore) shardsKey(productID string) string {
+	return r.key(fmt.Sprintf("product:%s:shards", productID))
+}
+
+func (r *RedisStore) shardStockKey(productID string, shard int) string {
+	return r.key(fmt.Sprintf("product:%s:stock:%d", productID, shard))
+}
+
+func (r *RedisStore) shardBuyersKey(productID string, shard int) string {
+	return r.key(fmt.Sprintf("product:%s:buyers:%d", productID, shard))
+}
+
+func (r *RedisStore) shardStockKeys(productID string, count int) []string {
+	keys := make([]string, count)
+	for i := range keys {
+		keys[i] = r.shardStockKey(productID, i)
+	}
+	return keys
+}
+
+// shardLayout returns the product's cached shard layout, reloading it from
+// Redis once it is older than shardInfoTTL. A count of 0 means unsharded.
+func (r *RedisStore) shardLayout(ctx context.Context, productID string) (*shardInfo, error) {
+	if v, ok := r.shards.Load(productID); ok {
+		if si := v.(*shardInfo); time.Since(si.loadedAt) < shardInfoTTL {
+			return si, nil
+		}
+	}
+
+	count, err := r.shardCount(ctx, productID)
+	if err != nil {
+		return nil, err
+	}
+
+	si := &shardInfo{
+		count:     count,
+		remaining: make([]atomic.Int64, count),
+		loadedAt:  time.Now(),
+	}
+
+	if count > 0 {
+		stocks, err := r.ShardStocks(ctx, productID)
+		if err != nil {
+			return nil, err
+		}
+		for i, v := range stocks {
+			si.remaining[i].Store(v)
+		}
+	}
+
+	r.shards.Store(productID, si)
+	return si, nil
+}
+
+// shardCount returns the number of shards a product was initialized with
+func (r *RedisStore) shardCount(ctx context.Context, productID string) (int, error) {
+	ctx, cancel := r.callContext(ctx)
+	defer cancel()
+	count, err := r.client.Get(ctx, r.shardsKey(productID)).Int()
+	if err == redis.Nil {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("failed to get shard count: %w", err)
+	}
+	return count, nil
+}
+
+// ShardStocks returns the current stock of every shard, or nil if the
+// product is not sharded
+func (r *RedisStore) ShardStocks(ctx context.Context, productID string) ([]int64, error) {
+	count, err := r.shardCount(ctx, productID)
+	if err != nil || count == 0 {
+		return nil, err
+	}
+
+	ctx, cancel := r.callContext(ctx)
+	defer cancel()
+	cmds, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i := 0; i < count; i++ {
+			pipe.Get(ctx, r.shardStockKey(productID, i))
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("failed to get shard stock: %w", err)
+	}
+
+	stocks := make([]int64, count)
+	for i, cmd := range cmds {
+		v, err := cmd.(*redis.StringCmd).Int64()
+		if err != nil && err != redis.Nil {
+			return nil, fmt.Errorf("failed to parse shard stock: %w", err)
+		}
+		stocks[i] = v
+	}
+	return stocks, nil
+}
+
+// attemptShardedPurchase tries shards in si.order() until one has stock.
+// Each attempt runs the regular purchase script against a single shard, so
+// no call ever touches more than one stock key. The cached counts are only
+// hints, so before answering sold out it reads every shard's stock and
+// tries those it skipped that still have some.
+func (r *RedisStore) attemptShardedPurchase(ctx context.Context, productID, userID, orderID string, si *shardInfo, o purchaseOpts) (PurchaseResult, error) {
+	tried := make([]bool, si.count)
+	attempt := func(shard int) (PurchaseResult, bool, error) {
+		tried[shard] = true
+		result, err := r.evalPurchase(ctx, productID, r.shardStockKey(productID, shard), r.shardBuyersKey(productID, shard), userID, orderID, o)
+		if err != nil {
+			return PurchaseResult{}, true, err
+		}
+		if result.Queued {
+			return result, true, nil
+		}
+
+		si.remaining[shard].Store(result.Remaining)
+		if result.Success {
+			// Report an estimate of the product-wide stock
+			result.Remaining = si.total()
+			return result, true, nil
+		}
+		return result, false, nil
+	}
+
+	for _, shard := range si.order() {
+		if result, done, err := attempt(shard); done {
+			return result, err
+		}
+	}
+
+	stocks, err := r.ShardStocks(ctx, productID)
+	if err != nil {
+		return PurchaseResult{}, fmt.Errorf("redis error: %w", err)
+	}
+	for shard, stock := range stocks {
+		// A layout changed meanwhile is picked up with the next reload
+		if shard >= si.count {
+			break
+		}
+		si.remaining[shard].Store(stock)
+		if tried[shard] || stock <= 0 {
+			continue
+		}
+		if result, done, err := attempt(shard); done {
+			return result, err
+		}
+	}
+	return PurchaseResult{Success: false}, nil
+}
+
+// InitShardedProduct splits stock evenly across the given number of shard
+// keys, replacing any previous layout
+func (r *RedisStore) InitShardedProduct(ctx context.Context, productID string, stock int64, shards int) error {
+	if shards < 2 || shards > MaxShards {
+		return fmt.Errorf("shard count must be between 2 and %d", MaxShards)
+	}
+	return r.initProduct(ctx, productID, stock, shards)
+}
+
+// Rebalance evens out stock across a sharded product's shards and returns
+// the total remaining
+func (r *RedisStore) Rebalance(ctx context.Context, productID string) (int64, error) {
+	count, err := r.shardCount(ctx, productID)
+	if err != nil {
+		return 0, err
+	}
+	if count == 0 {
+		return 0, fmt.Errorf("product '%s' is not sharded", productID)
+	}
+
+	total, err := rebalanceScript.Run(ctx, r.client, r.shardStockKeys(productID, count)).Int64()
+	if err != nil {
+		return 0, fmt.Errorf("failed to rebalance: %w", err)
+	}
+
+	r.shards.Delete(productID)
+	return total, nil
+}
+
+// RunShardRebalancer periodically rebalances sharded products this process
+// has served once their shards drift apart, until ctx is cancelled. An
+// empty shard next to full ones forces purchases to fall through to a
+// second shard, so those are evened out first. Ticks while active reports
+// false are skipped, so only one server of a fleet rebalances.
+func (r *RedisStore) RunShardRebalancer(ctx context.Context, interval time.Duration, active func() bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if !active() {
+			continue
+		}
+
+		r.shards.Range(func(key, value any) bool {
+			productID, si := key.(string), value.(*shardInfo)
+			if si.count == 0 || !needsRebalance(si) {
+				return true
+			}
+
+			total, err := r.Rebalance(ctx, productID)
+			if err != nil {
+				log.Printf("Failed to rebalance %s: %v", productID, err)
+				return true
+			}
+			log.Printf("Rebalanced %s across %d shards (%d remaining)", productID, si.count, total)
+			return true
+		})
+	}
+}
+
+// needsRebalance reports whether the largest shard holds more than twice
+// the smallest, or any shard is empty while stock remains elsewhere
+func needsRebalance(si *shardInfo) bool {
+	minStock, maxStock := si.remaining[0].Load(), si.remaining[0].Load()
+	for i := 1; i < si.count; i++ {
+		v := si.remaining[i].Load()
+		minStock = min(minStock, v)
+		maxStock = max(maxStock, v)
+	}
+
+	if maxStock == 0 {
+		return false
+	}
+	if minStock == 0 {
+		return maxStock > 1
+	}
+	return maxStock > 2*minStock
+}
+
+// PrimeCaches loads the shard layout of every product in infos, so the
+// first purchases after start-up do not each wait for it. Unsharded
+// products need no round trip: their snapshot already says so.
+func (r *RedisStore) PrimeCaches(ctx context.Context, infos []ProductInfo) error {
+	now := time.Now()
+	for _, info := range infos {
+		if info.Shards == 0 {
+			r.shards.Store(info.ID, &shardInfo{loadedAt: now})
+			continue
+		}
+		if _, err := r.shardLayout(ctx, info.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,455 @@
+package store
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// SnapshotVersion is the snapshot format Snapshot writes and
+// RestoreSnapshot reads
+const SnapshotVersion = 1
+
+// ErrSnapshotVersion is returned when restoring a snapshot of a format
+// this build does not know
+var ErrSnapshotVersion = errors.New("unsupported snapshot version")
+
+// Snapshot is the whole Redis state of one product: its stock, buyers,
+// queue, waitlist and policy keys, its orders and queued tickets, and its
+// entries in the indexes it shares with other products. Key names are
+// those below the tenant prefix, so a snapshot restores into any tenant
+// or a local Redis.
+type Snapshot struct {
+	Version   int       `json:"version"`
+	ProductID string    `json:"product_id"`
+	Tenant    string    `json:"tenant,omitempty"`
+	TakenAt   time.Time `json:"taken_at"`
+	// Keys belong to the product alone and replace its keys on restore
+	Keys []SnapshotKey `json:"keys"`
+	// Shared are the product's members of keys other products use too,
+	// such as the pending orders index, added to them on restore
+	Shared []SnapshotKey `json:"shared,omitempty"`
+}
+
+// SnapshotKey is one key of a Snapshot, with the field of its type set
+type SnapshotKey struct {
+	Key  string `json:"key"`
+	Type string `json:"type"`
+	// TTLMillis is what was left of the key's time to live, 0 for none
+	TTLMillis int64                    `json:"ttl_ms,omitempty"`
+	String    *SnapshotValue           `json:"string,omitempty"`
+	Hash      map[string]SnapshotValue `json:"hash,omitempty"`
+	List      []SnapshotValue          `json:"list,omitempty"`
+	Set       []SnapshotValue          `json:"set,omitempty"`
+	ZSet      []SnapshotMember         `json:"zset,omitempty"`
+}
+
+// SnapshotMember is a sorted set member with its score
+type SnapshotMember struct {
+	Member SnapshotValue `json:"member"`
+	Score  float64       `json:"score"`
+}
+
+// SnapshotValue is a Redis value. It is a JSON string when it is valid
+// UTF-8, and {"base64": "..."} otherwise, as msgpack buyer entries are.
+type SnapshotValue string
+
+func (v SnapshotValue) MarshalJSON() ([]byte, error) {
+	if utf8.ValidString(string(v)) {
+		return json.Marshal(string(v))
+	}
+	return json.Marshal(map[string]string{"base64": base64.StdEncoding.EncodeToString([]byte(v))})
+}
+
+func (v *SnapshotValue) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*v = SnapshotValue(s)
+		return nil
+	}
+	var b struct {
+		Base64 string `json:"base64"`
+	}
+	if err := json.Unmarshal(data, &b); err != nil {
+		return fmt.Errorf("snapshot value must be a string or {\"base64\": ...}")
+	}
+	raw, err := base64.StdEncoding.DecodeString(b.Base64)
+	if err != nil {
+		return fmt.Errorf("invalid base64 snapshot value: %w", err)
+	}
+	*v = SnapshotValue(raw)
+	return nil
+}
+
+// Snapshotter is implemented by stores that can dump a product's state and
+// write it back
+type Snapshotter interface {
+	// Snapshot returns the state of a product
+	Snapshot(ctx context.Context, productID string) (Snapshot, error)
+	// RestoreSnapshot writes a snapshot back in one transaction. It refuses
+	// to overwrite a product that exists unless replace is set, in which
+	// case the product's current keys and orders are dropped first.
+	RestoreSnapshot(ctx context.Context, s Snapshot, replace bool) error
+}
+
+var _ Snapshotter = (*RedisStore)(nil)
+
+// orderKeyFields are the order hash fields naming keys, which carry the
+// tenant prefix
+var orderKeyFields = []string{"stock_key", "buyers_key"}
+
+// ownedKeys are the keys of a product alone, apart from its orders and
+// tickets
+func (r *RedisStore) ownedKeys(ctx context.Context, productID string) ([]string, error) {
+	keys, err := r.productKeys(ctx, productID)
+	if err != nil {
+		return nil, err
+	}
+	return append(keys, r.strictKey(productID), r.queueModeKey(productID), r.pausedKey(productID), r.metaKey(productID),
+		r.allowlistKey(productID)), nil
+}
+
+// Snapshot reads a product's keys in one transaction, after finding its
+// orders with a scan. Orders placed while the scan runs may be left out,
+// so a sale should be paused or over for an exact copy.
+func (r *RedisStore) Snapshot(ctx context.Context, productID string) (Snapshot, error) {
+	if _, err := r.ProductInfo(ctx, productID); err != nil {
+		return Snapshot{}, err
+	}
+	orders, err := r.productOrders(ctx, productID, nil)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	keys, err := r.ownedKeys(ctx, productID)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	tickets, err := r.client.LRange(ctx, r.queueKey(productID), 0, -1).Result()
+	if err != nil {
+		return Snapshot{}, fmt.Errorf("failed to get queue: %w", err)
+	}
+	saleEvent, err := r.client.HGet(ctx, r.metaKey(productID), "sale_event").Result()
+	if err != nil && err != redis.Nil {
+		return Snapshot{}, fmt.Errorf("failed to get sale event: %w", err)
+	}
+	for _, o := range orders {
+		keys = append(keys, r.orderKey(o.ID))
+	}
+	for _, id := range tickets {
+		keys = append(keys, r.queueTicketKey(id))
+	}
+
+	types := make([]*redis.StatusCmd, len(keys))
+	_, err = r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			types[i] = pipe.Type(ctx, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return Snapshot{}, fmt.Errorf("failed to get key types: %w", err)
+	}
+
+	snap := Snapshot{Version: SnapshotVersion, ProductID: productID, Tenant: r.opts.Tenant, TakenAt: time.Now().UTC()}
+	var reads []func() error
+	_, err = r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			typ := types[i].Val()
+			if typ == "none" {
+				continue
+			}
+			k := len(snap.Keys)
+			snap.Keys = append(snap.Keys, SnapshotKey{Key: strings.TrimPrefix(key, r.prefix), Type: typ})
+			fill, err := r.readKey(ctx, pipe, key, typ)
+			if err != nil {
+				return err
+			}
+			reads = append(reads, func() error { return fill(&snap.Keys[k]) })
+		}
+
+		for _, index := range []string{pendingOrdersKey, heldOrdersKey} {
+			entry := SnapshotKey{Key: index, Type: "zset"}
+			reads = append(reads, r.readScores(ctx, pipe, r.key(index), orders, &entry, &snap.Shared))
+		}
+		byUser := make(map[string][]Order)
+		var users []string
+		for _, o := range orders {
+			if _, ok := byUser[o.UserID]; !ok {
+				users = append(users, o.UserID)
+			}
+			byUser[o.UserID] = append(byUser[o.UserID], o)
+		}
+		for _, user := range users {
+			entry := SnapshotKey{Key: strings.TrimPrefix(r.userOrdersKey(user), r.prefix), Type: "zset"}
+			reads = append(reads, r.readScores(ctx, pipe, r.userOrdersKey(user), byUser[user], &entry, &snap.Shared))
+		}
+		closing := pipe.ZScore(ctx, r.key(closingSalesKey), productID)
+		reads = append(reads, func() error {
+			if closing.Err() == nil {
+				snap.Shared = append(snap.Shared, SnapshotKey{Key: closingSalesKey, Type: "zset",
+					ZSet: []SnapshotMember{{Member: SnapshotValue(productID), Score: closing.Val()}}})
+			}
+			return nil
+		})
+		queued := pipe.SIsMember(ctx, r.key(queueProductsKey), productID)
+		reads = append(reads, func() error {
+			if queued.Val() {
+				snap.Shared = append(snap.Shared, SnapshotKey{Key: queueProductsKey, Type: "set", Set: []SnapshotValue{SnapshotValue(productID)}})
+			}
+			return nil
+		})
+		if saleEvent != "" {
+			buyers := pipe.SMembers(ctx, r.saleEventBuyersKey(saleEvent))
+			reads = append(reads, func() error {
+				if len(buyers.Val()) > 0 {
+					snap.Shared = append(snap.Shared, SnapshotKey{Key: strings.TrimPrefix(r.saleEventBuyersKey(saleEvent), r.prefix),
+						Type: "set", Set: snapshotValues(buyers.Val())})
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return Snapshot{}, fmt.Errorf("failed to read product: %w", err)
+	}
+	for _, read := range reads {
+		if err := read(); err != nil {
+			return Snapshot{}, err
+		}
+	}
+	return snap, nil
+}
+
+// readKey queues the reads of a key of type typ on pipe, and returns the
+// function filling in its SnapshotKey once the pipeline ran
+func (r *RedisStore) readKey(ctx context.Context, pipe redis.Pipeliner, key, typ string) (func(k *SnapshotKey) error, error) {
+	ttl := pipe.PTTL(ctx, key)
+	var fill func(k *SnapshotKey)
+	switch typ {
+	case "string":
+		cmd := pipe.Get(ctx, key)
+		fill = func(k *SnapshotKey) {
+			v := SnapshotValue(cmd.Val())
+			k.String = &v
+		}
+	case "hash":
+		cmd := pipe.HGetAll(ctx, key)
+		fill = func(k *SnapshotKey) {
+			k.Hash = make(map[string]SnapshotValue, len(cmd.Val()))
+			for f, v := range cmd.Val() {
+				k.Hash[f] = SnapshotValue(v)
+			}
+			for _, f := range orderKeyFields {
+				if v, ok := k.Hash[f]; ok {
+					k.Hash[f] = SnapshotValue(strings.TrimPrefix(string(v), r.prefix))
+				}
+			}
+		}
+	case "list":
+		cmd := pipe.LRange(ctx, key, 0, -1)
+		fill = func(k *SnapshotKey) { k.List = snapshotValues(cmd.Val()) }
+	case "set":
+		cmd := pipe.SMembers(ctx, key)
+		fill = func(k *SnapshotKey) { k.Set = snapshotValues(cmd.Val()) }
+	case "zset":
+		cmd := pipe.ZRangeWithScores(ctx, key, 0, -1)
+		fill = func(k *SnapshotKey) {
+			for _, z := range cmd.Val() {
+				k.ZSet = append(k.ZSet, SnapshotMember{Member: SnapshotValue(fmt.Sprint(z.Member)), Score: z.Score})
+			}
+		}
+	default:
+		return nil, fmt.Errorf("cannot snapshot %s, a %s", key, typ)
+	}
+	return func(k *SnapshotKey) error {
+		if err := ttl.Err(); err != nil {
+			return fmt.Errorf("failed to read %s: %w", key, err)
+		}
+		if d := ttl.Val(); d > 0 {
+			k.TTLMillis = d.Milliseconds()
+		}
+		fill(k)
+		return nil
+	}, nil
+}
+
+// readScores queues the reads of the scores orders have in a shared sorted
+// set, and returns the function adding those found to shared as entry
+func (r *RedisStore) readScores(ctx context.Context, pipe redis.Pipeliner, key string, orders []Order, entry *SnapshotKey, shared *[]SnapshotKey) func() error {
+	cmds := make([]*redis.FloatCmd, len(orders))
+	for i, o := range orders {
+		cmds[i] = pipe.ZScore(ctx, key, o.ID)
+	}
+	return func() error {
+		for i, cmd := range cmds {
+			if cmd.Err() == nil {
+				entry.ZSet = append(entry.ZSet, SnapshotMember{Member: SnapshotValue(orders[i].ID), Score: cmd.Val()})
+			}
+		}
+		if len(entry.ZSet) > 0 {
+			*shared = append(*shared, *entry)
+		}
+		return nil
+	}
+}
+
+func snapshotValues(vals []string) []SnapshotValue {
+	out := make([]SnapshotValue, len(vals))
+	for i, v := range vals {
+		out[i] = SnapshotValue(v)
+	}
+	return out
+}
+
+// RestoreSnapshot writes s back in one MULTI/EXEC, so servers see either
+// the old product or the restored one. Shared keys only get the snapshot's
+// members added. With replace, the product's current orders are found with
+// a scan and dropped in the same transaction.
+func (r *RedisStore) RestoreSnapshot(ctx context.Context, s Snapshot, replace bool) error {
+	if s.Version != SnapshotVersion {
+		return fmt.Errorf("%w %d, expected %d", ErrSnapshotVersion, s.Version, SnapshotVersion)
+	}
+	if s.ProductID == "" {
+		return errors.New("snapshot names no product")
+	}
+	productID := s.ProductID
+	for _, k := range s.Keys {
+		switch {
+		case strings.HasPrefix(k.Key, fmt.Sprintf("product:%s:", productID)):
+		case strings.HasPrefix(k.Key, "order:"), strings.HasPrefix(k.Key, "queue:ticket:"):
+			// Orders and tickets are only the product's if they say so, so
+			// a snapshot cannot overwrite those of another product
+			if k.Type != "hash" || string(k.Hash["product_id"]) != productID {
+				return fmt.Errorf("snapshot key %s is not a key of %s", k.Key, productID)
+			}
+		default:
+			return fmt.Errorf("snapshot key %s is not a key of %s", k.Key, productID)
+		}
+	}
+	for _, k := range s.Shared {
+		if k.Key != pendingOrdersKey && k.Key != heldOrdersKey && k.Key != queueProductsKey && k.Key != closingSalesKey &&
+			!(strings.HasPrefix(k.Key, "user:") && strings.HasSuffix(k.Key, ":orders")) &&
+			!(strings.HasPrefix(k.Key, "sale_event:") && strings.HasSuffix(k.Key, ":buyers")) {
+			return fmt.Errorf("snapshot key %s is not a shared key", k.Key)
+		}
+	}
+
+	n, err := r.client.Exists(ctx, r.metaKey(productID), r.stockKey(productID),
+		r.buyersKey(productID), r.shardsKey(productID)).Result()
+	if err != nil {
+		return fmt.Errorf("failed to check product: %w", err)
+	}
+	if n > 0 && !replace {
+		return fmt.Errorf("%w: %s", ErrProductExists, productID)
+	}
+
+	var drop []string
+	var current []Order
+	if n > 0 {
+		if drop, err = r.ownedKeys(ctx, productID); err != nil {
+			return err
+		}
+		if current, err = r.productOrders(ctx, productID, nil); err != nil {
+			return err
+		}
+		for _, o := range current {
+			drop = append(drop, r.orderKey(o.ID))
+		}
+	}
+
+	_, err = r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		if len(drop) > 0 {
+			pipe.Del(ctx, drop...)
+		}
+		for _, o := range current {
+			pipe.ZRem(ctx, r.key(pendingOrdersKey), o.ID)
+			pipe.ZRem(ctx, r.key(heldOrdersKey), o.ID)
+			pipe.ZRem(ctx, r.userOrdersKey(o.UserID), o.ID)
+		}
+		for _, k := range s.Keys {
+			key := r.key(k.Key)
+			pipe.Del(ctx, key)
+			if err := r.writeKey(ctx, pipe, key, k); err != nil {
+				return err
+			}
+			if k.TTLMillis > 0 {
+				pipe.PExpire(ctx, key, time.Duration(k.TTLMillis)*time.Millisecond)
+			}
+		}
+		for _, k := range s.Shared {
+			if err := r.writeKey(ctx, pipe, r.key(k.Key), k); err != nil {
+				return err
+			}
+		}
+		// Allotments claimed before count for nothing once restored
+		pipe.HSet(ctx, r.metaKey(productID), "generation", newGeneration())
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to restore product: %w", err)
+	}
+
+	r.shards.Delete(productID)
+	r.announceRestock(ctx, productID)
+	return nil
+}
+
+// writeKey queues the writes adding the contents of k to key on pipe
+func (r *RedisStore) writeKey(ctx context.Context, pipe redis.Pipeliner, key string, k SnapshotKey) error {
+	switch k.Type {
+	case "string":
+		if k.String == nil {
+			return fmt.Errorf("snapshot key %s has no string", k.Key)
+		}
+		pipe.Set(ctx, key, string(*k.String), 0)
+	case "hash":
+		if len(k.Hash) == 0 {
+			return nil
+		}
+		values := make([]interface{}, 0, 2*len(k.Hash))
+		for f, v := range k.Hash {
+			values = append(values, f, string(v))
+		}
+		for _, f := range orderKeyFields {
+			if v, ok := k.Hash[f]; ok {
+				values = append(values, f, r.key(string(v)))
+			}
+		}
+		pipe.HSet(ctx, key, values...)
+	case "list":
+		if len(k.List) > 0 {
+			pipe.RPush(ctx, key, interfaces(k.List)...)
+		}
+	case "set":
+		if len(k.Set) > 0 {
+			pipe.SAdd(ctx, key, interfaces(k.Set)...)
+		}
+	case "zset":
+		members := make([]redis.Z, len(k.ZSet))
+		for i, m := range k.ZSet {
+			members[i] = redis.Z{Score: m.Score, Member: string(m.Member)}
+		}
+		if len(members) > 0 {
+			pipe.ZAdd(ctx, key, members...)
+		}
+	default:
+		return fmt.Errorf("snapshot key %s has unknown type %q", k.Key, k.Type)
+	}
+	return nil
+}
+
+func interfaces(vals []SnapshotValue) []interface{} {
+	out := make([]interface{}, len(vals))
+	for i, v := range vals {
+		out[i] = string(v)
+	}
+	return out
+}
@@ -0,0 +1,121 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// SpeedDetector is implemented by stores that can spot users attempting
+// purchases faster than a human could, across every server sharing the
+// store
+type SpeedDetector interface {
+	// RecordAttempt notes a purchase attempt of userID and reports whether
+	// the user is flagged
+	RecordAttempt(ctx context.Context, userID string, rule SpeedRule) (SpeedVerdict, error)
+	// SpeedFlagged reports whether userID is flagged without recording an
+	// attempt
+	SpeedFlagged(ctx context.Context, userID string) (bool, error)
+	// AllowFlaggedAttempt is AllowAttempt against the stricter limit of
+	// flagged users
+	AllowFlaggedAttempt(ctx context.Context, userID string, limit int64, window time.Duration) (RateDecision, error)
+}
+
+var _ SpeedDetector = (*RedisStore)(nil)
+
+// SpeedRule flags a user once Streak intervals in a row between their
+// attempts are shorter than Floor. The flag lasts FlagFor after the last
+// fast attempt.
+type SpeedRule struct {
+	Floor   time.Duration
+	Streak  int64
+	FlagFor time.Duration
+}
+
+// SpeedVerdict is the outcome of one RecordAttempt call
+type SpeedVerdict struct {
+	Flagged bool
+	// NewlyFlagged is set on the attempt that raised the flag
+	NewlyFlagged bool
+}
+
+func (r *RedisStore) speedKey(userID string) string {
+	return r.key(fmt.Sprintf("speed:user:%s", userID))
+}
+
+func (r *RedisStore) flaggedRateLimitKey(userID string) string {
+	return r.key(fmt.Sprintf("ratelimit:flagged:%s", userID))
+}
+
+// speedIdle is how long the speed state of a user who stopped attempting
+// is kept, beyond their flag
+const speedIdle = time.Minute
+
+// Lua script tracking one user's attempt intervals in a single hash: the
+// last attempt, how many intervals in a row were under the floor, and
+// until when the user is flagged. ARGV is now, floor, streak, flag
+// duration and idle TTL, times in milliseconds. Returns {flagged, newly}.
+var speedScript = newScript(`
+local now = tonumber(ARGV[1])
+local floor = tonumber(ARGV[2])
+local streak = tonumber(ARGV[3])
+local ttl = tonumber(ARGV[4])
+local idle = tonumber(ARGV[5])
+
+local f = redis.call("HMGET", KEYS[1], "last", "fast", "until")
+local last, fast, flagged_until = tonumber(f[1]), tonumber(f[2]) or 0, tonumber(f[3]) or 0
+if last and now - last < floor then
+    fast = fast + 1
+else
+    fast = 0
+end
+
+local newly = 0
+if fast >= streak then
+    if flagged_until <= now then
+        newly = 1
+    end
+    flagged_until = now + ttl
+end
+
+redis.call("HSET", KEYS[1], "last", now, "fast", fast, "until", flagged_until)
+redis.call("PEXPIRE", KEYS[1], math.max(flagged_until - now, 0) + idle)
+if flagged_until > now then
+    return {1, newly}
+end
+return {0, 0}
+`)
+
+// RecordAttempt updates userID's attempt intervals against rule
+func (r *RedisStore) RecordAttempt(ctx context.Context, userID string, rule SpeedRule) (SpeedVerdict, error) {
+	res, err := speedScript.Run(ctx, r.client, []string{r.speedKey(userID)},
+		time.Now().UnixMilli(), rule.Floor.Milliseconds(), rule.Streak, rule.FlagFor.Milliseconds(),
+		speedIdle.Milliseconds()).Int64Slice()
+	if err != nil {
+		return SpeedVerdict{}, fmt.Errorf("speed check failed: %w", err)
+	}
+	if len(res) != 2 {
+		return SpeedVerdict{}, fmt.Errorf("invalid lua response")
+	}
+	return SpeedVerdict{Flagged: res[0] == 1, NewlyFlagged: res[1] == 1}, nil
+}
+
+// SpeedFlagged reads the flag RecordAttempt keeps for userID
+func (r *RedisStore) SpeedFlagged(ctx context.Context, userID string) (bool, error) {
+	until, err := r.client.HGet(ctx, r.speedKey(userID), "until").Int64()
+	if err == redis.Nil {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to read speed flag: %w", err)
+	}
+	return until > time.Now().UnixMilli(), nil
+}
+
+// AllowFlaggedAttempt counts one attempt of a flagged user against the
+// flagged limit, separately from their normal rate limit
+func (r *RedisStore) AllowFlaggedAttempt(ctx context.Context, userID string, limit int64, window time.Duration) (RateDecision, error) {
+	return r.allowAttempt(ctx, r.flaggedRateLimitKey(userID), limit, window)
+}
@@ -0,0 +1,178 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// staleExpireBatch is how many stale orders ExpireStaleOrders expires per
+// call of ExpireOrders
+const staleExpireBatch = 500
+
+// StaleSweeper is implemented by stores that can find unpaid orders the
+// reaper missed
+type StaleSweeper interface {
+	// StaleOrders returns the PENDING orders past their payment deadline
+	StaleOrders(ctx context.Context, progress ProgressFunc) ([]StaleOrder, error)
+	// ExpireStaleOrders expires every PENDING order past its payment
+	// deadline and returns them
+	ExpireStaleOrders(ctx context.Context, progress ProgressFunc) (StaleSweep, error)
+}
+
+var _ StaleSweeper = (*RedisStore)(nil)
+
+// StaleOrder is a PENDING order past its payment deadline. An unindexed
+// one is missing from the pending index the reaper reads, so only a sweep
+// finds it.
+type StaleOrder struct {
+	Order
+	Unindexed bool
+}
+
+// StaleSweep is the result of ExpireStaleOrders. Unindexed counts the
+// expired orders that were missing from the pending index.
+type StaleSweep struct {
+	Expired   []ExpiredOrder
+	Unindexed int
+}
+
+// StaleOrders scans every order for PENDING ones past their deadline,
+// oldest deadline first. Unlike the reaper it does not trust the pending
+// index, so it also finds orders that fell out of it, but it is slow on a
+// large Redis.
+func (r *RedisStore) StaleOrders(ctx context.Context, progress ProgressFunc) ([]StaleOrder, error) {
+	now := time.Now()
+	var stale []StaleOrder
+	var scanned int64
+
+	iter := r.client.Scan(ctx, 0, r.orderKey("*"), auditBatchSize).Iterator()
+	var keys []string
+	flush := func() error {
+		if len(keys) == 0 {
+			return nil
+		}
+		cmds, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, key := range keys {
+				pipe.HMGet(ctx, key, "order_id", "product_id", "user_id", "quantity", "status", "created_at", "expires_at")
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to get orders: %w", err)
+		}
+		var found []StaleOrder
+		for _, cmd := range cmds {
+			vals := cmd.(*redis.SliceCmd).Val()
+			field := func(i int) string {
+				s, _ := vals[i].(string)
+				return s
+			}
+			if field(4) != OrderPending {
+				continue
+			}
+			o := StaleOrder{Order: Order{
+				ID:        field(0),
+				ProductID: field(1),
+				UserID:    field(2),
+				Status:    OrderPending,
+				CreatedAt: parseUnix(field(5)),
+				ExpiresAt: parseUnix(field(6)),
+			}}
+			o.Quantity, _ = strconv.ParseInt(field(3), 10, 64)
+			if o.ID == "" || o.ExpiresAt.IsZero() || o.ExpiresAt.After(now) {
+				continue
+			}
+			found = append(found, o)
+		}
+
+		if len(found) > 0 {
+			scores, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+				for _, o := range found {
+					pipe.ZScore(ctx, r.key(pendingOrdersKey), o.ID)
+				}
+				return nil
+			})
+			if err != nil && err != redis.Nil {
+				return fmt.Errorf("failed to read pending orders: %w", err)
+			}
+			for i, cmd := range scores {
+				found[i].Unindexed = cmd.Err() == redis.Nil
+			}
+			stale = append(stale, found...)
+		}
+
+		scanned += int64(len(keys))
+		progress.report("orders", scanned, 0)
+		keys = keys[:0]
+		return nil
+	}
+
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+		if len(keys) >= auditBatchSize {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("failed to scan orders: %w", err)
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(stale, func(i, j int) bool {
+		return stale[i].ExpiresAt.Before(stale[j].ExpiresAt)
+	})
+	return stale, nil
+}
+
+// ExpireStaleOrders puts the stale orders missing from the pending index
+// back into it, then expires every overdue order in the index, restocking
+// each or granting it to the waitlist as the reaper would. Each order is
+// still expired by the expire script, so it is safe to run beside the
+// reaper.
+func (r *RedisStore) ExpireStaleOrders(ctx context.Context, progress ProgressFunc) (StaleSweep, error) {
+	stale, err := r.StaleOrders(ctx, progress)
+	if err != nil {
+		return StaleSweep{}, err
+	}
+
+	var sweep StaleSweep
+	unindexed := make(map[string]bool)
+	var members []redis.Z
+	for _, o := range stale {
+		if o.Unindexed {
+			unindexed[o.ID] = true
+			members = append(members, redis.Z{Score: float64(o.ExpiresAt.Unix()), Member: o.ID})
+		}
+	}
+	if len(members) > 0 {
+		// An order paid since the scan is dropped again by the expire script
+		if err := r.client.ZAddNX(ctx, r.key(pendingOrdersKey), members...).Err(); err != nil {
+			return StaleSweep{}, fmt.Errorf("failed to index pending orders: %w", err)
+		}
+	}
+
+	for {
+		expired, err := r.ExpireOrders(ctx, staleExpireBatch)
+		for _, e := range expired {
+			if unindexed[e.ID] {
+				sweep.Unindexed++
+			}
+		}
+		sweep.Expired = append(sweep.Expired, expired...)
+		if err != nil {
+			return sweep, err
+		}
+		if len(expired) < staleExpireBatch {
+			return sweep, nil
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrInsufficientStock is returned when removing more units than remain
+var ErrInsufficientStock = errors.New("not enough stock left to remove")
+
+// Lua script changing a product's stock without touching its buyers.
+// KEYS[1] is the meta hash, KEYS[2] the events stream and KEYS[3..] the
+// stock key, or every shard key. ARGV[1] is "add" to add ARGV[2] units,
+// which may be negative, or "set" to make ARGV[2] units remain. Shards
+// are evened out as the rebalancer would. initial_stock moves with the
+// stock so the product stays balanced. Any change is recorded as a
+// restock event. Returns {previous, stock}, {-1} for an unknown product,
+// {-2} if the stock would go negative and {-3} once the sale is closed,
+// which freezes its stock.
+var adjustStockScript = newScript(`
+if redis.call("HEXISTS", KEYS[1], "closed_at") == 1 then
+    return {-3}
+end
+local first = 3
+local n = #KEYS - first + 1
+local vals = {}
+local total = 0
+for i = 1, n do
+    local v = redis.call("GET", KEYS[first + i - 1])
+    if not v then
+        return {-1}
+    end
+    vals[i] = tonumber(v)
+    total = total + vals[i]
+end
+
+local want = tonumber(ARGV[2])
+if ARGV[1] == "add" then
+    want = total + want
+end
+if want < 0 then
+    return {-2}
+end
+
+if n == 1 then
+    redis.call("SET", KEYS[first], want)
+else
+    local base = math.floor(want / n)
+    local extra = want % n
+    for i = 1, n do
+        local v = base
+        if i <= extra then
+            v = v + 1
+        end
+        if vals[i] ~= v then
+            redis.call("SET", KEYS[first + i - 1], v)
+        end
+    end
+end
+
+if redis.call("HEXISTS", KEYS[1], "initial_stock") == 1 then
+    redis.call("HINCRBY", KEYS[1], "initial_stock", want - total)
+end
+if want ~= total then
+    redis.call("XADD", KEYS[2], "MAXLEN", "~", ARGV[4], "*",
+        "type", "restock",
+        "product_id", ARGV[3],
+        "delta", want - total,
+        "stock", want,
+        "timestamp", ARGV[5])
+end
+return {total, want}
+`)
+
+// StockChange is the effect of AddStock or SetStock
+type StockChange struct {
+	Previous int64
+	Stock    int64
+}
+
+// AddStock adds delta units to a product mid-sale, or removes them if
+// delta is negative, keeping its buyers and orders. Units allotted to
+// servers are not counted and cannot be removed. Added units go on sale;
+// waitlisted users are not granted them.
+func (r *RedisStore) AddStock(ctx context.Context, productID string, delta int64) (StockChange, error) {
+	return r.adjustStock(ctx, productID, "add", delta)
+}
+
+// SetStock makes stock units of a product remain, like AddStock with the
+// difference
+func (r *RedisStore) SetStock(ctx context.Context, productID string, stock int64) (StockChange, error) {
+	if stock < 0 {
+		return StockChange{}, fmt.Errorf("stock must not be negative, got %d", stock)
+	}
+	return r.adjustStock(ctx, productID, "set", stock)
+}
+
+func (r *RedisStore) adjustStock(ctx context.Context, productID, mode string, value int64) (StockChange, error) {
+	count, err := r.shardCount(ctx, productID)
+	if err != nil {
+		return StockChange{}, err
+	}
+	keys := []string{r.metaKey(productID), r.key(EventsStream)}
+	if count == 0 {
+		keys = append(keys, r.stockKey(productID))
+	} else {
+		keys = append(keys, r.shardStockKeys(productID, count)...)
+	}
+
+	res, err := adjustStockScript.Run(ctx, r.client, keys, mode, value, productID, r.opts.EventsMaxLen, time.Now().Unix()).Int64Slice()
+	if err != nil {
+		return StockChange{}, fmt.Errorf("failed to change stock: %w", err)
+	}
+	switch {
+	case len(res) == 1 && res[0] == -1:
+		return StockChange{}, ErrProductNotFound
+	case len(res) == 1 && res[0] == -2:
+		return StockChange{}, ErrInsufficientStock
+	case len(res) == 1 && res[0] == -3:
+		return StockChange{}, ErrSaleClosed
+	case len(res) != 2:
+		return StockChange{}, fmt.Errorf("invalid lua response")
+	}
+
+	change := StockChange{Previous: res[0], Stock: res[1]}
+	r.shards.Delete(productID)
+	if change.Stock > change.Previous {
+		r.announceRestock(ctx, productID)
+	}
+	return change, nil
+}
@@ -0,0 +1,164 @@
+// Package store defines the persistence backend behind the flash sale
+// purchase path. The protocol layer only talks to the Store interface, so
+// backends other than Redis can be added without touching it.
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrProductNotFound is returned when a product has never been initialized
+var ErrProductNotFound = errors.New("product not found")
+
+// ErrNotDurable is returned by AttemptPurchase when stock was taken but the
+// backend could not confirm the purchase record reached durable storage.
+// The purchase must not be reported as successful.
+var ErrNotDurable = errors.New("purchase not confirmed durable")
+
+// Progress reports how far a long-running operation has got. Total is 0
+// when the amount of work is not known up front.
+type Progress struct {
+	Stage string
+	Done  int64
+	Total int64
+}
+
+// ProgressFunc receives progress updates; it may be nil
+type ProgressFunc func(Progress)
+
+func (f ProgressFunc) report(stage string, done, total int64) {
+	if f != nil {
+		f(Progress{Stage: stage, Done: done, Total: total})
+	}
+}
+
+// PurchaseResult is the outcome of a single purchase attempt
+type PurchaseResult struct {
+	// Success is false when the product is sold out
+	Success bool
+	// Remaining is the stock left after a successful purchase
+	Remaining int64
+	// Recorded is true when the backend durably recorded the purchase
+	// event as part of the purchase itself
+	Recorded bool
+	// OrderID identifies the order created by a successful purchase
+	OrderID string
+	// PaymentDeadline is set when the order is PENDING and must be
+	// confirmed before then
+	PaymentDeadline time.Time
+	// Queued is set instead of Success for products in queue mode: the
+	// attempt waits at QueuePosition as ticket OrderID
+	Queued        bool
+	QueuePosition int64
+	// WaitlistPosition is set on a sold out result when the user waits for
+	// a unit to be freed, 1 being next
+	WaitlistPosition int64
+}
+
+// OrderStatus is the status of the order a successful purchase created
+func (p PurchaseResult) OrderStatus() string {
+	if p.PaymentDeadline.IsZero() {
+		return OrderConfirmed
+	}
+	return OrderPending
+}
+
+// Store is an inventory backend. Implementations must make AttemptPurchase
+// atomic: concurrent callers may never take more units than were stocked.
+type Store interface {
+	// AttemptPurchase takes one unit of stock for userID, records them as
+	// a buyer and creates an order, or reports a sold out product
+	AttemptPurchase(ctx context.Context, productID, userID string) (PurchaseResult, error)
+
+	// GetStock returns the remaining stock of a product
+	GetStock(ctx context.Context, productID string) (int64, error)
+
+	// Buyers returns the user IDs of all successful purchases
+	Buyers(ctx context.Context, productID string) ([]string, error)
+
+	// BuyerCount returns the number of successful purchases
+	BuyerCount(ctx context.Context, productID string) (int64, error)
+
+	// InitProduct sets a product's stock and clears its buyers
+	InitProduct(ctx context.Context, productID string, stock int64) error
+
+	// ResetProduct deletes all data for a product
+	ResetProduct(ctx context.Context, productID string) error
+
+	// ListProducts returns the IDs of all initialized products
+	ListProducts(ctx context.Context) ([]string, error)
+
+	// ProductInfo returns stock, buyers and metadata for a product
+	ProductInfo(ctx context.Context, productID string) (ProductInfo, error)
+
+	// ListProductInfo returns ProductInfo for every product
+	ListProductInfo(ctx context.Context) ([]ProductInfo, error)
+
+	// GetOrder returns an order created by AttemptPurchase
+	GetOrder(ctx context.Context, orderID string) (Order, error)
+
+	// ConfirmPayment moves a PENDING order of userID to CONFIRMED
+	ConfirmPayment(ctx context.Context, orderID, userID string) (Order, error)
+
+	// ExpireOrders expires up to limit PENDING orders whose deadline has
+	// passed, restoring their stock or granting it to waitlisted users, and
+	// returns them
+	ExpireOrders(ctx context.Context, limit int) ([]ExpiredOrder, error)
+
+	// CancelPurchase cancels userID's order and restores its stock or
+	// grants it to a waitlisted user
+	CancelPurchase(ctx context.Context, productID, userID, orderID string) (CancelResult, error)
+}
+
+// HealthChecker is implemented by stores that can tell whether they are
+// able to serve purchases
+type HealthChecker interface {
+	// CheckHealth returns an error if purchases would fail right now
+	CheckHealth(ctx context.Context) error
+}
+
+var _ HealthChecker = (*RedisStore)(nil)
+
+// AgentPurchaser is implemented by stores that record purchases made by
+// an agent on behalf of a user
+type AgentPurchaser interface {
+	AttemptAgentPurchase(ctx context.Context, productID, userID, agentID string) (PurchaseResult, error)
+}
+
+var _ AgentPurchaser = (*RedisStore)(nil)
+
+// CachePrimer is implemented by stores that keep local per-product caches
+// which can be filled ahead of traffic
+type CachePrimer interface {
+	// PrimeCaches fills the caches for infos, as listed by ListProductInfo
+	PrimeCaches(ctx context.Context, infos []ProductInfo) error
+}
+
+var _ CachePrimer = (*RedisStore)(nil)
+
+// ProductAdmin is implemented by stores whose products can be managed
+// while a sale runs
+type ProductAdmin interface {
+	// InitShardedProduct is InitProduct spreading stock over shards
+	InitShardedProduct(ctx context.Context, productID string, stock int64, shards int) error
+
+	// SetSaleWindow sets when a product's sale starts and ends
+	SetSaleWindow(ctx context.Context, productID string, start, end time.Time) error
+
+	// AddStock adds or removes units, keeping buyers and orders
+	AddStock(ctx context.Context, productID string, delta int64) (StockChange, error)
+
+	// SetStock sets the remaining units, keeping buyers and orders
+	SetStock(ctx context.Context, productID string, stock int64) (StockChange, error)
+
+	// SetPaused pauses or resumes a product's sale
+	SetPaused(ctx context.Context, productID string, paused bool) error
+
+	// BuyerPage returns a page of buyers, oldest first, the offset of the
+	// next page, -1 after the last one, and the total
+	BuyerPage(ctx context.Context, productID string, offset, limit int64) ([]BuyerRecord, int64, int64, error)
+}
+
+var _ ProductAdmin = (*RedisStore)(nil)
@@ -0,0 +1,34 @@
+package store
+
+import "regexp"
+
+// tenantRE matches a tenant ID. The Lua scripts find the prefix of a key
+// by this shape, so it must never hold a colon.
+var tenantRE = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+// ValidTenant reports whether id can name a tenant: up to 64 lowercase
+// letters, digits, dashes and underscores, starting with a letter or digit
+func ValidTenant(id string) bool {
+	return tenantRE.MatchString(id)
+}
+
+// TenantPrefix is what every key, stream and channel of a tenant starts
+// with, "tenant:<id>:", or "" for none. Unprefixed keys never start with
+// "tenant:", so no tenant shares a key with the others or with a server
+// without tenants.
+func TenantPrefix(tenant string) string {
+	if tenant == "" {
+		return ""
+	}
+	return "tenant:" + tenant + ":"
+}
+
+// key is name in the store's tenant
+func (r *RedisStore) key(name string) string {
+	return r.prefix + name
+}
+
+// Tenant is the tenant the store keeps its keys under, "" for none
+func (r *RedisStore) Tenant() string {
+	return r.opts.Tenant
+}
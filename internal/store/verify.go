@@ -0,0 +1,134 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"sort"
+)
+
+// Verifier is implemented by stores that can check the stock invariants of
+// a product
+type Verifier interface {
+	VerifyProduct(ctx context.Context, productID string, progress ProgressFunc) (Verification, error)
+}
+
+var _ Verifier = (*RedisStore)(nil)
+
+// Verification checks, the names reported in Discrepancy.Check
+const (
+	CheckNegativeStock = "negative_stock"
+	CheckStock         = "stock"
+	CheckCounters      = "counters"
+	CheckDuplicates    = "duplicate_buyers"
+	CheckOrders        = "orders"
+)
+
+// Discrepancy is one invariant a product breaks
+type Discrepancy struct {
+	Check  string
+	Detail string
+}
+
+// Verification is the result of VerifyProduct. BuyerUnits is what the
+// buyers lists say buyers hold and OpenOrders what the order records say,
+// counting the orders that hold a unit.
+type Verification struct {
+	Info        ProductInfo
+	ShardStocks []int64
+	BuyerUnits  int64
+	OpenOrders  int64
+	// OverLimit are users holding more units than the product allows, one
+	// or its per-user limit, with the units they hold
+	OverLimit     map[string]int64
+	Discrepancies []Discrepancy
+}
+
+// OK reports whether the product holds every invariant
+func (v Verification) OK() bool {
+	return len(v.Discrepancies) == 0
+}
+
+// VerifyProduct checks that no stock key is negative, that the initial
+// stock less what remains, in Redis or allotted to servers, is what buyers
+// hold, that the sold and returned counters agree, that no user holds more
+// than the product allows, and that every unit held has an open order.
+// Orders are found with SCAN, so this is slow on a large Redis, and
+// purchases in flight make the reads disagree: only a product with no
+// sale running verifies reliably.
+func (r *RedisStore) VerifyProduct(ctx context.Context, productID string, progress ProgressFunc) (Verification, error) {
+	info, err := r.ProductInfo(ctx, productID)
+	if err != nil {
+		return Verification{}, err
+	}
+	v := Verification{Info: info, OverLimit: make(map[string]int64)}
+	report := func(check, format string, args ...interface{}) {
+		v.Discrepancies = append(v.Discrepancies, Discrepancy{Check: check, Detail: fmt.Sprintf(format, args...)})
+	}
+
+	v.ShardStocks, err = r.ShardStocks(ctx, productID)
+	if err != nil {
+		return Verification{}, err
+	}
+	for i, s := range v.ShardStocks {
+		if s < 0 {
+			report(CheckNegativeStock, "shard %d stock is %d", i, s)
+		}
+	}
+	if v.ShardStocks == nil && info.Stock < 0 {
+		report(CheckNegativeStock, "stock is %d", info.Stock)
+	}
+
+	records, err := r.BuyerRecords(ctx, productID)
+	if err != nil {
+		return Verification{}, err
+	}
+	units := make(map[string]int64)
+	for _, b := range records {
+		q := max(b.Quantity, 1)
+		units[b.UserID] += q
+		v.BuyerUnits += q
+	}
+	progress.report("buyers", int64(len(records)), int64(len(records)))
+
+	allowed := max(info.UserLimit, 1)
+	for user, n := range units {
+		if n > allowed {
+			v.OverLimit[user] = n
+		}
+	}
+	if len(v.OverLimit) > 0 {
+		users := make([]string, 0, len(v.OverLimit))
+		for user := range v.OverLimit {
+			users = append(users, user)
+		}
+		sort.Strings(users)
+		for _, user := range users {
+			report(CheckDuplicates, "user %s holds %d units, at most %d allowed", user, v.OverLimit[user], allowed)
+		}
+	}
+
+	if info.InitialStock > 0 || info.Tracked {
+		if left := info.InitialStock - info.Stock - info.Allotted; left != v.BuyerUnits {
+			report(CheckStock, "initial stock %d - remaining %d - allotted %d = %d, but buyers hold %d units",
+				info.InitialStock, info.Stock, info.Allotted, left, v.BuyerUnits)
+		}
+	}
+	if info.Tracked && info.NetSold() != v.BuyerUnits {
+		report(CheckCounters, "sold %d - returned %d = %d, but buyers hold %d units",
+			info.Sold, info.Returned, info.NetSold(), v.BuyerUnits)
+	}
+
+	orders, err := r.productOrders(ctx, productID, progress)
+	if err != nil {
+		return Verification{}, err
+	}
+	for _, o := range orders {
+		if OrderHoldsUnit(o.Status) {
+			v.OpenOrders += max(o.Quantity, 1)
+		}
+	}
+	if v.OpenOrders != v.BuyerUnits {
+		report(CheckOrders, "%d units in open orders, but buyers hold %d units", v.OpenOrders, v.BuyerUnits)
+	}
+	return v, nil
+}
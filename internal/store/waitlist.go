@@ -0,0 +1,145 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Lua script adding a user to a product's waitlist unless it is full. The
+// product must exist (KEYS[3] is its stock or shards key). Users are
+// scored by a per-product sequence rather than the clock, so servers with
+// skewed clocks still keep arrival order. Returns the user's position, or
+// 0 if the waitlist is full.
+var joinWaitlistScript = newScript(`
+local rank = redis.call("ZRANK", KEYS[1], ARGV[1])
+if rank then
+    return rank + 1
+end
+if redis.call("EXISTS", KEYS[3]) == 0 then
+    return 0
+end
+if redis.call("ZCARD", KEYS[1]) >= tonumber(ARGV[2]) then
+    return 0
+end
+local seq = redis.call("HINCRBY", KEYS[2], "waitlist_seq", 1)
+redis.call("ZADD", KEYS[1], seq, ARGV[1])
+return redis.call("ZCARD", KEYS[1])
+`)
+
+// WaitlistGrant is an order created for the next waitlisted user from the
+// unit of an order that expired or was cancelled
+type WaitlistGrant struct {
+	Order Order
+	// Remaining is the stock left after the grant
+	Remaining int64
+	// Recorded is true when the grant's purchase event is already in the
+	// events stream
+	Recorded bool
+}
+
+// ExpiredOrder is an order expired by ExpireOrders. Grant is set when its
+// unit went to a waitlisted user instead of back on sale.
+type ExpiredOrder struct {
+	Order
+	Grant *WaitlistGrant
+}
+
+// CancelResult is the outcome of CancelPurchase
+type CancelResult struct {
+	// Remaining is the product's stock after the cancellation
+	Remaining int64
+	// Previous is the status the order had
+	Previous string
+	// Grant is set when the unit went to a waitlisted user instead of back
+	// on sale
+	Grant *WaitlistGrant
+}
+
+// waitlistKey is a sorted set of the users waiting for a sold out product,
+// scored by arrival
+func (r *RedisStore) waitlistKey(productID string) string {
+	return r.key(fmt.Sprintf("product:%s:waitlist", productID))
+}
+
+// joinWaitlist adds the user to the product's waitlist and returns their
+// position, 0 if it is full or disabled
+func (r *RedisStore) joinWaitlist(ctx context.Context, productID, userID string, sharded bool) (int64, error) {
+	if r.opts.WaitlistSize <= 0 {
+		return 0, nil
+	}
+	exists := r.stockKey(productID)
+	if sharded {
+		exists = r.shardsKey(productID)
+	}
+
+	ctx, cancel := r.callContext(ctx)
+	defer cancel()
+	pos, err := joinWaitlistScript.Run(ctx, r.client,
+		[]string{r.waitlistKey(productID), r.metaKey(productID), exists},
+		userID, r.opts.WaitlistSize,
+	).Int64()
+	if err != nil {
+		return 0, fmt.Errorf("failed to join waitlist: %w", err)
+	}
+	return pos, nil
+}
+
+// waitlistHead returns the next waitlisted user of a product, "" if none
+func (r *RedisStore) waitlistHead(ctx context.Context, productID string) (string, error) {
+	if r.opts.WaitlistSize <= 0 {
+		return "", nil
+	}
+	head, err := r.client.ZRange(ctx, r.waitlistKey(productID), 0, 0).Result()
+	if err != nil {
+		return "", fmt.Errorf("failed to read waitlist: %w", err)
+	}
+	if len(head) == 0 {
+		return "", nil
+	}
+	return head[0], nil
+}
+
+// grantArgs returns the keys and arguments a restocking script needs to
+// hand the unit to user as a new order, appended to its own. With no user
+// waiting the keys are placeholders the script never touches.
+func (r *RedisStore) grantArgs(productID, user string) (keys []string, args []interface{}, orderID string) {
+	if user != "" {
+		orderID = strconv.FormatInt(r.opts.OrderIDs.Next(), 10)
+	}
+	keys = []string{r.waitlistKey(productID), r.orderKey(orderID), r.userOrdersKey(user), r.strictKey(productID), r.key(EventsStream),
+		r.userUnitsKey(productID)}
+	args = []interface{}{user, orderID, int64(r.opts.PaymentTTL.Seconds()), r.opts.ValueCodec.Name(), r.opts.EventsMaxLen}
+	return keys, args, orderID
+}
+
+// waitlistGrant builds the grant a restocking script reported
+func (r *RedisStore) waitlistGrant(productID, user, orderID string, now time.Time, remaining, recorded int64) *WaitlistGrant {
+	g := &WaitlistGrant{
+		Order: Order{
+			ID:        orderID,
+			ProductID: productID,
+			UserID:    user,
+			Quantity:  1,
+			Status:    OrderConfirmed,
+			CreatedAt: time.Unix(now.Unix(), 0),
+		},
+		Remaining: remaining,
+		Recorded:  recorded == 1,
+	}
+	if r.opts.PaymentTTL > 0 {
+		g.Order.Status = OrderPending
+		g.Order.ExpiresAt = g.Order.CreatedAt.Add(r.opts.PaymentTTL.Truncate(time.Second))
+	}
+	return g
+}
+
+// WaitlistLength returns how many users wait for a product
+func (r *RedisStore) WaitlistLength(ctx context.Context, productID string) (int64, error) {
+	n, err := r.client.ZCard(ctx, r.waitlistKey(productID)).Result()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read waitlist: %w", err)
+	}
+	return n, nil
+}
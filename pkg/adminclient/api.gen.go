@@ -0,0 +1,358 @@
+// Code generated by internal/gen from openapi.yaml; DO NOT EDIT.
+
+package adminclient
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// Error is the body of every error response
+type Error struct {
+	Error string `json:"error"`
+}
+
+// Product is a product's status
+type Product struct {
+	ProductID    string `json:"product_id"`
+	Stock        int64  `json:"stock"`
+	Buyers       int64  `json:"buyers"`
+	InitialStock int64  `json:"initial_stock,omitempty"`
+	Sold         int64  `json:"sold"`
+	Returned     int64  `json:"returned"`
+	// ACTIVE, PAUSED, SOLD_OUT, SCHEDULED or ENDED
+	State string `json:"state"`
+	// Unix seconds
+	SaleStart int64 `json:"sale_start,omitempty"`
+	// Unix seconds
+	SaleEnd int64 `json:"sale_end,omitempty"`
+	Shards  int   `json:"shards,omitempty"`
+	Strict  bool  `json:"strict,omitempty"`
+	Paused  bool  `json:"paused,omitempty"`
+	// the units each user can hold, absent for no cap
+	PerUserLimit int64 `json:"per_user_limit,omitempty"`
+	// the sale event in which each user can buy one unit across all its products, absent for none
+	SaleEvent string `json:"sale_event,omitempty"`
+	// Unix seconds the ended sale was closed at, absent while it is not closed
+	ClosedAt int64 `json:"closed_at,omitempty"`
+	// the stock left unsold when the sale closed
+	ClosedStock int64 `json:"closed_stock,omitempty"`
+}
+
+// ProductList is the body of ListProducts
+type ProductList struct {
+	Products []Product `json:"products"`
+}
+
+// CreateProductRequest is the body of CreateProduct
+type CreateProductRequest struct {
+	ProductID string `json:"product_id"`
+	Stock     int64  `json:"stock"`
+	// 0 for one stock key, or 2 to 256
+	Shards int `json:"shards,omitempty"`
+	// Unix seconds, 0 for an open start
+	SaleStart int64 `json:"sale_start,omitempty"`
+	// Unix seconds, 0 for an open end
+	SaleEnd int64 `json:"sale_end,omitempty"`
+}
+
+// StockRequest is the body of ChangeStock. Exactly one of stock and add is set.
+type StockRequest struct {
+	// Units that should remain
+	Stock *int64 `json:"stock,omitempty"`
+	// Units to add, or remove if negative
+	Add *int64 `json:"add,omitempty"`
+}
+
+// StockChange is the stock of a product before and after ChangeStock
+type StockChange struct {
+	ProductID string `json:"product_id"`
+	Previous  int64  `json:"previous"`
+	Stock     int64  `json:"stock"`
+}
+
+// Buyer is one successful purchase
+type Buyer struct {
+	UserID   string `json:"user_id"`
+	OrderID  string `json:"order_id,omitempty"`
+	Quantity int64  `json:"quantity,omitempty"`
+	// Unix seconds
+	CreatedAt int64 `json:"created_at,omitempty"`
+}
+
+// BuyerPage is one page of ListBuyers
+type BuyerPage struct {
+	Buyers []Buyer `json:"buyers"`
+	// Omitted on the last page
+	NextCursor string `json:"next_cursor,omitempty"`
+	Total      int64  `json:"total"`
+}
+
+// DrainStatus is whether the server is draining and how many connections are left
+type DrainStatus struct {
+	Draining    bool   `json:"draining"`
+	Connections int    `json:"connections"`
+	StartedAt   int64  `json:"started_at"`
+	Version     string `json:"version"`
+}
+
+// ReloadResult is the body of Reload
+type ReloadResult struct {
+	// Env keys of the settings that changed
+	Changed []string `json:"changed"`
+}
+
+// Instance is one server's record in the instance registry
+type Instance struct {
+	ID        string `json:"id"`
+	Host      string `json:"host"`
+	Addr      string `json:"addr"`
+	AdminAddr string `json:"admin_addr"`
+	Version   string `json:"version"`
+	Started   int64  `json:"started"`
+	Nonce     string `json:"nonce"`
+	Heartbeat int64  `json:"heartbeat"`
+	Leader    bool   `json:"leader"`
+}
+
+// InstanceList is the body of ListInstances
+type InstanceList struct {
+	Instances []Instance `json:"instances"`
+}
+
+// ReadOnlyStatus is whether the server is read only and why. Manual is set by SetReadOnly, automatic when Redis refused a write.
+type ReadOnlyStatus struct {
+	ReadOnly  bool   `json:"read_only"`
+	Manual    bool   `json:"manual"`
+	Automatic bool   `json:"automatic"`
+	Since     int64  `json:"since,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+	Replica   bool   `json:"replica"`
+}
+
+// AdminOrder is an order as the admin API shows it
+type AdminOrder struct {
+	OrderID   string `json:"order_id"`
+	ProductID string `json:"product_id"`
+	UserID    string `json:"user_id"`
+	AgentID   string `json:"agent_id,omitempty"`
+	// PENDING, CONFIRMED, HELD, REJECTED or FULFILLED
+	Status string `json:"status"`
+	// The status the order returns to once approved
+	HeldFrom string `json:"held_from,omitempty"`
+	// Why the order was held, such as speed_flagged
+	Reason string `json:"reason,omitempty"`
+	// Unix seconds
+	CreatedAt int64 `json:"created_at"`
+	// Unix seconds
+	HeldAt int64 `json:"held_at,omitempty"`
+	// Unix seconds, set on a PENDING order
+	PaymentDeadline int64 `json:"payment_deadline,omitempty"`
+	// Unix seconds, set on a FULFILLED order
+	FulfilledAt int64 `json:"fulfilled_at,omitempty"`
+	// The product's stock after a rejection
+	RemainingStock *int64 `json:"remaining_stock,omitempty"`
+}
+
+// HeldOrderList is the body of ListHeldOrders
+type HeldOrderList struct {
+	Orders []AdminOrder `json:"orders"`
+}
+
+// ListProducts lists every product, as `setup status --all`
+func (c *Client) ListProducts(ctx context.Context) (*ProductList, error) {
+	var out ProductList
+	if err := c.do(ctx, http.MethodGet, "/admin/products", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// CreateProduct creates a product, failing with 409 if it exists
+func (c *Client) CreateProduct(ctx context.Context, body CreateProductRequest) (*Product, error) {
+	var out Product
+	if err := c.do(ctx, http.MethodPost, "/admin/products", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetProduct returns one product's status
+func (c *Client) GetProduct(ctx context.Context, id string) (*Product, error) {
+	var out Product
+	if err := c.do(ctx, http.MethodGet, "/admin/products/"+url.PathEscape(id), nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// ChangeStock sets or adds to a product's stock, keeping its buyers, failing with 409 once its sale closed
+func (c *Client) ChangeStock(ctx context.Context, id string, body StockRequest) (*StockChange, error) {
+	var out StockChange
+	if err := c.do(ctx, http.MethodPost, "/admin/products/"+url.PathEscape(id)+"/stock", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// PauseSale pauses a product's sale
+func (c *Client) PauseSale(ctx context.Context, id string) (*Product, error) {
+	var out Product
+	if err := c.do(ctx, http.MethodPost, "/admin/products/"+url.PathEscape(id)+"/pause", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// ResumeSale resumes a paused sale
+func (c *Client) ResumeSale(ctx context.Context, id string) (*Product, error) {
+	var out Product
+	if err := c.do(ctx, http.MethodDelete, "/admin/products/"+url.PathEscape(id)+"/pause", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// ListBuyersParams are the query parameters of ListBuyers
+type ListBuyersParams struct {
+	// next_cursor of the previous page
+	Cursor string
+	// Page size, 100 by default and at most 1000
+	Limit int
+}
+
+// ListBuyers returns a page of a product's buyers, oldest first
+func (c *Client) ListBuyers(ctx context.Context, id string, params ListBuyersParams) (*BuyerPage, error) {
+	query := url.Values{}
+	if params.Cursor != "" {
+		query.Set("cursor", params.Cursor)
+	}
+	if params.Limit != 0 {
+		query.Set("limit", strconv.Itoa(params.Limit))
+	}
+	var out BuyerPage
+	if err := c.do(ctx, http.MethodGet, "/admin/products/"+url.PathEscape(id)+"/buyers", query, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetDrain reports whether the server is draining
+func (c *Client) GetDrain(ctx context.Context) (*DrainStatus, error) {
+	var out DrainStatus
+	if err := c.do(ctx, http.MethodGet, "/admin/drain", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// StartDrain starts draining connections ahead of a restart
+func (c *Client) StartDrain(ctx context.Context) (*DrainStatus, error) {
+	var out DrainStatus
+	if err := c.do(ctx, http.MethodPost, "/admin/drain", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// CancelDrain admits connections again
+func (c *Client) CancelDrain(ctx context.Context) (*DrainStatus, error) {
+	var out DrainStatus
+	if err := c.do(ctx, http.MethodDelete, "/admin/drain", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// Reload reloads the configuration, the same as SIGHUP
+func (c *Client) Reload(ctx context.Context) (*ReloadResult, error) {
+	var out ReloadResult
+	if err := c.do(ctx, http.MethodPost, "/admin/reload", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// ListInstances lists the live instances and which one leads
+func (c *Client) ListInstances(ctx context.Context) (*InstanceList, error) {
+	var out InstanceList
+	if err := c.do(ctx, http.MethodGet, "/admin/cluster", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetReadOnly reports whether the server is read only and why
+func (c *Client) GetReadOnly(ctx context.Context) (*ReadOnlyStatus, error) {
+	var out ReadOnlyStatus
+	if err := c.do(ctx, http.MethodGet, "/admin/readonly", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// SetReadOnly makes the server read only until ClearReadOnly
+func (c *Client) SetReadOnly(ctx context.Context) (*ReadOnlyStatus, error) {
+	var out ReadOnlyStatus
+	if err := c.do(ctx, http.MethodPost, "/admin/readonly", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// ClearReadOnly clears manual and automatic read only mode
+func (c *Client) ClearReadOnly(ctx context.Context) (*ReadOnlyStatus, error) {
+	var out ReadOnlyStatus
+	if err := c.do(ctx, http.MethodDelete, "/admin/readonly", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// ListHeldOrdersParams are the query parameters of ListHeldOrders
+type ListHeldOrdersParams struct {
+	// Page size, 100 by default and at most 1000
+	Limit int
+}
+
+// ListHeldOrders lists the orders held for review, held longest first
+func (c *Client) ListHeldOrders(ctx context.Context, params ListHeldOrdersParams) (*HeldOrderList, error) {
+	query := url.Values{}
+	if params.Limit != 0 {
+		query.Set("limit", strconv.Itoa(params.Limit))
+	}
+	var out HeldOrderList
+	if err := c.do(ctx, http.MethodGet, "/admin/holds", query, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// ApproveOrder returns a held order to the status it was held from
+func (c *Client) ApproveOrder(ctx context.Context, id string) (*AdminOrder, error) {
+	var out AdminOrder
+	if err := c.do(ctx, http.MethodPost, "/admin/holds/"+url.PathEscape(id)+"/approve", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// RejectOrder rejects a held order and returns its unit to stock
+func (c *Client) RejectOrder(ctx context.Context, id string) (*AdminOrder, error) {
+	var out AdminOrder
+	if err := c.do(ctx, http.MethodPost, "/admin/holds/"+url.PathEscape(id)+"/reject", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// FulfillOrder marks a CONFIRMED order FULFILLED, succeeding again if it already is
+func (c *Client) FulfillOrder(ctx context.Context, id string) (*AdminOrder, error) {
+	var out AdminOrder
+	if err := c.do(ctx, http.MethodPost, "/admin/orders/"+url.PathEscape(id)+"/fulfill", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
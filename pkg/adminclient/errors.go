@@ -0,0 +1,70 @@
+package adminclient
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// Sentinels an *APIError matches with errors.Is, by status code
+var (
+	// ErrInvalidRequest is a request the server refused as malformed
+	ErrInvalidRequest = errors.New("invalid request")
+	// ErrUnauthorized is a missing or wrong token, or a server without
+	// ADMIN_TOKEN
+	ErrUnauthorized = errors.New("unauthorized")
+	// ErrNotFound is an unknown product, or a disabled feature such as
+	// cluster coordination
+	ErrNotFound = errors.New("not found")
+	// ErrConflict is a product that already exists, a stock change
+	// removing more units than remain, or an order whose status does not
+	// allow the change
+	ErrConflict = errors.New("conflict")
+	// ErrNotSupported is an operation the server's store does not support
+	ErrNotSupported = errors.New("not supported")
+	// ErrUnavailable is a change refused while the server is read only
+	ErrUnavailable = errors.New("unavailable")
+)
+
+var statusErrors = map[int]error{
+	http.StatusBadRequest:         ErrInvalidRequest,
+	http.StatusUnauthorized:       ErrUnauthorized,
+	http.StatusNotFound:           ErrNotFound,
+	http.StatusConflict:           ErrConflict,
+	http.StatusNotImplemented:     ErrNotSupported,
+	http.StatusServiceUnavailable: ErrUnavailable,
+}
+
+// APIError is a non-2xx response
+type APIError struct {
+	Method     string
+	Path       string
+	StatusCode int
+	// Message is the error the server gave, if any
+	Message string
+}
+
+func (e *APIError) Error() string {
+	msg := e.Message
+	if msg == "" {
+		msg = http.StatusText(e.StatusCode)
+	}
+	return fmt.Sprintf("%s %s: %d %s", e.Method, e.Path, e.StatusCode, msg)
+}
+
+// Unwrap returns the sentinel of the status code, if it has one
+func (e *APIError) Unwrap() error {
+	return statusErrors[e.StatusCode]
+}
+
+func newAPIError(method, path string, resp *http.Response) *APIError {
+	e := &APIError{Method: method, Path: path, StatusCode: resp.StatusCode}
+	var body Error
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if json.Unmarshal(data, &body) == nil {
+		e.Message = body.Error
+	}
+	return e
+}
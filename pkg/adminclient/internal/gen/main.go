@@ -0,0 +1,345 @@
+// Command gen writes the types and methods of package adminclient from
+// openapi.yaml. It understands the subset of OpenAPI the admin API uses:
+// object schemas of scalars, arrays and references, path and query
+// parameters, and JSON request and response bodies.
+//
+// Usage: go run ./internal/gen <spec> <output>
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+type spec struct {
+	Paths      yaml.Node `yaml:"paths"`
+	Components struct {
+		Parameters map[string]parameter `yaml:"parameters"`
+		Schemas    yaml.Node            `yaml:"schemas"`
+	} `yaml:"components"`
+}
+
+type schema struct {
+	Ref         string    `yaml:"$ref"`
+	Type        string    `yaml:"type"`
+	Format      string    `yaml:"format"`
+	Description string    `yaml:"description"`
+	Nullable    bool      `yaml:"nullable"`
+	Required    []string  `yaml:"required"`
+	Properties  yaml.Node `yaml:"properties"`
+	Items       *schema   `yaml:"items"`
+}
+
+type parameter struct {
+	Ref         string `yaml:"$ref"`
+	Name        string `yaml:"name"`
+	In          string `yaml:"in"`
+	Description string `yaml:"description"`
+	Schema      schema `yaml:"schema"`
+}
+
+type content struct {
+	Content map[string]struct {
+		Schema schema `yaml:"schema"`
+	} `yaml:"content"`
+}
+
+type operation struct {
+	OperationID string             `yaml:"operationId"`
+	Summary     string             `yaml:"summary"`
+	Parameters  []parameter        `yaml:"parameters"`
+	RequestBody *content           `yaml:"requestBody"`
+	Responses   map[string]content `yaml:"responses"`
+}
+
+func main() {
+	if len(os.Args) != 3 {
+		log.Fatalf("Usage: gen <spec> <output>")
+	}
+	data, err := os.ReadFile(os.Args[1])
+	if err != nil {
+		log.Fatalf("Failed to read spec: %v", err)
+	}
+	var s spec
+	if err := yaml.Unmarshal(data, &s); err != nil {
+		log.Fatalf("Failed to parse spec: %v", err)
+	}
+
+	g := &generator{spec: &s, imports: map[string]bool{}}
+
+	for _, kv := range pairs(&s.Components.Schemas) {
+		var sc schema
+		if err := kv.value.Decode(&sc); err != nil {
+			log.Fatalf("Invalid schema %s: %v", kv.key, err)
+		}
+		g.schema(kv.key, sc)
+	}
+	for _, kv := range pairs(&s.Paths) {
+		for _, op := range pairs(kv.value) {
+			var o operation
+			if err := op.value.Decode(&o); err != nil {
+				log.Fatalf("Invalid operation %s %s: %v", op.key, kv.key, err)
+			}
+			g.operation(kv.key, strings.ToUpper(op.key), o)
+		}
+	}
+
+	var src bytes.Buffer
+	fmt.Fprintf(&src, "// Code generated by internal/gen from %s; DO NOT EDIT.\n\n", os.Args[1])
+	fmt.Fprintf(&src, "package adminclient\n\nimport (\n")
+	imports := make([]string, 0, len(g.imports))
+	for imp := range g.imports {
+		imports = append(imports, imp)
+	}
+	sort.Strings(imports)
+	for _, imp := range imports {
+		fmt.Fprintf(&src, "%q\n", imp)
+	}
+	fmt.Fprintf(&src, ")\n\n")
+	g.buf.WriteTo(&src)
+
+	out, err := format.Source(src.Bytes())
+	if err != nil {
+		log.Fatalf("Generated invalid code: %v\n%s", err, src.Bytes())
+	}
+	if err := os.WriteFile(os.Args[2], out, 0o644); err != nil {
+		log.Fatalf("Failed to write %s: %v", os.Args[2], err)
+	}
+}
+
+type generator struct {
+	spec *spec
+	buf  bytes.Buffer
+	// imports are the packages the generated code uses
+	imports map[string]bool
+}
+
+func (g *generator) printf(format string, args ...interface{}) {
+	fmt.Fprintf(&g.buf, format, args...)
+}
+
+func (g *generator) comment(text string) {
+	if text == "" {
+		return
+	}
+	for _, line := range strings.Split(strings.TrimSpace(text), "\n") {
+		g.printf("// %s\n", line)
+	}
+}
+
+// schema writes an object schema as a struct. Properties outside required
+// are omitted when empty and nullable ones are pointers.
+func (g *generator) schema(name string, sc schema) {
+	if sc.Type != "object" {
+		log.Fatalf("Schema %s is not an object", name)
+	}
+	if sc.Description != "" {
+		g.comment(name + " is " + sc.Description)
+	} else {
+		g.printf("// %s is the %s schema\n", name, name)
+	}
+	required := map[string]bool{}
+	for _, r := range sc.Required {
+		required[r] = true
+	}
+
+	g.printf("type %s struct {\n", name)
+	for _, kv := range pairs(&sc.Properties) {
+		var prop schema
+		if err := kv.value.Decode(&prop); err != nil {
+			log.Fatalf("Invalid property %s.%s: %v", name, kv.key, err)
+		}
+		typ := goType(prop)
+		if prop.Nullable {
+			typ = "*" + typ
+		}
+		tag := kv.key
+		if !required[kv.key] {
+			tag += ",omitempty"
+		}
+		g.comment(prop.Description)
+		g.printf("%s %s `json:%q`\n", exported(kv.key), typ, tag)
+	}
+	g.printf("}\n\n")
+}
+
+// operation writes a Client method calling one operation
+func (g *generator) operation(path, method string, op operation) {
+	name := op.OperationID
+	g.imports["context"] = true
+	g.imports["net/http"] = true
+	var pathParams, queryParams []parameter
+	for _, p := range op.Parameters {
+		if p.Ref != "" {
+			p = g.spec.Components.Parameters[refName(p.Ref)]
+		}
+		switch p.In {
+		case "path":
+			pathParams = append(pathParams, p)
+		case "query":
+			queryParams = append(queryParams, p)
+		default:
+			log.Fatalf("Unsupported %s parameter %s of %s", p.In, p.Name, name)
+		}
+	}
+
+	args := []string{"ctx context.Context"}
+	for _, p := range pathParams {
+		args = append(args, p.Name+" "+goType(p.Schema))
+	}
+	if len(queryParams) > 0 {
+		g.printf("// %sParams are the query parameters of %s\n", name, name)
+		g.printf("type %sParams struct {\n", name)
+		for _, p := range queryParams {
+			g.comment(p.Description)
+			g.printf("%s %s\n", exported(p.Name), goType(p.Schema))
+		}
+		g.printf("}\n\n")
+		args = append(args, "params "+name+"Params")
+	}
+	body := "nil"
+	if op.RequestBody != nil {
+		args = append(args, "body "+refName(jsonSchema(*op.RequestBody, name).Ref))
+		body = "body"
+	}
+
+	var result string
+	codes := make([]string, 0, len(op.Responses))
+	for code := range op.Responses {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	for _, code := range codes {
+		if strings.HasPrefix(code, "2") && len(op.Responses[code].Content) > 0 {
+			result = refName(jsonSchema(op.Responses[code], name).Ref)
+			break
+		}
+	}
+
+	g.printf("// %s %s\n", name, lowerFirst(op.Summary))
+	urlPath := fmt.Sprintf("%q", path)
+	for _, p := range pathParams {
+		urlPath = strings.ReplaceAll(urlPath, "{"+p.Name+"}", `" + url.PathEscape(`+p.Name+`) + "`)
+		g.imports["net/url"] = true
+	}
+	urlPath = strings.TrimSuffix(urlPath, ` + ""`)
+
+	query := "nil"
+	if len(queryParams) > 0 {
+		query = "query"
+	}
+	if result != "" {
+		g.printf("func (c *Client) %s(%s) (*%s, error) {\n", name, strings.Join(args, ", "), result)
+	} else {
+		g.printf("func (c *Client) %s(%s) error {\n", name, strings.Join(args, ", "))
+	}
+	if len(queryParams) > 0 {
+		g.imports["net/url"] = true
+		g.printf("query := url.Values{}\n")
+		for _, p := range queryParams {
+			field := "params." + exported(p.Name)
+			switch goType(p.Schema) {
+			case "string":
+				g.printf("if %s != \"\" {\nquery.Set(%q, %s)\n}\n", field, p.Name, field)
+			case "int":
+				g.imports["strconv"] = true
+				g.printf("if %s != 0 {\nquery.Set(%q, strconv.Itoa(%s))\n}\n", field, p.Name, field)
+			default:
+				log.Fatalf("Unsupported query parameter type of %s", p.Name)
+			}
+		}
+	}
+	if result != "" {
+		g.printf("var out %s\n", result)
+		g.printf("if err := c.do(ctx, http.Method%s, %s, %s, %s, &out); err != nil {\nreturn nil, err\n}\n", methodName(method), urlPath, query, body)
+		g.printf("return &out, nil\n}\n\n")
+	} else {
+		g.printf("return c.do(ctx, http.Method%s, %s, %s, %s, nil)\n}\n\n", methodName(method), urlPath, query, body)
+	}
+}
+
+// jsonSchema returns the JSON body schema of c, which must be a reference
+func jsonSchema(c content, op string) schema {
+	sc, ok := c.Content["application/json"]
+	if !ok || sc.Schema.Ref == "" {
+		log.Fatalf("Body of %s is not a JSON schema reference", op)
+	}
+	return sc.Schema
+}
+
+func goType(sc schema) string {
+	if sc.Ref != "" {
+		return refName(sc.Ref)
+	}
+	switch sc.Type {
+	case "string":
+		return "string"
+	case "boolean":
+		return "bool"
+	case "integer":
+		if sc.Format == "int64" {
+			return "int64"
+		}
+		return "int"
+	case "array":
+		return "[]" + goType(*sc.Items)
+	}
+	log.Fatalf("Unsupported schema type %q", sc.Type)
+	return ""
+}
+
+func refName(ref string) string {
+	return ref[strings.LastIndex(ref, "/")+1:]
+}
+
+// initialisms are written in capitals in Go names
+var initialisms = map[string]bool{"id": true, "url": true, "api": true}
+
+// exported turns a snake_case JSON name into an exported Go name
+func exported(name string) string {
+	var b strings.Builder
+	for _, part := range strings.Split(name, "_") {
+		if initialisms[part] {
+			b.WriteString(strings.ToUpper(part))
+		} else if part != "" {
+			b.WriteString(strings.ToUpper(part[:1]) + part[1:])
+		}
+	}
+	return b.String()
+}
+
+func methodName(method string) string {
+	return method[:1] + strings.ToLower(method[1:])
+}
+
+func lowerFirst(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToLower(s[:1]) + s[1:]
+}
+
+type pair struct {
+	key   string
+	value *yaml.Node
+}
+
+// pairs returns the entries of a YAML mapping in the order they appear,
+// so the output follows the spec
+func pairs(n *yaml.Node) []pair {
+	if n.Kind != yaml.MappingNode {
+		return nil
+	}
+	out := make([]pair, 0, len(n.Content)/2)
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		out = append(out, pair{key: n.Content[i].Value, value: n.Content[i+1]})
+	}
+	return out
+}
@@ -0,0 +1,35 @@
+package adminclient
+
+import "context"
+
+// ForEachBuyer calls fn for every buyer of a product, oldest first,
+// fetching pageSize buyers per request, 0 for the server's default. It
+// stops at the first error, from the API or returned by fn.
+func (c *Client) ForEachBuyer(ctx context.Context, productID string, pageSize int, fn func(Buyer) error) error {
+	params := ListBuyersParams{Limit: pageSize}
+	for {
+		page, err := c.ListBuyers(ctx, productID, params)
+		if err != nil {
+			return err
+		}
+		for _, b := range page.Buyers {
+			if err := fn(b); err != nil {
+				return err
+			}
+		}
+		if page.NextCursor == "" {
+			return nil
+		}
+		params.Cursor = page.NextCursor
+	}
+}
+
+// AllBuyers returns every buyer of a product, oldest first
+func (c *Client) AllBuyers(ctx context.Context, productID string) ([]Buyer, error) {
+	var buyers []Buyer
+	err := c.ForEachBuyer(ctx, productID, 1000, func(b Buyer) error {
+		buyers = append(buyers, b)
+		return nil
+	})
+	return buyers, err
+}
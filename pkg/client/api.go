@@ -0,0 +1,450 @@
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"chha/pkg/protocol"
+)
+
+// Timing is the server's timestamps of a response, with when it was read
+type Timing struct {
+	protocol.Timing
+	Received time.Time
+}
+
+type purchaseRequest struct {
+	ProductID string `json:"product_id"`
+	UserID    string `json:"user_id"`
+	AuthToken string `json:"auth_token,omitempty"`
+
+	PoWChallenge string `json:"pow_challenge,omitempty"`
+	PoWSolution  string `json:"pow_solution,omitempty"`
+
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+
+	VerificationToken string `json:"verification_token,omitempty"`
+
+	// TTLSeconds is only sent with MSG_RESERVE
+	TTLSeconds int64 `json:"ttl_seconds,omitempty"`
+}
+
+// PurchaseResult is the answer to a purchase attempt. Status is one of the
+// protocol STATUS_ values; only SUCCESS and QUEUED took a unit or a place
+// in the queue.
+type PurchaseResult struct {
+	Status          string `json:"status"`
+	RemainingStock  int64  `json:"remaining_stock,omitempty"`
+	OrderID         string `json:"order_id,omitempty"`
+	PaymentDeadline int64  `json:"payment_deadline,omitempty"`
+	Error           string `json:"error,omitempty"`
+	// Provisional marks a unit granted from overdraft while Redis was
+	// degraded, which reconciliation may still cancel
+	Provisional bool `json:"provisional,omitempty"`
+	// RetryAfterMs is set with STATUS_RATE_LIMITED and STATUS_BUSY
+	RetryAfterMs int64 `json:"retry_after_ms,omitempty"`
+	// QueuePosition is set with STATUS_QUEUED, WaitlistPosition with
+	// STATUS_SOLD_OUT when the user joined the waitlist
+	QueuePosition    int64 `json:"queue_position,omitempty"`
+	WaitlistPosition int64 `json:"waitlist_position,omitempty"`
+	// Held marks a unit reserved for manual review, which cannot be paid
+	// until approved
+	Held bool `json:"held,omitempty"`
+	// Replayed marks the answer of an earlier attempt with the same
+	// idempotency key, sent again
+	Replayed bool `json:"replayed,omitempty"`
+
+	// Timing is set when timestamps were negotiated, see WithTimestamps
+	Timing *Timing `json:"-"`
+}
+
+type challengeRequest struct {
+	ProductID string `json:"product_id"`
+	UserID    string `json:"user_id"`
+}
+
+type challengeResponse struct {
+	Status     string `json:"status"`
+	Challenge  string `json:"challenge,omitempty"`
+	Difficulty int    `json:"difficulty,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// verificationTokenKey is the context key of WithVerificationToken
+type verificationTokenKey struct{}
+
+// WithVerificationToken returns a context whose purchases carry token, such
+// as the captcha response of the shopper's page, for servers that verify
+// purchases. Without one they fail with protocol.ERROR_VERIFICATION_REQUIRED.
+func WithVerificationToken(ctx context.Context, token string) context.Context {
+	return context.WithValue(ctx, verificationTokenKey{}, token)
+}
+
+// Purchase attempts to buy one unit of a product for userID, under a new
+// idempotency key. A server enforcing proof of work is sent a solved
+// challenge.
+func (c *Client) Purchase(ctx context.Context, productID, userID string) (*PurchaseResult, error) {
+	key, err := newIdempotencyKey()
+	if err != nil {
+		return nil, err
+	}
+	return c.PurchaseWithKey(ctx, productID, userID, key)
+}
+
+// PurchaseWithKey is Purchase under the caller's idempotency key, such as
+// one per click of a buy button, so the caller's own retries are also
+// answered instead of buying again. Keys are per user and at most 128
+// bytes.
+func (c *Client) PurchaseWithKey(ctx context.Context, productID, userID, key string) (*PurchaseResult, error) {
+	return c.attempt(ctx, protocol.MSG_ATTEMPT_PURCHASE, purchaseRequest{ProductID: productID, UserID: userID, IdempotencyKey: key})
+}
+
+// Reserve holds one unit for userID while an external checkout charges
+// them, for up to ttl or the server's RESERVATION_TTL if shorter; a ttl
+// of 0 holds for RESERVATION_TTL. The result's OrderID names the
+// reservation, to Commit once paid or Release if not, and PaymentDeadline
+// is when the server releases it on its own. key is the idempotency key,
+// as with PurchaseWithKey, or empty for a new one.
+func (c *Client) Reserve(ctx context.Context, productID, userID, key string, ttl time.Duration) (*PurchaseResult, error) {
+	if key == "" {
+		var err error
+		if key, err = newIdempotencyKey(); err != nil {
+			return nil, err
+		}
+	}
+	req := purchaseRequest{ProductID: productID, UserID: userID, IdempotencyKey: key, TTLSeconds: int64(ttl / time.Second)}
+	return c.attempt(ctx, protocol.MSG_RESERVE, req)
+}
+
+// attempt sends a purchase or reservation, solving a proof of work
+// challenge and waiting out an earlier attempt with the key if need be. A
+// BUSY answer is retried after its retry_after_ms, within the retry
+// policy's attempts and the deadline of ctx; past those it is returned.
+func (c *Client) attempt(ctx context.Context, msgType byte, req purchaseRequest) (*PurchaseResult, error) {
+	req.VerificationToken, _ = ctx.Value(verificationTokenKey{}).(string)
+	// A session already proved the user
+	if c.o.token != nil && c.o.session == "" {
+		token, err := c.o.token(ctx, req.UserID)
+		if err != nil {
+			return nil, fmt.Errorf("auth token: %w", err)
+		}
+		req.AuthToken = token
+	}
+
+	for attempt := 1; ; attempt++ {
+		var resp PurchaseResult
+		timing, err := c.call(ctx, msgType, keyed, req, &resp)
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case resp.Status == protocol.STATUS_ERROR && resp.Error == protocol.ERROR_POW_REQUIRED && req.PoWSolution == "":
+			var ch challengeResponse
+			if _, err := c.call(ctx, protocol.MSG_CHALLENGE, always, challengeRequest{ProductID: req.ProductID, UserID: req.UserID}, &ch); err != nil {
+				return nil, err
+			}
+			if ch.Status != protocol.STATUS_SUCCESS {
+				return nil, fmt.Errorf("challenge failed: %s", ch.Error)
+			}
+			req.PoWChallenge = ch.Challenge
+			req.PoWSolution = protocol.SolvePoW(ch.Challenge, ch.Difficulty)
+		case resp.Status == protocol.STATUS_ERROR && resp.Error == protocol.ERROR_IN_PROGRESS:
+			// An earlier attempt with the key is still being made
+			err := errors.New(protocol.ERROR_IN_PROGRESS)
+			if attempt < c.o.retry.MaxAttempts {
+				err = c.o.retry.wait(ctx, attempt)
+			}
+			if err != nil {
+				return nil, errors.Join(ErrOutcomeUnknown, err)
+			}
+		case resp.Status == protocol.STATUS_BUSY && attempt < c.o.retry.MaxAttempts:
+			// Nothing was bought, so the attempt can be made again
+			wait := time.Duration(resp.RetryAfterMs) * time.Millisecond
+			if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+				resp.Timing = timing
+				return &resp, nil
+			}
+			if err := sleep(ctx, wait); err != nil {
+				return nil, err
+			}
+		default:
+			resp.Timing = timing
+			return &resp, nil
+		}
+	}
+}
+
+// PurchaseReply is the outcome of an asynchronous purchase
+type PurchaseReply struct {
+	Result *PurchaseResult
+	Err    error
+}
+
+// PurchaseAsync starts a purchase and returns at once. Its outcome is sent
+// on the returned channel, which has room for it, so it need not be read.
+// key is the idempotency key, as with PurchaseWithKey, or empty for a new
+// one. With request_ids, many purchases in flight share each connection
+// of the pool, so a gateway can fan thousands out over a few connections.
+func (c *Client) PurchaseAsync(ctx context.Context, productID, userID, key string) <-chan PurchaseReply {
+	done := make(chan PurchaseReply, 1)
+	c.PurchaseFunc(ctx, productID, userID, key, func(res *PurchaseResult, err error) {
+		done <- PurchaseReply{Result: res, Err: err}
+	})
+	return done
+}
+
+// PurchaseFunc is PurchaseAsync calling fn with the outcome instead, on a
+// goroutine of its own
+func (c *Client) PurchaseFunc(ctx context.Context, productID, userID, key string, fn func(*PurchaseResult, error)) {
+	go func() {
+		if key == "" {
+			fn(c.Purchase(ctx, productID, userID))
+			return
+		}
+		fn(c.PurchaseWithKey(ctx, productID, userID, key))
+	}()
+}
+
+// newIdempotencyKey returns a random key
+func newIdempotencyKey() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", fmt.Errorf("idempotency key: %w", err)
+	}
+	return hex.EncodeToString(b[:]), nil
+}
+
+type cancelRequest struct {
+	ProductID string `json:"product_id"`
+	UserID    string `json:"user_id"`
+	OrderID   string `json:"order_id"`
+	AuthToken string `json:"auth_token,omitempty"`
+}
+
+// userToken is the auth token sent with a request acting as userID, empty
+// without WithTokens or on a session, which already proved the user
+func (c *Client) userToken(ctx context.Context, userID string) (string, error) {
+	if c.o.token == nil || c.o.session != "" {
+		return "", nil
+	}
+	token, err := c.o.token(ctx, userID)
+	if err != nil {
+		return "", fmt.Errorf("auth token: %w", err)
+	}
+	return token, nil
+}
+
+// Cancel cancels a purchase, returning its unit to stock. The result's
+// Status is SUCCESS, or ERROR with the reason.
+func (c *Client) Cancel(ctx context.Context, productID, userID, orderID string) (*PurchaseResult, error) {
+	token, err := c.userToken(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	var resp PurchaseResult
+	if _, err := c.call(ctx, protocol.MSG_CANCEL_PURCHASE, never, cancelRequest{ProductID: productID, UserID: userID, OrderID: orderID, AuthToken: token}, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+type confirmPaymentRequest struct {
+	OrderID   string `json:"order_id"`
+	UserID    string `json:"user_id"`
+	AuthToken string `json:"auth_token,omitempty"`
+}
+
+// PaymentResult is the answer to a payment confirmation. OrderStatus is
+// set on success, and on failure if the order expired or is held.
+type PaymentResult struct {
+	Status      string `json:"status"`
+	OrderID     string `json:"order_id,omitempty"`
+	OrderStatus string `json:"order_status,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// ConfirmPayment moves a PENDING order to CONFIRMED. Confirming twice is
+// harmless, so a lost connection is retried.
+func (c *Client) ConfirmPayment(ctx context.Context, orderID, userID string) (*PaymentResult, error) {
+	token, err := c.userToken(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	var resp PaymentResult
+	if _, err := c.call(ctx, protocol.MSG_CONFIRM_PAYMENT, always, confirmPaymentRequest{OrderID: orderID, UserID: userID, AuthToken: token}, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Commit completes a reservation once its checkout is paid. Like
+// ConfirmPayment, which it is, committing twice is harmless.
+func (c *Client) Commit(ctx context.Context, orderID, userID string) (*PaymentResult, error) {
+	token, err := c.userToken(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	var resp PaymentResult
+	if _, err := c.call(ctx, protocol.MSG_COMMIT, always, confirmPaymentRequest{OrderID: orderID, UserID: userID, AuthToken: token}, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Release gives a reservation's unit back, such as when the card was
+// declined. The result's Status is SUCCESS, or ERROR with the reason.
+func (c *Client) Release(ctx context.Context, orderID, userID string) (*PurchaseResult, error) {
+	token, err := c.userToken(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	var resp PurchaseResult
+	if _, err := c.call(ctx, protocol.MSG_RELEASE, never, confirmPaymentRequest{OrderID: orderID, UserID: userID, AuthToken: token}, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+type getStockRequest struct {
+	ProductID string `json:"product_id"`
+}
+
+type getStockResponse struct {
+	Status string `json:"status"`
+	Stock  int64  `json:"stock"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Stock returns the remaining stock of a product, read from Redis by the
+// server
+func (c *Client) Stock(ctx context.Context, productID string) (int64, error) {
+	var resp getStockResponse
+	if _, err := c.call(ctx, protocol.MSG_GET_STOCK, always, getStockRequest{ProductID: productID}, &resp); err != nil {
+		return 0, err
+	}
+	if resp.Status != protocol.STATUS_SUCCESS {
+		return 0, fmt.Errorf("get stock failed: %s", resp.Error)
+	}
+	return resp.Stock, nil
+}
+
+type listProductsRequest struct {
+	Cursor string `json:"cursor,omitempty"`
+}
+
+// Product is one entry of the server's catalog
+type Product struct {
+	ProductID string `json:"product_id"`
+	State     string `json:"state"`
+	StockHint int64  `json:"stock_hint"`
+	SaleStart int64  `json:"sale_start,omitempty"`
+	SaleEnd   int64  `json:"sale_end,omitempty"`
+}
+
+type listProductsResponse struct {
+	Status     string    `json:"status"`
+	Products   []Product `json:"products,omitempty"`
+	NextCursor string    `json:"next_cursor,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// Products fetches every page of the server's product catalog
+func (c *Client) Products(ctx context.Context) ([]Product, error) {
+	var products []Product
+	var req listProductsRequest
+	for {
+		var resp listProductsResponse
+		if _, err := c.call(ctx, protocol.MSG_LIST_PRODUCTS, always, req, &resp); err != nil {
+			return nil, err
+		}
+		if resp.Status != protocol.STATUS_SUCCESS {
+			return nil, fmt.Errorf("list products failed: %s", resp.Error)
+		}
+		products = append(products, resp.Products...)
+		if resp.NextCursor == "" {
+			return products, nil
+		}
+		req.Cursor = resp.NextCursor
+	}
+}
+
+type orderStatusRequest struct {
+	OrderID string `json:"order_id"`
+	UserID  string `json:"user_id"`
+}
+
+// OrderStatus is the state of one order, or of a queued purchase attempt
+// by its ticket ID. Status is ERROR for orders that are not the user's.
+type OrderStatus struct {
+	Status          string `json:"status"`
+	OrderID         string `json:"order_id,omitempty"`
+	ProductID       string `json:"product_id,omitempty"`
+	OrderStatus     string `json:"order_status,omitempty"`
+	CreatedAt       int64  `json:"created_at,omitempty"`
+	PaymentDeadline int64  `json:"payment_deadline,omitempty"`
+	AgentID         string `json:"agent_id,omitempty"`
+	BundleID        string `json:"bundle_id,omitempty"`
+	QueuePosition   int64  `json:"queue_position,omitempty"`
+	Error           string `json:"error,omitempty"`
+}
+
+// Order returns the status of the user's order
+func (c *Client) Order(ctx context.Context, orderID, userID string) (*OrderStatus, error) {
+	var resp OrderStatus
+	if _, err := c.call(ctx, protocol.MSG_GET_ORDER_STATUS, always, orderStatusRequest{OrderID: orderID, UserID: userID}, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+type userOrdersRequest struct {
+	UserID    string `json:"user_id"`
+	Limit     int    `json:"limit,omitempty"`
+	AuthToken string `json:"auth_token,omitempty"`
+}
+
+// UserOrder is one order of UserOrders
+type UserOrder struct {
+	OrderID         string `json:"order_id"`
+	ProductID       string `json:"product_id"`
+	OrderStatus     string `json:"order_status"`
+	Quantity        int64  `json:"quantity"`
+	CreatedAt       int64  `json:"created_at"`
+	PaymentDeadline int64  `json:"payment_deadline,omitempty"`
+	AgentID         string `json:"agent_id,omitempty"`
+	BundleID        string `json:"bundle_id,omitempty"`
+}
+
+type userOrdersResponse struct {
+	Status string      `json:"status"`
+	Orders []UserOrder `json:"orders,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+// UserOrders returns up to limit of the user's orders across all
+// products, newest first; 0 asks for the server's default. It needs the
+// user's auth token, see WithTokens, and is how a purchase whose outcome
+// is unknown can be found.
+func (c *Client) UserOrders(ctx context.Context, userID string, limit int) ([]UserOrder, error) {
+	req := userOrdersRequest{UserID: userID, Limit: limit}
+	if c.o.token != nil && c.o.session == "" {
+		token, err := c.o.token(ctx, userID)
+		if err != nil {
+			return nil, fmt.Errorf("auth token: %w", err)
+		}
+		req.AuthToken = token
+	}
+	var resp userOrdersResponse
+	if _, err := c.call(ctx, protocol.MSG_GET_USER_ORDERS, always, req, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Status != protocol.STATUS_SUCCESS {
+		return nil, fmt.Errorf("get user orders failed: %s", resp.Error)
+	}
+	return resp.Orders, nil
+}
@@ -0,0 +1,489 @@
+// Package client is a Go client for the flash sale server's TCP protocol.
+// A Client keeps a pool of negotiated connections and is safe for
+// concurrent use: every call takes an idle connection, or dials one while
+// fewer than the pool size are open. Once the pool is full, calls share
+// the connections that agreed to request_ids, and wait otherwise. A
+// connection that fails is dropped and replaced on a later call. One the
+// server announced it is closing with MSG_GOAWAY is replaced by the next
+// call that can dial a new connection, and used until its deadline while
+// none can.
+//
+// A call whose connection fails on a transient error is retried on a new
+// one, with backoff, see RetryPolicy. Reads and payment confirmations are
+// safe to repeat. Purchases carry an idempotency key, so a server that
+// agreed to idempotency_keys answers a retry with the first attempt's
+// response instead of buying again. A purchase sent without that, or a
+// cancellation, is not retried once sent: the server may have carried it
+// out, so the error matches ErrOutcomeUnknown and the caller decides, for
+// example by looking for the order with UserOrders.
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"chha/internal/auth"
+	"chha/internal/quicnet"
+)
+
+// ErrClosed is returned by calls on a closed Client
+var ErrClosed = errors.New("client closed")
+
+// ErrOutcomeUnknown is matched by the errors of purchases and
+// cancellations that the server may have carried out: the connection
+// failed after the request was sent
+var ErrOutcomeUnknown = errors.New("outcome unknown")
+
+// Client calls one flash sale server over a pool of connections
+type Client struct {
+	addr string
+	o    options
+
+	mu      sync.Mutex
+	conns   []*conn
+	dialing int
+	// open counts the connections not closed yet, in the pool or not
+	open   int
+	closed bool
+	// freed is closed, and replaced, whenever a call ends or a dial is
+	// done, waking the calls waiting for room in the pool
+	freed chan struct{}
+
+	dials   atomic.Int64
+	goAways atomic.Int64
+}
+
+type options struct {
+	poolSize       int
+	dialTimeout    time.Duration
+	requestTimeout time.Duration
+	idleTimeout    time.Duration
+	encoding       string
+	frameCRC       bool
+	timestamps     bool
+	name           string
+	token          TokenFunc
+	retry          RetryPolicy
+	maxInFlight    int
+	tenant         string
+	tenantToken    string
+	session        string
+	// useQUIC dials streams with quic, which New sets up
+	useQUIC bool
+	quicTLS *tls.Config
+	quic    *quicnet.Dialer
+	// events and eventProducts are set for the connections of Events
+	events        bool
+	eventProducts []string
+}
+
+// TokenFunc returns the auth_token of a purchase by userID, for servers
+// with purchase authentication
+type TokenFunc func(ctx context.Context, userID string) (string, error)
+
+// Option configures a Client
+type Option func(*options)
+
+// WithPoolSize caps the connections open at once (default 8)
+func WithPoolSize(n int) Option {
+	return func(o *options) {
+		if n > 0 {
+			o.poolSize = n
+		}
+	}
+}
+
+// WithDialTimeout bounds connecting and the handshake (default 2s)
+func WithDialTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.dialTimeout = d
+	}
+}
+
+// WithRequestTimeout bounds every request unless its context ends sooner
+// (default 5s)
+func WithRequestTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.requestTimeout = d
+	}
+}
+
+// WithIdleTimeout closes connections left idle this long instead of
+// reusing them, which should be below the server's CONN_IDLE_TIMEOUT
+// (default 1m)
+func WithIdleTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.idleTimeout = d
+	}
+}
+
+// WithMaxInFlight caps the calls sharing one connection, on servers that
+// agree to request_ids (default 100, or the server's limit if lower); 1
+// keeps one call per connection
+func WithMaxInFlight(n int) Option {
+	return func(o *options) {
+		if n > 0 {
+			o.maxInFlight = n
+		}
+	}
+}
+
+// WithTenant buys from a tenant of a server hosting several, with its
+// TENANT_TOKEN
+func WithTenant(id, token string) Option {
+	return func(o *options) {
+		o.tenant = id
+		o.tenantToken = token
+	}
+}
+
+// WithMsgpack asks for msgpack payloads; servers without them are spoken
+// to in JSON
+func WithMsgpack() Option {
+	return func(o *options) {
+		o.encoding = "msgpack"
+	}
+}
+
+// WithFrameCRC asks for a CRC-32C trailer on every frame
+func WithFrameCRC() Option {
+	return func(o *options) {
+		o.frameCRC = true
+	}
+}
+
+// WithTimestamps asks the server to timestamp every response, reported
+// as the Timing of purchases
+func WithTimestamps() Option {
+	return func(o *options) {
+		o.timestamps = true
+	}
+}
+
+// WithName is the client name sent in MSG_HELLO (default
+// "flashsale-go-client")
+func WithName(name string) Option {
+	return func(o *options) {
+		o.name = name
+	}
+}
+
+// WithTokens signs purchases, order lookups, payments and cancellations
+// with the tokens fn returns
+func WithTokens(fn TokenFunc) Option {
+	return func(o *options) {
+		o.token = fn
+	}
+}
+
+// WithQUIC speaks to the server's QUIC_ADDR instead, over one QUIC
+// connection whose streams are the pool's connections, so a lost packet
+// only stalls the call it belongs to. tlsConfig verifies the server, nil
+// for the system roots. Experimental.
+func WithQUIC(tlsConfig *tls.Config) Option {
+	return func(o *options) {
+		o.useQUIC = true
+		o.quicTLS = tlsConfig
+	}
+}
+
+// WithSession binds every connection to userID with MSG_AUTH, using the
+// token of WithTokens or WithHMACSecret, for servers that require
+// authenticated sessions. Calls then act as userID only; a connection is
+// replaced once its token expires.
+func WithSession(userID string) Option {
+	return func(o *options) {
+		o.session = userID
+	}
+}
+
+// WithHMACSecret signs a short-lived token for every user with the
+// server's AUTH_HMAC_SECRET. Only tests and demos should hold the secret;
+// applications get tokens from their identity provider, see WithTokens.
+func WithHMACSecret(secret string) Option {
+	key := []byte(secret)
+	return WithTokens(func(ctx context.Context, userID string) (string, error) {
+		return auth.SignHS256(key, auth.Claims{
+			Subject:   userID,
+			ExpiresAt: time.Now().Add(time.Minute).Unix(),
+		})
+	})
+}
+
+// New returns a client of the server at addr, host:port or a unix socket
+// as unix:///path. No connection is made until the first call, or Warm.
+func New(addr string, opts ...Option) *Client {
+	o := options{
+		poolSize:       8,
+		dialTimeout:    2 * time.Second,
+		requestTimeout: 5 * time.Second,
+		idleTimeout:    time.Minute,
+		encoding:       "json",
+		name:           "flashsale-go-client",
+		retry:          DefaultRetryPolicy,
+		maxInFlight:    100,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.useQUIC {
+		o.quic = &quicnet.Dialer{Addr: addr, TLS: o.quicTLS}
+	}
+	return &Client{addr: addr, o: o, freed: make(chan struct{})}
+}
+
+// Warm opens connections until n are idle, at most the pool size, so the
+// first calls don't wait for a dial
+func (c *Client) Warm(ctx context.Context, n int) error {
+	n = min(n, c.o.poolSize)
+	var conns []*conn
+	defer func() {
+		for _, cn := range conns {
+			c.release(cn, nil)
+		}
+	}()
+	for i := 0; i < n; i++ {
+		cn, err := c.acquire(ctx)
+		if err != nil {
+			return err
+		}
+		conns = append(conns, cn)
+	}
+	return nil
+}
+
+// acquire takes a call on an idle connection, or dials one while the pool
+// has room. Once it is full, calls share the least busy connection with
+// request_ids, and wait while none has room.
+func (c *Client) acquire(ctx context.Context) (*conn, error) {
+	for {
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			return nil, ErrClosed
+		}
+		cn, old := c.pick()
+		full := len(c.conns)+c.dialing >= c.o.poolSize
+		switch {
+		case cn != nil && (cn.calls == 0 || full):
+			cn.calls++
+			c.mu.Unlock()
+			return cn, nil
+		case old != nil && !old.replacing:
+			// The server is closing old: move to a new connection, in
+			// its place
+			old.replacing = true
+			return c.dial(ctx, old)
+		case !full:
+			return c.dial(ctx, nil)
+		case old != nil && old.calls < old.streams:
+			old.calls++
+			c.mu.Unlock()
+			return old, nil
+		}
+		freed := c.freed
+		c.mu.Unlock()
+		select {
+		case <-freed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// pick returns the connection with room for a call that has the fewest,
+// and one with room that the server is closing, and closes idle ones that
+// can no longer be used; c.mu must be held
+func (c *Client) pick() (cn, old *conn) {
+	live := c.conns[:0]
+	for _, x := range c.conns {
+		usable := x.usable(c.o.idleTimeout)
+		if !usable && x.calls == 0 {
+			x.dropped = true
+			c.closeConn(x)
+			continue
+		}
+		live = append(live, x)
+		switch {
+		case !usable || x.calls >= x.streams:
+		case x.isRetired():
+			if old == nil {
+				old = x
+			}
+		case cn == nil || x.calls < cn.calls:
+			cn = x
+		}
+	}
+	clear(c.conns[len(live):])
+	c.conns = live
+	return cn, old
+}
+
+// dial opens a connection for the caller, replacing old if set. c.mu must
+// be held, and is released. If the dial fails, old is used while it has
+// room, as a draining server keeps refusing new connections.
+func (c *Client) dial(ctx context.Context, old *conn) (*conn, error) {
+	c.dialing++
+	c.mu.Unlock()
+	cn, err := dial(ctx, c.addr, &c.o)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer c.wake()
+	c.dialing--
+	if old != nil {
+		old.replacing = false
+	}
+	switch {
+	case err == nil && c.closed:
+		cn.Close()
+		return nil, ErrClosed
+	case err == nil:
+		c.dials.Add(1)
+		c.open++
+		cn.calls = 1
+		c.conns = append(c.conns, cn)
+		if old != nil {
+			c.drop(old)
+		}
+		return cn, nil
+	case old != nil && !old.dropped && old.calls < old.streams && old.usable(c.o.idleTimeout):
+		old.calls++
+		return old, nil
+	default:
+		return nil, err
+	}
+}
+
+// release ends a call on a connection. It leaves the pool after a failed
+// call, unless it has request_ids and only the call failed, and once the
+// client is closed.
+func (c *Client) release(cn *conn, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cn.calls--
+	if err != nil && !cn.framing.RequestIDs || cn.framing.RequestIDs && cn.broken() || c.closed {
+		c.drop(cn)
+	} else if cn.dropped && cn.calls == 0 {
+		c.closeConn(cn)
+	}
+	c.wake()
+}
+
+// drop takes a connection out of the pool, closing it once its last call
+// ends; c.mu must be held
+func (c *Client) drop(cn *conn) {
+	if !cn.dropped {
+		cn.dropped = true
+		if i := slices.Index(c.conns, cn); i >= 0 {
+			c.conns = slices.Delete(c.conns, i, i+1)
+		}
+	}
+	if cn.calls == 0 {
+		c.closeConn(cn)
+	}
+}
+
+// closeConn closes a connection that left the pool, and with the last
+// one of a closed client its QUIC connection; c.mu must be held
+func (c *Client) closeConn(cn *conn) {
+	if cn.isRetired() {
+		c.goAways.Add(1)
+	}
+	cn.Close()
+	c.open--
+	c.closeQUIC()
+}
+
+// closeQUIC closes the QUIC connection of a closed client once none of
+// its streams is in use; c.mu must be held
+func (c *Client) closeQUIC() {
+	if c.closed && c.open == 0 && c.o.quic != nil {
+		c.o.quic.Close()
+	}
+}
+
+// wake lets the calls waiting for room in the pool look again; c.mu must
+// be held
+func (c *Client) wake() {
+	close(c.freed)
+	c.freed = make(chan struct{})
+}
+
+// call sends one request on a pooled connection, retrying transient
+// failures while the policy allows and rs says the request may be sent
+// again
+func (c *Client) call(ctx context.Context, msgType byte, rs resend, req, resp interface{}) (*Timing, error) {
+	var written bool
+	var lastErr error
+	fail := func(err error) error {
+		if written && rs != always {
+			return errors.Join(ErrOutcomeUnknown, err)
+		}
+		return err
+	}
+	for attempt := 1; ; attempt++ {
+		cn, err := c.acquire(ctx)
+		var timing *Timing
+		if err == nil {
+			if written && rs == keyed && !cn.idempotencyKeys {
+				// A server that ignores the key would buy again
+				c.release(cn, nil)
+				return nil, fail(lastErr)
+			}
+			timing, err = cn.roundTrip(ctx, c.o.requestTimeout, msgType, req, resp)
+			c.release(cn, err)
+		}
+		if err == nil {
+			return timing, nil
+		}
+		written, lastErr = written || sent(err), err
+		if ctx.Err() != nil || attempt >= c.o.retry.MaxAttempts || !transient(err) || (written && rs == never) {
+			return nil, fail(err)
+		}
+		if werr := c.o.retry.wait(ctx, attempt); werr != nil {
+			return nil, fail(err)
+		}
+	}
+}
+
+// Stats counts the connections of a Client
+type Stats struct {
+	// Open are the connections of the pool, including those being
+	// dialled, and Idle those of them with no call
+	Open, Idle int
+	// Dials counts every connection made and GoAways those closed after
+	// the server sent MSG_GOAWAY
+	Dials, GoAways int64
+}
+
+// Stats returns the pool's connection counts
+func (c *Client) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	st := Stats{Open: len(c.conns) + c.dialing, Dials: c.dials.Load(), GoAways: c.goAways.Load()}
+	for _, cn := range c.conns {
+		if cn.calls == 0 {
+			st.Idle++
+		}
+	}
+	return st
+}
+
+// Close closes the idle connections and makes later calls fail with
+// ErrClosed; connections in use are closed when their calls return
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	for _, cn := range slices.Clone(c.conns) {
+		c.drop(cn)
+	}
+	c.closeQUIC()
+	c.wake()
+	return nil
+}
@@ -0,0 +1,464 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+
+	"chha/pkg/protocol"
+)
+
+// conn is one negotiated connection of the pool. It is used by one call
+// at a time, or by up to streams calls at once once request_ids were
+// agreed: requests are then written as they come, and a reader goroutine
+// hands each response to the call with its request ID.
+type conn struct {
+	net.Conn
+	framing  protocol.Framing
+	encoding byte
+	// hello is what the server agreed to in the handshake
+	hello protocol.HelloResponse
+	// idempotencyKeys is whether the server honours the idempotency_key
+	// of purchases, making them safe to send again
+	idempotencyKeys bool
+	// streams is how many calls may share the connection
+	streams int
+	// events is whether the server agreed to push MSG_EVENT
+	events bool
+	// sessionExpires is when the token of the connection's session
+	// expires, zero without a session or for a token that never does
+	sessionExpires time.Time
+
+	// calls, dropped and replacing belong to the Client, under its mu:
+	// the calls using the connection, whether it left the pool, and
+	// whether a replacement is being dialled
+	calls     int
+	dropped   bool
+	replacing bool
+
+	mu sync.Mutex
+	// retired is set once the server sent MSG_GOAWAY: the connection is
+	// replaced as soon as a new one can be dialled, and closed by deadline
+	retired  bool
+	deadline time.Time
+	lastUsed time.Time
+	// nextID and pending track the requests in flight with request_ids,
+	// and readErr is why the reader stopped
+	nextID  uint32
+	pending map[uint32]chan response
+	readErr error
+
+	writeMu sync.Mutex
+}
+
+// response is a frame handed to the call that sent its request, or the
+// error that ended the connection first
+type response struct {
+	frame    protocol.Frame
+	received time.Time
+	err      error
+}
+
+// errSent marks a failure after the request was written, when the server
+// may have acted on it
+type errSent struct{ err error }
+
+func (e errSent) Error() string { return e.err.Error() }
+func (e errSent) Unwrap() error { return e.err }
+
+// dial connects and negotiates the protocol. Servers that predate
+// MSG_HELLO answer with "unknown message type" and are spoken to as
+// protocol 1.0.
+func dial(ctx context.Context, addr string, o *options) (*conn, error) {
+	var nc net.Conn
+	var err error
+	if o.quic != nil {
+		dctx, cancel := context.WithTimeout(ctx, o.dialTimeout)
+		nc, err = o.quic.Dial(dctx)
+		cancel()
+	} else {
+		network := "tcp"
+		if path, ok := strings.CutPrefix(addr, "unix://"); ok {
+			network, addr = "unix", path
+		}
+		d := net.Dialer{Timeout: o.dialTimeout}
+		nc, err = d.DialContext(ctx, network, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &conn{Conn: nc, encoding: protocol.ENCODING_JSON, streams: 1}
+	if err := c.handshake(ctx, o); err != nil {
+		nc.Close()
+		return nil, fmt.Errorf("handshake failed: %w", err)
+	}
+	c.lastUsed = time.Now()
+	if c.framing.RequestIDs {
+		c.streams = o.maxInFlight
+		if limit := c.hello.MaxInFlight; limit > 0 {
+			c.streams = min(c.streams, limit)
+		}
+		c.pending = make(map[uint32]chan response)
+		go c.readLoop()
+	}
+	if o.session != "" {
+		if err := c.authenticate(ctx, o); err != nil {
+			nc.Close()
+			return nil, fmt.Errorf("authentication failed: %w", err)
+		}
+	}
+	return c, nil
+}
+
+// authenticate binds the connection to the session's user with MSG_AUTH
+func (c *conn) authenticate(ctx context.Context, o *options) error {
+	if o.token == nil {
+		return errors.New("a session needs WithTokens or WithHMACSecret")
+	}
+	token, err := o.token(ctx, o.session)
+	if err != nil {
+		return err
+	}
+	var resp protocol.AuthResponse
+	if _, err := c.roundTrip(ctx, o.dialTimeout, protocol.MSG_AUTH, protocol.AuthRequest{AuthToken: token}, &resp); err != nil {
+		return err
+	}
+	if resp.Status != protocol.STATUS_SUCCESS {
+		return errors.New(resp.Error)
+	}
+	if resp.ExpiresAt != 0 {
+		c.sessionExpires = time.Unix(resp.ExpiresAt, 0)
+	}
+	return nil
+}
+
+func (c *conn) handshake(ctx context.Context, o *options) error {
+	req := protocol.HelloRequest{
+		ProtocolVersion: protocol.PROTOCOL_VERSION,
+		ProtocolMinor:   protocol.PROTOCOL_MINOR,
+		Client:          o.name,
+		// The pool replaces a connection the server is closing, retries
+		// purchases the server can tell apart, and waits out BUSY
+		Capabilities: []string{protocol.CAP_GOAWAY, protocol.CAP_IDEMPOTENCY_KEYS, protocol.CAP_BACKPRESSURE},
+		Tenant:       o.tenant,
+		TenantToken:  o.tenantToken,
+	}
+	if o.encoding == "msgpack" {
+		req.Capabilities = append(req.Capabilities, protocol.CAP_CONTENT_ENCODING)
+		req.Encodings = []string{"msgpack"}
+	}
+	if o.frameCRC {
+		req.Capabilities = append(req.Capabilities, protocol.CAP_FRAME_CRC32)
+	}
+	if o.timestamps {
+		req.Capabilities = append(req.Capabilities, protocol.CAP_TIMESTAMPS)
+	}
+	if o.maxInFlight > 1 {
+		req.Capabilities = append(req.Capabilities, protocol.CAP_REQUEST_IDS)
+	}
+	if o.events {
+		req.Capabilities = append(req.Capabilities, protocol.CAP_EVENTS)
+		req.EventProducts = o.eventProducts
+	}
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	c.setDeadline(ctx, o.dialTimeout)
+	defer c.SetDeadline(time.Time{})
+	if err := protocol.WriteFrame(c, c.framing, protocol.Frame{Type: protocol.MSG_HELLO, Payload: payload}); err != nil {
+		return err
+	}
+	// A server in greeting mode sends MSG_SERVER_INFO on connect, before
+	// the HELLO response
+	fr, err := protocol.ReadFrame(c, c.framing)
+	if err == nil && fr.Type == protocol.MSG_SERVER_INFO {
+		fr, err = protocol.ReadFrame(c, c.framing)
+	}
+	if err != nil {
+		return err
+	}
+
+	var resp protocol.HelloResponse
+	if err := json.Unmarshal(fr.Payload, &resp); err != nil {
+		return err
+	}
+	switch {
+	case resp.Status == protocol.STATUS_SUCCESS:
+		c.hello = resp
+		c.framing.Encoding = slices.Contains(resp.Capabilities, protocol.CAP_CONTENT_ENCODING)
+		if c.framing.Encoding && o.encoding == "msgpack" && slices.Contains(resp.Encodings, "msgpack") {
+			c.encoding = protocol.ENCODING_MSGPACK
+		}
+		c.framing.RequestIDs = slices.Contains(resp.Capabilities, protocol.CAP_REQUEST_IDS)
+		c.framing.CRC = slices.Contains(resp.Capabilities, protocol.CAP_FRAME_CRC32)
+		c.framing.Timestamps = slices.Contains(resp.Capabilities, protocol.CAP_TIMESTAMPS)
+		c.idempotencyKeys = slices.Contains(resp.Capabilities, protocol.CAP_IDEMPOTENCY_KEYS)
+		c.events = slices.Contains(resp.Capabilities, protocol.CAP_EVENTS)
+	case resp.Error == "unknown message type":
+		c.hello = protocol.HelloResponse{ProtocolVersion: 1, ProtocolMinor: 0}
+	default:
+		return fmt.Errorf("%s (server supports %v)", resp.Error, resp.SupportedVersions)
+	}
+	return nil
+}
+
+// setDeadline bounds the next reads and writes by timeout, or by ctx if
+// it ends sooner
+func (c *conn) setDeadline(ctx context.Context, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	c.SetDeadline(deadline)
+}
+
+// roundTrip sends one request and decodes its response into resp. Frames
+// the server pushes on its own, like queue results, are skipped, and
+// MSG_GOAWAY retires the connection. Failures once the request is written
+// are errSent.
+func (c *conn) roundTrip(ctx context.Context, timeout time.Duration, msgType byte, req, resp interface{}) (*Timing, error) {
+	payload, err := c.marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	if c.framing.RequestIDs {
+		return c.roundTripID(ctx, timeout, msgType, payload, resp)
+	}
+	c.setDeadline(ctx, timeout)
+	defer c.SetDeadline(time.Time{})
+	c.mu.Lock()
+	c.lastUsed = time.Now()
+	c.mu.Unlock()
+
+	err = protocol.WriteFrame(c, c.framing, protocol.Frame{
+		Type:     msgType,
+		Encoding: c.encoding,
+		Timing:   protocol.Timing{ClientSent: time.Now().UnixMicro()},
+		Payload:  payload,
+	})
+	if err != nil {
+		return nil, errSent{err}
+	}
+	for {
+		fr, err := protocol.ReadFrame(c, c.framing)
+		if err != nil {
+			if ctx.Err() != nil {
+				err = ctx.Err()
+			}
+			return nil, errSent{err}
+		}
+		received := time.Now()
+		switch fr.Type {
+		case msgType:
+			return c.decode(fr, received, resp)
+		case protocol.MSG_GOAWAY:
+			if err := c.goAway(fr); err != nil {
+				return nil, errSent{err}
+			}
+		}
+	}
+}
+
+// roundTripID is roundTrip on a connection with request_ids: the request
+// is tagged with a new ID and the reader hands over its response. A call
+// that times out leaves the connection to the others, and its response is
+// dropped if it still comes.
+func (c *conn) roundTripID(ctx context.Context, timeout time.Duration, msgType byte, payload []byte, resp interface{}) (*Timing, error) {
+	done := make(chan response, 1)
+	c.mu.Lock()
+	if c.readErr != nil {
+		c.mu.Unlock()
+		return nil, c.readErr
+	}
+	c.nextID++
+	if c.nextID == 0 {
+		// 0 tags the frames the server pushes
+		c.nextID = 1
+	}
+	id := c.nextID
+	c.pending[id] = done
+	c.lastUsed = time.Now()
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+	}()
+
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	c.writeMu.Lock()
+	c.SetWriteDeadline(deadline)
+	err := protocol.WriteFrame(c, c.framing, protocol.Frame{
+		Type:      msgType,
+		Encoding:  c.encoding,
+		RequestID: id,
+		Timing:    protocol.Timing{ClientSent: time.Now().UnixMicro()},
+		Payload:   payload,
+	})
+	c.writeMu.Unlock()
+	if err != nil {
+		// Part of the frame may be written, nothing after it can be
+		c.fail(err)
+		return nil, errSent{err}
+	}
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case r := <-done:
+		if r.err != nil {
+			return nil, errSent{r.err}
+		}
+		if r.frame.Type != msgType {
+			return nil, errSent{fmt.Errorf("invalid response: message type %#x", r.frame.Type)}
+		}
+		return c.decode(r.frame, r.received, resp)
+	case <-timer.C:
+		return nil, errSent{os.ErrDeadlineExceeded}
+	case <-ctx.Done():
+		return nil, errSent{ctx.Err()}
+	}
+}
+
+// readLoop reads the frames of a connection with request_ids until it
+// fails, handing responses to their calls
+func (c *conn) readLoop() {
+	for {
+		fr, err := protocol.ReadFrame(c, c.framing)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		received := time.Now()
+		switch {
+		case fr.Type == protocol.MSG_GOAWAY:
+			if err := c.goAway(fr); err != nil {
+				c.fail(err)
+				return
+			}
+		case fr.RequestID != 0:
+			c.mu.Lock()
+			done, ok := c.pending[fr.RequestID]
+			delete(c.pending, fr.RequestID)
+			c.mu.Unlock()
+			if ok {
+				done <- response{frame: fr, received: received}
+			}
+		}
+	}
+}
+
+// fail ends a connection with request_ids, failing every call still
+// waiting on it with err
+func (c *conn) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.readErr != nil {
+		return
+	}
+	c.readErr = err
+	for id, done := range c.pending {
+		done <- response{err: err}
+		delete(c.pending, id)
+	}
+	c.Close()
+}
+
+// broken reports whether the reader of a connection with request_ids
+// stopped, so no call can use it any more
+func (c *conn) broken() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.readErr != nil
+}
+
+// goAway retires the connection by a MSG_GOAWAY frame
+func (c *conn) goAway(fr protocol.Frame) error {
+	var ga protocol.GoAway
+	if err := json.Unmarshal(fr.Payload, &ga); err != nil {
+		return fmt.Errorf("invalid GOAWAY: %w", err)
+	}
+	c.mu.Lock()
+	c.retired, c.deadline = true, time.Unix(ga.Deadline, 0)
+	c.mu.Unlock()
+	return nil
+}
+
+// isRetired reports whether the server sent MSG_GOAWAY
+func (c *conn) isRetired() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.retired
+}
+
+// decode unmarshals a response frame into resp and returns its timing
+func (c *conn) decode(fr protocol.Frame, received time.Time, resp interface{}) (*Timing, error) {
+	if err := c.unmarshal(fr.Encoding, fr.Payload, resp); err != nil {
+		return nil, errSent{fmt.Errorf("invalid response: %w", err)}
+	}
+	if !c.framing.Timestamps {
+		return nil, nil
+	}
+	return &Timing{Timing: fr.Timing, Received: received}, nil
+}
+
+func (c *conn) marshal(v interface{}) ([]byte, error) {
+	if c.encoding != protocol.ENCODING_MSGPACK {
+		return json.Marshal(v)
+	}
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	enc.UseCompactInts(true)
+	err := enc.Encode(v)
+	return buf.Bytes(), err
+}
+
+func (c *conn) unmarshal(encoding byte, data []byte, v interface{}) error {
+	if encoding != protocol.ENCODING_MSGPACK {
+		return json.Unmarshal(data, v)
+	}
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	return dec.Decode(v)
+}
+
+// usable reports whether a connection may still take calls: it was idle
+// no longer than idleTimeout, has not failed, its session has not
+// expired, and the server is not about to close it
+func (c *conn) usable(idleTimeout time.Duration) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.readErr != nil {
+		return false
+	}
+	now := time.Now()
+	if idleTimeout > 0 && now.Sub(c.lastUsed) > idleTimeout {
+		return false
+	}
+	if !c.sessionExpires.IsZero() && !now.Before(c.sessionExpires) {
+		return false
+	}
+	return !c.retired || now.Before(c.deadline)
+}
+
+// sent reports whether err happened after the request was written
+func sent(err error) bool {
+	var e errSent
+	return errors.As(err, &e)
+}
@@ -0,0 +1,105 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"chha/pkg/protocol"
+)
+
+// ErrNoEvents is returned by Events when the server does not push events
+var ErrNoEvents = errors.New("server does not push events")
+
+// Events follows the stock changes and sale states of productIDs, or of
+// every product without any, on a connection of its own outside the
+// pool. Events arrive on the returned channel, which is closed once ctx
+// ends. A lost connection is made again with the retry policy's backoff,
+// for as long as ctx lasts. Events sent meanwhile are missed, so callers
+// that must not miss a change should read the stock again after a gap.
+func (c *Client) Events(ctx context.Context, productIDs ...string) (<-chan protocol.Event, error) {
+	o := c.o
+	o.maxInFlight = 1
+	o.events = true
+	o.eventProducts = productIDs
+	cn, err := dialEvents(ctx, c.addr, &o)
+	if err != nil {
+		return nil, err
+	}
+	out := make(chan protocol.Event, 64)
+	go c.followEvents(ctx, &o, cn, out)
+	return out, nil
+}
+
+// dialEvents dials a connection the server pushes events on
+func dialEvents(ctx context.Context, addr string, o *options) (*conn, error) {
+	cn, err := dial(ctx, addr, o)
+	if err != nil {
+		return nil, err
+	}
+	if !cn.events {
+		cn.Close()
+		return nil, ErrNoEvents
+	}
+	return cn, nil
+}
+
+// followEvents reads events until ctx ends, moving to a new connection
+// when the server sends MSG_GOAWAY or the connection fails
+func (c *Client) followEvents(ctx context.Context, o *options, cn *conn, out chan<- protocol.Event) {
+	defer close(out)
+	for {
+		err := cn.readEvents(ctx, out)
+		if ctx.Err() != nil {
+			cn.Close()
+			return
+		}
+		if err == nil {
+			// MSG_GOAWAY: move now if a new connection can be made, or
+			// stay until the server closes this one
+			if next, err := dialEvents(ctx, c.addr, o); err == nil {
+				cn.Close()
+				cn = next
+			}
+			continue
+		}
+		cn.Close()
+		for attempt := 1; ; attempt++ {
+			if c.o.retry.wait(ctx, attempt) != nil {
+				return
+			}
+			if cn, err = dialEvents(ctx, c.addr, o); err == nil {
+				break
+			}
+		}
+	}
+}
+
+// readEvents sends the events read from the connection to out until it
+// fails or ctx ends, or returns nil on MSG_GOAWAY
+func (c *conn) readEvents(ctx context.Context, out chan<- protocol.Event) error {
+	stop := context.AfterFunc(ctx, func() { c.SetReadDeadline(time.Now()) })
+	defer stop()
+	for {
+		fr, err := protocol.ReadFrame(c, c.framing)
+		if err != nil {
+			return err
+		}
+		switch fr.Type {
+		case protocol.MSG_EVENT:
+			var ev protocol.Event
+			if err := json.Unmarshal(fr.Payload, &ev); err != nil {
+				return fmt.Errorf("invalid event: %w", err)
+			}
+			select {
+			case out <- ev:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		case protocol.MSG_GOAWAY:
+			return c.goAway(fr)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"syscall"
+	"time"
+)
+
+// RetryPolicy retries calls that failed on a transient error: the
+// connection was refused, reset or closed, or timed out. Each retry waits
+// exponentially longer, up to MaxBackoff, less a random part of the wait
+// so clients that failed together don't retry together.
+type RetryPolicy struct {
+	// MaxAttempts counts the first try; 1 disables retries
+	MaxAttempts int
+	// InitialBackoff is the wait before the first retry, doubled for every
+	// one after
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// Jitter is the fraction of each wait that is random, from 0 to 1
+	Jitter float64
+}
+
+// DefaultRetryPolicy is the policy of a Client without WithRetry
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    3,
+	InitialBackoff: 50 * time.Millisecond,
+	MaxBackoff:     time.Second,
+	Jitter:         0.5,
+}
+
+// WithRetry sets the retry policy of every call
+func WithRetry(p RetryPolicy) Option {
+	return func(o *options) {
+		o.retry = p
+	}
+}
+
+// backoff returns the wait before retry n, 1 being the first
+func (p RetryPolicy) backoff(n int) time.Duration {
+	d := p.MaxBackoff
+	if shift := n - 1; shift < 32 && p.InitialBackoff<<shift < p.MaxBackoff {
+		d = p.InitialBackoff << shift
+	}
+	if j := min(max(p.Jitter, 0), 1); j > 0 {
+		d -= time.Duration(rand.Float64() * j * float64(d))
+	}
+	return d
+}
+
+// wait sleeps for the backoff of retry n, or until ctx ends
+func (p RetryPolicy) wait(ctx context.Context, n int) error {
+	return sleep(ctx, p.backoff(n))
+}
+
+// sleep waits for d, or until ctx ends
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// transient reports whether err is a connection failure that a new
+// connection may not have
+func transient(err error) bool {
+	var ne net.Error
+	return errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, net.ErrClosed) ||
+		(errors.As(err, &ne) && ne.Timeout())
+}
+
+// resend says when a request that was written may be sent again
+type resend int
+
+const (
+	// never: the server may have acted on it, so the outcome is unknown
+	never resend = iota
+	// always: repeating it changes nothing
+	always
+	// keyed: it carries an idempotency key, which the connection it is
+	// sent on again must have negotiated
+	keyed
+)
@@ -0,0 +1,175 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"time"
+)
+
+// ErrChecksum is returned by ReadFrame when a frame's CRC trailer does not
+// match its contents. The stream cannot be trusted after it.
+var ErrChecksum = errors.New("frame checksum mismatch")
+
+// Framing is the frame format negotiated for a connection. The zero value
+// is the protocol 1.0 format.
+type Framing struct {
+	// Encoding adds the ENCODING byte (CAP_CONTENT_ENCODING)
+	Encoding bool
+	// RequestIDs adds the REQUEST_ID (CAP_REQUEST_IDS)
+	RequestIDs bool
+	// CRC adds the CRC trailer (CAP_FRAME_CRC32)
+	CRC bool
+	// Timestamps adds the TIMESTAMPS block (CAP_TIMESTAMPS)
+	Timestamps bool
+}
+
+// Frame is one message on the wire. Encoding is ENCODING_JSON unless the
+// framing carries an encoding byte; RequestID and Timing are zero unless
+// it carries them.
+type Frame struct {
+	Type      byte
+	Encoding  byte
+	RequestID uint32
+	Timing    Timing
+	Payload   []byte
+}
+
+// Timing is the TIMESTAMPS block: three Unix times in microseconds,
+// big-endian. A client sets ClientSent on its requests. The server echoes
+// it in the response, with when it read the request and when it wrote the
+// response; frames the server pushes only carry ServerSent.
+type Timing struct {
+	ClientSent     int64
+	ServerReceived int64
+	ServerSent     int64
+}
+
+const (
+	requestIDLen  = 4
+	timestampsLen = 24
+)
+
+// ServerTime is how long the server spent on the request
+func (t Timing) ServerTime() time.Duration {
+	return time.Duration(t.ServerSent-t.ServerReceived) * time.Microsecond
+}
+
+// NetworkTime is the round trip spent outside the server, for a response
+// the client read at received
+func (t Timing) NetworkTime(received time.Time) time.Duration {
+	return time.Duration(received.UnixMicro()-t.ClientSent)*time.Microsecond - t.ServerTime()
+}
+
+// ClockOffset estimates how far the server clock is ahead of the client
+// clock, assuming the network takes as long each way
+func (t Timing) ClockOffset(received time.Time) time.Duration {
+	up := t.ServerReceived - t.ClientSent
+	down := t.ServerSent - received.UnixMicro()
+	return time.Duration((up+down)/2) * time.Microsecond
+}
+
+// OneWay returns the request and response transit times as read from
+// the two clocks. They only hold when the clocks are synchronized, by NTP
+// for example: correcting them by ClockOffset would split the round trip
+// evenly by construction.
+func (t Timing) OneWay(received time.Time) (up, down time.Duration) {
+	up = time.Duration(t.ServerReceived-t.ClientSent) * time.Microsecond
+	down = time.Duration(received.UnixMicro()-t.ServerSent) * time.Microsecond
+	return up, down
+}
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// ReadFrame reads one frame, rejecting payloads over MAX_FRAME_SIZE
+func ReadFrame(r io.Reader, f Framing) (Frame, error) {
+	// TYPE (1 byte), then ENCODING (1 byte) if negotiated, then LENGTH
+	// (4 bytes, big-endian), then REQUEST_ID (4 bytes, big-endian) and
+	// TIMESTAMPS (24 bytes) if negotiated
+	lengthEnd := 5
+	if f.Encoding {
+		lengthEnd = 6
+	}
+	headerLen := lengthEnd
+	if f.RequestIDs {
+		headerLen += requestIDLen
+	}
+	tsStart := headerLen
+	if f.Timestamps {
+		headerLen += timestampsLen
+	}
+	header := make([]byte, headerLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return Frame{}, err
+	}
+
+	fr := Frame{Type: header[0], Encoding: ENCODING_JSON}
+	if f.Encoding {
+		fr.Encoding = header[1]
+	}
+	length := binary.BigEndian.Uint32(header[lengthEnd-4 : lengthEnd])
+	if length > MAX_FRAME_SIZE {
+		return Frame{}, fmt.Errorf("payload too large: %d", length)
+	}
+	if f.RequestIDs {
+		fr.RequestID = binary.BigEndian.Uint32(header[lengthEnd:])
+	}
+	if f.Timestamps {
+		ts := header[tsStart:]
+		fr.Timing = Timing{
+			ClientSent:     int64(binary.BigEndian.Uint64(ts[0:])),
+			ServerReceived: int64(binary.BigEndian.Uint64(ts[8:])),
+			ServerSent:     int64(binary.BigEndian.Uint64(ts[16:])),
+		}
+	}
+
+	// PAYLOAD, then CRC (4 bytes, big-endian) if negotiated
+	bodyLen := int(length)
+	if f.CRC {
+		bodyLen += 4
+	}
+	body := make([]byte, bodyLen)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return Frame{}, err
+	}
+	fr.Payload = body[:length]
+
+	if f.CRC {
+		crc := crc32.Update(crc32.Checksum(header, crc32c), crc32c, fr.Payload)
+		if binary.BigEndian.Uint32(body[length:]) != crc {
+			return Frame{}, ErrChecksum
+		}
+	}
+	return fr, nil
+}
+
+// WriteFrame writes one frame with a single Write call
+func WriteFrame(w io.Writer, f Framing, fr Frame) error {
+	if len(fr.Payload) > MAX_FRAME_SIZE {
+		return fmt.Errorf("payload too large: %d", len(fr.Payload))
+	}
+
+	buf := make([]byte, 0, 6+requestIDLen+timestampsLen+len(fr.Payload)+4)
+	buf = append(buf, fr.Type)
+	if f.Encoding {
+		buf = append(buf, fr.Encoding)
+	}
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(fr.Payload)))
+	if f.RequestIDs {
+		buf = binary.BigEndian.AppendUint32(buf, fr.RequestID)
+	}
+	if f.Timestamps {
+		buf = binary.BigEndian.AppendUint64(buf, uint64(fr.Timing.ClientSent))
+		buf = binary.BigEndian.AppendUint64(buf, uint64(fr.Timing.ServerReceived))
+		buf = binary.BigEndian.AppendUint64(buf, uint64(fr.Timing.ServerSent))
+	}
+	buf = append(buf, fr.Payload...)
+	if f.CRC {
+		buf = binary.BigEndian.AppendUint32(buf, crc32.Checksum(buf, crc32c))
+	}
+
+	_, err := w.Write(buf)
+	return err
+}
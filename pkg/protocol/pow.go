@@ -0,0 +1,39 @@
+package protocol
+
+import (
+	"crypto/sha256"
+	"math/bits"
+	"strconv"
+)
+
+// PoWValid reports whether solution solves challenge: SHA-256 of
+// "<challenge>:<solution>" must start with at least difficulty zero bits
+func PoWValid(challenge, solution string, difficulty int) bool {
+	sum := sha256.Sum256([]byte(challenge + ":" + solution))
+	return leadingZeroBits(sum[:]) >= difficulty
+}
+
+// SolvePoW finds a solution by trying decimal counters in order. It takes
+// about 2^difficulty hashes.
+func SolvePoW(challenge string, difficulty int) string {
+	prefix := []byte(challenge + ":")
+	buf := make([]byte, 0, len(prefix)+20)
+	for n := uint64(0); ; n++ {
+		buf = strconv.AppendUint(append(buf[:0], prefix...), n, 10)
+		sum := sha256.Sum256(buf)
+		if leadingZeroBits(sum[:]) >= difficulty {
+			return strconv.FormatUint(n, 10)
+		}
+	}
+}
+
+func leadingZeroBits(b []byte) int {
+	n := 0
+	for _, x := range b {
+		if x != 0 {
+			return n + bits.LeadingZeros8(x)
+		}
+		n += 8
+	}
+	return n
+}
@@ -0,0 +1,261 @@
+// Package protocol is the flash sale wire protocol shared by the server,
+// the client and tools: message types, statuses, the HELLO handshake and
+// TLV framing.
+//
+// A frame is
+//
+//	TYPE (1) [ENCODING (1)] LENGTH (4, big-endian) [REQUEST_ID (4)] [TIMESTAMPS (24)] PAYLOAD [CRC (4)]
+//
+// where ENCODING, REQUEST_ID, TIMESTAMPS and CRC are only present once
+// negotiated with MSG_HELLO.
+package protocol
+
+const (
+	// PROTOCOL_VERSION is bumped on incompatible frame or payload changes
+	PROTOCOL_VERSION = 1
+	// PROTOCOL_MINOR is bumped on backwards compatible additions. Peers with
+	// the same PROTOCOL_VERSION speak the lower of their minors.
+	PROTOCOL_MINOR = 1
+
+	// MAX_FRAME_SIZE caps the payload length of a single frame
+	MAX_FRAME_SIZE = 1024 * 1024
+)
+
+// Message types
+const (
+	MSG_ATTEMPT_PURCHASE byte = 0x01
+	MSG_LIST_PRODUCTS    byte = 0x02
+	MSG_SERVER_INFO      byte = 0x03
+	MSG_CONFIRM_PAYMENT  byte = 0x04
+	MSG_CANCEL_PURCHASE  byte = 0x05
+	MSG_GET_STOCK        byte = 0x06
+	MSG_GET_ORDER_STATUS byte = 0x07
+	MSG_ADMIN_OP         byte = 0x08
+	MSG_OP_PROGRESS      byte = 0x09
+	MSG_CANCEL_OP        byte = 0x0A
+	MSG_HELLO            byte = 0x0B
+	MSG_CHALLENGE        byte = 0x0C
+	MSG_GET_USER_ORDERS  byte = 0x0D
+	MSG_QUEUE_RESULT     byte = 0x0E
+	MSG_PURCHASE_BUNDLE  byte = 0x0F
+	MSG_GOAWAY           byte = 0x10
+	MSG_EVENT            byte = 0x11
+	MSG_RESERVE          byte = 0x12
+	MSG_COMMIT           byte = 0x13
+	MSG_RELEASE          byte = 0x14
+	MSG_AUTH             byte = 0x15
+)
+
+// MessageNames are the display names of the message types
+var MessageNames = map[byte]string{
+	MSG_ATTEMPT_PURCHASE: "ATTEMPT_PURCHASE",
+	MSG_LIST_PRODUCTS:    "LIST_PRODUCTS",
+	MSG_SERVER_INFO:      "SERVER_INFO",
+	MSG_CONFIRM_PAYMENT:  "CONFIRM_PAYMENT",
+	MSG_CANCEL_PURCHASE:  "CANCEL_PURCHASE",
+	MSG_GET_STOCK:        "GET_STOCK",
+	MSG_GET_ORDER_STATUS: "GET_ORDER_STATUS",
+	MSG_ADMIN_OP:         "ADMIN_OP",
+	MSG_OP_PROGRESS:      "OP_PROGRESS",
+	MSG_CANCEL_OP:        "CANCEL_OP",
+	MSG_HELLO:            "HELLO",
+	MSG_CHALLENGE:        "CHALLENGE",
+	MSG_GET_USER_ORDERS:  "GET_USER_ORDERS",
+	MSG_QUEUE_RESULT:     "QUEUE_RESULT",
+	MSG_PURCHASE_BUNDLE:  "PURCHASE_BUNDLE",
+	MSG_GOAWAY:           "GOAWAY",
+	MSG_EVENT:            "EVENT",
+	MSG_RESERVE:          "RESERVE",
+	MSG_COMMIT:           "COMMIT",
+	MSG_RELEASE:          "RELEASE",
+	MSG_AUTH:             "AUTH",
+}
+
+// Response statuses
+const (
+	STATUS_SUCCESS  = "SUCCESS"
+	STATUS_SOLD_OUT = "SOLD_OUT"
+	STATUS_ERROR    = "ERROR"
+	// STATUS_RATE_LIMITED rejects a purchase attempt because the user made
+	// too many recently; retry_after_ms says when to try again
+	STATUS_RATE_LIMITED = "RATE_LIMITED"
+	// STATUS_QUEUED answers a purchase attempt on a queue mode product: it
+	// waits at queue_position, and order_id is the order it creates if
+	// stock is left by its turn
+	STATUS_QUEUED = "QUEUED"
+	// STATUS_READ_ONLY rejects a purchase, bundle, payment confirmation or
+	// cancellation while the server is read only; queries still work
+	STATUS_READ_ONLY = "READ_ONLY"
+	// STATUS_PAUSED rejects a purchase or bundle of a product whose sale an
+	// operator paused; retry once it resumes
+	STATUS_PAUSED = "PAUSED"
+	// STATUS_LIMIT_REACHED rejects a purchase or bundle of a user who
+	// already holds as many units of a product as its per-user limit
+	// allows
+	STATUS_LIMIT_REACHED = "LIMIT_REACHED"
+	// STATUS_NOT_ON_SALE rejects a purchase or bundle of a product before
+	// its sale window opens
+	STATUS_NOT_ON_SALE = "NOT_ON_SALE"
+	// STATUS_ENDED rejects a purchase or bundle of a product from its sale
+	// end on; the sale is over, so there is no point retrying
+	STATUS_ENDED = "ENDED"
+	// STATUS_NOT_ELIGIBLE rejects a purchase or bundle of a user who is
+	// not on a product's allowlist before its sale opens to everyone
+	STATUS_NOT_ELIGIBLE = "NOT_ELIGIBLE"
+	// STATUS_BLOCKED rejects a purchase or bundle of a user or agent an
+	// operator blocked
+	STATUS_BLOCKED = "BLOCKED"
+	// STATUS_BUSY rejects a purchase, bundle or reservation the server had
+	// no capacity for, because it is shedding load or Redis is failing;
+	// nothing was bought, and retry_after_ms says when to try again. Only
+	// connections that negotiated CAP_BACKPRESSURE get it.
+	STATUS_BUSY = "BUSY"
+)
+
+// ERROR_POW_REQUIRED is the error of a purchase sent without a solved
+// MSG_CHALLENGE while proof of work is enforced
+const ERROR_POW_REQUIRED = "proof of work required"
+
+// ERROR_VERIFICATION_REQUIRED is the error of a purchase sent without the
+// verification_token, such as a captcha response, the server checks
+const ERROR_VERIFICATION_REQUIRED = "verification required"
+
+// ERROR_IN_PROGRESS is the error of a purchase repeating the idempotency
+// key of one still being made; retry later for its outcome
+const ERROR_IN_PROGRESS = "purchase in progress"
+
+// Payload encodings, carried in the frame header once CAP_CONTENT_ENCODING
+// has been negotiated
+const (
+	ENCODING_JSON    byte = 0x00
+	ENCODING_MSGPACK byte = 0x01
+)
+
+// Capabilities a client can ask for in MSG_HELLO
+const (
+	// CAP_CONTENT_ENCODING adds an ENCODING byte after TYPE in every frame
+	CAP_CONTENT_ENCODING = "content_encoding"
+	// CAP_FRAME_CRC32 adds a CRC-32C trailer to every frame
+	CAP_FRAME_CRC32 = "frame_crc32"
+	// CAP_QUEUE_RESULTS lets the server push MSG_QUEUE_RESULT frames for
+	// purchases queued on the connection
+	CAP_QUEUE_RESULTS = "queue_results"
+	// CAP_TIMESTAMPS adds a TIMESTAMPS block after LENGTH in every frame,
+	// see Timing
+	CAP_TIMESTAMPS = "timestamps"
+	// CAP_GOAWAY lets the server push a MSG_GOAWAY frame before it closes
+	// the connection
+	CAP_GOAWAY = "goaway"
+	// CAP_IDEMPOTENCY_KEYS is agreed when the server honours the
+	// idempotency_key of purchases, so they are safe to retry
+	CAP_IDEMPOTENCY_KEYS = "idempotency_keys"
+	// CAP_REQUEST_IDS adds a REQUEST_ID after LENGTH in every frame. The
+	// server then handles a connection's requests concurrently, up to
+	// HelloResponse.MaxInFlight, and answers each in the order they finish,
+	// tagged with the ID of its request. Frames it pushes carry ID 0.
+	CAP_REQUEST_IDS = "request_ids"
+	// CAP_EVENTS lets the server push MSG_EVENT frames as the stock or
+	// sale state of products changes
+	CAP_EVENTS = "events"
+	// CAP_BACKPRESSURE has the server answer STATUS_BUSY to attempts it
+	// has no capacity for, where it would otherwise answer RATE_LIMITED
+	// or ERROR
+	CAP_BACKPRESSURE = "backpressure"
+)
+
+// GOAWAY reasons
+const (
+	// GOAWAY_DRAINING is sent when an operator drains the server, as before
+	// a rolling restart
+	GOAWAY_DRAINING = "draining"
+	// GOAWAY_SHUTDOWN is sent when the server is stopping
+	GOAWAY_SHUTDOWN = "shutdown"
+)
+
+// GoAway is the payload of MSG_GOAWAY, always JSON. The server answers
+// requests already sent, and keeps serving new ones until Deadline, when
+// it closes the connection. Clients should open a connection to another
+// server and move over as soon as they can, ideally once their requests
+// in flight are answered.
+type GoAway struct {
+	Reason string `json:"reason"`
+	// Deadline is when the server closes the connection, in Unix seconds
+	Deadline int64 `json:"deadline"`
+}
+
+// Event types
+const (
+	// EVENT_STOCK is sent when units of a product are sold or go back on
+	// sale
+	EVENT_STOCK = "stock"
+	// EVENT_SALE_STATE is sent when a product's sale starts, ends, sells
+	// out, or is paused or resumed
+	EVENT_SALE_STATE = "sale_state"
+)
+
+// Event is the payload of MSG_EVENT, always JSON. Stock is the stock left,
+// which with EVENT_SALE_STATE may lag by the server's catalog cache TTL.
+// State is set with EVENT_SALE_STATE: ACTIVE, SOLD_OUT, SCHEDULED, ENDED
+// or PAUSED, as in MSG_LIST_PRODUCTS.
+type Event struct {
+	Type      string `json:"type"`
+	ProductID string `json:"product_id"`
+	Stock     int64  `json:"stock"`
+	State     string `json:"state,omitempty"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// HelloRequest opens a connection. It is optional for protocol 1.0
+// clients, which get the original frame format. HELLO frames are always
+// JSON.
+type HelloRequest struct {
+	ProtocolVersion int      `json:"protocol_version"`
+	ProtocolMinor   int      `json:"protocol_minor"`
+	Client          string   `json:"client,omitempty"`
+	Capabilities    []string `json:"capabilities,omitempty"`
+	// Encodings the client can send and receive with content_encoding
+	Encodings []string `json:"encodings,omitempty"`
+	// EventProducts limits the MSG_EVENT frames of events to these
+	// products; empty for every product
+	EventProducts []string `json:"event_products,omitempty"`
+	// Tenant names the merchant the connection buys from, on a server
+	// hosting several, and TenantToken authenticates it; empty for the
+	// server's own products
+	Tenant      string `json:"tenant,omitempty"`
+	TenantToken string `json:"tenant_token,omitempty"`
+}
+
+// HelloResponse is the negotiated protocol. Capabilities only lists what
+// both sides support; anything else the client asked for is off.
+type HelloResponse struct {
+	Status          string   `json:"status"`
+	ProtocolVersion int      `json:"protocol_version"`
+	ProtocolMinor   int      `json:"protocol_minor"`
+	Capabilities    []string `json:"capabilities"`
+	// Encodings are the requested encodings the server also supports
+	Encodings     []string `json:"encodings,omitempty"`
+	ServerVersion string   `json:"server_version,omitempty"`
+	// MaxInFlight is how many requests the server handles at once on the
+	// connection with request_ids; it reads no more until one is answered
+	MaxInFlight int `json:"max_in_flight,omitempty"`
+	// SupportedVersions is set when the client's version was rejected
+	SupportedVersions []int  `json:"supported_versions,omitempty"`
+	Error             string `json:"error,omitempty"`
+}
+
+// AuthRequest binds a connection to the user its auth_token was issued
+// to. Later frames may leave out user_id, and any other user_id is
+// refused.
+type AuthRequest struct {
+	AuthToken string `json:"auth_token"`
+}
+
+// AuthResponse names the user a connection is bound to. ExpiresAt is when
+// its token expires, in Unix seconds, 0 for never: send MSG_AUTH again
+// with a fresh token for the same user before then.
+type AuthResponse struct {
+	Status    string `json:"status"`
+	UserID    string `json:"user_id,omitempty"`
+	ExpiresAt int64  `json:"expires_at,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
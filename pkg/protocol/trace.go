@@ -0,0 +1,36 @@
+package protocol
+
+import "strings"
+
+// TraceID returns the trace ID of a W3C traceparent header value,
+// "00-<32 hex trace ID>-<16 hex parent ID>-<2 hex flags>". ok is false
+// for a malformed value or the all-zero trace ID. Versions after 00 may
+// append fields, which are ignored.
+func TraceID(traceparent string) (id string, ok bool) {
+	parts := strings.Split(traceparent, "-")
+	if len(parts) < 4 || (parts[0] == "00" && len(parts) != 4) {
+		return "", false
+	}
+	if len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return "", false
+	}
+	for _, p := range parts[:4] {
+		if !isLowerHex(p) {
+			return "", false
+		}
+	}
+	if strings.Trim(parts[1], "0") == "" || strings.Trim(parts[2], "0") == "" {
+		return "", false
+	}
+	return parts[1], true
+}
+
+func isLowerHex(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}